@@ -0,0 +1,234 @@
+package btcagent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AdminRequest 管理命令
+//
+// 每行一个命令，支持两种格式：
+//
+//	JSON: {"id":1,"method":"reconnect","params":[0,"subaccount"],"token":"xxx"}
+//	文本: reconnect 0 subaccount
+type AdminRequest struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Token  string        `json:"token,omitempty"`
+}
+
+// AdminResponse 管理命令的执行结果
+type AdminResponse struct {
+	Result interface{}
+	Error  *StratumError
+}
+
+// NewAdminRequest 解析一行管理命令
+func NewAdminRequest(line []byte) (req *AdminRequest, err error) {
+	line = bytes.TrimSpace(line)
+	req = new(AdminRequest)
+
+	if len(line) > 0 && line[0] == '{' {
+		err = json.Unmarshal(line, req)
+	} else {
+		fields := strings.Fields(string(line))
+		if len(fields) > 0 {
+			req.Method = fields[0]
+			for _, param := range fields[1:] {
+				req.Params = append(req.Params, param)
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	req.Method = strings.ToLower(strings.TrimSpace(req.Method))
+	if len(req.Method) < 1 {
+		err = AdminErrIllegalRequest
+	}
+	return
+}
+
+// ParamString 获取字符串参数，参数不存在时返回默认值
+func (req *AdminRequest) ParamString(index int, defaultValue string) (value string, ok bool) {
+	if index >= len(req.Params) {
+		return defaultValue, true
+	}
+	switch param := req.Params[index].(type) {
+	case string:
+		return param, true
+	case float64:
+		return strconv.FormatFloat(param, 'f', -1, 64), true
+	}
+	return
+}
+
+// ParamInt 获取整数参数，参数不存在时返回默认值
+func (req *AdminRequest) ParamInt(index int, defaultValue int) (value int, ok bool) {
+	if index >= len(req.Params) {
+		return defaultValue, true
+	}
+	switch param := req.Params[index].(type) {
+	case string:
+		num, err := strconv.Atoi(param)
+		return num, err == nil
+	case float64:
+		return int(param), param == float64(int(param))
+	}
+	return
+}
+
+// ParamJSON 将参数解码到 value 中。文本格式的命令中参数应为不含空格的 JSON 字符串。
+func (req *AdminRequest) ParamJSON(index int, value interface{}) bool {
+	if index >= len(req.Params) {
+		return false
+	}
+	data, ok := req.Params[index].(string)
+	if !ok {
+		encoded, err := json.Marshal(req.Params[index])
+		if err != nil {
+			return false
+		}
+		data = string(encoded)
+	}
+	return json.Unmarshal([]byte(data), value) == nil
+}
+
+// AdminServer 管理命令服务，通过 Unix 域套接字或本地 TCP 端口接收命令
+type AdminServer struct {
+	manager  *SessionManager
+	token    string
+	listener net.Listener
+}
+
+func NewAdminServer(manager *SessionManager, token string) (server *AdminServer) {
+	server = new(AdminServer)
+	server.manager = manager
+	server.token = token
+	return
+}
+
+// Listen 开始监听。以“/”开头或者以“unix:”为前缀的地址被视为 Unix 域套接字。
+func (server *AdminServer) Listen(addr string) (err error) {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "unix:") {
+		// 只有当前用户可以访问
+		server.listener, err = ListenUnix(strings.TrimPrefix(addr, "unix:"), "0600")
+		return
+	}
+
+	server.listener, err = net.Listen("tcp", addr)
+	if err == nil && len(server.token) < 1 {
+		if tcpAddr, ok := server.listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+			Log.Warning("[admin] listening on a non-loopback address without a token: ", addr)
+		}
+	}
+	return
+}
+
+func (server *AdminServer) Run() {
+	acceptLoop(server.manager.ctx, server.listener, "admin", server.handleConn)
+}
+
+func (server *AdminServer) Stop() {
+	if server.listener != nil {
+		server.listener.Close()
+	}
+}
+
+func (server *AdminServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authorized := len(server.token) < 1
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var response JSONRPCResponse
+			result, stratumErr := server.execute(line, &response.ID, &authorized)
+			response.Result = result
+			response.Error = stratumErr.ToJSONRPCArray(nil)
+
+			bytes, e := response.ToJSONBytesLine()
+			if e == nil {
+				_, e = conn.Write(bytes)
+			}
+			if e != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkToken 以恒定时间比较 token，以免通过响应时间猜测 token
+func (server *AdminServer) checkToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) == 1
+}
+
+func (server *AdminServer) execute(line []byte, id *interface{}, authorized *bool) (result interface{}, err *StratumError) {
+	req, e := NewAdminRequest(line)
+	if e != nil {
+		err = AdminErrIllegalRequest
+		return
+	}
+	*id = req.ID
+
+	if !*authorized && len(req.Token) > 0 {
+		*authorized = server.checkToken(req.Token)
+	}
+
+	if req.Method == "auth" {
+		token, _ := req.ParamString(0, "")
+		*authorized = server.checkToken(token)
+		if !*authorized {
+			err = AdminErrUnauthorized
+			return
+		}
+		result = true
+		return
+	}
+
+	if !*authorized {
+		err = AdminErrUnauthorized
+		return
+	}
+
+	if glog.V(2) {
+		Log.Info("[admin] command: ", req.Method, " ", req.Params)
+	}
+	response := server.manager.AdminCommand(req)
+	return response.Result, response.Error
+}
+
+// AdminCommandHelp 管理命令列表
+var AdminCommandHelp = map[string]string{
+	"help":      "list available commands",
+	"auth":      "auth <token>: authenticate the connection",
+	"stats":     "show connection statistics",
+	"pools":     "list pool connections and their state",
+	"sessions":  "list pool connections and the miners on each of them",
+	"reconnect": "reconnect <slot> [sub-account][@route]: force a pool connection to reconnect, append @route for the connections of a user_agent_routes rule",
+	"kick":      "kick <session-id|ip>: disconnect the miners with the session id or from the ip",
+	"drain":     "stop accepting new miners, connected miners are kept; with shutdown_submit_grace_seconds, new shares fail until responses of submitted shares are received",
+	"undrain":   "accept new miners again",
+	"setpools":  "setpools <pools>: replace the pool list with a JSON array like pools in the config file, connections to pools still in the list are kept",
+	"verbosity": "verbosity [level] | verbosity <exmessage|jsonrpc> <level>: show or change the log verbosity level, or raise it only for pool ex-messages or JSON-RPC lines",
+	"vmodule":   "vmodule [pattern=level,...]: change the log verbosity level per source file, clear it if omitted",
+}
+
+func adminCommandTimeout() <-chan time.Time {
+	return time.After(AdminCommandTimeoutSeconds.Get())
+}
@@ -0,0 +1,264 @@
+package btcagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewAdminRequest(t *testing.T) {
+	req, err := NewAdminRequest([]byte("  Reconnect 1 alice \n"))
+	if err != nil {
+		t.Fatalf("NewAdminRequest failed: %s", err.Error())
+	}
+	if req.Method != "reconnect" || len(req.Params) != 2 {
+		t.Errorf("wrong text request: %v", req)
+	}
+	if slot, ok := req.ParamInt(0, -1); !ok || slot != 1 {
+		t.Errorf("wrong slot: %d, %v", slot, ok)
+	}
+	if subAccount, ok := req.ParamString(1, ""); !ok || subAccount != "alice" {
+		t.Errorf("wrong sub-account: %s, %v", subAccount, ok)
+	}
+	if subAccount, ok := req.ParamString(2, "default"); !ok || subAccount != "default" {
+		t.Errorf("wrong default param: %s, %v", subAccount, ok)
+	}
+
+	req, err = NewAdminRequest([]byte(`{"id":7,"method":"RECONNECT","params":[2.5,"bob"],"token":"secret"}`))
+	if err != nil {
+		t.Fatalf("NewAdminRequest failed: %s", err.Error())
+	}
+	if req.Method != "reconnect" || req.Token != "secret" || req.ID != float64(7) {
+		t.Errorf("wrong JSON request: %v", req)
+	}
+	if _, ok := req.ParamInt(0, -1); ok {
+		t.Errorf("2.5 should not be an integer")
+	}
+
+	for _, line := range []string{"", "   ", `{"id":1}`, `{"method":`} {
+		_, err = NewAdminRequest([]byte(line))
+		if err == nil {
+			t.Errorf("NewAdminRequest(%q) should fail", line)
+		}
+	}
+}
+
+type adminTestResponse struct {
+	ID     interface{}     `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  []interface{}   `json:"error"`
+}
+
+func adminTestCommand(t *testing.T, reader *bufio.Reader, conn net.Conn, line string) (response adminTestResponse) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte(line + "\n"))
+	if err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+	bytes, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read failed: %s", err.Error())
+	}
+	err = json.Unmarshal(bytes, &response)
+	if err != nil {
+		t.Fatalf("bad response %s: %s", string(bytes), err.Error())
+	}
+	return
+}
+
+func TestAdminServerCommands(t *testing.T) {
+	config := NewConfig()
+	manager := NewSessionManager(config)
+	go manager.handleEvent()
+	defer manager.SendEvent(EventExit{})
+
+	server := NewAdminServer(manager, "secret")
+	err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+	go server.Run()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err.Error())
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	response := adminTestCommand(t, reader, conn, "stats")
+	if len(response.Error) < 1 || response.Error[0] != float64(AdminErrUnauthorized.ErrNo) {
+		t.Errorf("command without token should be rejected: %v", response)
+	}
+
+	response = adminTestCommand(t, reader, conn, "auth wrong")
+	if len(response.Error) < 1 {
+		t.Errorf("wrong token should be rejected: %v", response)
+	}
+
+	response = adminTestCommand(t, reader, conn, `{"id":1,"method":"drain","params":[],"token":"secret"}`)
+	if response.ID != float64(1) || string(response.Result) != "true" || response.Error != nil {
+		t.Errorf("drain failed: %v", response)
+	}
+
+	response = adminTestCommand(t, reader, conn, "stats")
+	var stats SessionManagerStats
+	err = json.Unmarshal(response.Result, &stats)
+	if err != nil || !stats.Draining || stats.Miners != 0 {
+		t.Errorf("wrong stats: %s", string(response.Result))
+	}
+
+	response = adminTestCommand(t, reader, conn, "undrain")
+	if string(response.Result) != "true" || manager.AdminCommand(&AdminRequest{Method: "stats"}).Result.(SessionManagerStats).Draining {
+		t.Errorf("undrain failed: %v", response)
+	}
+
+	response = adminTestCommand(t, reader, conn, "no_such_command")
+	if len(response.Error) < 1 || response.Error[0] != float64(AdminErrUnknownCommand.ErrNo) {
+		t.Errorf("unknown command should be rejected: %v", response)
+	}
+
+	response = adminTestCommand(t, reader, conn, "reconnect -1")
+	if len(response.Error) < 1 || response.Error[0] != float64(AdminErrIllegalParams.ErrNo) {
+		t.Errorf("illegal params should be rejected: %v", response)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miners := make([]net.Conn, 2)
+	for i := range miners {
+		miners[i] = dialTestMinerBTC(t, manager, fmt.Sprintf("test.w%d", i+1), "mining.notify")
+		if miners[i] == nil {
+			t.FailNow()
+		}
+		defer miners[i].Close()
+	}
+
+	// 列出矿机，等待两台矿机都加入矿池连接
+	listMiners := func() (miners []DownSessionStatus) {
+		t.Helper()
+		response := manager.AdminCommand(&AdminRequest{Method: "sessions"})
+		if response.Error != nil {
+			t.Fatalf("sessions failed: %v", response.Error)
+		}
+		for _, status := range response.Result.([]UpSessionManagerStatus) {
+			for _, up := range status.UpSessions {
+				miners = append(miners, up.Miners...)
+			}
+		}
+		return
+	}
+	waitMiners := func(expected int) (miners []DownSessionStatus) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if miners = listMiners(); len(miners) == expected {
+				return
+			}
+		}
+		t.Fatalf("expected %d miners, got %v", expected, miners)
+		return
+	}
+	expectClosed := func(conn net.Conn) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(ioutil.Discard, conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("miner connection is not closed: %v", err)
+		}
+	}
+	kick := func(param interface{}) []DownSessionStatus {
+		t.Helper()
+		response := manager.AdminCommand(&AdminRequest{Method: "kick", Params: []interface{}{param}})
+		if response.Error != nil {
+			t.Fatalf("kick %v failed: %v", param, response.Error)
+		}
+		return response.Result.([]DownSessionStatus)
+	}
+
+	var first DownSessionStatus
+	for _, status := range waitMiners(2) {
+		if status.FullName == "test.w1" {
+			first = status
+		}
+	}
+
+	// 按会话 ID 断开，JSON 请求中的数字参数也可以使用
+	kicked := kick(float64(first.SessionID))
+	if len(kicked) != 1 || kicked[0].SessionID != first.SessionID || kicked[0].FullName != "test.w1" {
+		t.Errorf("wrong kicked miners: %v", kicked)
+	}
+	expectClosed(miners[0])
+	if remaining := waitMiners(1); remaining[0].FullName != "test.w2" {
+		t.Errorf("wrong remaining miners: %v", remaining)
+	}
+
+	// 不匹配的 IP 不断开任何矿机
+	if kicked := kick("10.0.0.1"); len(kicked) != 0 {
+		t.Errorf("no miner should be kicked: %v", kicked)
+	}
+
+	// 按 IP 断开
+	kicked = kick("127.0.0.1")
+	if len(kicked) != 1 || kicked[0].FullName != "test.w2" {
+		t.Errorf("wrong kicked miners: %v", kicked)
+	}
+	expectClosed(miners[1])
+	waitMiners(0)
+
+	for _, params := range [][]interface{}{nil, {"abc"}, {"65536"}, {"-1"}} {
+		response := manager.AdminCommand(&AdminRequest{Method: "kick", Params: params})
+		if response.Error != AdminErrIllegalParams {
+			t.Errorf("kick %v should be rejected: %v", params, response)
+		}
+	}
+}
+
+func TestAdminKickWaitingMiner(t *testing.T) {
+	// 矿池不响应握手，矿机在 FakeUpSession 中等待矿池连接
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		io.Copy(ioutil.Discard, reader)
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	var kicked []DownSessionStatus
+	for start := time.Now(); len(kicked) < 1 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		response := manager.AdminCommand(&AdminRequest{Method: "kick", Params: []interface{}{"127.0.0.1"}})
+		if response.Error != nil {
+			t.Fatalf("kick failed: %v", response.Error)
+		}
+		kicked = response.Result.([]DownSessionStatus)
+	}
+	if len(kicked) != 1 || kicked[0].FullName != "test.w1" {
+		t.Fatalf("waiting miner should be kicked: %v", kicked)
+	}
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(ioutil.Discard, miner)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("miner connection is not closed: %v", err)
+	}
+}
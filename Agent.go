@@ -0,0 +1,92 @@
+package btcagent
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// Agent 一个 BTCAgent 实例，可以嵌入到其他程序中运行。
+// 同一个进程中可以运行多个实例，只要它们的监听地址不冲突。
+//
+//	config := btcagent.NewConfig()
+//	err := config.LoadFromFile("agent_conf.json")
+//	if err == nil {
+//		err = config.Init()
+//	}
+//	if err == nil {
+//		err = btcagent.NewAgent(config).Run(ctx)
+//	}
+type Agent struct {
+	config  *Config
+	manager *SessionManager
+}
+
+// NewAgent 创建实例，config 必须已调用过 Init()
+func NewAgent(config *Config) (agent *Agent) {
+	agent = new(Agent)
+	agent.config = config
+	agent.manager = NewSessionManager(config)
+	return
+}
+
+// Run 启动实例并阻塞，直到 ctx 被取消或调用了 Stop()。
+// 启动失败（如端口被占用）时返回错误，正常退出时返回 nil。
+func (agent *Agent) Run(ctx context.Context) (err error) {
+	err = agent.manager.Start()
+	if err != nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			agent.Stop()
+		case <-agent.manager.ctx.Done():
+		}
+	}()
+
+	agent.manager.serve(agent.manager.tcpListener)
+	return
+}
+
+// Stop 停止实例，可以在任意 goroutine 中多次调用
+func (agent *Agent) Stop() {
+	agent.manager.Stop()
+}
+
+// Addr 获取监听矿机连接的 TCP 地址，启动前返回 nil。
+// 配置的端口为 0 时可以通过它获取系统分配的端口。
+func (agent *Agent) Addr() net.Addr {
+	return agent.manager.Addr()
+}
+
+// Metrics 获取运行指标
+func (agent *Agent) Metrics() *AgentMetrics {
+	return agent.manager.Metrics()
+}
+
+// LogLevel 获取查看或修改日志级别（/log）的 HTTP 接口，修改日志级别需要 admin.token（如果已设置）
+func (agent *Agent) LogLevel() http.Handler {
+	return NewLogLevelHandler(agent.config.Admin.Token)
+}
+
+// Liveness 获取存活检查（/healthz）的 HTTP 接口，事件循环阻塞时返回 503
+func (agent *Agent) Liveness() http.Handler {
+	return &HealthHandler{agent.manager, false}
+}
+
+// Readiness 获取就绪检查（/readyz）的 HTTP 接口，没有已认证的矿池连接时返回 503
+func (agent *Agent) Readiness() http.Handler {
+	return &HealthHandler{agent.manager, true}
+}
+
+// ReloadTLSCertificate 重新载入TLS监听使用的证书，不影响已建立的连接
+func (agent *Agent) ReloadTLSCertificate() {
+	agent.manager.ReloadTLSCertificate()
+}
+
+// AdminCommand 执行管理命令，可以在任意 goroutine 中调用
+func (agent *Agent) AdminCommand(request *AdminRequest) AdminResponse {
+	return agent.manager.AdminCommand(request)
+}
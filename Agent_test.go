@@ -0,0 +1,137 @@
+package btcagent_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btccom/btcagent"
+)
+
+func ExampleAgent() {
+	config := btcagent.NewConfig()
+	config.AgentListenIp = "127.0.0.1"
+	config.AgentListenPort = 0 // 由系统分配端口
+	config.Pools = []btcagent.PoolInfo{{Host: "127.0.0.1", Port: 1800, SubAccount: "YourSubAccountName"}}
+	err := config.Init()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	agent := btcagent.NewAgent(config)
+	go func() {
+		done <- agent.Run(ctx)
+	}()
+
+	// 取消 ctx 后 Run() 返回
+	cancel()
+	fmt.Println("agent stopped:", <-done)
+	// Output: agent stopped: <nil>
+}
+
+func TestAgentStartAndStop(t *testing.T) {
+	config := btcagent.NewConfig()
+	config.AgentListenIp = "127.0.0.1"
+	config.AgentListenPort = 0
+	if err := config.Init(); err != nil {
+		t.Fatalf("config.Init failed: %s", err.Error())
+	}
+
+	agent := btcagent.NewAgent(config)
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run(context.Background())
+	}()
+
+	// 等待开始监听
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addr = agent.Addr()
+	}
+	if addr == nil {
+		t.Fatalf("agent is not listening")
+	}
+
+	// 同一个端口上的第二个实例启动失败并返回错误，而不是退出进程
+	config2 := btcagent.NewConfig()
+	config2.AgentListenIp = "127.0.0.1"
+	config2.AgentListenPort = uint16(addr.(*net.TCPAddr).Port)
+	config2.Init()
+	if err := btcagent.NewAgent(config2).Run(context.Background()); err == nil {
+		t.Errorf("second agent on the same port should fail")
+	}
+
+	agent.Stop()
+	agent.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned an error: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent did not stop")
+	}
+
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Errorf("agent is still listening after stopped")
+	}
+}
+
+func TestConfigInitUnknownAgentType(t *testing.T) {
+	config := btcagent.NewConfig()
+	config.AgentType = "doge"
+	if err := config.Init(); err == nil {
+		t.Errorf("unknown agent type should be rejected")
+	}
+}
+
+func TestConfigInitPoolSubAccount(t *testing.T) {
+	config := btcagent.NewConfig()
+	config.Pools = []btcagent.PoolInfo{{Host: "127.0.0.1", Port: 1800, SubAccount: "pool-1"}, {Host: "127.0.0.1", Port: 1801}}
+	if err := config.Init(); err == nil {
+		t.Errorf("pool without sub-account should be rejected")
+	}
+
+	config.SubAccount = "global"
+	if err := config.Init(); err != nil {
+		t.Fatalf("config.Init failed: %s", err.Error())
+	}
+	if subAccount := config.PoolSubAccount(0); subAccount != "pool-1" {
+		t.Errorf("sub-account of the pool should be used, got %s", subAccount)
+	}
+	if subAccount := config.PoolSubAccount(1); subAccount != "global" {
+		t.Errorf("global sub-account should be used, got %s", subAccount)
+	}
+
+	// 多用户模式下使用矿机的子账户，无需配置
+	config = btcagent.NewConfig()
+	config.MultiUserMode = true
+	config.Pools = []btcagent.PoolInfo{{Host: "127.0.0.1", Port: 1800}}
+	if err := config.Init(); err != nil {
+		t.Errorf("multi user mode does not need sub-account: %s", err.Error())
+	}
+}
+
+func TestConfigInitMessageQueueOverflow(t *testing.T) {
+	config := btcagent.NewConfig()
+	config.MultiUserMode = true
+	config.Advanced.MessageQueueOverflow.MinerNotify = "Drop"
+	config.Advanced.MessageQueueOverflow.Timer = ""
+	if err := config.Init(); err != nil {
+		t.Fatalf("config.Init failed: %s", err.Error())
+	}
+	if overflow := config.Advanced.MessageQueueOverflow; overflow.MinerNotify != btcagent.EventOverflowDrop || overflow.Timer != btcagent.DefaultTimerEventOverflow {
+		t.Errorf("wrong message_queue_overflow: %v", overflow)
+	}
+
+	config.Advanced.MessageQueueOverflow.Timer = "coalesce"
+	if err := config.Init(); err == nil {
+		t.Errorf("unknown message_queue_overflow should be rejected")
+	}
+}
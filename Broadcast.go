@@ -0,0 +1,60 @@
+package btcagent
+
+import "context"
+
+// broadcastTarget 接收广播任务的矿机连接（DownSessionBTC 或 DownSessionETH）
+type broadcastTarget interface {
+	SendEvent(event interface{})
+	trySendEvent(event interface{}) bool
+}
+
+// broadcastEvents 将 events 按顺序发给所有矿机，不阻塞调用方。
+//
+// 矿机由最多 UpSessionBroadcastWorkers 个 goroutine 分段发送，而不是每台矿机一个 goroutine；
+// events 中的事件已在调用方装箱，所有矿机共享，发送时不再为每台矿机分配内存。
+// 某台矿机的事件通道已满时，它剩余的事件交给单独的 goroutine 按 SendEvent 的方式等待发送，
+// 因此一台卡住的矿机不会拖慢同一段的其他矿机。
+// ctx 结束（矿池连接断开，矿机已转移到其他矿池连接）后不再发送这里的旧任务。
+func broadcastEvents(ctx context.Context, targets []broadcastTarget, events []interface{}) {
+	if len(targets) < 1 || len(events) < 1 {
+		return
+	}
+	workers := (len(targets) + UpSessionBroadcastSessionsPerWorker - 1) / UpSessionBroadcastSessionsPerWorker
+	if workers > UpSessionBroadcastWorkers {
+		workers = UpSessionBroadcastWorkers
+	}
+	size := (len(targets) + workers - 1) / workers
+	for start := 0; start < len(targets); start += size {
+		end := start + size
+		if end > len(targets) {
+			end = len(targets)
+		}
+		go broadcastToTargets(ctx, targets[start:end], events)
+	}
+}
+
+// broadcastToTargets 依次向每台矿机发送所有事件
+func broadcastToTargets(ctx context.Context, targets []broadcastTarget, events []interface{}) {
+	for _, target := range targets {
+		for i, event := range events {
+			if ctx.Err() != nil {
+				return
+			}
+			if !target.trySendEvent(event) {
+				// 同一个 goroutine 依次发送剩余的事件，以保证顺序
+				go sendRemainingEvents(ctx, target, events[i:])
+				break
+			}
+		}
+	}
+}
+
+// sendRemainingEvents 等待发送事件通道已满的矿机剩余的事件
+func sendRemainingEvents(ctx context.Context, target broadcastTarget, events []interface{}) {
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return
+		}
+		target.SendEvent(event)
+	}
+}
@@ -0,0 +1,213 @@
+package btcagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBroadcastSessions 创建 n 个只运行事件通道的矿机连接，每收到一个事件调用一次 received.Done()
+func newTestBroadcastSessions(ctx context.Context, n int, received *sync.WaitGroup) (targets []broadcastTarget) {
+	manager := NewSessionManager(NewConfig())
+	for i := 0; i < n; i++ {
+		down := &DownSessionBTC{manager: manager, ctx: ctx, eventChannel: make(chan interface{}, DownSessionChannelCache)}
+		go func() {
+			for {
+				select {
+				case <-down.eventChannel:
+					received.Done()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		targets = append(targets, down)
+	}
+	return
+}
+
+// broadcastEventsPerSession 原来的广播方式：每台矿机一个 goroutine，每次发送都装箱一个新的事件。
+// 只用于 BenchmarkFanOut 的对比。
+func broadcastEventsPerSession(ctx context.Context, targets []broadcastTarget, contents [][]byte) {
+	for _, target := range targets {
+		go func(target broadcastTarget) {
+			for _, content := range contents {
+				if ctx.Err() != nil {
+					return
+				}
+				target.SendEvent(EventMiningNotifyBTC{content})
+			}
+		}(target)
+	}
+}
+
+// stalledBroadcastTarget 事件通道总是已满的矿机，SendEvent 阻塞到 release 关闭
+type stalledBroadcastTarget struct {
+	release chan struct{}
+	events  chan interface{}
+}
+
+func (target *stalledBroadcastTarget) SendEvent(event interface{}) {
+	<-target.release
+	target.events <- event
+}
+
+func (target *stalledBroadcastTarget) trySendEvent(event interface{}) bool {
+	return false
+}
+
+func TestBroadcastEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received sync.WaitGroup
+	targets := newTestBroadcastSessions(ctx, 3*UpSessionBroadcastSessionsPerWorker, &received)
+	stalled := &stalledBroadcastTarget{make(chan struct{}), make(chan interface{}, 2)}
+	// 卡住的矿机在第一段中间，不应影响它之后的矿机
+	targets = append(targets[:10], append([]broadcastTarget{stalled}, targets[10:]...)...)
+
+	events := []interface{}{EventMiningNotifyBTC{[]byte("1")}, EventMiningNotifyBTC{[]byte("2")}}
+	received.Add((len(targets) - 1) * len(events))
+	broadcastEvents(ctx, targets, events)
+
+	done := make(chan struct{})
+	go func() {
+		received.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled miner blocks the broadcast to other miners")
+	}
+
+	// 卡住的矿机恢复后按顺序收到所有任务
+	close(stalled.release)
+	for i, expected := range []string{"1", "2"} {
+		select {
+		case event := <-stalled.events:
+			if content := string(event.(EventMiningNotifyBTC).Content); content != expected {
+				t.Errorf("stalled miner got job %s at %d, expected %s", content, i, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stalled miner did not get job %s", expected)
+		}
+	}
+}
+
+func TestBroadcastEventsStalledDownSession(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MessageQueueSize.MinerSession = 1
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+
+	// 不收数据、事件循环也不处理事件的矿机，第一个任务之后等待发送剩余任务的 goroutine 一直阻塞
+	client, server := net.Pipe()
+	defer client.Close()
+	stalled := NewDownSessionBTC(manager, server, 1)
+
+	var received sync.WaitGroup
+	targets := newTestBroadcastSessions(manager.ctx, UpSessionBroadcastSessionsPerWorker-1, &received)
+	// 与其他矿机在同一段，并且最先发送
+	targets = append([]broadcastTarget{stalled}, targets...)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			received.Add(len(targets) - 1)
+			broadcastEvents(manager.ctx, targets, []interface{}{EventMiningNotifyBTC{[]byte(strconv.Itoa(i))}})
+			received.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled miner blocks the broadcast to other miners in its segment")
+	}
+}
+
+func TestBroadcastEventsAllocs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 分配次数与矿机数无关，只与 goroutine 数有关。原来的广播方式每台矿机分配 3 次
+	var received sync.WaitGroup
+	targets := newTestBroadcastSessions(ctx, 4096, &received)
+	events := []interface{}{EventMiningNotifyBTC{[]byte("{}\n")}}
+	allocs := testing.AllocsPerRun(10, func() {
+		received.Add(len(targets))
+		broadcastEvents(ctx, targets, events)
+		received.Wait()
+	})
+	if allocs > 4*UpSessionBroadcastWorkers {
+		t.Errorf("too many allocations to broadcast a job to %d miners: %.0f", len(targets), allocs)
+	}
+}
+
+// BenchmarkFanOut 广播一个任务（序列化、装箱并发送给 N 台矿机）直到所有矿机的事件通道都收到为止，
+// per_session 为原来每台矿机一个 goroutine 的方式
+func BenchmarkFanOut(b *testing.B) {
+	job := new(StratumJobBTC)
+	job.Params = JSONRPCArray{"bf", "00", "01", "ff", []interface{}{}, "20000000", "1d00ffff", "5f5e1000", true}
+
+	for _, n := range []int{100, 1000, 10000} {
+		for _, mode := range []string{"per_session", "workers"} {
+			b.Run(fmt.Sprintf("%s/%d", mode, n), func(b *testing.B) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				var received sync.WaitGroup
+				targets := newTestBroadcastSessions(ctx, n, &received)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					content, err := job.ToNotifyLine(false)
+					if err != nil {
+						b.Fatal(err)
+					}
+					received.Add(n)
+					if mode == "workers" {
+						broadcastEvents(ctx, targets, []interface{}{EventMiningNotifyBTC{content}})
+					} else {
+						broadcastEventsPerSession(ctx, targets, [][]byte{content})
+					}
+					received.Wait()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkUpSessionBTCBroadcastJobs 矿池连接收到一个任务后经 broadcastJobs 广播给 N 台矿机，
+// 包括创建任务、遍历矿机列表，直到所有矿机的事件通道都收到为止
+func BenchmarkUpSessionBTCBroadcastJobs(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			up := newTestUpSessionBTC()
+			up.config.Advanced.PoolWarmupSeconds = 0
+			defer up.cancel()
+			var received sync.WaitGroup
+			for i, target := range newTestBroadcastSessions(up.ctx, n, &received) {
+				up.downSessions[uint16(i)] = target.(*DownSessionBTC)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rpcData := JSONRPCLineBTC{Method: "mining.notify", Params: []interface{}{"bf", "00", "01", "ff", []interface{}{}, "20000000", "1d00ffff", "5f5e1000", true}}
+				job, err := NewStratumJobBTC(&rpcData, up.extraNonce1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				received.Add(n)
+				up.broadcastJobs([]*StratumJobBTC{job})
+				received.Wait()
+			}
+		})
+	}
+}
@@ -1,18 +1,130 @@
-package main
+package btcagent
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"gopkg.in/yaml.v3"
 )
 
 type PoolInfo struct {
 	Host       string
 	Port       uint16
 	SubAccount string
+	Options    PoolOptions
+
+	// 矿池地址中带有 stratum+ssl:// 等加密连接的前缀，由 Normalize() 设置
+	TLS bool
+	// 矿池地址中带有 stratum+tcp:// 等明文连接的前缀，由 Normalize() 设置
+	plainScheme bool
+}
+
+// Normalize 解析矿池地址的常见写法，如 host:port、stratum+tcp://host:port、stratum+ssl://host:port，
+// 将其规范化为 Host、Port 和 TLS。端口可以写在地址中，也可以单独设置，两处不一致时返回错误。
+func (r *PoolInfo) Normalize() (err error) {
+	host := strings.TrimSpace(r.Host)
+	origin := host
+
+	if pos := strings.Index(host, "://"); pos >= 0 {
+		scheme := strings.ToLower(host[:pos])
+		switch scheme {
+		case "stratum+tcp", "stratum", "tcp":
+			r.plainScheme = true
+		case "stratum+ssl", "stratum+tls", "ssl", "tls":
+			r.TLS = true
+		default:
+			return fmt.Errorf("unsupported scheme %s:// in pool address %s", scheme, origin)
+		}
+		host = strings.TrimSuffix(host[pos+3:], "/")
+		if strings.Contains(host, "/") {
+			return fmt.Errorf("path is not allowed in pool address %s", origin)
+		}
+	}
+
+	// 多于一个冒号且没有方括号的是不带端口的 IPv6 地址
+	if strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1 {
+		var portStr string
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		} else {
+			host, portStr, err = net.SplitHostPort(host)
+			if err != nil {
+				return fmt.Errorf("wrong pool address %s: %w", origin, err)
+			}
+			port, e := strconv.ParseUint(portStr, 10, 16)
+			if e != nil || port == 0 {
+				return fmt.Errorf("wrong port %s in pool address %s", portStr, origin)
+			}
+			if r.Port != 0 && r.Port != uint16(port) {
+				return fmt.Errorf("pool address %s conflicts with port %d", origin, r.Port)
+			}
+			r.Port = uint16(port)
+		}
+	}
+
+	if len(host) < 1 {
+		return fmt.Errorf("missing host in pool address %s", origin)
+	}
+	if strings.ContainsAny(host, " /[]") {
+		return fmt.Errorf("wrong host in pool address %s", origin)
+	}
+	if r.Port == 0 {
+		return fmt.Errorf("missing port of pool %s", origin)
+	}
+	r.Host = host
+	return nil
+}
+
+// Address 矿池的 host:port 地址，IPv6 地址带有方括号
+func (r *PoolInfo) Address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// PoolOptions 单个矿池的可选配置，为零值的选项使用 advanced 中的全局配置
+type PoolOptions struct {
+	// 矿池读取超时时间
+	ReadTimeoutSeconds Seconds `json:"read_timeout_seconds,omitempty"`
+	// 矿池写入超时时间
+	WriteTimeoutSeconds Seconds `json:"write_timeout_seconds,omitempty"`
+	// 连接该矿池的矿机的初始难度
+	InitialDifficulty uint64 `json:"initial_difficulty,omitempty"`
+	// 向该矿池认证时使用的密码
+	Password Password `json:"password,omitempty"`
+	// 矿池的协议变体（standard 或 nicehash），决定如何解析矿池下发的难度
+	ProtocolVariant string `json:"protocol_variant,omitempty"`
+	// 不向该矿池发送 agent.get_capabilities，不使用 ex-message，以普通 stratum 协议代理矿机
+	SkipCapabilities bool `json:"skip_capabilities,omitempty"`
+	// 将该矿池下发的 mining.set_goal（切换算法或合并挖矿的目标）转发给支持它的矿机
+	ForwardSetGoal bool `json:"forward_set_goal,omitempty"`
+	// 向该矿池发送的请求使用数字 id，用于不接受字符串 id 的矿池
+	NumericRequestID bool `json:"numeric_request_id,omitempty"`
+	// 发给该矿池的矿工名中子账户名与矿机名之间的分隔符，默认为“.”
+	WorkerNameSeparator string `json:"worker_name_separator,omitempty"`
+	// 发给该矿池的矿工名的格式，{sub_account}、{separator}、{worker} 分别替换为子账户名、分隔符和矿机名
+	WorkerNameFormat string `json:"worker_name_format,omitempty"`
+	// 该矿池接受的矿工名的最大长度，超过时截断矿机名部分，0 表示不限制
+	MaxWorkerNameLength uint `json:"max_worker_name_length,omitempty"`
+	// 发给连接该矿池的矿机的难度是矿池难度的倍数，只把满足矿池难度的 share 提交给矿池，0 或 1 表示不调整（仅限 BTC，需要 report_difficulty）
+	DifficultyMultiplier uint64 `json:"difficulty_multiplier,omitempty"`
+	// 矿机的难度与矿池设置的不同时（如被 difficulty_clamp 调整），通过 CMD_MINING_SET_DIFF 告诉该矿池矿机的实际难度（仅限 BTC）
+	ReportDifficulty bool `json:"report_difficulty,omitempty"`
+	// 重连该矿池时在 mining.subscribe 中提供上次的会话ID（extranonce1），请求恢复之前的会话（仅限 BTC）
+	ResumeSession bool `json:"resume_session,omitempty"`
+	// 该矿池的订阅结果中没有会话ID时的处理方式（failover 或 zero），默认为 failover
+	MissingSessionID string `json:"missing_session_id,omitempty"`
+	// 该矿池的优先级（如费率、地区偏好），越大越优先，只在 advanced.pool_selection.priority_weight 不为 0 时使用
+	Priority int `json:"priority,omitempty"`
+	// 该矿池不支持 ex-message 协议，只以透传模式连接，在其他矿池都不可用时使用
+	Passthrough bool `json:"passthrough,omitempty"`
 }
 
 func (r *PoolInfo) UnmarshalJSON(p []byte) error {
@@ -35,11 +147,23 @@ func (r *PoolInfo) UnmarshalJSON(p []byte) error {
 			return err
 		}
 	}
+	if len(tmp) > 3 {
+		if err := json.Unmarshal(tmp[3], &r.Options); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (r *PoolInfo) MarshalJSON() ([]byte, error) {
-	return json.Marshal([]interface{}{r.Host, r.Port, r.SubAccount})
+	host := r.Host
+	if r.TLS {
+		host = "stratum+ssl://" + host
+	}
+	if r.Options == (PoolOptions{}) {
+		return json.Marshal([]interface{}{host, r.Port, r.SubAccount})
+	}
+	return json.Marshal([]interface{}{host, r.Port, r.SubAccount, r.Options})
 }
 
 type Seconds uint32
@@ -48,38 +172,210 @@ func (s Seconds) Get() time.Duration {
 	return time.Duration(s) * time.Second
 }
 
+// Password 密码，打印时隐藏其内容，以免泄露到日志中。
+// 输出为 JSON 时保留原值，以便重新载入；打印配置时使用 Config.Masked()
+type Password string
+
+func (p Password) String() string {
+	if len(p) > 0 {
+		return "******"
+	}
+	return ""
+}
+
 type Config struct {
 	MultiUserMode               bool       `json:"multi_user_mode"`
 	AgentType                   string     `json:"agent_type"`
 	AlwaysKeepDownconn          bool       `json:"always_keep_downconn"`
 	DisconnectWhenLostAsicboost bool       `json:"disconnect_when_lost_asicboost"`
+	PoolWithoutAsicboost        string     `json:"pool_without_asicboost"`
 	UseIpAsWorkerName           bool       `json:"use_ip_as_worker_name"`
 	IpWorkerNameFormat          string     `json:"ip_worker_name_format"`
 	FixedWorkerName             string     `json:"fixed_worker_name"`
 	SubmitResponseFromServer    bool       `json:"submit_response_from_server"`
+	PoolWithoutSubres           string     `json:"pool_without_subres"`
+	UnknownPoolMessage          string     `json:"unknown_pool_message"`
+	MinerErrorFormat            string     `json:"miner_error_format"`
+	NonStratumInput             string     `json:"non_stratum_input"`
 	AgentListenIp               string     `json:"agent_listen_ip"`
 	AgentListenPort             uint16     `json:"agent_listen_port"`
+	AgentListenBacklog          int        `json:"agent_listen_backlog"`
 	Proxy                       []string   `json:"proxy"`
 	UseProxy                    bool       `json:"use_proxy"`
 	DirectConnectWithProxy      bool       `json:"direct_connect_with_proxy"`
 	DirectConnectAfterProxy     bool       `json:"direct_connect_after_proxy"`
 	PoolUseTls                  bool       `json:"pool_use_tls"`
 	Pools                       []PoolInfo `json:"pools"`
-	HTTPDebug                   struct {
+	// 未启用多用户模式时，pools 中未填写子账户的矿池使用该子账户
+	SubAccount string `json:"sub_account"`
+	HTTPDebug  struct {
 		Enable bool   `json:"enable"`
 		Listen string `json:"listen"`
 	} `json:"http_debug"`
+	AgentListenTLS struct {
+		Enable   bool   `json:"enable"`
+		Port     uint16 `json:"port"`
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+	} `json:"agent_listen_tls"`
+	AgentListenUnix struct {
+		Enable bool   `json:"enable"`
+		Path   string `json:"path"`
+		Mode   string `json:"mode"`
+	} `json:"agent_listen_unix"`
+	Admin struct {
+		Enable bool   `json:"enable"`
+		Listen string `json:"listen"`
+		Token  string `json:"token"`
+	} `json:"admin"`
+	StatsPersist struct {
+		Enable               bool    `json:"enable"`
+		File                 string  `json:"file"`
+		FlushIntervalSeconds Seconds `json:"flush_interval_seconds"`
+	} `json:"stats_persist"`
+	InitialDifficulty struct {
+		Default     uint64            `json:"default"`
+		SubAccounts map[string]uint64 `json:"sub_accounts"`
+		// 认证前通过 mining.suggest_difficulty 向矿池建议初始难度
+		SuggestToPool bool `json:"suggest_to_pool"`
+	} `json:"initial_difficulty"`
+	// 多用户模式下只接受这些子账户的矿机，sub_accounts 和 pattern 均为空时接受所有子账户
+	SubAccountAllowlist struct {
+		SubAccounts []string `json:"sub_accounts"`
+		Pattern     string   `json:"pattern"` // 正则表达式，需要匹配整个子账户名
+	} `json:"sub_account_allowlist"`
+	// 按矿机的 user agent 选择单独的矿池连接，使用第一个匹配的规则
+	UserAgentRoutes []UserAgentRoute `json:"user_agent_routes"`
+	// 发给矿机的难度的上下限，0 表示不限制
+	DifficultyClamp struct {
+		Min uint64 `json:"min"`
+		Max uint64 `json:"max"`
+	} `json:"difficulty_clamp"`
+	RejectAlert struct {
+		Enable bool `json:"enable"`
+		// 计算拒绝率的滚动窗口
+		WindowSeconds Seconds `json:"window_seconds"`
+		// 拒绝率持续超过 alert_ratio 这么久才告警
+		SustainSeconds Seconds `json:"sustain_seconds"`
+		// 窗口内的 share 数少于该值时不告警
+		MinShares    uint64  `json:"min_shares"`
+		AlertRatio   float64 `json:"alert_ratio"`
+		RecoverRatio float64 `json:"recover_ratio"`
+		// 告警和恢复时以 POST 请求发送 JSON 通知的地址，为空则只打印日志
+		Webhook string `json:"webhook"`
+	} `json:"reject_alert"`
+	// 定期向监控服务报告各子账户的 share 统计和算力，与挖矿互不影响
+	StatsReport struct {
+		Enable bool `json:"enable"`
+		// 监控服务的地址（host:port），每次报告发送一行 JSON
+		Server          string  `json:"server"`
+		IntervalSeconds Seconds `json:"interval_seconds"`
+		// 连接失败或断开后的重连间隔
+		ReconnectIntervalSeconds Seconds `json:"reconnect_interval_seconds"`
+	} `json:"stats_report"`
+	PoolPassword struct {
+		Default     Password            `json:"default"`
+		SubAccounts map[string]Password `json:"sub_accounts"`
+		// 多用户模式下使用矿机在 mining.authorize 中提供的密码
+		FromMiner bool `json:"from_miner"`
+	} `json:"pool_password"`
+	// 透传模式：每台矿机使用单独的矿池连接，原样转发 JSON-RPC 消息，不通过 ex-message 聚合
+	Passthrough struct {
+		Enable bool `json:"enable"`
+		// 按 sub_account、fixed_worker_name 等配置替换矿机请求中的矿工名和密码
+		RewriteWorkerName bool `json:"rewrite_worker_name"`
+	} `json:"passthrough"`
 	Advanced struct {
 		// 每个子账户的矿池连接数量
 		PoolConnectionNumberPerSubAccount uint8 `json:"pool_connection_number_per_subaccount"`
+		// 每个矿池连接最多分配的矿机数，所有连接都达到上限时自动为该子账户新建矿池连接，0 表示不限制
+		PoolConnectionMaxMiners uint `json:"pool_connection_max_miners"`
 		// 矿池连接超时时间
 		PoolConnectionDialTimeoutSeconds Seconds `json:"pool_connection_dial_timeout_seconds"`
+		// 建立 TCP 连接失败后的重试次数，只在第一次尝试后的 pool_connection_dial_timeout_seconds 内重试，0 表示不重试
+		PoolConnectionDialRetries uint `json:"pool_connection_dial_retries"`
+		// 建立 TCP 连接失败后重试前等待的时间（毫秒）
+		PoolConnectionDialRetryIntervalMilliseconds uint `json:"pool_connection_dial_retry_interval_milliseconds"`
 		// 矿池读取超时时间
 		PoolConnectionReadTimeoutSeconds Seconds `json:"pool_connection_read_timeout_seconds"`
+		// 矿池写入超时时间
+		PoolConnectionWriteTimeoutSeconds Seconds `json:"pool_connection_write_timeout_seconds"`
+		// 矿池握手（订阅、认证等）超时时间
+		PoolHandshakeTimeoutSeconds Seconds `json:"pool_handshake_timeout_seconds"`
+		// 连接矿池时同时尝试的矿池数量上限。按 pools 的顺序尝试，当前矿池失败或超过 pool_connect_stagger_seconds
+		// 仍未认证成功时开始尝试下一个矿池，使用最先认证成功的连接，其余连接断开
+		PoolConnectConcurrency uint `json:"pool_connect_concurrency"`
+		// 开始尝试下一个矿池前等待当前矿池的时间，0 表示同时开始
+		PoolConnectStaggerSeconds Seconds `json:"pool_connect_stagger_seconds"`
+		// 矿池连接认证成功后，新的矿机等到该连接收到第一个任务或超过该时间后再分配给它，以免矿机没有任务可做。0 表示不等待
+		PoolWarmupSeconds Seconds `json:"pool_warmup_seconds"`
+		// 同一矿池连续多少次握手响应无法解析后标记为不可用并切换到其他矿池，0 表示不标记
+		PoolMaxIncompatibleHandshakes uint `json:"pool_max_incompatible_handshakes"`
+		// 矿池被标记为不可用的时间，期间连接时跳过它（所有矿池都不可用时仍会尝试）
+		PoolUnhealthySeconds Seconds `json:"pool_unhealthy_seconds"`
+		// 新的矿池连接按评分从高到低尝试矿池，这里是评分中优先级、连接耗时和成功率的权重，均为 0 时按 pools 的顺序尝试
+		PoolSelection PoolSelectionWeights `json:"pool_selection"`
+		// 启用 submit_response_from_server 时，矿池超过该时间未响应的 share 直接在本地响应为接受
+		PoolSubmitResponseTimeoutSeconds Seconds `json:"pool_submit_response_timeout_seconds"`
+		// 启用 submit_response_from_server 时，退出前最多等待该时间，以便把已提交的 share 的矿池响应转发给矿机，
+		// 到时仍未响应的 share 在本地响应为失败。0 表示不等待
+		ShutdownSubmitGraceSeconds Seconds `json:"shutdown_submit_grace_seconds"`
+		// 合并写出 share 的时间窗口（毫秒）：窗口内提交的 share（ex-message）在一次写入中发给矿池，0 表示立即写出
+		PoolSubmitCoalesceMilliseconds uint `json:"pool_submit_coalesce_milliseconds"`
 		// 假任务的发送周期（秒）
 		FakeJobNotifyIntervalSeconds Seconds `json:"fake_job_notify_interval_seconds"`
+		// 同一个矿机连接上最多认证的矿工数
+		MaxWorkersPerMinerConnection uint `json:"max_workers_per_miner_connection"`
+		// 同一个矿机连接上已转发但矿池尚未响应的最大 share 数，超过后新的 share 在本地拒绝，0 表示不限制
+		MaxOutstandingSubmitsPerMinerConnection uint `json:"max_outstanding_submits_per_miner_connection"`
+		// 矿机空闲（未发送任何数据）超过该时间后发送 mining.ping，再空闲一个周期则断开连接，0 表示不发送
+		MinerPingIntervalSeconds Seconds `json:"miner_ping_interval_seconds"`
+		// 矿机连接建立（而非认证）后的最长时间，超过后等待已转发的 share 得到响应，再发送 client.reconnect 让矿机重新连接，
+		// 以便按当前的矿池配置重新分配矿池连接。0 表示不限制
+		MinerSessionMaxLifetimeSeconds Seconds `json:"miner_session_max_lifetime_seconds"`
+		// 矿机连接后必须在该时间内完成认证，否则断开连接，0 表示不限制
+		MinerAuthorizeTimeoutSeconds Seconds `json:"miner_authorize_timeout_seconds"`
+		// 矿机认证之前最多发送的请求数（mining.subscribe、mining.configure 等），超过后断开连接，0 表示不限制
+		MinerMaxUnauthorizedMessages uint `json:"miner_max_unauthorized_messages"`
+		// 调试用：为每个矿机连接分配从 1 开始递增的序号，显示在该连接的所有日志和管理命令 sessions 的结果中，
+		// 以便在会话ID被重复使用时追踪同一个连接的完整生命周期
+		MinerSessionSerial bool `json:"miner_session_serial"`
+		// 已分配的会话ID超过容量的该百分比时，在管理命令 pools 的结果中设置 capacity_warning，0 表示不提示
+		SessionCapacityWarningPercent uint `json:"session_capacity_warning_percent"`
+		// 矿机连接的发送队列长度，矿机长时间不接收数据导致队列满时断开该矿机，以免阻塞其他矿机
+		MinerSendQueueSize uint `json:"miner_send_queue_size"`
+		// 会话ID用完时对新的矿机连接的处理方式
+		MinerCapacityEviction struct {
+			// reject（默认）拒绝新连接；evict_idle 踢掉最早建立的空闲连接
+			Policy string `json:"policy"`
+			// 这段时间内没有被接受的 share 的矿机连接视为空闲
+			IdleSeconds Seconds `json:"idle_seconds"`
+			// 没有空闲的连接时不踢掉活跃的连接，仍然拒绝新连接；为 false 时踢掉最早建立的连接
+			NeverEvictActive bool `json:"never_evict_active"`
+		} `json:"miner_capacity_eviction"`
+		// 调试用：把与矿池之间收发的所有数据（mining.authorize 中的密码除外）写入文件，以便用模拟矿池重放
+		PoolCapture struct {
+			Enable bool   `json:"enable"`
+			File   string `json:"file"`
+			// 文件超过该大小（MB）时轮转
+			MaxFileSizeMB uint `json:"max_file_size_mb"`
+			// 最多保留的旧文件数（file.1、file.2 ...），0 表示轮转时直接丢弃旧文件
+			MaxBackups uint `json:"max_backups"`
+		} `json:"pool_capture"`
+		// 矿池连续发送的任务在广播给矿机之前合并：排队的任务中有 clean_jobs 为 true 的任务时，只广播该任务及其后的任务
+		CoalesceMiningNotify bool `json:"coalesce_mining_notify"`
+		// 向矿池请求的能力（agent.get_capabilities），为空时使用默认值
+		PoolCapabilities []string `json:"pool_capabilities"`
+		// 矿池必须支持的能力，不支持时断开连接并尝试下一个矿池
+		RequiredPoolCapabilities []string `json:"required_pool_capabilities"`
 		// 不进行 TLS 证书校验
 		TLSSkipCertificateVerify bool `json:"tls_skip_certificate_verify"`
+		// 矿机提交的版本位超出矿池允许的掩码时直接拒绝该 share，否则去掉掩码之外的位后提交
+		RejectIllegalVersionMask bool `json:"reject_illegal_version_mask"`
+		// 无法识别矿池对 mining.configure 的响应时视为握手失败，断开连接并尝试下一个矿池，否则只打印警告并继续握手
+		StrictConfigureResponse bool `json:"strict_configure_response"`
+		// 将矿机通过 mining.hashrate、扩展的 mining.submit 或 eth_submitHashrate 声明的算力以 ex-message 转发给矿池，只转发给支持 CMD_SUBMIT_HASHRATE（能力 hashrate）的矿池
+		ForwardDeclaredHashrate bool `json:"forward_declared_hashrate"`
 
 		// 消息队列大小
 		MessageQueueSize struct {
@@ -88,9 +384,27 @@ type Config struct {
 			PoolSession        uint `json:"pool_session"`
 			MinerSession       uint `json:"miner_session"`
 		} `json:"message_queue_size"`
+		// 读取连接的缓冲区大小（字节）。任务较大、下发频繁时调大可以减少读取的系统调用次数
+		ReadBufferSize struct {
+			PoolSession  uint `json:"pool_session"`
+			MinerSession uint `json:"miner_session"`
+		} `json:"read_buffer_size"`
+		// 事件通道已满时的处理方式（block 或 drop）。
+		// 其他事件（share 提交及其响应、连接管理等）不能丢弃，总是等待事件循环处理。
+		MessageQueueOverflow struct {
+			MinerNotify string `json:"miner_notify"`
+			Timer       string `json:"timer"`
+		} `json:"message_queue_overflow"`
 	} `json:"advanced"`
 
 	sessionFactory SessionFactory
+	// 直连矿池使用的 Dialer，为 nil 时使用 net.Dialer。测试中可以替换为内存中的连接（net.Pipe）
+	dialer Dialer
+	// 由 sub_account_allowlist 生成，在 Init() 中设置
+	subAccountAllowlist map[string]bool
+	subAccountPattern   *regexp.Regexp
+	// 按 user_agent_routes 建立的矿池连接使用的规则（见 WithRoute），其他为 nil
+	route *UserAgentRoute
 }
 
 // NewConfig 创建配置对象并设置默认值
@@ -99,35 +413,426 @@ func NewConfig() (config *Config) {
 	config.AgentType = "btc"
 
 	config.DisconnectWhenLostAsicboost = DownSessionDisconnectWhenLostAsicboost
+	config.PoolWithoutAsicboost = DefaultPoolWithoutAsicboost
+	config.PoolWithoutSubres = DefaultPoolWithoutSubres
+	config.UnknownPoolMessage = DefaultUnknownPoolMessage
+	config.MinerErrorFormat = DefaultMinerErrorFormat
+	config.NonStratumInput = DefaultNonStratumInput
 	config.IpWorkerNameFormat = DefaultIpWorkerNameFormat
 	config.UseProxy = true
+	config.AgentListenUnix.Mode = DownSessionUnixSocketMode
+	config.Admin.Listen = DefaultAdminListen
+	config.StatsPersist.File = DefaultStatsPersistFile
+	config.StatsPersist.FlushIntervalSeconds = StatsPersistFlushIntervalSeconds
 	config.DirectConnectAfterProxy = true
+	config.RejectAlert.WindowSeconds = RejectAlertWindowSeconds
+	config.RejectAlert.SustainSeconds = RejectAlertSustainSeconds
+	config.RejectAlert.MinShares = RejectAlertMinShares
+	config.RejectAlert.AlertRatio = RejectAlertRatio
+	config.RejectAlert.RecoverRatio = RejectAlertRecoverRatio
+	config.StatsReport.IntervalSeconds = StatsReportIntervalSeconds
+	config.StatsReport.ReconnectIntervalSeconds = StatsReportReconnectIntervalSeconds
+	config.Passthrough.RewriteWorkerName = PassthroughRewriteWorkerName
 
 	config.Advanced.PoolConnectionNumberPerSubAccount = UpSessionNumPerSubAccount
 	config.Advanced.PoolConnectionDialTimeoutSeconds = UpSessionDialTimeoutSeconds
+	config.Advanced.PoolConnectionDialRetryIntervalMilliseconds = UpSessionDialRetryIntervalMilliseconds
 	config.Advanced.PoolConnectionReadTimeoutSeconds = UpSessionReadTimeoutSeconds
+	config.Advanced.PoolConnectionWriteTimeoutSeconds = UpSessionWriteTimeoutSeconds
+	config.Advanced.PoolHandshakeTimeoutSeconds = UpSessionHandshakeTimeoutSeconds
+	config.Advanced.PoolConnectConcurrency = UpSessionConnectConcurrency
+	config.Advanced.PoolConnectStaggerSeconds = UpSessionConnectStaggerSeconds
+	config.Advanced.PoolWarmupSeconds = UpSessionWarmupSeconds
+	config.Advanced.PoolMaxIncompatibleHandshakes = UpSessionMaxIncompatibleHandshakes
+	config.Advanced.PoolUnhealthySeconds = UpSessionUnhealthySeconds
+	config.Advanced.PoolSubmitResponseTimeoutSeconds = UpSessionSubmitResponseTimeoutSeconds
 	config.Advanced.FakeJobNotifyIntervalSeconds = FakeJobNotifyIntervalSeconds
 	config.Advanced.TLSSkipCertificateVerify = UpSessionTLSInsecureSkipVerify
+	config.Advanced.MaxWorkersPerMinerConnection = DownSessionMaxWorkers
+	config.Advanced.MaxOutstandingSubmitsPerMinerConnection = DownSessionMaxOutstandingSubmits
+	config.Advanced.SessionCapacityWarningPercent = DefaultSessionCapacityWarningPercent
 
 	config.Advanced.MessageQueueSize.SessionManager = SessionManagerChannelCache
 	config.Advanced.MessageQueueSize.PoolSessionManager = UpSessionManagerChannelCache
 	config.Advanced.MessageQueueSize.PoolSession = UpSessionChannelCache
 	config.Advanced.MessageQueueSize.MinerSession = DownSessionChannelCache
+	config.Advanced.MinerSendQueueSize = DownSessionSendQueueSize
+	config.Advanced.MinerCapacityEviction.Policy = DefaultMinerCapacityEvictionPolicy
+	config.Advanced.MinerCapacityEviction.IdleSeconds = MinerCapacityEvictIdleSeconds
+	config.Advanced.MinerCapacityEviction.NeverEvictActive = true
+	config.Advanced.PoolCapture.File = DefaultPoolCaptureFile
+	config.Advanced.PoolCapture.MaxFileSizeMB = DefaultPoolCaptureMaxFileSizeMB
+	config.Advanced.PoolCapture.MaxBackups = DefaultPoolCaptureMaxBackups
+	config.Advanced.ReadBufferSize.PoolSession = DefaultReadBufferSize
+	config.Advanced.ReadBufferSize.MinerSession = DefaultReadBufferSize
+	config.Advanced.MessageQueueOverflow.MinerNotify = DefaultMinerNotifyOverflow
+	config.Advanced.MessageQueueOverflow.Timer = DefaultTimerEventOverflow
+
+	return
+}
+
+// Pool 获取第 poolIndex 个矿池，超出范围时返回 nil
+func (conf *Config) Pool(poolIndex int) *PoolInfo {
+	if poolIndex < 0 || poolIndex >= len(conf.Pools) {
+		return nil
+	}
+	return &conf.Pools[poolIndex]
+}
+
+// PoolReadTimeout 获取第 poolIndex 个矿池的读取超时时间
+func (conf *Config) PoolReadTimeout(poolIndex int) time.Duration {
+	if poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.ReadTimeoutSeconds > 0 {
+		return conf.Pools[poolIndex].Options.ReadTimeoutSeconds.Get()
+	}
+	return conf.Advanced.PoolConnectionReadTimeoutSeconds.Get()
+}
+
+// PoolUseTLS 是否使用 SSL/TLS 连接矿池
+func (conf *Config) PoolUseTLS(poolIndex int) bool {
+	return conf.PoolUseTls || (poolIndex < len(conf.Pools) && conf.Pools[poolIndex].TLS)
+}
+
+// PoolProtocolVariant 获取第 poolIndex 个矿池的协议变体
+func (conf *Config) PoolProtocolVariant(poolIndex int) string {
+	if poolIndex < len(conf.Pools) && len(conf.Pools[poolIndex].Options.ProtocolVariant) > 0 {
+		return conf.Pools[poolIndex].Options.ProtocolVariant
+	}
+	return ProtocolVariantStandard
+}
+
+// initSubAccountAllowlist 检查 sub_account_allowlist 并编译其中的正则表达式
+func (conf *Config) initSubAccountAllowlist() (err error) {
+	allowlist := &conf.SubAccountAllowlist
+	if len(allowlist.SubAccounts) < 1 && len(allowlist.Pattern) < 1 {
+		return
+	}
+	if !conf.MultiUserMode {
+		Log.Warning("[OPTION] sub_account_allowlist is ignored because multi_user_mode is disabled")
+		return
+	}
+
+	conf.subAccountAllowlist = make(map[string]bool, len(allowlist.SubAccounts))
+	for _, subAccount := range allowlist.SubAccounts {
+		conf.subAccountAllowlist[subAccount] = true
+	}
+	if len(allowlist.Pattern) > 0 {
+		conf.subAccountPattern, err = regexp.Compile("^(?:" + allowlist.Pattern + ")$")
+		if err != nil {
+			err = fmt.Errorf("[OPTION] Illegal sub_account_allowlist.pattern %q: %w", allowlist.Pattern, err)
+			return
+		}
+	}
+	Log.Info("[OPTION] Only accept miners of sub-accounts: ", allowlist.SubAccounts, ", pattern: ", allowlist.Pattern)
+	return
+}
+
+// SubAccountAllowed 多用户模式下是否接受子账户 subAccount 的矿机（sub_account_allowlist）
+func (conf *Config) SubAccountAllowed(subAccount string) bool {
+	if conf.subAccountAllowlist == nil {
+		return true
+	}
+	if conf.subAccountAllowlist[subAccount] {
+		return true
+	}
+	return conf.subAccountPattern != nil && conf.subAccountPattern.MatchString(subAccount)
+}
+
+// PassthroughPool 第 poolIndex 个矿池是否只以透传模式连接（passthrough.enable 或矿池的 passthrough）
+func (conf *Config) PassthroughPool(poolIndex int) bool {
+	return conf.Passthrough.Enable || (poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.Passthrough)
+}
+
+// PassthroughOnly 是否所有矿池都只以透传模式连接，此时不建立聚合的矿池连接
+func (conf *Config) PassthroughOnly() bool {
+	if conf.Passthrough.Enable {
+		return true
+	}
+	if len(conf.Pools) < 1 {
+		return false
+	}
+	for i := range conf.Pools {
+		if !conf.PassthroughPool(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasPassthroughPool 是否有只以透传模式连接的矿池
+func (conf *Config) HasPassthroughPool() bool {
+	for i := range conf.Pools {
+		if conf.PassthroughPool(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// PoolSkipCapabilities 第 poolIndex 个矿池是否跳过能力协商
+func (conf *Config) PoolSkipCapabilities(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.SkipCapabilities
+}
 
+// PoolForwardSetGoal 是否转发第 poolIndex 个矿池下发的 mining.set_goal
+func (conf *Config) PoolForwardSetGoal(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.ForwardSetGoal
+}
+
+// PoolResumeSession 重连第 poolIndex 个矿池时是否请求恢复之前的会话
+func (conf *Config) PoolResumeSession(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.ResumeSession
+}
+
+// PoolMissingSessionID 获取第 poolIndex 个矿池的订阅结果中没有会话ID时的处理方式
+func (conf *Config) PoolMissingSessionID(poolIndex int) string {
+	if poolIndex < len(conf.Pools) && len(conf.Pools[poolIndex].Options.MissingSessionID) > 0 {
+		return conf.Pools[poolIndex].Options.MissingSessionID
+	}
+	return MissingSessionIDFailover
+}
+
+// PoolFormatWorkerNames 是否为第 poolIndex 个矿池配置了矿工名的分隔符或格式
+func (conf *Config) PoolFormatWorkerNames(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && (len(conf.Pools[poolIndex].Options.WorkerNameSeparator) > 0 || len(conf.Pools[poolIndex].Options.WorkerNameFormat) > 0)
+}
+
+// poolWorkerNameFormat 获取第 poolIndex 个矿池的矿工名分隔符和格式，未配置时使用默认值
+func (conf *Config) poolWorkerNameFormat(poolIndex int) (separator string, format string) {
+	separator, format = DefaultWorkerNameSeparator, DefaultWorkerNameFormat
+	if poolIndex >= len(conf.Pools) {
+		return
+	}
+	options := &conf.Pools[poolIndex].Options
+	if len(options.WorkerNameSeparator) > 0 {
+		separator = options.WorkerNameSeparator
+	}
+	if len(options.WorkerNameFormat) > 0 {
+		format = options.WorkerNameFormat
+	}
 	return
 }
 
-// LoadFromFile 从文件载入配置
+// PoolWorkerName 按第 poolIndex 个矿池的 worker_name_format 和 worker_name_separator 生成发给矿池的矿工名。
+// 超过 max_worker_name_length 时截断矿机名部分（不截断多字节字符），子账户名等其余部分保持不变。
+func (conf *Config) PoolWorkerName(poolIndex int, subAccount string, workerName string) string {
+	var options PoolOptions
+	if poolIndex < len(conf.Pools) {
+		options = conf.Pools[poolIndex].Options
+	}
+	separator, format := conf.poolWorkerNameFormat(poolIndex)
+	replacer := strings.NewReplacer("{sub_account}", subAccount, "{separator}", separator)
+	prefix, suffix := format, ""
+	if pos := strings.Index(format, "{worker}"); pos >= 0 {
+		prefix, suffix = format[:pos], format[pos+len("{worker}"):]
+	}
+	prefix, suffix = replacer.Replace(prefix), replacer.Replace(suffix)
+
+	if maxLength := int(options.MaxWorkerNameLength); maxLength > 0 && len(prefix)+len(workerName)+len(suffix) > maxLength {
+		keep := maxLength - len(prefix) - len(suffix)
+		if keep < 0 {
+			// 子账户名本身已超长，只能整体截断（单用户模式下在 Init() 中检查）
+			return TruncateUTF8(prefix+suffix, maxLength)
+		}
+		workerName = TruncateUTF8(workerName, keep)
+	}
+	return prefix + workerName + suffix
+}
+
+// PoolDifficultyMultiplier 获取第 poolIndex 个矿池的 difficulty_multiplier，未设置时为 1
+func (conf *Config) PoolDifficultyMultiplier(poolIndex int) uint64 {
+	if poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.DifficultyMultiplier > 1 {
+		return conf.Pools[poolIndex].Options.DifficultyMultiplier
+	}
+	return 1
+}
+
+// PoolReportDifficulty 是否向第 poolIndex 个矿池报告矿机的实际难度
+func (conf *Config) PoolReportDifficulty(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.ReportDifficulty
+}
+
+// PoolNumericRequestID 向第 poolIndex 个矿池发送的请求是否使用数字 id
+func (conf *Config) PoolNumericRequestID(poolIndex int) bool {
+	return poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.NumericRequestID
+}
+
+// DirectDialer 获取直连矿池（不使用代理）时使用的 Dialer
+func (conf *Config) DirectDialer() Dialer {
+	if conf.dialer != nil {
+		return conf.dialer
+	}
+	return &net.Dialer{Timeout: conf.Advanced.PoolConnectionDialTimeoutSeconds.Get()}
+}
+
+// PoolWriteTimeout 获取第 poolIndex 个矿池的写入超时时间
+func (conf *Config) PoolWriteTimeout(poolIndex int) time.Duration {
+	if poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.WriteTimeoutSeconds > 0 {
+		return conf.Pools[poolIndex].Options.WriteTimeoutSeconds.Get()
+	}
+	return conf.Advanced.PoolConnectionWriteTimeoutSeconds.Get()
+}
+
+// PoolSubAccount 获取未启用多用户模式时连接第 poolIndex 个矿池使用的子账户。
+// 优先使用矿池的配置，未配置时使用全局的 sub_account。
+func (conf *Config) PoolSubAccount(poolIndex int) string {
+	if poolIndex < len(conf.Pools) && len(conf.Pools[poolIndex].SubAccount) > 0 {
+		return conf.Pools[poolIndex].SubAccount
+	}
+	return conf.SubAccount
+}
+
+// PoolInitialDifficulty 获取连接第 poolIndex 个矿池的子账户 subAccount 下矿机的初始难度。
+// 优先使用子账户的配置，其次是矿池的配置，最后是默认值。返回 0 表示未配置。
+func (conf *Config) PoolInitialDifficulty(poolIndex int, subAccount string) uint64 {
+	if diff := conf.InitialDifficulty.SubAccounts[subAccount]; diff > 0 {
+		return diff
+	}
+	if poolIndex < len(conf.Pools) && conf.Pools[poolIndex].Options.InitialDifficulty > 0 {
+		return conf.Pools[poolIndex].Options.InitialDifficulty
+	}
+	return conf.InitialDifficulty.Default
+}
+
+// ClampDifficulty 将发给矿机的难度限制在 difficulty_clamp 的范围内
+func (conf *Config) ClampDifficulty(diff uint64) uint64 {
+	if conf.DifficultyClamp.Min > 0 && diff < conf.DifficultyClamp.Min {
+		return conf.DifficultyClamp.Min
+	}
+	if conf.DifficultyClamp.Max > 0 && diff > conf.DifficultyClamp.Max {
+		return conf.DifficultyClamp.Max
+	}
+	return diff
+}
+
+// PoolAuthorizePassword 获取子账户 subAccount 向第 poolIndex 个矿池认证时使用的密码。
+// 启用 from_miner 时优先使用矿机的密码 minerPassword，其次是子账户的配置，然后是矿池的配置，最后是默认值。
+func (conf *Config) PoolAuthorizePassword(poolIndex int, subAccount string, minerPassword string) string {
+	if conf.PoolPassword.FromMiner && len(minerPassword) > 0 {
+		return minerPassword
+	}
+	if password, ok := conf.PoolPassword.SubAccounts[subAccount]; ok {
+		return string(password)
+	}
+	if poolIndex < len(conf.Pools) && len(conf.Pools[poolIndex].Options.Password) > 0 {
+		return string(conf.Pools[poolIndex].Options.Password)
+	}
+	return string(conf.PoolPassword.Default)
+}
+
+// LoadFromFile 从文件载入配置，扩展名为 .yaml 或 .yml 的文件按 YAML 格式解析，其他按 JSON 格式解析
 func (conf *Config) LoadFromFile(file string) (err error) {
 	configJSON, err := ioutil.ReadFile(file)
 	if err != nil {
 		return
 	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		configJSON, err = YAMLToJSON(configJSON)
+		if err != nil {
+			return
+		}
+	}
 	err = json.Unmarshal(configJSON, conf)
+	if err != nil {
+		return
+	}
+	err = conf.expandEnv()
+	return
+}
+
+// YAMLToJSON 将 YAML 文档转换为 JSON，以便使用与 JSON 配置相同的字段名和解析方式（如 pools 的数组格式）
+func YAMLToJSON(data []byte) (jsonBytes []byte, err error) {
+	var value interface{}
+	err = yaml.Unmarshal(data, &value)
+	if err != nil {
+		return
+	}
+	if value == nil {
+		// 空文件
+		return []byte("{}"), nil
+	}
+	return json.Marshal(yamlValueToJSON(value))
+}
+
+// yamlValueToJSON 将 YAML 中键不是字符串的映射（如以数字为名的子账户）转换为 JSON 对象
+func yamlValueToJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = yamlValueToJSON(item)
+		}
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[fmt.Sprint(key)] = yamlValueToJSON(item)
+		}
+		return object
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlValueToJSON(item)
+		}
+	}
+	return value
+}
+
+// envVarPattern 配置中引用的环境变量，只支持 ${NAME} 的形式，以免误替换密码中的 $
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnv 将 value 中的 ${NAME} 替换为环境变量的值，引用的环境变量不存在时返回错误
+func ExpandEnv(value string) (expanded string, err error) {
+	expanded = envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVarPattern.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
 	return
 }
 
-func (conf *Config) Init() {
+// expandEnv 替换子账户名、密码等敏感配置中引用的环境变量，使其不必写在配置文件中
+func (conf *Config) expandEnv() (err error) {
+	expand := func(option string, value *string) {
+		if err == nil {
+			*value, err = ExpandEnv(*value)
+			if err != nil {
+				err = fmt.Errorf("[OPTION] %s: %w", option, err)
+			}
+		}
+	}
+	expandPassword := func(option string, value *Password) {
+		str := string(*value)
+		expand(option, &str)
+		*value = Password(str)
+	}
+
+	expand("sub_account", &conf.SubAccount)
+	expandPassword("pool_password.default", &conf.PoolPassword.Default)
+	if len(conf.PoolPassword.SubAccounts) > 0 {
+		passwords := make(map[string]Password, len(conf.PoolPassword.SubAccounts))
+		for subAccount, password := range conf.PoolPassword.SubAccounts {
+			expand("pool_password.sub_accounts", &subAccount)
+			expandPassword("pool_password.sub_accounts."+subAccount, &password)
+			passwords[subAccount] = password
+		}
+		conf.PoolPassword.SubAccounts = passwords
+	}
+	for i := range conf.Pools {
+		pool := &conf.Pools[i]
+		expand(fmt.Sprintf("sub-account of pool #%d", i), &pool.SubAccount)
+		expandPassword(fmt.Sprintf("password of pool #%d", i), &pool.Options.Password)
+	}
+	for i := range conf.Proxy {
+		expand("proxy", &conf.Proxy[i])
+	}
+	expand("admin.token", &conf.Admin.Token)
+	expand("reject_alert.webhook", &conf.RejectAlert.Webhook)
+	return
+}
+
+// Init 检查并初始化配置，配置有误时返回错误
+func (conf *Config) Init() (err error) {
 	conf.AgentType = strings.ToLower(conf.AgentType)
 	switch conf.AgentType {
 	case "btc":
@@ -141,28 +846,317 @@ func (conf *Config) Init() {
 	case "eth":
 		conf.sessionFactory = new(SessionFactoryETH)
 	default:
-		glog.Fatal("[OPTION] Unknown agent_type: ", conf.AgentType)
+		err = errors.New("[OPTION] Unknown agent_type: " + conf.AgentType)
 		return
 	}
-	glog.Info("[OPTION] BTCAgent for ", strings.ToUpper(conf.AgentType))
+	Log.Info("[OPTION] BTCAgent for ", strings.ToUpper(conf.AgentType))
 
 	if conf.MultiUserMode {
-		glog.Info("[OPTION] Multi user mode: Enabled. Sub-accounts in config file will be ignored.")
+		Log.Info("[OPTION] Multi user mode: Enabled. Sub-accounts in config file will be ignored.")
 	} else {
-		glog.Info("[OPTION] Multi user mode: Disabled. Sub-accounts in config file will be used.")
+		Log.Info("[OPTION] Multi user mode: Disabled. Sub-accounts in config file will be used.")
 	}
 
-	glog.Info("[OPTION] Connect to pool server with SSL/TLS encryption: ", IsEnabled(conf.PoolUseTls))
-	glog.Info("[OPTION] Always keep miner connections even if pool disconnected: ", IsEnabled(conf.AlwaysKeepDownconn))
-	glog.Info("[OPTION] Disconnect if a miner lost its AsicBoost mid-way: ", IsEnabled(conf.DisconnectWhenLostAsicboost))
+	Log.Info("[OPTION] Connect to pool server with SSL/TLS encryption: ", IsEnabled(conf.PoolUseTls))
+	if conf.AgentListenBacklog < 0 {
+		err = fmt.Errorf("[OPTION] Illegal agent_listen_backlog: %d, should be 0 (system default) or a positive number", conf.AgentListenBacklog)
+		return
+	}
+	if conf.AgentListenBacklog > 0 {
+		Log.Info("[OPTION] Listen backlog of miner connections: ", conf.AgentListenBacklog)
+	}
+	if conf.AgentListenTLS.Enable {
+		Log.Info("[OPTION] Accept miner connections with SSL/TLS encryption on port ", conf.AgentListenTLS.Port)
+	}
+	if conf.AgentListenUnix.Enable {
+		Log.Info("[OPTION] Accept miner connections from unix socket ", conf.AgentListenUnix.Path)
+	}
+	if conf.StatsPersist.Enable {
+		if conf.StatsPersist.FlushIntervalSeconds < 1 {
+			conf.StatsPersist.FlushIntervalSeconds = StatsPersistFlushIntervalSeconds
+		}
+		Log.Info("[OPTION] Save share statistics to ", conf.StatsPersist.File, " every ", conf.StatsPersist.FlushIntervalSeconds, " seconds")
+	}
+	if conf.RejectAlert.Enable {
+		alert := &conf.RejectAlert
+		if alert.WindowSeconds < 1 {
+			alert.WindowSeconds = RejectAlertWindowSeconds
+		}
+		if alert.AlertRatio <= 0 || alert.AlertRatio > 1 || alert.RecoverRatio < 0 || alert.RecoverRatio >= alert.AlertRatio {
+			err = fmt.Errorf("[OPTION] Illegal reject_alert: alert_ratio %v and recover_ratio %v, should be 0 <= recover_ratio < alert_ratio <= 1", alert.AlertRatio, alert.RecoverRatio)
+			return
+		}
+		Log.Info("[OPTION] Alert if reject ratio of a sub-account stays above ", alert.AlertRatio, " for ", alert.SustainSeconds,
+			" seconds in a ", alert.WindowSeconds, " seconds window, recover below ", alert.RecoverRatio)
+		if !conf.SubmitResponseFromServer {
+			Log.Warning("[OPTION] reject_alert needs submit_response_from_server, otherwise all shares are accepted locally")
+		}
+	}
+	if conf.StatsReport.Enable {
+		report := &conf.StatsReport
+		if _, _, e := net.SplitHostPort(report.Server); e != nil {
+			err = fmt.Errorf("[OPTION] Illegal stats_report.server %s: %w", report.Server, e)
+			return
+		}
+		if report.IntervalSeconds < 1 {
+			report.IntervalSeconds = StatsReportIntervalSeconds
+		}
+		if report.ReconnectIntervalSeconds < 1 {
+			report.ReconnectIntervalSeconds = StatsReportReconnectIntervalSeconds
+		}
+		Log.Info("[OPTION] Report share statistics and hashrate to ", report.Server, " every ", report.IntervalSeconds, " seconds")
+		if !conf.SubmitResponseFromServer {
+			Log.Warning("[OPTION] stats_report counts shares accepted locally without submit_response_from_server")
+		}
+	}
+	if conf.Passthrough.Enable {
+		if conf.Passthrough.RewriteWorkerName {
+			Log.Info("[OPTION] Passthrough mode enabled, each miner uses its own pool connection, worker names are rewritten")
+		} else {
+			Log.Info("[OPTION] Passthrough mode enabled, each miner uses its own pool connection, requests are relayed verbatim")
+		}
+	}
+	if conf.Advanced.PoolSubmitResponseTimeoutSeconds < 1 {
+		conf.Advanced.PoolSubmitResponseTimeoutSeconds = UpSessionSubmitResponseTimeoutSeconds
+	}
+	if conf.Advanced.ShutdownSubmitGraceSeconds > 0 {
+		Log.Info("[OPTION] Wait up to ", conf.Advanced.ShutdownSubmitGraceSeconds, " seconds for responses of submitted shares before exiting")
+	}
+	if conf.Advanced.PoolSubmitCoalesceMilliseconds > UpSessionMaxSubmitCoalesceMilliseconds {
+		err = fmt.Errorf("[OPTION] Illegal pool_submit_coalesce_milliseconds: %d, should not be greater than %d", conf.Advanced.PoolSubmitCoalesceMilliseconds, UpSessionMaxSubmitCoalesceMilliseconds)
+		return
+	}
+	if conf.Advanced.PoolSubmitCoalesceMilliseconds > 0 {
+		Log.Info("[OPTION] Shares submitted within ", conf.Advanced.PoolSubmitCoalesceMilliseconds, " ms are written to pool server at once")
+	}
+	if conf.Advanced.PoolConnectionDialRetries > 0 {
+		Log.Info("[OPTION] Retry connecting to pool server up to ", conf.Advanced.PoolConnectionDialRetries, " times every ",
+			conf.Advanced.PoolConnectionDialRetryIntervalMilliseconds, " ms within ", conf.Advanced.PoolConnectionDialTimeoutSeconds, " seconds")
+	}
+	if conf.Advanced.PoolConnectionMaxMiners > 0 {
+		Log.Info("[OPTION] Up to ", conf.Advanced.PoolConnectionMaxMiners, " miners per pool connection, open more pool connections (up to ",
+			UpSessionMaxNumPerSubAccount, " per sub-account) when all connections are full")
+	}
+	if conf.Advanced.PoolConnectConcurrency < 1 {
+		conf.Advanced.PoolConnectConcurrency = 1
+	}
+	if len(conf.Pools) > 1 && (conf.Advanced.PoolConnectConcurrency != UpSessionConnectConcurrency || conf.Advanced.PoolConnectStaggerSeconds != UpSessionConnectStaggerSeconds) {
+		Log.Info("[OPTION] Pool servers tried at the same time: ", conf.Advanced.PoolConnectConcurrency, ", try the next one after ", conf.Advanced.PoolConnectStaggerSeconds, " seconds")
+	}
+	if conf.Advanced.PoolWarmupSeconds > 0 {
+		Log.Info("[OPTION] New miners wait up to ", conf.Advanced.PoolWarmupSeconds, " seconds for the first job of a newly authorized pool connection")
+	}
+	if conf.Advanced.PoolMaxIncompatibleHandshakes > 0 && conf.Advanced.PoolUnhealthySeconds < 1 {
+		err = fmt.Errorf("[OPTION] Illegal pool_unhealthy_seconds: %d, should be greater than 0", conf.Advanced.PoolUnhealthySeconds)
+		return
+	}
+	if conf.Advanced.PoolMaxIncompatibleHandshakes != UpSessionMaxIncompatibleHandshakes || conf.Advanced.PoolUnhealthySeconds != UpSessionUnhealthySeconds {
+		if conf.Advanced.PoolMaxIncompatibleHandshakes > 0 {
+			Log.Info("[OPTION] Skip a pool server for ", conf.Advanced.PoolUnhealthySeconds, " seconds after ", conf.Advanced.PoolMaxIncompatibleHandshakes, " incompatible handshakes in a row")
+		} else {
+			Log.Info("[OPTION] Pool servers with incompatible handshakes are never skipped")
+		}
+	}
+	if err = conf.Advanced.PoolSelection.check(); err != nil {
+		return
+	}
+	if selection := conf.Advanced.PoolSelection; selection.Enabled() {
+		Log.Info("[OPTION] Try pool servers in order of score, weights: priority ", selection.Priority,
+			", latency ", selection.Latency, ", reliability ", selection.Reliability)
+	}
+	if conf.Advanced.MinerSessionMaxLifetimeSeconds > 0 {
+		Log.Info("[OPTION] Rotate miner connections after ", conf.Advanced.MinerSessionMaxLifetimeSeconds, " seconds")
+	}
+	if conf.Advanced.MinerSessionSerial {
+		Log.Info("[OPTION] Miner session serial numbers enabled in logs and status")
+	}
+	if conf.Advanced.MinerAuthorizeTimeoutSeconds > 0 || conf.Advanced.MinerMaxUnauthorizedMessages > 0 {
+		Log.Info("[OPTION] Miners must authorize in ", conf.Advanced.MinerAuthorizeTimeoutSeconds, " seconds and ", conf.Advanced.MinerMaxUnauthorizedMessages, " requests (0 means unlimited)")
+	}
+	if conf.Advanced.SessionCapacityWarningPercent > 100 {
+		err = fmt.Errorf("[OPTION] session_capacity_warning_percent should not be greater than 100: %d", conf.Advanced.SessionCapacityWarningPercent)
+		return
+	}
+	if conf.Advanced.SessionCapacityWarningPercent != DefaultSessionCapacityWarningPercent {
+		Log.Info("[OPTION] Warn when more than ", conf.Advanced.SessionCapacityWarningPercent, "% of session ids are allocated (0 means never)")
+	}
+	if conf.Advanced.MinerSendQueueSize < 1 {
+		conf.Advanced.MinerSendQueueSize = DownSessionSendQueueSize
+	}
+	eviction := &conf.Advanced.MinerCapacityEviction
+	eviction.Policy = strings.ToLower(eviction.Policy)
+	switch eviction.Policy {
+	case "":
+		eviction.Policy = DefaultMinerCapacityEvictionPolicy
+	case MinerCapacityReject:
+	case MinerCapacityEvictIdle:
+		if eviction.IdleSeconds < 1 {
+			eviction.IdleSeconds = MinerCapacityEvictIdleSeconds
+		}
+		if conf.PassthroughOnly() {
+			Log.Warning("[OPTION] miner_capacity_eviction is ignored in passthrough mode")
+		} else if eviction.NeverEvictActive {
+			Log.Info("[OPTION] When all session ids are in use, evict the oldest miner without accepted shares in ", eviction.IdleSeconds, " seconds")
+		} else {
+			Log.Info("[OPTION] When all session ids are in use, evict the oldest miner without accepted shares in ", eviction.IdleSeconds,
+				" seconds, or the oldest miner if none is idle")
+		}
+	default:
+		err = fmt.Errorf("[OPTION] Unknown miner_capacity_eviction.policy: %s, should be %s or %s", eviction.Policy, MinerCapacityReject, MinerCapacityEvictIdle)
+		return
+	}
+	if capture := &conf.Advanced.PoolCapture; capture.Enable {
+		if len(capture.File) < 1 {
+			capture.File = DefaultPoolCaptureFile
+		}
+		if capture.MaxFileSizeMB < 1 {
+			capture.MaxFileSizeMB = DefaultPoolCaptureMaxFileSizeMB
+		}
+		Log.Warning("[OPTION] Capture all pool traffic to ", capture.File, " (max ", capture.MaxFileSizeMB, " MB, ", capture.MaxBackups, " backups), for debugging only")
+	}
+	if conf.Advanced.ReadBufferSize.PoolSession < 1 {
+		conf.Advanced.ReadBufferSize.PoolSession = DefaultReadBufferSize
+	}
+	if conf.Advanced.ReadBufferSize.MinerSession < 1 {
+		conf.Advanced.ReadBufferSize.MinerSession = DefaultReadBufferSize
+	}
+	if conf.Advanced.ReadBufferSize.PoolSession != DefaultReadBufferSize || conf.Advanced.ReadBufferSize.MinerSession != DefaultReadBufferSize {
+		Log.Info("[OPTION] Read buffer size of pool sessions: ", conf.Advanced.ReadBufferSize.PoolSession, ", miner sessions: ", conf.Advanced.ReadBufferSize.MinerSession)
+	}
+	if conf.Advanced.PoolCapabilities != nil {
+		Log.Info("[OPTION] Capabilities requested from pool server: ", conf.Advanced.PoolCapabilities)
+	}
+	if len(conf.Advanced.RequiredPoolCapabilities) > 0 {
+		Log.Info("[OPTION] Capabilities required from pool server: ", conf.Advanced.RequiredPoolCapabilities)
+	}
+	if conf.InitialDifficulty.Default > 0 || len(conf.InitialDifficulty.SubAccounts) > 0 {
+		if conf.AgentType != "btc" {
+			err = errors.New("[OPTION] initial_difficulty is only supported by BTCAgent for BTC")
+			return
+		}
+		Log.Info("[OPTION] Initial difficulty of miners: ", conf.InitialDifficulty.Default, ", sub-accounts: ", conf.InitialDifficulty.SubAccounts)
+	}
+	if conf.InitialDifficulty.SuggestToPool {
+		Log.Info("[OPTION] Suggest the initial difficulty to pool servers: Enabled")
+	}
+	if conf.DifficultyClamp.Min > 0 && conf.DifficultyClamp.Max > 0 && conf.DifficultyClamp.Min > conf.DifficultyClamp.Max {
+		err = fmt.Errorf("[OPTION] Illegal difficulty_clamp: min %d is greater than max %d", conf.DifficultyClamp.Min, conf.DifficultyClamp.Max)
+		return
+	}
+	if conf.DifficultyClamp.Min > 0 || conf.DifficultyClamp.Max > 0 {
+		Log.Info("[OPTION] Difficulty clamp of miners: min ", conf.DifficultyClamp.Min, ", max ", conf.DifficultyClamp.Max)
+	}
+	if len(conf.PoolPassword.Default) > 0 || len(conf.PoolPassword.SubAccounts) > 0 {
+		Log.Info("[OPTION] Password for pool servers: configured, sub-accounts: ", conf.PoolPassword.SubAccounts)
+	}
+	if conf.PoolPassword.FromMiner {
+		if conf.MultiUserMode {
+			Log.Info("[OPTION] Password for pool servers: from the first miner of each sub-account")
+		} else {
+			Log.Warning("[OPTION] pool_password.from_miner only works in multi user mode, ignored")
+		}
+	}
+	Log.Info("[OPTION] Always keep miner connections even if pool disconnected: ", IsEnabled(conf.AlwaysKeepDownconn))
+	Log.Info("[OPTION] Disconnect if a miner lost its AsicBoost mid-way: ", IsEnabled(conf.DisconnectWhenLostAsicboost))
+	conf.PoolWithoutAsicboost = strings.ToLower(conf.PoolWithoutAsicboost)
+	switch conf.PoolWithoutAsicboost {
+	case "":
+		conf.PoolWithoutAsicboost = DefaultPoolWithoutAsicboost
+	case PoolWithoutAsicboostWarn, PoolWithoutAsicboostFailover, PoolWithoutAsicboostDisable:
+	default:
+		err = errors.New("[OPTION] Unknown pool_without_asicboost: " + conf.PoolWithoutAsicboost)
+		return
+	}
+	Log.Info("[OPTION] If a pool server does not support AsicBoost: ", conf.PoolWithoutAsicboost)
+	conf.PoolWithoutSubres = strings.ToLower(conf.PoolWithoutSubres)
+	switch conf.PoolWithoutSubres {
+	case "":
+		conf.PoolWithoutSubres = DefaultPoolWithoutSubres
+	case PoolWithoutSubresLocalAck, PoolWithoutSubresFailover:
+	default:
+		err = errors.New("[OPTION] Unknown pool_without_subres: " + conf.PoolWithoutSubres)
+		return
+	}
+	if conf.SubmitResponseFromServer {
+		Log.Info("[OPTION] If a pool server does not send share responses: ", conf.PoolWithoutSubres)
+	}
+	conf.UnknownPoolMessage = strings.ToLower(conf.UnknownPoolMessage)
+	switch conf.UnknownPoolMessage {
+	case "":
+		conf.UnknownPoolMessage = DefaultUnknownPoolMessage
+	case UnknownPoolMessageInfo, UnknownPoolMessageStrict, UnknownPoolMessageQuiet, UnknownPoolMessagePassthrough:
+	default:
+		err = errors.New("[OPTION] Unknown unknown_pool_message: " + conf.UnknownPoolMessage)
+		return
+	}
+	if conf.UnknownPoolMessage != DefaultUnknownPoolMessage {
+		Log.Info("[OPTION] Unknown messages from pool servers: ", conf.UnknownPoolMessage)
+	}
+	if conf.UnknownPoolMessage == UnknownPoolMessagePassthrough {
+		plainStratum := false
+		for i := range conf.Pools {
+			plainStratum = plainStratum || conf.PoolSkipCapabilities(i)
+		}
+		if !plainStratum {
+			Log.Warning("[OPTION] unknown_pool_message passthrough only relays notifications from pools with skip_capabilities, other unknown messages are logged")
+		}
+	}
+	conf.MinerErrorFormat = strings.ToLower(conf.MinerErrorFormat)
+	switch conf.MinerErrorFormat {
+	case "":
+		conf.MinerErrorFormat = DefaultMinerErrorFormat
+	case MinerErrorFormatArray, MinerErrorFormatObject:
+	default:
+		err = errors.New("[OPTION] Unknown miner_error_format: " + conf.MinerErrorFormat)
+		return
+	}
+	if conf.MinerErrorFormat != DefaultMinerErrorFormat {
+		Log.Info("[OPTION] Format of JSON-RPC errors sent to miners: ", conf.MinerErrorFormat)
+	}
+	conf.NonStratumInput = strings.ToLower(conf.NonStratumInput)
+	switch conf.NonStratumInput {
+	case "":
+		conf.NonStratumInput = DefaultNonStratumInput
+	case NonStratumInputDisconnect, NonStratumInputQuiet, NonStratumInputRespond:
+	default:
+		err = errors.New("[OPTION] Unknown non_stratum_input: " + conf.NonStratumInput)
+		return
+	}
+	if conf.NonStratumInput != DefaultNonStratumInput {
+		Log.Info("[OPTION] Non-stratum data from miner connections: ", conf.NonStratumInput)
+	}
+	overflow := &conf.Advanced.MessageQueueOverflow
+	if err = initEventOverflow(EventClassMinerNotify, &overflow.MinerNotify, DefaultMinerNotifyOverflow); err != nil {
+		return
+	}
+	if err = initEventOverflow(EventClassTimer, &overflow.Timer, DefaultTimerEventOverflow); err != nil {
+		return
+	}
+	Log.Info("[OPTION] If the queue of a session is full, job notifications to miners: ", overflow.MinerNotify, ", timer events: ", overflow.Timer)
+	if conf.Advanced.RejectIllegalVersionMask {
+		Log.Info("[OPTION] Shares with version bits outside the allowed mask: Rejected")
+	} else {
+		Log.Info("[OPTION] Shares with version bits outside the allowed mask: Corrected")
+	}
+	if conf.Advanced.StrictConfigureResponse {
+		Log.Info("[OPTION] Unrecognized mining.configure response from pool server: Fail over")
+	}
+	if conf.Advanced.ForwardDeclaredHashrate {
+		Log.Info("[OPTION] Forward hashrate declared by miners to pool servers supporting ", CapSubmitHashrate)
+	}
+
+	err = conf.initSubAccountAllowlist()
+	if err != nil {
+		return
+	}
 
 	if len(conf.FixedWorkerName) > 0 {
-		glog.Info("[OPTION] Fixed worker name enabled, all worker name will be replaced to ", conf.FixedWorkerName, " on the server.")
+		Log.Info("[OPTION] Fixed worker name enabled, all worker name will be replaced to ", conf.FixedWorkerName, " on the server.")
 	}
 
 	if !conf.UseProxy && len(conf.Proxy) > 0 {
 		conf.Proxy = []string{}
-		glog.Info("[OPTION] Proxy disabled")
+		Log.Info("[OPTION] Proxy disabled")
 	}
 	for i := range conf.Proxy {
 		if conf.Proxy[i] == "system" {
@@ -170,17 +1164,187 @@ func (conf *Config) Init() {
 		}
 	}
 	if len(conf.Proxy) > 0 {
-		glog.Info("[OPTION] Connect to pool server with proxy ", conf.Proxy)
+		Log.Info("[OPTION] Connect to pool server with proxy ", conf.Proxy)
+	}
+
+	err = conf.initPools()
+	if err != nil {
+		return
 	}
+	err = conf.initUserAgentRoutes()
+	return
+}
 
+// initPools 检查并规范化 pools 中的每个矿池
+func (conf *Config) initPools() (err error) {
 	for i := range conf.Pools {
 		pool := &conf.Pools[i]
+		if err = pool.Normalize(); err != nil {
+			err = fmt.Errorf("[OPTION] Pool #%d: %w", i, err)
+			return
+		}
+		if pool.plainScheme && conf.PoolUseTls {
+			err = fmt.Errorf("[OPTION] Pool %s is a plain stratum connection, but pool_use_tls is enabled", pool.Address())
+			return
+		}
+		if pool.TLS && !conf.PoolUseTls {
+			Log.Info("[OPTION] Connect to pool ", pool.Address(), " with SSL/TLS encryption")
+		}
+		pool.Options.ProtocolVariant = strings.ToLower(pool.Options.ProtocolVariant)
+		switch pool.Options.ProtocolVariant {
+		case "", ProtocolVariantStandard:
+		case ProtocolVariantNiceHash:
+			Log.Info("[OPTION] Protocol variant of pool ", pool.Host, ":", pool.Port, ": ", pool.Options.ProtocolVariant)
+		default:
+			err = fmt.Errorf("[OPTION] Unknown protocol_variant of pool %s:%d: %s", pool.Host, pool.Port, pool.Options.ProtocolVariant)
+			return
+		}
+		if pool.Options.SkipCapabilities {
+			if conf.AgentType != "btc" {
+				err = fmt.Errorf("[OPTION] skip_capabilities of pool %s:%d is only supported by BTCAgent for BTC", pool.Host, pool.Port)
+				return
+			}
+			if len(conf.Advanced.RequiredPoolCapabilities) > 0 {
+				err = fmt.Errorf("[OPTION] Pool %s:%d skips capabilities negotiation, but required_pool_capabilities is set", pool.Host, pool.Port)
+				return
+			}
+			Log.Info("[OPTION] Capabilities negotiation with pool ", pool.Host, ":", pool.Port, ": Skipped, shares are submitted with mining.submit")
+		}
+		if pool.Options.InitialDifficulty > 0 && conf.AgentType != "btc" {
+			err = fmt.Errorf("[OPTION] initial_difficulty of pool %s:%d is only supported by BTCAgent for BTC", pool.Host, pool.Port)
+			return
+		}
+		if pool.Options.DifficultyMultiplier > 1 {
+			if conf.AgentType != "btc" {
+				err = fmt.Errorf("[OPTION] difficulty_multiplier of pool %s:%d is only supported by BTCAgent for BTC", pool.Host, pool.Port)
+				return
+			}
+			// 矿池按其自身的难度统计 share 时，只看到满足矿池难度的 share，矿机的工作量被少算，因此要求矿池按报告的矿机难度统计
+			if !pool.Options.ReportDifficulty {
+				err = fmt.Errorf("[OPTION] difficulty_multiplier of pool %s:%d needs report_difficulty, otherwise the work of miners is under-credited", pool.Host, pool.Port)
+				return
+			}
+			Log.Info("[OPTION] Difficulty of miners connected to pool ", pool.Host, ":", pool.Port, ": ", pool.Options.DifficultyMultiplier,
+				" times the pool difficulty, reported to the pool, only shares meeting the pool difficulty are submitted")
+		}
+		if pool.Options.ReportDifficulty {
+			if conf.AgentType != "btc" {
+				err = fmt.Errorf("[OPTION] report_difficulty of pool %s:%d is only supported by BTCAgent for BTC", pool.Host, pool.Port)
+				return
+			}
+			if pool.Options.SkipCapabilities {
+				err = fmt.Errorf("[OPTION] report_difficulty of pool %s:%d needs ex-messages, but skip_capabilities is set", pool.Host, pool.Port)
+				return
+			}
+			Log.Info("[OPTION] Report the difficulty of miners to pool ", pool.Host, ":", pool.Port, " when it differs from the pool difficulty")
+		}
+		if pool.Options.ResumeSession {
+			if conf.AgentType != "btc" {
+				err = fmt.Errorf("[OPTION] resume_session of pool %s:%d is only supported by BTCAgent for BTC", pool.Host, pool.Port)
+				return
+			}
+			Log.Info("[OPTION] Resume the previous session when reconnecting to pool ", pool.Host, ":", pool.Port)
+		}
+		pool.Options.MissingSessionID = strings.ToLower(pool.Options.MissingSessionID)
+		switch pool.Options.MissingSessionID {
+		case "", MissingSessionIDFailover:
+		case MissingSessionIDZero:
+			Log.Info("[OPTION] Use session id 0 if pool ", pool.Host, ":", pool.Port, " does not send one in the subscribe result")
+		default:
+			err = fmt.Errorf("[OPTION] Unknown missing_session_id of pool %s:%d: %s", pool.Host, pool.Port, pool.Options.MissingSessionID)
+			return
+		}
+		if pool.Options.ForwardSetGoal {
+			Log.Info("[OPTION] Forward mining.set_goal from pool ", pool.Host, ":", pool.Port, " to miners supporting it")
+		}
+		if pool.Options.Passthrough && !conf.Passthrough.Enable {
+			Log.Info("[OPTION] Pool ", pool.Host, ":", pool.Port, " is connected in passthrough mode, only when no other pool server is available")
+		}
+		if len(pool.Options.WorkerNameFormat) > 0 && strings.Count(pool.Options.WorkerNameFormat, "{worker}") != 1 {
+			err = fmt.Errorf("[OPTION] worker_name_format of pool %s:%d should contain {worker} once: %s", pool.Host, pool.Port, pool.Options.WorkerNameFormat)
+			return
+		}
+		if conf.PoolFormatWorkerNames(i) || pool.Options.MaxWorkerNameLength > 0 {
+			separator, format := conf.poolWorkerNameFormat(i)
+			Log.Info("[OPTION] Worker names sent to pool ", pool.Host, ":", pool.Port, ": ", format, ", separator: \"", separator, "\", max length: ", pool.Options.MaxWorkerNameLength)
+		}
 		if conf.MultiUserMode {
 			// 如果启用多用户模式，删除矿池设置中的子账户名
 			pool.SubAccount = ""
-			glog.Info("add pool: ", pool.Host, ":", pool.Port, ", multi user mode")
+			Log.Info("add pool: ", pool.Host, ":", pool.Port, ", multi user mode")
 		} else {
-			glog.Info("add pool: ", pool.Host, ":", pool.Port, ", sub-account: ", pool.SubAccount)
+			subAccount := conf.PoolSubAccount(i)
+			if len(subAccount) < 1 {
+				err = fmt.Errorf("[OPTION] No sub-account for pool %s:%d, please set sub_account or the sub-account of the pool", pool.Host, pool.Port)
+				return
+			}
+			if maxLength := int(pool.Options.MaxWorkerNameLength); maxLength > 0 && len(conf.PoolWorkerName(i, subAccount, "")) >= maxLength {
+				err = fmt.Errorf("[OPTION] Worker names of sub-account %s are longer than max_worker_name_length %d of pool %s:%d", subAccount, maxLength, pool.Host, pool.Port)
+				return
+			}
+			Log.Info("add pool: ", pool.Host, ":", pool.Port, ", sub-account: ", subAccount)
+		}
+	}
+	return
+}
+
+// WithPools 复制配置并将矿池列表替换为 pools，用于运行时更新矿池列表。
+//
+// 新的矿池列表按 Init() 的规则检查，有误时返回错误，原配置不受影响。
+// 其余配置与原配置共用，因此原配置必须已调用过 Init()。
+func (conf *Config) WithPools(pools []PoolInfo) (newConf *Config, err error) {
+	if len(pools) < 1 {
+		err = errors.New("[OPTION] Pool list is empty")
+		return
+	}
+	copied := *conf
+	copied.Pools = make([]PoolInfo, len(pools))
+	copy(copied.Pools, pools)
+	err = copied.initPools()
+	if err != nil {
+		return
+	}
+	newConf = &copied
+	return
+}
+
+// Masked 复制配置并隐藏其中的密码，用于将配置打印到日志
+func (conf *Config) Masked() *Config {
+	maskPools := func(pools []PoolInfo) []PoolInfo {
+		masked := make([]PoolInfo, len(pools))
+		for i := range pools {
+			masked[i] = pools[i]
+			masked[i].Options.Password = Password(pools[i].Options.Password.String())
 		}
+		return masked
 	}
+
+	copied := *conf
+	copied.Pools = maskPools(conf.Pools)
+	copied.UserAgentRoutes = make([]UserAgentRoute, len(conf.UserAgentRoutes))
+	for i := range conf.UserAgentRoutes {
+		copied.UserAgentRoutes[i] = conf.UserAgentRoutes[i]
+		copied.UserAgentRoutes[i].Pools = maskPools(conf.UserAgentRoutes[i].Pools)
+	}
+	copied.PoolPassword.Default = Password(conf.PoolPassword.Default.String())
+	if conf.PoolPassword.SubAccounts != nil {
+		copied.PoolPassword.SubAccounts = make(map[string]Password, len(conf.PoolPassword.SubAccounts))
+		for subAccount, password := range conf.PoolPassword.SubAccounts {
+			copied.PoolPassword.SubAccounts[subAccount] = Password(password.String())
+		}
+	}
+	return &copied
+}
+
+// initEventOverflow 检查事件通道已满时的处理方式，未配置时使用默认值
+func initEventOverflow(class string, policy *string, preset string) error {
+	*policy = strings.ToLower(*policy)
+	switch *policy {
+	case "":
+		*policy = preset
+	case EventOverflowBlock, EventOverflowDrop:
+	default:
+		return errors.New("[OPTION] Unknown message_queue_overflow." + class + ": " + *policy)
+	}
+	return nil
 }
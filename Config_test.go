@@ -0,0 +1,426 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPoolInfoNormalize(t *testing.T) {
+	for _, c := range []struct {
+		host string
+		port uint16
+		// 规范化后的结果
+		expectedHost string
+		expectedPort uint16
+		tls          bool
+	}{
+		{"pool.example.com", 1800, "pool.example.com", 1800, false},
+		{" pool.example.com ", 1800, "pool.example.com", 1800, false},
+		{"pool.example.com:1800", 0, "pool.example.com", 1800, false},
+		{"pool.example.com:1800", 1800, "pool.example.com", 1800, false},
+		{"stratum+tcp://pool.example.com:1800", 0, "pool.example.com", 1800, false},
+		{"Stratum+TCP://pool.example.com:1800/", 0, "pool.example.com", 1800, false},
+		{"stratum+tcp://pool.example.com", 1800, "pool.example.com", 1800, false},
+		{"stratum+ssl://pool.example.com:443", 0, "pool.example.com", 443, true},
+		{"stratum+tls://pool.example.com", 443, "pool.example.com", 443, true},
+		{"127.0.0.1:1800", 0, "127.0.0.1", 1800, false},
+		{"[2001:db8::1]:1800", 0, "2001:db8::1", 1800, false},
+		{"[2001:db8::1]", 1800, "2001:db8::1", 1800, false},
+		{"2001:db8::1", 1800, "2001:db8::1", 1800, false},
+	} {
+		pool := PoolInfo{Host: c.host, Port: c.port}
+		if err := pool.Normalize(); err != nil {
+			t.Errorf("%s, %d: unexpected error: %s", c.host, c.port, err.Error())
+			continue
+		}
+		if pool.Host != c.expectedHost || pool.Port != c.expectedPort || pool.TLS != c.tls {
+			t.Errorf("%s, %d: wrong result: %s, %d, %v", c.host, c.port, pool.Host, pool.Port, pool.TLS)
+		}
+	}
+
+	for _, c := range []struct {
+		host string
+		port uint16
+	}{
+		{"pool.example.com:1800", 3333}, // 两处端口不一致
+		{"pool.example.com", 0},         // 缺少端口
+		{"pool.example.com:abc", 0},
+		{"pool.example.com:0", 0},
+		{"pool.example.com:70000", 0},
+		{"http://pool.example.com:1800", 0},
+		{"stratum+tcp://pool.example.com:1800/path", 0},
+		{"stratum+tcp://:1800", 0},
+		{"", 1800},
+	} {
+		pool := PoolInfo{Host: c.host, Port: c.port}
+		if err := pool.Normalize(); err == nil {
+			t.Errorf("%s, %d: error expected, got %s, %d", c.host, c.port, pool.Host, pool.Port)
+		}
+	}
+}
+
+func TestConfigInitPoolAddress(t *testing.T) {
+	config := NewConfig()
+	if err := json.Unmarshal([]byte(`{"pools":[["stratum+ssl://pool.example.com:443",null,"sub"],["pool.example.com:1800",0,"sub"]]}`), config); err != nil {
+		t.Fatalf("unmarshal failed: %s", err.Error())
+	}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Init failed: %s", err.Error())
+	}
+	if config.Pools[0].Address() != "pool.example.com:443" || !config.PoolUseTLS(0) {
+		t.Errorf("wrong pool 0: %s, %v", config.Pools[0].Address(), config.PoolUseTLS(0))
+	}
+	if config.Pools[1].Address() != "pool.example.com:1800" || config.PoolUseTLS(1) {
+		t.Errorf("wrong pool 1: %s, %v", config.Pools[1].Address(), config.PoolUseTLS(1))
+	}
+
+	// 明文连接的前缀与 pool_use_tls 矛盾
+	config = NewConfig()
+	config.PoolUseTls = true
+	config.Pools = []PoolInfo{{Host: "stratum+tcp://pool.example.com:1800", SubAccount: "sub"}}
+	if err := config.Init(); err == nil {
+		t.Errorf("plain scheme with pool_use_tls should be rejected")
+	}
+}
+
+func TestConfigInitialDifficultyETH(t *testing.T) {
+	// ETH 矿机没有初始难度
+	config := NewConfig()
+	config.AgentType = "eth"
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "sub"}}
+	config.InitialDifficulty.Default = 1024
+	if err := config.Init(); err == nil {
+		t.Errorf("initial_difficulty should be rejected for ETH")
+	}
+
+	config = NewConfig()
+	config.AgentType = "eth"
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "sub", Options: PoolOptions{InitialDifficulty: 1024}}}
+	if err := config.Init(); err == nil {
+		t.Errorf("initial_difficulty of a pool should be rejected for ETH")
+	}
+}
+
+func TestConfigDifficultyMultiplier(t *testing.T) {
+	// difficulty_multiplier 需要 report_difficulty，否则矿池少算矿机的工作量
+	for _, c := range []struct {
+		multiplier uint64
+		report     bool
+		ok         bool
+	}{
+		{1, false, true},
+		{4, false, false},
+		{4, true, true},
+	} {
+		config := NewConfig()
+		config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "sub",
+			Options: PoolOptions{DifficultyMultiplier: c.multiplier, ReportDifficulty: c.report}}}
+		if err := config.Init(); (err == nil) != c.ok {
+			t.Errorf("difficulty_multiplier %d, report_difficulty %v: %v", c.multiplier, c.report, err)
+		}
+	}
+}
+
+func TestConfigPoolWithoutSubres(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		ok    bool
+	}{
+		{"", true},
+		{"Local_Ack", true},
+		{"failover", true},
+		{"warn", false},
+	} {
+		config := NewConfig()
+		config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "sub"}}
+		config.PoolWithoutSubres = c.value
+		if err := config.Init(); (err == nil) != c.ok {
+			t.Errorf("pool_without_subres %q: %v", c.value, err)
+		}
+	}
+}
+
+func TestConfigMarshalPassword(t *testing.T) {
+	config := NewConfig()
+	config.PoolPassword.Default = "default-secret"
+	config.PoolPassword.SubAccounts = map[string]Password{"alice": "alice-secret"}
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "alice", Options: PoolOptions{Password: "pool-secret"}}}
+
+	config.UserAgentRoutes = []UserAgentRoute{{Name: "old", Pools: []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "alice", Options: PoolOptions{Password: "route-secret"}}}}}
+
+	// 输出为 JSON 时保留密码，以便重新载入
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("marshal config failed: %s", err.Error())
+	}
+	reloaded := NewConfig()
+	if err := json.Unmarshal(data, reloaded); err != nil {
+		t.Fatalf("unmarshal config failed: %s", err.Error())
+	}
+	if reloaded.PoolPassword.Default != "default-secret" || reloaded.PoolPassword.SubAccounts["alice"] != "alice-secret" ||
+		reloaded.Pools[0].Options.Password != "pool-secret" || reloaded.UserAgentRoutes[0].Pools[0].Options.Password != "route-secret" {
+		t.Errorf("passwords are lost in the round-trip: %s", data)
+	}
+
+	// 打印到日志的配置隐藏密码，且不修改原配置
+	data, err = json.Marshal(config.Masked())
+	if err != nil {
+		t.Fatalf("marshal masked config failed: %s", err.Error())
+	}
+	if strings.Contains(string(data), "secret") || !strings.Contains(string(data), `"******"`) {
+		t.Errorf("passwords are not masked: %s", data)
+	}
+	if config.PoolPassword.SubAccounts["alice"] != "alice-secret" || config.Pools[0].Options.Password != "pool-secret" ||
+		config.UserAgentRoutes[0].Pools[0].Options.Password != "route-secret" {
+		t.Errorf("Masked() changed the original config")
+	}
+	// 未设置的密码仍为空
+	if Password("").String() != "" || Password("x").String() != "******" {
+		t.Errorf("wrong password string")
+	}
+}
+
+func TestConfigPoolWorkerName(t *testing.T) {
+	config := NewConfig()
+	if err := json.Unmarshal([]byte(`{"pools":[
+		["pool1.example.com",1800,"sub"],
+		["pool2.example.com",1800,"sub",{"worker_name_separator":"_"}],
+		["pool3.example.com",1800,"sub",{"worker_name_separator":"/"}],
+		["pool4.example.com",1800,"sub",{"worker_name_format":"{worker}@{sub_account}","max_worker_name_length":12}]
+	]}`), config); err != nil {
+		t.Fatalf("unmarshal failed: %s", err.Error())
+	}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Init failed: %s", err.Error())
+	}
+
+	cases := []struct {
+		pool     int
+		worker   string
+		expected string
+	}{
+		{0, "w1", "sub.w1"},
+		{1, "w1", "sub_w1"},
+		{2, "w1", "sub/w1"},
+		{3, "w1", "w1@sub"},
+		// 超长时只截断矿机名，子账户名保持完整
+		{3, "rack01-miner02", "rack01-m@sub"},
+		// 不截断多字节字符
+		{3, "矿机矿机01", "矿机@sub"},
+		{3, "rack01-m矿机", "rack01-m@sub"},
+		{3, "rack01-矿机", "rack01-@sub"},
+	}
+	for _, c := range cases {
+		if name := config.PoolWorkerName(c.pool, "sub", c.worker); name != c.expected {
+			t.Errorf("pool %d, worker %s: expected %s, got %s", c.pool, c.worker, c.expected, name)
+		}
+	}
+	if config.PoolFormatWorkerNames(0) || !config.PoolFormatWorkerNames(1) || !config.PoolFormatWorkerNames(3) {
+		t.Errorf("wrong pools with worker name format")
+	}
+
+	for _, options := range []PoolOptions{
+		{WorkerNameFormat: "{sub_account}"},
+		{WorkerNameFormat: "{worker}.{worker}"},
+		// 子账户名和分隔符已用完长度限制
+		{MaxWorkerNameLength: 4},
+	} {
+		config = NewConfig()
+		config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, SubAccount: "sub", Options: options}}
+		if err := config.Init(); err == nil {
+			t.Errorf("options should be rejected: %+v", options)
+		}
+	}
+}
+
+func TestConfigSubAccountAllowlist(t *testing.T) {
+	newConfig := func(allowlist string) *Config {
+		t.Helper()
+		config := NewConfig()
+		if err := json.Unmarshal([]byte(`{"multi_user_mode":true,"pools":[["pool.example.com",1800,""]],"sub_account_allowlist":`+allowlist+`}`), config); err != nil {
+			t.Fatalf("unmarshal failed: %s", err.Error())
+		}
+		if err := config.Init(); err != nil {
+			t.Fatalf("Init failed: %s", err.Error())
+		}
+		return config
+	}
+
+	cases := []struct {
+		allowlist  string
+		subAccount string
+		allowed    bool
+	}{
+		// 为空时接受所有子账户
+		{`{}`, "anyone", true},
+		{`{"sub_accounts":["alice","bob"]}`, "alice", true},
+		{`{"sub_accounts":["alice","bob"]}`, "carol", false},
+		{`{"sub_accounts":["alice","bob"]}`, "alice2", false},
+		{`{"pattern":"team-[0-9]+"}`, "team-42", true},
+		// 正则表达式需要匹配整个子账户名
+		{`{"pattern":"team-[0-9]+"}`, "team-42x", false},
+		{`{"pattern":"team-[0-9]+"}`, "myteam-42", false},
+		{`{"sub_accounts":["alice"],"pattern":"team-[0-9]+"}`, "alice", true},
+		{`{"sub_accounts":["alice"],"pattern":"team-[0-9]+"}`, "team-1", true},
+		{`{"sub_accounts":["alice"],"pattern":"a|b"}`, "ab", false},
+	}
+	for _, c := range cases {
+		config := newConfig(c.allowlist)
+		if allowed := config.SubAccountAllowed(c.subAccount); allowed != c.allowed {
+			t.Errorf("%s, %s: expected %v, got %v", c.allowlist, c.subAccount, c.allowed, allowed)
+		}
+		_, err := ParseWorkerName(config, c.subAccount+".w1", "")
+		if (err == nil) != c.allowed || (err != nil && err != StratumErrSubAccountNotAllowed) {
+			t.Errorf("%s, %s: wrong error of ParseWorkerName: %v", c.allowlist, c.subAccount, err)
+		}
+	}
+
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800}}
+	config.SubAccountAllowlist.Pattern = "team-("
+	if err := config.Init(); err == nil {
+		t.Errorf("illegal pattern should be rejected")
+	}
+}
+
+func TestConfigLoadFromFileEnv(t *testing.T) {
+	t.Setenv("BTCAGENT_TEST_SUB_ACCOUNT", "alice")
+	t.Setenv("BTCAGENT_TEST_PASSWORD", "secret")
+	t.Setenv("BTCAGENT_TEST_EMPTY", "")
+
+	load := func(content string) (config *Config, err error) {
+		file := filepath.Join(t.TempDir(), "agent_conf.json")
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("write config failed: %s", err.Error())
+		}
+		config = NewConfig()
+		err = config.LoadFromFile(file)
+		return
+	}
+
+	config, err := load(`{
+		"sub_account": "${BTCAGENT_TEST_SUB_ACCOUNT}",
+		"pools": [["pool.example.com", 1800, "${BTCAGENT_TEST_SUB_ACCOUNT}-2", {"password": "p-${BTCAGENT_TEST_PASSWORD}"}]],
+		"pool_password": {"default": "${BTCAGENT_TEST_PASSWORD}", "sub_accounts": {"${BTCAGENT_TEST_SUB_ACCOUNT}": "x${BTCAGENT_TEST_EMPTY}"}},
+		"fixed_worker_name": "${BTCAGENT_TEST_SUB_ACCOUNT}"
+	}`)
+	if err != nil {
+		t.Fatalf("LoadFromFile failed: %s", err.Error())
+	}
+	if config.SubAccount != "alice" || config.Pools[0].SubAccount != "alice-2" || config.Pools[0].Options.Password != "p-secret" {
+		t.Errorf("env vars are not expanded: %s, %s, %s", config.SubAccount, config.Pools[0].SubAccount, string(config.Pools[0].Options.Password))
+	}
+	if config.PoolPassword.Default != "secret" || config.PoolPassword.SubAccounts["alice"] != "x" {
+		t.Errorf("env vars in pool_password are not expanded: %s, %v", string(config.PoolPassword.Default), config.PoolPassword.SubAccounts)
+	}
+	// 只替换敏感配置
+	if config.FixedWorkerName != "${BTCAGENT_TEST_SUB_ACCOUNT}" {
+		t.Errorf("fixed_worker_name should not be expanded: %s", config.FixedWorkerName)
+	}
+
+	// 只支持 ${NAME}，密码中的 $ 原样保留
+	config, err = load(`{"pool_password": {"default": "pa$$word$BTCAGENT_TEST_PASSWORD"}}`)
+	if err != nil || config.PoolPassword.Default != "pa$$word$BTCAGENT_TEST_PASSWORD" {
+		t.Errorf("password with $ should be kept: %v, %s", err, string(config.PoolPassword.Default))
+	}
+
+	_, err = load(`{"pools": [["pool.example.com", 1800, "sub", {"password": "${BTCAGENT_TEST_MISSING}"}]]}`)
+	if err == nil || !strings.Contains(err.Error(), "BTCAGENT_TEST_MISSING is not set") || !strings.Contains(err.Error(), "password of pool #0") {
+		t.Errorf("missing env var should be reported: %v", err)
+	}
+}
+
+func TestConfigLoadFromFileYAML(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("write config failed: %s", err.Error())
+		}
+		return file
+	}
+
+	jsonFile := write("agent_conf.json", `{
+		"multi_user_mode": false,
+		"agent_listen_port": 3333,
+		"sub_account": "alice",
+		"pools": [
+			["stratum+tcp://us.ss.btc.com:1800", null, ""],
+			["us.ss.btc.com", 443, "bob", {"read_timeout_seconds": 60, "initial_difficulty": 65536, "password": "x"}]
+		],
+		"initial_difficulty": {"default": 16384, "sub_accounts": {"123": 4096}},
+		"reject_alert": {"enable": true, "alert_ratio": 0.05},
+		"advanced": {"pool_connection_number_per_subaccount": 2}
+	}`)
+	yamlFile := write("agent_conf.yaml", `
+# 与 agent_conf.json 相同的配置
+multi_user_mode: false
+agent_listen_port: 3333
+sub_account: alice
+pools:
+  - [stratum+tcp://us.ss.btc.com:1800, null, ""]
+  - - us.ss.btc.com
+    - 443
+    - bob
+    - read_timeout_seconds: 60
+      initial_difficulty: 65536
+      password: x
+initial_difficulty:
+  default: 16384
+  sub_accounts:
+    123: 4096  # 以数字为名的子账户
+reject_alert:
+  enable: true
+  alert_ratio: 0.05
+advanced:
+  pool_connection_number_per_subaccount: 2
+`)
+	ymlFile := write("agent_conf.yml", "sub_account: alice\n")
+
+	fromJSON := NewConfig()
+	if err := fromJSON.LoadFromFile(jsonFile); err != nil {
+		t.Fatalf("load JSON failed: %s", err.Error())
+	}
+	fromYAML := NewConfig()
+	if err := fromYAML.LoadFromFile(yamlFile); err != nil {
+		t.Fatalf("load YAML failed: %s", err.Error())
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("JSON and YAML configs are different:\n%+v\n%+v", fromJSON, fromYAML)
+	}
+	if fromYAML.Pools[1].Options.ReadTimeoutSeconds != 60 || fromYAML.InitialDifficulty.SubAccounts["123"] != 4096 ||
+		fromYAML.Advanced.PoolConnectionNumberPerSubAccount != 2 {
+		t.Errorf("wrong YAML config: %+v", fromYAML)
+	}
+
+	fromYML := NewConfig()
+	if err := fromYML.LoadFromFile(ymlFile); err != nil || fromYML.SubAccount != "alice" {
+		t.Errorf("load .yml failed: %v, %s", err, fromYML.SubAccount)
+	}
+
+	if err := NewConfig().LoadFromFile(write("wrong.yaml", "pools: [\n")); err == nil {
+		t.Errorf("invalid YAML should be rejected")
+	}
+}
+
+func TestConfigUserAgentRoutesDuplicateName(t *testing.T) {
+	config := NewConfig()
+	config.UserAgentRoutes = []UserAgentRoute{{Name: "old", Pattern: "cgminer"}, {Pattern: "bmminer"}}
+	if err := config.initUserAgentRoutes(); err != nil {
+		t.Fatalf("init user_agent_routes failed: %s", err.Error())
+	}
+
+	// 显式的名称与重复的名称或自动生成的名称相同时被拒绝
+	for _, names := range [][2]string{{"old", "old"}, {"route#1", ""}} {
+		config := NewConfig()
+		config.UserAgentRoutes = []UserAgentRoute{{Name: names[0], Pattern: "cgminer"}, {Name: names[1], Pattern: "bmminer"}}
+		if err := config.initUserAgentRoutes(); err == nil || !strings.Contains(err.Error(), "Duplicate") {
+			t.Errorf("duplicate names %q should be rejected: %v", names, err)
+		}
+	}
+}
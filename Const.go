@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 import (
 	"encoding/hex"
@@ -17,6 +17,51 @@ const (
 	StatExit
 )
 
+func (stat AuthorizeStat) String() string {
+	switch stat {
+	case StatConnected:
+		return "connected"
+	case StatSubScribed:
+		return "subscribed"
+	case StatAuthorized:
+		return "authorized"
+	case StatDisconnected:
+		return "disconnected"
+	case StatExit:
+		return "exit"
+	default:
+		return "unknown"
+	}
+}
+
+// HandshakeStage 与矿池握手的步骤，按发送请求的顺序排列
+type HandshakeStage uint8
+
+const (
+	HandshakeConnect HandshakeStage = iota // 尚未发送任何握手请求
+	HandshakeGetCapabilities
+	HandshakeConfigure
+	HandshakeSubscribe
+	HandshakeAuthorize
+)
+
+func (stage HandshakeStage) String() string {
+	switch stage {
+	case HandshakeConnect:
+		return "connect"
+	case HandshakeGetCapabilities:
+		return "agent.get_capabilities"
+	case HandshakeConfigure:
+		return "mining.configure"
+	case HandshakeSubscribe:
+		return "mining.subscribe"
+	case HandshakeAuthorize:
+		return "mining.authorize"
+	default:
+		return "unknown"
+	}
+}
+
 // Stratum协议类型
 type StratumProtocol uint8
 
@@ -38,27 +83,273 @@ const EthereumStratumPrefix = "ethereumstratum/"
 const EthereumStratumVersion = "EthereumStratum/1.0.0"
 
 const DownSessionChannelCache uint = 64
+
+// DownSessionSendQueueSize 矿机连接的发送队列长度，队列满时断开该矿机
+const DownSessionSendQueueSize uint = 256
+
+// DefaultReadBufferSize 读取矿池和矿机连接的缓冲区大小，与 bufio 的默认值相同
+const DefaultReadBufferSize uint = 4096
+
+// DownSessionFlushTimeoutSeconds 关闭矿机连接前发送队列中剩余内容的超时时间
+const DownSessionFlushTimeoutSeconds Seconds = 5
+
+// DownSessionRotateDrainSeconds 轮换矿机连接时，等待已转发的 share 得到响应以及等待矿机收到 client.reconnect 后自行断开的最长时间
+const DownSessionRotateDrainSeconds Seconds = 10
+
+// RegisterWorkerMaxClientAgentLength 通过 CMD_REGISTER_WORKER 发给矿池的挖矿软件名称（user agent）的最大长度（字节）
+const RegisterWorkerMaxClientAgentLength = 64
+
+// DownSessionMaxWorkers 同一个矿机连接上最多认证的矿工数
+const DownSessionMaxWorkers uint = 16
+
+// DownSessionMaxOutstandingSubmits 同一个矿机连接上已转发但矿池尚未响应的最大 share 数
+const DownSessionMaxOutstandingSubmits uint = 256
+
+// DownSessionMaxBatchSize 矿机的一个 JSON RPC 批量请求中最多包含的请求数
+const DownSessionMaxBatchSize = 32
+
+// UpSessionExtraNonce2SizeBTC 矿池分配的 extranonce2 的字节数，
+// 由矿机的 extranonce1（4 字节的会话ID）和矿机的 extranonce2（DownSessionExtraNonce2SizeBTC 字节）组成
+const UpSessionExtraNonce2SizeBTC = 8
+
+// UpSessionBroadcastWorkers 广播任务时最多使用的 goroutine 数
+const UpSessionBroadcastWorkers = 8
+
+// UpSessionBroadcastSessionsPerWorker 广播任务时每个 goroutine 至少负责的矿机数，矿机较少时不必拆分
+const UpSessionBroadcastSessionsPerWorker = 256
+
+// UpSessionRecentJobsBTC 设置了 difficulty_multiplier 或 difficulty_clamp.max 时保存的最近任务数，用于在本地计算 share 的哈希
+const UpSessionRecentJobsBTC = 16
+
+// DownSessionExtraNonce2SizeBTC 发给矿机的 extranonce2 的字节数
+const DownSessionExtraNonce2SizeBTC = 4
+
+// DefaultSessionCapacityWarningPercent 已分配的会话ID超过容量的该百分比时，在管理命令 pools 的结果中提示
+const DefaultSessionCapacityWarningPercent uint = 90
+
+// SelfTestTimeoutSeconds 自检（-selftest）中每个步骤的超时时间
+const SelfTestTimeoutSeconds Seconds = 10
+
 const UpSessionChannelCache uint = 512
 const UpSessionManagerChannelCache uint = 64
 const SessionManagerChannelCache uint = 64
 
+// 事件通道已满时的处理方式
+const (
+	EventOverflowBlock = "block" // 等待事件循环处理（背压）
+	EventOverflowDrop  = "drop"  // 丢弃事件，并计入 btcagent_dropped_events_total
+)
+
+// 可以配置溢出处理方式的事件类别
+const (
+	EventClassMinerNotify = "miner_notify" // 广播给矿机的新任务
+	EventClassTimer       = "timer"        // 定时器触发的检查，下一次触发时会再次检查
+)
+
+const DefaultMinerNotifyOverflow = EventOverflowBlock
+const DefaultTimerEventOverflow = EventOverflowDrop
+
+const DefaultAdminListen = "127.0.0.1:9998"
+
+// ListenerAcceptRetryMinMilliseconds 接受连接遇到临时错误（如文件描述符耗尽）时第一次等待的时间（毫秒），连续出错时每次加倍
+const ListenerAcceptRetryMinMilliseconds = 5
+
+// ListenerAcceptRetryMaxMilliseconds 接受连接遇到临时错误时最长等待的时间（毫秒）
+const ListenerAcceptRetryMaxMilliseconds = 1000
+
+// AdminCommandTimeoutSeconds 管理命令在事件循环中执行的超时时间
+const AdminCommandTimeoutSeconds Seconds = 5
+
+// HealthCheckTimeoutSeconds 健康检查（/healthz、/readyz）等待事件循环响应的超时时间，超时则认为事件循环已阻塞
+const HealthCheckTimeoutSeconds Seconds = 5
+
+const DefaultStatsPersistFile = "agent_stats.json"
+
+// StatsPersistFlushIntervalSeconds 统计数据的保存周期
+const StatsPersistFlushIntervalSeconds Seconds = 60
+
+// 拒绝率告警的默认配置
+const RejectAlertWindowSeconds Seconds = 300
+const RejectAlertSustainSeconds Seconds = 60
+const RejectAlertMinShares = 20
+const RejectAlertRatio = 0.05
+const RejectAlertRecoverRatio = 0.02
+
+// RejectAlertCheckIntervalSeconds 检查拒绝率的间隔
+const RejectAlertCheckIntervalSeconds Seconds = 5
+
+// StatsReportIntervalSeconds 向监控服务报告统计数据的间隔
+const StatsReportIntervalSeconds Seconds = 60
+
+// StatsReportReconnectIntervalSeconds 与监控服务的连接失败或断开后的重连间隔
+const StatsReportReconnectIntervalSeconds Seconds = 30
+
+// StatsReportTimeoutSeconds 连接监控服务和发送报告的超时时间
+const StatsReportTimeoutSeconds Seconds = 10
+
+// RejectAlertWebhookTimeoutSeconds 发送拒绝率告警 webhook 的超时时间
+const RejectAlertWebhookTimeoutSeconds Seconds = 10
+
 const UpSessionDialTimeoutSeconds Seconds = 15
+
+// UpSessionDialRetryIntervalMilliseconds 连接矿池失败后重试前等待的时间（毫秒）
+const UpSessionDialRetryIntervalMilliseconds uint = 500
+
 const UpSessionReadTimeoutSeconds Seconds = 60
+const UpSessionWriteTimeoutSeconds Seconds = 15
+const UpSessionHandshakeTimeoutSeconds Seconds = 15
+
+// UpSessionSubmitResponseTimeoutSeconds 启用 submit_response_from_server 时等待矿池响应 share 的超时时间
+const UpSessionSubmitResponseTimeoutSeconds Seconds = 60
+
+// UpSessionSubmitResponseExpireChecks 每个超时时间内检查超时未响应的 share 的次数，share 最多在超时后再等待超时时间的 1/N
+const UpSessionSubmitResponseExpireChecks = 4
+
+// ShutdownWaitMarginSeconds 退出前等待 share 响应时，上层在 shutdown_submit_grace_seconds 之后额外等待下层结束的时间
+const ShutdownWaitMarginSeconds Seconds = 1
+
+// UpSessionMaxSubmitCoalesceMilliseconds pool_submit_coalesce_milliseconds 的最大值，过大的窗口会明显增加 share 的延迟
+const UpSessionMaxSubmitCoalesceMilliseconds = 100
+
+// UpSessionMaxCoalescedSubmitBytes 等待合并写出的 share 超过该大小时立即写出
+const UpSessionMaxCoalescedSubmitBytes = 16 * 1024
+
+// SubmitResponseSecondsBuckets share 响应时间直方图的区间（秒）
+var SubmitResponseSecondsBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// UpSessionRetryIntervalSeconds 连接所有矿池均失败后的重试间隔
+const UpSessionRetryIntervalSeconds Seconds = 5
+
+// UpSessionConnectConcurrency 每个矿池连接同时尝试的矿池数量上限，为 1 时按顺序逐个尝试
+const UpSessionConnectConcurrency uint = 2
+
+// UpSessionConnectStaggerSeconds 当前尝试的矿池超过该时间仍未认证成功时，同时开始尝试下一个矿池
+const UpSessionConnectStaggerSeconds Seconds = 3
+
+// UpSessionWarmupSeconds 矿池连接认证成功后，等待第一个任务的最长时间，期间新的矿机暂不分配给该连接。0 表示不等待
+const UpSessionWarmupSeconds Seconds = 0
+
+// UpSessionMaxIncompatibleHandshakes 同一矿池连续多少次握手响应无法解析（协议不兼容）后将其标记为不可用
+const UpSessionMaxIncompatibleHandshakes uint = 3
+
+// UpSessionUnhealthySeconds 协议不兼容的矿池被标记为不可用的时间，期间连接矿池时跳过它
+const UpSessionUnhealthySeconds Seconds = 300
+
+// PoolSelectionSmoothing 选择矿池的评分中，连接耗时和成功率的指数移动平均里最近一次尝试所占的比例
+const PoolSelectionSmoothing = 0.3
+
+// UpSessionHandshakeRetryTimes 从未连接成功的子账户因矿池在认证之前断开而失败时，每个矿池连接最多重试的次数
+const UpSessionHandshakeRetryTimes = 3
+
+// UpSessionAuthorizeRetryIntervalSeconds 所有矿池均因永久性错误拒绝认证后的重试间隔
+const UpSessionAuthorizeRetryIntervalSeconds Seconds = 60
+
+// UpSessionMaxPendingExMessages 认证成功前最多暂存的 ex-message 数量
+const UpSessionMaxPendingExMessages = 64
 
 const UpSessionUserAgent = "btccom-agent/2.0.0-mu"
 const DefaultWorkerName = "__default__"
+
+// DefaultWorkerNameSeparator 发给矿池的矿工名中子账户名与矿机名之间的默认分隔符
+const DefaultWorkerNameSeparator = "."
+
+// DefaultWorkerNameFormat 发给矿池的矿工名的默认格式，见 PoolOptions.WorkerNameFormat
+const DefaultWorkerNameFormat = "{sub_account}{separator}{worker}"
 const DefaultIpWorkerNameFormat = "{1}x{2}x{3}x{4}"
 
 // UpSessionNumPerSubAccount 每个子账户的矿池连接数量
 const UpSessionNumPerSubAccount uint8 = 5
 
+// UpSessionMaxNumPerSubAccount 设置了 pool_connection_max_miners 时，每个子账户自动新建的矿池连接数量上限（包括最初的连接）
+const UpSessionMaxNumPerSubAccount = 255
+
+const (
+	CapVersionRolling = "verrol"   // ASICBoost version rolling
+	CapSubmitResponse = "subres"   // Send response of mining.submit
+	CapMiningNotify   = "exnotify" // Send jobs with ex-message CMD_MINING_NOTIFY (BTC)
+	CapSubmitHashrate = "hashrate" // Accept hashrate declared by miners with ex-message CMD_SUBMIT_HASHRATE
+)
+
+// 矿池不支持 ASICBoost（verrol）时的处理方式
+const (
+	PoolWithoutAsicboostWarn     = "warn"     // 只打印警告
+	PoolWithoutAsicboostFailover = "failover" // 断开连接并尝试下一个矿池
+	PoolWithoutAsicboostDisable  = "disable"  // 禁用 version rolling，并向矿机发送空的版本掩码
+)
+
+// 启用 submit_response_from_server 但矿池不支持 subres 时的处理方式
 const (
-	CapVersionRolling = "verrol" // ASICBoost version rolling
-	CapSubmitResponse = "subres" // Send response of mining.submit
+	PoolWithoutSubresLocalAck = "local_ack" // 该矿池降级为本地响应，并明确打印降级信息
+	PoolWithoutSubresFailover = "failover"  // 断开连接并尝试下一个矿池
+)
+
+// 矿池发送了无法处理的消息（未知的方法或响应）时的处理方式
+const (
+	UnknownPoolMessageInfo        = "info"        // 以 Info 级别打印日志后丢弃
+	UnknownPoolMessageStrict      = "strict"      // 以 Warning 级别打印完整消息后丢弃
+	UnknownPoolMessageQuiet       = "quiet"       // 直接丢弃
+	UnknownPoolMessagePassthrough = "passthrough" // 跳过能力协商的矿池发送的未知通知原样转发给矿机，其他同 info
+)
+
+// 矿池的协议变体
+const (
+	// 标准的 btcpool 协议：只有第一个 mining.set_difficulty 通过 JSON 下发，之后的难度通过 ex-message 下发
+	ProtocolVariantStandard = "standard"
+	// NiceHash 风格：难度随时通过 mining.set_difficulty 或 mining.set_target 调整，
+	// mining.notify 的最后还可能附带目标值（target）
+	ProtocolVariantNiceHash = "nicehash"
+)
+
+// 矿池的订阅结果中没有会话ID（extranonce1 为空字符串或 null）时的处理方式
+const (
+	MissingSessionIDFailover = "failover" // 视为协议不兼容，断开连接并尝试下一个矿池
+	MissingSessionIDZero     = "zero"     // 使用为 0 的会话ID继续，用于不使用会话ID的矿池
+)
+
+// 会话ID用完时对新的矿机连接的处理方式（miner_capacity_eviction.policy）
+const (
+	MinerCapacityReject    = "reject"     // 拒绝新的矿机连接
+	MinerCapacityEvictIdle = "evict_idle" // 踢掉最早建立的空闲连接，为新的矿机腾出会话ID
+)
+
+const DefaultMinerCapacityEvictionPolicy = MinerCapacityReject
+
+// MinerCapacityEvictIdleSeconds 这段时间内没有被接受的 share 的矿机连接视为空闲，可以被踢掉
+const MinerCapacityEvictIdleSeconds Seconds = 600
+
+// MinerCapacityEvictWaitMilliseconds 踢掉矿机后等待其释放会话ID的最长时间（毫秒），超时则拒绝新的矿机连接
+const MinerCapacityEvictWaitMilliseconds = 1000
+
+// MinerCapacityEvictPollMilliseconds 等待释放会话ID时重新分配的间隔（毫秒）
+const MinerCapacityEvictPollMilliseconds = 10
+
+// 矿池抓包（advanced.pool_capture）的默认文件名、文件大小上限（MB）和保留的旧文件数
+const DefaultPoolCaptureFile = "pool_capture.jsonl"
+const DefaultPoolCaptureMaxFileSizeMB = 64
+const DefaultPoolCaptureMaxBackups = 3
+
+// 发给矿机的 JSON-RPC 错误的格式
+const (
+	MinerErrorFormatArray  = "array"  // [code, message, data]，大多数矿机使用
+	MinerErrorFormatObject = "object" // {"code": code, "message": message, "data": data}，JSON-RPC 2.0 的格式
+)
+
+// 矿机连接上收到的第一段数据明显不是 Stratum 协议（如浏览器或端口扫描器的 HTTP 请求、TLS 握手）时的处理方式
+const (
+	NonStratumInputDisconnect = "disconnect" // 打印一行日志后断开连接
+	NonStratumInputQuiet      = "quiet"      // 不打印日志，直接断开连接
+	NonStratumInputRespond    = "respond"    // 与旧版本相同，逐行解析并响应错误
 )
 
 const DownSessionDisconnectWhenLostAsicboost = true
+const DefaultPoolWithoutAsicboost = PoolWithoutAsicboostWarn
+const DefaultPoolWithoutSubres = PoolWithoutSubresLocalAck
+const DefaultUnknownPoolMessage = UnknownPoolMessageInfo
+const DefaultMinerErrorFormat = MinerErrorFormatArray
+const DefaultNonStratumInput = NonStratumInputDisconnect
+const DownSessionUnixSocketMode = "0660"
 const UpSessionTLSInsecureSkipVerify = true
+const PassthroughRewriteWorkerName = true
 
 const FakeJobNotifyIntervalSeconds Seconds = 30
 
@@ -75,6 +366,9 @@ var FakeJobIDETHPrefix = hex.EncodeToString(FakeJobIDETHPrefixBin)
 const EthereumInvalidExtraNonce = 0xffffffff
 const EthereumJobIDQueueSize = 256
 
+// BitcoinPoolDiff1 难度为 1 时的目标值（0x00000000ffff0000...）
+var BitcoinPoolDiff1 = uint256.Int{0, 0, 0, 0x00000000ffff0000}
+
 var EthereumPoolDiff1 = uint256.Int{
 	0xffffffffffffffff, 0xffffffffffffffff,
 	0xffffffffffffffff, 0xffffffffffffffff,
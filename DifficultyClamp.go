@@ -0,0 +1,93 @@
+package btcagent
+
+import "math"
+
+//////////////////////////////// DifficultyClamp //////////////////////////////
+
+// DifficultyClamp 按 difficulty_multiplier 和 difficulty_clamp 计算发给矿机的难度（非线程安全，只在事件循环中使用）。
+//
+// 难度被调低到矿池难度以下的 BTC 矿机提交的 share，在本地验证不满足矿池难度的不提交给矿池，
+// 满足矿机收到的难度的响应为接受，以免矿机因拒绝率过高而切换矿池，其余的以难度过低拒绝。
+// 矿池按报告的难度统计（report_difficulty）、或者无法在本地验证的 share 仍提交给矿池，
+// 矿池以难度过低拒绝、但在本地验证过满足矿机难度的，响应给矿机时改为接受；其余的按矿池的结果响应，以免掩盖真正的拒绝。
+// ETH 无法在本地计算 share 的哈希，share 都原样提交给矿池。
+//
+// 同时记录矿池设置的难度，用它在本地检查 share 是否满足矿池难度。
+type DifficultyClamp struct {
+	config     *Config
+	multiplier uint64          // 发给矿机的难度是矿池难度的倍数，至少为 1
+	all        bool            // 矿池通过 mining.set_difficulty 下发的难度被调低（对所有矿机有效）
+	sessions   map[uint16]bool // 矿池通过 ex-message 为单台矿机设置的难度是否被调低，优先于 all
+
+	allPoolDiff      uint64            // 矿池通过 mining.set_difficulty 下发的难度，未知时为 0
+	sessionPoolDiffs map[uint16]uint64 // 矿池通过 ex-message 为单台矿机设置的难度，优先于 allPoolDiff
+}
+
+func NewDifficultyClamp(config *Config, multiplier uint64) (clamp *DifficultyClamp) {
+	clamp = new(DifficultyClamp)
+	clamp.config = config
+	clamp.multiplier = multiplier
+	if clamp.multiplier < 1 {
+		clamp.multiplier = 1
+	}
+	clamp.sessions = make(map[uint16]bool)
+	clamp.sessionPoolDiffs = make(map[uint16]uint64)
+	return
+}
+
+// MinerDifficulty 由矿池难度计算发给矿机的难度，不记录
+func (clamp *DifficultyClamp) MinerDifficulty(poolDiff uint64) uint64 {
+	diff := poolDiff
+	if poolDiff > math.MaxUint64/clamp.multiplier {
+		diff = math.MaxUint64
+	} else {
+		diff *= clamp.multiplier
+	}
+	return clamp.config.ClampDifficulty(diff)
+}
+
+// ClampAll 限制矿池对所有矿机设置的难度
+func (clamp *DifficultyClamp) ClampAll(poolDiff uint64) (diff uint64) {
+	diff = clamp.MinerDifficulty(poolDiff)
+	clamp.all = diff < poolDiff
+	clamp.allPoolDiff = poolDiff
+	return
+}
+
+// ClampSession 限制矿池对单台矿机设置的难度
+func (clamp *DifficultyClamp) ClampSession(sessionID uint16, poolDiff uint64) (diff uint64) {
+	diff = clamp.MinerDifficulty(poolDiff)
+	clamp.sessions[sessionID] = diff < poolDiff
+	clamp.sessionPoolDiffs[sessionID] = poolDiff
+	return
+}
+
+// Remove 矿机断开后移除其记录
+func (clamp *DifficultyClamp) Remove(sessionID uint16) {
+	delete(clamp.sessions, sessionID)
+	delete(clamp.sessionPoolDiffs, sessionID)
+}
+
+// Lowered 矿机的难度是否被调低到了矿池难度以下
+func (clamp *DifficultyClamp) Lowered(sessionID uint16) bool {
+	if lowered, ok := clamp.sessions[sessionID]; ok {
+		return lowered
+	}
+	return clamp.all
+}
+
+// PoolDifficulty 矿池为矿机设置的难度，未知时返回 0
+func (clamp *DifficultyClamp) PoolDifficulty(sessionID uint16) uint64 {
+	if diff, ok := clamp.sessionPoolDiffs[sessionID]; ok {
+		return diff
+	}
+	return clamp.allPoolDiff
+}
+
+// SubmitStatus 获取响应给矿机的 share 提交结果，clamped 表示矿池以难度过低拒绝、因满足矿机难度而改为接受
+func (clamp *DifficultyClamp) SubmitStatus(submitID SubmitID, status StratumStatus) (result StratumStatus, clamped bool) {
+	if status == STATUS_LOW_DIFFICULTY && submitID.MeetsClampedDifficulty {
+		return STATUS_ACCEPT, true
+	}
+	return status, false
+}
@@ -1,11 +1,15 @@
-package main
+package btcagent
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -17,7 +21,9 @@ type DownSessionBTC struct {
 	upSession EventInterface  // 所属的服务器会话
 
 	sessionID       uint16        // 会话ID
+	serial          uint64        // 调试用的连接序号（miner_session_serial），未启用时为 0
 	clientConn      net.Conn      // 到矿机的TCP连接
+	sendQueue       *SendQueue    // 写入 clientConn 的发送队列
 	clientReader    *bufio.Reader // 读取矿机发送的内容
 	readLoopRunning bool          // TCP读循环是否在运行
 	stat            AuthorizeStat // 认证状态
@@ -26,11 +32,49 @@ type DownSessionBTC struct {
 	fullName       string // 完整的矿工名
 	subAccountName string // 子账户名部分
 	workerName     string // 矿机名部分
-	versionMask    uint32 // 比特币版本掩码(用于AsicBoost)
+	password       string // 矿机在 mining.authorize 中提供的密码
+	// 比特币版本掩码(用于AsicBoost)，矿池连接要求矿机停止滚动版本位时清零，通过 loadVersionMask()、storeVersionMask() 访问
+	versionMask uint32
+
+	suggestedDifficulty uint64 // 矿机通过 mining.suggest_difficulty 建议的难度
+	difficulty          uint64 // 发给矿机的难度，用于统计 share 的难度，未知时为 0
+
+	supportSetGoal bool // 矿机在 mining.configure 中声明支持 set-goal 扩展
+	setGoalIgnored bool // 已打印过忽略 mining.set_goal 的日志
+
+	// 同一连接上认证的所有矿工，第一个为最先认证的矿工（即 fullName 等字段）。
+	// 所有矿工共用一个会话ID，难度也是共用的。矿池按会话ID注册的矿工（第一个矿工）统计通过 ex-message 提交的 share，
+	// 只有跳过能力协商、以 mining.submit 提交时（skip_capabilities）才能带上各自的矿机名。
+	workers DownSessionWorkers
+
+	// 已转发给矿池、尚未收到响应的 share 数
+	outstandingSubmits uint
+
+	hashrate MinerHashrate // 矿机声明的算力和按接受的 share 估算的算力
+
+	unauthorizedMessages uint // 认证之前收到的请求数
+
+	lastRecvTime time.Time // 最后一次收到矿机数据的时间
+	pingSent     bool      // 矿机空闲时已发送 mining.ping，之后尚未收到任何数据
+
+	rotateTime    time.Time // 开始轮换连接的时间（连接达到最长时间），为零值时没有轮换
+	reconnectTime time.Time // 轮换时发送 client.reconnect 的时间
+
+	sessionLog DownSessionLog // 连接和断开日志
 
 	eventLoopRunning bool             // 消息循环是否在运行
 	eventChannel     chan interface{} // 消息通道
 
+	// 由 SessionManager 的 ctx 派生，取消后断开连接、退出事件循环
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 保证连接关闭后发送来的事件都会交给 dropEvent 处理，不会留在通道中无人处理。
+	// 发送时只持有读锁，一个等待发送的 goroutine 不会阻塞其他 goroutine 向同一矿机的发送（如广播任务时的 trySendEvent）；
+	// 关闭时先取消 ctx，使等待中的发送返回，再以写锁处理剩余的事件
+	eventLock sync.RWMutex
+	closed    bool
+
 	versionRollingShareCounter uint64 // ASICBoost share 提交数量
 }
 
@@ -40,13 +84,18 @@ func NewDownSessionBTC(manager *SessionManager, clientConn net.Conn, sessionID u
 	down.manager = manager
 	down.sessionID = sessionID
 	down.clientConn = clientConn
-	down.clientReader = bufio.NewReader(clientConn)
+	down.clientReader = bufio.NewReaderSize(clientConn, int(manager.config.Advanced.ReadBufferSize.MinerSession))
 	down.stat = StatConnected
+	down.lastRecvTime = time.Now()
 	down.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.MinerSession)
+	down.ctx, down.cancel = context.WithCancel(manager.ctx)
 
-	down.id = fmt.Sprintf("miner#%d (%s) ", down.sessionID, down.clientConn.RemoteAddr())
+	down.id, down.serial = manager.sessionLogID("miner", down.sessionID, down.clientConn)
+	down.sendQueue = NewSendQueue(down.id, clientConn, manager.config.Advanced.MinerSendQueueSize, down.writeFailed)
 
-	glog.Info(down.id, "miner connected")
+	down.sessionLog = NewDownSessionLog(down.lastRecvTime)
+	Log.Info(down.id, "miner connected")
+	manager.minerCapacity.Add(sessionID, down.id, clientConn, &down.hashrate, down.lastRecvTime)
 	return
 }
 
@@ -58,29 +107,70 @@ func (down *DownSessionBTC) SubAccountName() string {
 	return down.subAccountName
 }
 
+// UserAgent 矿机在 mining.subscribe 中提供的挖矿软件名称
+func (down *DownSessionBTC) UserAgent() string {
+	return down.clientAgent
+}
+
+func (down *DownSessionBTC) Password() string {
+	return down.password
+}
+
 func (down *DownSessionBTC) Stat() AuthorizeStat {
 	return down.stat
 }
 
+// sessionLogInfo 连接和断开日志中的连接信息
+func (down *DownSessionBTC) sessionLogInfo() DownSessionLogInfo {
+	subAccount := down.subAccountName
+	if !down.manager.config.MultiUserMode {
+		subAccount = down.manager.config.SubAccount
+	}
+	return DownSessionLogInfo{
+		RemoteAddr: ConnRemoteAddr(down.clientConn),
+		SubAccount: subAccount,
+		Worker:     down.workerName,
+		SessionID:  down.sessionID,
+		Difficulty: down.difficulty,
+	}
+}
+
 func (down *DownSessionBTC) Init() {
 	go down.handleRequest()
+	if timeout := down.manager.config.Advanced.MinerAuthorizeTimeoutSeconds; timeout > 0 {
+		timer := time.AfterFunc(timeout.Get(), func() { down.SendEvent(EventAuthorizeTimeout{}) })
+		defer timer.Stop()
+	}
 	down.handleEvent()
 }
 
 func (down *DownSessionBTC) Run() {
+	if down.manager.config.Advanced.MinerPingIntervalSeconds > 0 {
+		go down.pingTicker()
+	}
+	if down.manager.config.Advanced.MinerSessionMaxLifetimeSeconds > 0 {
+		go down.rotateTimer()
+	}
 	down.handleEvent()
 }
 
 func (down *DownSessionBTC) close() {
+	down.sessionLog.End(down.id, down.sessionLogInfo(), time.Now())
+
 	if down.upSession != nil && down.stat != StatExit {
 		go down.upSession.SendEvent(EventDownSessionBroken{down.sessionID})
 	}
 
 	down.eventLoopRunning = false
 	down.stat = StatDisconnected
-	down.clientConn.Close()
+	down.sendQueue.Close(DownSessionFlushTimeoutSeconds.Get())
+	down.cancel()
+	down.resetOutstandingSubmits()
+	down.manager.metrics.DeclaredHashrate.Add(down.hashrate.Declare(0))
+	down.dropPendingEvents()
 
 	// release down id
+	down.manager.minerCapacity.Remove(down.sessionID)
 	down.manager.sessionIDManager.FreeSessionID(down.sessionID)
 }
 
@@ -89,14 +179,19 @@ func (down *DownSessionBTC) writeJSONResponse(jsonData *JSONRPCResponse) (int, e
 	if err != nil {
 		return 0, err
 	}
-	if glog.V(12) {
-		glog.Info(down.id, "writeJSONResponse: ", string(bytes))
+	if glog.V(12) || LogJSONRPC.V(12) {
+		Log.Info(down.id, "writeJSONResponse: ", string(bytes))
 	}
-	return down.clientConn.Write(bytes)
+	return down.sendQueue.Write(bytes)
 }
 
 func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, requestJSON []byte) (result interface{}, err *StratumError) {
-	switch request.Method {
+	// 矿机对 mining.ping 等请求的响应，无需处理和回复
+	if len(request.Method) < 1 && (request.Result != nil || request.Error != nil) {
+		return
+	}
+
+	switch NormalizeMethod(request.Method) {
 	case "mining.subscribe":
 		if down.stat != StatConnected {
 			err = StratumErrDuplicateSubscribed
@@ -109,11 +204,21 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 		return
 
 	case "mining.authorize":
+		if down.stat == StatAuthorized {
+			result, err = down.authorizeAdditionalWorker(request)
+			return
+		}
 		if down.stat != StatSubScribed {
 			err = StratumErrNeedSubscribed
 			return
 		}
 		result, err = down.parseAuthorizeRequest(request)
+		if err == StratumErrSubAccountNotAllowed {
+			// 响应错误后断开连接，以免一直占用会话ID
+			Log.Warning(down.id, "reject miner, sub-account is not in sub_account_allowlist: ", string(requestJSON))
+			go down.SendEvent(EventConnBroken{"sub-account not allowed"})
+			return
+		}
 		if err == nil {
 			down.stat = StatAuthorized
 			// 让 Init() 函数返回
@@ -121,7 +226,10 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 
 			down.id += fmt.Sprintf("<%s> ", down.fullName)
 
-			glog.Info(down.id, "miner authorized")
+			Log.Info(down.id, "miner authorized")
+			down.sessionLog.Authorized()
+			down.hashrate.Start(time.Now())
+			down.manager.minerCapacity.Authorized(down.sessionID, down.id)
 		}
 		return
 
@@ -132,20 +240,37 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 	case "mining.submit":
 		result, err = down.parseMiningSubmit(request)
 		if err != nil {
-			glog.Warning(down.id, "stratum error: ", err, "; ", string(requestJSON))
+			Log.Warning(down.id, "stratum error: ", err, "; ", string(requestJSON))
 		}
 		return
 
-	// ignore unimplemented methods
-	case "mining.multi_version":
-		fallthrough
 	case "mining.suggest_difficulty":
-		// If no response, the miner may wait indefinitely
-		err = StratumErrIllegalParams
+		result, err = down.parseSuggestDifficulty(request)
+		return
+
+	case "mining.hashrate":
+		result, err = down.parseHashrate(request)
+		return
+
+	case "mining.ping":
+		result = "pong"
+		return
+
+	case "mining.pong":
+		// 矿机以通知的形式响应 mining.ping，无需回复
+		return
+
+	case "client.get_version":
+		result = UpSessionUserAgent
+		return
+
+	case "mining.multi_version":
+		// 旧版固件用它告知支持的版本，版本滚动实际通过 mining.configure 协商，这里只需确认
+		result = true
 		return
 
 	default:
-		glog.Warning(down.id, "unknown request: ", string(requestJSON))
+		Log.Warning(down.id, "unknown request: ", string(requestJSON))
 
 		// If no response, the miner may wait indefinitely
 		err = StratumErrIllegalParams
@@ -155,7 +280,9 @@ func (down *DownSessionBTC) stratumHandleRequest(request *JSONRPCLineBTC, reques
 
 func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
 	if down.stat != StatAuthorized {
+		// 不转发给矿池，以免矿池收到无法对应矿机的 share
 		err = StratumErrNeedAuthorized
+		down.manager.metrics.UnauthorizedSubmits.Inc()
 
 		// there must be something wrong, send reconnect command
 		down.sendReconnectRequest()
@@ -174,6 +301,15 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 	// [3] Time
 	// [4] Nonce
 	// [5] Version Mask
+	//
+	// 有些固件在之后附带声明的算力 {"hashrate": ...}
+
+	var hashrate float64
+	var declared bool
+	request.Params, hashrate, declared = takeSubmitHashrate(request.Params, 5)
+	if declared {
+		down.declareHashrate(hashrate)
+	}
 
 	if len(request.Params) < 5 {
 		err = StratumErrTooFewParams
@@ -189,6 +325,7 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 		return
 	}
 
+	msg.JobIDString = jobIDStr
 	if IsFakeJobIDBTC(jobIDStr) {
 		msg.IsFakeJob = true
 	} else {
@@ -219,12 +356,12 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 		err = StratumErrIllegalParams
 		return
 	}
-	time, convErr := strconv.ParseUint(timeHex, 16, 32)
+	nTime, convErr := strconv.ParseUint(timeHex, 16, 32)
 	if convErr != nil {
 		err = StratumErrIllegalParams
 		return
 	}
-	msg.Time = uint32(time)
+	msg.Time = uint32(nTime)
 
 	// [4] Nonce
 	nonceHex, ok := request.Params[4].(string)
@@ -259,14 +396,23 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 	// down id
 	msg.Base.SessionID = down.sessionID
 
-	go down.upSession.SendEvent(EventSubmitShareBTC{request.ID, &msg})
+	// [0] Worker Name
+	workerName, _ := request.Params[0].(string)
+
+	if !down.addOutstandingSubmit() {
+		err = StratumErrTooManyOutstandingSubmits
+		return
+	}
+	// 只统计转发给矿池的 share
+	worker, _ := down.workers.Submit(workerName)
+	go down.upSession.SendEvent(EventSubmitShareBTC{request.ID, &msg, time.Now(), worker.WorkerName})
 
 	// 如果 AsicBoost 丢失，就发送重连请求
 	if down.manager.config.DisconnectWhenLostAsicboost {
 		if hasVersionMask {
 			down.versionRollingShareCounter++
 		} else if down.versionRollingShareCounter > 100 {
-			glog.Warning(down.id, "AsicBoost disabled mid-way after ", down.versionRollingShareCounter, " shares, send client.reconnect")
+			Log.Warning(down.id, "AsicBoost disabled mid-way after ", down.versionRollingShareCounter, " shares, send client.reconnect")
 
 			// send reconnect request to miner
 			down.sendReconnectRequest()
@@ -275,31 +421,70 @@ func (down *DownSessionBTC) parseMiningSubmit(request *JSONRPCLineBTC) (result i
 	return
 }
 
+// parseHashrate 解析 mining.hashrate 中矿机声明的算力，params 为 [算力] 或 [矿工名, 算力]
+func (down *DownSessionBTC) parseHashrate(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	if down.stat != StatAuthorized {
+		err = StratumErrNeedAuthorized
+		return
+	}
+	if len(request.Params) < 1 {
+		err = StratumErrTooFewParams
+		return
+	}
+	hashrate, ok := ParseDeclaredHashrate(request.Params[len(request.Params)-1])
+	if !ok {
+		err = StratumErrIllegalParams
+		return
+	}
+	down.declareHashrate(hashrate)
+	result = true
+	return
+}
+
+// declareHashrate 记录矿机声明的算力，启用 forward_declared_hashrate 时转发给矿池
+func (down *DownSessionBTC) declareHashrate(hashrate float64) {
+	down.manager.metrics.DeclaredHashrate.Add(down.hashrate.Declare(hashrate))
+	if glog.V(3) {
+		Log.Info(down.id, "miner declared hashrate: ", hashrate)
+	}
+	if down.manager.config.Advanced.ForwardDeclaredHashrate && down.upSession != nil {
+		go down.upSession.SendEvent(EventDeclaredHashrate{down.sessionID, hashrate})
+	}
+}
+
 func (down *DownSessionBTC) sendReconnectRequest() {
 	var reconnect JSONRPCRequest
 	reconnect.Method = "client.reconnect"
 	reconnect.Params = JSONRPCArray{}
 	bytes, err := reconnect.ToJSONBytesLine()
 	if err != nil {
-		glog.Error(down.id, "failed to convert client.reconnect request to JSON: ", err.Error(), "; ", reconnect)
+		Log.Error(down.id, "failed to convert client.reconnect request to JSON: ", err.Error(), "; ", reconnect)
 		return
 	}
 	go down.SendEvent(EventSendBytes{bytes})
 }
 
+// DownSessionExtraNonce1BTC 会话ID为 sessionID 的矿机的 extranonce1（hex），
+// 它与矿机的 extranonce2 依次组成矿池的 extranonce2
+func DownSessionExtraNonce1BTC(sessionID uint16) string {
+	return Uint32ToHex(uint32(sessionID))
+}
+
 func (down *DownSessionBTC) parseSubscribeRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
 
 	if len(request.Params) >= 1 {
 		down.clientAgent, _ = request.Params[0].(string)
 	}
 
-	sessionIDString := Uint32ToHex(uint32(down.sessionID))
+	// 矿机的 extranonce1 为会话ID，与矿机的 extranonce2 一起组成矿池的 extranonce2
+	sessionIDString := DownSessionExtraNonce1BTC(down.sessionID)
 
-	result = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", sessionIDString}, JSONRPCArray{"mining.notify", sessionIDString}}, sessionIDString, 4}
+	result = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", sessionIDString}, JSONRPCArray{"mining.notify", sessionIDString}}, sessionIDString, DownSessionExtraNonce2SizeBTC}
 	return
 }
 
-func (down *DownSessionBTC) parseAuthorizeRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+// parseAuthorizeWorker 解析 mining.authorize 请求中的矿工名
+func (down *DownSessionBTC) parseAuthorizeWorker(request *JSONRPCLineBTC) (worker DownSessionWorker, err *StratumError) {
 	if len(request.Params) < 1 {
 		err = StratumErrTooFewParams
 		return
@@ -312,47 +497,58 @@ func (down *DownSessionBTC) parseAuthorizeRequest(request *JSONRPCLineBTC) (resu
 		return
 	}
 
-	// 矿工名
-	down.fullName = FilterWorkerName(fullWorkerName)
+	parsed, err := ParseWorkerName(down.manager.config, fullWorkerName, ConnRemoteAddr(down.clientConn))
+	if err != nil {
+		return
+	}
+	worker = parsed
+	return
+}
 
-	// 截取“.”之前的做为子账户名，“.”及之后的做矿机名
-	pos := strings.IndexByte(down.fullName, '.')
-	if pos >= 0 {
-		down.subAccountName = down.fullName[:pos]
-		down.workerName = down.fullName[pos+1:]
-	} else {
-		down.subAccountName = down.fullName
-		down.workerName = ""
+func (down *DownSessionBTC) parseAuthorizeRequest(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	worker, err := down.parseAuthorizeWorker(request)
+	if err != nil {
+		return
+	}
+	down.fullName = worker.FullName
+	down.subAccountName = worker.SubAccountName
+	down.workerName = worker.WorkerName
+	down.workers.Reset(worker)
+	if len(request.Params) > 1 {
+		down.password, _ = request.Params[1].(string)
 	}
 
-	if len(down.manager.config.FixedWorkerName) > 0 {
-		down.workerName = down.manager.config.FixedWorkerName
-		down.fullName = down.subAccountName + "." + down.workerName
-	} else if down.manager.config.UseIpAsWorkerName {
-		down.workerName = IPAsWorkerName(down.manager.config.IpWorkerNameFormat, down.clientConn.RemoteAddr().String())
-		down.fullName = down.subAccountName + "." + down.workerName
+	// 获取矿机名成功
+	result = true
+	return
+}
+
+// authorizeAdditionalWorker 处理同一连接上其他矿工的 mining.authorize 请求
+func (down *DownSessionBTC) authorizeAdditionalWorker(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	worker, err := down.parseAuthorizeWorker(request)
+	if err != nil {
+		return
 	}
 
-	if down.manager.config.MultiUserMode {
-		if len(down.subAccountName) < 1 {
-			err = StratumErrSubAccountNameEmpty
-			return
-		}
-	} else {
-		down.subAccountName = ""
+	// 子账户不同的矿工需要连接到不同的矿池连接
+	if worker.SubAccountName != down.subAccountName {
+		err = StratumErrSubAccountMismatch
+		return
 	}
 
-	if down.workerName == "" {
-		down.workerName = down.fullName
-		if down.workerName == "" {
-			down.workerName = DefaultWorkerName
-			down.fullName = down.subAccountName + "." + down.workerName
-		}
+	added, ok := down.workers.Add(worker, down.manager.config.Advanced.MaxWorkersPerMinerConnection)
+	if !ok {
+		Log.Warning(down.id, "too many workers on a connection, reject ", worker.FullName)
+		err = StratumErrTooManyWorkers
+		return
+	}
+	if !added {
+		result = true
+		return
 	}
 
-	// 获取矿机名成功
+	Log.Info(down.id, "additional worker authorized: ", worker.FullName)
 	result = true
-	err = nil
 	return
 }
 
@@ -368,23 +564,42 @@ func (down *DownSessionBTC) parseConfigureRequest(request *JSONRPCLineBTC) (resu
 		return
 	}
 
+	// 矿池切换挖矿目标时发送的 mining.set_goal 只转发给声明支持 set-goal 扩展的矿机
+	if extensions, ok := request.Params[0].([]interface{}); ok {
+		for _, extension := range extensions {
+			if extension == "set-goal" {
+				down.supportSetGoal = true
+			}
+		}
+	}
+
 	if options, ok := request.Params[1].(map[string]interface{}); ok {
 		if obj, ok := options["version-rolling.mask"]; ok {
 			if versionMaskStr, ok := obj.(string); ok {
 				versionMask, err := strconv.ParseUint(versionMaskStr, 16, 32)
 				if err == nil {
-					down.versionMask = uint32(versionMask)
+					down.storeVersionMask(uint32(versionMask))
 				}
 			}
 		}
 	}
 
-	if down.versionMask != 0 {
+	// 矿池要求的 version rolling 最少位数由矿机所属的矿池连接决定，矿机分配给矿池连接时检查（见 UpSessionBTC.addDownSession）
+	if down.loadVersionMask() != 0 {
 		// 这里响应的是虚假的版本掩码。在连接服务器后将通过 mining.set_version_mask
 		// 更新为真实的版本掩码。
-		result = JSONRPCObj{
+		obj := JSONRPCObj{
 			"version-rolling":      true,
 			"version-rolling.mask": down.versionMaskStr()}
+		if down.supportSetGoal {
+			obj["set-goal"] = true
+		}
+		result = obj
+		return
+	}
+
+	if down.supportSetGoal {
+		result = JSONRPCObj{"set-goal": true}
 		return
 	}
 
@@ -392,11 +607,44 @@ func (down *DownSessionBTC) parseConfigureRequest(request *JSONRPCLineBTC) (resu
 	return
 }
 
+func (down *DownSessionBTC) parseSuggestDifficulty(request *JSONRPCLineBTC) (result interface{}, err *StratumError) {
+	// request:
+	//		{"id":4,"method":"mining.suggest_difficulty","params":[65536]}
+	// response:
+	//		{"id":4,"result":true,"error":null}
+
+	if len(request.Params) < 1 {
+		err = StratumErrTooFewParams
+		return
+	}
+	diff, ok := request.Params[0].(float64)
+	if !ok || diff < 1 {
+		err = StratumErrIllegalParams
+		return
+	}
+
+	// 只作为初始难度使用，矿池发送难度后以矿池的为准
+	down.suggestedDifficulty = uint64(diff)
+	result = true
+	return
+}
+
 func (down *DownSessionBTC) versionMaskStr() string {
-	return fmt.Sprintf("%08x", down.versionMask)
+	return fmt.Sprintf("%08x", down.loadVersionMask())
+}
+
+// loadVersionMask 获取矿机的版本掩码，可以在任意 goroutine 中调用
+func (down *DownSessionBTC) loadVersionMask() uint32 {
+	return atomic.LoadUint32(&down.versionMask)
+}
+
+// storeVersionMask 更新矿机的版本掩码，可以在任意 goroutine 中调用
+func (down *DownSessionBTC) storeVersionMask(versionMask uint32) {
+	atomic.StoreUint32(&down.versionMask, versionMask)
 }
 
 func (down *DownSessionBTC) setUpSession(e EventSetUpSession) {
+	down.resetOutstandingSubmits()
 	down.upSession = e.Session
 	down.upSession.SendEvent(EventAddDownSession{down})
 }
@@ -404,22 +652,41 @@ func (down *DownSessionBTC) setUpSession(e EventSetUpSession) {
 func (down *DownSessionBTC) handleRequest() {
 	down.readLoopRunning = true
 
+	// 在读取第一行之前检查，以免没有换行符的二进制数据（如 TLS 握手）一直等到认证超时
+	if _, err := down.clientReader.Peek(1); err == nil {
+		buffered, _ := down.clientReader.Peek(down.clientReader.Buffered())
+		if down.rejectNonStratumInput(nonStratumInputHead(buffered), buffered) {
+			return
+		}
+	}
+	receivedJSON := false
+
 	for down.readLoopRunning {
 		jsonBytes, err := down.clientReader.ReadBytes('\n')
 		if err != nil {
-			glog.Error(down.id, "failed to read request from miner: ", err.Error())
-			down.connBroken()
+			Log.Error(down.id, "failed to read request from miner: ", err.Error())
+			down.connBroken(err)
 			return
 		}
-		if glog.V(11) {
-			glog.Info(down.id, "handleRequest: ", string(jsonBytes))
+		if glog.V(11) || LogJSONRPC.V(11) {
+			Log.Info(down.id, "handleRequest: ", string(jsonBytes))
+		}
+
+		if IsJSONRPCBatch(jsonBytes) {
+			receivedJSON = true
+			down.SendEvent(down.parseJSONRPCBatch(jsonBytes))
+			continue
 		}
 
 		rpcData, err := NewJSONRPCLineBTC(jsonBytes)
+		if !receivedJSON && down.rejectNonStratumInput(jsonBytes, jsonBytes) {
+			return
+		}
+		receivedJSON = receivedJSON || err == nil
 
 		// ignore the json decode error
 		if err != nil {
-			glog.Warning(down.id, "failed to decode JSON from miner: ", err.Error(), "; ", string(jsonBytes))
+			Log.Warning(down.id, "failed to decode JSON from miner: ", err.Error(), "; ", string(jsonBytes))
 		}
 
 		down.SendEvent(EventRecvJSONRPCBTC{rpcData, jsonBytes})
@@ -427,6 +694,11 @@ func (down *DownSessionBTC) handleRequest() {
 }
 
 func (down *DownSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
+	down.markActive()
+	if !down.countUnauthorizedMessages(1) {
+		return
+	}
+
 	// stat will be changed in stratumHandleRequest
 	result, stratumErr := down.stratumHandleRequest(e.RPCData, e.JSONBytes)
 
@@ -435,51 +707,418 @@ func (down *DownSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 		var response JSONRPCResponse
 		response.ID = e.RPCData.ID
 		response.Result = result
-		response.Error = stratumErr.ToJSONRPCArray(nil)
+		response.Error = down.jsonRPCError(stratumErr)
 
 		_, err := down.writeJSONResponse(&response)
 
 		if err != nil {
-			glog.Error(down.id, "failed to send response to miner: ", err.Error())
+			Log.Error(down.id, "failed to send response to miner: ", err.Error())
+			down.sessionLog.SetReason("failed to send response to miner: " + err.Error())
 			down.close()
 			return
 		}
 	}
 }
 
+func (down *DownSessionBTC) parseJSONRPCBatch(jsonBytes []byte) (e EventRecvJSONRPCBatchBTC) {
+	elements, err := SplitJSONRPCBatch(jsonBytes, DownSessionMaxBatchSize)
+	if err != nil {
+		Log.Warning(down.id, "illegal batch request from miner: ", err.Error(), "; ", string(jsonBytes))
+		e.Error = StratumErrIllegalBatch
+		return
+	}
+
+	e.Requests = make([]EventRecvJSONRPCBTC, len(elements))
+	for i, element := range elements {
+		rpcData, err := NewJSONRPCLineBTC(element)
+		if err != nil {
+			Log.Warning(down.id, "failed to decode JSON from miner: ", err.Error(), "; ", string(element))
+			rpcData = nil
+		}
+		e.Requests[i] = EventRecvJSONRPCBTC{rpcData, element}
+	}
+	return
+}
+
+// recvJSONRPCBatch 按顺序处理批量请求中的每个请求，一个请求出错不影响其他请求
+func (down *DownSessionBTC) recvJSONRPCBatch(e EventRecvJSONRPCBatchBTC) {
+	down.markActive()
+	if !down.countUnauthorizedMessages(len(e.Requests)) {
+		return
+	}
+
+	// 批量请求本身非法时，按 JSON RPC 规范响应一个单独的错误
+	if e.Error != nil {
+		_, err := down.writeJSONResponse(&JSONRPCResponse{nil, nil, down.jsonRPCError(e.Error)})
+		if err != nil {
+			Log.Error(down.id, "failed to send response to miner: ", err.Error())
+			down.sessionLog.SetReason("failed to send response to miner: " + err.Error())
+			down.close()
+		}
+		return
+	}
+
+	var responses []JSONRPCResponse
+	for _, request := range e.Requests {
+		if request.RPCData == nil {
+			responses = append(responses, JSONRPCResponse{nil, nil, down.jsonRPCError(StratumErrIllegalParams)})
+			continue
+		}
+
+		// stat will be changed in stratumHandleRequest
+		result, stratumErr := down.stratumHandleRequest(request.RPCData, request.JSONBytes)
+
+		// 两个均为空说明没有想要返回的响应
+		if result != nil || stratumErr != nil {
+			responses = append(responses, JSONRPCResponse{request.RPCData.ID, result, down.jsonRPCError(stratumErr)})
+		}
+	}
+
+	if len(responses) < 1 {
+		return
+	}
+
+	bytes, err := JSONRPCBatchToJSONBytesLine(responses, 1)
+	if err == nil {
+		if glog.V(12) || LogJSONRPC.V(12) {
+			Log.Info(down.id, "writeJSONResponse: ", string(bytes))
+		}
+		_, err = down.sendQueue.Write(bytes)
+	}
+	if err != nil {
+		Log.Error(down.id, "failed to send response to miner: ", err.Error())
+		down.sessionLog.SetReason("failed to send response to miner: " + err.Error())
+		down.close()
+	}
+}
+
 func (down *DownSessionBTC) SendEvent(event interface{}) {
-	down.eventChannel <- event
+	down.eventLock.RLock()
+	defer down.eventLock.RUnlock()
+
+	if down.closed {
+		down.dropEvent(event)
+		return
+	}
+	if !sendEventWithPolicy(down.ctx, down.eventChannel, event, down.manager.config, down.manager.metrics) {
+		down.dropEvent(event)
+	}
+}
+
+// trySendEvent 不阻塞地发送事件，事件通道已满时返回 false，由调用方改用 SendEvent 等待发送。
+// 连接已关闭时按 SendEvent 的方式处理事件并返回 true。
+func (down *DownSessionBTC) trySendEvent(event interface{}) bool {
+	down.eventLock.RLock()
+	defer down.eventLock.RUnlock()
+
+	if down.closed {
+		down.dropEvent(event)
+		return true
+	}
+	select {
+	case down.eventChannel <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropPendingEvents 连接关闭后，处理通道中剩余的以及之后发送来的事件
+func (down *DownSessionBTC) dropPendingEvents() {
+	down.eventLock.Lock()
+	defer down.eventLock.Unlock()
+
+	down.closed = true
+	for {
+		select {
+		case event := <-down.eventChannel:
+			down.dropEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// sendPendingSubmitResponses 代理退出时，先发送通道中已有的 share 响应（如退出前等待到的矿池响应），
+// 其他事件交给 dropEvent 处理
+func (down *DownSessionBTC) sendPendingSubmitResponses() {
+	// 发送失败时会话已关闭
+	for down.eventLoopRunning {
+		select {
+		case event := <-down.eventChannel:
+			if e, ok := event.(EventSubmitResponse); ok {
+				down.submitResponse(e)
+			} else {
+				down.dropEvent(event)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// dropEvent 处理连接关闭后收到的事件。
+// 矿池连接在分配矿机时就已计入矿机数，需要告知它矿机已断开，否则矿机数永远不会减少。
+func (down *DownSessionBTC) dropEvent(event interface{}) {
+	switch e := event.(type) {
+	case EventSetUpSession:
+		go e.Session.SendEvent(EventDownSessionBroken{down.sessionID})
+	case EventKickDownSession:
+		// 已断开的矿机不再返回
+		e.Response <- nil
+	}
+}
+
+// status 矿机连接的状态（用于管理命令）
+func (down *DownSessionBTC) status() DownSessionStatus {
+	return DownSessionStatus{
+		SessionID:   down.sessionID,
+		Serial:      down.serial,
+		FullName:    down.fullName,
+		ClientAgent: down.clientAgent,
+		RemoteAddr:  ConnRemoteAddr(down.clientConn),
+		Workers:     down.workers.Snapshot(),
+
+		DeclaredHashrate:  down.hashrate.Declared(),
+		EstimatedHashrate: down.hashrate.Estimated(hashesPerDifficulty(down.manager.config.AgentType), time.Now()),
+	}
+}
+
+// kick 符合条件时断开连接（管理命令 kick），之后按正常断开的流程通知矿池连接并释放会话 ID
+func (down *DownSessionBTC) kick(e EventKickDownSession) {
+	status := down.status()
+	if !e.Filter.Match(status) {
+		e.Response <- nil
+		return
+	}
+	Log.Info(down.id, "[admin] disconnect miner, session id ", status.SessionID)
+	down.sessionLog.SetReason("disconnected by admin")
+	down.close()
+	e.Response <- []DownSessionStatus{status}
+}
+
+// markActive 收到了矿机发送的数据
+func (down *DownSessionBTC) markActive() {
+	down.lastRecvTime = time.Now()
+	down.pingSent = false
+}
+
+// pingTicker 定期检查矿机是否空闲
+func (down *DownSessionBTC) pingTicker() {
+	ticker := time.NewTicker(down.manager.config.Advanced.MinerPingIntervalSeconds.Get())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-down.ctx.Done():
+			return
+		case <-ticker.C:
+			down.SendEvent(EventPingMiner{})
+		}
+	}
+}
+
+// pingMiner 矿机空闲时发送 mining.ping，发送后仍然空闲则断开连接。
+// 不支持 mining.ping 的矿机只要还在提交 share 就不受影响。
+func (down *DownSessionBTC) pingMiner() {
+	idle := time.Since(down.lastRecvTime)
+	if idle < down.manager.config.Advanced.MinerPingIntervalSeconds.Get() {
+		return
+	}
+	if down.pingSent {
+		Log.Warning(down.id, "miner has been idle for ", idle.Truncate(time.Second), " and did not respond to mining.ping, disconnect")
+		down.sessionLog.SetReason("no response to mining.ping")
+		down.close()
+		return
+	}
+
+	var ping JSONRPCRequest
+	ping.ID = "ping"
+	ping.Method = "mining.ping"
+	ping.Params = JSONRPCArray{}
+	bytes, err := ping.ToJSONBytesLine()
+	if err != nil {
+		Log.Error(down.id, "failed to convert mining.ping request to JSON: ", err.Error(), "; ", ping)
+		return
+	}
+	down.pingSent = true
+	down.sendBytes(EventSendBytes{bytes})
 }
 
-func (down *DownSessionBTC) connBroken() {
+// rotateTimer 自连接建立（Run）起达到 miner_session_max_lifetime_seconds 后开始轮换
+func (down *DownSessionBTC) rotateTimer() {
+	timer := time.NewTimer(down.manager.config.Advanced.MinerSessionMaxLifetimeSeconds.Get())
+	defer timer.Stop()
+
+	select {
+	case <-down.ctx.Done():
+	case <-timer.C:
+		down.SendEvent(EventRotateSession{})
+	}
+}
+
+// rotateSession 轮换达到最长时间的连接，以免丢失正在提交的 share：
+// 先等待已转发给矿池的 share 得到响应，再发送 client.reconnect，之后矿机提交的 share 仍然正常转发，
+// 等待矿机自行断开；每一步最多等待 DownSessionRotateDrainSeconds，超时后断开连接。
+func (down *DownSessionBTC) rotateSession() {
+	now := time.Now()
+	if down.rotateTime.IsZero() {
+		down.rotateTime = now
+		down.sessionLog.SetReason("session lifetime exceeded")
+		Log.Info(down.id, "connected for more than ", down.manager.config.Advanced.MinerSessionMaxLifetimeSeconds, " seconds, rotate the connection")
+		down.scheduleRotate()
+	}
+
+	waitSince := down.rotateTime
+	if !down.reconnectTime.IsZero() {
+		waitSince = down.reconnectTime
+	}
+	if down.outstandingSubmits > 0 && now.Sub(waitSince) < DownSessionRotateDrainSeconds.Get() {
+		// 收到响应或等待超时后再次检查
+		return
+	}
+
+	if down.reconnectTime.IsZero() {
+		down.reconnectTime = now
+		var reconnect JSONRPCRequest
+		reconnect.Method = "client.reconnect"
+		reconnect.Params = JSONRPCArray{}
+		bytes, err := reconnect.ToJSONBytesLine()
+		if err == nil {
+			down.sendBytes(EventSendBytes{bytes})
+			down.scheduleRotate()
+			return
+		}
+		Log.Error(down.id, "failed to convert client.reconnect request to JSON: ", err.Error(), "; ", reconnect)
+	}
+
+	Log.Info(down.id, "miner did not reconnect in ", DownSessionRotateDrainSeconds, " seconds, disconnect")
+	down.close()
+}
+
+// scheduleRotate 等待 DownSessionRotateDrainSeconds 后再次检查轮换
+func (down *DownSessionBTC) scheduleRotate() {
+	time.AfterFunc(DownSessionRotateDrainSeconds.Get(), func() {
+		down.SendEvent(EventRotateSession{})
+	})
+}
+
+// rejectNonStratumInput 矿机发送的数据明显不是 Stratum 协议时按 non_stratum_input 断开连接，返回 true 时读循环应退出。
+// 只检查收到的第一段数据和第一个有效 JSON 之前的行，received 是日志中打印的收到的数据。
+func (down *DownSessionBTC) rejectNonStratumInput(data []byte, received []byte) bool {
+	if down.manager.config.NonStratumInput == NonStratumInputRespond || !IsNonStratumInput(data) {
+		return false
+	}
+	if down.manager.config.NonStratumInput != NonStratumInputQuiet {
+		Log.Info(down.id, "non-stratum data from miner, disconnect: ", nonStratumInputPreview(received))
+	}
 	down.readLoopRunning = false
-	down.SendEvent(EventConnBroken{})
+	down.SendEvent(EventConnBroken{"non-stratum data"})
+	return true
+}
+
+func (down *DownSessionBTC) connBroken(err error) {
+	down.readLoopRunning = false
+	reason := "read failed: " + err.Error()
+	if err == io.EOF {
+		reason = "closed by miner"
+	}
+	down.SendEvent(EventConnBroken{reason})
+}
+
+// writeFailed 发送队列写入矿机连接失败（如 broken pipe），在写入 goroutine 中调用
+func (down *DownSessionBTC) writeFailed(err error) {
+	down.SendEvent(EventConnBroken{"write failed: " + err.Error()})
 }
 
 func (down *DownSessionBTC) sendBytes(e EventSendBytes) {
-	if glog.V(12) {
-		glog.Info(down.id, "sendBytes: ", string(e.Content))
+	if glog.V(12) || LogJSONRPC.V(12) {
+		Log.Info(down.id, "sendBytes: ", string(e.Content))
 	}
-	_, err := down.clientConn.Write(e.Content)
+	_, err := down.sendQueue.Write(e.Content)
 	if err != nil {
-		glog.Error(down.id, "failed to send notify to miner: ", err.Error())
+		Log.Error(down.id, "failed to send notify to miner: ", err.Error())
+		down.sessionLog.SetReason("failed to send notify to miner: " + err.Error())
 		down.close()
 	}
 }
 
+// setVersionMask 转发矿池的版本掩码。掩码为 0 时矿机应停止滚动版本位，
+// 之后不带版本位的 share 不再被 disconnect_when_lost_asicboost 当作 AsicBoost 丢失
+func (down *DownSessionBTC) setVersionMask(e EventSetVersionMask) {
+	if e.VersionMask == 0 {
+		down.versionRollingShareCounter = 0
+	}
+	down.sendBytes(EventSendBytes{e.Content})
+}
+
+// setGoal 转发矿池的 mining.set_goal，矿机不支持时忽略
+func (down *DownSessionBTC) setGoal(e EventSetGoal) {
+	if !down.supportSetGoal {
+		if !down.setGoalIgnored {
+			Log.Info(down.id, "miner does not support set-goal extension, ignore mining.set_goal from pool server")
+			down.setGoalIgnored = true
+		}
+		return
+	}
+	down.sendBytes(EventSendBytes{e.Content})
+}
+
+// addOutstandingSubmit 记录一个转发给矿池的 share。未响应的 share 达到上限时返回 false，
+// 以免矿池变慢时未响应的 share 无限增长。
+func (down *DownSessionBTC) addOutstandingSubmit() bool {
+	max := down.manager.config.Advanced.MaxOutstandingSubmitsPerMinerConnection
+	if max > 0 && down.outstandingSubmits >= max {
+		Log.Warning(down.id, "reject share locally: ", down.outstandingSubmits, " submits are still waiting for responses of pool server")
+		down.manager.metrics.OutstandingSubmitsRejected.Inc()
+		return false
+	}
+	down.outstandingSubmits++
+	down.manager.metrics.OutstandingSubmits.Add(1)
+	return true
+}
+
+// resetOutstandingSubmits 矿池连接断开或矿机断开后，未响应的 share 不会再收到响应
+func (down *DownSessionBTC) resetOutstandingSubmits() {
+	down.manager.metrics.OutstandingSubmits.Add(-float64(down.outstandingSubmits))
+	down.outstandingSubmits = 0
+}
+
 func (down *DownSessionBTC) submitResponse(e EventSubmitResponse) {
+	if down.outstandingSubmits > 0 {
+		down.outstandingSubmits--
+		down.manager.metrics.OutstandingSubmits.Add(-1)
+	}
+
 	var response JSONRPCResponse
 	response.ID = e.ID
 	if e.Status.IsAccepted() {
 		response.Result = true
 	} else {
-		response.Error = e.Status.ToJSONRPCArray(nil)
+		response.Error = down.jsonRPCError(e.Status.ToStratumError())
+	}
+	if e.FakeJob {
+		// 假任务的 share 没有实际的工作量，只为让矿机保持连接
+		down.manager.metrics.FakeJobSubmits.Inc()
+	} else {
+		down.manager.addShare(down.subAccountName, e.Status.IsAccepted(), down.difficulty)
+		if e.Status.IsAccepted() {
+			down.hashrate.AddAccepted(down.difficulty)
+		}
+		down.sessionLog.AddShare(e.Status.IsAccepted())
 	}
 
 	_, err := down.writeJSONResponse(&response)
 	if err != nil {
-		glog.Error(down.id, "failed to send share response to miner: ", err.Error())
+		Log.Error(down.id, "failed to send share response to miner: ", err.Error())
+		down.sessionLog.SetReason("failed to send share response to miner: " + err.Error())
 		down.close()
+		return
+	}
+
+	// 轮换连接时等待的 share 都已得到响应
+	if down.outstandingSubmits == 0 && !down.rotateTime.IsZero() && down.reconnectTime.IsZero() {
+		down.rotateSession()
 	}
 }
 
@@ -488,33 +1127,98 @@ func (down *DownSessionBTC) exit() {
 	down.close()
 }
 
+// jsonRPCError 按 miner_error_format 转换发给矿机的错误
+func (down *DownSessionBTC) jsonRPCError(err *StratumError) interface{} {
+	return err.ToJSONRPCError(down.manager.config.MinerErrorFormat, nil)
+}
+
+// countUnauthorizedMessages 统计认证之前收到的请求数，超过 miner_max_unauthorized_messages 时断开连接并返回 false
+func (down *DownSessionBTC) countUnauthorizedMessages(n int) bool {
+	if down.stat == StatAuthorized {
+		return true
+	}
+	if n < 1 {
+		n = 1
+	}
+	down.unauthorizedMessages += uint(n)
+	max := down.manager.config.Advanced.MinerMaxUnauthorizedMessages
+	if max < 1 || down.unauthorizedMessages <= max {
+		return true
+	}
+	Log.Warning(down.id, "miner sent ", down.unauthorizedMessages, " requests without authorizing, disconnect it")
+	down.close()
+	return false
+}
+
+// authorizeTimeout 矿机未在 miner_authorize_timeout_seconds 内完成认证时断开连接
+func (down *DownSessionBTC) authorizeTimeout() {
+	if down.stat == StatAuthorized {
+		return
+	}
+	Log.Warning(down.id, "miner did not authorize in ", down.manager.config.Advanced.MinerAuthorizeTimeoutSeconds, " seconds, disconnect it")
+	down.close()
+}
+
 func (down *DownSessionBTC) poolNotReady() {
-	glog.Warning(down.id, "pool connection not ready")
+	Log.Warning(down.id, "pool connection not ready")
+	down.sessionLog.SetReason("pool connection not ready")
 	down.exit()
 }
 
 func (down *DownSessionBTC) handleEvent() {
 	down.eventLoopRunning = true
 	for down.eventLoopRunning {
-		event := <-down.eventChannel
+		var event interface{}
+		select {
+		case event = <-down.eventChannel:
+		case <-down.ctx.Done():
+			down.sessionLog.SetReason("agent stopping")
+			down.sendPendingSubmitResponses()
+			if down.eventLoopRunning {
+				down.exit()
+			}
+			return
+		}
 
 		switch e := event.(type) {
 		case EventSetUpSession:
 			down.setUpSession(e)
 		case EventRecvJSONRPCBTC:
 			down.recvJSONRPC(e)
+		case EventRecvJSONRPCBatchBTC:
+			down.recvJSONRPCBatch(e)
 		case EventSendBytes:
 			down.sendBytes(e)
+		case EventMiningNotifyBTC:
+			down.sendBytes(EventSendBytes{e.Content})
+		case EventSetDifficultyBTC:
+			down.difficulty = e.Difficulty
+			down.sendBytes(EventSendBytes{e.Content})
+			down.sessionLog.Start(down.id, down.sessionLogInfo())
+		case EventSetVersionMask:
+			down.setVersionMask(e)
+		case EventSetGoal:
+			down.setGoal(e)
+		case EventPingMiner:
+			down.pingMiner()
+		case EventRotateSession:
+			down.rotateSession()
 		case EventSubmitResponse:
 			down.submitResponse(e)
 		case EventConnBroken:
+			down.sessionLog.SetReason(e.Reason)
 			down.close()
+		case EventKickDownSession:
+			down.kick(e)
 		case EventExit:
+			down.sessionLog.SetReason("disconnected by agent")
 			down.exit()
 		case EventPoolNotReady:
 			down.poolNotReady()
+		case EventAuthorizeTimeout:
+			down.authorizeTimeout()
 		default:
-			glog.Error(down.id, "unknown event: ", e)
+			Log.Error(down.id, "unknown event: ", e)
 		}
 	}
 }
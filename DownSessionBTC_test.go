@@ -0,0 +1,832 @@
+package btcagent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func recvTestJSONRPCBatchBTC(t *testing.T, batch string) (line []byte) {
+	manager := NewSessionManager(NewConfig())
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	down := NewDownSessionBTC(manager, server, 1)
+	go down.recvJSONRPCBatch(down.parseJSONRPCBatch([]byte(batch)))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read response failed: %s", err.Error())
+	}
+	return
+}
+
+func TestDownSessionBTCBatchRequest(t *testing.T) {
+	line := recvTestJSONRPCBatchBTC(t, `[`+
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.0"]},`+
+		`5,`+
+		`{"id":2,"method":"mining.unknown","params":[]},`+
+		`{"id":3,"method":"mining.subscribe","params":[]}`+
+		`]`)
+
+	var responses []JSONRPCResponse
+	err := json.Unmarshal(line, &responses)
+	if err != nil {
+		t.Fatalf("response is not a batch: %s, %s", string(line), err.Error())
+	}
+	if len(responses) != 4 {
+		t.Fatalf("wrong response number: %v", responses)
+	}
+	if responses[0].ID != float64(1) || responses[0].Result == nil || responses[0].Error != nil {
+		t.Errorf("subscribe should succeed: %v", responses[0])
+	}
+	if responses[1].ID != nil || responses[1].Error == nil {
+		t.Errorf("illegal element should get an error: %v", responses[1])
+	}
+	if responses[2].ID != float64(2) || responses[2].Error == nil {
+		t.Errorf("unknown method should get an error: %v", responses[2])
+	}
+	errArr, _ := responses[3].Error.([]interface{})
+	if responses[3].ID != float64(3) || len(errArr) < 1 || errArr[0] != float64(StratumErrDuplicateSubscribed.ErrNo) {
+		t.Errorf("duplicate subscribe should be rejected: %v", responses[3])
+	}
+}
+
+func TestDownSessionBTCBatchTooLarge(t *testing.T) {
+	batch := "["
+	for i := 0; i <= DownSessionMaxBatchSize; i++ {
+		if i > 0 {
+			batch += ","
+		}
+		batch += `{"id":1,"method":"mining.subscribe","params":[]}`
+	}
+	batch += "]"
+
+	line := recvTestJSONRPCBatchBTC(t, batch)
+	var response JSONRPCResponse
+	err := json.Unmarshal(line, &response)
+	if err != nil || response.Error == nil {
+		t.Errorf("oversized batch should be rejected as a whole: %s", string(line))
+	}
+}
+
+func TestDownSessionBTCErrorFormat(t *testing.T) {
+	for format, expected := range map[string]string{
+		MinerErrorFormatArray:  `{"id":5,"result":null,"error":[23,"Low difficulty",null]}`,
+		MinerErrorFormatObject: `{"id":5,"result":null,"error":{"code":23,"data":null,"message":"Low difficulty"}}`,
+	} {
+		config := NewConfig()
+		config.MinerErrorFormat = format
+		manager := NewSessionManager(config)
+		client, server := net.Pipe()
+		down := NewDownSessionBTC(manager, server, 1)
+		go down.submitResponse(EventSubmitResponse{5, STATUS_LOW_DIFFICULTY, false})
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(client).ReadString('\n')
+		if err != nil {
+			t.Fatalf("read response failed: %s", err.Error())
+		}
+		if line != expected+"\n" {
+			t.Errorf("wrong %s error, expected %s, got %s", format, expected, line)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDownSessionBTCMethodCaseInsensitive(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(NewSessionManager(NewConfig()), server, 1)
+
+	for _, method := range []string{"Mining.Subscribe", " mining.SUBSCRIBE\t"} {
+		down.stat = StatConnected
+		result, err := down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: method}, nil)
+		if err != nil || result == nil || down.stat != StatSubScribed {
+			t.Errorf("method %q is not routed to mining.subscribe: %v, %v", method, result, err)
+		}
+	}
+
+	_, err := down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "Mining.Authorize"}, nil)
+	if err != StratumErrIllegalParams && err != StratumErrTooFewParams {
+		t.Errorf("odd-cased mining.authorize is not routed: %v", err)
+	}
+}
+
+func TestDownSessionBTCMultipleWorkers(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.Advanced.MaxWorkersPerMinerConnection = 2
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(NewSessionManager(config), server, 1)
+
+	authorize := func(name string) *StratumError {
+		_, err := down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "mining.authorize", Params: []interface{}{name, "x"}}, nil)
+		return err
+	}
+
+	down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "mining.subscribe", Params: []interface{}{}}, nil)
+	if err := authorize("alice.w1"); err != nil || down.stat != StatAuthorized {
+		t.Fatalf("first authorize failed: %v", err)
+	}
+	if err := authorize("alice.w2"); err != nil {
+		t.Errorf("second authorize failed: %v", err)
+	}
+	if err := authorize("alice.w1"); err != nil {
+		t.Errorf("authorize an authorized worker again failed: %v", err)
+	}
+	if err := authorize("bob.w3"); err != StratumErrSubAccountMismatch {
+		t.Errorf("worker of another sub-account should be rejected: %v", err)
+	}
+	if err := authorize("alice.w3"); err != StratumErrTooManyWorkers {
+		t.Errorf("worker over the limit should be rejected: %v", err)
+	}
+
+	if workers := down.workers.Snapshot(); len(workers) != 2 || down.fullName != "alice.w1" || down.subAccountName != "alice" {
+		t.Fatalf("wrong workers: %v, %s", workers, down.fullName)
+	}
+	if worker, _ := down.workers.Submit("alice.w2"); worker.FullName != "alice.w2" {
+		t.Errorf("submit of alice.w2 is not attributed to it: %v", worker)
+	}
+	if worker, _ := down.workers.Submit("w2"); worker.FullName != "alice.w2" {
+		t.Errorf("submit of w2 is not attributed to alice.w2: %v", worker)
+	}
+	if worker, _ := down.workers.Submit("alice.unknown"); worker.FullName != "alice.w1" {
+		t.Errorf("submit of an unknown worker should be attributed to the first worker: %v", worker)
+	}
+	if workers := down.workers.Snapshot(); workers[0].Submits != 1 || workers[1].Submits != 2 {
+		t.Errorf("wrong submit counts: %v", workers)
+	}
+}
+
+func TestDownSessionBTCOutstandingSubmits(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.SubmitResponseFromServer = true
+	config.Advanced.MaxOutstandingSubmitsPerMinerConnection = 8
+	config.sessionFactory = new(SessionFactoryBTC)
+	manager := NewSessionManager(config)
+
+	// 矿池读取 share 但从不响应
+	poolConn, agentConn := net.Pipe()
+	defer poolConn.Close()
+	defer agentConn.Close()
+	go io.Copy(ioutil.Discard, poolConn)
+
+	up := NewUpSessionBTC(NewUpSessionManager("test", "", config, manager), config, 0, 0)
+	up.serverConn = agentConn
+	up.stat = StatAuthorized
+	up.serverCapSubmitResponse = true
+	go up.handleEvent()
+	defer up.SendEvent(EventExit{})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, client)
+	down := NewDownSessionBTC(manager, server, 1)
+	down.stat = StatAuthorized
+	down.upSession = up
+	down.workers.Reset(DownSessionWorker{Name: "alice.w1", FullName: "alice.w1", SubAccountName: "alice", WorkerName: "w1"})
+
+	rejected := 0
+	for i := 0; i < 20; i++ {
+		_, err := down.parseMiningSubmit(&JSONRPCLineBTC{ID: i, Method: "mining.submit",
+			Params: []interface{}{"alice.w1", "1", "00000000", "5f5e1000", "12345678"}})
+		if err == StratumErrTooManyOutstandingSubmits {
+			rejected++
+		} else if err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+	}
+
+	if rejected != 12 || down.outstandingSubmits != 8 {
+		t.Errorf("wrong outstanding submits: %d rejected, %d outstanding", rejected, down.outstandingSubmits)
+	}
+	if manager.metrics.OutstandingSubmits.Get() != 8 || manager.metrics.OutstandingSubmitsRejected.Get() != 12 {
+		t.Errorf("wrong metrics: %v, %v", manager.metrics.OutstandingSubmits.Get(), manager.metrics.OutstandingSubmitsRejected.Get())
+	}
+	// 在本地拒绝的 share 不计入矿工提交的 share 数
+	if workers := down.workers.Snapshot(); workers[0].Submits != 8 {
+		t.Errorf("rejected shares should not be counted as submits: %d", workers[0].Submits)
+	}
+
+	// 矿池响应后可以继续提交
+	down.submitResponse(EventSubmitResponse{1, STATUS_ACCEPT, false})
+	if down.outstandingSubmits != 7 || !down.addOutstandingSubmit() {
+		t.Errorf("outstanding submits are not released by the response")
+	}
+}
+
+func TestDownSessionBTCFakeJobSubmitResponse(t *testing.T) {
+	manager := NewSessionManager(NewConfig())
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, client)
+	down := NewDownSessionBTC(manager, server, 1)
+	down.subAccountName = "alice"
+	down.difficulty = 1000
+
+	// 假任务的 share 响应为接受，但不计入 share 统计和算力
+	down.submitResponse(EventSubmitResponse{1, STATUS_ACCEPT, true})
+	if stats := manager.shareStats.Snapshot(); len(stats.SubAccounts) != 0 {
+		t.Errorf("shares on the fake job should not be counted: %+v", stats)
+	}
+	if manager.metrics.AcceptedDifficulty.Get() != 0 || !down.hashrate.LastAccepted().IsZero() {
+		t.Errorf("shares on the fake job should not count as work")
+	}
+	if manager.metrics.FakeJobSubmits.Get() != 1 {
+		t.Errorf("wrong fake job submits: %v", manager.metrics.FakeJobSubmits.Get())
+	}
+
+	down.submitResponse(EventSubmitResponse{2, STATUS_ACCEPT, false})
+	if stats := manager.shareStats.Snapshot(); stats.SubAccounts["alice"].Accepted != 1 {
+		t.Errorf("wrong share stats: %+v", stats)
+	}
+}
+
+func TestDownSessionBTCPing(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(NewSessionManager(NewConfig()), server, 1)
+
+	result, err := down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "mining.ping"}, nil)
+	if err != nil || result != "pong" {
+		t.Errorf("wrong response of mining.ping: %v, %v", result, err)
+	}
+
+	// 矿机对 mining.ping 的响应及 mining.pong 通知都不需要回复
+	for _, request := range []*JSONRPCLineBTC{{ID: "ping", Result: "pong"}, {ID: "ping", Error: JSONRPCArray{20, "unknown method", nil}}, {Method: "mining.pong"}} {
+		result, err := down.stratumHandleRequest(request, nil)
+		if result != nil || err != nil {
+			t.Errorf("%v should not be replied: %v, %v", request, result, err)
+		}
+	}
+}
+
+func TestDownSessionBTCIdlePing(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MinerPingIntervalSeconds = 1
+	client, server := net.Pipe()
+	defer client.Close()
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	down := NewDownSessionBTC(manager, server, 1)
+	down.stat = StatAuthorized
+	go down.Run()
+
+	reader := bufio.NewReader(client)
+	readPing := func() {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("idle miner is not pinged: %v", err)
+		}
+		request, err := NewJSONRPCRequest([]byte(line))
+		if err != nil || request.Method != "mining.ping" {
+			t.Fatalf("wrong ping request: %s", line)
+		}
+	}
+
+	// 响应 mining.ping 的矿机不会被断开
+	readPing()
+	rpcData, _ := NewJSONRPCLineBTC([]byte(`{"id":"ping","result":"pong","error":null}`))
+	down.SendEvent(EventRecvJSONRPCBTC{rpcData, nil})
+	readPing()
+
+	// 不再响应，再空闲一个周期后断开连接
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := reader.ReadString('\n')
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Errorf("idle miner is not disconnected: %v", err)
+	}
+}
+
+func TestDownSessionBTCVersionMethods(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(NewSessionManager(NewConfig()), server, 1)
+
+	result, err := down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "client.get_version", Params: JSONRPCArray{}}, nil)
+	if err != nil || result != UpSessionUserAgent {
+		t.Errorf("wrong response of client.get_version: %v, %v", result, err)
+	}
+
+	result, err = down.stratumHandleRequest(&JSONRPCLineBTC{ID: 2, Method: "mining.multi_version", Params: JSONRPCArray{1}}, nil)
+	if err != nil || result != true {
+		t.Errorf("wrong response of mining.multi_version: %v, %v", result, err)
+	}
+}
+
+func TestDownSessionBTCEventOverflow(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MessageQueueSize.MinerSession = 2
+	config.Advanced.MessageQueueOverflow.MinerNotify = EventOverflowDrop
+	manager := NewSessionManager(config)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 事件循环未运行，通道很快被填满
+	down := NewDownSessionBTC(manager, server, 1)
+	for i := 0; i < 5; i++ {
+		down.SendEvent(EventMiningNotifyBTC{[]byte("notify\n")})
+	}
+	down.SendEvent(EventPingMiner{})
+	if len(down.eventChannel) != 2 {
+		t.Errorf("wrong number of queued events: %d", len(down.eventChannel))
+	}
+	if dropped := manager.metrics.DroppedEvents.Get("class", EventClassMinerNotify); dropped != 3 {
+		t.Errorf("wrong number of dropped notifies: %v", dropped)
+	}
+	if dropped := manager.metrics.DroppedEvents.Get("class", EventClassTimer); dropped != 1 {
+		t.Errorf("wrong number of dropped timer events: %v", dropped)
+	}
+
+	// share 的响应不能丢弃，等待事件循环处理
+	sent := make(chan bool)
+	go func() {
+		down.SendEvent(EventSubmitResponse{1, STATUS_ACCEPT, false})
+		sent <- true
+	}()
+	select {
+	case <-sent:
+		t.Fatalf("submit response should wait for the full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-down.eventChannel
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("submit response is not queued")
+	}
+
+	// 策略为 block 时，新任务同样等待
+	config.Advanced.MessageQueueOverflow.MinerNotify = EventOverflowBlock
+	go func() {
+		down.SendEvent(EventMiningNotifyBTC{[]byte("notify\n")})
+		sent <- true
+	}()
+	select {
+	case <-sent:
+		t.Fatalf("notify should wait for the full queue with block policy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-down.eventChannel
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notify is not queued")
+	}
+	if dropped := manager.metrics.DroppedEvents.Get("class", EventClassMinerNotify); dropped != 3 {
+		t.Errorf("notify is dropped with block policy: %v", dropped)
+	}
+}
+
+func TestDownSessionBTCSessionLog(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	down := NewDownSessionBTC(manager, server, 7)
+
+	output := captureLog(t, func() {
+		down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "mining.subscribe", Params: []interface{}{}}, nil)
+		down.stratumHandleRequest(&JSONRPCLineBTC{ID: 2, Method: "mining.authorize", Params: []interface{}{"alice.w1", "x"}}, nil)
+
+		down.SendEvent(EventSetDifficultyBTC{4096, []byte(`{"id":null,"method":"mining.set_difficulty","params":[4096]}` + "\n")})
+		// 难度变化不再打印连接日志
+		down.SendEvent(EventSetDifficultyBTC{8192, []byte(`{"id":null,"method":"mining.set_difficulty","params":[8192]}` + "\n")})
+		down.SendEvent(EventSubmitResponse{1, STATUS_ACCEPT, false})
+		down.SendEvent(EventSubmitResponse{2, STATUS_ACCEPT, false})
+		down.SendEvent(EventSubmitResponse{3, STATUS_LOW_DIFFICULTY, false})
+		down.SendEvent(EventConnBroken{"closed by miner"})
+		down.handleEvent()
+		// 重复关闭也只打印一次断开日志
+		down.close()
+	})
+
+	remote := ConnRemoteAddr(server)
+	started := "miner session started: ip=" + remote + " sub_account=alice worker=w1 session_id=7 difficulty=4096\n"
+	ended := "miner session ended: ip=" + remote + ` sub_account=alice worker=w1 session_id=7 difficulty=8192 reason="closed by miner" duration=0s shares=3 rejected=1` + "\n"
+	if strings.Count(output, "miner session started") != 1 || !strings.Contains(output, started) {
+		t.Errorf("wrong connect log, expected %s:\n%s", started, output)
+	}
+	if strings.Count(output, "miner session ended") != 1 || !strings.Contains(output, ended) {
+		t.Errorf("wrong disconnect log, expected %s:\n%s", ended, output)
+	}
+
+	// 认证之前断开的连接不打印
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	down = NewDownSessionBTC(manager, server2, 8)
+	output = captureLog(t, func() {
+		down.SendEvent(EventConnBroken{"closed by miner"})
+		down.handleEvent()
+	})
+	if strings.Contains(output, "miner session") {
+		t.Errorf("unauthorized connection should not be logged:\n%s", output)
+	}
+}
+
+func TestDownSessionBTCRotateSession(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.Advanced.MinerSessionMaxLifetimeSeconds = 1
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	lines := make(chan string, 16)
+	go func() {
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	down := NewDownSessionBTC(manager, server, 1)
+	down.stratumHandleRequest(&JSONRPCLineBTC{ID: 1, Method: "mining.subscribe", Params: []interface{}{}}, nil)
+	down.stratumHandleRequest(&JSONRPCLineBTC{ID: 2, Method: "mining.authorize", Params: []interface{}{"alice.w1", "x"}}, nil)
+	// 一个已转发给矿池、尚未得到响应的 share
+	down.addOutstandingSubmit()
+
+	done := make(chan bool)
+	go down.handleRequest()
+	go func() {
+		down.Run()
+		close(done)
+	}()
+
+	// 达到最长时间后，share 得到响应之前不发送 client.reconnect
+	select {
+	case line := <-lines:
+		t.Fatalf("unexpected message before the share response: %s", line)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	down.SendEvent(EventSubmitResponse{5, STATUS_ACCEPT, false})
+	select {
+	case line := <-lines:
+		if line != `{"id":5,"result":true,"error":null}`+"\n" {
+			t.Errorf("wrong share response: %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("share response is lost")
+	}
+	select {
+	case line := <-lines:
+		if line != `{"id":null,"method":"client.reconnect","params":[]}`+"\n" {
+			t.Errorf("wrong message after the share response: %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client.reconnect is not sent after the session lifetime")
+	}
+
+	// 矿机收到 client.reconnect 后断开
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session is not closed after the miner disconnected")
+	}
+	if down.sessionLog.reason != "session lifetime exceeded" {
+		t.Errorf("wrong disconnect reason: %s", down.sessionLog.reason)
+	}
+}
+
+func TestDownSessionBTCUnauthorizedFlood(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MinerMaxUnauthorizedMessages = 4
+	client, server := net.Pipe()
+	defer client.Close()
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	down := NewDownSessionBTC(manager, server, 1)
+	done := make(chan struct{})
+	go func() {
+		down.Init()
+		close(done)
+	}()
+
+	// 反复订阅、从不认证的矿机在超过请求数限制后被断开
+	go func() {
+		for i := 0; i < 10; i++ {
+			_, err := client.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	reader := bufio.NewReader(client)
+	responses := 0
+	for {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := reader.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("miner flooding mining.subscribe is not disconnected")
+			}
+			break
+		}
+		responses++
+	}
+	if responses != 4 {
+		t.Errorf("miner should be disconnected after 4 requests, got %d responses", responses)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Init() does not return")
+	}
+	if down.Stat() == StatAuthorized {
+		t.Errorf("wrong stat after disconnecting: %v", down.Stat())
+	}
+}
+
+func TestDownSessionBTCAuthorizeTimeout(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MinerAuthorizeTimeoutSeconds = 1
+	client, server := net.Pipe()
+	defer client.Close()
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	down := NewDownSessionBTC(manager, server, 1)
+	go down.Init()
+
+	reader := bufio.NewReader(client)
+	client.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("failed to read subscribe response: %v", err)
+	}
+
+	// 订阅后一直不认证，超时后断开连接
+	start := time.Now()
+	_, err := reader.ReadString('\n')
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Fatalf("unauthorized miner is not disconnected: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("miner disconnected too late: %s", elapsed)
+	}
+}
+
+func TestDownSessionBTCNonStratumInput(t *testing.T) {
+	inputs := map[string]string{
+		"http": "GET / HTTP/1.1\r\nHost: 127.0.0.1:3333\r\nUser-Agent: curl/7.68.0\r\n\r\n",
+		"tls":  "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03",
+		"utf8": "{\"id\":1,\"method\":\"\xff\xfe\"}\n",
+	}
+	for name, input := range inputs {
+		config := NewConfig()
+		client, server := net.Pipe()
+		manager := NewSessionManager(config)
+		manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+		down := NewDownSessionBTC(manager, server, 1)
+		go down.Init()
+
+		go client.Write([]byte(input))
+		start := time.Now()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := bufio.NewReader(client).ReadString('\n')
+		if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+			t.Errorf("%s: miner sending non-stratum data is not disconnected: %v", name, err)
+		} else if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: miner disconnected too late: %s", name, elapsed)
+		}
+		client.Close()
+	}
+
+	// 收到有效的 JSON 之后的无法解析的行，以及 respond 模式下的非 Stratum 数据都会得到响应
+	for _, mode := range []string{NonStratumInputDisconnect, NonStratumInputRespond} {
+		config := NewConfig()
+		config.NonStratumInput = mode
+		client, server := net.Pipe()
+		manager := NewSessionManager(config)
+		manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+		down := NewDownSessionBTC(manager, server, 1)
+		go down.Init()
+
+		input := "GET / HTTP/1.1\r\n"
+		if mode == NonStratumInputDisconnect {
+			input = `{"id":1,"method":"mining.subscribe","params":[]}` + "\n" + input
+		}
+		go client.Write([]byte(input))
+		reader := bufio.NewReader(client)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Errorf("%s: failed to read response: %v", mode, err)
+		}
+		client.Close()
+	}
+}
+
+func TestDownSessionBTCSubAccountNotAllowed(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800}}
+	config.SubAccountAllowlist.SubAccounts = []string{"alice"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Init failed: %s", err.Error())
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	manager := NewSessionManager(config)
+	manager.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	down := NewDownSessionBTC(manager, server, 1)
+	done := make(chan struct{})
+	go func() {
+		down.Init()
+		close(done)
+	}()
+
+	// 不在允许列表中的子账户收到错误后被断开
+	go client.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["mallory.w1","x"]}` + "\n"))
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("miner of a disallowed sub-account is not disconnected")
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], `{"id":2,`) || !strings.Contains(lines[1], `[110,"Sub-account Not Allowed"`) {
+		t.Errorf("wrong responses: %q", lines)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Init() does not return")
+	}
+	if down.Stat() == StatAuthorized {
+		t.Errorf("miner of a disallowed sub-account should not be authorized")
+	}
+}
+
+func TestDownSessionBTCSubmitBeforeAuthorize(t *testing.T) {
+	var submits int32
+	registered := make(chan struct{}, 1)
+	pool := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			switch header.Type {
+			case CMD_REGISTER_WORKER:
+				registered <- struct{}{}
+			case CMD_SUBMIT_SHARE, CMD_SUBMIT_SHARE_WITH_TIME, CMD_SUBMIT_SHARE_WITH_VER, CMD_SUBMIT_SHARE_WITH_TIME_VER:
+				atomic.AddInt32(&submits, 1)
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner, agentConn := net.Pipe()
+	defer miner.Close()
+	go manager.RunDownSession(agentConn)
+	go miner.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.submit","params":["test.w1","1","00000000","5f5e1000","00000000"]}` + "\n"))
+
+	// 认证之前的提交以 Unauthorized worker 错误拒绝
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(miner)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the response of submit: %v", err)
+		}
+		if strings.HasPrefix(line, `{"id":2,`) {
+			var response struct {
+				Error []interface{} `json:"error"`
+			}
+			json.Unmarshal([]byte(line), &response)
+			if len(response.Error) < 1 || response.Error[0] != float64(StratumErrNeedAuthorized.ErrNo) {
+				t.Errorf("submit before authorize should be rejected as unauthorized: %s", line)
+			}
+			break
+		}
+	}
+	if count := manager.metrics.UnauthorizedSubmits.Get(); count != 1 {
+		t.Errorf("wrong btcagent_unauthorized_submits_total: %v", count)
+	}
+
+	// 认证之后矿池只收到矿机注册，没有收到之前的提交
+	go miner.Write([]byte(`{"id":3,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+	go io.Copy(ioutil.Discard, reader)
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner is not registered to pool after authorizing")
+	}
+	if n := atomic.LoadInt32(&submits); n != 0 {
+		t.Errorf("submit before authorize should not be forwarded to pool, got %d", n)
+	}
+}
+
+func TestDownSessionBTCDeclaredHashrate(t *testing.T) {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.Advanced.ForwardDeclaredHashrate = true
+	config.sessionFactory = new(SessionFactoryBTC)
+	manager := NewSessionManager(config)
+
+	poolConn, agentConn := net.Pipe()
+	defer poolConn.Close()
+	defer agentConn.Close()
+
+	up := NewUpSessionBTC(NewUpSessionManager("test", "", config, manager), config, 0, 0)
+	up.serverConn = agentConn
+	up.stat = StatAuthorized
+	up.serverCapSubmitHashrate = true
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, client)
+	down := NewDownSessionBTC(manager, server, 1)
+	down.stat = StatAuthorized
+	down.upSession = up
+	down.difficulty = 1000
+	down.hashrate.Start(time.Now().Add(-time.Second))
+	up.downSessions[down.sessionID] = down
+	go up.handleEvent()
+	defer up.SendEvent(EventExit{})
+
+	// 不声明算力的矿机
+	if status := down.status(); status.DeclaredHashrate != 0 {
+		t.Errorf("miner without a declaration should not have a declared hashrate: %v", status)
+	}
+
+	_, err := down.parseHashrate(&JSONRPCLineBTC{ID: 1, Method: "mining.hashrate", Params: []interface{}{"alice.w1", "fast"}})
+	if err != StratumErrIllegalParams {
+		t.Errorf("illegal declaration should be rejected: %v", err)
+	}
+	result, err := down.parseHashrate(&JSONRPCLineBTC{ID: 2, Method: "mining.hashrate", Params: []interface{}{"alice.w1", float64(1.2e14)}})
+	if err != nil || result != true {
+		t.Errorf("declaration should be accepted: %v, %v", result, err)
+	}
+
+	// 矿池收到转发的算力
+	reader := bufio.NewReader(poolConn)
+	poolConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header ExMessageHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil || header.Type != CMD_SUBMIT_HASHRATE || header.Size != 4+2+8 {
+		t.Fatalf("pool did not receive the declared hashrate: %v, %v", header, err)
+	}
+	var msg ExMessageSubmitHashrate
+	if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil || msg.SessionID != down.sessionID || msg.Hashrate != 1.2e14 {
+		t.Errorf("wrong declared hashrate forwarded: %v, %v", msg, err)
+	}
+	go io.Copy(ioutil.Discard, reader)
+
+	// 扩展的 mining.submit 更新声明的算力
+	_, stratumErr := down.parseMiningSubmit(&JSONRPCLineBTC{ID: 3, Method: "mining.submit",
+		Params: []interface{}{"alice.w1", "1", "00000000", "5f5e1000", "12345678", map[string]interface{}{"hashrate": "1.1e14"}}})
+	if stratumErr != nil {
+		t.Fatalf("extended submit failed: %v", stratumErr)
+	}
+	down.submitResponse(EventSubmitResponse{3, STATUS_ACCEPT, false})
+
+	status := down.status()
+	if status.DeclaredHashrate != 1.1e14 || status.EstimatedHashrate <= 0 {
+		t.Errorf("wrong hashrate in status: %v", status)
+	}
+	if manager.metrics.DeclaredHashrate.Get() != 1.1e14 || manager.metrics.AcceptedDifficulty.Get() != 1000 {
+		t.Errorf("wrong hashrate metrics: %v, %v", manager.metrics.DeclaredHashrate.Get(), manager.metrics.AcceptedDifficulty.Get())
+	}
+}
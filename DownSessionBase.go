@@ -1,10 +1,177 @@
-package main
+package btcagent
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
 
 type DownSession interface {
 	SessionID() uint16
 	SubAccountName() string
+	Password() string
+	UserAgent() string
 	Stat() AuthorizeStat
 	Init()
 	Run()
 	SendEvent(event interface{})
 }
+
+// DownSessionWorker 矿机连接上认证的矿工
+type DownSessionWorker struct {
+	Name           string `json:"name"`        // 矿机提供的矿工名（未替换矿机名）
+	FullName       string `json:"full_name"`   // 完整的矿工名
+	SubAccountName string `json:"sub_account"` // 子账户名部分
+	WorkerName     string `json:"worker_name"` // 矿机名部分
+	Submits        uint64 `json:"submits"`     // 提交的 share 数
+}
+
+// MatchName 判断 mining.submit 中的矿工名是否为该矿工。
+// 有些挖矿软件提交时只提供“.”之后的矿机名。
+func (worker *DownSessionWorker) MatchName(name string) bool {
+	return worker.Name == name || strings.HasSuffix(worker.Name, "."+name)
+}
+
+// DownSessionWorkers 矿机连接上认证的所有矿工，第一个为最先认证的矿工（即矿机连接的 fullName 等字段）。
+// 由矿机连接更新，可以在任意 goroutine 中读取（如管理命令 sessions）。
+type DownSessionWorkers struct {
+	lock    sync.Mutex
+	workers []DownSessionWorker
+}
+
+// Reset 矿机连接的第一个矿工认证成功
+func (w *DownSessionWorkers) Reset(worker DownSessionWorker) {
+	w.lock.Lock()
+	w.workers = []DownSessionWorker{worker}
+	w.lock.Unlock()
+}
+
+// Add 添加同一连接上的其他矿工，已认证过的矿工直接返回 true，矿工数已达到 max 时返回 false
+func (w *DownSessionWorkers) Add(worker DownSessionWorker, max uint) (added bool, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i := range w.workers {
+		if w.workers[i].FullName == worker.FullName {
+			return false, true
+		}
+	}
+	if uint(len(w.workers)) >= max {
+		return false, false
+	}
+	w.workers = append(w.workers, worker)
+	return true, true
+}
+
+// Submit 将 share 计入 mining.submit 中的矿工名 name 对应的矿工（找不到时为最先认证的矿工），返回该矿工。
+// 还没有矿工认证时返回 false。
+func (w *DownSessionWorkers) Submit(name string) (worker DownSessionWorker, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.workers) < 1 {
+		return
+	}
+	index := 0
+	if len(w.workers) > 1 {
+		name = FilterWorkerName(name)
+		for i := range w.workers {
+			if w.workers[i].MatchName(name) {
+				index = i
+				break
+			}
+		}
+	}
+	w.workers[index].Submits++
+	return w.workers[index], true
+}
+
+// Snapshot 获取所有矿工的副本
+func (w *DownSessionWorkers) Snapshot() []DownSessionWorker {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]DownSessionWorker{}, w.workers...)
+}
+
+// ParseWorkerName 解析矿机在 mining.authorize 中提供的矿工名，
+// 并按配置替换矿机名（fixed_worker_name、use_ip_as_worker_name）
+func ParseWorkerName(config *Config, fullWorkerName string, remoteAddr string) (worker DownSessionWorker, err *StratumError) {
+	// 矿工名
+	worker.Name = FilterWorkerName(fullWorkerName)
+	worker.FullName = worker.Name
+
+	// 截取“.”之前的做为子账户名，“.”及之后的做矿机名
+	pos := strings.IndexByte(worker.FullName, '.')
+	if pos >= 0 {
+		worker.SubAccountName = worker.FullName[:pos]
+		worker.WorkerName = worker.FullName[pos+1:]
+	} else {
+		worker.SubAccountName = worker.FullName
+		worker.WorkerName = ""
+	}
+
+	if len(config.FixedWorkerName) > 0 {
+		worker.WorkerName = config.FixedWorkerName
+		worker.FullName = worker.SubAccountName + "." + worker.WorkerName
+	} else if config.UseIpAsWorkerName {
+		worker.WorkerName = IPAsWorkerName(config.IpWorkerNameFormat, remoteAddr)
+		worker.FullName = worker.SubAccountName + "." + worker.WorkerName
+	}
+
+	if config.MultiUserMode {
+		if len(worker.SubAccountName) < 1 {
+			err = StratumErrSubAccountNameEmpty
+			return
+		}
+		if !config.SubAccountAllowed(worker.SubAccountName) {
+			err = StratumErrSubAccountNotAllowed
+			return
+		}
+	} else {
+		worker.SubAccountName = ""
+	}
+
+	if worker.WorkerName == "" {
+		worker.WorkerName = worker.FullName
+		if worker.WorkerName == "" {
+			worker.WorkerName = DefaultWorkerName
+			worker.FullName = worker.SubAccountName + "." + worker.WorkerName
+		}
+	}
+	return
+}
+
+// nonStratumInputPreviewSize 日志中打印的非 Stratum 数据的最大字节数
+const nonStratumInputPreviewSize = 32
+
+// IsNonStratumInput 判断矿机连接上收到的第一段数据是否明显不是 Stratum 协议：
+// 第一个非空白字节不是 '{' 或 '['（如 HTTP 请求、TLS 握手），或者其中有非 UTF-8 的二进制数据。
+// 只有空白字节时无法判断，返回 false。
+func IsNonStratumInput(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) < 1 {
+		return false
+	}
+	if trimmed[0] != '{' && trimmed[0] != '[' {
+		return true
+	}
+	return !utf8.Valid(trimmed)
+}
+
+// nonStratumInputHead 获取第一次读到的数据中开头的一个非空白字节，用于在收到完整的一行之前检查。
+// 数据可能在多字节字符中间截断，所以不检查其余部分
+func nonStratumInputHead(buffered []byte) []byte {
+	trimmed := bytes.TrimLeft(buffered, " \t\r\n")
+	if len(trimmed) > 1 {
+		return trimmed[:1]
+	}
+	return trimmed
+}
+
+// nonStratumInputPreview 获取日志中打印的非 Stratum 数据的开头部分
+func nonStratumInputPreview(data []byte) string {
+	if len(data) > nonStratumInputPreviewSize {
+		return strconv.Quote(string(data[:nonStratumInputPreviewSize])) + "..."
+	}
+	return strconv.Quote(string(data))
+}
@@ -0,0 +1,83 @@
+package btcagent
+
+import (
+	"fmt"
+	"time"
+)
+
+// DownSessionLogInfo 矿机会话日志中的连接信息
+type DownSessionLogInfo struct {
+	RemoteAddr string // 矿机地址（ConnRemoteAddr）
+	SubAccount string
+	Worker     string
+	SessionID  uint16
+	Difficulty uint64 // 发给矿机的难度，未知时为 0
+}
+
+func (info DownSessionLogInfo) String() string {
+	return fmt.Sprintf("ip=%s sub_account=%s worker=%s session_id=%d difficulty=%d",
+		info.RemoteAddr, info.SubAccount, info.Worker, info.SessionID, info.Difficulty)
+}
+
+// DownSessionLog 矿机会话的生命周期日志，用于排查矿机在某个时间掉线等问题。
+//
+// 每个认证成功的矿机会话只打印一行连接日志和一行断开日志：认证后第一次收到难度时打印连接日志，
+// 断开时打印断开原因、连接时长和提交的 share 数。认证前就断开的连接不打印。
+type DownSessionLog struct {
+	connectTime time.Time
+	authorized  bool
+	started     bool
+	ended       bool
+	accepted    uint64
+	rejected    uint64
+	reason      string // 断开的原因，只记录第一个
+}
+
+func NewDownSessionLog(connectTime time.Time) (log DownSessionLog) {
+	log.connectTime = connectTime
+	return
+}
+
+// SetReason 记录断开的原因，已有原因时不覆盖
+func (log *DownSessionLog) SetReason(reason string) {
+	if len(log.reason) < 1 {
+		log.reason = reason
+	}
+}
+
+func (log *DownSessionLog) Authorized() {
+	log.authorized = true
+}
+
+func (log *DownSessionLog) AddShare(accepted bool) {
+	if accepted {
+		log.accepted++
+	} else {
+		log.rejected++
+	}
+}
+
+// Start 打印连接日志，只在第一次调用时打印
+func (log *DownSessionLog) Start(id string, info DownSessionLogInfo) {
+	if !log.authorized || log.started {
+		return
+	}
+	log.started = true
+	Log.Info(id, "miner session started: ", info)
+}
+
+// End 打印断开日志，只在第一次调用时打印。尚未打印连接日志时先打印。
+func (log *DownSessionLog) End(id string, info DownSessionLogInfo, now time.Time) {
+	if !log.authorized || log.ended {
+		return
+	}
+	log.Start(id, info)
+	log.ended = true
+
+	reason := log.reason
+	if len(reason) < 1 {
+		reason = "unknown"
+	}
+	Log.Info(id, "miner session ended: ", info, fmt.Sprintf(" reason=%q duration=%s shares=%d rejected=%d",
+		reason, now.Sub(log.connectTime).Truncate(time.Second), log.accepted+log.rejected, log.rejected))
+}
@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 import (
 	"math/big"
@@ -6,7 +6,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/golang/glog"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -68,7 +67,7 @@ func (header *ETHPoWHeader) GetExtraWithNonce(extraNonce uint32) (data []byte) {
 	nonce := Uint32ToBin(extraNonce)
 	pos := len(header.Extra) - len(nonce)
 	if pos < 0 {
-		glog.Error("ETHPoWHeader.SetExtraNonce: Extra too small: ", header)
+		Log.Error("ETHPoWHeader.SetExtraNonce: Extra too small: ", header)
 		return
 	}
 	data = make([]byte, len(header.Extra))
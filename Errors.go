@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 import "errors"
 
@@ -33,6 +33,17 @@ func (err *StratumError) ToJSONRPCArray(extData interface{}) interface{} {
 	return JSONRPCArray{err.ErrNo, err.ErrMsg, extData}
 }
 
+// ToJSONRPCError 按 format（miner_error_format）转换为发给矿机的错误
+func (err *StratumError) ToJSONRPCError(format string, extData interface{}) interface{} {
+	if err == nil {
+		return nil
+	}
+	if format == MinerErrorFormatObject {
+		return JSONRPCObj{"code": err.ErrNo, "message": err.ErrMsg, "data": extData}
+	}
+	return err.ToJSONRPCArray(extData)
+}
+
 var (
 	// ErrBufIOReadTimeout 从bufio.Reader中读取数据时超时
 	ErrBufIOReadTimeout = errors.New("bufIO read timeout")
@@ -67,6 +78,16 @@ var (
 	StratumErrWorkerNameMustBeString = NewStratumError(104, "Worker Name Must be a String")
 	// StratumErrSubAccountNameEmpty 子账户名为空
 	StratumErrSubAccountNameEmpty = NewStratumError(105, "Sub-account Name Cannot be Empty")
+	// StratumErrIllegalBatch 批量请求为空或包含的请求太多
+	StratumErrIllegalBatch = NewStratumError(106, "Empty batch or too many requests in a batch")
+	// StratumErrSubAccountMismatch 同一连接上的矿工必须属于同一个子账户
+	StratumErrSubAccountMismatch = NewStratumError(107, "Workers on a Connection Must Belong to the Same Sub-account")
+	// StratumErrTooManyWorkers 同一连接上认证的矿工太多
+	StratumErrTooManyWorkers = NewStratumError(108, "Too Many Workers on a Connection")
+	// StratumErrTooManyOutstandingSubmits 已转发但矿池尚未响应的 share 过多
+	StratumErrTooManyOutstandingSubmits = NewStratumError(109, "Too Many Outstanding Submits")
+	// StratumErrSubAccountNotAllowed 子账户不在 sub_account_allowlist 中
+	StratumErrSubAccountNotAllowed = NewStratumError(110, "Sub-account Not Allowed")
 
 	// StratumErrStratumServerNotFound 找不到对应币种的Stratum Server
 	StratumErrStratumServerNotFound = NewStratumError(301, "Stratum Server Not Found")
@@ -77,6 +98,30 @@ var (
 	StratumErrUnknownChainType = NewStratumError(500, "Unknown Chain Type")
 )
 
+// PermanentAuthorizeErrorCodes 矿池认证失败时，重试也不会成功的错误码
+var PermanentAuthorizeErrorCodes = map[int]struct{}{
+	24:  {}, // Unauthorized worker
+	28:  {}, // IP banned
+	29:  {}, // Invalid username
+	104: {}, // Worker name must be a string
+	105: {}, // Sub-account name cannot be empty
+	200: {}, // Sub-account not found
+	201: {}, // Sub-account banned
+}
+
+var (
+	// AdminErrIllegalRequest 管理命令格式错误
+	AdminErrIllegalRequest = NewStratumError(400, "Illegal request")
+	// AdminErrUnauthorized 管理命令需要认证
+	AdminErrUnauthorized = NewStratumError(401, "Unauthorized")
+	// AdminErrUnknownCommand 未知管理命令
+	AdminErrUnknownCommand = NewStratumError(404, "Unknown command")
+	// AdminErrIllegalParams 管理命令参数非法
+	AdminErrIllegalParams = NewStratumError(422, "Illegal params")
+	// AdminErrTimeout 管理命令执行超时
+	AdminErrTimeout = NewStratumError(504, "Command timeout")
+)
+
 var (
 	// ErrReadFailed IO读错误
 	ErrReadFailed = errors.New("read failed")
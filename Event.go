@@ -1,8 +1,9 @@
-package main
+package btcagent
 
 import (
 	"bufio"
 	"net"
+	"time"
 )
 
 type EventType uint8
@@ -16,10 +17,23 @@ type EventInitFinished struct{}
 type EventUpSessionReady struct {
 	Slot    int
 	Session UpSession
+	Pool    PoolInfo
+	HasJob  bool // 认证过程中已收到矿池的任务
+}
+
+// EventUpSessionWarmedUp 矿池连接收到了第一个任务，或者等待任务超过了 pool_warmup_seconds
+type EventUpSessionWarmedUp struct {
+	Slot    int
+	Session UpSession
+	Timeout bool
 }
 
 type EventUpSessionInitFailed struct {
 	Slot int
+	// 所有矿池均因永久性错误拒绝认证
+	PermanentAuthorizeError bool
+	// 有矿池在响应认证请求之前断开了连接或握手超时，与子账户无关
+	HandshakeInterrupted bool
 }
 
 type EventSetUpSession struct {
@@ -30,7 +44,9 @@ type EventAddDownSession struct {
 	Session DownSession
 }
 
-type EventConnBroken struct{}
+type EventConnBroken struct {
+	Reason string // 断开的原因，用于矿机会话的断开日志
+}
 
 type EventRecvExMessage struct {
 	Message *ExMessage
@@ -46,31 +62,87 @@ type EventRecvJSONRPCETH struct {
 	JSONBytes []byte
 }
 
+// EventRecvJSONRPCBatchBTC 矿机发送的批量请求，RPCData 为 nil 的请求无法解析
+type EventRecvJSONRPCBatchBTC struct {
+	Requests []EventRecvJSONRPCBTC
+	Error    *StratumError
+}
+
+// EventRecvJSONRPCBatchETH 矿机发送的批量请求，RPCData 为 nil 的请求无法解析
+type EventRecvJSONRPCBatchETH struct {
+	Requests []EventRecvJSONRPCETH
+	Error    *StratumError
+}
+
 type EventSendBytes struct {
 	Content []byte
 }
 
+// EventSetVersionMask 发给矿机的 mining.set_version_mask，VersionMask 为矿池允许的版本掩码，为 0 时矿机应停止滚动版本位
+type EventSetVersionMask struct {
+	VersionMask uint32
+	Content     []byte
+}
+
+// EventMiningNotifyBTC 广播给矿机的新任务，矿机的事件通道已满时按 message_queue_overflow.miner_notify 处理
+type EventMiningNotifyBTC struct {
+	Content []byte
+}
+
+// EventSetDifficultyBTC 发给矿机的 mining.set_difficulty，Difficulty 为其中的难度，用于统计 share 的难度
+type EventSetDifficultyBTC struct {
+	Difficulty uint64
+	Content    []byte
+}
+
+// EventMiningNotifyETH 广播给矿机的新任务，矿机的事件通道已满时按 message_queue_overflow.miner_notify 处理
+type EventMiningNotifyETH struct {
+	Job *StratumJobETH
+}
+
+// EventSetGoal 矿池下发的 mining.set_goal，只转发给支持它的矿机
+type EventSetGoal struct {
+	Content []byte
+}
+
+// EventBroadcastNotify 广播排队中的任务（启用 coalesce_mining_notify 时）
+type EventBroadcastNotify struct{}
+
 type EventDownSessionBroken struct {
 	SessionID uint16
 }
 
+// EventUpSessionBroken 矿池连接断开。Session 用于忽略已被替代的连接（如 drain 后）迟到的事件
 type EventUpSessionBroken struct {
-	Slot int
+	Slot    int
+	Session UpSession
 }
 
 type EventSubmitShareBTC struct {
 	ID      interface{}
 	Message *ExMessageSubmitShareBTC
+	Time    time.Time // 收到矿机提交的时间
+	// mining.submit 中的矿工名对应的矿机名（同一连接上认证了多个矿工时用于区分），为空时使用连接的矿机名
+	WorkerName string
+}
+
+// EventDeclaredHashrate 矿机声明了算力，由矿机连接发给矿池连接（forward_declared_hashrate）
+type EventDeclaredHashrate struct {
+	SessionID uint16
+	Hashrate  float64 // H/s
 }
 
 type EventSubmitShareETH struct {
 	ID      interface{}
 	Message *ExMessageSubmitShareETH
+	Time    time.Time // 收到矿机提交的时间
 }
 
 type EventSubmitResponse struct {
 	ID     interface{}
 	Status StratumStatus
+	// 对本地假任务（矿池连接不可用时）的 share 的响应，不计入 share 统计和算力
+	FakeJob bool
 }
 
 type EventUpdateMinerNum struct {
@@ -86,8 +158,9 @@ type EventSendUpdateMinerNum struct{}
 
 type EventPrintMinerNum struct{}
 
+// EventStopUpSessionManager 关闭矿池会话管理器，Key 为它在 SessionManager 中的标识（见 upSessionManagerKey）
 type EventStopUpSessionManager struct {
-	SubAccount string
+	Key string
 }
 
 type EventUpdateFakeJobBTC struct {
@@ -102,6 +175,18 @@ type EventTransferDownSessions struct{}
 
 type EventSendFakeNotify struct{}
 
+// EventExpireSubmitIDs 清理矿池超时未响应的 share
+type EventExpireSubmitIDs struct{}
+
+// EventFlushSubmits 写出等待合并的 share（启用 pool_submit_coalesce_milliseconds 时）
+type EventFlushSubmits struct{}
+
+// EventPingMiner 检查矿机是否空闲，需要时发送 mining.ping
+type EventPingMiner struct{}
+
+// EventRotateSession 矿机连接达到 miner_session_max_lifetime_seconds，开始或继续轮换
+type EventRotateSession struct{}
+
 type EventUpSessionConnection struct {
 	ProxyURL string
 	Conn     net.Conn
@@ -120,3 +205,61 @@ type EventSetExtraNonce struct {
 type EventStratumJobETH struct {
 	Job *StratumJobETH
 }
+
+type EventAdminCommand struct {
+	Request  *AdminRequest
+	Response chan AdminResponse
+}
+
+type EventGetUpSessionManagerStatus struct {
+	WithMiners bool
+	Response   chan UpSessionManagerStatus
+}
+
+type EventGetUpSessionStatus struct {
+	WithMiners bool
+	Response   chan UpSessionStatus
+}
+
+type EventReconnectUpSession struct {
+	Slot     int
+	Response chan AdminResponse
+}
+
+type EventKickDownSessions struct {
+	Filter   DownSessionFilter
+	Response chan []DownSessionStatus
+}
+
+// EventGetDownSessions 获取矿池连接上的矿机（用于管理命令 kick）
+type EventGetDownSessions struct {
+	Response chan []DownSession
+}
+
+// EventKickDownSession 矿机符合条件时断开连接并通过 Response 返回自己的状态，否则返回空列表（管理命令 kick）
+type EventKickDownSession struct {
+	Filter   DownSessionFilter
+	Response chan []DownSessionStatus
+}
+
+// EventSetPools 矿池列表已更新（setpools），Config 为 Config.WithPools() 返回的新配置
+type EventSetPools struct {
+	Config *Config
+}
+
+type EventHealthCheck struct {
+	Response chan HealthStatus
+}
+
+// EventWaitSubmits 退出前等待矿池响应已提交的 share（shutdown_submit_grace_seconds），
+// 到 Deadline 仍未响应的在本地响应为失败，Response 返回这样的 share 数
+type EventWaitSubmits struct {
+	Deadline time.Time
+	Response chan int
+}
+
+// EventWaitSubmitsTimeout 退出前等待 share 响应的时间已到
+type EventWaitSubmitsTimeout struct{}
+
+// EventAuthorizeTimeout 矿机连接后未在 miner_authorize_timeout_seconds 内完成认证
+type EventAuthorizeTimeout struct{}
@@ -0,0 +1,53 @@
+package btcagent
+
+import "context"
+
+// eventClass 获取事件的类别，只有 EventClassMinerNotify 和 EventClassTimer 的事件可以在事件通道已满时丢弃，
+// 其他事件返回空字符串。
+//
+// 新任务会被之后的任务取代，定时器事件会在下一次触发时再次检查，丢弃它们不会丢失数据。
+// share 提交及其响应、矿机数同步、连接管理等事件丢弃后无法恢复，必须等待事件循环处理。
+// EventPrintMinerNum 是一次性的，丢弃后不会再打印矿机数，也不能丢弃。
+func eventClass(event interface{}) string {
+	switch event.(type) {
+	case EventMiningNotifyBTC, EventMiningNotifyETH:
+		return EventClassMinerNotify
+	case EventPingMiner, EventExpireSubmitIDs, EventSendFakeNotify:
+		return EventClassTimer
+	}
+	return ""
+}
+
+// eventOverflowPolicy 获取事件通道已满时该事件的处理方式
+func eventOverflowPolicy(config *Config, event interface{}) string {
+	switch eventClass(event) {
+	case EventClassMinerNotify:
+		return config.Advanced.MessageQueueOverflow.MinerNotify
+	case EventClassTimer:
+		return config.Advanced.MessageQueueOverflow.Timer
+	}
+	return EventOverflowBlock
+}
+
+// sendEventWithPolicy 向事件通道发送事件，通道已满时按 message_queue_overflow 处理。
+// 事件被丢弃或 ctx 已结束时返回 false。
+func sendEventWithPolicy(ctx context.Context, channel chan<- interface{}, event interface{}, config *Config, metrics *AgentMetrics) bool {
+	if eventOverflowPolicy(config, event) == EventOverflowDrop {
+		select {
+		case channel <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		default:
+			metrics.DroppedEvents.Inc("class", eventClass(event))
+			return false
+		}
+	}
+
+	select {
+	case channel <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
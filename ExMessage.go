@@ -1,20 +1,28 @@
-package main
+package btcagent
 
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
 )
 
 // ex-message的magic number
 const ExMessageMagicNumber uint8 = 0x7F
 
 // types
+//
+// 收到未定义的类型时只打印日志并丢弃。
 const (
 	CMD_REGISTER_WORKER            uint8 = 0x01 // Agent -> Pool
 	CMD_SUBMIT_SHARE               uint8 = 0x02 // Agent -> Pool,  mining.submit(...)
 	CMD_SUBMIT_SHARE_WITH_TIME     uint8 = 0x03 // Agent -> Pool,  mining.submit(..., nTime)
 	CMD_UNREGISTER_WORKER          uint8 = 0x04 // Agent -> Pool
-	CMD_MINING_SET_DIFF            uint8 = 0x05 // Pool  -> Agent, mining.set_difficulty(diff)
+	CMD_MINING_SET_DIFF            uint8 = 0x05 // Pool <-> Agent, mining.set_difficulty(diff), Agent -> Pool only with report_difficulty
+	CMD_SUBMIT_HASHRATE            uint8 = 0x06 // Agent -> Pool,  hashrate declared by the miner (optional, forward_declared_hashrate)
+	CMD_MINING_NOTIFY              uint8 = 0x07 // Pool  -> Agent, mining.notify(...) (optional, BTC)
 	CMD_SUBMIT_RESPONSE            uint8 = 0x10 // Pool  -> Agent, response of the submit (optional)
 	CMD_SUBMIT_SHARE_WITH_VER      uint8 = 0x12 // Agent -> Pool,  mining.submit(..., nVersionMask)
 	CMD_SUBMIT_SHARE_WITH_TIME_VER uint8 = 0x13 // Agent -> Pool,  mining.submit(..., nTime, nVersionMask)
@@ -83,6 +91,27 @@ func (msg *ExMessageUnregisterWorker) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// ExMessageSubmitHashrate 矿机声明的算力（H/s），只在启用 forward_declared_hashrate 时发送
+type ExMessageSubmitHashrate struct {
+	SessionID uint16
+	Hashrate  uint64
+}
+
+func (msg *ExMessageSubmitHashrate) Serialize() []byte {
+	header := ExMessageHeader{
+		ExMessageMagicNumber,
+		CMD_SUBMIT_HASHRATE,
+		uint16(4 + 2 + 8)}
+
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, &header)
+	binary.Write(buf, binary.LittleEndian, msg.SessionID)
+	binary.Write(buf, binary.LittleEndian, msg.Hashrate)
+
+	return buf.Bytes()
+}
+
 type ExMessageSubmitShareBTC struct {
 	Base struct {
 		JobID       uint8
@@ -95,6 +124,8 @@ type ExMessageSubmitShareBTC struct {
 	VersionMask uint32
 
 	IsFakeJob bool
+	// 矿机提交的原始任务ID，跳过能力协商、通过 mining.submit 提交时，以及按 difficulty_multiplier 检查 share 时使用
+	JobIDString string
 }
 
 func (msg *ExMessageSubmitShareBTC) Serialize() []byte {
@@ -167,6 +198,8 @@ func (msg *ExMessageSubmitShareETH) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// ExMessageMiningSetDiff CMD_MINING_SET_DIFF，将 SessionIDs 对应矿机的难度设置为 2^DiffExp。
+// 矿池发给 BTCAgent 时设置矿机的难度；设置了 report_difficulty 时 BTCAgent 也用它告诉矿池矿机的实际难度。
 type ExMessageMiningSetDiff struct {
 	Base struct {
 		DiffExp uint8
@@ -175,11 +208,36 @@ type ExMessageMiningSetDiff struct {
 	SessionIDs []uint16
 }
 
+// ExMessageMiningSetDiffMaxSessions 一个 CMD_MINING_SET_DIFF 最多包含的矿机数（受 Size 字段的范围限制）
+const ExMessageMiningSetDiffMaxSessions = (0xFFFF - 4 - 1 - 2) / 2
+
+func (msg *ExMessageMiningSetDiff) Serialize() []byte {
+	header := ExMessageHeader{
+		ExMessageMagicNumber,
+		CMD_MINING_SET_DIFF,
+		uint16(4 + 1 + 2 + 2*len(msg.SessionIDs))}
+
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, &header)
+	binary.Write(buf, binary.LittleEndian, &msg.Base)
+	binary.Write(buf, binary.LittleEndian, msg.SessionIDs)
+
+	return buf.Bytes()
+}
+
 func (msg *ExMessageMiningSetDiff) Unserialize(data []byte) (err error) {
 	buf := bytes.NewReader(data)
 
 	err = binary.Read(buf, binary.LittleEndian, &msg.Base)
-	if err != nil || msg.Base.Count == 0 {
+	if err != nil {
+		return
+	}
+	// 难度为 uint64，更大的指数会溢出为 0
+	if msg.Base.DiffExp > 63 {
+		return fmt.Errorf("difficulty exponent %d out of range", msg.Base.DiffExp)
+	}
+	if msg.Base.Count == 0 {
 		return
 	}
 
@@ -188,6 +246,90 @@ func (msg *ExMessageMiningSetDiff) Unserialize(data []byte) (err error) {
 	return
 }
 
+// ExMessageMiningNotify CMD_MINING_NOTIFY，矿池以 ex-message 下发的任务，与 JSON 的 mining.notify 字段一一对应：
+//
+//	job_id         uint8_t     任务ID，发给矿机时为十进制字符串（与 CMD_SUBMIT_SHARE 中的任务ID相同）
+//	prev_hash      uint8_t[32] 前一区块的哈希，与 mining.notify 中的十六进制字符串的字节顺序相同
+//	version        uint32_t
+//	nbits          uint32_t
+//	ntime          uint32_t
+//	clean_jobs     uint8_t     非 0 时为 true
+//	coinbase1_len  uint16_t
+//	coinbase1      uint8_t[coinbase1_len]
+//	coinbase2_len  uint16_t
+//	coinbase2      uint8_t[coinbase2_len]
+//	merkle_count   uint8_t
+//	merkle_branch  uint8_t[32][merkle_count]
+type ExMessageMiningNotify struct {
+	Base struct {
+		JobID     uint8
+		PrevHash  [32]byte
+		Version   uint32
+		NBits     uint32
+		NTime     uint32
+		CleanJobs uint8
+	}
+	Coinbase1      []byte
+	Coinbase2      []byte
+	MerkleBranches [][32]byte
+}
+
+func (msg *ExMessageMiningNotify) Unserialize(data []byte) (err error) {
+	buf := bytes.NewReader(data)
+
+	err = binary.Read(buf, binary.LittleEndian, &msg.Base)
+	if err != nil {
+		return
+	}
+	readBytes := func() (field []byte) {
+		var size uint16
+		if err != nil {
+			return
+		}
+		err = binary.Read(buf, binary.LittleEndian, &size)
+		if err != nil {
+			return
+		}
+		field = make([]byte, size)
+		_, err = io.ReadFull(buf, field)
+		return
+	}
+	msg.Coinbase1 = readBytes()
+	msg.Coinbase2 = readBytes()
+	if err != nil {
+		return
+	}
+
+	var count uint8
+	err = binary.Read(buf, binary.LittleEndian, &count)
+	if err != nil {
+		return
+	}
+	msg.MerkleBranches = make([][32]byte, count)
+	err = binary.Read(buf, binary.LittleEndian, msg.MerkleBranches)
+	return
+}
+
+// Params 转换为 JSON 的 mining.notify 的参数，extraNonce1 由 NewStratumJobBTC 加在 coinbase1 之后
+func (msg *ExMessageMiningNotify) Params() []interface{} {
+	// 与解码 JSON 得到的类型相同，StratumJobBTC 按 []interface{} 读取 merkle branch
+	merkleBranches := make([]interface{}, 0, len(msg.MerkleBranches))
+	for i := range msg.MerkleBranches {
+		merkleBranches = append(merkleBranches, hex.EncodeToString(msg.MerkleBranches[i][:]))
+	}
+	return []interface{}{
+		strconv.FormatUint(uint64(msg.Base.JobID), 10),
+		hex.EncodeToString(msg.Base.PrevHash[:]),
+		hex.EncodeToString(msg.Coinbase1),
+		hex.EncodeToString(msg.Coinbase2),
+		merkleBranches,
+		fmt.Sprintf("%08x", msg.Base.Version),
+		fmt.Sprintf("%08x", msg.Base.NBits),
+		fmt.Sprintf("%08x", msg.Base.NTime),
+		msg.Base.CleanJobs != 0,
+	}
+}
+
 type ExMessageSubmitResponse struct {
 	Index  uint16
 	Status StratumStatus
@@ -0,0 +1,149 @@
+package btcagent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// testExMessageMiningNotify 任务ID为 2 的 clean 任务，coinbase 两部分各 4 字节，一个 merkle branch
+var testExMessageMiningNotify = []byte{
+	0x7F, CMD_MINING_NOTIFY, 95, 0,
+	// job_id
+	2,
+	// prev_hash
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+	// version、nbits、ntime
+	0x00, 0x00, 0x00, 0x20,
+	0xff, 0xff, 0x00, 0x1d,
+	0x00, 0x10, 0x5e, 0x5f,
+	// clean_jobs
+	1,
+	// coinbase1、coinbase2
+	4, 0, 0x01, 0x00, 0x00, 0x00,
+	4, 0, 0xff, 0xff, 0xff, 0xff,
+	// merkle branches
+	1,
+	0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa,
+	0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xbb,
+}
+
+// testExMessageMiningNotifyParams testExMessageMiningNotify 对应的 mining.notify 参数（JSON）
+const testExMessageMiningNotifyParams = `["2","000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f","01000000","ffffffff",` +
+	`["aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaabb"],"20000000","1d00ffff","5f5e1000",true]`
+
+func TestExMessageMiningSetDiffUnserialize(t *testing.T) {
+	// 难度 2^14，两个会话ID：0x0001 和 0x0302
+	var msg ExMessageMiningSetDiff
+	if err := msg.Unserialize([]byte{14, 2, 0, 1, 0, 2, 3}); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if msg.Base.DiffExp != 14 || len(msg.SessionIDs) != 2 || msg.SessionIDs[0] != 0x0001 || msg.SessionIDs[1] != 0x0302 {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	msg = ExMessageMiningSetDiff{}
+	if err := msg.Unserialize([]byte{10, 0, 0}); err != nil || len(msg.SessionIDs) != 0 {
+		t.Errorf("message without sessions should be decoded: %+v, %v", msg, err)
+	}
+
+	for _, body := range [][]byte{
+		{},
+		{10, 1},
+		// 会话ID比 count 少
+		{10, 2, 0, 1, 0},
+		// 难度溢出
+		{64, 1, 0, 1, 0},
+	} {
+		msg = ExMessageMiningSetDiff{}
+		if err := msg.Unserialize(body); err == nil {
+			t.Errorf("wrong frame %v should fail: %+v", body, msg)
+		}
+	}
+}
+
+func TestExMessageMiningSetDiffSerialize(t *testing.T) {
+	var msg ExMessageMiningSetDiff
+	msg.Base.DiffExp = 14
+	msg.Base.Count = 2
+	msg.SessionIDs = []uint16{0x0001, 0x0302}
+	expected := []byte{0x7F, CMD_MINING_SET_DIFF, 11, 0, 14, 2, 0, 1, 0, 2, 3}
+	data := msg.Serialize()
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("wrong frame: %v, expected %v", data, expected)
+	}
+
+	// 与矿池发来的消息格式相同
+	var decoded ExMessageMiningSetDiff
+	if err := decoded.Unserialize(data[4:]); err != nil || decoded.Base != msg.Base || len(decoded.SessionIDs) != 2 || decoded.SessionIDs[1] != 0x0302 {
+		t.Errorf("serialized frame decoded as %+v, %v", decoded, err)
+	}
+}
+
+func TestExMessageRegisterWorkerSerialize(t *testing.T) {
+	msg := ExMessageRegisterWorker{0x0102, "cgminer/4.10", "w1"}
+	expected := []byte{0x7F, CMD_REGISTER_WORKER, 22, 0, 2, 1}
+	expected = append(expected, "cgminer/4.10\x00w1\x00"...)
+	if data := msg.Serialize(); !bytes.Equal(data, expected) {
+		t.Errorf("wrong frame: %v, expected %v", data, expected)
+	}
+
+	// 矿机名和 user agent 可以为空
+	msg = ExMessageRegisterWorker{SessionID: 0xFFFF}
+	if data := msg.Serialize(); !bytes.Equal(data, []byte{0x7F, CMD_REGISTER_WORKER, 8, 0, 0xFF, 0xFF, 0, 0}) {
+		t.Errorf("wrong frame without names: %v", data)
+	}
+}
+
+func TestExMessageUnregisterWorkerSerialize(t *testing.T) {
+	msg := ExMessageUnregisterWorker{0x0102}
+	if data := msg.Serialize(); !bytes.Equal(data, []byte{0x7F, CMD_UNREGISTER_WORKER, 6, 0, 2, 1}) {
+		t.Errorf("wrong frame: %v", data)
+	}
+}
+
+func TestExMessageMiningNotifyUnserialize(t *testing.T) {
+	if len(testExMessageMiningNotify) != 95 {
+		t.Fatalf("wrong test frame size: %d", len(testExMessageMiningNotify))
+	}
+	var msg ExMessageMiningNotify
+	if err := msg.Unserialize(testExMessageMiningNotify[4:]); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if msg.Base.JobID != 2 || msg.Base.Version != 0x20000000 || msg.Base.NBits != 0x1d00ffff || msg.Base.NTime != 0x5f5e1000 || msg.Base.CleanJobs != 1 ||
+		hex.EncodeToString(msg.Coinbase1) != "01000000" || hex.EncodeToString(msg.Coinbase2) != "ffffffff" || len(msg.MerkleBranches) != 1 {
+		t.Errorf("wrong message: %+v", msg)
+	}
+
+	rpcData := JSONRPCLineBTC{Method: "mining.notify", Params: msg.Params()}
+	job, err := NewStratumJobBTC(&rpcData, "01000002")
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	line, _ := job.ToNotifyLine(false)
+	expected := `{"id":null,"method":"mining.notify","params":` + strings.Replace(testExMessageMiningNotifyParams, `"01000000"`, `"0100000001000002"`, 1) + "}\n"
+	if string(line) != expected {
+		t.Errorf("wrong job: %s, expected %s", line, expected)
+	}
+	if !job.IsClean() {
+		t.Errorf("job should be clean")
+	}
+
+	// 没有 merkle branch，不带 clean_jobs
+	body := append([]byte{}, testExMessageMiningNotify[4:62]...)
+	body[45] = 0
+	body = append(body, 0)
+	msg = ExMessageMiningNotify{}
+	if err := msg.Unserialize(body); err != nil || len(msg.MerkleBranches) != 0 || msg.Params()[8] != false {
+		t.Errorf("job without merkle branches should be decoded: %+v, %v", msg, err)
+	}
+
+	for _, size := range []int{0, 45, 47, 51, 55, 58, 90} {
+		msg = ExMessageMiningNotify{}
+		if err := msg.Unserialize(testExMessageMiningNotify[4 : 4+size]); err == nil {
+			t.Errorf("truncated frame of %d bytes should fail: %+v", size, msg)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package btcagent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ExitSummary 代理退出时打印的运行摘要，便于在短时间运行的容器中留下最终的记录
+type ExitSummary struct {
+	Uptime     time.Duration // 本次运行的时间
+	Sessions   int           // 退出时的矿机连接数
+	Reconnects uint64        // 本次运行中矿池连接断开后重新连接的次数，包括 setpools 删除的矿池
+	// 各子账户本次运行的 share 统计
+	SubAccounts map[string]SubAccountShareStats
+	// 启用 stats_persist 时从文件载入的之前运行的 share 统计，单独打印以免与本次运行混淆
+	PreviousRuns map[string]SubAccountShareStats
+}
+
+// Lines 获取摘要的日志行：一行总体信息，之后每个子账户一行
+func (summary ExitSummary) Lines() (lines []string) {
+	lines = append(lines, fmt.Sprintf("uptime=%s sessions=%d reconnects=%d sub_accounts=%d",
+		summary.Uptime.Truncate(time.Second), summary.Sessions, summary.Reconnects, len(summary.SubAccounts)))
+	lines = append(lines, shareStatsLines("", summary.SubAccounts)...)
+	lines = append(lines, shareStatsLines("previous_runs ", summary.PreviousRuns)...)
+	return
+}
+
+// shareStatsLines 按子账户名排序，每个子账户一行，行首加上 prefix
+func shareStatsLines(prefix string, subAccounts map[string]SubAccountShareStats) (lines []string) {
+	names := make([]string, 0, len(subAccounts))
+	for name := range subAccounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		account := subAccounts[name]
+		lines = append(lines, fmt.Sprintf("%ssub_account=%s forwarded=%d accepted=%d rejected=%d",
+			prefix, name, account.Forwarded, account.Accepted, account.Rejected))
+	}
+	return
+}
+
+// ExitSummary 获取运行摘要，可以在任意 goroutine 中调用
+func (manager *SessionManager) ExitSummary() (summary ExitSummary) {
+	summary.Uptime = time.Since(manager.startTime)
+	if manager.sessionIDManager != nil {
+		summary.Sessions = manager.sessionIDManager.Count()
+	}
+	summary.Reconnects = manager.poolStats.Reconnects()
+
+	// 统计数据包含之前运行的统计，减去后得到本次运行的统计
+	summary.PreviousRuns = manager.shareStats.Previous()
+	summary.SubAccounts = make(map[string]SubAccountShareStats)
+	for name, account := range manager.shareStats.Snapshot().SubAccounts {
+		previous := summary.PreviousRuns[name]
+		account.Forwarded -= previous.Forwarded
+		account.Accepted -= previous.Accepted
+		account.Rejected -= previous.Rejected
+		account.AcceptedDifficulty -= previous.AcceptedDifficulty
+		if account.Forwarded > 0 || account.Accepted > 0 || account.Rejected > 0 {
+			summary.SubAccounts[name] = account
+		}
+	}
+	return
+}
+
+// logExitSummary 打印运行摘要
+func (manager *SessionManager) logExitSummary(summary ExitSummary) {
+	for _, line := range summary.Lines() {
+		Log.Info("exit summary: ", line)
+	}
+}
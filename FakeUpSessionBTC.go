@@ -1,6 +1,7 @@
-package main
+package btcagent
 
 import (
+	"context"
 	"time"
 
 	"github.com/golang/glog"
@@ -11,8 +12,11 @@ type FakeUpSessionBTC struct {
 	downSessions map[uint16]DownSession
 	eventChannel chan interface{}
 
-	fakeJob     *StratumJobBTC
-	exitChannel chan bool
+	fakeJob *StratumJobBTC
+
+	// 由 UpSessionManager 的 ctx 派生，取消后退出事件循环
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// 用于统计断开连接的矿机数，并同步给 UpSessionManager
 	disconnectedMinerCounter int
@@ -23,7 +27,7 @@ func NewFakeUpSessionBTC(manager *UpSessionManager) (up *FakeUpSessionBTC) {
 	up.manager = manager
 	up.downSessions = make(map[uint16]DownSession)
 	up.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSession)
-	up.exitChannel = make(chan bool, 1)
+	up.ctx, up.cancel = context.WithCancel(manager.ctx)
 	return
 }
 
@@ -36,7 +40,7 @@ func (up *FakeUpSessionBTC) Run() {
 }
 
 func (up *FakeUpSessionBTC) SendEvent(event interface{}) {
-	up.eventChannel <- event
+	sendEventWithPolicy(up.ctx, up.eventChannel, event, up.manager.config, up.manager.parent.metrics)
 }
 
 func (up *FakeUpSessionBTC) addDownSession(e EventAddDownSession) {
@@ -48,25 +52,29 @@ func (up *FakeUpSessionBTC) addDownSession(e EventAddDownSession) {
 		if err == nil {
 			e.Session.SendEvent(EventSendBytes{bytes})
 		} else {
-			glog.Warning("[fake-pool-connection] failed to convert fake job to JSON:", err.Error(), "; ", up.fakeJob)
+			Log.Warning("[fake-pool-connection] failed to convert fake job to JSON:", err.Error(), "; ", up.fakeJob)
 		}
 	}
 }
 
 func (up *FakeUpSessionBTC) transferDownSessions() {
-	for _, down := range up.downSessions {
-		go up.manager.SendEvent(EventAddDownSession{down})
-	}
-	// 与 UpSessionManager 同步矿机数量
-	go up.manager.SendEvent(EventUpdateFakeMinerNum{len(up.downSessions)})
+	// 在同一个 goroutine 中按顺序发送，保证 UpSessionManager 先把矿机计入矿池连接，
+	// 再减少 FakeUpSession 的矿机数，以免误以为子账户已没有矿机
+	downSessions := up.downSessions
+	go func() {
+		for _, down := range downSessions {
+			up.manager.SendEvent(EventAddDownSession{down})
+		}
+		// 与 UpSessionManager 同步矿机数量
+		up.manager.SendEvent(EventUpdateFakeMinerNum{len(downSessions)})
+	}()
 	// 清空map
 	up.downSessions = make(map[uint16]DownSession)
 }
 
 func (up *FakeUpSessionBTC) exit() {
-	if up.manager.config.AlwaysKeepDownconn {
-		up.exitChannel <- true
-	}
+	// 停止 fakeNotifyTicker
+	up.cancel()
 
 	for _, down := range up.downSessions {
 		go down.SendEvent(EventExit{})
@@ -78,11 +86,11 @@ func (up *FakeUpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{},
 	if !ok {
 		// 客户端已断开，忽略
 		if glog.V(3) {
-			glog.Info("[fake-pool-connection] cannot find down session: ", sessionID)
+			Log.Info("[fake-pool-connection] cannot find down session: ", sessionID)
 		}
 		return
 	}
-	go down.SendEvent(EventSubmitResponse{id, status})
+	go down.SendEvent(EventSubmitResponse{id, status, true})
 }
 
 func (up *FakeUpSessionBTC) handleSubmitShare(e EventSubmitShareBTC) {
@@ -94,8 +102,11 @@ func (up *FakeUpSessionBTC) downSessionBroken(e EventDownSessionBroken) {
 
 	if up.disconnectedMinerCounter == 0 {
 		go func() {
-			time.Sleep(1 * time.Second)
-			up.SendEvent(EventSendUpdateMinerNum{})
+			select {
+			case <-time.After(1 * time.Second):
+				up.SendEvent(EventSendUpdateMinerNum{})
+			case <-up.ctx.Done():
+			}
 		}()
 	}
 	up.disconnectedMinerCounter++
@@ -116,7 +127,7 @@ func (up *FakeUpSessionBTC) fakeNotifyTicker() {
 
 	for {
 		select {
-		case <-up.exitChannel:
+		case <-up.ctx.Done():
 			return
 		case <-ticker.C:
 			up.SendEvent(EventSendFakeNotify{})
@@ -133,18 +144,34 @@ func (up *FakeUpSessionBTC) sendFakeNotify() {
 
 	bytes, err := up.fakeJob.ToNotifyLine(false)
 	if err != nil {
-		glog.Warning("[fake-pool-connection] failed to convert fake job to JSON:", err.Error(), "; ", up.fakeJob)
+		Log.Warning("[fake-pool-connection] failed to convert fake job to JSON:", err.Error(), "; ", up.fakeJob)
 		return
 	}
 
+	e := EventMiningNotifyBTC{bytes}
+	for _, down := range up.downSessions {
+		go down.SendEvent(e)
+	}
+}
+
+// getDownSessions 获取等待矿池连接的矿机（管理命令 kick）
+func (up *FakeUpSessionBTC) getDownSessions(e EventGetDownSessions) {
+	downSessions := make([]DownSession, 0, len(up.downSessions))
 	for _, down := range up.downSessions {
-		go down.SendEvent(EventSendBytes{bytes})
+		downSessions = append(downSessions, down)
 	}
+	e.Response <- downSessions
 }
 
 func (up *FakeUpSessionBTC) handleEvent() {
 	for {
-		event := <-up.eventChannel
+		var event interface{}
+		select {
+		case event = <-up.eventChannel:
+		case <-up.ctx.Done():
+			up.exit()
+			return
+		}
 
 		switch e := event.(type) {
 		case EventAddDownSession:
@@ -157,6 +184,8 @@ func (up *FakeUpSessionBTC) handleEvent() {
 			up.sendUpdateMinerNum()
 		case EventTransferDownSessions:
 			up.transferDownSessions()
+		case EventGetDownSessions:
+			up.getDownSessions(e)
 		case EventUpdateFakeJobBTC:
 			up.updateFakeJob(e)
 		case EventSendFakeNotify:
@@ -166,7 +195,7 @@ func (up *FakeUpSessionBTC) handleEvent() {
 			return
 
 		default:
-			glog.Error("[fake-pool-connection] unknown event: ", e)
+			Log.Error("[fake-pool-connection] unknown event: ", e)
 		}
 	}
 }
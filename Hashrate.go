@@ -0,0 +1,144 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashesPerDifficulty 难度为 1 的 share 平均需要计算的哈希数
+func hashesPerDifficulty(agentType string) float64 {
+	if agentType != "btc" {
+		// 以太坊（及 etc、ethw 等）的难度就是哈希数
+		return 1
+	}
+	return 4294967296
+}
+
+// ParseDeclaredHashrate 解析矿机声明的算力（H/s）。
+// 支持数字、十进制字符串和以 0x 开头的十六进制字符串（eth_submitHashrate），负数和无法解析的值返回 false。
+func ParseDeclaredHashrate(value interface{}) (hashrate float64, ok bool) {
+	switch v := value.(type) {
+	case float64:
+		hashrate = v
+	case json.Number:
+		var err error
+		hashrate, err = v.Float64()
+		if err != nil {
+			return 0, false
+		}
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			num, err := strconv.ParseUint(v[2:], 16, 64)
+			if err != nil {
+				return 0, false
+			}
+			hashrate = float64(num)
+		} else {
+			var err error
+			hashrate, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, false
+			}
+		}
+	default:
+		return 0, false
+	}
+	if hashrate < 0 || math.IsNaN(hashrate) || math.IsInf(hashrate, 0) {
+		return 0, false
+	}
+	return hashrate, true
+}
+
+// declaredHashrateUint64 将矿机声明的算力转换为 CMD_SUBMIT_HASHRATE 中的整数，
+// NaN 和负数为 0，超出 uint64 范围的取最大值（float64 到 uint64 的转换溢出时结果不确定）
+func declaredHashrateUint64(hashrate float64) uint64 {
+	if !(hashrate > 0) {
+		return 0
+	}
+	if hashrate >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(hashrate)
+}
+
+// takeSubmitHashrate 取出扩展的 mining.submit 在第 minParams 个之后的参数中附带的算力声明 {"hashrate": ...}，
+// 返回去掉该参数后的参数列表。没有声明时原样返回参数列表，ok 为 false。
+func takeSubmitHashrate(params []interface{}, minParams int) (rest []interface{}, hashrate float64, ok bool) {
+	for i := minParams; i < len(params); i++ {
+		extension, isObject := params[i].(map[string]interface{})
+		if !isObject {
+			continue
+		}
+		value, exists := extension["hashrate"]
+		if !exists {
+			continue
+		}
+		hashrate, ok = ParseDeclaredHashrate(value)
+		rest = append(append([]interface{}{}, params[:i]...), params[i+1:]...)
+		return
+	}
+	return params, 0, false
+}
+
+// MinerHashrate 矿机连接声明的算力和 BTCAgent 按接受的 share 估算的算力。
+// 由矿机连接更新，可以在任意 goroutine 中读取。
+type MinerHashrate struct {
+	lock               sync.Mutex
+	declared           float64   // 最后一次声明的算力（H/s），未声明时为 0
+	acceptedDifficulty float64   // 接受的 share 的难度之和
+	since              time.Time // 开始统计的时间（矿机认证的时间）
+	lastAccepted       time.Time // 最后一次接受 share 的时间
+}
+
+// Start 从 now 开始统计接受的 share
+func (h *MinerHashrate) Start(now time.Time) {
+	h.lock.Lock()
+	h.since = now
+	h.lock.Unlock()
+}
+
+// Declare 记录矿机声明的算力，返回变化量
+func (h *MinerHashrate) Declare(hashrate float64) (delta float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delta = hashrate - h.declared
+	h.declared = hashrate
+	return
+}
+
+// AddAccepted 记录一个接受的 share
+func (h *MinerHashrate) AddAccepted(difficulty uint64) {
+	h.lock.Lock()
+	h.acceptedDifficulty += float64(difficulty)
+	h.lastAccepted = time.Now()
+	h.lock.Unlock()
+}
+
+// LastAccepted 最后一次接受 share 的时间，没有接受过时为零值
+func (h *MinerHashrate) LastAccepted() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastAccepted
+}
+
+// Declared 获取矿机最后一次声明的算力，未声明时为 0
+func (h *MinerHashrate) Declared() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.declared
+}
+
+// Estimated 按开始统计以来接受的 share 的难度估算的平均算力（H/s）
+func (h *MinerHashrate) Estimated(hashesPerDifficulty float64, now time.Time) float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	elapsed := now.Sub(h.since).Seconds()
+	if h.since.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return h.acceptedDifficulty * hashesPerDifficulty / elapsed
+}
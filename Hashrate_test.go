@@ -0,0 +1,97 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseDeclaredHashrate(t *testing.T) {
+	for _, c := range []struct {
+		value    interface{}
+		hashrate float64
+		ok       bool
+	}{
+		{float64(1.2e14), 1.2e14, true},
+		{json.Number("12000000"), 12e6, true},
+		{"120000000000000", 1.2e14, true},
+		{"1.2e14", 1.2e14, true},
+		{"0x1dcd6500", 500000000, true}, // eth_submitHashrate
+		{"0x", 0, false},
+		{"fast", 0, false},
+		{"NaN", 0, false},
+		{float64(-1), 0, false},
+		{nil, 0, false},
+		{[]interface{}{}, 0, false},
+	} {
+		hashrate, ok := ParseDeclaredHashrate(c.value)
+		if ok != c.ok || hashrate != c.hashrate {
+			t.Errorf("ParseDeclaredHashrate(%#v) = %v, %v, expected %v, %v", c.value, hashrate, ok, c.hashrate, c.ok)
+		}
+	}
+}
+
+func TestDeclaredHashrateUint64(t *testing.T) {
+	for _, c := range []struct {
+		hashrate float64
+		expected uint64
+	}{
+		{1.2e14, 120000000000000},
+		{0, 0},
+		{-1, 0},
+		{math.NaN(), 0},
+		{1e30, math.MaxUint64},
+		{math.Inf(1), math.MaxUint64},
+	} {
+		if value := declaredHashrateUint64(c.hashrate); value != c.expected {
+			t.Errorf("declaredHashrateUint64(%v) = %v, expected %v", c.hashrate, value, c.expected)
+		}
+	}
+}
+
+func TestTakeSubmitHashrate(t *testing.T) {
+	submit := []interface{}{"alice.w1", "1", "00000000", "5f5e1000", "12345678"}
+
+	// 没有声明时原样返回
+	params, _, ok := takeSubmitHashrate(submit, 5)
+	if ok || len(params) != 5 {
+		t.Errorf("submit without a declaration should not change: %v, %v", params, ok)
+	}
+
+	// 声明在版本掩码之后
+	extended := append(append([]interface{}{}, submit...), "00002000", map[string]interface{}{"hashrate": float64(1.1e14)})
+	params, hashrate, ok := takeSubmitHashrate(extended, 5)
+	if !ok || hashrate != 1.1e14 || len(params) != 6 || params[5] != "00002000" {
+		t.Errorf("wrong declaration from extended submit: %v, %v, %v", params, hashrate, ok)
+	}
+
+	// 无法解析的声明也要去掉，以免被当作版本掩码
+	extended = append(append([]interface{}{}, submit...), map[string]interface{}{"hashrate": "fast"})
+	params, _, ok = takeSubmitHashrate(extended, 5)
+	if ok || len(params) != 5 {
+		t.Errorf("illegal declaration should be removed: %v, %v", params, ok)
+	}
+}
+
+func TestMinerHashrate(t *testing.T) {
+	var hashrate MinerHashrate
+	now := time.Now()
+	if hashrate.Estimated(4294967296, now) != 0 {
+		t.Errorf("hashrate should be 0 before authorized")
+	}
+
+	hashrate.Start(now)
+	hashrate.AddAccepted(1000)
+	hashrate.AddAccepted(1000)
+	if estimated := hashrate.Estimated(4294967296, now.Add(100*time.Second)); estimated != 2000*4294967296/100 {
+		t.Errorf("wrong estimated hashrate: %v", estimated)
+	}
+
+	if delta := hashrate.Declare(1e14); delta != 1e14 {
+		t.Errorf("wrong delta of the first declaration: %v", delta)
+	}
+	if delta := hashrate.Declare(0.9e14); delta != -0.1e14 || hashrate.Declared() != 0.9e14 {
+		t.Errorf("wrong delta of the second declaration: %v, %v", delta, hashrate.Declared())
+	}
+}
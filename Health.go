@@ -0,0 +1,93 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthStatus 健康检查的结果（用于 /healthz 和 /readyz）
+type HealthStatus struct {
+	Live        bool `json:"live"`  // 所有事件循环都在超时之前响应
+	Ready       bool `json:"ready"` // 可以接受矿机连接
+	Draining    bool `json:"draining"`
+	SubAccounts int  `json:"sub_accounts"`
+	Pools       int  `json:"pools"` // 已认证的矿池连接数
+}
+
+// HealthCheck 依次向代理和各子账户的事件循环发送心跳，并统计已认证的矿池连接。可以在任意 goroutine 中调用。
+//
+// 任一事件循环未在 HealthCheckTimeoutSeconds 内响应时 Live 为 false。
+// 有已认证的矿池连接且未处于 drain 状态时 Ready 为 true；多用户模式下尚无矿机连接、
+// 以及透传模式下不预先连接矿池，只要事件循环正常就认为可以接受矿机连接。
+func (manager *SessionManager) HealthCheck() (status HealthStatus) {
+	response := make(chan HealthStatus, 1)
+	// 事件通道已满时发送也会阻塞，在单独的 goroutine 中发送以免超过超时时间
+	go manager.SendEvent(EventHealthCheck{response})
+
+	select {
+	case status = <-response:
+	case <-time.After(HealthCheckTimeoutSeconds.Get()):
+		Log.Warning("[health] session manager does not respond in ", HealthCheckTimeoutSeconds, " seconds")
+	}
+	return
+}
+
+// healthCheck 收集所有子账户的健康状态，在单独的 goroutine 中等待以免阻塞事件循环
+func (manager *SessionManager) healthCheck(e EventHealthCheck) {
+	children := make([]*UpSessionManager, 0, len(manager.upSessionManagers))
+	for _, child := range manager.upSessionManagers {
+		children = append(children, child)
+	}
+	status := HealthStatus{Live: true, Draining: manager.draining}
+
+	go func() {
+		timeout := time.After(HealthCheckTimeoutSeconds.Get())
+		for _, child := range children {
+			response := make(chan HealthStatus, 1)
+			go child.SendEvent(EventHealthCheck{response})
+			select {
+			case childStatus := <-response:
+				status.SubAccounts += childStatus.SubAccounts
+				status.Pools += childStatus.Pools
+			case <-timeout:
+				Log.Warning("[health] ", child.id, "does not respond in ", HealthCheckTimeoutSeconds, " seconds")
+				status.Live = false
+				e.Response <- status
+				return
+			}
+		}
+
+		switch {
+		case status.Draining:
+		case status.Pools > 0, manager.poolsConfig().HasPassthroughPool():
+			status.Ready = true
+		case manager.config.MultiUserMode && status.SubAccounts < 1:
+			status.Ready = true
+		}
+		e.Response <- status
+	}()
+}
+
+// HealthHandler 健康检查的 HTTP 接口，响应内容为 JSON 格式的 HealthStatus。
+// 检查通过时返回 200，否则返回 503。
+type HealthHandler struct {
+	manager   *SessionManager
+	readiness bool // true 时检查 Ready（/readyz），否则只检查 Live（/healthz）
+}
+
+func (handler *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := handler.manager.HealthCheck()
+	ok := status.Live
+	if handler.readiness {
+		ok = ok && status.Ready
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
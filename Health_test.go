@@ -0,0 +1,99 @@
+package btcagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	authorize := make(chan struct{})
+	drop := make(chan struct{})
+	// 收到 authorize 之前不响应握手，收到 drop 之后断开连接并拒绝之后的连接
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		select {
+		case <-drop:
+			return
+		case <-authorize:
+		}
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		go io.Copy(ioutil.Discard, reader)
+		<-drop
+	})
+	manager := startTestSessionManager(t, pool.Config(new(SessionFactoryBTC)))
+	liveness := &HealthHandler{manager, false}
+	readiness := &HealthHandler{manager, true}
+
+	check := func(handler http.Handler) (code int, status HealthStatus) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatalf("wrong response %s: %v", recorder.Body.String(), err)
+		}
+		return recorder.Code, status
+	}
+	waitCode := func(handler http.Handler, expected int) {
+		t.Helper()
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			code, status := check(handler)
+			if code == expected {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("status code %d, expected %d: %+v", code, expected, status)
+			}
+		}
+	}
+
+	// 矿池连接认证之前存活但未就绪
+	if code, status := check(liveness); code != http.StatusOK || !status.Live {
+		t.Errorf("agent should be live before connecting to pool: %d %+v", code, status)
+	}
+	if code, status := check(readiness); code != http.StatusServiceUnavailable || status.Ready {
+		t.Errorf("agent should not be ready before connecting to pool: %d %+v", code, status)
+	}
+
+	close(authorize)
+	waitCode(readiness, http.StatusOK)
+	if _, status := check(readiness); status.Pools < 1 || status.SubAccounts != 1 {
+		t.Errorf("wrong status after connecting to pool: %+v", status)
+	}
+
+	// drain 时不再就绪
+	manager.AdminCommand(&AdminRequest{Method: "drain"})
+	if code, status := check(readiness); code != http.StatusServiceUnavailable || !status.Draining {
+		t.Errorf("agent should not be ready while draining: %d %+v", code, status)
+	}
+	manager.AdminCommand(&AdminRequest{Method: "undrain"})
+	waitCode(readiness, http.StatusOK)
+
+	// 所有矿池连接断开后不再就绪，但仍然存活
+	close(drop)
+	waitCode(readiness, http.StatusServiceUnavailable)
+	if code, _ := check(liveness); code != http.StatusOK {
+		t.Errorf("agent should be live after pool connections dropped: %d", code)
+	}
+}
+
+func TestHealthHandlerMultiUser(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.MultiUserMode = true
+	manager := startTestSessionManager(t, config)
+
+	// 多用户模式下尚无矿机连接时不需要矿池连接
+	recorder := httptest.NewRecorder()
+	(&HealthHandler{manager, true}).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("agent in multi user mode should be ready without miners: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 type EventInterface interface {
 	SendEvent(e interface{})
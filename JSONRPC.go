@@ -1,7 +1,13 @@
-package main
+package btcagent
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 )
 
 // JSONRPCRequest JSON RPC 请求的数据结构
@@ -99,15 +105,179 @@ func NewJSONRPC2Error(v1Err interface{}) (err *JSONRPC2Error) {
 	return
 }
 
+// ParseJSONRPCError 解析对方返回的 error 字段，支持以下格式：
+//
+//	[code, "message", data]                 JSON RPC 1.0 (Stratum)
+//	{"code": code, "message": "message"}    JSON RPC 2.0
+//	"message"
+//
+// error 为空时 ok 为 false
+func ParseJSONRPCError(rpcErr interface{}) (code int, message string, ok bool) {
+	switch e := rpcErr.(type) {
+	case []interface{}:
+		if len(e) > 0 {
+			num, _ := e[0].(float64)
+			code = int(num)
+		}
+		if len(e) > 1 {
+			message, _ = e[1].(string)
+		}
+		ok = len(e) > 0
+	case map[string]interface{}:
+		num, _ := e["code"].(float64)
+		code = int(num)
+		message, _ = e["message"].(string)
+		ok = true
+	case string:
+		message = e
+		ok = len(e) > 0
+	}
+	return
+}
+
+// NormalizeMethod 去除方法名两端的空白并转为小写，用于匹配大小写不规范的方法名（如 "Mining.Notify"）。
+// 日志中应打印原始的方法名。
+func NormalizeMethod(method string) string {
+	return strings.ToLower(strings.TrimSpace(method))
+}
+
+// IsJSONRPCBatch 判断一行 JSON 是否为批量请求（顶层为数组）
+func IsJSONRPCBatch(rpcJSON []byte) bool {
+	rpcJSON = bytes.TrimLeft(rpcJSON, " \t\r\n")
+	return len(rpcJSON) > 0 && rpcJSON[0] == '['
+}
+
+// SplitJSONRPCBatch 将批量请求拆分为单个请求的 JSON，请求数为 0 或超过 maxSize 时返回错误
+func SplitJSONRPCBatch(rpcJSON []byte, maxSize int) (elements []json.RawMessage, err error) {
+	err = json.Unmarshal(rpcJSON, &elements)
+	if err != nil {
+		return
+	}
+	if len(elements) < 1 {
+		err = errors.New("empty batch")
+		return
+	}
+	if len(elements) > maxSize {
+		err = errors.New("too many requests in a batch")
+	}
+	return
+}
+
+// jsonRPCRawID 用于单独解析 id 字段
+type jsonRPCRawID struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// decodeJSONRPCID 数字 id 默认会被解析为 float64，较大的整数会丢失精度。
+// 这里将其重新解析为 json.Number，以便原样返回给对方。
+func decodeJSONRPCID(rpcJSON []byte, id interface{}) interface{} {
+	if _, ok := id.(float64); !ok {
+		return id
+	}
+	var raw jsonRPCRawID
+	if json.Unmarshal(rpcJSON, &raw) != nil {
+		return id
+	}
+	return json.Number(raw.ID)
+}
+
+// JSONRPCIDString 获取字符串类型的 id。
+// BTCAgent 发出的请求默认使用字符串 id，数字或 null id 不会被当作这些请求的响应（numeric_request_id 见 JSONRPCResponseID）。
+func JSONRPCIDString(id interface{}) (idStr string, ok bool) {
+	idStr, ok = id.(string)
+	return
+}
+
+// numericRequestIDs 矿池选项 numeric_request_id 启用时 BTCAgent 请求的字符串 id 对应的数字 id。
+// mining.submit 的 "submit:<序号>" 对应 numericSubmitIDBase + 序号。
+var numericRequestIDs = map[string]uint64{
+	"caps":         1,
+	"conf":         2,
+	"sub":          3,
+	"suggest_diff": 4,
+	"auth":         5,
+	"caps_again":   6,
+	"submit":       7,
+	"conn_test":    8,
+}
+
+const numericSubmitIDBase = 0x10000
+
+// NumericRequestID 获取 BTCAgent 请求的字符串 id 对应的数字 id，没有对应的数字时返回原 id
+func NumericRequestID(id string) interface{} {
+	if num, ok := numericRequestIDs[id]; ok {
+		return num
+	}
+	if strings.HasPrefix(id, "submit:") {
+		index, err := strconv.ParseUint(strings.TrimPrefix(id, "submit:"), 10, 16)
+		if err == nil {
+			return numericSubmitIDBase + index
+		}
+	}
+	return id
+}
+
+// JSONRPCResponseID 获取响应对应的 BTCAgent 请求的字符串 id。
+// numeric 为 true 时（矿池选项 numeric_request_id），数字 id 按 NumericRequestID 的对应关系换回字符串 id，
+// 矿池回显的 id 是 JSON 数字（如 5、5.0）还是字符串（如 "5"）都可以匹配。
+func JSONRPCResponseID(id interface{}, numeric bool) (idStr string, ok bool) {
+	if !numeric {
+		return JSONRPCIDString(id)
+	}
+	num, isNumber := numericJSONRPCID(id)
+	if !isNumber {
+		return JSONRPCIDString(id)
+	}
+	if num >= numericSubmitIDBase && num <= numericSubmitIDBase+0xffff {
+		return fmt.Sprintf("submit:%d", num-numericSubmitIDBase), true
+	}
+	for name, value := range numericRequestIDs {
+		if value == num {
+			return name, true
+		}
+	}
+	return JSONRPCIDString(id)
+}
+
+// numericJSONRPCID 获取 id 表示的非负整数，id 可以是 JSON 数字（json.Number 或 float64）或者十进制的字符串
+func numericJSONRPCID(id interface{}) (num uint64, ok bool) {
+	var text string
+	switch v := id.(type) {
+	case json.Number:
+		text = string(v)
+	case string:
+		text = v
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return
+	}
+	if num, err := strconv.ParseUint(text, 10, 64); err == nil {
+		return num, true
+	}
+	// 5.0、5e0 等写法
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 || value > 1<<53 || value != math.Trunc(value) {
+		return
+	}
+	return uint64(value), true
+}
+
 func NewJSONRPCLineBTC(rpcJSON []byte) (rpcData *JSONRPCLineBTC, err error) {
 	rpcData = new(JSONRPCLineBTC)
 	err = json.Unmarshal(rpcJSON, &rpcData)
+	if err == nil && rpcData != nil {
+		rpcData.ID = decodeJSONRPCID(rpcJSON, rpcData.ID)
+	}
 	return
 }
 
 func NewJSONRPCLineETH(rpcJSON []byte) (rpcData *JSONRPCLineETH, err error) {
 	rpcData = new(JSONRPCLineETH)
 	err = json.Unmarshal(rpcJSON, &rpcData)
+	if err == nil && rpcData != nil {
+		rpcData.ID = decodeJSONRPCID(rpcJSON, rpcData.ID)
+	}
 	return
 }
 
@@ -214,3 +384,25 @@ func (rpcData *JSONRPCResponse) ToJSONBytesLineWithVersion(version int) (bytes [
 	}
 	return rpcData.ToJSONBytesLine()
 }
+
+// JSONRPCBatchToJSONBytesLine 将批量请求的多个响应转换为一行 JSON 数组
+func JSONRPCBatchToJSONBytesLine(responses []JSONRPCResponse, version int) (line []byte, err error) {
+	line = append(line, '[')
+	for i := range responses {
+		var data []byte
+		if version == 2 {
+			data, err = responses[i].ToRPC2JSONBytes()
+		} else {
+			data, err = responses[i].ToJSONBytes()
+		}
+		if err != nil {
+			return
+		}
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = append(line, data...)
+	}
+	line = append(line, ']', '\n')
+	return
+}
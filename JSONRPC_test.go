@@ -0,0 +1,117 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSplitJSONRPCBatch(t *testing.T) {
+	if IsJSONRPCBatch([]byte(`{"id":1,"method":"mining.subscribe","params":[]}`)) {
+		t.Errorf("a single request is not a batch")
+	}
+	if !IsJSONRPCBatch([]byte(" \t[{\"id\":1}]\n")) {
+		t.Errorf("an array is a batch")
+	}
+
+	elements, err := SplitJSONRPCBatch([]byte(`[{"id":1,"method":"a"}, 5, {"id":"x","method":"b"}]`), 3)
+	if err != nil {
+		t.Fatalf("SplitJSONRPCBatch failed: %s", err.Error())
+	}
+	if len(elements) != 3 || string(elements[1]) != "5" {
+		t.Errorf("wrong elements: %q", elements)
+	}
+
+	for _, batch := range []string{`[]`, `[1,2,3,4]`, `[{"id":1}`} {
+		_, err = SplitJSONRPCBatch([]byte(batch), 3)
+		if err == nil {
+			t.Errorf("SplitJSONRPCBatch(%s) should fail", batch)
+		}
+	}
+}
+
+func TestJSONRPCBatchToJSONBytesLine(t *testing.T) {
+	responses := []JSONRPCResponse{
+		{1, true, nil},
+		{"x", nil, StratumErrIllegalParams.ToJSONRPCArray(nil)},
+	}
+
+	line, err := JSONRPCBatchToJSONBytesLine(responses, 1)
+	if err != nil {
+		t.Fatalf("JSONRPCBatchToJSONBytesLine failed: %s", err.Error())
+	}
+	expected := `[{"id":1,"result":true,"error":null},{"id":"x","result":null,"error":[27,"Illegal params",null]}]` + "\n"
+	if string(line) != expected {
+		t.Errorf("wrong batch response: %s", string(line))
+	}
+
+	line, err = JSONRPCBatchToJSONBytesLine(responses, 2)
+	if err != nil || !strings.HasPrefix(string(line), `[{"id":1,"jsonrpc":"2.0","result":true},`) {
+		t.Errorf("wrong json-rpc 2.0 batch response: %s, %v", string(line), err)
+	}
+}
+
+func TestJSONRPCLineID(t *testing.T) {
+	rpcData, err := NewJSONRPCLineBTC([]byte(`{"id":null,"method":"mining.notify","params":[]}`))
+	if err != nil || rpcData.ID != nil {
+		t.Errorf("wrong null id: %v, %v", rpcData, err)
+	}
+
+	rpcData, err = NewJSONRPCLineBTC([]byte(`{"method":"mining.notify","params":[]}`))
+	if err != nil || rpcData.ID != nil {
+		t.Errorf("wrong missing id: %v, %v", rpcData, err)
+	}
+
+	rpcData, err = NewJSONRPCLineBTC([]byte(`{"id":"sub","result":true}`))
+	if id, ok := JSONRPCIDString(rpcData.ID); err != nil || !ok || id != "sub" {
+		t.Errorf("wrong string id: %v, %v", rpcData, err)
+	}
+
+	// 较大的数字 id 应原样返回给矿机
+	rpcDataETH, err := NewJSONRPCLineETH([]byte(`{"id":12345678901234567890,"method":"mining.submit","params":[]}`))
+	if err != nil || rpcDataETH.ID != json.Number("12345678901234567890") {
+		t.Fatalf("wrong numeric id: %v, %v", rpcDataETH, err)
+	}
+	if _, ok := JSONRPCIDString(rpcDataETH.ID); ok {
+		t.Errorf("numeric id should not be a string id")
+	}
+	response := JSONRPCResponse{rpcDataETH.ID, true, nil}
+	bytes, _ := response.ToJSONBytes()
+	if string(bytes) != `{"id":12345678901234567890,"result":true,"error":null}` {
+		t.Errorf("numeric id is changed in response: %s", string(bytes))
+	}
+}
+
+func TestJSONRPCResponseIDTypes(t *testing.T) {
+	// 同一个 id 以字符串和数字的形式返回
+	for _, test := range []struct {
+		line     string
+		numeric  bool
+		expected string
+		ok       bool
+	}{
+		{`{"id":"auth","result":true}`, false, "auth", true},
+		{`{"id":"auth","result":true}`, true, "auth", true},
+		{`{"id":5,"result":true}`, true, "auth", true},
+		{`{"id":"5","result":true}`, true, "auth", true},
+		{`{"id":5.0,"result":true}`, true, "auth", true},
+		{`{"id":65539,"result":true}`, true, "submit:3", true},
+		{`{"id":"65539","result":true}`, true, "submit:3", true},
+		// 未启用 numeric_request_id 时数字 id 不是 BTCAgent 请求的响应，字符串 "5" 原样返回
+		{`{"id":5,"result":true}`, false, "", false},
+		{`{"id":"5","result":true}`, false, "5", true},
+		// 没有对应请求的数字 id
+		{`{"id":100,"result":true}`, true, "", false},
+		{`{"id":"100","result":true}`, true, "100", true},
+		{`{"id":-5,"result":true}`, true, "", false},
+		{`{"id":null,"result":true}`, true, "", false},
+	} {
+		rpcData, err := NewJSONRPCLineBTC([]byte(test.line))
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", test.line, err)
+		}
+		if id, ok := JSONRPCResponseID(rpcData.ID, test.numeric); id != test.expected || ok != test.ok {
+			t.Errorf("wrong id of %s (numeric: %v): %q, %v", test.line, test.numeric, id, ok)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 type JobIDPairETH struct {
 	PowHash string
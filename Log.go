@@ -0,0 +1,249 @@
+package btcagent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// LogSubsystem 可以单独提高日志级别的子系统，用于只查看某一类消息的详细日志。
+// 子系统的日志级别只会提高该子系统的日志，不会低于全局日志级别（及 vmodule），因此调用方写作
+//
+//	if glog.V(10) || LogExMessage.V(10) { ... }
+//
+// 以保留 glog.V() 按调用者源文件判断 vmodule 的行为。
+type LogSubsystem struct {
+	name      string
+	verbosity int32
+}
+
+// 可以单独设置日志级别的子系统
+var (
+	LogExMessage = &LogSubsystem{name: "exmessage"} // 与矿池之间收发的 ex-message（类型、长度、会话ID等）
+	LogJSONRPC   = &LogSubsystem{name: "jsonrpc"}   // 与矿池和矿机之间收发的 JSON-RPC 行
+)
+
+var logSubsystems = []*LogSubsystem{LogExMessage, LogJSONRPC}
+
+// V 子系统的日志级别是否不低于 level
+func (subsystem *LogSubsystem) V(level glog.Level) glog.Verbose {
+	return glog.Verbose(glog.Level(atomic.LoadInt32(&subsystem.verbosity)) >= level)
+}
+
+// Logger BTCAgent 输出日志的包装，日志级别仍由调用方通过 glog.V() 判断。
+// 默认按 glog 的方式输出到 -l 指定的日志文件和 stderr；通过 SetWriter 设置 io.Writer 后，
+// 日志以与 glog 相同的格式写入该 Writer，不经过 glog，也不替换 os.Stderr，用于嵌入 BTCAgent 或在测试中获取日志。
+type Logger struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// Log BTCAgent 的日志都通过它输出
+var Log = new(Logger)
+
+// SetWriter 将之后的日志写入 w，w 为 nil 时恢复 glog 的输出方式。可以在任意 goroutine 中调用
+func (logger *Logger) SetWriter(w io.Writer) {
+	glog.Flush()
+	logger.lock.Lock()
+	logger.writer = w
+	logger.lock.Unlock()
+}
+
+func (logger *Logger) Info(args ...interface{}) {
+	if !logger.write('I', args) {
+		glog.InfoDepth(1, args...)
+	}
+}
+
+func (logger *Logger) Warning(args ...interface{}) {
+	if !logger.write('W', args) {
+		glog.WarningDepth(1, args...)
+	}
+}
+
+func (logger *Logger) Error(args ...interface{}) {
+	if !logger.write('E', args) {
+		glog.ErrorDepth(1, args...)
+	}
+}
+
+// write 设置了 Writer 时按 glog 的格式（Lmmdd hh:mm:ss.uuuuuu pid file:line] msg）写入一行日志，未设置时返回 false
+func (logger *Logger) write(severity byte, args []interface{}) bool {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if logger.writer == nil {
+		return false
+	}
+	_, file, line, ok := runtime.Caller(2)
+	if ok {
+		file = filepath.Base(file)
+	} else {
+		file, line = "???", 1
+	}
+	msg := fmt.Sprint(args...)
+	if len(msg) < 1 || msg[len(msg)-1] != '\n' {
+		msg += "\n"
+	}
+	now := time.Now()
+	fmt.Fprintf(logger.writer, "%c%s %7d %s:%d] %s", severity, now.Format("0102 15:04:05.000000"), os.Getpid(), file, line, msg)
+	return true
+}
+
+// LogLevel 当前的日志级别
+type LogLevel struct {
+	Verbosity  int            `json:"v"`
+	VModule    string         `json:"vmodule"`
+	Subsystems map[string]int `json:"subsystems"`
+}
+
+// GetLogLevel 获取当前的日志级别（即 glog 的 -v 和 -vmodule 参数）及各子系统的日志级别
+func GetLogLevel() (level LogLevel) {
+	level.Verbosity, _ = strconv.Atoi(flag.Lookup("v").Value.String())
+	level.VModule = flag.Lookup("vmodule").Value.String()
+	level.Subsystems = make(map[string]int, len(logSubsystems))
+	for _, subsystem := range logSubsystems {
+		level.Subsystems[subsystem.name] = int(atomic.LoadInt32(&subsystem.verbosity))
+	}
+	return
+}
+
+// IsLogSubsystem name 是否为可以单独设置日志级别的子系统
+func IsLogSubsystem(name string) bool {
+	return findLogSubsystem(name) != nil
+}
+
+func findLogSubsystem(name string) *LogSubsystem {
+	for _, subsystem := range logSubsystems {
+		if subsystem.name == name {
+			return subsystem
+		}
+	}
+	return nil
+}
+
+// SetLogSubsystemVerbosity 修改子系统 name 的日志级别，对之后的调用立即生效，0 表示只按全局日志级别输出
+func SetLogSubsystemVerbosity(name string, verbosity int) (err error) {
+	subsystem := findLogSubsystem(name)
+	if subsystem == nil {
+		return errors.New("unknown log subsystem: " + name)
+	}
+	if verbosity < 0 {
+		return errors.New("verbosity must not be negative")
+	}
+	atomic.StoreInt32(&subsystem.verbosity, int32(verbosity))
+	Log.Info("log verbosity of ", name, " changed to ", verbosity)
+	return
+}
+
+// SetLogVerbosity 修改全局日志级别，对之后的 glog.V() 调用立即生效
+func SetLogVerbosity(verbosity int) (err error) {
+	if verbosity < 0 {
+		return errors.New("verbosity must not be negative")
+	}
+	err = flag.Lookup("v").Value.Set(strconv.Itoa(verbosity))
+	if err == nil {
+		Log.Info("log verbosity changed to ", verbosity)
+	}
+	return
+}
+
+// SetLogVModule 修改按源文件设置的日志级别，格式与 glog 的 -vmodule 参数相同。
+// 如 "UpSession*=5" 只提高 UpSessionBTC.go、UpSessionManager.go 等文件的日志级别。
+// 传入空字符串时清除所有按源文件设置的日志级别。
+func SetLogVModule(vmodule string) (err error) {
+	err = flag.Lookup("vmodule").Value.Set(vmodule)
+	if err == nil {
+		Log.Info("log vmodule changed to \"", vmodule, "\"")
+	}
+	return
+}
+
+// LogLevelHandler 通过 HTTP 查看或修改日志级别
+//
+//	GET  /log                          查看当前日志级别
+//	POST /log?v=3                      修改全局日志级别
+//	POST /log?vmodule=UpSession*=5     修改按源文件设置的日志级别
+//	POST /log?exmessage=10&jsonrpc=0   修改子系统的日志级别
+//
+// 修改日志级别只接受 POST；token 不为空时请求还必须带有 "Authorization: Bearer <token>" 头
+type LogLevelHandler struct {
+	token string
+}
+
+// NewLogLevelHandler 创建日志级别的 HTTP 接口，token 为空时不检查 token
+func NewLogLevelHandler(token string) *LogLevelHandler {
+	return &LogLevelHandler{token}
+}
+
+func (handler *LogLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.Form
+
+	if r.Method != http.MethodPost {
+		if len(query) > 0 {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "changing the log level needs POST", http.StatusMethodNotAllowed)
+			return
+		}
+	} else if len(handler.token) > 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(handler.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	for _, subsystem := range logSubsystems {
+		if !query.Has(subsystem.name) {
+			continue
+		}
+		verbosity, err := strconv.Atoi(query.Get(subsystem.name))
+		if err == nil {
+			err = SetLogSubsystemVerbosity(subsystem.name, verbosity)
+		}
+		if err != nil {
+			http.Error(w, "illegal "+subsystem.name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Has("v") {
+		verbosity, err := strconv.Atoi(query.Get("v"))
+		if err == nil {
+			err = SetLogVerbosity(verbosity)
+		}
+		if err != nil {
+			http.Error(w, "illegal v: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Has("vmodule") {
+		err := SetLogVModule(query.Get("vmodule"))
+		if err != nil {
+			http.Error(w, "illegal vmodule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetLogLevel())
+}
@@ -0,0 +1,219 @@
+package btcagent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/golang/glog"
+)
+
+// captureLog 通过 Log.SetWriter 获取 fn 执行期间的日志
+func captureLog(t *testing.T, fn func()) string {
+	output := new(bytes.Buffer)
+	Log.SetWriter(output)
+	fn()
+	Log.SetWriter(nil)
+	return output.String()
+}
+
+func TestLogWriter(t *testing.T) {
+	stderr := os.Stderr
+	var output bytes.Buffer
+	Log.SetWriter(&output)
+	Log.Info("captured by log writer")
+	Log.Warning("warning captured by log writer")
+	Log.SetWriter(nil)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "I") || !strings.Contains(lines[0], " Log_test.go:") ||
+		!strings.HasSuffix(lines[0], "] captured by log writer") ||
+		!strings.HasPrefix(lines[1], "W") || !strings.HasSuffix(lines[1], "] warning captured by log writer") {
+		t.Errorf("wrong log output:\n%s", output.String())
+	}
+	if os.Stderr != stderr {
+		t.Errorf("os.Stderr should not be replaced")
+	}
+
+	// 恢复后不再输出到 w
+	Log.Info("not captured after restore")
+	if strings.Contains(output.String(), "not captured") {
+		t.Errorf("log should not be written after restore:\n%s", output.String())
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	oldLevel := GetLogLevel()
+	defer SetLogVModule(oldLevel.VModule)
+	defer SetLogVerbosity(oldLevel.Verbosity)
+
+	output := captureLog(t, func() {
+		SetLogVerbosity(0)
+		if glog.V(2) {
+			Log.Info("hidden at verbosity 0")
+		}
+		SetLogVerbosity(2)
+		if glog.V(2) {
+			Log.Info("shown at verbosity 2")
+		}
+		if glog.V(3) {
+			Log.Info("hidden at verbosity 2")
+		}
+	})
+	if strings.Contains(output, "hidden at") || !strings.Contains(output, "shown at verbosity 2") {
+		t.Errorf("wrong log output after changing verbosity:\n%s", output)
+	}
+	if GetLogLevel().Verbosity != 2 {
+		t.Errorf("wrong verbosity: %v", GetLogLevel())
+	}
+
+	output = captureLog(t, func() {
+		SetLogVerbosity(0)
+		SetLogVModule("UpSession*=5")
+		if glog.V(3) {
+			Log.Info("hidden by other module")
+		}
+		SetLogVModule("Log_test=3")
+		if glog.V(3) {
+			Log.Info("shown by vmodule")
+		}
+		SetLogVModule("")
+		if glog.V(3) {
+			Log.Info("hidden after vmodule cleared")
+		}
+	})
+	if strings.Contains(output, "hidden") || !strings.Contains(output, "shown by vmodule") {
+		t.Errorf("wrong log output after changing vmodule:\n%s", output)
+	}
+
+	if SetLogVerbosity(-1) == nil {
+		t.Errorf("negative verbosity should be rejected")
+	}
+	if SetLogVModule("UpSession*") == nil {
+		t.Errorf("vmodule without level should be rejected")
+	}
+}
+
+func TestLogSubsystemVerbosity(t *testing.T) {
+	oldLevel := GetLogLevel()
+	defer SetLogVerbosity(oldLevel.Verbosity)
+	for name, verbosity := range oldLevel.Subsystems {
+		defer SetLogSubsystemVerbosity(name, verbosity)
+	}
+
+	config := NewMockPipePool(t, nil).Config(new(SessionFactoryBTC))
+	up := NewUpSessionBTC(NewUpSessionManager("", "", config, NewSessionManager(config)), config, 0, 0)
+	agentConn, poolConn := net.Pipe()
+	defer agentConn.Close()
+	go io.Copy(io.Discard, poolConn)
+	up.serverConn = agentConn
+
+	write := func() {
+		up.writeExMessage(&ExMessageUnregisterWorker{SessionID: 3})
+		request := JSONRPCRequest{ID: "sub", Method: "mining.subscribe", Params: []interface{}{UpSessionUserAgent}}
+		up.writeJSONRequest(&request)
+	}
+
+	SetLogVerbosity(0)
+	for _, test := range []struct {
+		subsystem string
+		shown     string
+		hidden    string
+	}{
+		{"exmessage", "writeExMessage: ", "writeJSONRequest: "},
+		{"jsonrpc", "writeJSONRequest: ", "writeExMessage: "},
+	} {
+		output := captureLog(t, func() {
+			SetLogSubsystemVerbosity(test.subsystem, 10)
+			write()
+			SetLogSubsystemVerbosity(test.subsystem, 0)
+			write()
+		})
+		if strings.Count(output, test.shown) != 1 || strings.Contains(output, test.hidden) {
+			t.Errorf("wrong log output with verbose %s:\n%s", test.subsystem, output)
+		}
+	}
+	if !strings.Contains(captureLog(t, func() {
+		SetLogSubsystemVerbosity("exmessage", 10)
+		write()
+		SetLogSubsystemVerbosity("exmessage", 0)
+	}), "len=6 ") {
+		t.Errorf("length of ex-message is not logged")
+	}
+
+	// 子系统的日志级别不会降低全局日志级别
+	SetLogVerbosity(10)
+	output := captureLog(t, write)
+	if !strings.Contains(output, "writeExMessage: ") || !strings.Contains(output, "writeJSONRequest: ") {
+		t.Errorf("global verbosity is lowered by subsystems:\n%s", output)
+	}
+
+	if SetLogSubsystemVerbosity("exmessage", -1) == nil || SetLogSubsystemVerbosity("unknown", 1) == nil {
+		t.Errorf("illegal subsystem verbosity should be rejected")
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	oldLevel := GetLogLevel()
+	defer SetLogVModule(oldLevel.VModule)
+	defer SetLogVerbosity(oldLevel.Verbosity)
+	defer SetLogSubsystemVerbosity("jsonrpc", oldLevel.Subsystems["jsonrpc"])
+
+	handler := NewLogLevelHandler("secret")
+	serve := func(method string, target string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		if len(token) > 0 {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := serve("GET", "/log", "")
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"vmodule"`) {
+		t.Errorf("viewing the log level should not need a token: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve("GET", "/log?v=4", "secret")
+	if recorder.Code != 405 || GetLogLevel().Verbosity != oldLevel.Verbosity {
+		t.Errorf("GET should not change the log level: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		recorder = serve("POST", "/log?v=4&jsonrpc=9", token)
+		if recorder.Code != 401 || GetLogLevel().Verbosity != oldLevel.Verbosity || GetLogLevel().Subsystems["jsonrpc"] != oldLevel.Subsystems["jsonrpc"] {
+			t.Errorf("POST with token %q should be rejected: %d %s", token, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder = serve("POST", "/log?v=4&vmodule=UpSession*=6", "secret")
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"v":4`) {
+		t.Errorf("wrong response: %d %s", recorder.Code, recorder.Body.String())
+	}
+	level := GetLogLevel()
+	if level.Verbosity != 4 || level.VModule != "UpSession*=6" {
+		t.Errorf("wrong log level: %v", level)
+	}
+
+	recorder = serve("POST", "/log?jsonrpc=9", "secret")
+	if recorder.Code != 200 || GetLogLevel().Subsystems["jsonrpc"] != 9 || GetLogLevel().Subsystems["exmessage"] != 0 {
+		t.Errorf("wrong subsystem log level: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve("POST", "/log?v=abc", "secret")
+	if recorder.Code != 400 {
+		t.Errorf("illegal verbosity should be rejected: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// token 为空时不检查 token
+	recorder = httptest.NewRecorder()
+	NewLogLevelHandler("").ServeHTTP(recorder, httptest.NewRequest("POST", "/log?v=5", nil))
+	if recorder.Code != 200 || GetLogLevel().Verbosity != 5 {
+		t.Errorf("POST without a configured token should be allowed: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,310 @@
+package btcagent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric 一个指标，按 Prometheus 文本格式输出
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metricValues 按标签保存的指标值
+type metricValues struct {
+	name   string
+	help   string
+	kind   string
+	lock   sync.Mutex
+	values map[string]float64 // map[标签]值
+}
+
+func newMetricValues(name, help, kind string) *metricValues {
+	return &metricValues{name: name, help: help, kind: kind, values: make(map[string]float64)}
+}
+
+// metricLabels 将 "key1", "value1", "key2", "value2" 形式的标签转换为 key1="value1",key2="value2"
+func metricLabels(labels []string) string {
+	var builder strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(labels[i])
+		builder.WriteString("=")
+		builder.WriteString(strconv.Quote(labels[i+1]))
+	}
+	return builder.String()
+}
+
+func (m *metricValues) add(delta float64, labels []string) {
+	key := metricLabels(labels)
+	m.lock.Lock()
+	m.values[key] += delta
+	m.lock.Unlock()
+}
+
+func (m *metricValues) set(value float64, labels []string) {
+	key := metricLabels(labels)
+	m.lock.Lock()
+	m.values[key] = value
+	m.lock.Unlock()
+}
+
+func (m *metricValues) get(labels []string) float64 {
+	key := metricLabels(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[key]
+}
+
+func (m *metricValues) writeTo(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	if len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strconv.FormatFloat(m.values[key], 'g', -1, 64)
+		if len(key) > 0 {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, key, value)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", m.name, value)
+		}
+	}
+}
+
+// MetricCounter 只增不减的计数器
+type MetricCounter struct {
+	values *metricValues
+}
+
+// Inc 计数加一，labels 为 "key1", "value1", "key2", "value2" 形式的标签
+func (c *MetricCounter) Inc(labels ...string) {
+	c.values.add(1, labels)
+}
+
+// Add 计数增加 delta
+func (c *MetricCounter) Add(delta float64, labels ...string) {
+	if delta > 0 {
+		c.values.add(delta, labels)
+	}
+}
+
+// Get 获取当前计数
+func (c *MetricCounter) Get(labels ...string) float64 {
+	return c.values.get(labels)
+}
+
+// MetricGauge 可增可减的数值
+type MetricGauge struct {
+	values *metricValues
+}
+
+// Add 数值增加 delta（可以为负数）
+func (g *MetricGauge) Add(delta float64, labels ...string) {
+	g.values.add(delta, labels)
+}
+
+// Set 设置数值
+func (g *MetricGauge) Set(value float64, labels ...string) {
+	g.values.set(value, labels)
+}
+
+// Get 获取当前数值
+func (g *MetricGauge) Get(labels ...string) float64 {
+	return g.values.get(labels)
+}
+
+// MetricHistogram 按区间统计观测值的分布
+type MetricHistogram struct {
+	name    string
+	help    string
+	lock    sync.Mutex
+	buckets []float64 // 各区间的上限，从小到大
+	counts  []uint64  // 落入各区间的观测次数（不累加）
+	sum     float64
+	count   uint64
+}
+
+// Observe 记录一个观测值
+func (h *MetricHistogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Count 获取观测次数
+func (h *MetricHistogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Sum 获取观测值之和
+func (h *MetricHistogram) Sum() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sum
+}
+
+func (h *MetricHistogram) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Metrics 程序的运行指标，可以在多个 goroutine 中使用。
+// 通过 HTTP 以 Prometheus 文本格式输出。
+type Metrics struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewMetrics() *Metrics {
+	return new(Metrics)
+}
+
+func (metrics *Metrics) register(m metric) {
+	metrics.lock.Lock()
+	metrics.metrics = append(metrics.metrics, m)
+	metrics.lock.Unlock()
+}
+
+// NewCounter 创建并注册一个计数器
+func (metrics *Metrics) NewCounter(name, help string) (counter *MetricCounter) {
+	counter = &MetricCounter{newMetricValues(name, help, "counter")}
+	metrics.register(counter.values)
+	return
+}
+
+// NewGauge 创建并注册一个数值
+func (metrics *Metrics) NewGauge(name, help string) (gauge *MetricGauge) {
+	gauge = &MetricGauge{newMetricValues(name, help, "gauge")}
+	metrics.register(gauge.values)
+	return
+}
+
+// NewHistogram 创建并注册一个直方图，buckets 为从小到大排列的区间上限
+func (metrics *Metrics) NewHistogram(name, help string, buckets []float64) (histogram *MetricHistogram) {
+	histogram = &MetricHistogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metrics.register(histogram)
+	return
+}
+
+// WriteText 按注册顺序输出所有指标
+func (metrics *Metrics) WriteText(w io.Writer) {
+	metrics.lock.Lock()
+	list := metrics.metrics
+	metrics.lock.Unlock()
+
+	for _, m := range list {
+		m.writeTo(w)
+	}
+}
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteText(w)
+}
+
+// AgentMetrics BTCAgent 输出的所有指标
+type AgentMetrics struct {
+	*Metrics
+
+	// 所有矿机连接上已转发给矿池、尚未收到响应的 share 数
+	OutstandingSubmits *MetricGauge
+	// 因未响应的 share 过多而在本地拒绝的 share 数
+	OutstandingSubmitsRejected *MetricCounter
+	// 从收到矿机提交到收到矿池响应的时间（秒），只在启用 subres 时统计
+	SubmitResponseSeconds *MetricHistogram
+	// 事件通道已满时丢弃的事件数，按事件类别（class）统计
+	DroppedEvents *MetricCounter
+	// 因 extranonce1（sessionID）已全部分配而拒绝的矿机连接数
+	ExtranonceExhausted *MetricCounter
+	// 因 extranonce1（sessionID）已全部分配而踢掉的矿机连接数，按原因（reason：idle 或 oldest）统计
+	MinersEvicted *MetricCounter
+	// 矿机认证之前提交、在本地拒绝的 share 数
+	UnauthorizedSubmits *MetricCounter
+	// 当前连接的矿机声明的算力之和（H/s）
+	DeclaredHashrate *MetricGauge
+	// 接受的 share 的难度之和，与 DeclaredHashrate 对照：BTC 的算力约为其增长率乘以 2^32
+	AcceptedDifficulty *MetricCounter
+	// 矿池订阅结果中的 extranonce2 大小不符合要求而放弃的矿池连接数，按矿池（pool）和大小（extranonce2_size）统计
+	IncompatibleExtranonce *MetricCounter
+	// 滚动了矿池掩码之外的版本位的 share 数，按处理方式（action：corrected 或 rejected）统计
+	IllegalVersionBits *MetricCounter
+	// 矿池未响应、在本地响应为接受的 share 数，按原因（reason：timeout 或 evicted）统计，这些 share 的实际结果未知
+	UnconfirmedSubmits *MetricCounter
+	// 低于矿池难度（不提交到矿池或被矿池拒绝）、但满足被 difficulty_clamp 调低的矿机难度而向矿机响应为接受的 share 数
+	ClampedSubmits *MetricCounter
+	// 矿池连接不可用时提交到本地假任务的 share 数，向矿机响应为接受，但不计入 share 统计和算力
+	FakeJobSubmits *MetricCounter
+}
+
+func NewAgentMetrics() (metrics *AgentMetrics) {
+	metrics = &AgentMetrics{Metrics: NewMetrics()}
+	metrics.OutstandingSubmits = metrics.NewGauge("btcagent_outstanding_submits",
+		"Shares forwarded to pool servers and waiting for responses.")
+	metrics.OutstandingSubmitsRejected = metrics.NewCounter("btcagent_outstanding_submits_rejected_total",
+		"Shares rejected locally because a miner connection had too many outstanding submits.")
+	metrics.SubmitResponseSeconds = metrics.NewHistogram("btcagent_submit_response_seconds",
+		"Time from receiving a share from a miner to receiving its response from the pool server.",
+		SubmitResponseSecondsBuckets)
+	metrics.DroppedEvents = metrics.NewCounter("btcagent_dropped_events_total",
+		"Events dropped because the event queue of a session was full, see advanced.message_queue_overflow.")
+	metrics.ExtranonceExhausted = metrics.NewCounter("btcagent_extranonce_exhausted_total",
+		"Miner connections rejected because all extranonce1 values (session ids) were in use.")
+	metrics.MinersEvicted = metrics.NewCounter("btcagent_miners_evicted_total",
+		"Miner connections closed to make room for new miners because all session ids were in use, see advanced.miner_capacity_eviction.")
+	metrics.UnauthorizedSubmits = metrics.NewCounter("btcagent_unauthorized_submits_total",
+		"Shares rejected locally because the miner had not authorized, they are never forwarded to pool servers.")
+	metrics.DeclaredHashrate = metrics.NewGauge("btcagent_declared_hashrate",
+		"Sum of the hashrate (H/s) declared by connected miners via mining.hashrate, extended mining.submit or eth_submitHashrate.")
+	metrics.AcceptedDifficulty = metrics.NewCounter("btcagent_accepted_difficulty_total",
+		"Sum of the difficulty of accepted shares, the estimated hashrate of BTC is its rate multiplied by 2^32.")
+	metrics.IncompatibleExtranonce = metrics.NewCounter("btcagent_pool_incompatible_extranonce_total",
+		"Pool connections given up because the extranonce2 size in the subscribe result of the pool server was not supported.")
+	metrics.IllegalVersionBits = metrics.NewCounter("btcagent_illegal_version_bits_total",
+		"Shares rolling version bits outside the mask allowed by the pool server, corrected (bits stripped) or rejected, see advanced.reject_illegal_version_mask.")
+	metrics.UnconfirmedSubmits = metrics.NewCounter("btcagent_unconfirmed_submits_total",
+		"Shares acknowledged to miners as accepted without a response from the pool server, because of the response timeout or too many shares waiting for responses, their real result is unknown.")
+	metrics.ClampedSubmits = metrics.NewCounter("btcagent_clamped_submits_total",
+		"Shares below the pool difficulty, not submitted or rejected by the pool server, but reported to miners as accepted because they met the difficulty lowered by difficulty_clamp.")
+	metrics.FakeJobSubmits = metrics.NewCounter("btcagent_fake_job_submits_total",
+		"Shares on the local fake job while no pool connection is available, reported to miners as accepted but not counted in share statistics.")
+	return
+}
@@ -0,0 +1,70 @@
+package btcagent
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	metrics := NewMetrics()
+	gauge := metrics.NewGauge("test_gauge", "A gauge.")
+	counter := metrics.NewCounter("test_total", "A counter.")
+	metrics.NewCounter("test_empty_total", "An empty counter.")
+
+	gauge.Add(3)
+	gauge.Add(-1)
+	counter.Inc("pool", "us.ss.btc.com:1800")
+	counter.Add(2, "pool", "us.ss.btc.com:1800")
+	counter.Add(-5, "pool", "us.ss.btc.com:1800")
+	counter.Inc("pool", `a"b`)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 2
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{pool="a\"b"} 1
+test_total{pool="us.ss.btc.com:1800"} 3
+# HELP test_empty_total An empty counter.
+# TYPE test_empty_total counter
+test_empty_total 0
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("wrong metrics output:\n%s", body)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("wrong content type: %s", recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	metrics := NewMetrics()
+	histogram := metrics.NewHistogram("test_seconds", "A histogram.", []float64{0.01, 0.1, 1})
+
+	histogram.Observe(0.005)
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(3)
+
+	var builder strings.Builder
+	metrics.WriteText(&builder)
+	expected := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.01"} 1
+test_seconds_bucket{le="0.1"} 3
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.155
+test_seconds_count 4
+`
+	if body := builder.String(); body != expected {
+		t.Errorf("wrong histogram output:\n%s", body)
+	}
+	if histogram.Count() != 4 {
+		t.Errorf("wrong count: %d", histogram.Count())
+	}
+}
@@ -0,0 +1,93 @@
+package btcagent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// MinerCapacity 记录占用会话ID的矿机连接（不包括透传模式），会话ID用完时按 miner_capacity_eviction 选出并断开一个连接，
+// 为新的矿机腾出会话ID。可以在任意 goroutine 中调用。
+type MinerCapacity struct {
+	lock     sync.Mutex
+	sessions map[uint16]*minerCapacitySession
+}
+
+type minerCapacitySession struct {
+	id        string         // 打印日志用的连接标识符，认证后包含矿工名
+	conn      net.Conn       // 到矿机的连接，关闭后由矿机连接自行退出并释放会话ID
+	hashrate  *MinerHashrate // 用于获取最后一次接受 share 的时间
+	connected time.Time      // 建立连接的时间
+}
+
+func NewMinerCapacity() *MinerCapacity {
+	return &MinerCapacity{sessions: make(map[uint16]*minerCapacitySession)}
+}
+
+// Add 记录新的矿机连接
+func (capacity *MinerCapacity) Add(sessionID uint16, id string, conn net.Conn, hashrate *MinerHashrate, now time.Time) {
+	capacity.lock.Lock()
+	capacity.sessions[sessionID] = &minerCapacitySession{id, conn, hashrate, now}
+	capacity.lock.Unlock()
+}
+
+// Authorized 矿机认证后更新其日志标识符
+func (capacity *MinerCapacity) Authorized(sessionID uint16, id string) {
+	capacity.lock.Lock()
+	if session, ok := capacity.sessions[sessionID]; ok {
+		session.id = id
+	}
+	capacity.lock.Unlock()
+}
+
+// Remove 矿机连接关闭后、释放会话ID之前移除其记录
+func (capacity *MinerCapacity) Remove(sessionID uint16) {
+	capacity.lock.Lock()
+	delete(capacity.sessions, sessionID)
+	capacity.lock.Unlock()
+}
+
+// Evict 断开一个矿机连接并移除其记录，返回其描述和原因（idle 或 oldest）。
+// 优先选择 idle 时间内没有被接受的 share（刚连接的矿机从连接时算起）的连接中最早建立的；
+// 没有空闲的连接时，neverEvictActive 为 false 则选择最早建立的连接，否则不断开任何连接，返回 false。
+func (capacity *MinerCapacity) Evict(idle time.Duration, neverEvictActive bool, now time.Time) (victim string, reason string, ok bool) {
+	capacity.lock.Lock()
+	var idleID, oldestID uint16
+	var idleSession, oldestSession *minerCapacitySession
+	for sessionID, session := range capacity.sessions {
+		if oldestSession == nil || session.connected.Before(oldestSession.connected) {
+			oldestID, oldestSession = sessionID, session
+		}
+		if now.Sub(session.lastActive()) >= idle && (idleSession == nil || session.connected.Before(idleSession.connected)) {
+			idleID, idleSession = sessionID, session
+		}
+	}
+
+	sessionID, session := idleID, idleSession
+	reason = "idle"
+	if session == nil {
+		if neverEvictActive || oldestSession == nil {
+			capacity.lock.Unlock()
+			return
+		}
+		sessionID, session = oldestID, oldestSession
+		reason = "oldest"
+	}
+	delete(capacity.sessions, sessionID)
+	victim = fmt.Sprintf("%sconnected %v ago, last active %v ago", session.id,
+		now.Sub(session.connected).Truncate(time.Second), now.Sub(session.lastActive()).Truncate(time.Second))
+	capacity.lock.Unlock()
+
+	// 关闭连接可能阻塞（如 TLS 连接发送 close_notify），不能持有锁，以免阻塞其他矿机的连接和断开
+	session.conn.Close()
+	return victim, reason, true
+}
+
+// lastActive 最后一次接受 share 的时间，从未接受过时为建立连接的时间
+func (session *minerCapacitySession) lastActive() time.Time {
+	if last := session.hashrate.LastAccepted(); last.After(session.connected) {
+		return last
+	}
+	return session.connected
+}
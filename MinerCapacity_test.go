@@ -0,0 +1,102 @@
+package btcagent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMinerCapacityEvict(t *testing.T) {
+	now := time.Now()
+	newCapacity := func() *MinerCapacity {
+		capacity := NewMinerCapacity()
+		// 会话 1 最早连接，但刚刚有被接受的 share；会话 2 刚连接，还不算空闲
+		active := new(MinerHashrate)
+		active.AddAccepted(1)
+		for _, s := range []struct {
+			sessionID uint16
+			hashrate  *MinerHashrate
+			connected time.Time
+		}{
+			{1, active, now.Add(-2 * time.Hour)},
+			{2, new(MinerHashrate), now.Add(-time.Minute)},
+		} {
+			client, server := net.Pipe()
+			client.Close()
+			capacity.Add(s.sessionID, fmt.Sprintf("miner#%d ", s.sessionID), server, s.hashrate, s.connected)
+		}
+		return capacity
+	}
+
+	// 没有空闲的矿机时不踢掉活跃的矿机
+	capacity := newCapacity()
+	if victim, _, ok := capacity.Evict(10*time.Minute, true, now); ok {
+		t.Errorf("active miner %s should not be evicted", victim)
+	}
+
+	// 关闭保护后踢掉最早连接的矿机，之后不会再次选中它
+	victim, reason, ok := capacity.Evict(10*time.Minute, false, now)
+	if !ok || reason != "oldest" || victim[:8] != "miner#1 " {
+		t.Errorf("wrong victim: %q, %s, %v", victim, reason, ok)
+	}
+	victim, reason, ok = capacity.Evict(10*time.Minute, false, now)
+	if !ok || reason != "oldest" || victim[:8] != "miner#2 " {
+		t.Errorf("wrong second victim: %q, %s, %v", victim, reason, ok)
+	}
+	if _, _, ok = capacity.Evict(10*time.Minute, false, now); ok {
+		t.Error("no miner left to evict")
+	}
+
+	// 一分钟没有 share 的矿机在 idle 为 30 秒时是空闲的，优先于更早连接的活跃矿机
+	capacity = newCapacity()
+	victim, reason, ok = capacity.Evict(30*time.Second, true, now)
+	if !ok || reason != "idle" || victim != "miner#2 connected 1m0s ago, last active 1m0s ago" {
+		t.Errorf("wrong idle victim: %q, %s, %v", victim, reason, ok)
+	}
+}
+
+// blockingCloseConn Close 阻塞到 release 关闭，模拟对端不读取时发送 TLS close_notify
+type blockingCloseConn struct {
+	net.Conn
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (conn *blockingCloseConn) Close() error {
+	close(conn.closing)
+	<-conn.release
+	return conn.Conn.Close()
+}
+
+func TestMinerCapacityEvictClosesOutsideLock(t *testing.T) {
+	capacity := NewMinerCapacity()
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &blockingCloseConn{server, make(chan struct{}), make(chan struct{})}
+	capacity.Add(1, "miner#1 ", conn, new(MinerHashrate), time.Now())
+
+	evicted := make(chan bool, 1)
+	go func() {
+		_, _, ok := capacity.Evict(0, false, time.Now())
+		evicted <- ok
+	}()
+	<-conn.closing
+
+	// 关闭连接期间其他矿机仍可以连接和断开
+	done := make(chan struct{})
+	go func() {
+		capacity.Add(2, "miner#2 ", server, new(MinerHashrate), time.Now())
+		capacity.Remove(2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capacity is locked while closing the evicted connection")
+	}
+	close(conn.release)
+	if !<-evicted {
+		t.Error("miner should be evicted")
+	}
+}
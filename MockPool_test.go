@@ -0,0 +1,146 @@
+package btcagent
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// MockPool 用于测试的矿池服务器，每个连接由 handler 处理
+type MockPool struct {
+	t        *testing.T
+	listener net.Listener
+	handler  func(pool *MockPool, conn net.Conn, reader *bufio.Reader)
+}
+
+func NewMockPool(t *testing.T, handler func(pool *MockPool, conn net.Conn, reader *bufio.Reader)) (pool *MockPool) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mock pool listen failed: %s", err.Error())
+	}
+
+	pool = &MockPool{t, listener, handler}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go pool.serve(conn)
+		}
+	}()
+	return
+}
+
+// NewMockPipePool 创建不监听端口的矿池，BTCAgent 通过 Config() 中的 Dialer 以 net.Pipe 连接到它
+func NewMockPipePool(t *testing.T, handler func(pool *MockPool, conn net.Conn, reader *bufio.Reader)) (pool *MockPool) {
+	return &MockPool{t, nil, handler}
+}
+
+func (pool *MockPool) serve(conn net.Conn) {
+	defer conn.Close()
+	pool.handler(pool, conn, bufio.NewReader(conn))
+}
+
+// Dial 创建一对 net.Pipe 连接，一端由 handler 处理，另一端返回给 BTCAgent
+func (pool *MockPool) Dial(network, addr string) (net.Conn, error) {
+	agentConn, poolConn := net.Pipe()
+	go pool.serve(poolConn)
+	return agentConn, nil
+}
+
+func (pool *MockPool) PoolInfo(subAccount string) PoolInfo {
+	if pool.listener == nil {
+		return PoolInfo{Host: "mock.pool", Port: 3333, SubAccount: subAccount}
+	}
+	addr := pool.listener.Addr().(*net.TCPAddr)
+	return PoolInfo{Host: addr.IP.String(), Port: uint16(addr.Port), SubAccount: subAccount}
+}
+
+// Config 创建连接到该矿池的单用户模式配置
+func (pool *MockPool) Config(factory SessionFactory) (config *Config) {
+	config = NewConfig()
+	config.Pools = []PoolInfo{pool.PoolInfo("test")}
+	config.sessionFactory = factory
+	if pool.listener == nil {
+		config.dialer = pool
+	}
+	return
+}
+
+// ReadRequest 读取 BTCAgent 发送的一个 JSON 请求
+func (pool *MockPool) ReadRequest(reader *bufio.Reader) (request *JSONRPCRequest, err error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	return NewJSONRPCRequest(line)
+}
+
+// WriteLine 向 BTCAgent 发送一行数据
+func (pool *MockPool) WriteLine(conn net.Conn, line string) {
+	conn.Write([]byte(line + "\n"))
+}
+
+// AcceptConnTest 响应 BTCAgent 在建立连接时发送的测试请求
+func (pool *MockPool) AcceptConnTest(conn net.Conn, reader *bufio.Reader) bool {
+	request, err := pool.ReadRequest(reader)
+	if err != nil || request.ID != "conn_test" {
+		return false
+	}
+	pool.WriteLine(conn, `{"id":"conn_test","result":{"capabilities":["verrol","subres"]},"error":null}`)
+	return true
+}
+
+// AcceptHandshakeBTC 响应 BTCAgent 矿池连接的测试请求和握手请求（订阅、认证等），并下发一个任务
+func (pool *MockPool) AcceptHandshakeBTC(conn net.Conn, reader *bufio.Reader) bool {
+	return pool.AcceptHandshakeBTCWithAuthorize(conn, reader, func(request *JSONRPCRequest) bool { return true })
+}
+
+// AcceptHandshakeBTCWithAuthorize 同 AcceptHandshakeBTC，但由 authorize 决定是否接受 mining.authorize 请求。
+// 拒绝认证时返回 false，连接由 BTCAgent 关闭。
+func (pool *MockPool) AcceptHandshakeBTCWithAuthorize(conn net.Conn, reader *bufio.Reader, authorize func(request *JSONRPCRequest) bool) bool {
+	return pool.acceptHandshakeBTC(conn, reader, "", authorize)
+}
+
+// AcceptHandshakeBTCUntil 同 AcceptHandshakeBTC，但收到 ID 为 closeAt 的握手请求（caps、conf、sub、auth）时不响应，返回 false
+func (pool *MockPool) AcceptHandshakeBTCUntil(conn net.Conn, reader *bufio.Reader, closeAt string) bool {
+	return pool.acceptHandshakeBTC(conn, reader, closeAt, func(request *JSONRPCRequest) bool { return true })
+}
+
+func (pool *MockPool) acceptHandshakeBTC(conn net.Conn, reader *bufio.Reader, closeAt string, authorize func(request *JSONRPCRequest) bool) bool {
+	if !pool.AcceptConnTest(conn, reader) {
+		return false
+	}
+	for {
+		request, err := pool.ReadRequest(reader)
+		if err != nil {
+			return false
+		}
+		if request.ID == closeAt {
+			return false
+		}
+		switch request.ID {
+		case "caps", "caps_again":
+			pool.WriteLine(conn, `{"id":"`+request.ID.(string)+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+		case "conf":
+			pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+		case "sub":
+			pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+		case "auth":
+			if !authorize(request) {
+				pool.WriteLine(conn, `{"id":"auth","result":false,"error":[29,"Invalid username",null]}`)
+				return false
+			}
+			pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+		}
+		if request.ID == "caps_again" {
+			break
+		}
+	}
+	pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+		`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+	return true
+}
@@ -0,0 +1,269 @@
+package btcagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//////////////////////////////// PassthroughSession //////////////////////////////
+
+// PassthroughSession 透传模式（passthrough.enable 或矿池的 passthrough 选项）下的矿机连接。
+//
+// 每台矿机使用单独的矿池连接，双方的 JSON-RPC 消息按行原样转发，不通过 ex-message 聚合，
+// 因此可以连接不支持 BTCAgent 协议的矿池。启用 rewrite_worker_name 时，
+// 矿机请求中的矿工名和密码按 sub_account、fixed_worker_name 等配置替换，其余内容不变。
+// 只在连接时按顺序尝试各个以透传模式连接的矿池，矿池连接断开后矿机连接也随之断开，由矿机重连。
+type PassthroughSession struct {
+	manager    *SessionManager
+	config     *Config
+	sessionID  uint16
+	id         string // 打印日志用的连接标识符
+	poolIndex  int
+	clientConn net.Conn
+	serverConn net.Conn
+
+	// 矿机在 mining.authorize 中提供的矿工名 -> 发给矿池的矿工名，只在 relayToPool 中使用
+	workerNames    map[string]string
+	lastWorkerName string
+}
+
+func NewPassthroughSession(manager *SessionManager, clientConn net.Conn, sessionID uint16) (session *PassthroughSession) {
+	session = new(PassthroughSession)
+	session.manager = manager
+	session.config = manager.poolsConfig()
+	session.sessionID = sessionID
+	session.clientConn = clientConn
+	session.workerNames = make(map[string]string)
+	session.id, _ = manager.sessionLogID("passthrough", sessionID, clientConn)
+
+	Log.Info(session.id, "miner connected")
+	return
+}
+
+// dial 依次尝试代理和直连，返回第一个成功的连接
+func (session *PassthroughSession) dial(poolIndex int) (conn net.Conn, err error) {
+	return DialPool(session.config, poolIndex, session.id)
+}
+
+// Run 连接矿池并转发消息，直到任意一方断开
+func (session *PassthroughSession) Run() {
+	defer session.manager.sessionIDManager.FreeSessionID(session.sessionID)
+
+	pools := 0
+	for i := range session.config.Pools {
+		if !session.config.PassthroughPool(i) {
+			continue
+		}
+		pools++
+		conn, err := session.dial(i)
+		if err == nil {
+			session.poolIndex = i
+			session.serverConn = conn
+			break
+		}
+	}
+	if session.serverConn == nil {
+		Log.Error(session.id, "failed to connect to all ", pools, " pool servers")
+		session.clientConn.Close()
+		return
+	}
+	session.id += fmt.Sprintf("[%s] ", session.serverConn.RemoteAddr().String())
+	Log.Info(session.id, "connected to pool server")
+
+	ctx, cancel := context.WithCancel(session.manager.ctx)
+	go func() {
+		// 任意一方断开或代理退出时关闭两个连接，以结束另一方向的转发
+		<-ctx.Done()
+		session.clientConn.Close()
+		session.serverConn.Close()
+	}()
+	go func() {
+		session.relayToMiner()
+		cancel()
+	}()
+	session.relayToPool()
+	cancel()
+
+	Log.Info(session.id, "miner disconnected")
+}
+
+// relayToPool 将矿机的请求转发给矿池
+func (session *PassthroughSession) relayToPool() {
+	reader := bufio.NewReaderSize(session.clientConn, int(session.config.Advanced.ReadBufferSize.MinerSession))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if glog.V(3) {
+				Log.Info(session.id, "failed to read request from miner: ", err.Error())
+			}
+			return
+		}
+		if glog.V(12) || LogJSONRPC.V(12) {
+			Log.Info(session.id, "recv from miner: ", string(line))
+		}
+
+		if session.rejectSubAccount(line) {
+			return
+		}
+		if session.config.Passthrough.RewriteWorkerName {
+			line = session.rewriteRequest(line)
+		}
+
+		session.serverConn.SetWriteDeadline(time.Now().Add(session.config.PoolWriteTimeout(session.poolIndex)))
+		_, err = session.serverConn.Write(line)
+		if err != nil {
+			Log.Error(session.id, "failed to write to pool server: ", err.Error())
+			return
+		}
+	}
+}
+
+// relayToMiner 将矿池的消息转发给矿机
+func (session *PassthroughSession) relayToMiner() {
+	reader := bufio.NewReaderSize(session.serverConn, int(session.config.Advanced.ReadBufferSize.PoolSession))
+	for {
+		session.serverConn.SetReadDeadline(time.Now().Add(session.config.PoolReadTimeout(session.poolIndex)))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if glog.V(3) {
+				Log.Info(session.id, "failed to read from pool server: ", err.Error())
+			}
+			return
+		}
+		if glog.V(12) || LogJSONRPC.V(12) {
+			Log.Info(session.id, "recv from pool server: ", string(line))
+		}
+
+		_, err = session.clientConn.Write(line)
+		if err != nil {
+			if glog.V(3) {
+				Log.Info(session.id, "failed to write to miner: ", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// rejectSubAccount 多用户模式下拒绝子账户不在 sub_account_allowlist 中的认证请求，
+// 响应错误后返回 true，由调用方断开连接。不论是否启用 rewrite_worker_name 都会检查。
+func (session *PassthroughSession) rejectSubAccount(line []byte) bool {
+	if session.config.subAccountAllowlist == nil {
+		return false
+	}
+	request, err := NewJSONRPCRequest(line)
+	if err != nil || len(request.Params) < 1 {
+		return false
+	}
+	switch NormalizeMethod(request.Method) {
+	case "mining.authorize", "eth_submitlogin":
+	default:
+		return false
+	}
+	name, _ := request.Params[0].(string)
+	_, stratumErr := ParseWorkerName(session.config, name, ConnRemoteAddr(session.clientConn))
+	if stratumErr != StratumErrSubAccountNotAllowed {
+		return false
+	}
+
+	Log.Warning(session.id, "reject miner, sub-account is not in sub_account_allowlist: ", string(line))
+	response := JSONRPCResponse{request.ID, nil, stratumErr.ToJSONRPCError(session.config.MinerErrorFormat, nil)}
+	bytes, err := response.ToJSONBytesLine()
+	if err == nil {
+		session.clientConn.SetWriteDeadline(time.Now().Add(DownSessionFlushTimeoutSeconds.Get()))
+		session.clientConn.Write(bytes)
+	}
+	return true
+}
+
+// rewriteRequest 替换矿机请求中的矿工名（和认证密码），其余字段原样保留。无需替换或无法解析时返回原请求。
+func (session *PassthroughSession) rewriteRequest(line []byte) []byte {
+	var request map[string]json.RawMessage
+	if json.Unmarshal(line, &request) != nil || request == nil {
+		return line
+	}
+	var method string
+	json.Unmarshal(request["method"], &method)
+	method = NormalizeMethod(method)
+
+	changed := false
+	var params []json.RawMessage
+	if json.Unmarshal(request["params"], &params) == nil && len(params) > 0 {
+		var name string
+		if json.Unmarshal(params[0], &name) == nil {
+			switch method {
+			case "mining.authorize", "eth_submitlogin":
+				poolName, password := session.authorizeWorker(name, params)
+				params[0], _ = json.Marshal(poolName)
+				if len(params) > 1 {
+					params[1], _ = json.Marshal(password)
+				}
+				changed = true
+			case "mining.submit":
+				params[0], _ = json.Marshal(session.submitWorker(name))
+				changed = true
+			}
+		}
+		if changed {
+			request["params"], _ = json.Marshal(params)
+		}
+	}
+
+	// ethminer 的 ETHProxy 协议在 worker 字段中提供矿机名
+	var worker string
+	if json.Unmarshal(request["worker"], &worker) == nil && len(worker) > 0 && len(session.lastWorkerName) > 0 {
+		request["worker"], _ = json.Marshal(session.lastWorkerName)
+		changed = true
+	}
+
+	if !changed {
+		return line
+	}
+	bytes, err := json.Marshal(request)
+	if err != nil {
+		Log.Warning(session.id, "failed to rewrite request: ", err.Error(), "; ", string(line))
+		return line
+	}
+	return append(bytes, '\n')
+}
+
+// authorizeWorker 获取 mining.authorize 中发给矿池的矿工名和密码，与聚合模式下向矿池认证和注册的名称相同
+func (session *PassthroughSession) authorizeWorker(name string, params []json.RawMessage) (poolName string, password string) {
+	var minerPassword string
+	if len(params) > 1 {
+		json.Unmarshal(params[1], &minerPassword)
+	}
+
+	worker, err := ParseWorkerName(session.config, name, ConnRemoteAddr(session.clientConn))
+	if err != nil {
+		// 多用户模式下缺少子账户名，交给矿池处理
+		return name, minerPassword
+	}
+	subAccount := worker.SubAccountName
+	if !session.config.MultiUserMode {
+		subAccount = session.config.PoolSubAccount(session.poolIndex)
+	}
+
+	poolName = session.config.PoolWorkerName(session.poolIndex, subAccount, worker.WorkerName)
+	password = session.config.PoolAuthorizePassword(session.poolIndex, subAccount, minerPassword)
+	session.workerNames[name] = poolName
+	session.lastWorkerName = poolName
+	return
+}
+
+// submitWorker 获取 mining.submit 中发给矿池的矿工名
+func (session *PassthroughSession) submitWorker(name string) string {
+	if poolName, ok := session.workerNames[name]; ok {
+		return poolName
+	}
+	// 有些挖矿软件提交时只提供“.”之后的矿机名，或者与认证时的名称不同
+	if len(session.lastWorkerName) > 0 {
+		return session.lastWorkerName
+	}
+	return name
+}
@@ -0,0 +1,188 @@
+package btcagent
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassthroughSessionShares(t *testing.T) {
+	// 只支持普通 stratum 协议的矿池，记录收到的请求
+	requests := make(chan *JSONRPCRequest, 16)
+	connections := make(chan bool, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		connections <- true
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			requests <- request
+			switch request.Method {
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":1,"result":[[["mining.notify","ae6812eb4cd7735a302a8a9dd95cf71f"]],"08000002",4],"error":null}`)
+			case "mining.authorize":
+				pool.WriteLine(conn, `{"id":2,"result":true,"error":null}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["bf","0000000000000000000000000000000000000000000000000000000000000000",`+
+					`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+			case "mining.submit":
+				pool.WriteLine(conn, `{"id":12345678901234567890,"result":true,"error":null}`)
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Passthrough.Enable = true
+	config.PoolPassword.Default = "pool-secret"
+	manager := startTestSessionManager(t, config)
+
+	conn := dialTestMinerBTC(t, manager, "miner-user.w1", "mining.notify")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	expectRequest := func(method string) *JSONRPCRequest {
+		t.Helper()
+		for {
+			select {
+			case request := <-requests:
+				if request.Method == method {
+					return request
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("pool did not receive %s", method)
+				return nil
+			}
+		}
+	}
+
+	// 矿工名和密码按单用户模式的配置替换
+	authorize := expectRequest("mining.authorize")
+	if authorize.Params[0] != "test.w1" || authorize.Params[1] != "pool-secret" {
+		t.Errorf("wrong mining.authorize params: %v", authorize.Params)
+	}
+
+	// share 原样转发给矿池（除矿工名外），矿池的响应原样转发给矿机
+	conn.Write([]byte(`{"id":12345678901234567890,"method":"mining.submit","params":["miner-user.w1","bf","00000001","5f5e1001","12345678"]}` + "\n"))
+	submit := expectRequest("mining.submit")
+	if len(submit.Params) != 5 || submit.Params[0] != "test.w1" || submit.Params[1] != "bf" || submit.Params[2] != "00000001" {
+		t.Errorf("wrong mining.submit params: %v", submit.Params)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive share response: %v", err)
+		}
+		if strings.HasPrefix(line, `{"id":12345678901234567890,`) {
+			if line != `{"id":12345678901234567890,"result":true,"error":null}`+"\n" {
+				t.Errorf("wrong share response: %s", line)
+			}
+			break
+		}
+	}
+
+	// 每台矿机使用单独的矿池连接
+	conn2 := dialTestMinerBTC(t, manager, "miner-user.w2", "")
+	if conn2 == nil {
+		t.FailNow()
+	}
+	defer conn2.Close()
+	if len(connections) != 2 {
+		t.Errorf("each miner should have its own pool connection, got %d connections", len(connections))
+	}
+}
+
+func TestPassthroughSessionFailover(t *testing.T) {
+	// 支持 BTCAgent 协议的矿池无法连接时，新的矿机以透传模式连接设置了 passthrough 的矿池
+	aggregated := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {})
+	authorized := make(chan *JSONRPCRequest, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.Method {
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":1,"result":[[["mining.notify","ae6812eb4cd7735a302a8a9dd95cf71f"]],"08000002",4],"error":null}`)
+			case "mining.authorize":
+				authorized <- request
+				pool.WriteLine(conn, `{"id":2,"result":true,"error":null}`)
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{aggregated.PoolInfo("test"), pool.PoolInfo("test")}
+	config.Pools[1].Options.Passthrough = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.poolStats.Available(&config.Pools[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection to the aggregated pool should fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn := dialTestMinerBTC(t, manager, "miner-user.w1", "")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	select {
+	case request := <-authorized:
+		if request.Params[0] != "test.w1" {
+			t.Errorf("wrong mining.authorize params: %v", request.Params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("miner is not connected to the passthrough pool")
+	}
+}
+
+func TestPassthroughSessionRewriteRequest(t *testing.T) {
+	config := NewConfig()
+	config.SubAccount = "test"
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	session := &PassthroughSession{config: config, clientConn: server, workerNames: map[string]string{}}
+
+	// 只替换矿工名和密码，大整数 ID 等其他内容保持不变
+	line := `{"id":12345678901234567890,"method":"mining.authorize","params":["user.w1","x"]}` + "\n"
+	expected := `{"id":12345678901234567890,"method":"mining.authorize","params":["test.w1",""]}` + "\n"
+	if rewritten := session.rewriteRequest([]byte(line)); string(rewritten) != expected {
+		t.Errorf("wrong rewritten request: %s", rewritten)
+	}
+	// 提交时只提供矿机名
+	line = `{"id":2,"method":"mining.submit","params":["w1","bf","00000001","5f5e1001","12345678"]}` + "\n"
+	expected = `{"id":2,"method":"mining.submit","params":["test.w1","bf","00000001","5f5e1001","12345678"]}` + "\n"
+	if rewritten := session.rewriteRequest([]byte(line)); string(rewritten) != expected {
+		t.Errorf("wrong rewritten request: %s", rewritten)
+	}
+
+	// 无需替换的请求原样返回
+	for _, line := range []string{
+		`{"id":3,"method":"mining.subscribe","params":["cgminer/4.10.0"]}` + "\n",
+		`{"id":4, "method":"mining.configure","params":[["version-rolling"],{}]}` + "\n",
+		"not json\n",
+	} {
+		if rewritten := session.rewriteRequest([]byte(line)); string(rewritten) != line {
+			t.Errorf("request should be relayed verbatim: %s -> %s", line, rewritten)
+		}
+	}
+
+	// 矿池使用其他分隔符
+	config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 1800, Options: PoolOptions{WorkerNameSeparator: "_"}}}
+	session.workerNames = map[string]string{}
+	line = `{"id":1,"method":"mining.authorize","params":["user.w1","x"]}` + "\n"
+	expected = `{"id":1,"method":"mining.authorize","params":["test_w1",""]}` + "\n"
+	if rewritten := session.rewriteRequest([]byte(line)); string(rewritten) != expected {
+		t.Errorf("wrong rewritten request: %s", rewritten)
+	}
+}
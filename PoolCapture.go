@@ -0,0 +1,269 @@
+package btcagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// 抓包记录的方向
+const (
+	PoolCaptureSend = "send" // BTCAgent 发给矿池
+	PoolCaptureRecv = "recv" // 从矿池收到
+)
+
+// PoolCaptureRecord 抓包文件中的一条记录（一行 JSON），对应一次对矿池连接的读或写
+type PoolCaptureRecord struct {
+	Time time.Time `json:"time"`
+	Conn uint64    `json:"conn"` // 矿池连接的序号，从 1 开始，用于区分同一文件中的不同连接
+	Pool string    `json:"pool"` // 矿池地址
+	Dir  string    `json:"dir"`  // send 或 recv
+	Text string    `json:"text,omitempty"`
+	Hex  string    `json:"hex,omitempty"` // 不是文本的数据（如 ex-message）以 hex 记录
+}
+
+// Data 获取记录的原始数据
+func (record *PoolCaptureRecord) Data() ([]byte, error) {
+	if len(record.Hex) > 0 {
+		return hex.DecodeString(record.Hex)
+	}
+	return []byte(record.Text), nil
+}
+
+// PoolCapture 调试用的矿池抓包（advanced.pool_capture）：把与矿池之间收发的所有数据按时间顺序写入文件，
+// 每行一条 PoolCaptureRecord，mining.authorize 中的密码会被隐藏。文件超过 maxSize 字节时轮转，
+// 最多保留 maxBackups 个旧文件（file.1 最新）。所有矿池连接共用，可以在任意 goroutine 中调用。
+type PoolCapture struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	serial     uint64 // 已分配的连接序号
+}
+
+func NewPoolCapture(path string, maxSize int64, maxBackups int) (capture *PoolCapture, err error) {
+	capture = &PoolCapture{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	capture.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := capture.file.Stat()
+	if err != nil {
+		capture.file.Close()
+		return nil, err
+	}
+	capture.size = info.Size()
+	return
+}
+
+// Wrap 返回记录所有读写数据的连接，pool 为矿池地址
+func (capture *PoolCapture) Wrap(conn net.Conn, pool string) net.Conn {
+	return &poolCaptureConn{conn, capture, atomic.AddUint64(&capture.serial, 1), pool}
+}
+
+// Close 关闭抓包文件，之后的数据不再记录
+func (capture *PoolCapture) Close() error {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if capture.file == nil {
+		return nil
+	}
+	err := capture.file.Close()
+	capture.file = nil
+	return err
+}
+
+func (capture *PoolCapture) record(conn uint64, pool string, dir string, data []byte) {
+	record := PoolCaptureRecord{Time: time.Now(), Conn: conn, Pool: pool, Dir: dir}
+	if isPoolCaptureText(data) {
+		record.Text = string(data)
+	} else {
+		record.Hex = hex.EncodeToString(data)
+	}
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if capture.file == nil {
+		return
+	}
+	if capture.maxSize > 0 && capture.size > 0 && capture.size+int64(len(line)) > capture.maxSize {
+		if err := capture.rotate(); err != nil {
+			return
+		}
+	}
+	n, _ := capture.file.Write(line)
+	capture.size += int64(n)
+}
+
+// rotate 将当前文件改名为 file.1（原有的旧文件依次后移，超过 maxBackups 的删除），然后新建文件
+func (capture *PoolCapture) rotate() (err error) {
+	capture.file.Close()
+	capture.file = nil
+	if capture.maxBackups > 0 {
+		for i := capture.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", capture.path, i), fmt.Sprintf("%s.%d", capture.path, i+1))
+		}
+		os.Rename(capture.path, capture.path+".1")
+	}
+	capture.file, err = os.OpenFile(capture.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	capture.size = 0
+	return
+}
+
+// isPoolCaptureText 数据是否为可以直接写成字符串的文本（JSON 行）
+func isPoolCaptureText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, c := range data {
+		if (c < 0x20 && c != '\t' && c != '\r' && c != '\n') || c == ExMessageMagicNumber {
+			return false
+		}
+	}
+	return true
+}
+
+// redactPoolCapture 隐藏发给矿池的 mining.authorize 请求中的密码。
+// 矿池连接每次写入的都是完整的 JSON 行或 ex-message，因此按行处理即可。
+func redactPoolCapture(data []byte) []byte {
+	if len(data) < 1 || data[0] == ExMessageMagicNumber || !bytes.Contains(data, []byte("authorize")) {
+		return data
+	}
+	var redacted []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.Contains(line, []byte("authorize")) {
+			if request, err := NewJSONRPCRequest(line); err == nil {
+				if masked := jsonRequestForLog(request, line); len(masked) > 0 {
+					line = []byte(masked)
+				}
+			}
+		}
+		redacted = append(redacted, line...)
+	}
+	return redacted
+}
+
+// poolCaptureConn 记录所有读写数据的矿池连接
+type poolCaptureConn struct {
+	net.Conn
+	capture *PoolCapture
+	id      uint64
+	pool    string
+}
+
+func (conn *poolCaptureConn) Read(p []byte) (n int, err error) {
+	n, err = conn.Conn.Read(p)
+	if n > 0 {
+		conn.capture.record(conn.id, conn.pool, PoolCaptureRecv, p[:n])
+	}
+	return
+}
+
+func (conn *poolCaptureConn) Write(p []byte) (n int, err error) {
+	conn.capture.record(conn.id, conn.pool, PoolCaptureSend, redactPoolCapture(p))
+	return conn.Conn.Write(p)
+}
+
+// ReadPoolCapture 读取抓包文件中的所有记录
+func ReadPoolCapture(reader io.Reader) (records []PoolCaptureRecord, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) < 1 {
+			continue
+		}
+		var record PoolCaptureRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("broken pool capture record %q: %w", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// ReplayPoolCapture 扮演抓包中序号为 captureConn 的连接的矿池，用于离线重现矿池的行为（如在 MockPool 的 handler 中调用）：
+// 按顺序向 writer 发送矿池当时发来的数据，每次发送之前先从 reader 读取 BTCAgent 当时在此之前发出的同样数量的消息
+// （JSON 行或 ex-message，不比较内容）。所有记录重放完后返回，连接由调用方关闭。
+func ReplayPoolCapture(writer io.Writer, reader *bufio.Reader, records []PoolCaptureRecord, captureConn uint64) error {
+	for i := range records {
+		record := &records[i]
+		if record.Conn != captureConn {
+			continue
+		}
+		data, err := record.Data()
+		if err != nil {
+			return fmt.Errorf("broken pool capture record at %v: %w", record.Time, err)
+		}
+		switch record.Dir {
+		case PoolCaptureSend:
+			for n := countPoolCaptureMessages(data); n > 0; n-- {
+				if err := skipPoolCaptureMessage(reader); err != nil {
+					return fmt.Errorf("agent did not send the message recorded at %v: %w", record.Time, err)
+				}
+			}
+		case PoolCaptureRecv:
+			if _, err := WriteFull(writer, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// countPoolCaptureMessages 数据中的消息（JSON 行或 ex-message）数
+func countPoolCaptureMessages(data []byte) (count int) {
+	for len(data) > 0 {
+		count++
+		if data[0] == ExMessageMagicNumber && len(data) >= 4 {
+			size := int(binary.LittleEndian.Uint16(data[2:4]))
+			if size < 4 || size > len(data) {
+				return
+			}
+			data = data[size:]
+			continue
+		}
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return
+		}
+		data = data[end+1:]
+	}
+	return
+}
+
+// skipPoolCaptureMessage 从 reader 读取并丢弃一个消息（JSON 行或 ex-message）
+func skipPoolCaptureMessage(reader *bufio.Reader) error {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] != ExMessageMagicNumber {
+		_, err = reader.ReadBytes('\n')
+		return err
+	}
+	var header ExMessageHeader
+	if err = binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Size > 4 {
+		_, err = io.CopyN(io.Discard, reader, int64(header.Size-4))
+	}
+	return err
+}
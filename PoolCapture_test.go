@@ -0,0 +1,124 @@
+package btcagent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPoolCaptureReplay(t *testing.T) {
+	// 抓取与矿池的握手过程
+	pool := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			for _, err := reader.ReadBytes('\n'); err == nil; _, err = reader.ReadBytes('\n') {
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.PoolPassword.Default = "capture-secret"
+	file := filepath.Join(t.TempDir(), "pool_capture.jsonl")
+
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+	capture, err := NewPoolCapture(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.poolCapture = capture
+	up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+	up.Init()
+	if up.Stat() != StatAuthorized {
+		t.Fatalf("captured session is not authorized: %v", up.HandshakeError())
+	}
+	capture.Close()
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "capture-secret") || !strings.Contains(string(content), "******") {
+		t.Errorf("password is not redacted in the capture: %s", content)
+	}
+	records, err := ReadPoolCapture(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent, received int
+	for _, record := range records {
+		if record.Conn != 1 || record.Pool != "mock.pool:3333" {
+			t.Errorf("wrong connection of record: %+v", record)
+		}
+		switch record.Dir {
+		case PoolCaptureSend:
+			sent++
+		case PoolCaptureRecv:
+			received++
+		}
+	}
+	if sent < 1 || received < 1 {
+		t.Fatalf("capture is incomplete, %d sent, %d received: %s", sent, received, content)
+	}
+
+	// 用抓包代替矿池，新的连接同样完成握手
+	replayed := make(chan error, 1)
+	replay := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		replayed <- ReplayPoolCapture(conn, reader, records, 1)
+		for _, err := reader.ReadBytes('\n'); err == nil; _, err = reader.ReadBytes('\n') {
+		}
+	})
+	config.dialer = replay
+	up = NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+	up.Init()
+	if up.Stat() != StatAuthorized {
+		t.Fatalf("replayed session is not authorized: %v", up.HandshakeError())
+	}
+	if err := <-replayed; err != nil {
+		t.Errorf("replay failed: %s", err)
+	}
+}
+
+func TestPoolCaptureRotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pool_capture.jsonl")
+	capture, err := NewPoolCapture(file, 512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		capture.record(1, "pool", PoolCaptureRecv, []byte(fmt.Sprintf(`{"id":%d,"result":true,"error":null}`+"\n", i)))
+	}
+	// ex-message 以 hex 记录
+	capture.record(1, "pool", PoolCaptureSend, []byte{ExMessageMagicNumber, 0x01, 0x04, 0x00})
+	capture.Close()
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing capture file: %s", err)
+		}
+		if info.Size() > 512 {
+			t.Errorf("%s exceeds the size limit: %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Error("too many capture backups are kept")
+	}
+
+	reader, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	records, err := ReadPoolCapture(reader)
+	if err != nil || len(records) < 1 {
+		t.Fatalf("failed to read the capture: %v", err)
+	}
+	last := records[len(records)-1]
+	data, err := last.Data()
+	if err != nil || len(last.Hex) < 1 || countPoolCaptureMessages(data) != 1 {
+		t.Errorf("ex-message is not recorded as hex: %+v", last)
+	}
+}
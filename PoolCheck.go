@@ -0,0 +1,89 @@
+package btcagent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PoolCheckResult 检查一个矿池的结果（用于 --check-pools）
+type PoolCheckResult struct {
+	Pool       string
+	SubAccount string
+	Connected  bool
+	Authorized bool // 多用户模式下没有可用于认证的子账户，只检查连接
+	Err        error
+}
+
+func (result PoolCheckResult) String() string {
+	status := "OK"
+	switch {
+	case result.Err != nil:
+		status = "FAILED: " + result.Err.Error()
+	case !result.Authorized:
+		status = "OK (connected, authorization skipped in multi user mode)"
+	}
+	if len(result.SubAccount) > 0 {
+		return fmt.Sprintf("pool %s, sub-account %s: %s", result.Pool, result.SubAccount, status)
+	}
+	return fmt.Sprintf("pool %s: %s", result.Pool, status)
+}
+
+// CheckPools 依次检查每个矿池能否连接。单用户模式下还会完成握手并以该矿池的子账户认证，
+// 多用户模式下只建立连接（使用 SSL/TLS 时完成 TLS 握手）。config 必须已调用过 Init()。
+func CheckPools(config *Config) (results []PoolCheckResult) {
+	results = make([]PoolCheckResult, len(config.Pools))
+	for i := range config.Pools {
+		result := &results[i]
+		result.Pool = config.Pools[i].Address()
+		if config.MultiUserMode {
+			result.Err = checkPoolConnection(config, i)
+			result.Connected = result.Err == nil
+			continue
+		}
+		result.SubAccount = config.PoolSubAccount(i)
+		result.Err = checkPoolAuthorize(config, i)
+		result.Connected = result.Err == nil
+		result.Authorized = result.Err == nil
+	}
+	return
+}
+
+// checkPoolConnection 连接矿池后立即断开
+func checkPoolConnection(config *Config, poolIndex int) (err error) {
+	id := fmt.Sprintf("check <%s> ", config.Pools[poolIndex].Address())
+	conn, err := DialPool(config, poolIndex, id)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(config.Advanced.PoolHandshakeTimeoutSeconds.Get()))
+		err = tlsConn.Handshake()
+	}
+	return
+}
+
+// checkPoolAuthorize 使用与正常运行时相同的 UpSession 完成握手和认证，之后断开连接
+func checkPoolAuthorize(config *Config, poolIndex int) (err error) {
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+	upManager := NewUpSessionManager("", "", config, manager)
+
+	up := config.sessionFactory.NewUpSession(upManager, config, poolIndex, 0)
+	up.Init()
+	if up.Stat() == StatAuthorized {
+		// 取消 ctx 后事件循环退出并断开连接
+		go up.Run()
+		return nil
+	}
+	if authErr := up.AuthorizeError(); authErr != nil {
+		return authErr
+	}
+	if handshakeErr := up.HandshakeError(); handshakeErr != nil {
+		return handshakeErr
+	}
+	return errors.New("connection or handshake failed, see the log for details")
+}
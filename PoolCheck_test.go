@@ -0,0 +1,54 @@
+package btcagent
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckPools(t *testing.T) {
+	accept := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	reject := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		pool.AcceptHandshakeBTCWithAuthorize(conn, reader, func(request *JSONRPCRequest) bool { return false })
+	})
+	// 已关闭的端口
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	closed := PoolInfo{Host: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port), SubAccount: "test"}
+	listener.Close()
+
+	config := accept.Config(new(SessionFactoryBTC))
+	config.Pools = append(config.Pools, reject.PoolInfo("test"), closed)
+	results := CheckPools(config)
+	if len(results) != 3 {
+		t.Fatalf("wrong results: %v", results)
+	}
+	if !results[0].Authorized || results[0].Err != nil || !strings.HasSuffix(results[0].String(), ": OK") {
+		t.Errorf("pool should be authorized: %v", results[0])
+	}
+	if results[1].Authorized || results[1].Err == nil {
+		t.Errorf("pool should reject the sub-account: %v", results[1])
+	}
+	if results[2].Connected || results[2].Err == nil || !strings.Contains(results[2].String(), "FAILED") {
+		t.Errorf("pool should be unreachable: %v", results[2])
+	}
+
+	// 多用户模式只检查连接
+	config.MultiUserMode = true
+	results = CheckPools(config)
+	if !results[0].Connected || results[0].Authorized || results[0].Err != nil {
+		t.Errorf("pool should be connected without authorization: %v", results[0])
+	}
+	if results[2].Connected || results[2].Err == nil {
+		t.Errorf("pool should be unreachable: %v", results[2])
+	}
+}
@@ -0,0 +1,54 @@
+package btcagent
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// PoolSelectionWeights 选择矿池的评分中各项的权重（advanced.pool_selection），0 表示不考虑该项。
+// 均为 0 时所有矿池的评分相同，按 pools 的顺序尝试。
+type PoolSelectionWeights struct {
+	Priority    float64 `json:"priority_weight"`
+	Latency     float64 `json:"latency_weight"`
+	Reliability float64 `json:"reliability_weight"`
+}
+
+// Enabled 是否按评分选择矿池
+func (weights *PoolSelectionWeights) Enabled() bool {
+	return weights.Priority != 0 || weights.Latency != 0 || weights.Reliability != 0
+}
+
+// check 检查权重，负数、NaN 和无穷大返回错误
+func (weights *PoolSelectionWeights) check() error {
+	for _, weight := range []struct {
+		name  string
+		value float64
+	}{
+		{"priority_weight", weights.Priority},
+		{"latency_weight", weights.Latency},
+		{"reliability_weight", weights.Reliability},
+	} {
+		if weight.value < 0 || math.IsNaN(weight.value) || math.IsInf(weight.value, 0) {
+			return fmt.Errorf("[OPTION] Illegal pool_selection.%s: %v, should be a non-negative number", weight.name, weight.value)
+		}
+	}
+	return nil
+}
+
+// Score 矿池的评分，新的矿池连接按评分从高到低尝试矿池，评分相同时按 pools 的顺序：
+//
+//	score = priority_weight * priority + reliability_weight * reliability - latency_weight * latency
+//
+// priority 为矿池的 priority 选项（默认 0，越大越优先，用于表示费率、地区等偏好）；
+// reliability 为最近连接尝试的成功率，0 到 1，未尝试过时为 1；
+// latency 为最近认证成功的连接从开始连接到认证成功的耗时（秒），未测量时为 0。
+// 后两项是最近几次尝试的指数移动平均，平滑系数为 PoolSelectionSmoothing。
+func (weights *PoolSelectionWeights) Score(priority int, latency time.Duration, reliability float64) float64 {
+	return weights.Priority*float64(priority) + weights.Reliability*reliability - weights.Latency*latency.Seconds()
+}
+
+// smoothPoolSample 按 PoolSelectionSmoothing 将一次尝试的结果计入指数移动平均
+func smoothPoolSample(average float64, sample float64) float64 {
+	return average + PoolSelectionSmoothing*(sample-average)
+}
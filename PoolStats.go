@@ -0,0 +1,310 @@
+package btcagent
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PoolConnectionStats 单个矿池的连接统计（用于管理命令）
+type PoolConnectionStats struct {
+	Pool        string `json:"pool"`
+	Connections int    `json:"connections"` // 当前已认证的连接数
+	Connects    uint64 `json:"connects"`    // 认证成功的总次数
+	Reconnects  uint64 `json:"reconnects"`  // 其中同一子账户的同一连接断开后重新连接的次数
+
+	LastConnectTime  int64  `json:"last_connect_time,omitempty"` // 最后一次认证成功的时间（Unix 时间戳）
+	ConnectedSeconds uint64 `json:"connected_seconds"`           // 所有连接（包括当前连接）的累计连接时长
+	UptimeSeconds    uint64 `json:"uptime_seconds"`              // 当前连接中持续时间最长的连接的时长
+
+	Unhealthy bool `json:"unhealthy,omitempty"` // 因协议不兼容被暂时跳过
+
+	// 选择矿池的评分及其各项（见 PoolSelectionWeights.Score）
+	Priority                   int     `json:"priority,omitempty"`
+	ConnectLatencyMilliseconds int64   `json:"connect_latency_milliseconds,omitempty"` // 未测量时为 0
+	Reliability                float64 `json:"reliability"`
+	Score                      float64 `json:"score"`
+}
+
+// poolStatsEntry 单个矿池的统计数据
+type poolStatsEntry struct {
+	connects    uint64
+	reconnects  uint64
+	lastConnect time.Time
+	closed      time.Duration        // 已断开的连接的累计时长
+	active      map[string]time.Time // 当前连接的标识 -> 认证成功的时间
+
+	incompatible   uint      // 认证成功后连续的协议不兼容次数
+	unhealthyUntil time.Time // 在此之前连接时跳过该矿池
+
+	attempts    uint64        // 连接尝试的次数
+	lastFailed  bool          // 最近一次连接尝试失败
+	reliability float64       // 连接尝试成功率的指数移动平均，attempts 为 0 时无效
+	latency     time.Duration // 认证成功的连接耗时的指数移动平均，0 表示未测量
+}
+
+// PoolStats 按矿池统计的连接次数和连接时长，可以在多个 goroutine 中使用。
+//
+// 数据只在矿池连接认证成功和断开时更新，输出时再加上当前连接已持续的时间。
+// 同时作为指标注册到 Metrics，按 pool 标签输出。
+type PoolStats struct {
+	lock    sync.Mutex
+	pools   []PoolInfo
+	stats   []poolStatsEntry
+	seen    map[string]bool // 曾经认证成功过的连接标识，用于区分首次连接和重连
+	weights PoolSelectionWeights
+	// 所有矿池的重连次数之和，包括 setpools 删除的矿池
+	reconnects uint64
+}
+
+func NewPoolStats(config *Config) (stats *PoolStats) {
+	stats = new(PoolStats)
+	stats.weights = config.Advanced.PoolSelection
+	stats.SetPools(config.Pools)
+	stats.seen = make(map[string]bool)
+	return
+}
+
+// SetPools 更新矿池列表，保留仍在列表中的矿池的统计数据，删除的矿池不再统计
+func (stats *PoolStats) SetPools(pools []PoolInfo) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	entries := make([]poolStatsEntry, len(pools))
+	for i := range pools {
+		if entry := stats.entry(&pools[i]); entry != nil {
+			entries[i] = *entry
+			// 列表中有相同的矿池时，只有第一个保留原有数据
+			*entry = poolStatsEntry{}
+		}
+		if entries[i].active == nil {
+			entries[i].active = make(map[string]time.Time)
+		}
+	}
+	stats.pools = append([]PoolInfo(nil), pools...)
+	stats.stats = entries
+}
+
+// entry 获取矿池的统计数据，矿池为 nil 或不在列表中时返回 nil。调用方需持有锁。
+func (stats *PoolStats) entry(pool *PoolInfo) *poolStatsEntry {
+	if pool == nil {
+		return nil
+	}
+	for i := range stats.pools {
+		if stats.pools[i] == *pool {
+			return &stats.stats[i]
+		}
+	}
+	return nil
+}
+
+// poolStatsKey 矿池连接的标识，同一子账户的同一连接（slot）重连后标识不变
+func poolStatsKey(subAccount string, slot int) string {
+	return fmt.Sprintf("%s#%d", subAccount, slot)
+}
+
+// Connected 记录一次认证成功的矿池连接
+func (stats *PoolStats) Connected(pool *PoolInfo, subAccount string, slot int, now time.Time) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	if entry == nil {
+		return
+	}
+
+	key := poolStatsKey(subAccount, slot)
+	entry.connects++
+	if stats.seen[key] {
+		entry.reconnects++
+		stats.reconnects++
+	}
+	stats.seen[key] = true
+	entry.lastConnect = now
+	entry.active[key] = now
+	entry.incompatible = 0
+}
+
+// Incompatible 记录一次协议不兼容的握手。连续 maxTimes 次后将矿池标记为不可用 duration，
+// 并返回 true。maxTimes 为 0 时不标记。
+func (stats *PoolStats) Incompatible(pool *PoolInfo, now time.Time, maxTimes uint, duration time.Duration) bool {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	if entry == nil || maxTimes == 0 {
+		return false
+	}
+
+	entry.incompatible++
+	if entry.incompatible < maxTimes {
+		return false
+	}
+	entry.incompatible = 0
+	entry.unhealthyUntil = now.Add(duration)
+	return true
+}
+
+// Attempted 记录一次连接尝试的结果，authorized 表示认证成功，elapsed 为从开始连接到结束的耗时
+func (stats *PoolStats) Attempted(pool *PoolInfo, authorized bool, elapsed time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	if entry == nil {
+		return
+	}
+
+	var success float64
+	if authorized {
+		success = 1
+	}
+	if entry.attempts == 0 {
+		// 未尝试过时按成功率为 1 计算
+		entry.reliability = 1
+	}
+	entry.reliability = smoothPoolSample(entry.reliability, success)
+	entry.attempts++
+	entry.lastFailed = !authorized
+	if !authorized {
+		return
+	}
+	if entry.latency == 0 {
+		entry.latency = elapsed
+	} else {
+		entry.latency = time.Duration(smoothPoolSample(float64(entry.latency), float64(elapsed)))
+	}
+}
+
+// score 矿池的评分及其中的成功率，entry 为 nil（不在列表中的矿池）时按未尝试过计算。调用方需持有锁。
+func (stats *PoolStats) score(pool *PoolInfo, entry *poolStatsEntry) (score float64, reliability float64) {
+	var latency time.Duration
+	reliability = 1
+	if entry != nil && entry.attempts > 0 {
+		latency = entry.latency
+		reliability = entry.reliability
+	}
+	return stats.weights.Score(pool.Options.Priority, latency, reliability), reliability
+}
+
+// Scores 获取 pools 中每个矿池的评分
+func (stats *PoolStats) Scores(pools []PoolInfo) (scores []float64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	scores = make([]float64, len(pools))
+	for i := range pools {
+		scores[i], _ = stats.score(&pools[i], stats.entry(&pools[i]))
+	}
+	return
+}
+
+// Unhealthy 矿池在 now 时是否被标记为不可用
+func (stats *PoolStats) Unhealthy(pool *PoolInfo, now time.Time) bool {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	return entry != nil && now.Before(entry.unhealthyUntil)
+}
+
+// Available 矿池是否可用：有已认证的连接，或者最近一次连接尝试没有失败（包括未尝试过和不在列表中的矿池）
+func (stats *PoolStats) Available(pool *PoolInfo) bool {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	return entry == nil || len(entry.active) > 0 || !entry.lastFailed
+}
+
+// Disconnected 记录一个已认证的矿池连接断开
+func (stats *PoolStats) Disconnected(pool *PoolInfo, subAccount string, slot int, now time.Time) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	entry := stats.entry(pool)
+	if entry == nil {
+		return
+	}
+
+	key := poolStatsKey(subAccount, slot)
+	if start, ok := entry.active[key]; ok {
+		entry.closed += now.Sub(start)
+		delete(entry.active, key)
+	}
+}
+
+// Reconnects 获取本次运行中所有矿池的重连次数之和，包括已从矿池列表中删除的矿池
+func (stats *PoolStats) Reconnects() uint64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.reconnects
+}
+
+// Snapshot 获取所有矿池在 now 时的统计数据，按配置中的顺序排列
+func (stats *PoolStats) Snapshot(now time.Time) (snapshot []PoolConnectionStats) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	snapshot = make([]PoolConnectionStats, len(stats.stats))
+	for i := range stats.stats {
+		entry := &stats.stats[i]
+		connected := entry.closed
+		var uptime time.Duration
+		for _, start := range entry.active {
+			connected += now.Sub(start)
+			if now.Sub(start) > uptime {
+				uptime = now.Sub(start)
+			}
+		}
+
+		snapshot[i] = PoolConnectionStats{
+			Pool:             stats.pools[i].Address(),
+			Connections:      len(entry.active),
+			Connects:         entry.connects,
+			Reconnects:       entry.reconnects,
+			ConnectedSeconds: uint64(connected.Seconds()),
+			UptimeSeconds:    uint64(uptime.Seconds()),
+			Unhealthy:        now.Before(entry.unhealthyUntil),
+			Priority:         stats.pools[i].Options.Priority,
+		}
+		snapshot[i].Score, snapshot[i].Reliability = stats.score(&stats.pools[i], entry)
+		if entry.attempts > 0 {
+			snapshot[i].ConnectLatencyMilliseconds = entry.latency.Milliseconds()
+		}
+		if !entry.lastConnect.IsZero() {
+			snapshot[i].LastConnectTime = entry.lastConnect.Unix()
+		}
+	}
+	return
+}
+
+func (stats *PoolStats) writeTo(w io.Writer) {
+	snapshot := stats.Snapshot(time.Now())
+
+	families := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(pool *PoolConnectionStats) float64
+	}{
+		{"btcagent_pool_connections", "Authorized connections to the pool server.", "gauge",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.Connections) }},
+		{"btcagent_pool_connects_total", "Successful connections (authorized) to the pool server.", "counter",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.Connects) }},
+		{"btcagent_pool_reconnects_total", "Connections to the pool server re-established after a connection was lost.", "counter",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.Reconnects) }},
+		{"btcagent_pool_last_connect_timestamp_seconds", "Unix time of the last successful connection to the pool server.", "gauge",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.LastConnectTime) }},
+		{"btcagent_pool_connected_seconds_total", "Cumulative duration of all connections to the pool server.", "counter",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.ConnectedSeconds) }},
+		{"btcagent_pool_uptime_seconds", "Duration of the longest current connection to the pool server.", "gauge",
+			func(pool *PoolConnectionStats) float64 { return float64(pool.UptimeSeconds) }},
+		{"btcagent_pool_selection_score", "Score used to choose the pool server for new connections, higher is tried first.", "gauge",
+			func(pool *PoolConnectionStats) float64 { return pool.Score }},
+	}
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+		for i := range snapshot {
+			value := strconv.FormatFloat(family.value(&snapshot[i]), 'g', -1, 64)
+			fmt.Fprintf(w, "%s{%s} %s\n", family.name, metricLabels([]string{"pool", snapshot[i].Pool}), value)
+		}
+	}
+}
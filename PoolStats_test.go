@@ -0,0 +1,160 @@
+package btcagent
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolStatsReconnectCycles(t *testing.T) {
+	config := NewConfig()
+	config.Pools = []PoolInfo{{Host: "pool1", Port: 3333}, {Host: "pool2", Port: 3333}}
+	stats := NewPoolStats(config)
+	start := time.Unix(1600000000, 0)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// 两个连接首次连接，不算重连
+	stats.Connected(&config.Pools[0], "", 0, at(0))
+	stats.Connected(&config.Pools[0], "", 1, at(0))
+	// slot 0 每 10 秒断开一次，断开 2 秒后重连
+	for i := 0; i < 3; i++ {
+		stats.Disconnected(&config.Pools[0], "", 0, at(i*12+10))
+		stats.Connected(&config.Pools[0], "", 0, at(i*12+12))
+	}
+	// 重复断开不会重复计算时长
+	stats.Disconnected(&config.Pools[0], "", 1, at(30))
+	stats.Disconnected(&config.Pools[0], "", 1, at(31))
+
+	snapshot := stats.Snapshot(at(40))
+	pool := snapshot[0]
+	if pool.Pool != "pool1:3333" || pool.Connects != 5 || pool.Reconnects != 3 || pool.Connections != 1 {
+		t.Errorf("wrong counters: %+v", pool)
+	}
+	if pool.LastConnectTime != at(36).Unix() {
+		t.Errorf("wrong last connect time: %d", pool.LastConnectTime)
+	}
+	// slot 0: 3 次 10 秒 + 当前连接 4 秒，slot 1: 30 秒
+	if pool.ConnectedSeconds != 64 || pool.UptimeSeconds != 4 {
+		t.Errorf("wrong durations: %+v", pool)
+	}
+
+	// 切换到另一个矿池的连接在该矿池上算重连
+	stats.Disconnected(&config.Pools[0], "", 0, at(40))
+	stats.Connected(&config.Pools[1], "", 0, at(41))
+	snapshot = stats.Snapshot(at(50))
+	if snapshot[0].Connections != 0 || snapshot[0].UptimeSeconds != 0 || snapshot[0].ConnectedSeconds != 64 {
+		t.Errorf("wrong stats of disconnected pool: %+v", snapshot[0])
+	}
+	if snapshot[1].Connects != 1 || snapshot[1].Reconnects != 1 || snapshot[1].UptimeSeconds != 9 {
+		t.Errorf("wrong stats of failover pool: %+v", snapshot[1])
+	}
+
+	// setpools 保留的矿池保留重连次数，删除的矿池的重连次数仍计入总数
+	stats.SetPools([]PoolInfo{{Host: "pool3", Port: 3333}, config.Pools[1]})
+	snapshot = stats.Snapshot(at(50))
+	if snapshot[0].Reconnects != 0 || snapshot[1].Pool != "pool2:3333" || snapshot[1].Reconnects != 1 {
+		t.Errorf("wrong stats after setpools: %+v", snapshot)
+	}
+	if stats.Reconnects() != 4 {
+		t.Errorf("wrong total reconnects: %d", stats.Reconnects())
+	}
+}
+
+func TestPoolStatsUpSessionReconnect(t *testing.T) {
+	// 矿池前两次认证成功后立即断开连接，之后保持连接
+	var connections int32
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) && atomic.AddInt32(&connections, 1) > 2 {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var stats PoolConnectionStats
+	for time.Now().Before(deadline) {
+		stats = manager.poolStats.Snapshot(time.Now())[0]
+		if stats.Connects >= 3 && stats.Connections == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Connects != 3 || stats.Reconnects != 2 || stats.Connections != 1 || stats.LastConnectTime == 0 {
+		t.Fatalf("wrong pool stats after reconnects: %+v", stats)
+	}
+
+	recorder := httptest.NewRecorder()
+	manager.metrics.WriteText(recorder)
+	for _, expected := range []string{
+		`btcagent_pool_connects_total{pool="` + stats.Pool + `"} 3`,
+		`btcagent_pool_reconnects_total{pool="` + stats.Pool + `"} 2`,
+		`btcagent_pool_connections{pool="` + stats.Pool + `"} 1`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("missing metric %s:\n%s", expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestPoolStatsSelectionScores(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.PoolSelection = PoolSelectionWeights{Priority: 1, Latency: 2, Reliability: 4}
+	config.Pools = []PoolInfo{{Host: "a", Port: 3333}, {Host: "b", Port: 3333}, {Host: "c", Port: 3333}, {Host: "d", Port: 3333}}
+	config.Pools[1].Options.Priority = 1
+	config.Pools[2].Options.Priority = 2
+	config.Pools[3].Options.Priority = 1
+	stats := NewPoolStats(config)
+
+	// a: 两次成功，耗时 100ms 和 200ms，平均耗时 100 + 0.3 * 100 = 130ms
+	stats.Attempted(&config.Pools[0], true, 100*time.Millisecond)
+	stats.Attempted(&config.Pools[0], true, 200*time.Millisecond)
+	// b: 失败后成功，成功率 1 -> 0.7 -> 0.79，耗时 500ms
+	stats.Attempted(&config.Pools[1], false, 15*time.Second)
+	stats.Attempted(&config.Pools[1], true, 500*time.Millisecond)
+	// c: 两次失败，成功率 0.49，未测量耗时
+	stats.Attempted(&config.Pools[2], false, time.Second)
+	stats.Attempted(&config.Pools[2], false, time.Second)
+	// d: 未尝试过
+
+	expected := []float64{
+		0 + 4*1 - 2*0.13,
+		1 + 4*0.79 - 2*0.5,
+		2 + 4*0.49,
+		1 + 4*1,
+	}
+	scores := stats.Scores(config.Pools)
+	for i := range expected {
+		if math.Abs(scores[i]-expected[i]) > 1e-9 {
+			t.Errorf("wrong score of pool %s: %v, expected %v", config.Pools[i].Host, scores[i], expected[i])
+		}
+	}
+
+	snapshot := stats.Snapshot(time.Now())
+	if snapshot[0].ConnectLatencyMilliseconds != 130 || snapshot[0].Reliability != 1 || snapshot[0].Priority != 0 {
+		t.Errorf("wrong selection stats of pool a: %+v", snapshot[0])
+	}
+	if math.Abs(snapshot[2].Reliability-0.49) > 1e-9 || snapshot[2].ConnectLatencyMilliseconds != 0 || snapshot[2].Priority != 2 {
+		t.Errorf("wrong selection stats of pool c: %+v", snapshot[2])
+	}
+	if snapshot[3].Score != scores[3] || snapshot[3].Reliability != 1 {
+		t.Errorf("wrong selection stats of pool d: %+v", snapshot[3])
+	}
+
+	// 不在列表中的矿池按未尝试过计算
+	other := PoolInfo{Host: "e", Port: 3333}
+	other.Options.Priority = 3
+	if scores := stats.Scores([]PoolInfo{other}); scores[0] != 3+4 {
+		t.Errorf("wrong score of unknown pool: %v", scores[0])
+	}
+}
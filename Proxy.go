@@ -1,6 +1,8 @@
-package main
+package btcagent
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -102,3 +104,68 @@ func GetProxyDialer(proxyURL string, timeout time.Duration, insecureSkipVerify b
 	}
 	return
 }
+
+// DialRetry 使用 dialer 建立 TCP 连接，失败时最多重试 pool_connection_dial_retries 次，
+// 每次重试前等待 pool_connection_dial_retry_interval_milliseconds。
+// 只在第一次尝试后的 pool_connection_dial_timeout_seconds 内开始重试，确实无法连接的矿池不会拖慢故障切换太久。
+func DialRetry(config *Config, dialer Dialer, address string, id string) (conn net.Conn, err error) {
+	retries := config.Advanced.PoolConnectionDialRetries
+	interval := time.Duration(config.Advanced.PoolConnectionDialRetryIntervalMilliseconds) * time.Millisecond
+	deadline := time.Now().Add(config.Advanced.PoolConnectionDialTimeoutSeconds.Get())
+
+	for retry := uint(0); ; retry++ {
+		conn, err = dialer.Dial("tcp", address)
+		if err == nil || retry >= retries || time.Now().Add(interval).After(deadline) {
+			return
+		}
+		Log.Warning(id, "connect to pool server ", address, " failed, retry ", retry+1, "/", retries, " in ", interval, ": ", err.Error())
+		time.Sleep(interval)
+	}
+}
+
+// DialPool 依次尝试代理和直连，返回第一个成功的矿池连接（SSL/TLS 连接尚未握手）。id 为打印日志用的连接标识符。
+//
+// 与 UpSession 不同，不同时尝试多个代理，用于透传模式和 --check-pools。
+func DialPool(config *Config, poolIndex int, id string) (conn net.Conn, err error) {
+	pool := config.Pools[poolIndex]
+	url := pool.Address()
+	timeout := config.Advanced.PoolConnectionDialTimeoutSeconds.Get()
+	insecureSkipVerify := config.Advanced.TLSSkipCertificateVerify
+
+	proxies := append([]string{}, config.Proxy...)
+	if len(proxies) < 1 || config.DirectConnectWithProxy || config.DirectConnectAfterProxy {
+		proxies = append(proxies, "")
+	}
+
+	err = errors.New("no available connection method")
+	for _, proxyURL := range proxies {
+		var dialer Dialer
+		if len(proxyURL) > 0 {
+			dialer, err = GetProxyDialer(proxyURL, timeout, insecureSkipVerify)
+			if err != nil {
+				Log.Warning(id, "proxy [", proxyURL, "] failed: ", err.Error())
+				continue
+			}
+		} else {
+			dialer = config.DirectDialer()
+		}
+
+		conn, err = DialRetry(config, dialer, url, id)
+		if err != nil {
+			if len(proxyURL) > 0 {
+				Log.Warning(id, "connect to pool server ", url, " with proxy [", proxyURL, "] failed: ", err.Error())
+			} else {
+				Log.Warning(id, "connect to pool server ", url, " directly failed: ", err.Error())
+			}
+			continue
+		}
+		if config.PoolUseTLS(poolIndex) {
+			conn = tls.Client(conn, &tls.Config{
+				ServerName:         pool.Host,
+				InsecureSkipVerify: insecureSkipVerify,
+			})
+		}
+		return
+	}
+	return
+}
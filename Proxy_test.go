@@ -0,0 +1,86 @@
+package btcagent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// retryTestDialer 直连 address，并记录尝试次数。第一次尝试之后调用 afterFirst。
+type retryTestDialer struct {
+	attempts   int
+	afterFirst func()
+}
+
+func (dialer *retryTestDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer.attempts++
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if dialer.attempts == 1 && dialer.afterFirst != nil {
+		dialer.afterFirst()
+	}
+	return conn, err
+}
+
+// reserveTestPort 获取一个当前没有监听的本地端口
+func reserveTestPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestDialRetry(t *testing.T) {
+	addr := reserveTestPort(t)
+	config := NewConfig()
+	config.Advanced.PoolConnectionDialRetries = 2
+	config.Advanced.PoolConnectionDialRetryIntervalMilliseconds = 100
+
+	// 第一次尝试时没有监听，之后才开始监听，第二次尝试成功
+	dialer := &retryTestDialer{afterFirst: func() {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("listen on %s failed: %s", addr, err.Error())
+		}
+		t.Cleanup(func() { listener.Close() })
+	}}
+	conn, err := DialRetry(config, dialer, addr, "")
+	if err != nil {
+		t.Fatalf("dial should succeed after retry: %v", err)
+	}
+	conn.Close()
+	if dialer.attempts != 2 {
+		t.Errorf("dial should succeed on the second attempt, attempts: %d", dialer.attempts)
+	}
+
+	// 不配置重试时只尝试一次
+	config.Advanced.PoolConnectionDialRetries = 0
+	dialer = &retryTestDialer{}
+	if _, err = DialRetry(config, dialer, reserveTestPort(t), ""); err == nil || dialer.attempts != 1 {
+		t.Errorf("dial without retries should fail after 1 attempt: %d, %v", dialer.attempts, err)
+	}
+}
+
+func TestDialRetryBounded(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.PoolConnectionDialTimeoutSeconds = 1
+	config.Advanced.PoolConnectionDialRetries = 100
+	config.Advanced.PoolConnectionDialRetryIntervalMilliseconds = 300
+
+	// 只在连接超时时间内重试
+	dialer := &retryTestDialer{}
+	start := time.Now()
+	_, err := DialRetry(config, dialer, reserveTestPort(t), "")
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("dial to a closed port should fail")
+	}
+	if dialer.attempts < 2 || dialer.attempts > 4 {
+		t.Errorf("wrong attempts within the dial timeout: %d", dialer.attempts)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("retries should end within the dial timeout, elapsed: %s", elapsed)
+	}
+}
@@ -0,0 +1,172 @@
+package btcagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	RejectAlertStatusAlert     = "alert"
+	RejectAlertStatusRecovered = "recovered"
+)
+
+// RejectAlertEvent 拒绝率告警或恢复的通知，也是发送给 webhook 的 JSON
+type RejectAlertEvent struct {
+	SubAccount  string  `json:"sub_account"`
+	Status      string  `json:"status"`       // alert 或 recovered
+	RejectRatio float64 `json:"reject_ratio"` // 窗口内的拒绝率
+	Accepted    uint64  `json:"accepted"`     // 窗口内接受的 share 数
+	Rejected    uint64  `json:"rejected"`     // 窗口内拒绝的 share 数
+	Time        int64   `json:"time"`
+}
+
+// rejectAlertSlot 一秒内的 share 统计
+type rejectAlertSlot struct {
+	time     time.Time
+	accepted uint64
+	rejected uint64
+}
+
+type rejectAlertAccount struct {
+	slots    []rejectAlertSlot // 窗口内的统计，按时间排列
+	accepted uint64            // 窗口内接受的 share 数
+	rejected uint64            // 窗口内拒绝的 share 数
+
+	aboveSince time.Time // 拒绝率开始超过告警阈值的时间，零值表示未超过
+	alerting   bool      // 已发出告警，尚未恢复
+}
+
+// prune 移除 now 之前超过 window 的统计
+func (account *rejectAlertAccount) prune(now time.Time, window time.Duration) {
+	i := 0
+	for ; i < len(account.slots) && now.Sub(account.slots[i].time) >= window; i++ {
+		account.accepted -= account.slots[i].accepted
+		account.rejected -= account.slots[i].rejected
+	}
+	account.slots = account.slots[i:]
+}
+
+func (account *rejectAlertAccount) rejectRatio() float64 {
+	total := account.accepted + account.rejected
+	if total == 0 {
+		return 0
+	}
+	return float64(account.rejected) / float64(total)
+}
+
+// RejectAlert 按子账户计算滚动窗口内的拒绝率，持续超过告警阈值时告警，低于恢复阈值时恢复。
+// 可以在多个 goroutine 中使用。
+type RejectAlert struct {
+	lock     sync.Mutex
+	config   *Config
+	accounts map[string]*rejectAlertAccount
+}
+
+func NewRejectAlert(config *Config) (alert *RejectAlert) {
+	alert = new(RejectAlert)
+	alert.config = config
+	alert.accounts = make(map[string]*rejectAlertAccount)
+	return
+}
+
+// AddShare 记录一个 share 的提交结果
+func (alert *RejectAlert) AddShare(subAccount string, accepted bool, now time.Time) {
+	alert.lock.Lock()
+	defer alert.lock.Unlock()
+
+	account, ok := alert.accounts[subAccount]
+	if !ok {
+		account = new(rejectAlertAccount)
+		alert.accounts[subAccount] = account
+	}
+
+	second := now.Truncate(time.Second)
+	if len(account.slots) < 1 || account.slots[len(account.slots)-1].time.Before(second) {
+		account.slots = append(account.slots, rejectAlertSlot{time: second})
+	}
+	slot := &account.slots[len(account.slots)-1]
+	if accepted {
+		slot.accepted++
+		account.accepted++
+	} else {
+		slot.rejected++
+		account.rejected++
+	}
+}
+
+// Check 检查所有子账户的拒绝率，返回状态发生变化的子账户
+func (alert *RejectAlert) Check(now time.Time) (events []RejectAlertEvent) {
+	alert.lock.Lock()
+	defer alert.lock.Unlock()
+
+	conf := &alert.config.RejectAlert
+	for name, account := range alert.accounts {
+		account.prune(now, conf.WindowSeconds.Get())
+		ratio := account.rejectRatio()
+
+		status := ""
+		if account.alerting {
+			// 使用更低的恢复阈值，以免拒绝率在告警阈值附近波动时反复告警
+			if ratio < conf.RecoverRatio {
+				account.alerting = false
+				status = RejectAlertStatusRecovered
+			}
+		} else if account.accepted+account.rejected >= conf.MinShares && ratio >= conf.AlertRatio {
+			if account.aboveSince.IsZero() {
+				account.aboveSince = now
+			}
+			if now.Sub(account.aboveSince) >= conf.SustainSeconds.Get() {
+				account.alerting = true
+				account.aboveSince = time.Time{}
+				status = RejectAlertStatusAlert
+			}
+		} else {
+			account.aboveSince = time.Time{}
+			if len(account.slots) < 1 {
+				delete(alert.accounts, name)
+			}
+		}
+
+		if status != "" {
+			events = append(events, RejectAlertEvent{name, status, ratio, account.accepted, account.rejected, now.Unix()})
+		}
+	}
+	return
+}
+
+// Notify 打印告警日志，并发送给 webhook（如果已配置）
+func (alert *RejectAlert) Notify(event RejectAlertEvent) {
+	if event.Status == RejectAlertStatusAlert {
+		Log.Warning("[reject alert] reject ratio of sub-account <", event.SubAccount, "> is ", event.RejectRatio,
+			" in the last ", alert.config.RejectAlert.WindowSeconds, " seconds, accepted: ", event.Accepted, ", rejected: ", event.Rejected)
+	} else {
+		Log.Info("[reject alert] reject ratio of sub-account <", event.SubAccount, "> recovered to ", event.RejectRatio,
+			", accepted: ", event.Accepted, ", rejected: ", event.Rejected)
+	}
+
+	if len(alert.config.RejectAlert.Webhook) > 0 {
+		go alert.postWebhook(event)
+	}
+}
+
+func (alert *RejectAlert) postWebhook(event RejectAlertEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		Log.Error("[reject alert] failed to encode webhook request: ", err)
+		return
+	}
+
+	client := http.Client{Timeout: RejectAlertWebhookTimeoutSeconds.Get()}
+	response, err := client.Post(alert.config.RejectAlert.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		Log.Error("[reject alert] failed to send webhook request: ", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		Log.Error("[reject alert] webhook responded with ", response.Status)
+	}
+}
@@ -0,0 +1,159 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRejectAlert() *RejectAlert {
+	config := NewConfig()
+	config.RejectAlert.Enable = true
+	config.RejectAlert.WindowSeconds = 60
+	config.RejectAlert.SustainSeconds = 10
+	config.RejectAlert.MinShares = 10
+	config.RejectAlert.AlertRatio = 0.1
+	config.RejectAlert.RecoverRatio = 0.05
+	return NewRejectAlert(config)
+}
+
+func TestRejectAlertCrossAndRecover(t *testing.T) {
+	alert := newTestRejectAlert()
+	start := time.Unix(1600000000, 0)
+
+	// 每秒 10 个 share，rejectEvery 个中拒绝 1 个（0 表示全部接受）
+	now := start
+	feed := func(seconds int, rejectEvery int) (events []RejectAlertEvent) {
+		for i := 0; i < seconds; i++ {
+			for j := 0; j < 10; j++ {
+				alert.AddShare("test", rejectEvery == 0 || j%rejectEvery != 0, now)
+			}
+			now = now.Add(time.Second)
+			events = append(events, alert.Check(now)...)
+		}
+		return
+	}
+
+	// 拒绝率 0
+	if events := feed(30, 0); len(events) != 0 {
+		t.Errorf("no alert expected: %v", events)
+	}
+
+	// 拒绝率升到 50%，滚动窗口内的拒绝率约 8 秒后才超过 10%，再持续 10 秒后告警
+	events := feed(10, 2)
+	if len(events) != 0 {
+		t.Errorf("alert is not sustained long enough: %v", events)
+	}
+	events = feed(20, 2)
+	if len(events) != 1 || events[0].Status != RejectAlertStatusAlert || events[0].SubAccount != "test" {
+		t.Fatalf("alert expected: %v", events)
+	}
+	if events[0].RejectRatio < 0.1 || events[0].Rejected == 0 {
+		t.Errorf("wrong reject ratio in alert: %v", events[0])
+	}
+
+	// 告警只发一次
+	if events := feed(10, 2); len(events) != 0 {
+		t.Errorf("alert should be sent only once: %v", events)
+	}
+
+	// 全部接受后，窗口内的拒绝率降到恢复阈值以下时恢复
+	events = feed(60, 0)
+	if len(events) != 1 || events[0].Status != RejectAlertStatusRecovered {
+		t.Errorf("recovery expected: %v", events)
+	}
+}
+
+func TestRejectAlertHysteresis(t *testing.T) {
+	alert := newTestRejectAlert()
+	now := time.Unix(1600000000, 0)
+
+	add := func(accepted, rejected int) []RejectAlertEvent {
+		for i := 0; i < accepted; i++ {
+			alert.AddShare("test", true, now)
+		}
+		for i := 0; i < rejected; i++ {
+			alert.AddShare("test", false, now)
+		}
+		now = now.Add(time.Second)
+		return alert.Check(now)
+	}
+
+	// 拒绝率 20%，持续 10 秒后告警
+	var events []RejectAlertEvent
+	for i := 0; i < 11; i++ {
+		events = append(events, add(8, 2)...)
+	}
+	if len(events) != 1 || events[0].Status != RejectAlertStatusAlert {
+		t.Fatalf("alert expected: %v", events)
+	}
+
+	// 窗口内的拒绝率降到 5% 到 10% 之间（低于告警阈值但高于恢复阈值），不恢复
+	for i := 0; i < 60; i++ {
+		events = add(93, 7)
+		if len(events) != 0 {
+			t.Fatalf("should not recover above recover_ratio: %v", events)
+		}
+	}
+
+	// 降到 5% 以下时恢复
+	for i := 0; i < 60 && len(events) == 0; i++ {
+		events = add(100, 0)
+	}
+	if len(events) != 1 || events[0].Status != RejectAlertStatusRecovered || events[0].RejectRatio >= 0.05 {
+		t.Fatalf("recovery expected: %v", events)
+	}
+
+	// 恢复后需要重新持续超过阈值才告警
+	events = add(0, 100)
+	if len(events) != 0 {
+		t.Errorf("alert is not sustained long enough: %v", events)
+	}
+}
+
+func TestRejectAlertMinShares(t *testing.T) {
+	alert := newTestRejectAlert()
+	now := time.Unix(1600000000, 0)
+
+	// 每 10 秒拒绝一个 share，窗口内的 share 数不足 min_shares
+	for i := 0; i < 30; i++ {
+		alert.AddShare("test", false, now)
+		now = now.Add(10 * time.Second)
+		if events := alert.Check(now); len(events) != 0 {
+			t.Fatalf("too few shares to alert: %v", events)
+		}
+	}
+
+	// 没有 share 的子账户会被清理
+	alert.Check(now.Add(time.Hour))
+	if len(alert.accounts) != 0 {
+		t.Errorf("idle sub-account is not removed: %v", alert.accounts)
+	}
+}
+
+func TestRejectAlertWebhook(t *testing.T) {
+	received := make(chan RejectAlertEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RejectAlertEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("wrong webhook request: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	alert := newTestRejectAlert()
+	alert.config.RejectAlert.Webhook = server.URL
+	alert.Notify(RejectAlertEvent{"test", RejectAlertStatusAlert, 0.5, 10, 10, 1600000000})
+
+	select {
+	case event := <-received:
+		if event.SubAccount != "test" || event.Status != RejectAlertStatusAlert || event.Rejected != 10 {
+			t.Errorf("wrong webhook event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook is not called")
+	}
+}
@@ -0,0 +1,438 @@
+package btcagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 自检使用的固定数据，每次运行时模拟矿池下发的任务和模拟矿机提交的 share 都相同
+const (
+	selfTestSubAccount  = "selftest"
+	selfTestWorkerName  = "selftest.miner"
+	selfTestJobID       = "1"
+	selfTestNTime       = "5f5e1000"
+	selfTestExtraNonce2 = "01020304"
+	selfTestNonce       = "a1b2c3d4"
+)
+
+// SelfTestStep 自检（-selftest）的一个步骤
+type SelfTestStep struct {
+	Name    string
+	Elapsed time.Duration
+	Err     error
+	Skipped bool // 之前的步骤已失败，没有运行
+}
+
+func (step SelfTestStep) String() string {
+	switch {
+	case step.Skipped:
+		return fmt.Sprintf("%s: SKIPPED", step.Name)
+	case step.Err != nil:
+		return fmt.Sprintf("%s: FAILED: %s", step.Name, step.Err.Error())
+	}
+	return fmt.Sprintf("%s: OK (%s)", step.Name, step.Elapsed.Round(time.Microsecond))
+}
+
+// SelfTestReport 自检的结果
+type SelfTestReport struct {
+	Steps []SelfTestStep
+}
+
+// Passed 是否所有步骤都成功
+func (report SelfTestReport) Passed() bool {
+	for _, step := range report.Steps {
+		if step.Skipped || step.Err != nil {
+			return false
+		}
+	}
+	return len(report.Steps) > 0
+}
+
+// Lines 获取报告的输出行：每个步骤一行，最后一行为总体结果
+func (report SelfTestReport) Lines() (lines []string) {
+	for _, step := range report.Steps {
+		lines = append(lines, "self-test "+step.String())
+	}
+	if report.Passed() {
+		lines = append(lines, "self-test PASSED: the share was proxied from the miner to the pool and the response back to the miner")
+	} else {
+		lines = append(lines, "self-test FAILED")
+	}
+	return
+}
+
+// RunSelfTest 在进程内启动一个模拟矿池和一台模拟矿机，依次完成矿池握手、订阅、认证、下发任务和提交 share，
+// 途经的监听、矿池连接、矿机连接和 ex-message 都是正常运行时使用的代码，以此确认 BTCAgent 能在本机代理 share。
+// 不读取配置文件，使用默认配置（单用户模式，agent_type 为 btc），模拟矿池和代理只监听 127.0.0.1 的随机端口。
+func RunSelfTest() (report SelfTestReport) {
+	test := new(selfTest)
+	defer test.close()
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"start", test.start},
+		{"pool_handshake", test.poolHandshake},
+		{"subscribe", test.subscribe},
+		{"authorize", test.authorize},
+		{"notify", test.notify},
+		{"submit", test.submit},
+	}
+	failed := false
+	for _, s := range steps {
+		step := SelfTestStep{Name: s.name, Skipped: failed}
+		if !failed {
+			start := time.Now()
+			step.Err = s.run()
+			step.Elapsed = time.Since(start)
+			failed = step.Err != nil
+		}
+		report.Steps = append(report.Steps, step)
+	}
+	return
+}
+
+// selfTest 自检的状态，各步骤依次在同一个 goroutine 中运行
+type selfTest struct {
+	pool    *selfTestPool
+	manager *SessionManager
+
+	miner       net.Conn
+	reader      *bufio.Reader
+	extraNonce1 string
+	jobID       string // 矿机收到的最新任务（不包括 fake job）
+}
+
+// start 启动模拟矿池和代理
+func (test *selfTest) start() (err error) {
+	test.pool, err = newSelfTestPool()
+	if err != nil {
+		return
+	}
+
+	config := NewConfig()
+	config.AgentListenIp = "127.0.0.1"
+	config.AgentListenPort = 0
+	config.UseProxy = false
+	config.SubmitResponseFromServer = true
+	config.Pools = []PoolInfo{test.pool.PoolInfo()}
+	err = config.Init()
+	if err != nil {
+		return
+	}
+
+	test.manager = NewSessionManager(config)
+	err = test.manager.Start()
+	if err != nil {
+		return
+	}
+	go test.manager.serve(test.manager.tcpListener)
+	return
+}
+
+// poolHandshake 等待代理连接模拟矿池并完成握手和认证
+func (test *selfTest) poolHandshake() error {
+	select {
+	case err := <-test.pool.handshake:
+		return err
+	case <-time.After(SelfTestTimeoutSeconds.Get()):
+		return errors.New("timeout, BTCAgent did not connect and authorize to the fake pool")
+	}
+}
+
+// subscribe 模拟矿机连接代理并订阅
+func (test *selfTest) subscribe() (err error) {
+	test.miner, err = net.DialTimeout("tcp", test.manager.Addr().String(), SelfTestTimeoutSeconds.Get())
+	if err != nil {
+		return
+	}
+	test.reader = bufio.NewReader(test.miner)
+
+	response, err := test.request("subscribe", "mining.subscribe", "selftest/1.0")
+	if err != nil {
+		return
+	}
+	result, ok := response.Result.([]interface{})
+	if !ok || len(result) < 3 {
+		return fmt.Errorf("unexpected subscribe result: %v", response.Result)
+	}
+	test.extraNonce1, ok = result[1].(string)
+	if !ok {
+		return fmt.Errorf("unexpected extranonce1: %v", result[1])
+	}
+	return
+}
+
+// authorize 模拟矿机认证
+func (test *selfTest) authorize() (err error) {
+	response, err := test.request("authorize", "mining.authorize", selfTestWorkerName, "x")
+	if err != nil {
+		return
+	}
+	if response.Result != true {
+		return fmt.Errorf("unexpected authorize result: %v", response.Result)
+	}
+	return
+}
+
+// notify 等待矿机收到模拟矿池下发的任务
+func (test *selfTest) notify() (err error) {
+	for len(test.jobID) < 1 {
+		_, err = test.readLine()
+		if err != nil {
+			return
+		}
+	}
+	if test.jobID != selfTestJobID {
+		return fmt.Errorf("miner got job %s, expected %s", test.jobID, selfTestJobID)
+	}
+	return
+}
+
+// submit 模拟矿机提交 share，检查模拟矿池收到的 share 和矿机收到的响应
+func (test *selfTest) submit() (err error) {
+	response, err := test.request("submit", "mining.submit", selfTestWorkerName, test.jobID, selfTestExtraNonce2, selfTestNTime, selfTestNonce)
+	if err != nil {
+		return
+	}
+	if response.Result != true {
+		return fmt.Errorf("share rejected: %v", response.Error)
+	}
+
+	var share ExMessageSubmitShareBTC
+	select {
+	case share = <-test.pool.shares:
+	case <-time.After(SelfTestTimeoutSeconds.Get()):
+		return errors.New("the share was accepted but the fake pool did not receive it")
+	}
+	return test.checkShare(share)
+}
+
+// checkShare 检查模拟矿池收到的 share 与矿机提交的是否一致
+func (test *selfTest) checkShare(share ExMessageSubmitShareBTC) error {
+	sessionID, _ := strconv.ParseUint(test.extraNonce1, 16, 32)
+	jobID, _ := strconv.ParseUint(selfTestJobID, 10, 8)
+	extraNonce2, _ := strconv.ParseUint(selfTestExtraNonce2, 16, 32)
+	nTime, _ := strconv.ParseUint(selfTestNTime, 16, 32)
+	nonce, _ := strconv.ParseUint(selfTestNonce, 16, 32)
+
+	switch {
+	case uint64(share.Base.SessionID) != sessionID:
+		return fmt.Errorf("the fake pool received session id %04x, expected %s", share.Base.SessionID, test.extraNonce1)
+	case uint64(share.Base.JobID) != jobID:
+		return fmt.Errorf("the fake pool received job id %d, expected %s", share.Base.JobID, selfTestJobID)
+	case uint64(share.Base.ExtraNonce2) != extraNonce2:
+		return fmt.Errorf("the fake pool received extranonce2 %08x, expected %s", share.Base.ExtraNonce2, selfTestExtraNonce2)
+	case uint64(share.Time) != nTime:
+		return fmt.Errorf("the fake pool received ntime %08x, expected %s", share.Time, selfTestNTime)
+	case uint64(share.Base.Nonce) != nonce:
+		return fmt.Errorf("the fake pool received nonce %08x, expected %s", share.Base.Nonce, selfTestNonce)
+	}
+	return nil
+}
+
+// request 模拟矿机发送请求并等待响应
+func (test *selfTest) request(id string, method string, params ...interface{}) (response *JSONRPCLineBTC, err error) {
+	request := JSONRPCRequest{id, method, params}
+	bytes, err := request.ToJSONBytesLine()
+	if err != nil {
+		return
+	}
+	test.miner.SetWriteDeadline(time.Now().Add(SelfTestTimeoutSeconds.Get()))
+	_, err = test.miner.Write(bytes)
+	if err != nil {
+		return
+	}
+
+	for {
+		response, err = test.readLine()
+		if err != nil {
+			return
+		}
+		if response.ID == id {
+			return
+		}
+	}
+}
+
+// readLine 模拟矿机读取一行消息，并记录其中的任务
+func (test *selfTest) readLine() (rpcData *JSONRPCLineBTC, err error) {
+	test.miner.SetReadDeadline(time.Now().Add(SelfTestTimeoutSeconds.Get()))
+	line, err := test.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from BTCAgent: %w", err)
+	}
+	rpcData, err = NewJSONRPCLineBTC(line)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %w", line, err)
+	}
+	if rpcData.Method == "mining.notify" && len(rpcData.Params) > 0 {
+		if jobID, ok := rpcData.Params[0].(string); ok && !IsFakeJobIDBTC(jobID) {
+			test.jobID = jobID
+		}
+	}
+	return
+}
+
+func (test *selfTest) close() {
+	if test.miner != nil {
+		test.miner.Close()
+	}
+	if test.manager != nil {
+		test.manager.Stop()
+	}
+	if test.pool != nil {
+		test.pool.listener.Close()
+	}
+}
+
+//////////////////////////////// selfTestPool //////////////////////////////
+
+// selfTestPool 自检使用的模拟矿池，按 BTCAgent 协议完成握手，下发一个固定的任务，并接受所有 share
+type selfTestPool struct {
+	listener  net.Listener
+	handshake chan error                   // 第一个连接的握手结果
+	shares    chan ExMessageSubmitShareBTC // 收到的 share
+}
+
+func newSelfTestPool() (pool *selfTestPool, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	pool = &selfTestPool{listener, make(chan error, 1), make(chan ExMessageSubmitShareBTC, 1)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go pool.serve(conn)
+		}
+	}()
+	return
+}
+
+func (pool *selfTestPool) PoolInfo() PoolInfo {
+	addr := pool.listener.Addr().(*net.TCPAddr)
+	return PoolInfo{Host: addr.IP.String(), Port: uint16(addr.Port), SubAccount: selfTestSubAccount}
+}
+
+func (pool *selfTestPool) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	err := pool.acceptHandshake(conn, reader)
+	select {
+	case pool.handshake <- err:
+	default:
+	}
+	if err != nil {
+		Log.Warning("self-test fake pool: ", err.Error())
+		return
+	}
+
+	index := uint16(0)
+	for {
+		magicNumber, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if magicNumber[0] != ExMessageMagicNumber {
+			// 握手之后的 JSON 请求不影响自检
+			if _, err = reader.ReadBytes('\n'); err != nil {
+				return
+			}
+			continue
+		}
+
+		var header ExMessageHeader
+		if err = binary.Read(reader, binary.LittleEndian, &header); err != nil || header.Size < 4 {
+			return
+		}
+		body := make([]byte, header.Size-4)
+		if _, err = io.ReadFull(reader, body); err != nil {
+			return
+		}
+		switch header.Type {
+		case CMD_SUBMIT_SHARE, CMD_SUBMIT_SHARE_WITH_TIME, CMD_SUBMIT_SHARE_WITH_VER, CMD_SUBMIT_SHARE_WITH_TIME_VER:
+			pool.recordShare(header.Type, body)
+			// 矿池按收到的顺序为 share 编号
+			pool.writeSubmitResponse(conn, index, STATUS_ACCEPT)
+			index++
+		}
+	}
+}
+
+// acceptHandshake 响应连接测试、能力协商、订阅和认证请求，之后下发任务
+func (pool *selfTestPool) acceptHandshake(conn net.Conn, reader *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(SelfTestTimeoutSeconds.Get()))
+	defer conn.SetDeadline(time.Time{})
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("handshake failed: %w", err)
+		}
+		request, err := NewJSONRPCRequest(line)
+		if err != nil {
+			return fmt.Errorf("failed to decode handshake request %q: %w", line, err)
+		}
+		id, _ := request.ID.(string)
+		switch id {
+		case "conn_test", "caps", "caps_again":
+			pool.writeLine(conn, `{"id":"`+id+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+		case "conf":
+			pool.writeLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+		case "sub":
+			pool.writeLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+		case "auth":
+			pool.writeLine(conn, `{"id":"auth","result":true,"error":null}`)
+		}
+		if id == "caps_again" {
+			break
+		}
+	}
+
+	pool.writeLine(conn, `{"id":null,"method":"mining.notify","params":["`+selfTestJobID+`","0000000000000000000000000000000000000000000000000000000000000000",`+
+		`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","`+selfTestNTime+`",true]}`)
+	return nil
+}
+
+// recordShare 解析 share 并发给自检，只保留第一个
+func (pool *selfTestPool) recordShare(msgType uint8, body []byte) {
+	var share ExMessageSubmitShareBTC
+	buf := bytes.NewReader(body)
+	binary.Read(buf, binary.LittleEndian, &share.Base)
+	if msgType == CMD_SUBMIT_SHARE_WITH_TIME || msgType == CMD_SUBMIT_SHARE_WITH_TIME_VER {
+		binary.Read(buf, binary.LittleEndian, &share.Time)
+	}
+	if msgType == CMD_SUBMIT_SHARE_WITH_VER || msgType == CMD_SUBMIT_SHARE_WITH_TIME_VER {
+		binary.Read(buf, binary.LittleEndian, &share.VersionMask)
+	}
+	select {
+	case pool.shares <- share:
+	default:
+	}
+}
+
+func (pool *selfTestPool) writeSubmitResponse(conn net.Conn, index uint16, status StratumStatus) {
+	buf := new(bytes.Buffer)
+	response := ExMessageSubmitResponse{index, status}
+	header := ExMessageHeader{ExMessageMagicNumber, CMD_SUBMIT_RESPONSE, uint16(4 + binary.Size(response))}
+	binary.Write(buf, binary.LittleEndian, &header)
+	binary.Write(buf, binary.LittleEndian, &response)
+	conn.Write(buf.Bytes())
+}
+
+func (pool *selfTestPool) writeLine(conn net.Conn, line string) {
+	conn.Write([]byte(line + "\n"))
+}
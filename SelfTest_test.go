@@ -0,0 +1,35 @@
+package btcagent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	report := RunSelfTest()
+	lines := report.Lines()
+	if !report.Passed() || len(report.Steps) != 6 {
+		t.Fatalf("self-test should pass:\n%s", strings.Join(lines, "\n"))
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "self-test PASSED") {
+		t.Errorf("wrong last line of report: %s", lines[len(lines)-1])
+	}
+}
+
+func TestSelfTestCheckShare(t *testing.T) {
+	test := &selfTest{extraNonce1: "00000002"}
+	var share ExMessageSubmitShareBTC
+	share.Base.SessionID = 2
+	share.Base.JobID = 1
+	share.Base.ExtraNonce2 = 0x01020304
+	share.Base.Nonce = 0xa1b2c3d4
+	share.Time = 0x5f5e1000
+	if err := test.checkShare(share); err != nil {
+		t.Errorf("share should match: %v", err)
+	}
+
+	share.Base.Nonce = 0
+	if err := test.checkShare(share); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("share with wrong nonce should not match: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package btcagent
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrSendQueueFull = errors.New("send queue is full")
+var ErrSendQueueClosed = errors.New("send queue is closed")
+
+//////////////////////////////// SendQueue //////////////////////////////
+
+// SendQueue 矿机连接的发送队列，由单独的 goroutine 写入连接。
+//
+// 事件循环只把数据放入队列，不会因为矿机的 TCP 发送缓冲区已满而阻塞，
+// 这样一台不收数据的矿机不会拖慢任务的广播以及它自己的事件处理。
+// 队列满时 Write 返回 ErrSendQueueFull，调用方应断开该矿机。
+// 写入连接失败时调用 onWriteError，由调用方断开该矿机。
+// Write 和 Close 只能在同一个 goroutine（事件循环）中调用。
+type SendQueue struct {
+	id           string // 打印日志用的连接标识符
+	conn         net.Conn
+	queue        chan []byte
+	closed       bool
+	onWriteError func(err error) // 在写入 goroutine 中调用，可以为 nil
+}
+
+// NewSendQueue 创建发送队列并启动写入 goroutine
+func NewSendQueue(id string, conn net.Conn, size uint, onWriteError func(err error)) (q *SendQueue) {
+	q = new(SendQueue)
+	q.id = id
+	q.conn = conn
+	q.queue = make(chan []byte, size)
+	q.onWriteError = onWriteError
+	go q.writeLoop()
+	return
+}
+
+// Write 将 bytes 放入队列，不等待写入连接
+func (q *SendQueue) Write(bytes []byte) (int, error) {
+	if q.closed {
+		return 0, ErrSendQueueClosed
+	}
+	select {
+	case q.queue <- bytes:
+		return len(bytes), nil
+	default:
+		return 0, ErrSendQueueFull
+	}
+}
+
+// Close 在 flushTimeout 内发送完队列中剩余的内容（如发给矿机的错误响应），然后关闭连接
+func (q *SendQueue) Close(flushTimeout time.Duration) {
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	close(q.queue)
+}
+
+func (q *SendQueue) writeLoop() {
+	defer q.conn.Close()
+
+	for bytes := range q.queue {
+		_, err := q.conn.Write(bytes)
+		if err != nil {
+			Log.Warning(q.id, "failed to write to miner: ", err.Error())
+			// 先通知会话以写入失败为原因断开，不必等读循环出错；之后的内容直接丢弃
+			if q.onWriteError != nil {
+				q.onWriteError(err)
+			}
+			q.conn.Close()
+			for range q.queue {
+			}
+			return
+		}
+	}
+}
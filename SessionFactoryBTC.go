@@ -1,12 +1,12 @@
-package main
+package btcagent
 
 import "net"
 
 type SessionFactoryBTC struct {
 }
 
-func (factory *SessionFactoryBTC) NewUpSession(manager *UpSessionManager, poolIndex int, slot int) (up UpSession) {
-	return NewUpSessionBTC(manager, poolIndex, slot)
+func (factory *SessionFactoryBTC) NewUpSession(manager *UpSessionManager, config *Config, poolIndex int, slot int) (up UpSession) {
+	return NewUpSessionBTC(manager, config, poolIndex, slot)
 }
 
 func (factory *SessionFactoryBTC) NewFakeUpSession(manager *UpSessionManager) (up FakeUpSession) {
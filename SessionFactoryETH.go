@@ -1,12 +1,12 @@
-package main
+package btcagent
 
 import "net"
 
 type SessionFactoryETH struct {
 }
 
-func (factory *SessionFactoryETH) NewUpSession(manager *UpSessionManager, poolIndex int, slot int) (up UpSession) {
-	return NewUpSessionETH(manager, poolIndex, slot)
+func (factory *SessionFactoryETH) NewUpSession(manager *UpSessionManager, config *Config, poolIndex int, slot int) (up UpSession) {
+	return NewUpSessionETH(manager, config, poolIndex, slot)
 }
 
 func (factory *SessionFactoryETH) NewFakeUpSession(manager *UpSessionManager) (up FakeUpSession) {
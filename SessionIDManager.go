@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 import (
 	"sync"
@@ -50,6 +50,19 @@ func (manager *SessionIDManager) next() {
 	}
 }
 
+// Count 已分配的会话ID数量
+func (manager *SessionIDManager) Count() int {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	return int(manager.count)
+}
+
+// Capacity 可以同时分配的会话ID数量
+func (manager *SessionIDManager) Capacity() int {
+	return int(manager.maxSessionId) + 1
+}
+
 // AllocSessionID 为调用者分配一个会话ID
 func (manager *SessionIDManager) AllocSessionID() (sessionID uint16, err error) {
 	defer manager.lock.Unlock()
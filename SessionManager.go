@@ -1,79 +1,420 @@
-package main
+package btcagent
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
-
-	"github.com/golang/glog"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SessionManager struct {
+	// 已分配的矿机连接序号（miner_session_serial），用于 64 位原子操作，放在第一个字段以保证在 32 位平台上对齐
+	sessionSerial uint64
+
 	config            *Config                      // 配置
+	pools             atomic.Value                 // *Config，与 config 只有矿池列表不同，运行时更新矿池列表（setpools）后替换
 	tcpListener       net.Listener                 // TCP监听对象
+	tlsListener       net.Listener                 // TLS监听对象
+	tlsCertificate    *TLSCertificate              // TLS监听使用的证书
+	unixListener      net.Listener                 // Unix域套接字监听对象
 	sessionIDManager  *SessionIDManager            // 会话ID管理器
+	minerCapacity     *MinerCapacity               // 占用会话ID的矿机连接，用于会话ID用完时踢掉空闲的连接
+	poolCapture       *PoolCapture                 // 矿池抓包，未启用时为 nil
 	upSessionManagers map[string]*UpSessionManager // map[子账户名]矿池会话管理器
-	exitChannel       chan bool                    // 退出信号
+	adminServer       *AdminServer                 // 管理命令服务
+	shareStats        *ShareStats                  // share 统计
+	poolStats         *PoolStats                   // 矿池连接统计
+	rejectAlert       *RejectAlert                 // 拒绝率告警，未启用时为 nil
+	metrics           *AgentMetrics                // 运行指标
+	ctx               context.Context              // 取消后所有会话退出
+	cancel            context.CancelFunc           // 取消 ctx
+	stopOnce          sync.Once                    // 保证只退出一次
+	listenAddr        atomic.Value                 // TCP监听地址
 	eventChannel      chan interface{}             // 事件循环
+
+	startTime    time.Time // 启动时间
+	draining     bool      // 是否停止接受新矿机
+	submitsState int32     // 是否向矿池提交新的 share（submitsRunning 等），原子操作
 }
 
 func NewSessionManager(config *Config) (manager *SessionManager) {
 	manager = new(SessionManager)
 	manager.config = config
+	manager.pools.Store(config)
 	manager.upSessionManagers = make(map[string]*UpSessionManager)
-	manager.exitChannel = make(chan bool, 1)
+	manager.minerCapacity = NewMinerCapacity()
+	manager.ctx, manager.cancel = context.WithCancel(context.Background())
 	manager.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.SessionManager)
+	manager.startTime = time.Now()
+	manager.shareStats = NewShareStats()
+	manager.metrics = NewAgentMetrics()
+	manager.poolStats = NewPoolStats(config)
+	manager.metrics.register(manager.poolStats)
+	if config.RejectAlert.Enable {
+		manager.rejectAlert = NewRejectAlert(config)
+	}
 	return
 }
 
-func (manager *SessionManager) Run() {
-	var err error
+// Metrics 获取运行指标，可以在任意 goroutine 中调用
+func (manager *SessionManager) Metrics() *AgentMetrics {
+	return manager.metrics
+}
 
+// Run 启动代理并接受矿机连接，直到调用 Stop()。启动失败时返回错误。
+func (manager *SessionManager) Run() (err error) {
+	err = manager.Start()
+	if err != nil {
+		return
+	}
+	manager.serve(manager.tcpListener)
+	return
+}
+
+// Start 启动监听和事件循环，不等待代理退出。启动失败时已打开的监听会被关闭。
+func (manager *SessionManager) Start() (err error) {
 	// 初始化会话管理器
 	manager.sessionIDManager, err = NewSessionIDManager(0xfffe)
 	if err != nil {
-		glog.Fatal("NewSessionIDManager failed: ", err)
+		return fmt.Errorf("NewSessionIDManager failed: %w", err)
+	}
+
+	if capture := &manager.config.Advanced.PoolCapture; capture.Enable {
+		manager.poolCapture, err = NewPoolCapture(capture.File, int64(capture.MaxFileSizeMB)*1024*1024, int(capture.MaxBackups))
+		if err != nil {
+			return fmt.Errorf("failed to open pool capture file: %w", err)
+		}
+	}
+
+	err = manager.listen()
+	if err != nil {
+		manager.Stop()
 		return
 	}
 
-	// 启动事件循环
+	// 为单用户模式连接矿池，透传模式下每台矿机单独连接矿池
+	if !manager.config.MultiUserMode && !manager.config.PassthroughOnly() {
+		manager.createUpSessionManager("", "", nil)
+	}
+
+	// 启动事件循环，此后只能在事件循环中访问 upSessionManagers
 	go manager.handleEvent()
 
+	// 载入之前保存的统计数据
+	if manager.config.StatsPersist.Enable {
+		err = manager.shareStats.LoadFromFile(manager.config.StatsPersist.File)
+		if err != nil {
+			Log.Warning("failed to load share statistics from ", manager.config.StatsPersist.File, ", start from zero: ", err)
+			err = nil
+		}
+		go manager.persistStats()
+	}
+
+	if manager.rejectAlert != nil {
+		go manager.checkRejectAlert()
+	}
+
+	// 在载入统计数据之后启动，以免第一次报告包含之前保存的数据
+	if manager.config.StatsReport.Enable {
+		go NewStatsReporter(manager.config, manager.shareStats).Run(manager.ctx)
+	}
+	return
+}
+
+func (manager *SessionManager) listen() (err error) {
 	// TCP监听
 	listenAddr := fmt.Sprintf("%s:%d", manager.config.AgentListenIp, manager.config.AgentListenPort)
-	glog.Info("startup is successful, listening: ", listenAddr)
 	manager.tcpListener, err = net.Listen("tcp", listenAddr)
 	if err != nil {
-		glog.Fatal("failed to listen on ", listenAddr, ": ", err)
+		return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+	manager.setListenBacklog(manager.tcpListener)
+	manager.listenAddr.Store(manager.tcpListener.Addr())
+	Log.Info("startup is successful, listening: ", manager.tcpListener.Addr())
+
+	// TLS监听
+	if manager.config.AgentListenTLS.Enable {
+		tlsConf := &manager.config.AgentListenTLS
+		manager.tlsCertificate, err = NewTLSCertificate(tlsConf.CertFile, tlsConf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate %s and key %s: %w", tlsConf.CertFile, tlsConf.KeyFile, err)
+		}
+
+		tlsListenAddr := fmt.Sprintf("%s:%d", manager.config.AgentListenIp, tlsConf.Port)
+		Log.Info("listening with SSL/TLS: ", tlsListenAddr)
+		listener, err := net.Listen("tcp", tlsListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", tlsListenAddr, err)
+		}
+		manager.setListenBacklog(listener)
+		manager.tlsListener = tls.NewListener(listener, manager.tlsCertificate.TLSConfig())
+		go manager.serve(manager.tlsListener)
+	}
+
+	// Unix域套接字监听
+	if manager.config.AgentListenUnix.Enable {
+		unixConf := &manager.config.AgentListenUnix
+		Log.Info("listening on unix socket: ", unixConf.Path)
+		manager.unixListener, err = ListenUnix(unixConf.Path, unixConf.Mode)
+		if err != nil {
+			return fmt.Errorf("failed to listen on unix socket %s: %w", unixConf.Path, err)
+		}
+		manager.setListenBacklog(manager.unixListener)
+		go manager.serve(manager.unixListener)
+	}
+
+	// 管理命令服务
+	if manager.config.Admin.Enable {
+		adminServer := NewAdminServer(manager, manager.config.Admin.Token)
+		Log.Info("admin command service listening: ", manager.config.Admin.Listen)
+		err = adminServer.Listen(manager.config.Admin.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", manager.config.Admin.Listen, err)
+		}
+		manager.adminServer = adminServer
+		go manager.adminServer.Run()
+	}
+	return
+}
+
+// Addr 获取监听矿机连接的 TCP 地址，启动前返回 nil。可以在任意 goroutine 中调用。
+func (manager *SessionManager) Addr() net.Addr {
+	addr, _ := manager.listenAddr.Load().(net.Addr)
+	return addr
+}
+
+// setListenBacklog 按 agent_listen_backlog 设置矿机连接的监听队列长度，平台不支持时只打印日志
+func (manager *SessionManager) setListenBacklog(listener net.Listener) {
+	if manager.config.AgentListenBacklog < 1 {
 		return
 	}
+	err := SetListenBacklog(listener, manager.config.AgentListenBacklog)
+	if err != nil {
+		Log.Warning("failed to set listen backlog of ", listener.Addr(), " to ", manager.config.AgentListenBacklog, ", use the system default: ", err.Error())
+	}
+}
 
-	// 为单用户模式连接矿池
-	if !manager.config.MultiUserMode {
-		manager.createUpSessionManager("")
+func (manager *SessionManager) serve(listener net.Listener) {
+	acceptLoop(manager.ctx, listener, "miner", manager.RunDownSession)
+}
+
+// acceptLoop 接受连接并交给 handle 在新的 goroutine 中处理，直到 ctx 被取消或监听被关闭（net.ErrClosed）。
+// 其他错误（如文件描述符耗尽 EMFILE、连接在握手中被重置）时等待一段时间后继续，连续出错时等待时间加倍，以免空转刷屏。
+// 不依赖已废弃的 net.Error.Temporary()，它对很多可以恢复的错误返回 false。
+func acceptLoop(ctx context.Context, listener net.Listener, name string, handle func(conn net.Conn)) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			delay = 0
+			go handle(conn)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			Log.Error("stop accepting ", name, " connections on ", listener.Addr(), ": ", err.Error())
+			return
+		}
+
+		if delay == 0 {
+			delay = ListenerAcceptRetryMinMilliseconds * time.Millisecond
+		} else if delay *= 2; delay > ListenerAcceptRetryMaxMilliseconds*time.Millisecond {
+			delay = ListenerAcceptRetryMaxMilliseconds * time.Millisecond
+		}
+		Log.Warning("failed to accept ", name, " connection: ", err.Error(), ", retry in ", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReloadTLSCertificate 重新载入TLS监听使用的证书，不影响已建立的连接
+func (manager *SessionManager) ReloadTLSCertificate() {
+	if manager.tlsCertificate == nil {
+		return
+	}
+	err := manager.tlsCertificate.Reload()
+	if err != nil {
+		Log.Error("failed to reload TLS certificate: ", err)
+		return
 	}
+	Log.Info("TLS certificate reloaded")
+}
+
+// persistStats 定期保存统计数据
+func (manager *SessionManager) persistStats() {
+	ticker := time.NewTicker(manager.config.StatsPersist.FlushIntervalSeconds.Get())
+	defer ticker.Stop()
 
 	for {
-		conn, err := manager.tcpListener.Accept()
-		if err != nil {
-			select {
-			case <-manager.exitChannel:
-				return
-			default:
-				glog.Warning("failed to accept miner connection: ", err.Error())
-				continue
+		select {
+		case <-ticker.C:
+			manager.saveStats()
+		case <-manager.ctx.Done():
+			return
+		}
+	}
+}
+
+// addShare 记录矿池对 share 的响应，difficulty 为 share 的难度（未知时为 0），可以在任意 goroutine 中调用
+func (manager *SessionManager) addShare(subAccount string, accepted bool, difficulty uint64) {
+	manager.shareStats.AddShare(subAccount, accepted, difficulty)
+	if accepted {
+		manager.metrics.AcceptedDifficulty.Add(float64(difficulty))
+	}
+	if manager.rejectAlert != nil {
+		manager.rejectAlert.AddShare(subAccount, accepted, time.Now())
+	}
+}
+
+// checkRejectAlert 定期检查各子账户的拒绝率
+func (manager *SessionManager) checkRejectAlert() {
+	ticker := time.NewTicker(RejectAlertCheckIntervalSeconds.Get())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, event := range manager.rejectAlert.Check(now) {
+				manager.rejectAlert.Notify(event)
 			}
+		case <-manager.ctx.Done():
+			return
 		}
-		go manager.RunDownSession(conn)
 	}
 }
 
+func (manager *SessionManager) saveStats() {
+	err := manager.shareStats.SaveToFile(manager.config.StatsPersist.File)
+	if err != nil {
+		Log.Error("failed to save share statistics to ", manager.config.StatsPersist.File, ": ", err)
+	}
+}
+
+// Stop 停止代理，可以多次调用
 func (manager *SessionManager) Stop() {
-	// 退出TCP监听
-	manager.exitChannel <- true
-	manager.tcpListener.Close()
+	manager.stopOnce.Do(manager.stop)
+}
+
+func (manager *SessionManager) stop() {
+	if manager.waitSubmitsEnabled() {
+		atomic.StoreInt32(&manager.submitsState, submitsStopped)
+		manager.waitSubmits(time.Now().Add(manager.config.Advanced.ShutdownSubmitGraceSeconds.Get()))
+	}
+
+	// 在会话退出之前获取摘要，以统计退出时的连接数
+	summary := manager.ExitSummary()
+
+	// 退出TCP监听、事件循环及所有会话
+	manager.cancel()
+	if manager.config.StatsPersist.Enable {
+		manager.saveStats()
+	}
+	if manager.tcpListener != nil {
+		manager.tcpListener.Close()
+	}
+	if manager.tlsListener != nil {
+		manager.tlsListener.Close()
+	}
+	if manager.unixListener != nil {
+		// 套接字文件会在 Close() 时被删除
+		manager.unixListener.Close()
+	}
+	if manager.adminServer != nil {
+		manager.adminServer.Stop()
+	}
+	if manager.poolCapture != nil {
+		manager.poolCapture.Close()
+	}
+	manager.logExitSummary(summary)
+}
+
+// waitSubmitsEnabled 退出或 drain 时是否等待矿池响应已提交的 share
+func (manager *SessionManager) waitSubmitsEnabled() bool {
+	return manager.config.Advanced.ShutdownSubmitGraceSeconds > 0 && manager.config.SubmitResponseFromServer
+}
+
+// 是否向矿池提交新的 share。暂停或停止时矿机提交的 share 在本地响应为失败
+const (
+	submitsRunning int32 = iota // 正常提交
+	submitsPaused               // drain 后等待已提交的 share 的响应，等待结束后恢复提交
+	submitsStopped              // 退出前等待已提交的 share 的响应，不再恢复
+)
+
+// pauseSubmits drain 时暂停提交新的 share，等待已提交的 share 的响应后恢复。
+// 已经暂停或正在退出时不做任何事。
+func (manager *SessionManager) pauseSubmits() {
+	if !atomic.CompareAndSwapInt32(&manager.submitsState, submitsRunning, submitsPaused) {
+		return
+	}
+	Log.Info("[admin] new shares will not be submitted to pool servers until responses of submitted shares are received")
+	// waitSubmits 需要事件循环处理 EventWaitSubmits，不能在事件循环中等待
+	go func() {
+		manager.waitSubmits(time.Now().Add(manager.config.Advanced.ShutdownSubmitGraceSeconds.Get()))
+		manager.resumeSubmits()
+	}()
+}
+
+// resumeSubmits 恢复提交被 drain 暂停的 share，正在退出时不会恢复
+func (manager *SessionManager) resumeSubmits() {
+	if atomic.CompareAndSwapInt32(&manager.submitsState, submitsPaused, submitsRunning) {
+		Log.Info("[admin] shares are submitted to pool servers again")
+	}
+}
 
-	// 退出事件循环
-	manager.SendEvent(EventExit{})
+// SubmitsStopped 是否已暂停或停止向矿池提交新的 share，可以在任意 goroutine 中调用
+func (manager *SessionManager) SubmitsStopped() bool {
+	return atomic.LoadInt32(&manager.submitsState) != submitsRunning
+}
+
+// waitSubmits 退出或 drain 时等待矿池响应已提交的 share，最多等到 deadline
+func (manager *SessionManager) waitSubmits(deadline time.Time) {
+	Log.Info("waiting up to ", manager.config.Advanced.ShutdownSubmitGraceSeconds, " seconds for responses of submitted shares")
+	response := make(chan int, 1)
+	// 事件循环未启动（启动失败）时发送会阻塞，在单独的 goroutine 中发送
+	go manager.SendEvent(EventWaitSubmits{deadline, response})
+
+	select {
+	case failed := <-response:
+		if failed > 0 {
+			Log.Warning(failed, " shares are not responded by pool servers in time, respond to miners locally")
+		}
+	case <-time.After(time.Until(deadline) + ShutdownWaitMarginSeconds.Get()):
+		Log.Warning("timeout waiting for responses of submitted shares")
+	}
+}
+
+// waitChildrenSubmits 停止接受新矿机，等待所有子账户的矿池连接响应已提交的 share
+func (manager *SessionManager) waitChildrenSubmits(e EventWaitSubmits) {
+	manager.draining = true
+	children := make([]EventInterface, 0, len(manager.upSessionManagers))
+	for _, child := range manager.upSessionManagers {
+		children = append(children, child)
+	}
+	go waitSubmitsOf(children, e)
+}
+
+// waitSubmitsOf 依次等待各个会话，deadline 对所有会话相同，因此总的等待时间不会超过它
+func waitSubmitsOf(sessions []EventInterface, e EventWaitSubmits) {
+	failed := 0
+	for _, session := range sessions {
+		response := make(chan int, 1)
+		go session.SendEvent(EventWaitSubmits{e.Deadline, response})
+		select {
+		case n := <-response:
+			failed += n
+		case <-time.After(time.Until(e.Deadline) + ShutdownWaitMarginSeconds.Get()):
+		}
+	}
+	e.Response <- failed
 }
 
 func (manager *SessionManager) exit() {
@@ -85,14 +426,26 @@ func (manager *SessionManager) exit() {
 
 func (manager *SessionManager) RunDownSession(conn net.Conn) {
 	// 产生 sessionID （Extranonce1）
-	sessionID, err := manager.sessionIDManager.AllocSessionID()
+	sessionID, err := manager.allocSessionID(conn)
 
 	if err != nil {
-		glog.Warning("failed to allocate session id : ", err)
+		if err == ErrSessionIDFull {
+			// 所有矿池连接共用同一个 sessionID 空间，增加矿池连接无济于事
+			manager.metrics.ExtranonceExhausted.Inc()
+			Log.Error("reject miner ", ConnRemoteAddr(conn), ": extranonce space is exhausted, all ", manager.sessionIDManager.Capacity(),
+				" session ids are in use. Please run another BTCAgent instance for the remaining miners.")
+		} else {
+			Log.Warning("failed to allocate session id : ", err)
+		}
 		conn.Close()
 		return
 	}
 
+	if manager.usePassthrough() {
+		NewPassthroughSession(manager, conn, sessionID).Run()
+		return
+	}
+
 	down := manager.config.sessionFactory.NewDownSession(manager, conn, sessionID)
 	down.Init()
 	if down.Stat() != StatAuthorized {
@@ -105,49 +458,332 @@ func (manager *SessionManager) RunDownSession(conn net.Conn) {
 	manager.SendEvent(EventAddDownSession{down})
 }
 
+// usePassthrough 新的矿机连接是否使用透传模式：所有矿池都只以透传模式连接时总是使用，
+// 部分矿池设置了 passthrough 时，只在其他矿池都不可用（最近的连接尝试失败且没有已认证的连接）时使用
+func (manager *SessionManager) usePassthrough() bool {
+	config := manager.poolsConfig()
+	if !config.HasPassthroughPool() {
+		return false
+	}
+	for i := range config.Pools {
+		if !config.PassthroughPool(i) && manager.poolStats.Available(&config.Pools[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocSessionID 为新的矿机连接 conn 分配会话ID。会话ID用完时，miner_capacity_eviction.policy 为 evict_idle 则踢掉一个空闲的矿机连接，
+// 等待它释放会话ID后再分配
+func (manager *SessionManager) allocSessionID(conn net.Conn) (sessionID uint16, err error) {
+	sessionID, err = manager.sessionIDManager.AllocSessionID()
+	eviction := &manager.config.Advanced.MinerCapacityEviction
+	if err != ErrSessionIDFull || eviction.Policy != MinerCapacityEvictIdle || manager.config.PassthroughOnly() {
+		return
+	}
+
+	victim, reason, ok := manager.minerCapacity.Evict(eviction.IdleSeconds.Get(), eviction.NeverEvictActive, time.Now())
+	if !ok {
+		Log.Warning("no idle miner to evict for ", ConnRemoteAddr(conn), ", all miners have accepted shares in ", eviction.IdleSeconds, " seconds")
+		return
+	}
+	manager.metrics.MinersEvicted.Inc("reason", reason)
+	Log.Warning("evict miner ", victim, " (", reason, ") to make room for ", ConnRemoteAddr(conn), ", all session ids are in use")
+
+	deadline := time.Now().Add(MinerCapacityEvictWaitMilliseconds * time.Millisecond)
+	for err == ErrSessionIDFull && time.Now().Before(deadline) {
+		select {
+		case <-time.After(MinerCapacityEvictPollMilliseconds * time.Millisecond):
+		case <-manager.ctx.Done():
+			return
+		}
+		sessionID, err = manager.sessionIDManager.AllocSessionID()
+	}
+	return
+}
+
+// sessionLogID 生成矿机连接打印日志用的标识符。
+// 启用 miner_session_serial 时分配从 1 开始递增的连接序号并加在标识符中，否则序号为 0。
+func (manager *SessionManager) sessionLogID(kind string, sessionID uint16, conn net.Conn) (id string, serial uint64) {
+	if !manager.config.Advanced.MinerSessionSerial {
+		return fmt.Sprintf("%s#%d (%s) ", kind, sessionID, ConnRemoteAddr(conn)), 0
+	}
+	serial = atomic.AddUint64(&manager.sessionSerial, 1)
+	return fmt.Sprintf("%s#%d serial#%d (%s) ", kind, sessionID, serial, ConnRemoteAddr(conn)), serial
+}
+
 func (manager *SessionManager) SendEvent(event interface{}) {
-	manager.eventChannel <- event
+	sendEventWithPolicy(manager.ctx, manager.eventChannel, event, manager.config, manager.metrics)
+}
+
+// poolsConfig 获取当前矿池列表所在的配置，可以在任意 goroutine 中调用
+func (manager *SessionManager) poolsConfig() *Config {
+	return manager.pools.Load().(*Config)
 }
 
-func (manager *SessionManager) createUpSessionManager(subAccount string) (upManager *UpSessionManager) {
-	upManager = NewUpSessionManager(subAccount, manager.config, manager)
+// createUpSessionManager 创建子账户的矿池会话管理器，route 不为 nil 时为按 user_agent_routes 建立的单独的矿池连接
+func (manager *SessionManager) createUpSessionManager(subAccount string, minerPassword string, route *UserAgentRoute) (upManager *UpSessionManager) {
+	config := manager.poolsConfig()
+	if route != nil {
+		config = config.WithRoute(route)
+	}
+	upManager = NewUpSessionManager(subAccount, minerPassword, config, manager)
 	go upManager.Run()
-	manager.upSessionManagers[subAccount] = upManager
+	manager.upSessionManagers[upManager.key] = upManager
 	return
 }
 
 func (manager *SessionManager) addDownSession(e EventAddDownSession) {
-	upManager, ok := manager.upSessionManagers[e.Session.SubAccountName()]
+	if manager.draining {
+		Log.Info("draining, reject miner #", e.Session.SessionID())
+		e.Session.SendEvent(EventExit{})
+		return
+	}
+
+	route := manager.config.UserAgentRoute(e.Session.UserAgent())
+	upManager, ok := manager.upSessionManagers[upSessionManagerKey(e.Session.SubAccountName(), route)]
 	if !ok {
-		upManager = manager.createUpSessionManager(e.Session.SubAccountName())
+		upManager = manager.createUpSessionManager(e.Session.SubAccountName(), e.Session.Password(), route)
 	}
 	upManager.SendEvent(e)
 }
 
 func (manager *SessionManager) stopUpSessionManager(e EventStopUpSessionManager) {
-	child := manager.upSessionManagers[e.SubAccount]
+	child := manager.upSessionManagers[e.Key]
 	if child == nil {
-		glog.Error("StopUpSessionManager: cannot find sub-account: ", e.SubAccount)
+		Log.Error("StopUpSessionManager: cannot find sub-account: ", e.Key)
 		return
 	}
-	delete(manager.upSessionManagers, e.SubAccount)
+	delete(manager.upSessionManagers, e.Key)
 	child.SendEvent(EventExit{})
 }
 
 func (manager *SessionManager) handleEvent() {
 	for {
-		event := <-manager.eventChannel
+		var event interface{}
+		select {
+		case event = <-manager.eventChannel:
+		case <-manager.ctx.Done():
+			manager.exit()
+			return
+		}
 
 		switch e := event.(type) {
 		case EventAddDownSession:
 			manager.addDownSession(e)
 		case EventStopUpSessionManager:
 			manager.stopUpSessionManager(e)
+		case EventAdminCommand:
+			manager.adminCommand(e)
+		case EventHealthCheck:
+			manager.healthCheck(e)
+		case EventWaitSubmits:
+			manager.waitChildrenSubmits(e)
 		case EventExit:
 			manager.exit()
 			return
 		default:
-			glog.Error("[SessionManager] unknown event: ", event)
+			Log.Error("[SessionManager] unknown event: ", event)
+		}
+	}
+}
+
+// AdminCommand 在事件循环中执行管理命令并等待结果
+func (manager *SessionManager) AdminCommand(req *AdminRequest) AdminResponse {
+	response := make(chan AdminResponse, 1)
+	manager.SendEvent(EventAdminCommand{req, response})
+
+	select {
+	case r := <-response:
+		return r
+	case <-adminCommandTimeout():
+		return AdminResponse{nil, AdminErrTimeout}
+	}
+}
+
+func (manager *SessionManager) adminCommand(e EventAdminCommand) {
+	switch e.Request.Method {
+	case "help":
+		e.Response <- AdminResponse{AdminCommandHelp, nil}
+
+	case "drain":
+		manager.draining = true
+		Log.Info("[admin] draining, new miners will be rejected")
+		if manager.waitSubmitsEnabled() {
+			// 与退出时相同，暂停提交新的 share 并等待已提交的 share 的响应，使此时停止代理不会丢失 share。
+			// 等待结束后恢复提交，保留的矿机照常挖矿
+			manager.pauseSubmits()
+		}
+		e.Response <- AdminResponse{true, nil}
+
+	case "undrain":
+		manager.draining = false
+		manager.resumeSubmits()
+		Log.Info("[admin] undrained, new miners will be accepted")
+		e.Response <- AdminResponse{true, nil}
+
+	case "stats", "pools", "sessions":
+		children := make([]*UpSessionManager, 0, len(manager.upSessionManagers))
+		for _, child := range manager.upSessionManagers {
+			children = append(children, child)
+		}
+		go manager.adminStatus(e, children, manager.draining)
+
+	case "reconnect":
+		slot, ok := e.Request.ParamInt(0, -1)
+		if !ok || slot < 0 {
+			e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+			return
+		}
+		subAccount, _ := e.Request.ParamString(1, "")
+		child, ok := manager.upSessionManagers[subAccount]
+		if !ok {
+			e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+			return
+		}
+		child.SendEvent(EventReconnectUpSession{slot, e.Response})
+
+	case "kick":
+		param, ok := e.Request.ParamString(0, "")
+		filter, valid := ParseDownSessionFilter(param)
+		if !ok || !valid {
+			e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+			return
+		}
+		children := make([]*UpSessionManager, 0, len(manager.upSessionManagers))
+		for _, child := range manager.upSessionManagers {
+			children = append(children, child)
+		}
+		go manager.adminKick(e, children, filter)
+
+	case "setpools":
+		manager.setPools(e)
+
+	case "verbosity":
+		if name, _ := e.Request.ParamString(0, ""); IsLogSubsystem(name) {
+			level, ok := e.Request.ParamInt(1, -1)
+			if !ok || SetLogSubsystemVerbosity(name, level) != nil {
+				e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+				return
+			}
+		} else if len(e.Request.Params) > 0 {
+			level, ok := e.Request.ParamInt(0, 0)
+			if !ok || SetLogVerbosity(level) != nil {
+				e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+				return
+			}
+		}
+		e.Response <- AdminResponse{GetLogLevel(), nil}
+
+	case "vmodule":
+		vmodule, ok := e.Request.ParamString(0, "")
+		if !ok || SetLogVModule(vmodule) != nil {
+			e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+			return
+		}
+		e.Response <- AdminResponse{GetLogLevel(), nil}
+
+	default:
+		e.Response <- AdminResponse{nil, AdminErrUnknownCommand}
+	}
+}
+
+// setPools 将矿池列表替换为参数中的列表（管理命令 setpools），新列表有误时不做任何改变。
+// 连接到仍在列表中的矿池的连接不受影响，连接到已删除矿池的连接开始 drain，透传模式下只影响之后的矿机连接。
+func (manager *SessionManager) setPools(e EventAdminCommand) {
+	var pools []PoolInfo
+	if !e.Request.ParamJSON(0, &pools) {
+		e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+		return
+	}
+	config, err := manager.poolsConfig().WithPools(pools)
+	if err == nil && config.PassthroughOnly() != manager.config.PassthroughOnly() {
+		// 是否建立聚合的矿池连接在启动时决定
+		err = errors.New("pools connected in passthrough mode cannot replace all other pools, or be replaced by them, at runtime")
+	}
+	if err != nil {
+		Log.Warning("[admin] setpools rejected: ", err)
+		e.Response <- AdminResponse{nil, NewStratumError(AdminErrIllegalParams.ErrNo, err.Error())}
+		return
+	}
+
+	manager.pools.Store(config)
+	manager.poolStats.SetPools(config.Pools)
+	for _, child := range manager.upSessionManagers {
+		if child.config.route != nil {
+			if len(child.config.route.Pools) > 0 {
+				// 规则中配置的矿池不受影响
+				continue
+			}
+			child.SendEvent(EventSetPools{config.WithRoute(child.config.route)})
+			continue
+		}
+		child.SendEvent(EventSetPools{config})
+	}
+
+	addresses := make([]string, len(config.Pools))
+	for i := range config.Pools {
+		addresses[i] = config.Pools[i].Address()
+	}
+	Log.Info("[admin] pool list updated: ", addresses)
+	e.Response <- AdminResponse{addresses, nil}
+}
+
+// adminKick 断开所有子账户中符合条件的矿机，返回被断开的矿机列表
+func (manager *SessionManager) adminKick(e EventAdminCommand, children []*UpSessionManager, filter DownSessionFilter) {
+	kicked := make([]DownSessionStatus, 0)
+	for _, child := range children {
+		response := make(chan []DownSessionStatus, 1)
+		child.SendEvent(EventKickDownSessions{filter, response})
+		select {
+		case result := <-response:
+			kicked = append(kicked, result...)
+		case <-adminCommandTimeout():
+			e.Response <- AdminResponse{nil, AdminErrTimeout}
+			return
+		}
+	}
+	Log.Info("[admin] kick ", e.Request.Params[0], ": ", len(kicked), " miners disconnected")
+	e.Response <- AdminResponse{kicked, nil}
+}
+
+// adminStatus 收集所有子账户的连接状态，在单独的 goroutine 中运行以免阻塞事件循环
+func (manager *SessionManager) adminStatus(e EventAdminCommand, children []*UpSessionManager, draining bool) {
+	withMiners := e.Request.Method == "sessions"
+	statusList := make([]UpSessionManagerStatus, 0, len(children))
+
+	for _, child := range children {
+		response := make(chan UpSessionManagerStatus, 1)
+		child.SendEvent(EventGetUpSessionManagerStatus{withMiners, response})
+		select {
+		case status := <-response:
+			statusList = append(statusList, status)
+		case <-adminCommandTimeout():
+			e.Response <- AdminResponse{nil, AdminErrTimeout}
+			return
+		}
+	}
+
+	switch e.Request.Method {
+	case "pools", "sessions":
+		e.Response <- AdminResponse{statusList, nil}
+
+	case "stats":
+		var stats SessionManagerStats
+		stats.UptimeSeconds = uint64(time.Since(manager.startTime).Seconds())
+		stats.Shares = manager.shareStats.Snapshot()
+		stats.PoolConnections = manager.poolStats.Snapshot(time.Now())
+		stats.Draining = draining
+		stats.SubAccounts = len(statusList)
+		for _, status := range statusList {
+			stats.FakeMiners += status.FakeMinerNum
+			for _, up := range status.UpSessions {
+				if up.Ready {
+					stats.Pools++
+				}
+				stats.Miners += up.MinerNum
+			}
 		}
+		e.Response <- AdminResponse{stats, nil}
 	}
 }
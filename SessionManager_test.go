@@ -0,0 +1,754 @@
+package btcagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkGoroutineLeak 等待 goroutine 数量回落到 baseline + tolerance 以内，
+// 超时则输出所有 goroutine 的调用栈并使测试失败
+func checkGoroutineLeak(t *testing.T, baseline int, tolerance int, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > baseline+tolerance {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("goroutine leak: %d goroutines are running, baseline %d, tolerance %d:\n%s",
+				runtime.NumGoroutine(), baseline, tolerance, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startTestSessionManager 启动监听随机端口的 SessionManager，测试结束时停止
+func startTestSessionManager(t *testing.T, config *Config) (manager *SessionManager) {
+	config.AgentListenIp = "127.0.0.1"
+	config.AgentListenPort = 0
+
+	manager = NewSessionManager(config)
+	if err := manager.Start(); err != nil {
+		t.Fatalf("start failed: %s", err.Error())
+	}
+	go manager.serve(manager.tcpListener)
+	t.Cleanup(manager.Stop)
+	return
+}
+
+// dialTestMinerBTC 连接到 BTCAgent，完成订阅和认证，并等待读取到 waitMethod 通知（为空则不等待）
+func dialTestMinerBTC(t *testing.T, manager *SessionManager, workerName string, waitMethod string) (conn net.Conn) {
+	conn, err := net.Dial("tcp", manager.Addr().String())
+	if err != nil {
+		t.Errorf("connect to agent failed: %s", err.Error())
+		return nil
+	}
+	conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["` + workerName + `","x"]}` + "\n"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	authorized := false
+	for !authorized || len(waitMethod) > 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("miner %s did not receive expected messages: %v", workerName, err)
+			conn.Close()
+			return nil
+		}
+		if strings.HasPrefix(line, `{"id":2,`) {
+			authorized = true
+		}
+		if len(waitMethod) > 0 && strings.Contains(line, `"method":"`+waitMethod+`"`) {
+			waitMethod = ""
+		}
+	}
+	return
+}
+
+func TestSessionManagerStopCancelsSessions(t *testing.T) {
+	// 矿池接受连接后不再响应，矿池连接一直停留在握手阶段
+	poolConnected := make(chan bool, 16)
+	poolClosed := make(chan bool, 16)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptConnTest(conn, reader) {
+			poolConnected <- true
+			io.Copy(ioutil.Discard, reader)
+			poolClosed <- true
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 2
+	config.Advanced.PoolHandshakeTimeoutSeconds = 60
+
+	baseline := runtime.NumGoroutine()
+	manager := startTestSessionManager(t, config)
+
+	// 一台矿机认证后托管在 FakeUpSession 上，另一台只订阅不认证
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	idleMiner, err := net.Dial("tcp", manager.Addr().String())
+	if err != nil {
+		t.Fatalf("connect to agent failed: %s", err.Error())
+	}
+	defer idleMiner.Close()
+	idleMiner.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+
+	// 等待矿池连接建立
+	for i := uint8(0); i < config.Advanced.PoolConnectionNumberPerSubAccount; i++ {
+		select {
+		case <-poolConnected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("agent did not connect to the pool")
+		}
+	}
+
+	manager.Stop()
+
+	// 所有连接都应被关闭
+	for _, conn := range []net.Conn{miner, idleMiner} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		// 未读取的数据可能导致连接被重置，这也算作已关闭
+		_, err := io.Copy(ioutil.Discard, conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("miner connection is not closed: %v", err)
+		}
+	}
+	for i := uint8(0); i < config.Advanced.PoolConnectionNumberPerSubAccount; i++ {
+		select {
+		case <-poolClosed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool connection is not closed")
+		}
+	}
+
+	// 所有 goroutine 都应在截止时间前返回
+	checkGoroutineLeak(t, baseline, 0, 5*time.Second)
+}
+
+func TestSessionManagerGoroutineLeak(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.MultiUserMode = true
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 2
+
+	manager := startTestSessionManager(t, config)
+	baseline := runtime.NumGoroutine()
+
+	// 多用户模式下子账户的矿机全部断开后，该子账户的矿池连接也会关闭，
+	// 因此每一轮都会建立并断开矿机连接和矿池连接
+	const rounds = 3
+	const miners = 10
+	for round := 0; round < rounds; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < miners; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// 一半矿机等到矿池连接下发任务（已从 FakeUpSession 转到矿池连接上）才断开，
+				// 另一半认证后立即断开，此时可能还在 FakeUpSession 上或正在转移
+				waitMethod := ""
+				if i%2 == 0 {
+					waitMethod = "mining.notify"
+				}
+				conn := dialTestMinerBTC(t, manager, fmt.Sprintf("user%d.w%d", i%3, i), waitMethod)
+				if conn != nil {
+					conn.Close()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// 矿机断开约 1 秒后矿池连接才同步矿机数量，之后子账户的矿池连接关闭
+		checkGoroutineLeak(t, baseline, 0, 10*time.Second)
+	}
+}
+
+func TestSessionManagerExtranonceExhausted(t *testing.T) {
+	manager := NewSessionManager(NewConfig())
+	defer manager.cancel()
+
+	// 用很小的 sessionID 空间代替 0xffff 个矿机连接
+	var err error
+	manager.sessionIDManager, err = NewSessionIDManager(1)
+	if err != nil {
+		t.Fatalf("NewSessionIDManager failed: %s", err.Error())
+	}
+	for i := 0; i < manager.sessionIDManager.Capacity(); i++ {
+		if _, err := manager.sessionIDManager.AllocSessionID(); err != nil {
+			t.Fatalf("AllocSessionID failed: %s", err.Error())
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	output := captureLog(t, func() {
+		manager.RunDownSession(server)
+	})
+
+	// 新的矿机连接被直接关闭
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("miner connection should be closed, got %v", err)
+	}
+	if count := manager.metrics.ExtranonceExhausted.Get(); count != 1 {
+		t.Errorf("wrong btcagent_extranonce_exhausted_total: %v", count)
+	}
+	if !strings.Contains(output, "extranonce space is exhausted, all 2 session ids are in use") ||
+		!strings.Contains(output, "run another BTCAgent instance") {
+		t.Errorf("missing or wrong log: %s", output)
+	}
+}
+
+func TestSessionManagerSessionSerial(t *testing.T) {
+	config := NewConfig()
+	manager := NewSessionManager(config)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 默认不分配序号
+	if id, serial := manager.sessionLogID("miner", 1, server); serial != 0 || strings.Contains(id, "serial") {
+		t.Errorf("serial should be disabled by default: %q, %d", id, serial)
+	}
+
+	config.Advanced.MinerSessionSerial = true
+	var last uint64
+	for i := 0; i < 3; i++ {
+		down := NewDownSessionBTC(manager, server, 1)
+		if down.serial <= last || !strings.Contains(down.id, fmt.Sprintf("serial#%d ", down.serial)) {
+			t.Errorf("serial should increase monotonically: %q, %d after %d", down.id, down.serial, last)
+		}
+		last = down.serial
+	}
+
+	// 并发分配的序号也不重复
+	const n = 100
+	serials := make(chan uint64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, serial := manager.sessionLogID("passthrough", 1, server)
+			serials <- serial
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	seen := make(map[uint64]bool)
+	for serial := range serials {
+		if serial <= last || seen[serial] {
+			t.Errorf("duplicate or reused serial: %d", serial)
+		}
+		seen[serial] = true
+	}
+	if len(seen) != n {
+		t.Errorf("wrong number of serials: %d", len(seen))
+	}
+}
+
+func TestSessionManagerShutdownSubmitGrace(t *testing.T) {
+	// 矿池稍后响应 extranonce2 以 000a 结尾的 share，从不响应其他 share
+	submits := make(chan string, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.Method {
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+			case "mining.authorize":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+					`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+			case "mining.submit":
+				extraNonce2, _ := request.Params[2].(string)
+				submits <- extraNonce2
+				if strings.HasSuffix(extraNonce2, "000a") {
+					id, _ := json.Marshal(request.ID)
+					time.Sleep(200 * time.Millisecond)
+					pool.WriteLine(conn, `{"id":`+string(id)+`,"result":true,"error":null}`)
+				}
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.SkipCapabilities = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.SubmitResponseFromServer = true
+	config.Advanced.ShutdownSubmitGraceSeconds = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	conn := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","0000000a","5f5e1001","12345678"]}` + "\n" +
+		`{"id":4,"method":"mining.submit","params":["test.w1","1","0000000b","5f5e1001","12345678"]}` + "\n"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-submits:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool did not receive mining.submit")
+		}
+	}
+
+	// 退出时等待矿池的响应，到时仍未响应的 share 在本地响应为失败
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		manager.Stop()
+		close(stopped)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	responses := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		for _, id := range []string{`{"id":3,`, `{"id":4,`} {
+			if strings.HasPrefix(line, id) {
+				responses[id] = line
+			}
+		}
+	}
+	if !strings.Contains(responses[`{"id":3,`], `"result":true`) {
+		t.Errorf("response of the pool server is not relayed before exiting: %v", responses)
+	}
+	if !strings.Contains(responses[`{"id":4,`], fmt.Sprintf(`"error":[%d,`, STATUS_INTERNAL_ERROR)) {
+		t.Errorf("share without response should fail locally before exiting: %v", responses)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent did not stop after the grace period")
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("agent should wait for the grace period before exiting, stopped in %s", elapsed)
+	}
+}
+
+func TestSessionManagerDrainWaitSubmits(t *testing.T) {
+	// 矿池稍后响应 extranonce2 以 000a 结尾的 share，从不响应其他 share
+	submits := make(chan string, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.Method {
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+			case "mining.authorize":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+					`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+			case "mining.submit":
+				extraNonce2, _ := request.Params[2].(string)
+				submits <- extraNonce2
+				if strings.HasSuffix(extraNonce2, "000a") {
+					id, _ := json.Marshal(request.ID)
+					time.Sleep(200 * time.Millisecond)
+					pool.WriteLine(conn, `{"id":`+string(id)+`,"result":true,"error":null}`)
+				}
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.SkipCapabilities = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.SubmitResponseFromServer = true
+	config.Advanced.ShutdownSubmitGraceSeconds = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	conn := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readResponse := func(prefix string) string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("miner did not receive the response %s: %v", prefix, err)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		}
+	}
+
+	conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","0000000a","5f5e1001","12345678"]}` + "\n"))
+	select {
+	case <-submits:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pool did not receive mining.submit")
+	}
+
+	// drain 后暂停提交新的 share，已提交的 share 仍转发矿池的响应
+	if response := manager.AdminCommand(&AdminRequest{Method: "drain"}); response.Error != nil {
+		t.Fatalf("drain failed: %v", response.Error)
+	}
+	if !manager.SubmitsStopped() {
+		t.Fatalf("submits should be paused after drain")
+	}
+	conn.Write([]byte(`{"id":4,"method":"mining.submit","params":["test.w1","1","0000000b","5f5e1001","12345678"]}` + "\n"))
+	if line := readResponse(`{"id":4,`); !strings.Contains(line, fmt.Sprintf(`"error":[%d,`, STATUS_INTERNAL_ERROR)) {
+		t.Errorf("share after drain should fail locally: %s", line)
+	}
+	if line := readResponse(`{"id":3,`); !strings.Contains(line, `"result":true`) {
+		t.Errorf("response of the pool server is not relayed after drain: %s", line)
+	}
+	select {
+	case extraNonce2 := <-submits:
+		t.Errorf("share %s is submitted to the pool server after drain", extraNonce2)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 已提交的 share 都得到响应后恢复提交，保留的矿机照常挖矿，不需要 undrain
+	for deadline := time.Now().Add(5 * time.Second); manager.SubmitsStopped(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("submits are not resumed after responses of submitted shares are received")
+		}
+	}
+	conn.Write([]byte(`{"id":5,"method":"mining.submit","params":["test.w1","1","0000000a","5f5e1001","12345678"]}` + "\n"))
+	select {
+	case <-submits:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pool did not receive mining.submit after the wait")
+	}
+	if line := readResponse(`{"id":5,`); !strings.Contains(line, `"result":true`) {
+		t.Errorf("response of the pool server is not relayed after the wait: %s", line)
+	}
+}
+
+func TestSessionManagerExitSummary(t *testing.T) {
+	pool := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+	miner.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","00000000","5f5e1000","00000000"]}` + "\n"))
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(miner)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the response of submit: %v", err)
+		}
+		if strings.HasPrefix(line, `{"id":3,`) {
+			break
+		}
+	}
+
+	// 摘要包含运行时间、连接数、重连次数和各子账户的 share 数。
+	// 会话仍在打印日志，不能通过 captureLog 获取，直接检查摘要的日志行
+	lines := strings.Join(manager.ExitSummary().Lines(), "\n")
+	expected := "uptime=0s sessions=1 reconnects=0 sub_accounts=1\n" +
+		// 单用户模式下矿机的子账户名为空
+		"sub_account= forwarded=1 accepted=1 rejected=0"
+	if lines != expected {
+		t.Errorf("wrong exit summary, expected:\n%s\ngot:\n%s", expected, lines)
+	}
+}
+
+func TestExitSummaryPreviousRuns(t *testing.T) {
+	summary := ExitSummary{
+		Uptime:       90 * time.Second,
+		Reconnects:   2,
+		SubAccounts:  map[string]SubAccountShareStats{"bob": {Accepted: 3, Forwarded: 3}},
+		PreviousRuns: map[string]SubAccountShareStats{"bob": {Accepted: 10, Rejected: 1, Forwarded: 11}, "alice": {Accepted: 5, Forwarded: 5}},
+	}
+	lines := strings.Join(summary.Lines(), "\n")
+	expected := "uptime=1m30s sessions=0 reconnects=2 sub_accounts=1\n" +
+		"sub_account=bob forwarded=3 accepted=3 rejected=0\n" +
+		"previous_runs sub_account=alice forwarded=5 accepted=5 rejected=0\n" +
+		"previous_runs sub_account=bob forwarded=11 accepted=10 rejected=1"
+	if lines != expected {
+		t.Errorf("wrong exit summary, expected:\n%s\ngot:\n%s", expected, lines)
+	}
+}
+
+func TestSessionManagerUserAgentRoutes(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.UserAgentRoutes = []UserAgentRoute{{Name: "old-firmware", Pattern: `^cgminer/4\.9\.`, DisableVersionRolling: true}}
+	if err := config.initUserAgentRoutes(); err != nil {
+		t.Fatalf("init user_agent_routes failed: %v", err)
+	}
+	if route := config.UserAgentRoute("CGMiner/4.9.2"); route == nil || route.Name != "old-firmware" {
+		t.Errorf("user agent should match the route case-insensitively: %v", route)
+	}
+	if route := config.UserAgentRoute("bmminer/2.0.0"); route != nil {
+		t.Errorf("user agent should use the default route: %v", route)
+	}
+	manager := startTestSessionManager(t, config)
+
+	// 连接并滚动版本位，等待收到任务（waitEmptyMask 为 true 时等待空的版本掩码），返回是否收到了空的版本掩码
+	dial := func(userAgent string, waitEmptyMask bool) (emptyMask bool) {
+		t.Helper()
+		conn, err := net.Dial("tcp", manager.Addr().String())
+		if err != nil {
+			t.Fatalf("connect to agent failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"1fffe000","version-rolling.min-bit-count":2}]}` + "\n" +
+			`{"id":2,"method":"mining.subscribe","params":["` + userAgent + `"]}` + "\n" +
+			`{"id":3,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("miner %s did not receive expected messages: %v", userAgent, err)
+			}
+			if strings.Contains(line, `"mining.set_version_mask","params":["00000000"]`) {
+				emptyMask = true
+			}
+			// 矿池连接就绪之前矿机先由 FakeUpSession 托管，收到虚假的任务
+			if (emptyMask || !waitEmptyMask) && strings.Contains(line, `"mining.notify"`) {
+				return
+			}
+		}
+	}
+	if dial("bmminer/2.0.0", false) {
+		t.Errorf("miner of the default route should keep version rolling")
+	}
+	dial("cgminer/4.9.2", true)
+
+	// 两台矿机分别使用默认的和按规则建立的矿池连接
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		response := manager.AdminCommand(&AdminRequest{Method: "pools"})
+		statusList, _ := response.Result.([]UpSessionManagerStatus)
+		miners := make(map[string]int)
+		for _, status := range statusList {
+			for _, up := range status.UpSessions {
+				miners[status.Route] += up.MinerNum
+			}
+		}
+		if len(statusList) == 2 && miners[""] == 1 && miners["old-firmware"] == 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("miners are not routed by user agent: %+v", statusList)
+		}
+	}
+}
+
+// temporaryAcceptError 模拟 EMFILE 等临时错误
+type temporaryAcceptError struct{}
+
+func (temporaryAcceptError) Error() string   { return "accept: too many open files" }
+func (temporaryAcceptError) Timeout() bool   { return false }
+func (temporaryAcceptError) Temporary() bool { return true }
+
+// flakyListener 前 failures 次 Accept 交替返回临时错误和其他错误，之后返回一个连接，再之后返回监听已关闭的错误
+type flakyListener struct {
+	failures int
+	accepts  []time.Time
+}
+
+func (listener *flakyListener) Accept() (net.Conn, error) {
+	listener.accepts = append(listener.accepts, time.Now())
+	switch n := len(listener.accepts); {
+	case n <= listener.failures && n%2 == 0:
+		return nil, errors.New("accept: software caused connection abort")
+	case n <= listener.failures:
+		return nil, temporaryAcceptError{}
+	case n == listener.failures+1:
+		conn, _ := net.Pipe()
+		return conn, nil
+	default:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *flakyListener) Close() error   { return nil }
+func (listener *flakyListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestAcceptLoopErrors(t *testing.T) {
+	listener := &flakyListener{failures: 4}
+	handled := make(chan net.Conn, 1)
+	done := make(chan struct{})
+	go func() {
+		acceptLoop(context.Background(), listener, "miner", func(conn net.Conn) { handled <- conn })
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop does not stop after the listener is closed")
+	}
+	select {
+	case conn := <-handled:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop does not recover after accept errors")
+	}
+
+	// 每次出错后等待，等待时间加倍：5ms、10ms、20ms、40ms，之后正常接受连接
+	if len(listener.accepts) != listener.failures+2 {
+		t.Fatalf("accept loop should stop at the fatal error, got %d accepts", len(listener.accepts))
+	}
+	for i := 1; i <= listener.failures; i++ {
+		expected := (ListenerAcceptRetryMinMilliseconds << (i - 1)) * time.Millisecond
+		if waited := listener.accepts[i].Sub(listener.accepts[i-1]); waited < expected {
+			t.Errorf("accept %d retried after %v, expected at least %v", i, waited, expected)
+		}
+	}
+	if waited := listener.accepts[listener.failures+1].Sub(listener.accepts[listener.failures]); waited > 100*time.Millisecond {
+		t.Errorf("accept loop keeps backing off after a successful accept: %v", waited)
+	}
+}
+
+func TestSetListenBacklog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("listen backlog cannot be changed on Windows")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := SetListenBacklog(listener, 16); err != nil {
+		t.Fatalf("failed to set listen backlog: %v", err)
+	}
+
+	// 修改后仍然可以接受连接
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept after setting the backlog failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSessionManagerEvictIdleMiner(t *testing.T) {
+	config := NewConfig()
+	config.sessionFactory = new(SessionFactoryBTC)
+	config.Advanced.MinerCapacityEviction.Policy = MinerCapacityEvictIdle
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+
+	// 只有 2 个会话ID
+	var err error
+	manager.sessionIDManager, err = NewSessionIDManager(1)
+	if err != nil {
+		t.Fatalf("NewSessionIDManager failed: %s", err.Error())
+	}
+
+	// 两台矿机占满会话ID：先连接的矿机空闲了 1 小时；更早连接的矿机刚刚提交了被接受的 share
+	connect := func() (client net.Conn, session *minerCapacitySession) {
+		client, server := net.Pipe()
+		go manager.RunDownSession(server)
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			manager.minerCapacity.lock.Lock()
+			for _, s := range manager.minerCapacity.sessions {
+				if s.conn == server {
+					session = s
+				}
+			}
+			manager.minerCapacity.lock.Unlock()
+			if session != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("miner connection is not registered")
+		return
+	}
+	idle, idleSession := connect()
+	defer idle.Close()
+	active, activeSession := connect()
+	defer active.Close()
+	manager.minerCapacity.lock.Lock()
+	idleSession.connected = time.Now().Add(-time.Hour)
+	activeSession.connected = time.Now().Add(-2 * time.Hour)
+	manager.minerCapacity.lock.Unlock()
+	activeSession.hashrate.AddAccepted(1)
+
+	// 新的矿机连接时踢掉空闲的矿机
+	client, server := net.Pipe()
+	defer client.Close()
+	go manager.RunDownSession(server)
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, idle); err != nil {
+		t.Errorf("idle miner should be evicted, got %v", err)
+	}
+
+	// 新的矿机得到会话ID，可以订阅
+	go client.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, `{"id":1,"result":[`) {
+		t.Errorf("new miner is not served: %q, %v", line, err)
+	}
+
+	if count := manager.metrics.MinersEvicted.Get("reason", "idle"); count != 1 {
+		t.Errorf("wrong btcagent_miners_evicted_total: %v", count)
+	}
+
+	// 活跃的矿机没有被踢掉
+	manager.minerCapacity.lock.Lock()
+	remaining := len(manager.minerCapacity.sessions)
+	manager.minerCapacity.lock.Unlock()
+	if remaining != 2 {
+		t.Errorf("expected the active and the new miner to remain, got %d", remaining)
+	}
+}
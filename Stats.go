@@ -0,0 +1,170 @@
+package btcagent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SubAccountShareStats 子账户的 share 统计
+type SubAccountShareStats struct {
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	// 接受的 share 的难度之和，用于估算算力
+	AcceptedDifficulty float64 `json:"accepted_difficulty"`
+	// 转发给矿池的 share 数
+	Forwarded uint64 `json:"forwarded"`
+}
+
+// ShareStatsSnapshot share 统计的快照，也是持久化文件的格式
+type ShareStatsSnapshot struct {
+	UptimeSeconds uint64                          `json:"uptime_seconds"`
+	SavedAt       int64                           `json:"saved_at"`
+	SubAccounts   map[string]SubAccountShareStats `json:"sub_accounts"`
+}
+
+// ShareStats 按子账户统计的 share 数，可以在多个 goroutine 中使用
+type ShareStats struct {
+	lock        sync.Mutex
+	startTime   time.Time     // 本次运行的启动时间
+	prevUptime  time.Duration // 之前运行的累计时间（从文件载入）
+	subAccounts map[string]*SubAccountShareStats
+	previous    map[string]SubAccountShareStats // 之前运行的统计（从文件载入），已包含在 subAccounts 中
+}
+
+func NewShareStats() (stats *ShareStats) {
+	stats = new(ShareStats)
+	stats.startTime = time.Now()
+	stats.subAccounts = make(map[string]*SubAccountShareStats)
+	stats.previous = make(map[string]SubAccountShareStats)
+	return
+}
+
+// AddShare 记录一个 share 的提交结果，difficulty 为 share 的难度（未知时为 0）
+func (stats *ShareStats) AddShare(subAccount string, accepted bool, difficulty uint64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	account, ok := stats.subAccounts[subAccount]
+	if !ok {
+		account = new(SubAccountShareStats)
+		stats.subAccounts[subAccount] = account
+	}
+	if accepted {
+		account.Accepted++
+		account.AcceptedDifficulty += float64(difficulty)
+	} else {
+		account.Rejected++
+	}
+}
+
+// AddForwarded 记录一个转发给矿池的 share
+func (stats *ShareStats) AddForwarded(subAccount string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	account, ok := stats.subAccounts[subAccount]
+	if !ok {
+		account = new(SubAccountShareStats)
+		stats.subAccounts[subAccount] = account
+	}
+	account.Forwarded++
+}
+
+// Snapshot 获取当前统计数据的副本
+func (stats *ShareStats) Snapshot() (snapshot ShareStatsSnapshot) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	snapshot.UptimeSeconds = uint64((stats.prevUptime + time.Since(stats.startTime)).Seconds())
+	snapshot.SubAccounts = make(map[string]SubAccountShareStats, len(stats.subAccounts))
+	for name, account := range stats.subAccounts {
+		snapshot.SubAccounts[name] = *account
+	}
+	return
+}
+
+// SaveToFile 保存统计数据。先写入临时文件再重命名，以免进程意外退出时留下不完整的文件。
+func (stats *ShareStats) SaveToFile(file string) (err error) {
+	snapshot := stats.Snapshot()
+	snapshot.SavedAt = time.Now().Unix()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name()) // 重命名成功后该调用无效
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp.Name(), file)
+	return
+}
+
+// LoadFromFile 载入之前保存的统计数据，之后的统计会在其基础上累加。
+// 载入失败时当前数据不受影响。
+func (stats *ShareStats) LoadFromFile(file string) (err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	var snapshot ShareStatsSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return
+	}
+
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.prevUptime = time.Duration(snapshot.UptimeSeconds) * time.Second
+	for name, saved := range snapshot.SubAccounts {
+		account, ok := stats.subAccounts[name]
+		if !ok {
+			account = new(SubAccountShareStats)
+			stats.subAccounts[name] = account
+		}
+		account.add(saved)
+		previous := stats.previous[name]
+		previous.add(saved)
+		stats.previous[name] = previous
+	}
+	return
+}
+
+// Previous 获取从文件载入的之前运行的统计数据，未载入时为空
+func (stats *ShareStats) Previous() map[string]SubAccountShareStats {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	previous := make(map[string]SubAccountShareStats, len(stats.previous))
+	for name, account := range stats.previous {
+		previous[name] = account
+	}
+	return previous
+}
+
+func (account *SubAccountShareStats) add(other SubAccountShareStats) {
+	account.Forwarded += other.Forwarded
+	account.Accepted += other.Accepted
+	account.Rejected += other.Rejected
+	account.AcceptedDifficulty += other.AcceptedDifficulty
+}
@@ -0,0 +1,151 @@
+package btcagent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// StatsReportAccount 子账户在一个报告周期内的 share 统计
+type StatsReportAccount struct {
+	Accepted           uint64  `json:"accepted"`
+	Rejected           uint64  `json:"rejected"`
+	AcceptedDifficulty float64 `json:"accepted_difficulty"`
+	Hashrate           float64 `json:"hashrate"` // 按接受的 share 的难度估算的算力（H/s）
+}
+
+// StatsReportMessage 发送给监控服务的报告，每次一行 JSON
+type StatsReportMessage struct {
+	Agent           string                        `json:"agent"` // agent_type
+	Time            int64                         `json:"time"`
+	IntervalSeconds float64                       `json:"interval_seconds"` // 与上一次成功报告的时间间隔
+	SubAccounts     map[string]StatsReportAccount `json:"sub_accounts"`
+}
+
+// StatsReporter 定期将各子账户在报告周期内新增的 share 统计和估算的算力发送给 stats_report.server。
+//
+// 使用单独的 goroutine 和连接，只读取 ShareStats，监控服务无响应或断开不会影响 share 的提交。
+// 连接失败或断开后每隔 reconnect_interval_seconds 重连，未能发送的周期合并到下一次报告中。
+type StatsReporter struct {
+	config *Config
+	stats  *ShareStats
+
+	conn     net.Conn
+	last     ShareStatsSnapshot // 上一次成功报告时的统计
+	lastTime time.Time
+}
+
+func NewStatsReporter(config *Config, stats *ShareStats) (reporter *StatsReporter) {
+	reporter = new(StatsReporter)
+	reporter.config = config
+	reporter.stats = stats
+	return
+}
+
+// Run 定期发送报告，直到 ctx 结束
+func (reporter *StatsReporter) Run(ctx context.Context) {
+	conf := &reporter.config.StatsReport
+	reporter.last = reporter.stats.Snapshot()
+	reporter.lastTime = time.Now()
+
+	ticker := time.NewTicker(conf.IntervalSeconds.Get())
+	defer ticker.Stop()
+	defer func() {
+		if reporter.conn != nil {
+			reporter.conn.Close()
+		}
+	}()
+
+	for {
+		if reporter.conn == nil && !reporter.connect(ctx) {
+			select {
+			case <-time.After(conf.ReconnectIntervalSeconds.Get()):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case now := <-ticker.C:
+			reporter.report(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (reporter *StatsReporter) connect(ctx context.Context) bool {
+	server := reporter.config.StatsReport.Server
+	dialer := net.Dialer{Timeout: StatsReportTimeoutSeconds.Get()}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		if ctx.Err() == nil {
+			Log.Warning("[stats report] failed to connect to ", server, ", retry in ", reporter.config.StatsReport.ReconnectIntervalSeconds, " seconds: ", err)
+		}
+		return false
+	}
+	Log.Info("[stats report] connected to ", server)
+
+	// 监控服务发送的内容直接丢弃，连接断开后关闭连接，让下一次报告失败并重连
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+	reporter.conn = conn
+	return true
+}
+
+// report 发送自上一次成功报告以来的统计，失败时断开连接
+func (reporter *StatsReporter) report(now time.Time) {
+	snapshot := reporter.stats.Snapshot()
+	bytes, err := json.Marshal(reporter.message(snapshot, now))
+	if err != nil {
+		Log.Error("[stats report] failed to encode report: ", err)
+		return
+	}
+	bytes = append(bytes, '\n')
+
+	reporter.conn.SetWriteDeadline(now.Add(StatsReportTimeoutSeconds.Get()))
+	_, err = reporter.conn.Write(bytes)
+	if err != nil {
+		Log.Warning("[stats report] failed to send report to ", reporter.config.StatsReport.Server, ", reconnect in ",
+			reporter.config.StatsReport.ReconnectIntervalSeconds, " seconds: ", err)
+		reporter.conn.Close()
+		reporter.conn = nil
+		return
+	}
+	reporter.last = snapshot
+	reporter.lastTime = now
+}
+
+// message 计算 snapshot 与上一次成功报告之间的增量
+func (reporter *StatsReporter) message(snapshot ShareStatsSnapshot, now time.Time) (message StatsReportMessage) {
+	message.Agent = reporter.config.AgentType
+	message.Time = now.Unix()
+	interval := now.Sub(reporter.lastTime).Seconds()
+	message.IntervalSeconds = interval
+	message.SubAccounts = make(map[string]StatsReportAccount, len(snapshot.SubAccounts))
+
+	for name, current := range snapshot.SubAccounts {
+		last := reporter.last.SubAccounts[name]
+		account := StatsReportAccount{
+			Accepted:           current.Accepted - last.Accepted,
+			Rejected:           current.Rejected - last.Rejected,
+			AcceptedDifficulty: current.AcceptedDifficulty - last.AcceptedDifficulty,
+		}
+		if interval > 0 {
+			account.Hashrate = account.AcceptedDifficulty * reporter.hashesPerDifficulty() / interval
+		}
+		message.SubAccounts[name] = account
+	}
+	return
+}
+
+// hashesPerDifficulty 难度为 1 的 share 平均需要计算的哈希数
+func (reporter *StatsReporter) hashesPerDifficulty() float64 {
+	return hashesPerDifficulty(reporter.config.AgentType)
+}
@@ -0,0 +1,107 @@
+package btcagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsReporter(t *testing.T) {
+	// 模拟监控服务，收到的每个连接都交给测试处理
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	config := NewConfig()
+	config.AgentType = "btc"
+	config.StatsReport.Enable = true
+	config.StatsReport.Server = listener.Addr().String()
+	config.StatsReport.IntervalSeconds = 1
+	config.StatsReport.ReconnectIntervalSeconds = 1
+
+	stats := NewShareStats()
+	stats.AddShare("alice", true, 1024)
+	reporter := NewStatsReporter(config, stats)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reporter.Run(ctx)
+
+	accept := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		select {
+		case conn := <-conns:
+			return conn, bufio.NewReader(conn)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connection from stats reporter")
+			return nil, nil
+		}
+	}
+	readReport := func(conn net.Conn, reader *bufio.Reader) (message StatsReportMessage) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("failed to read report: %v", err)
+		}
+		if err := json.Unmarshal(line, &message); err != nil {
+			t.Fatalf("wrong report %s: %v", line, err)
+		}
+		return
+	}
+
+	conn, reader := accept()
+	// 启动前已有的 share 不计入报告
+	stats.AddShare("alice", true, 2048)
+	stats.AddShare("alice", false, 2048)
+	stats.AddShare("bob", true, 4096)
+	message := readReport(conn, reader)
+	if message.Agent != "btc" || message.IntervalSeconds <= 0 {
+		t.Errorf("wrong report: %+v", message)
+	}
+	alice := message.SubAccounts["alice"]
+	if alice.Accepted != 1 || alice.Rejected != 1 || alice.AcceptedDifficulty != 2048 {
+		t.Errorf("wrong report of alice: %+v", alice)
+	}
+	expected := 2048 * 4294967296 / message.IntervalSeconds
+	if alice.Hashrate < expected*0.999 || alice.Hashrate > expected*1.001 {
+		t.Errorf("wrong hashrate of alice: %v, expected %v", alice.Hashrate, expected)
+	}
+	if bob := message.SubAccounts["bob"]; bob.Accepted != 1 || bob.AcceptedDifficulty != 4096 {
+		t.Errorf("wrong report of bob: %+v", bob)
+	}
+
+	// 每次只报告新增的 share
+	stats.AddShare("bob", true, 4096)
+	message = readReport(conn, reader)
+	if alice := message.SubAccounts["alice"]; alice.Accepted != 0 || alice.Hashrate != 0 {
+		t.Errorf("wrong report of alice: %+v", alice)
+	}
+	if bob := message.SubAccounts["bob"]; bob.Accepted != 1 || bob.AcceptedDifficulty != 4096 {
+		t.Errorf("wrong report of bob: %+v", bob)
+	}
+
+	// 监控服务断开后重连，断开期间的 share 在重连后报告
+	conn.Close()
+	stats.AddShare("bob", true, 4096)
+	conn, reader = accept()
+	defer conn.Close()
+	message = readReport(conn, reader)
+	if bob := message.SubAccounts["bob"]; bob.Accepted != 1 || bob.AcceptedDifficulty != 4096 {
+		t.Errorf("shares should be reported after reconnecting: %+v", bob)
+	}
+}
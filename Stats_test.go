@@ -0,0 +1,93 @@
+package btcagent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShareStatsSaveAndLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stats.json")
+
+	stats := NewShareStats()
+	stats.prevUptime = 100 * time.Second
+	stats.AddShare("alice", true, 1024)
+	stats.AddShare("alice", true, 1024)
+	stats.AddShare("alice", false, 1024)
+	stats.AddShare("bob", false, 0)
+	stats.AddForwarded("alice")
+	stats.AddForwarded("alice")
+
+	err := stats.SaveToFile(file)
+	if err != nil {
+		t.Fatalf("SaveToFile failed: %s", err.Error())
+	}
+	matches, _ := filepath.Glob(file + ".tmp*")
+	if len(matches) > 0 {
+		t.Errorf("temp files are not removed: %v", matches)
+	}
+
+	loaded := NewShareStats()
+	loaded.AddShare("alice", true, 1024)
+	err = loaded.LoadFromFile(file)
+	if err != nil {
+		t.Fatalf("LoadFromFile failed: %s", err.Error())
+	}
+
+	snapshot := loaded.Snapshot()
+	if snapshot.UptimeSeconds < 100 {
+		t.Errorf("uptime is not restored: %d", snapshot.UptimeSeconds)
+	}
+	if snapshot.SubAccounts["alice"] != (SubAccountShareStats{3, 1, 3072, 2}) {
+		t.Errorf("wrong stats of alice: %v", snapshot.SubAccounts["alice"])
+	}
+	if snapshot.SubAccounts["bob"] != (SubAccountShareStats{0, 1, 0, 0}) {
+		t.Errorf("wrong stats of bob: %v", snapshot.SubAccounts["bob"])
+	}
+	// 之前运行的统计单独保留
+	previous := loaded.Previous()
+	if len(previous) != 2 || previous["alice"] != (SubAccountShareStats{2, 1, 2048, 2}) || previous["bob"] != (SubAccountShareStats{0, 1, 0, 0}) {
+		t.Errorf("wrong stats of previous runs: %v", previous)
+	}
+	if len(NewShareStats().Previous()) != 0 {
+		t.Errorf("stats of previous runs should be empty without loading")
+	}
+}
+
+func TestShareStatsLoadCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "stats.json")
+
+	stats := NewShareStats()
+	stats.AddShare("alice", true, 0)
+
+	err := stats.LoadFromFile(filepath.Join(dir, "missing.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file should return a not-exist error: %v", err)
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"uptime_seconds":100,"sub_accounts":{"alice":`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err.Error())
+	}
+	err = stats.LoadFromFile(file)
+	if err == nil {
+		t.Errorf("corrupt file should return an error")
+	}
+
+	snapshot := stats.Snapshot()
+	if snapshot.UptimeSeconds >= 100 || snapshot.SubAccounts["alice"] != (SubAccountShareStats{1, 0, 0, 0}) {
+		t.Errorf("stats changed after loading a corrupt file: %v", snapshot)
+	}
+
+	// 保存时覆盖损坏的文件
+	err = stats.SaveToFile(file)
+	if err == nil {
+		err = NewShareStats().LoadFromFile(file)
+	}
+	if err != nil {
+		t.Errorf("failed to replace the corrupt file: %s", err.Error())
+	}
+}
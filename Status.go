@@ -0,0 +1,107 @@
+package btcagent
+
+import (
+	"net"
+	"strconv"
+)
+
+// DownSessionStatus 矿机连接的状态（用于管理命令）
+type DownSessionStatus struct {
+	SessionID   uint16 `json:"session_id"`
+	Serial      uint64 `json:"serial,omitempty"` // 调试用的连接序号，只在启用 miner_session_serial 时输出
+	FullName    string `json:"full_name"`
+	ClientAgent string `json:"client_agent"`
+	RemoteAddr  string `json:"remote_addr"`
+
+	// 矿机最后一次声明的算力（H/s），未声明时不输出
+	DeclaredHashrate float64 `json:"declared_hashrate,omitempty"`
+	// 按认证以来接受的 share 的难度估算的平均算力（H/s）
+	EstimatedHashrate float64 `json:"estimated_hashrate"`
+
+	// 同一连接上认证的所有矿工
+	Workers []DownSessionWorker `json:"workers,omitempty"`
+}
+
+// DownSessionFilter 按会话 ID 或 IP 选择矿机连接（用于管理命令 kick）
+type DownSessionFilter struct {
+	SessionID int    // 小于 0 时不按会话 ID 选择
+	IP        net.IP // 为 nil 时不按 IP 选择
+}
+
+// ParseDownSessionFilter 解析会话 ID（十进制）或 IP 地址
+func ParseDownSessionFilter(param string) (filter DownSessionFilter, ok bool) {
+	filter.SessionID = -1
+	if sessionID, err := strconv.Atoi(param); err == nil {
+		filter.SessionID = sessionID
+		return filter, sessionID >= 0 && sessionID <= 0xffff
+	}
+	filter.IP = net.ParseIP(param)
+	return filter, filter.IP != nil
+}
+
+// Match 判断矿机连接是否符合条件，RemoteAddr 中的端口不参与比较
+func (filter DownSessionFilter) Match(status DownSessionStatus) bool {
+	if filter.SessionID >= 0 {
+		return int(status.SessionID) == filter.SessionID
+	}
+	host, _, err := net.SplitHostPort(status.RemoteAddr)
+	if err != nil {
+		host = status.RemoteAddr
+	}
+	return filter.IP != nil && filter.IP.Equal(net.ParseIP(host))
+}
+
+// UpSessionStatus 矿池连接的状态（用于管理命令）
+type UpSessionStatus struct {
+	Slot          int                 `json:"slot"`
+	Ready         bool                `json:"ready"`
+	Draining      bool                `json:"draining,omitempty"`   // 连接的矿池已从矿池列表中删除，等待替代的连接
+	WarmingUp     bool                `json:"warming_up,omitempty"` // 等待矿池的第一个任务，新的矿机暂不分配给该连接
+	MinerNum      int                 `json:"miner_num"`
+	Pool          string              `json:"pool,omitempty"`
+	SubAccount    string              `json:"sub_account,omitempty"`
+	Stat          string              `json:"stat,omitempty"`
+	SessionID     uint32              `json:"session_id,omitempty"`
+	UptimeSeconds uint64              `json:"uptime_seconds,omitempty"` // 当前连接认证成功后持续的时间
+	ExtraNonce    *ExtraNonceStatus   `json:"extranonce,omitempty"`     // extranonce 的分配方式，只有 BTC 有
+	Miners        []DownSessionStatus `json:"miners,omitempty"`
+}
+
+// ExtraNonceStatus 矿池的 extranonce2 在会话ID和矿机的 extranonce2 之间的划分，以及会话ID的用量（用于管理命令）。
+//
+// 会话ID由所有矿池连接共用，Sessions 和 MaxSessions 是整个代理的数量。
+// 已分配的会话ID超过 session_capacity_warning_percent 时 CapacityWarning 为 true。
+type ExtraNonceStatus struct {
+	PoolExtraNonce1      string `json:"pool_extranonce1"`
+	PoolExtraNonce2Size  int    `json:"pool_extranonce2_size"`
+	SessionIDSize        int    `json:"session_id_size"` // 矿池的 extranonce2 中留给会话ID（矿机的 extranonce1）的字节数
+	SessionIDBits        int    `json:"session_id_bits"` // 其中会话ID实际使用的位数
+	MinerExtraNonce2Size int    `json:"miner_extranonce2_size"`
+	Sessions             int    `json:"sessions"`
+	MaxSessions          int    `json:"max_sessions"`
+	CapacityWarning      bool   `json:"capacity_warning"`
+}
+
+// UpSessionManagerStatus 子账户的矿池连接状态（用于管理命令）
+type UpSessionManagerStatus struct {
+	SubAccount   string            `json:"sub_account"`
+	Route        string            `json:"route,omitempty"` // 按 user_agent_routes 建立的矿池连接的规则名称
+	FakeMinerNum int               `json:"fake_miner_num"`
+	UpSessions   []UpSessionStatus `json:"pools"`
+	// 矿池地址 -> 连接到该矿池的已就绪的连接数
+	ActiveConnections map[string]int `json:"active_connections"`
+}
+
+// SessionManagerStats 代理的连接统计（用于管理命令）
+type SessionManagerStats struct {
+	UptimeSeconds uint64 `json:"uptime_seconds"`
+	Draining      bool   `json:"draining"`
+	SubAccounts   int    `json:"sub_accounts"`
+	Pools         int    `json:"pools"`
+	Miners        int    `json:"miners"`
+	FakeMiners    int    `json:"fake_miners"`
+
+	Shares ShareStatsSnapshot `json:"shares"`
+	// 按矿池统计的重连次数和连接时长
+	PoolConnections []PoolConnectionStats `json:"pool_connections"`
+}
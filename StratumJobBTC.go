@@ -1,16 +1,22 @@
-package main
+package btcagent
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
+
+	"github.com/holiman/uint256"
 )
 
 type StratumJobBTC struct {
 	JSONRPCRequest
 }
 
-func NewStratumJobBTC(json *JSONRPCLineBTC, sessionID uint32) (job *StratumJobBTC, err error) {
+// NewStratumJobBTC 由矿池的任务创建发给矿机的任务，矿池分配的 extraNonce1（hex）加在 coinbase1 之后
+func NewStratumJobBTC(json *JSONRPCLineBTC, extraNonce1 string) (job *StratumJobBTC, err error) {
 	/*
 		Fields in order:
 			[0] Job ID. This is included when miners submit a results so work can be matched with proper transactions.
@@ -39,7 +45,7 @@ func NewStratumJobBTC(json *JSONRPCLineBTC, sessionID uint32) (job *StratumJobBT
 		return
 	}
 
-	job.Params[2] = coinbase1 + Uint32ToHex(sessionID)
+	job.Params[2] = coinbase1 + extraNonce1
 
 	return
 }
@@ -52,6 +58,114 @@ func (job *StratumJobBTC) ToNotifyLine(firstJob bool) (bytes []byte, err error)
 	return job.ToJSONBytesLine()
 }
 
+// IsClean 矿机是否应立即放弃当前任务（clean_jobs）
+func (job *StratumJobBTC) IsClean() bool {
+	clean, _ := job.Params[8].(bool)
+	return clean
+}
+
+// ShareHash 计算矿机提交的 share 的区块头哈希（按大端字节序解释为数值）。
+// extraNonce2 为提交给矿池的 extranonce2（hex），versionBits 为矿机滚动的版本位（0 表示未滚动），
+// versionMask 为矿池允许滚动的版本位。
+func (job *StratumJobBTC) ShareHash(extraNonce2 string, nTime uint32, nonce uint32, versionBits uint32, versionMask uint32) (hash uint256.Int, err error) {
+	hexField := func(index int, name string) (bin []byte) {
+		if err != nil {
+			return
+		}
+		str, ok := job.Params[index].(string)
+		if !ok {
+			err = errors.New("wrong job format, " + name + " is not a string")
+			return
+		}
+		bin, err = hex.DecodeString(str)
+		if err != nil {
+			err = fmt.Errorf("wrong job format, %s is not a hex string: %w", name, err)
+		}
+		return
+	}
+	uint32Field := func(index int, name string) uint32 {
+		if err != nil {
+			return 0
+		}
+		str, _ := job.Params[index].(string)
+		num, convErr := strconv.ParseUint(str, 16, 32)
+		if convErr != nil {
+			err = fmt.Errorf("wrong job format, %s is not a 32-bit hex number: %w", name, convErr)
+		}
+		return uint32(num)
+	}
+
+	prevHash := hexField(1, "previous block hash")
+	coinbase1 := hexField(2, "coinbase1")
+	coinbase2 := hexField(3, "coinbase2")
+	version := uint32Field(5, "version")
+	nBits := uint32Field(6, "nBits")
+	if err != nil {
+		return
+	}
+	if len(prevHash) != 32 {
+		err = fmt.Errorf("wrong job format, previous block hash is %d bytes", len(prevHash))
+		return
+	}
+	extraNonce2Bin, err := hex.DecodeString(extraNonce2)
+	if err != nil {
+		return
+	}
+	branches, ok := job.Params[4].([]interface{})
+	if !ok {
+		err = errors.New("wrong job format, merkle branches is not an array")
+		return
+	}
+
+	coinbase := make([]byte, 0, len(coinbase1)+len(extraNonce2Bin)+len(coinbase2))
+	coinbase = append(append(append(coinbase, coinbase1...), extraNonce2Bin...), coinbase2...)
+	merkleRoot := DoubleSHA256(coinbase)
+	for _, branch := range branches {
+		str, _ := branch.(string)
+		bin, decodeErr := hex.DecodeString(str)
+		if decodeErr != nil || len(bin) != 32 {
+			err = fmt.Errorf("wrong job format, illegal merkle branch %v", branch)
+			return
+		}
+		merkleRoot = DoubleSHA256(append(merkleRoot, bin...))
+	}
+
+	if versionBits != 0 {
+		version = version&^versionMask | versionBits&versionMask
+	}
+
+	// 区块头中的整数为小端字节序，stratum 中的 prevhash 每 4 字节颠倒了字节序
+	header := make([]byte, 80)
+	binary.LittleEndian.PutUint32(header[0:], version)
+	for i := 0; i < 32; i += 4 {
+		binary.LittleEndian.PutUint32(header[4+i:], binary.BigEndian.Uint32(prevHash[i:]))
+	}
+	copy(header[36:], merkleRoot)
+	binary.LittleEndian.PutUint32(header[68:], nTime)
+	binary.LittleEndian.PutUint32(header[72:], nBits)
+	binary.LittleEndian.PutUint32(header[76:], nonce)
+
+	headerHash := DoubleSHA256(header)
+	BinReverse(headerHash)
+	hash.SetBytes(headerHash)
+	return
+}
+
+// MeetDifficultyBTC 区块头哈希是否满足难度 diff（哈希不大于 diff1 / diff）
+func MeetDifficultyBTC(hash *uint256.Int, diff uint64) bool {
+	if diff < 1 {
+		return true
+	}
+	var target uint256.Int
+	target.Div(&BitcoinPoolDiff1, uint256.NewInt(diff))
+	return !hash.Gt(&target)
+}
+
+// TargetToDiffBTC 将 NiceHash 风格的目标值转换为比特币的难度
+func TargetToDiffBTC(targetHex string) (uint64, error) {
+	return TargetToDiff(&BitcoinPoolDiff1, targetHex)
+}
+
 func IsFakeJobIDBTC(id string) bool {
 	return len(id) < 1 || id[0] == 'f'
 }
@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 import (
 	"encoding/hex"
@@ -126,6 +126,11 @@ func (job *StratumJobETH) Height() uint64 {
 	return job.PoWHeader.Number.Uint64()
 }
 
+// TargetToDiffETH 将目标值转换为以太坊的难度（与 DiffToTargetETH 相反）
+func TargetToDiffETH(targetHex string) (uint64, error) {
+	return TargetToDiff(&EthereumPoolDiff1, targetHex)
+}
+
 func DiffToTargetETH(diff uint64) (target string) {
 	var result uint256.Int
 	result.SetUint64(diff)
@@ -1,4 +1,4 @@
-package main
+package btcagent
 
 type StratumStatus uint32
 
@@ -0,0 +1,99 @@
+package btcagent
+
+import "time"
+
+//////////////////////////////// SubmitIDMap //////////////////////////////
+
+// SubmitID 矿机提交 share 时的请求 ID
+type SubmitID struct {
+	ID        interface{} // 矿机 mining.submit 请求的 JSON-RPC ID
+	SessionID uint16      // 矿机连接的会话ID
+	Time      time.Time   // 收到矿机提交的时间
+	// share 满足被 difficulty_clamp 调低的矿机难度（已在本地验证），矿池以难度过低拒绝时向矿机响应为接受
+	MeetsClampedDifficulty bool
+}
+
+// SubmitIDMap 记录提交给矿池的 share 序号与矿机请求 ID 的对应关系（非线程安全，只在事件循环中使用）。
+//
+// 启用 subres 后，矿池按收到 CMD_SUBMIT_SHARE 的顺序为 share 编号（从 0 开始，uint16 回绕），
+// 并在 CMD_SUBMIT_RESPONSE 中返回该序号。因此提交每个 share 时都必须按顺序分配序号。
+// 序号是按时间顺序分配的，未响应的记录总在 oldest 与 next 之间，超时清理只需从 oldest 开始向后检查。
+// oldest 和 next 使用不回绕的计数，其低 16 位才是序号，以区分空和 65536 个记录都未响应的情况。
+type SubmitIDMap struct {
+	ids     map[uint16]SubmitID
+	oldest  uint64 // 可能仍未响应的最早的 share 的计数
+	next    uint64 // 下一个 share 的计数
+	timeout time.Duration
+}
+
+// NewSubmitIDMap 创建实例，超过 timeout 未响应的记录会被 Expire() 清除
+func NewSubmitIDMap(timeout time.Duration) (m *SubmitIDMap) {
+	m = new(SubmitIDMap)
+	m.ids = make(map[uint16]SubmitID)
+	m.timeout = timeout
+	return
+}
+
+// Len 获取尚未响应的 share 数
+func (m *SubmitIDMap) Len() int {
+	return len(m.ids)
+}
+
+// Add 为新提交的 share 分配序号。
+// 序号回绕后若仍有 65536 个之前的 share 未响应，最早的记录会被挤出并通过 evicted 返回。
+func (m *SubmitIDMap) Add(id interface{}, sessionID uint16, submitTime time.Time) (index uint16, evicted *SubmitID) {
+	index = uint16(m.next)
+	if old, ok := m.ids[index]; ok {
+		evicted = &old
+		m.oldest = m.next - 0xffff
+	}
+	m.ids[index] = SubmitID{ID: id, SessionID: sessionID, Time: submitTime}
+	m.next++
+	return
+}
+
+// SetMeetsClampedDifficulty 记录序号为 index 的 share 满足被调低的矿机难度
+func (m *SubmitIDMap) SetMeetsClampedDifficulty(index uint16) {
+	if submitID, ok := m.ids[index]; ok {
+		submitID.MeetsClampedDifficulty = true
+		m.ids[index] = submitID
+	}
+}
+
+// Remove 根据矿池响应中的序号查找并移除记录
+func (m *SubmitIDMap) Remove(index uint16) (submitID SubmitID, ok bool) {
+	submitID, ok = m.ids[index]
+	if ok {
+		delete(m.ids, index)
+	}
+	return
+}
+
+// RemoveAll 按提交的顺序移除并返回所有未响应的记录
+func (m *SubmitIDMap) RemoveAll() (removed []SubmitID) {
+	for ; m.oldest < m.next; m.oldest++ {
+		index := uint16(m.oldest)
+		if submitID, ok := m.ids[index]; ok {
+			delete(m.ids, index)
+			removed = append(removed, submitID)
+		}
+	}
+	return
+}
+
+// Expire 移除 now 之前超过 timeout 未响应的记录并返回，调用方需要自行给矿机响应
+func (m *SubmitIDMap) Expire(now time.Time) (expired []SubmitID) {
+	for m.oldest < m.next {
+		index := uint16(m.oldest)
+		submitID, ok := m.ids[index]
+		if ok {
+			if now.Sub(submitID.Time) < m.timeout {
+				break
+			}
+			delete(m.ids, index)
+			expired = append(expired, submitID)
+		}
+		m.oldest++
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package btcagent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubmitIDMapRoundTrip(t *testing.T) {
+	now := time.Now()
+	m := NewSubmitIDMap(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		index, evicted := m.Add(i, uint16(10+i), now)
+		if index != uint16(i) || evicted != nil {
+			t.Errorf("wrong index %d (evicted %v) for share %d", index, evicted, i)
+		}
+	}
+
+	// 响应可以乱序到达
+	for _, index := range []uint16{2, 0, 1} {
+		submitID, ok := m.Remove(index)
+		if !ok || submitID.ID != int(index) || submitID.SessionID != 10+index {
+			t.Errorf("wrong submit id for index %d: %v, %v", index, submitID, ok)
+		}
+	}
+	if _, ok := m.Remove(1); ok {
+		t.Errorf("index 1 should be removed")
+	}
+	if m.Len() != 0 {
+		t.Errorf("map should be empty, len: %d", m.Len())
+	}
+}
+
+func TestSubmitIDMapExpire(t *testing.T) {
+	now := time.Now()
+	m := NewSubmitIDMap(time.Minute)
+
+	m.Add("a", 1, now)
+	m.Add("b", 1, now.Add(10*time.Second))
+	m.Add("c", 1, now.Add(20*time.Second))
+	m.Remove(0)
+
+	expired := m.Expire(now.Add(70 * time.Second))
+	if len(expired) != 1 || expired[0].ID != "b" {
+		t.Errorf("wrong expired submit ids: %v", expired)
+	}
+	if m.Len() != 1 {
+		t.Errorf("wrong len after expire: %d", m.Len())
+	}
+
+	// 已超时的记录不能再被响应
+	if _, ok := m.Remove(1); ok {
+		t.Errorf("expired index 1 should not be found")
+	}
+	if submitID, ok := m.Remove(2); !ok || submitID.ID != "c" {
+		t.Errorf("wrong submit id for index 2: %v, %v", submitID, ok)
+	}
+	if expired := m.Expire(now.Add(time.Hour)); len(expired) != 0 {
+		t.Errorf("nothing should be expired: %v", expired)
+	}
+}
+
+func TestSubmitIDMapWraparound(t *testing.T) {
+	now := time.Now()
+	m := NewSubmitIDMap(time.Minute)
+
+	// 长时间运行后序号回绕，已响应的序号可以复用
+	for i := 0; i < 0x10000+5; i++ {
+		index, evicted := m.Add(i, 1, now)
+		if index != uint16(i) || evicted != nil {
+			t.Fatalf("wrong index %d (evicted %v) for share %d", index, evicted, i)
+		}
+		if submitID, ok := m.Remove(index); !ok || submitID.ID != i {
+			t.Fatalf("wrong submit id for index %d: %v, %v", index, submitID, ok)
+		}
+	}
+
+	// 65536 个 share 都未响应时，再提交会挤出最早的记录
+	m = NewSubmitIDMap(time.Minute)
+	for i := 0; i < 0x10000; i++ {
+		m.Add(i, 1, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	index, evicted := m.Add(0x10000, 1, now.Add(time.Hour))
+	if index != 0 || evicted == nil || evicted.ID != 0 {
+		t.Errorf("wrong index %d or evicted submit id %v", index, evicted)
+	}
+	if m.Len() != 0x10000 {
+		t.Errorf("wrong len after eviction: %d", m.Len())
+	}
+	if submitID, ok := m.Remove(0); !ok || submitID.ID != 0x10000 {
+		t.Errorf("wrong submit id for reused index 0: %v, %v", submitID, ok)
+	}
+
+	// 超时清理从被挤出的记录之后开始
+	expired := m.Expire(now.Add(time.Minute + 2*time.Millisecond))
+	if len(expired) != 2 || expired[0].ID != 1 || expired[1].ID != 2 {
+		t.Errorf("wrong expired submit ids: %v", expired)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package btcagent
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// UnixPeerCredential 通过 SO_PEERCRED 获取 Unix 域套接字对端进程的身份
+func UnixPeerCredential(conn *net.UnixConn) (peer string) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rawConn.Control(func(fd uintptr) {
+		cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if err == nil {
+			peer = fmt.Sprintf("pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid)
+		}
+	})
+	return
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package btcagent
+
+import "net"
+
+// UnixPeerCredential 除 Linux 以外的平台暂不支持获取对端进程身份
+func UnixPeerCredential(conn *net.UnixConn) string {
+	return ""
+}
@@ -1,11 +1,11 @@
 //go:build !windows
 
-package main
+package btcagent
 
 import (
+	"errors"
+	"net"
 	"syscall"
-
-	"github.com/golang/glog"
 )
 
 func IncreaseFDLimit() {
@@ -28,11 +28,31 @@ func IncreaseFDLimit() {
 
 	// checking
 	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlm)
-	glog.Info("[OPTION] File descriptor limits: ", rlm.Cur, " / ", rlm.Max)
+	Log.Info("[OPTION] File descriptor limits: ", rlm.Cur, " / ", rlm.Max)
 	if rlm.Max < 5000 {
-		glog.Error("[OPTION] File descriptor hard limit is too small: ", rlm.Max, "! The problem may be solved by executing the following command before launching BTCAgent: ulimit -Hn 65535")
+		Log.Error("[OPTION] File descriptor hard limit is too small: ", rlm.Max, "! The problem may be solved by executing the following command before launching BTCAgent: ulimit -Hn 65535")
 	}
 	if rlm.Cur < 5000 {
-		glog.Error("[OPTION] File descriptor soft limit is too small: ", rlm.Cur, "! The problem may be solved by executing the following command before launching BTCAgent: ulimit -Sn 65535")
+		Log.Error("[OPTION] File descriptor soft limit is too small: ", rlm.Cur, "! The problem may be solved by executing the following command before launching BTCAgent: ulimit -Sn 65535")
+	}
+}
+
+// SetListenBacklog 对监听中的套接字再次调用 listen(2) 以修改等待接受的连接队列的长度。
+// Linux 和 BSD 都允许这样调用，实际长度仍受系统上限（如 net.core.somaxconn）的限制。
+func SetListenBacklog(listener net.Listener, backlog int) (err error) {
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return errors.New("listener does not expose its socket")
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), backlog)
+	})
+	if controlErr != nil {
+		err = controlErr
 	}
+	return
 }
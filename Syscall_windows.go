@@ -1,7 +1,17 @@
 //go:build windows
 
-package main
+package btcagent
+
+import (
+	"errors"
+	"net"
+)
 
 func IncreaseFDLimit() {
 	// Windows has no file descriptor limit. Do nothing.
 }
+
+// SetListenBacklog Windows 不支持修改监听中的套接字的连接队列长度
+func SetListenBacklog(listener net.Listener, backlog int) error {
+	return errors.New("not supported on Windows")
+}
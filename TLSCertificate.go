@@ -0,0 +1,49 @@
+package btcagent
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// TLSCertificate 可热重载的 TLS 证书（用于矿机侧的 TLS 监听）
+type TLSCertificate struct {
+	lock     sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// NewTLSCertificate 载入证书和私钥文件，载入失败时返回错误
+func NewTLSCertificate(certFile string, keyFile string) (certificate *TLSCertificate, err error) {
+	certificate = new(TLSCertificate)
+	certificate.certFile = certFile
+	certificate.keyFile = keyFile
+	err = certificate.Reload()
+	return
+}
+
+// Reload 重新载入证书文件。载入失败时继续使用原有证书。
+// 已建立的连接不受影响，新的连接将使用新证书。
+func (certificate *TLSCertificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(certificate.certFile, certificate.keyFile)
+	if err != nil {
+		return err
+	}
+
+	certificate.lock.Lock()
+	certificate.cert = &cert
+	certificate.lock.Unlock()
+	return nil
+}
+
+// GetCertificate 用于 tls.Config.GetCertificate
+func (certificate *TLSCertificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate.lock.RLock()
+	defer certificate.lock.RUnlock()
+	return certificate.cert, nil
+}
+
+// TLSConfig 创建使用该证书的 tls.Config
+func (certificate *TLSCertificate) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: certificate.GetCertificate}
+}
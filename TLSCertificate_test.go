@@ -0,0 +1,165 @@
+package btcagent
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, commonName string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err.Error())
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %s", err.Error())
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func tlsHandshakeCommonName(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial failed: %s", err.Error())
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping\n"))
+	if err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo: %q, %v", line, err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertificateHandshakeAndReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "first")
+
+	certificate, err := NewTLSCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewTLSCertificate failed: %s", err.Error())
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", certificate.TLSConfig())
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %s", err.Error())
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+
+	if name := tlsHandshakeCommonName(t, listener.Addr().String()); name != "first" {
+		t.Errorf("unexpected certificate before reload: %s", name)
+	}
+
+	writeTestCertificate(t, dir, "second")
+	if err := certificate.Reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err.Error())
+	}
+	if name := tlsHandshakeCommonName(t, listener.Addr().String()); name != "second" {
+		t.Errorf("unexpected certificate after reload: %s", name)
+	}
+
+	// 载入失败时保留原有证书
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	if err := certificate.Reload(); err == nil {
+		t.Errorf("Reload should fail with a broken certificate")
+	}
+	if name := tlsHandshakeCommonName(t, listener.Addr().String()); name != "second" {
+		t.Errorf("certificate should be kept after a failed reload: %s", name)
+	}
+}
+
+func TestTLSCertificateLoadFailed(t *testing.T) {
+	_, err := NewTLSCertificate("/nonexistent/cert.pem", "/nonexistent/key.pem")
+	if err == nil {
+		t.Errorf("NewTLSCertificate should fail with missing files")
+	}
+}
+
+func TestSessionManagerTLSListener(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(io.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.AgentListenTLS.Enable = true
+	config.AgentListenTLS.CertFile, config.AgentListenTLS.KeyFile = writeTestCertificate(t, t.TempDir(), "agent")
+	manager := startTestSessionManager(t, config)
+
+	conn, err := tls.Dial("tcp", manager.tlsListener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial failed: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["test.tls","x"]}` + "\n"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	subscribed := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner over TLS did not receive responses, subscribed: %v, error: %v", subscribed, err)
+		}
+		if strings.HasPrefix(line, `{"id":1,`) {
+			subscribed = !strings.Contains(line, `"result":null`)
+		}
+		if strings.HasPrefix(line, `{"id":2,`) {
+			if !subscribed || !strings.Contains(line, `"result":true`) {
+				t.Errorf("subscribe or authorize over TLS failed, subscribed: %v, authorize response: %s", subscribed, line)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package btcagent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ListenUnix 在 path 上创建 Unix 域套接字监听，并设置文件权限
+// 如果 path 是一个无人监听的残留套接字文件，会先将其删除
+// 监听对象被 Close() 时套接字文件会被自动删除
+//
+// 套接字先在只有当前用户可以访问的临时目录中创建，修改权限后再移动到 path，
+// 以免在 chmod 之前被其他用户连接
+func ListenUnix(path string, mode string) (listener net.Listener, err error) {
+	var perm uint64
+	if len(mode) > 0 {
+		perm, err = strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return
+		}
+	}
+
+	err = removeStaleUnixSocket(path)
+	if err != nil {
+		return
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "s")
+	unixListener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return
+	}
+	// 套接字文件会被移动到 path，由 unixSocketListener 在关闭时删除
+	unixListener.SetUnlinkOnClose(false)
+
+	if len(mode) > 0 {
+		err = os.Chmod(tmpPath, os.FileMode(perm))
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		unixListener.Close()
+		return
+	}
+
+	listener = &unixSocketListener{unixListener, path}
+	return
+}
+
+// unixSocketListener 监听地址为移动后的套接字文件路径，关闭时删除该文件
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixSocketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: listener.path, Net: "unix"}
+}
+
+func (listener *unixSocketListener) Close() error {
+	err := listener.UnixListener.Close()
+	if err == nil {
+		os.Remove(listener.path)
+	}
+	return err
+}
+
+func removeStaleUnixSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("file exists and is not a unix socket: " + path)
+	}
+
+	// 如果还有进程在监听，不能删除
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("unix socket is in use by another process: " + path)
+	}
+	return os.Remove(path)
+}
+
+// ConnRemoteAddr 返回用于打印日志的连接远端地址
+// Unix 域套接字没有远端地址，尽可能返回对端进程的身份
+func ConnRemoteAddr(conn net.Conn) string {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		return "unix:" + UnixPeerCredential(unixConn)
+	}
+	return conn.RemoteAddr().String()
+}
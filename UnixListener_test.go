@@ -0,0 +1,136 @@
+package btcagent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := ListenUnix(path, "660")
+	if err != nil {
+		t.Fatalf("ListenUnix failed: %s", err.Error())
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("wrong socket file: %v, %v", info, err)
+	}
+	// 创建套接字用的临时目录不应残留
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "agent.sock" {
+		t.Errorf("temporary directory is left: %v, %v", entries, err)
+	}
+	if listener.Addr().String() != path {
+		t.Errorf("wrong listener address: %s", listener.Addr())
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+		close(accepted)
+	}()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connect to unix socket failed: %s", err.Error())
+	}
+	defer client.Close()
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("unix socket did not accept the connection")
+	}
+	defer conn.Close()
+
+	remote := ConnRemoteAddr(conn)
+	if !strings.HasPrefix(remote, "unix:") {
+		t.Errorf("wrong remote address of unix socket connection: %s", remote)
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(remote, "pid=") {
+		t.Errorf("peer credential is missing: %s", remote)
+	}
+
+	// 关闭时删除套接字文件
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file should be removed after close: %v", err)
+	}
+
+	if _, err := ListenUnix(filepath.Join(t.TempDir(), "bad.sock"), "abc"); err == nil {
+		t.Errorf("illegal mode should be rejected")
+	}
+}
+
+func TestRemoveStaleUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// 无人监听的残留套接字文件被删除
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("stale socket file should be left: %s", err)
+	}
+	if err := removeStaleUnixSocket(stale); err != nil {
+		t.Errorf("stale socket should be removed: %s", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale socket file still exists: %v", err)
+	}
+	// 残留的套接字可以被 ListenUnix 复用
+	listener, err = net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = ListenUnix(stale, "")
+	if err != nil {
+		t.Fatalf("ListenUnix should replace a stale socket: %s", err)
+	}
+	defer listener.Close()
+
+	// 仍在监听的套接字不能删除
+	if err := removeStaleUnixSocket(stale); err == nil {
+		t.Errorf("live socket should not be removed")
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("live socket file is removed: %s", err)
+	}
+
+	// 不是套接字的文件不能删除
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, []byte("data"), 0600)
+	if err := removeStaleUnixSocket(regular); err == nil {
+		t.Errorf("regular file should not be removed")
+	}
+
+	if err := removeStaleUnixSocket(filepath.Join(dir, "nonexistent.sock")); err != nil {
+		t.Errorf("nonexistent path should be ignored: %s", err)
+	}
+}
+
+func TestConnRemoteAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if remote := ConnRemoteAddr(client); remote != listener.Addr().String() {
+		t.Errorf("wrong remote address of tcp connection: %s", remote)
+	}
+}
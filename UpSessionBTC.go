@@ -1,15 +1,20 @@
-package main
+package btcagent
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -29,43 +34,86 @@ type UpSessionBTC struct {
 	serverConn      net.Conn
 	serverReader    *bufio.Reader
 	readLoopRunning bool
+	readAuthorized  int32 // 供读循环判断是否已认证，需原子读写
 
 	stat            AuthorizeStat
+	authorizeError  *AuthorizeError
+	authorizedTime  time.Time // 认证成功的时间，断开后清零，用于矿池连接统计
+	handshake       handshakeProgress
+	handshakeError  *HandshakeError
 	sessionID       uint32
+	extraNonce1     string // 矿池分配的 extranonce1（hex），原样加在矿机收到的 coinbase1 之后
 	versionMask     uint32
 	extraNonce2Size int
 
+	// 启用 resume_session 时请求恢复的会话ID（上次的 extranonce1），收到订阅结果后清空。
+	// 不为空时等待订阅结果再发送认证请求，以便矿池拒绝恢复时重新订阅
+	resumeSessionID string
+
+	// 矿池要求的 version rolling 最少位数
+	versionRollingMinBitCount int
+
 	serverCapVersionRolling bool
 	serverCapSubmitResponse bool
+	serverCapMiningNotify   bool // 矿池可以通过 CMD_MINING_NOTIFY 下发任务，未协商时忽略该 ex-message
+	serverCapSubmitHashrate bool // 矿池接受 CMD_SUBMIT_HASHRATE，未协商时不转发矿机声明的算力
+
+	// 等待合并写出的 share（启用 pool_submit_coalesce_milliseconds 时）
+	pendingSubmits []byte
 
 	eventLoopRunning bool
 	eventChannel     chan interface{}
 
+	// 由 UpSessionManager 的 ctx 派生，取消后断开连接、退出事件循环
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 握手（订阅、认证等）的截止时间，超时未认证成功则断开连接
+	handshakeDeadline time.Time
+
 	lastJob           *StratumJobBTC
-	rpcSetVersionMask []byte
+	rpcSetVersionMask []byte // 发给矿机的 mining.set_version_mask，尚未得到矿池的版本掩码时为 nil
 	rpcSetDifficulty  []byte
-
-	submitIDs   map[uint16]SubmitID
-	submitIndex uint16
+	difficulty        uint64 // rpcSetDifficulty 中的难度，未知时为 0
+	rpcSetGoal        []byte // 矿池最近下发的 mining.set_goal，启用 forward_set_goal 时使用
+
+	// 尚未广播给矿机的任务，启用 coalesce_mining_notify 时使用
+	pendingJobs []*StratumJobBTC
+	// 最近的任务（任务ID -> 任务）及其先后顺序，设置了 difficulty_multiplier 或 difficulty_clamp.max 时用于计算 share 的哈希
+	recentJobs   map[string]*StratumJobBTC
+	recentJobIDs []string
+
+	// 提交给矿池的 share 序号与矿机请求 ID 的对应关系，用于 submit_response_from_server
+	submitIDs *SubmitIDMap
+	// 退出前等待已提交的 share 的响应（shutdown_submit_grace_seconds），未在等待时为 nil
+	waitingSubmits *EventWaitSubmits
+	// 限制发给矿机的难度
+	difficultyClamp *DifficultyClamp
 
 	// 用于统计断开连接的矿机数，并同步给 UpSessionManager
 	disconnectedMinerCounter int
+
+	// 认证成功前收到的 ex-message，认证成功后再处理
+	pendingExMessages []*ExMessage
 }
 
-func NewUpSessionBTC(manager *UpSessionManager, poolIndex int, slot int) (up *UpSessionBTC) {
+func NewUpSessionBTC(manager *UpSessionManager, config *Config, poolIndex int, slot int) (up *UpSessionBTC) {
 	up = new(UpSessionBTC)
 	up.manager = manager
-	up.config = manager.config
+	up.config = config
 	up.slot = slot
 	up.subAccount = manager.subAccount
 	up.poolIndex = poolIndex
 	up.downSessions = make(map[uint16]*DownSessionBTC)
 	up.stat = StatDisconnected
-	up.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSession)
-	up.submitIDs = make(map[uint16]SubmitID)
+	up.eventChannel = make(chan interface{}, up.config.Advanced.MessageQueueSize.PoolSession)
+	up.ctx, up.cancel = context.WithCancel(manager.ctx)
+	up.submitIDs = NewSubmitIDMap(up.config.Advanced.PoolSubmitResponseTimeoutSeconds.Get())
+	up.difficultyClamp = NewDifficultyClamp(up.config, up.config.PoolDifficultyMultiplier(poolIndex))
+	up.recentJobs = make(map[string]*StratumJobBTC)
 
 	if !up.config.MultiUserMode {
-		up.subAccount = manager.config.Pools[poolIndex].SubAccount
+		up.subAccount = up.config.PoolSubAccount(poolIndex)
 	}
 
 	return
@@ -75,11 +123,23 @@ func (up *UpSessionBTC) Stat() AuthorizeStat {
 	return up.stat
 }
 
+func (up *UpSessionBTC) AuthorizeError() *AuthorizeError {
+	return up.authorizeError
+}
+
+func (up *UpSessionBTC) HandshakeError() *HandshakeError {
+	return up.handshakeError
+}
+
+func (up *UpSessionBTC) HasJob() bool {
+	return up.lastJob != nil
+}
+
 func (up *UpSessionBTC) connect() {
 	pool := up.config.Pools[up.poolIndex]
-	url := fmt.Sprintf("%s:%d", pool.Host, pool.Port)
+	url := pool.Address()
 
-	if up.config.PoolUseTls {
+	if up.config.PoolUseTLS(up.poolIndex) {
 		up.id = fmt.Sprintf("pool#%d <%s> [tls://%s] ", up.slot, up.subAccount, url)
 	} else {
 		up.id = fmt.Sprintf("pool#%d <%s> [%s] ", up.slot, up.subAccount, url)
@@ -97,7 +157,12 @@ func (up *UpSessionBTC) connect() {
 
 	// 接收连接事件
 	for i := 0; i < counter; i++ {
-		event := <-up.eventChannel
+		var event interface{}
+		select {
+		case event = <-up.eventChannel:
+		case <-up.ctx.Done():
+			return
+		}
 		switch e := event.(type) {
 		case EventUpSessionConnection:
 			up.upSessionConnection(e)
@@ -105,7 +170,7 @@ func (up *UpSessionBTC) connect() {
 				return
 			}
 		default:
-			glog.Error(up.id, "unknown event: ", e)
+			Log.Error(up.id, "unknown event: ", e)
 		}
 	}
 
@@ -116,21 +181,26 @@ func (up *UpSessionBTC) connect() {
 
 	// 尝试直连
 	go up.tryConnect(pool.Host, url, "")
-	event := <-up.eventChannel
+	var event interface{}
+	select {
+	case event = <-up.eventChannel:
+	case <-up.ctx.Done():
+		return
+	}
 	switch e := event.(type) {
 	case EventUpSessionConnection:
 		up.upSessionConnection(e)
 	default:
-		glog.Error(up.id, "unknown event: ", e)
+		Log.Error(up.id, "unknown event: ", e)
 	}
 }
 
 func (up *UpSessionBTC) upSessionConnection(e EventUpSessionConnection) {
 	if e.Error != nil {
 		if len(e.ProxyURL) > 0 {
-			glog.Warning(up.id, "proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
+			Log.Warning(up.id, "proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
 		} else {
-			glog.Warning(up.id, "direct connection failed: ", e.Error.Error())
+			Log.Warning(up.id, "direct connection failed: ", e.Error.Error())
 		}
 
 		if e.Conn != nil {
@@ -145,9 +215,9 @@ func (up *UpSessionBTC) upSessionConnection(e EventUpSessionConnection) {
 	up.id += fmt.Sprintf("(%s) ", up.serverConn.RemoteAddr().String())
 
 	if len(e.ProxyURL) > 0 {
-		glog.Info(up.id, "successfully connected with proxy [", e.ProxyURL, "]")
+		Log.Info(up.id, "successfully connected with proxy [", e.ProxyURL, "]")
 	} else {
-		glog.Info(up.id, "successfully connected directly")
+		Log.Info(up.id, "successfully connected directly")
 	}
 }
 
@@ -161,47 +231,62 @@ func (up *UpSessionBTC) tryConnect(poolHost, poolURL, proxyURL string) {
 	var reader *bufio.Reader
 
 	if len(proxyURL) > 0 {
-		glog.Info(up.id, "connect to pool server with proxy [", proxyURL, "]...")
+		Log.Info(up.id, "connect to pool server with proxy [", proxyURL, "]...")
 		dialer, err = GetProxyDialer(proxyURL, timeout, insecureSkipVerify)
 	} else {
-		glog.Info(up.id, "connect to pool server directly...")
-		dialer = &net.Dialer{Timeout: timeout}
+		Log.Info(up.id, "connect to pool server directly...")
+		dialer = up.config.DirectDialer()
 	}
 
 	if err == nil {
-		conn, err = dialer.Dial("tcp", poolURL)
+		conn, err = DialRetry(up.config, dialer, poolURL, up.id)
 		if err == nil {
-			if up.config.PoolUseTls {
+			if up.config.PoolUseTLS(up.poolIndex) {
 				conn = tls.Client(conn, &tls.Config{
 					ServerName:         poolHost,
 					InsecureSkipVerify: insecureSkipVerify,
 				})
 			}
-			reader, err = up.testConnection(conn)
+			if capture := up.manager.parent.poolCapture; capture != nil {
+				conn = capture.Wrap(conn, poolURL)
+			}
+			if up.skipCapabilities() {
+				// 测试请求也是 agent.get_capabilities，普通 stratum 矿池可能不会响应
+				reader = bufio.NewReaderSize(conn, int(up.config.Advanced.ReadBufferSize.PoolSession))
+			} else {
+				reader, err = up.testConnection(conn)
+			}
 		}
 	}
 
-	up.SendEvent(EventUpSessionConnection{proxyURL, conn, reader, err})
+	select {
+	case up.eventChannel <- EventUpSessionConnection{proxyURL, conn, reader, err}:
+	case <-up.ctx.Done():
+		// 已退出，没有人会接收这个连接
+		if conn != nil {
+			conn.Close()
+		}
+	}
 }
 
 func (up *UpSessionBTC) testConnection(conn net.Conn) (reader *bufio.Reader, err error) {
 	ch := make(chan error, 1)
-	reader = bufio.NewReader(conn)
+	reader = bufio.NewReaderSize(conn, int(up.config.Advanced.ReadBufferSize.PoolSession))
 
 	go func() {
 		capsRequest := up.getAgentGetCapsRequest("conn_test")
-		bytes, e := capsRequest.ToJSONBytesLine()
+		bytes, e := up.requestWithPoolID(&capsRequest).ToJSONBytesLine()
 		if e == nil {
-			if glog.V(10) {
-				glog.Info(up.id, "testConnection send: ", string(bytes))
+			if glog.V(10) || LogJSONRPC.V(10) {
+				Log.Info(up.id, "testConnection send: ", string(bytes))
 			}
-			conn.SetWriteDeadline(up.getIODeadLine())
-			_, e = conn.Write(bytes)
+			conn.SetWriteDeadline(up.getIODeadLine(up.config.PoolWriteTimeout(up.poolIndex), false))
+			_, e = WriteFull(conn, bytes)
 			if e == nil {
-				conn.SetReadDeadline(up.getIODeadLine())
+				conn.SetReadDeadline(up.getIODeadLine(up.config.PoolReadTimeout(up.poolIndex), false))
 				bytes, e = reader.ReadBytes('\n')
-				if glog.V(9) {
-					glog.Info(up.id, "testConnection recv: ", string(bytes))
+				if glog.V(9) || LogJSONRPC.V(9) {
+					Log.Info(up.id, "testConnection recv: ", string(bytes))
 				}
 			}
 		}
@@ -219,71 +304,176 @@ func (up *UpSessionBTC) testConnection(conn net.Conn) (reader *bufio.Reader, err
 }
 
 func (up *UpSessionBTC) writeJSONRequest(jsonData *JSONRPCRequest) (int, error) {
+	jsonData = up.requestWithPoolID(jsonData)
 	bytes, err := jsonData.ToJSONBytesLine()
 	if err != nil {
 		return 0, err
 	}
-	if glog.V(10) {
-		glog.Info(up.id, "writeJSONRequest: ", string(bytes))
+	if glog.V(10) || LogJSONRPC.V(10) {
+		Log.Info(up.id, "writeJSONRequest: ", jsonRequestForLog(jsonData, bytes))
 	}
 	return up.writeBytes(bytes)
 }
 
+// requestWithPoolID 矿池要求数字 id 时返回换成数字 id 的请求副本
+func (up *UpSessionBTC) requestWithPoolID(jsonData *JSONRPCRequest) *JSONRPCRequest {
+	id, ok := jsonData.ID.(string)
+	if !ok || !up.config.PoolNumericRequestID(up.poolIndex) {
+		return jsonData
+	}
+	request := *jsonData
+	request.ID = NumericRequestID(id)
+	return &request
+}
+
 func (up *UpSessionBTC) writeExMessage(msg SerializableExMessage) (int, error) {
 	bytes := msg.Serialize()
-	if glog.V(10) && len(bytes) > 1 {
-		glog.Info(up.id, "writeExMessage: ", bytes[1], msg, " ", hex.EncodeToString(bytes))
+	if (glog.V(10) || LogExMessage.V(10)) && len(bytes) > 1 {
+		Log.Info(up.id, "writeExMessage: ", bytes[1], msg, " len=", len(bytes), " ", hex.EncodeToString(bytes))
 	}
 	return up.writeBytes(bytes)
 }
 
 func (up *UpSessionBTC) writeBytes(bytes []byte) (int, error) {
+	if len(up.pendingSubmits) > 0 {
+		// 先写出等待合并的 share，保持与其他消息（如注销矿工）的顺序
+		bytes = append(up.pendingSubmits, bytes...)
+		up.pendingSubmits = nil
+	}
 	up.setWriteDeadline()
-	return up.serverConn.Write(bytes)
+	// 只写出部分数据时调用方会断开连接，不会从帧的中间继续写
+	return WriteFull(up.serverConn, bytes)
+}
+
+// writeSubmitExMessage 提交 share。启用 pool_submit_coalesce_milliseconds 时先放入队列，
+// 窗口结束时与窗口内的其他 share 在一次写入中发给矿池，以减少系统调用
+func (up *UpSessionBTC) writeSubmitExMessage(msg SerializableExMessage) (int, error) {
+	window := up.config.Advanced.PoolSubmitCoalesceMilliseconds
+	if window == 0 {
+		return up.writeExMessage(msg)
+	}
+
+	bytes := msg.Serialize()
+	if (glog.V(10) || LogExMessage.V(10)) && len(bytes) > 1 {
+		Log.Info(up.id, "queue ExMessage: ", bytes[1], msg, " len=", len(bytes), " ", hex.EncodeToString(bytes))
+	}
+	if len(up.pendingSubmits) == 0 {
+		time.AfterFunc(time.Duration(window)*time.Millisecond, func() {
+			up.SendEvent(EventFlushSubmits{})
+		})
+	}
+	up.pendingSubmits = append(up.pendingSubmits, bytes...)
+	if len(up.pendingSubmits) >= UpSessionMaxCoalescedSubmitBytes {
+		return up.writeBytes(nil)
+	}
+	return len(bytes), nil
+}
+
+// flushSubmits 写出等待合并的 share
+func (up *UpSessionBTC) flushSubmits() {
+	if len(up.pendingSubmits) == 0 {
+		return
+	}
+	_, err := up.writeBytes(nil)
+	if err != nil {
+		Log.Error(up.id, "failed to submit share: ", err.Error())
+		up.close()
+	}
+}
+
+func (up *UpSessionBTC) requestedCapabilities() []string {
+	capabilities := []string{CapVersionRolling}
+	if up.config.SubmitResponseFromServer {
+		capabilities = append(capabilities, CapSubmitResponse)
+	}
+	capabilities = append(capabilities, CapMiningNotify)
+	if up.config.Advanced.ForwardDeclaredHashrate {
+		capabilities = append(capabilities, CapSubmitHashrate)
+	}
+	return RequestedCapabilities(up.config, capabilities...)
 }
 
 func (up *UpSessionBTC) getAgentGetCapsRequest(id string) (req JSONRPCRequest) {
 	req.ID = id
 	req.Method = "agent.get_capabilities"
-	if up.config.SubmitResponseFromServer {
-		req.SetParams(JSONRPCArray{CapVersionRolling, CapSubmitResponse})
-	} else {
-		req.SetParams(JSONRPCArray{CapVersionRolling})
+
+	caps := JSONRPCArray{}
+	for _, capability := range up.requestedCapabilities() {
+		caps = append(caps, capability)
 	}
+	req.SetParams(caps)
 	return
 }
 
+// initialDifficulty 配置的矿机初始难度，0 表示未配置
+func (up *UpSessionBTC) initialDifficulty() uint64 {
+	return up.config.PoolInitialDifficulty(up.poolIndex, up.subAccount)
+}
+
 func (up *UpSessionBTC) sendInitRequest() (err error) {
 	// send agent.get_capabilities first
 	capsRequest := up.getAgentGetCapsRequest("caps")
-	_, err = up.writeJSONRequest(&capsRequest)
-	if err != nil {
-		return
+	if !up.skipCapabilities() {
+		up.handshake.send(HandshakeGetCapabilities)
+		_, err = up.writeJSONRequest(&capsRequest)
+		if err != nil {
+			return
+		}
 	}
 
 	// send configure request
 	var request JSONRPCRequest
 	request.ID = "conf"
 	request.Method = "mining.configure"
+	up.handshake.send(HandshakeConfigure)
 	request.SetParams(JSONRPCArray{"version-rolling"}, JSONRPCObj{"version-rolling.mask": "ffffffff", "version-rolling.min-bit-count": 0})
 	_, err = up.writeJSONRequest(&request)
 	if err != nil {
 		return
 	}
 
-	// send subscribe request
+	err = up.sendSubscribeRequest()
+	if err != nil || len(up.resumeSessionID) > 0 {
+		return
+	}
+	return up.sendAuthorizeRequest()
+}
+
+// sendSubscribeRequest 发送订阅请求，有 resumeSessionID 时请求恢复该会话
+func (up *UpSessionBTC) sendSubscribeRequest() (err error) {
+	var request JSONRPCRequest
 	request.ID = "sub"
 	request.Method = "mining.subscribe"
-	request.SetParams(UpSessionUserAgent)
+	up.handshake.send(HandshakeSubscribe)
+	if len(up.resumeSessionID) > 0 {
+		request.SetParams(UpSessionUserAgent, up.resumeSessionID)
+	} else {
+		request.SetParams(UpSessionUserAgent)
+	}
 	_, err = up.writeJSONRequest(&request)
-	if err != nil {
-		return
+	return
+}
+
+// sendAuthorizeRequest 发送建议难度、认证和第二次能力协商请求
+func (up *UpSessionBTC) sendAuthorizeRequest() (err error) {
+	var request JSONRPCRequest
+
+	// 启用 suggest_to_pool 时向矿池建议初始难度，矿池的难度调整将以此为起点
+	if diff := up.initialDifficulty(); diff > 0 && up.config.InitialDifficulty.SuggestToPool {
+		request.ID = "suggest_diff"
+		request.Method = "mining.suggest_difficulty"
+		request.SetParams(diff)
+		_, err = up.writeJSONRequest(&request)
+		if err != nil {
+			return
+		}
 	}
 
 	// send authorize request
 	request.ID = "auth"
 	request.Method = "mining.authorize"
-	request.SetParams(up.subAccount, "")
+	up.handshake.send(HandshakeAuthorize)
+	request.SetParams(up.subAccount, up.config.PoolAuthorizePassword(up.poolIndex, up.subAccount, up.manager.minerPassword))
 	_, err = up.writeJSONRequest(&request)
 	if err != nil {
 		return
@@ -292,8 +482,10 @@ func (up *UpSessionBTC) sendInitRequest() (err error) {
 	// send agent.get_capabilities again
 	// fix subres (submit_response_from_server)
 	// Subres negotiation must be sent after authentication, or sserver will not send the response.
-	capsRequest.ID = "caps_again"
-	_, err = up.writeJSONRequest(&capsRequest)
+	if !up.skipCapabilities() {
+		capsRequest := up.getAgentGetCapsRequest("caps_again")
+		_, err = up.writeJSONRequest(&capsRequest)
+	}
 	return
 }
 
@@ -304,7 +496,12 @@ func (up *UpSessionBTC) exit() {
 
 func (up *UpSessionBTC) close() {
 	if up.stat == StatAuthorized {
-		up.manager.SendEvent(EventUpSessionBroken{up.slot})
+		up.manager.SendEvent(EventUpSessionBroken{up.slot, up})
+	}
+	if !up.authorizedTime.IsZero() {
+		// exit() 时 stat 已不是 StatAuthorized，因此通过认证时间判断
+		up.manager.parent.poolStats.Disconnected(up.config.Pool(up.poolIndex), up.manager.subAccount, up.slot, time.Now())
+		up.authorizedTime = time.Time{}
 	}
 
 	if up.config.AlwaysKeepDownconn {
@@ -322,51 +519,87 @@ func (up *UpSessionBTC) close() {
 
 	up.eventLoopRunning = false
 	up.stat = StatDisconnected
+	up.pendingSubmits = nil
 	up.serverConn.Close()
+	up.cancel()
 }
 
 func (up *UpSessionBTC) Init() {
 	up.connect()
 	if up.stat != StatConnected {
 		if len(up.config.Proxy) > 0 && (up.config.DirectConnectWithProxy || up.config.DirectConnectAfterProxy) {
-			glog.Error(up.id, "all connections both proxy and direct failed")
+			Log.Error(up.id, "all connections both proxy and direct failed")
 		} else if len(up.config.Proxy) > 1 {
-			glog.Error(up.id, "all proxy connections failed")
+			Log.Error(up.id, "all proxy connections failed")
 		}
+		up.cancel()
 		return
 	}
 
+	up.handshakeDeadline = time.Now().Add(up.config.Advanced.PoolHandshakeTimeoutSeconds.Get())
 	go up.handleResponse()
 
+	if up.skipCapabilities() {
+		Log.Info(up.id, "capabilities negotiation skipped, submit shares with mining.submit")
+		// mining.submit 本身可以携带版本位，版本滚动由 mining.configure 协商
+		up.serverCapVersionRolling = true
+		// 矿池对 mining.submit 的响应就是 share 的提交结果
+		up.serverCapSubmitResponse = up.config.SubmitResponseFromServer
+	}
+
+	if up.config.RouteDisableVersionRolling() {
+		Log.Info(up.id, "version rolling of miners disabled by user_agent_routes ", up.config.route.Name)
+		up.disableVersionRolling()
+	}
+	if up.config.PoolResumeSession(up.poolIndex) {
+		up.resumeSessionID = up.manager.resumeSessionID(up.slot, up.config.Pool(up.poolIndex))
+	}
 	err := up.sendInitRequest()
 	if err != nil {
-		glog.Error(up.id, "failed to send request to pool server: ", err.Error())
+		up.handshakeError = &HandshakeError{up.handshake.last(), err.Error(), false}
+		Log.Error(up.id, "failed to send ", up.handshakeError.Stage, " request to pool server: ", err.Error())
 		up.close()
 		return
 	}
 
 	up.handleEvent()
+
+	if up.stat != StatAuthorized && !time.Now().Before(up.handshakeDeadline) {
+		up.handshakeError = &HandshakeError{up.handshake.pending(), "timeout", false}
+		Log.Error(up.id, "pool server handshake timeout, not authorized in ", up.config.Advanced.PoolHandshakeTimeoutSeconds,
+			" seconds, no response to ", up.handshakeError.Stage, " received")
+	}
 }
 
 func (up *UpSessionBTC) handleSetVersionMask(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	if up.config.RouteDisableVersionRolling() || (!up.serverCapVersionRolling && up.config.PoolWithoutAsicboost == PoolWithoutAsicboostDisable) {
+		// 已向矿机发送空的版本掩码，忽略矿池的版本掩码
+		return
+	}
 	up.rpcSetVersionMask = jsonBytes
 
 	if len(rpcData.Params) > 0 {
 		if up.serverCapVersionRolling {
 			versionMaskHex, ok := rpcData.Params[0].(string)
 			if !ok {
-				glog.Error(up.id, "version mask is not a string: ", string(jsonBytes))
+				Log.Error(up.id, "version mask is not a string: ", string(jsonBytes))
 				return
 			}
 			versionMask, err := strconv.ParseUint(versionMaskHex, 16, 32)
 			if err != nil {
-				glog.Error(up.id, "version mask is not a hex: ", string(jsonBytes))
+				Log.Error(up.id, "version mask is not a hex: ", string(jsonBytes))
+				return
+			}
+			if versionMask == 0 {
+				// 矿池关闭了版本滚动，之后 share 中的版本位按 reject_illegal_version_mask 去掉或拒绝
+				Log.Warning(up.id, "pool server set an empty version mask, AsicBoost disabled: ", string(jsonBytes))
+				up.disableVersionRolling()
 				return
 			}
 			up.versionMask = uint32(versionMask)
 
 			if glog.V(1) {
-				glog.Info(up.id, "AsicBoost via BTCAgent enabled, allowed version mask: ", versionMaskHex)
+				Log.Info(up.id, "AsicBoost via BTCAgent enabled, allowed version mask: ", versionMaskHex)
 			}
 		} else {
 			// server doesn't support version rolling via BTCAgent
@@ -375,148 +608,512 @@ func (up *UpSessionBTC) handleSetVersionMask(rpcData *JSONRPCLineBTC, jsonBytes
 		}
 	}
 
-	e := EventSendBytes{up.rpcSetVersionMask}
+	up.sendVersionMask()
+}
+
+// disableVersionRolling 向矿机发送空的版本掩码，让矿机停止滚动版本位
+func (up *UpSessionBTC) disableVersionRolling() {
+	up.versionMask = 0
+	up.rpcSetVersionMask = []byte(`{"id":null,"method":"mining.set_version_mask","params":["00000000"]}` + "\n")
+
+	up.sendVersionMask()
+}
+
+// sendVersionMask 将当前的版本掩码发给滚动版本位的矿机
+func (up *UpSessionBTC) sendVersionMask() {
+	e := EventSetVersionMask{up.versionMask, up.rpcSetVersionMask}
 	for _, down := range up.downSessions {
-		if down.versionMask != 0 {
+		if down.loadVersionMask() != 0 {
 			go down.SendEvent(e)
 		}
 	}
 }
 
 func (up *UpSessionBTC) handleSetDifficulty(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	if up.rpcSetDifficulty == nil {
+	if up.isNiceHash() || up.skipCapabilities() {
+		// 难度随时可能调整（不使用 ex-message 时矿池也通过 mining.set_difficulty 调整难度），每次都要转发
+		if len(rpcData.Params) < 1 {
+			Log.Error(up.id, "missing difficulty in mining.set_difficulty message: ", string(jsonBytes))
+			return
+		}
+		diff, ok := rpcData.Params[0].(float64)
+		if !ok {
+			Log.Error(up.id, "difficulty in mining.set_difficulty message is not a number: ", string(jsonBytes))
+			return
+		}
+		up.setPoolDifficulty(uint64(diff))
+		return
+	}
+
+	// 有些矿池在认证响应之前就发送难度，此时还没有矿机，保留最新的难度
+	if up.rpcSetDifficulty == nil || up.stat != StatAuthorized {
 		up.rpcSetDifficulty = jsonBytes
 
-		e := EventSendBytes{up.rpcSetDifficulty}
-		for _, down := range up.downSessions {
+		if len(rpcData.Params) > 0 {
+			if poolDiff, ok := rpcData.Params[0].(float64); ok {
+				diff := up.difficultyClamp.ClampAll(uint64(poolDiff))
+				up.difficulty = diff
+				if diff != uint64(poolDiff) {
+					Log.Info(up.id, "difficulty ", poolDiff, " from pool server is adjusted to ", diff)
+					bytes, err := up.getSetDifficultyLine(diff)
+					if err != nil {
+						Log.Error(up.id, "failed to convert mining.set_difficulty request to JSON: ", err.Error(), "; ", diff)
+						return
+					}
+					up.rpcSetDifficulty = bytes
+				}
+			}
+		}
+
+		e := EventSetDifficultyBTC{up.difficulty, up.rpcSetDifficulty}
+		sessionIDs := make([]uint16, 0, len(up.downSessions))
+		for sessionID, down := range up.downSessions {
+			sessionIDs = append(sessionIDs, sessionID)
 			go down.SendEvent(e)
 		}
+		up.reportMinerDifficulty(sessionIDs, up.difficulty, up.difficultyClamp.allPoolDiff)
 	}
 }
 
-func (up *UpSessionBTC) handleSubScribeResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	result, ok := rpcData.Result.([]interface{})
-	if !ok {
-		glog.Error(up.id, "subscribe result is not an array: ", string(jsonBytes))
-		up.close()
+// handleSetTarget 处理 NiceHash 风格的矿池通过目标值下发的难度
+func (up *UpSessionBTC) handleSetTarget(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	if !up.isNiceHash() {
+		logUnknownPoolMessage(up.config, up.id, "request", rpcData, jsonBytes)
 		return
 	}
-	if len(result) < 3 {
-		glog.Error(up.id, "subscribe result missing items: ", string(jsonBytes))
-		up.close()
+	if len(rpcData.Params) < 1 {
+		Log.Error(up.id, "missing target in mining.set_target message: ", string(jsonBytes))
 		return
 	}
-	sessionIDHex, ok := result[1].(string)
+	target, ok := rpcData.Params[0].(string)
 	if !ok {
-		glog.Error(up.id, "session id is not a string: ", string(jsonBytes))
-		up.close()
+		Log.Error(up.id, "target in mining.set_target message is not a string: ", string(jsonBytes))
+		return
+	}
+	diff, err := TargetToDiffBTC(target)
+	if err != nil {
+		Log.Error(up.id, "failed to convert target to difficulty: ", err.Error(), "; ", string(jsonBytes))
 		return
 	}
-	sessionID, err := strconv.ParseUint(sessionIDHex, 16, 32)
+	up.setPoolDifficulty(diff)
+}
+
+// setPoolDifficulty 将 NiceHash 风格的或跳过能力协商的矿池下发的难度转发给所有矿机，难度未变化时不转发
+func (up *UpSessionBTC) setPoolDifficulty(poolDiff uint64) {
+	if poolDiff < 1 {
+		poolDiff = 1
+	}
+	diff := up.difficultyClamp.ClampAll(poolDiff)
+	if diff != poolDiff {
+		Log.Info(up.id, "difficulty ", poolDiff, " from pool server is adjusted to ", diff)
+	}
+
+	line, err := up.getSetDifficultyLine(diff)
 	if err != nil {
-		glog.Error(up.id, "session id is not a hex: ", string(jsonBytes))
+		Log.Error(up.id, "failed to convert mining.set_difficulty request to JSON: ", err.Error(), "; ", diff)
+		return
+	}
+	if string(line) == string(up.rpcSetDifficulty) {
+		return
+	}
+	up.rpcSetDifficulty = line
+	up.difficulty = diff
+
+	// 新难度只对之后的任务有效
+	up.broadcastPendingJobs()
+	e := EventSetDifficultyBTC{up.difficulty, up.rpcSetDifficulty}
+	sessionIDs := make([]uint16, 0, len(up.downSessions))
+	for sessionID, down := range up.downSessions {
+		sessionIDs = append(sessionIDs, sessionID)
+		go down.SendEvent(e)
+	}
+	up.reportMinerDifficulty(sessionIDs, diff, poolDiff)
+}
+
+// handleSetGoal 处理多算法或合并挖矿的矿池切换挖矿目标的 mining.set_goal，
+// 记录下来并转发给所有矿机，由矿机会话决定是否发送给矿机
+func (up *UpSessionBTC) handleSetGoal(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	if !up.config.PoolForwardSetGoal(up.poolIndex) {
+		logUnknownPoolMessage(up.config, up.id, "request", rpcData, jsonBytes)
+		return
+	}
+	Log.Info(up.id, "pool server switches goal: ", rpcData.Params)
+
+	up.rpcSetGoal = jsonBytes
+	e := EventSetGoal{up.rpcSetGoal}
+	for _, down := range up.downSessions {
+		go down.SendEvent(e)
+	}
+}
+
+// handleUnknownRequest 处理未知方法的矿池消息。unknown_pool_message 为 passthrough 时，
+// 跳过能力协商的矿池发送的通知原样转发给所有矿机；带 id 的请求需要响应，不转发。
+func (up *UpSessionBTC) handleUnknownRequest(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	if up.config.UnknownPoolMessage != UnknownPoolMessagePassthrough || !up.skipCapabilities() || rpcData.ID != nil {
+		logUnknownPoolMessage(up.config, up.id, "request", rpcData, jsonBytes)
+		return
+	}
+	if glog.V(3) {
+		Log.Info(up.id, "relay unknown pool notification to miners: ", rpcData)
+	}
+	e := EventSendBytes{jsonBytes}
+	for _, down := range up.downSessions {
+		go down.SendEvent(e)
+	}
+}
+
+// isNiceHash 矿池是否为 NiceHash 风格的协议变体
+func (up *UpSessionBTC) isNiceHash() bool {
+	return up.config.PoolProtocolVariant(up.poolIndex) == ProtocolVariantNiceHash
+}
+
+// skipCapabilities 是否跳过能力协商，以普通 stratum 协议代理矿机
+func (up *UpSessionBTC) skipCapabilities() bool {
+	return up.config.PoolSkipCapabilities(up.poolIndex)
+}
+
+func (up *UpSessionBTC) handleSubScribeResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	if rpcData.Error != nil && len(up.resumeSessionID) > 0 {
+		// 矿池不接受恢复会话，订阅新的会话
+		Log.Warning(up.id, "pool server rejected resuming session ", up.resumeSessionID, ", subscribe a new session: ", string(jsonBytes))
+		up.resumeSessionID = ""
+		up.sendHandshakeRequest(up.sendSubscribeRequest)
+		if up.stat == StatConnected {
+			up.sendHandshakeRequest(up.sendAuthorizeRequest)
+		}
+		return
+	}
+	if rpcData.Error != nil {
+		// 矿池拒绝订阅，不是协议不兼容
+		Log.Error(up.id, "subscribe failed: ", string(jsonBytes))
 		up.close()
 		return
 	}
-	up.sessionID = uint32(sessionID)
+	result, ok := rpcData.Result.([]interface{})
+	if !ok {
+		up.incompatibleHandshake(HandshakeSubscribe, "subscribe result is not an array", jsonBytes)
+		return
+	}
+	if len(result) < 3 {
+		up.incompatibleHandshake(HandshakeSubscribe, "subscribe result missing items", jsonBytes)
+		return
+	}
+	if !up.parseSessionID(result[1], jsonBytes) {
+		return
+	}
 
 	extraNonce2SizeFloat, ok := result[2].(float64)
 	if !ok {
-		glog.Error(up.id, "extra nonce 2 size is not an integer: ", string(jsonBytes))
-		up.close()
+		up.incompatibleHandshake(HandshakeSubscribe, "extra nonce 2 size is not an integer", jsonBytes)
 		return
 	}
 	up.extraNonce2Size = int(extraNonce2SizeFloat)
-	if up.extraNonce2Size != 8 {
-		glog.Error(up.id, "BTCAgent is not compatible with this server, extra nonce 2 should be 8 bytes but only ", up.extraNonce2Size, " bytes")
-		up.close()
+	if up.extraNonce2Size != UpSessionExtraNonce2SizeBTC {
+		// 矿池更新后改变了 extranonce2 的大小时，所有连接都会失败，单独打印带标记的日志并计数，以便监控告警
+		pool := up.config.Pools[up.poolIndex].Address()
+		up.manager.parent.metrics.IncompatibleExtranonce.Inc("pool", pool, "extranonce2_size", strconv.Itoa(up.extraNonce2Size))
+		Log.Error(up.id, "[INCOMPATIBLE_EXTRANONCE] pool=", pool, " extranonce2_size=", up.extraNonce2Size, " expected=", UpSessionExtraNonce2SizeBTC, ", fail over to the next pool server")
+		up.incompatibleHandshake(HandshakeSubscribe, fmt.Sprintf("extra nonce 2 should be %d bytes but only %d bytes", UpSessionExtraNonce2SizeBTC, up.extraNonce2Size), jsonBytes)
 		return
 	}
 	up.stat = StatSubScribed
+
+	if len(up.resumeSessionID) > 0 {
+		if up.resumeSessionID == up.extraNonce1 {
+			Log.Info(up.id, "session ", up.extraNonce1, " resumed")
+		} else {
+			Log.Info(up.id, "session ", up.resumeSessionID, " not resumed, new session: ", up.extraNonce1)
+		}
+		up.resumeSessionID = ""
+		up.sendHandshakeRequest(up.sendAuthorizeRequest)
+	}
+}
+
+// parseSessionID 解析订阅结果中的会话ID（extranonce1），无法解析时断开连接并返回 false。
+// 没有会话ID（空字符串或 null）时按矿池的 missing_session_id 配置断开连接或使用为 0 的会话ID。
+func (up *UpSessionBTC) parseSessionID(value interface{}, jsonBytes []byte) bool {
+	sessionIDHex, ok := value.(string)
+	if !ok && value != nil {
+		up.incompatibleHandshake(HandshakeSubscribe, "session id is not a string", jsonBytes)
+		return false
+	}
+	if len(sessionIDHex) < 1 {
+		if up.config.PoolMissingSessionID(up.poolIndex) != MissingSessionIDZero {
+			up.incompatibleHandshake(HandshakeSubscribe, "session id is missing", jsonBytes)
+			return false
+		}
+		Log.Warning(up.id, "pool server does not send a session id, use session id 0: ", string(jsonBytes))
+		up.extraNonce1 = ""
+		up.sessionID = 0
+		return true
+	}
+
+	// 矿池的 extranonce1 不一定是 4 字节，必须原样转发，否则矿机算出的 coinbase 与矿池的不同，share 全部被拒绝
+	extraNonce1, err := hex.DecodeString(sessionIDHex)
+	if err != nil {
+		up.incompatibleHandshake(HandshakeSubscribe, "session id is not a hex", jsonBytes)
+		return false
+	}
+	up.extraNonce1 = sessionIDHex
+	// 会话ID只用于日志和状态，超过 4 字节时取最后 4 字节
+	if len(extraNonce1) > 4 {
+		extraNonce1 = extraNonce1[len(extraNonce1)-4:]
+	}
+	up.sessionID = 0
+	for _, b := range extraNonce1 {
+		up.sessionID = up.sessionID<<8 | uint32(b)
+	}
+	return true
+}
+
+// sendHandshakeRequest 在事件循环中发送后续的握手请求，失败时断开连接
+func (up *UpSessionBTC) sendHandshakeRequest(send func() error) {
+	err := send()
+	if err != nil {
+		up.handshakeError = &HandshakeError{up.handshake.last(), err.Error(), false}
+		Log.Error(up.id, "failed to send ", up.handshakeError.Stage, " request to pool server: ", err.Error())
+		up.close()
+	}
+}
+
+// incompatibleHandshake 矿池的握手响应无法解析，断开连接。
+// UpSessionManager 根据 HandshakeError.Incompatible 统计矿池连续的协议不兼容次数。
+func (up *UpSessionBTC) incompatibleHandshake(stage HandshakeStage, reason string, jsonBytes []byte) {
+	Log.Error(up.id, "pool server speaks an incompatible protocol, ", reason, ": ", string(jsonBytes))
+	up.handshakeError = &HandshakeError{stage, reason, true}
+	up.close()
 }
 
 func (up *UpSessionBTC) handleConfigureResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	// ignore
+	// response:
+	//		{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000","version-rolling.min-bit-count":2},"error":null}
+	if reason := configureResponseProblem(rpcData); len(reason) > 0 {
+		// 按错误的格式继续握手可能得到错误的版本掩码，使矿机的 ASICBoost share 被拒绝
+		if up.config.Advanced.StrictConfigureResponse {
+			up.incompatibleHandshake(HandshakeConfigure, "unrecognized mining.configure response, "+reason, jsonBytes)
+			return
+		}
+		Log.Warning(up.id, "unrecognized mining.configure response, ", reason, ", ignore it: ", string(jsonBytes))
+		return
+	}
+	result, ok := rpcData.Result.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if enabled, _ := result["version-rolling"].(bool); enabled {
+		// 有些矿池只在 mining.configure 的响应中协商版本掩码，不发送 mining.set_version_mask，
+		// 按收到同样掩码的 mining.set_version_mask 处理，之后收到的 mining.set_version_mask 会覆盖它
+		mask, _ := result["version-rolling.mask"].(string)
+		up.setConfiguredVersionMask(mask)
+	}
+	minBitCount, ok := result["version-rolling.min-bit-count"].(float64)
+	if !ok || minBitCount < 1 {
+		return
+	}
+
+	up.versionRollingMinBitCount = int(minBitCount)
+	if glog.V(1) {
+		Log.Info(up.id, "pool server requires version rolling min-bit-count: ", up.versionRollingMinBitCount)
+	}
+}
+
+// setConfiguredVersionMask 使用 mining.configure 响应中的版本掩码（hex），与 mining.set_version_mask 相同地保存并转发给矿机
+func (up *UpSessionBTC) setConfiguredVersionMask(mask string) {
+	var request JSONRPCRequest
+	request.Method = "mining.set_version_mask"
+	request.SetParams(mask)
+	bytes, err := request.ToJSONBytesLine()
+	if err != nil {
+		Log.Error(up.id, "failed to convert mining.set_version_mask request to JSON: ", err.Error(), "; ", mask)
+		return
+	}
+	up.handleSetVersionMask(&JSONRPCLineBTC{Method: request.Method, Params: request.Params}, bytes)
+}
+
+// configureResponseProblem 检查 mining.configure 响应的格式，无法识别时返回原因。
+// 错误响应（矿池不支持 mining.configure）和 "version-rolling":false（矿池不支持 version rolling）都是可以识别的。
+func configureResponseProblem(rpcData *JSONRPCLineBTC) string {
+	if rpcData.Error != nil {
+		return ""
+	}
+	result, ok := rpcData.Result.(map[string]interface{})
+	if !ok {
+		return "result is not an object"
+	}
+	enabled, ok := result["version-rolling"].(bool)
+	if !ok {
+		return "version-rolling is missing or not a boolean"
+	}
+	if !enabled {
+		return ""
+	}
+	mask, ok := result["version-rolling.mask"].(string)
+	if !ok {
+		return "version-rolling.mask is missing or not a string"
+	}
+	if _, err := strconv.ParseUint(mask, 16, 32); err != nil {
+		return "version-rolling.mask is not a 32-bit hex"
+	}
+	if minBitCount, exists := result["version-rolling.min-bit-count"]; exists {
+		if _, ok := minBitCount.(float64); !ok {
+			return "version-rolling.min-bit-count is not a number"
+		}
+	}
+	return ""
 }
 
 func (up *UpSessionBTC) handleGetCapsResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
 	result, ok := rpcData.Result.(map[string]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, result is not an object: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, result is not an object: ", string(jsonBytes))
 	}
 	caps, ok := result["capabilities"]
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, missing field capabilities: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, missing field capabilities: ", string(jsonBytes))
 	}
 	capsArr, ok := caps.([]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
 	}
+	offered := []string{}
 	for _, capability := range capsArr {
+		if str, ok := capability.(string); ok {
+			offered = append(offered, str)
+		}
+	}
+	requested := up.requestedCapabilities()
+	negotiated := NegotiateCapabilities(requested, offered)
+	Log.Info(up.id, "capabilities requested: ", requested, ", offered by pool server: ", offered, ", negotiated: ", negotiated)
+
+	missing := MissingCapabilities(up.config.Advanced.RequiredPoolCapabilities, negotiated)
+	if len(missing) > 0 {
+		Log.Error(up.id, "pool server does not support required capabilities ", missing, ", try the next pool server")
+		up.close()
+		return
+	}
+
+	for _, capability := range negotiated {
 		switch capability {
 		case CapVersionRolling:
 			up.serverCapVersionRolling = true
 		case CapSubmitResponse:
 			up.serverCapSubmitResponse = true
+		case CapMiningNotify:
+			up.serverCapMiningNotify = true
+		case CapSubmitHashrate:
+			up.serverCapSubmitHashrate = true
 		}
 	}
+	if up.config.Advanced.ForwardDeclaredHashrate && !up.serverCapSubmitHashrate {
+		Log.Warning(up.id, "[WARNING] pool server does not support ", CapSubmitHashrate, ", hashrate declared by miners is not forwarded")
+	}
 	if !up.serverCapVersionRolling {
-		glog.Warning(up.id, "[WARNING] pool server does not support ASICBoost")
+		switch up.config.PoolWithoutAsicboost {
+		case PoolWithoutAsicboostFailover:
+			Log.Error(up.id, "pool server does not support ASICBoost, try the next pool server")
+			up.close()
+			return
+		case PoolWithoutAsicboostDisable:
+			Log.Warning(up.id, "[WARNING] pool server does not support ASICBoost, disable version rolling of miners")
+			up.disableVersionRolling()
+		default:
+			Log.Warning(up.id, "[WARNING] pool server does not support ASICBoost")
+		}
 	}
 	if up.config.SubmitResponseFromServer {
 		if up.serverCapSubmitResponse {
 			if glog.V(1) {
-				glog.Info(up.id, "pool server will send share response to BTCAgent")
+				Log.Info(up.id, "pool server will send share response to BTCAgent")
 			}
 		} else {
-			glog.Warning(up.id, "[WARNING] pool server does not support sendding share response to BTCAgent")
+			switch up.config.PoolWithoutSubres {
+			case PoolWithoutSubresFailover:
+				Log.Error(up.id, "pool server does not support sending share responses to BTCAgent, try the next pool server")
+				up.close()
+				return
+			default:
+				// 矿池不会响应 share，没有 subres 时所有 share 都在本地响应为接受
+				Log.Warning(up.id, "[WARNING] pool server does not support sending share responses to BTCAgent, ",
+					"downgrade to local-ack mode: shares submitted to this pool server are accepted by BTCAgent immediately")
+			}
 		}
 	}
 }
 
 func (up *UpSessionBTC) handleAuthorizeResponse(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	result, ok := rpcData.Result.(bool)
-	if !ok || !result {
-		glog.Error(up.id, "authorize failed: ", rpcData.Error)
+	up.authorizeError = NewAuthorizeError(rpcData.Result, rpcData.Error)
+	if up.authorizeError != nil {
+		Log.Error(up.id, "authorize failed: ", up.authorizeError, "; ", string(jsonBytes))
 		up.close()
 		return
 	}
-	glog.Info(up.id, "authorize success, session id: ", up.sessionID)
+	Log.Info(up.id, "authorize success, session id: ", up.sessionID)
 	up.stat = StatAuthorized
+	atomic.StoreInt32(&up.readAuthorized, 1)
+	up.authorizedTime = time.Now()
+	if up.config.PoolResumeSession(up.poolIndex) {
+		up.manager.saveResumeSession(up.slot, up.config.Pool(up.poolIndex), up.extraNonce1)
+	}
+	up.manager.parent.poolStats.Connected(up.config.Pool(up.poolIndex), up.manager.subAccount, up.slot, up.authorizedTime)
+	// 正在进行的读操作使用的是握手的截止时间，需要更新
+	up.setReadDeadline()
+	up.processPendingExMessages()
+	// 认证之前收到的任务立即广播，使之后加入的矿机马上获得当前任务，而不是等待下一个 mining.notify
+	if len(up.pendingJobs) > 0 {
+		up.broadcastPendingJobs()
+	}
 	// 让 Init() 函数返回
 	up.eventLoopRunning = false
 }
 
+// handleConnBroken 与矿池的连接断开。握手过程中断开时记录正在等待响应的步骤，
+// Init() 返回后由 UpSessionManager 尝试下一个矿池或重连。
+func (up *UpSessionBTC) handleConnBroken() {
+	if up.stat == StatConnected || up.stat == StatSubScribed {
+		up.handshakeError = &HandshakeError{up.handshake.pending(), "connection lost", false}
+		if time.Now().Before(up.handshakeDeadline) {
+			Log.Error(up.id, "pool server closed the connection during handshake, no response to ", up.handshakeError.Stage, " received")
+		}
+	}
+	up.close()
+}
+
 func (up *UpSessionBTC) connBroken() {
 	up.readLoopRunning = false
 	up.SendEvent(EventConnBroken{})
 }
 
-func (up *UpSessionBTC) getIODeadLine() time.Time {
-	var timeout Seconds
-	if up.stat == StatAuthorized {
-		timeout = up.config.Advanced.PoolConnectionReadTimeoutSeconds
-	} else {
-		timeout = up.config.Advanced.PoolConnectionDialTimeoutSeconds
+// getIODeadLine 认证成功后使用 timeout 作为读写超时，之前则受连接超时和握手超时的限制
+func (up *UpSessionBTC) getIODeadLine(timeout time.Duration, authorized bool) time.Time {
+	if authorized {
+		return time.Now().Add(timeout)
 	}
-	return time.Now().Add(timeout.Get())
+
+	deadline := time.Now().Add(up.config.Advanced.PoolConnectionDialTimeoutSeconds.Get())
+	if !up.handshakeDeadline.IsZero() && up.handshakeDeadline.Before(deadline) {
+		deadline = up.handshakeDeadline
+	}
+	return deadline
 }
 
 func (up *UpSessionBTC) setReadDeadline() {
-	up.serverConn.SetReadDeadline(up.getIODeadLine())
+	// 读循环与事件循环并行运行，不能读取 up.stat
+	up.serverConn.SetReadDeadline(up.getIODeadLine(up.config.PoolReadTimeout(up.poolIndex), atomic.LoadInt32(&up.readAuthorized) != 0))
 }
 
+// setWriteDeadline 写入超时后 Write 会返回错误，调用方将断开连接并重连，以免阻塞事件循环
 func (up *UpSessionBTC) setWriteDeadline() {
-	up.serverConn.SetWriteDeadline(up.getIODeadLine())
+	up.serverConn.SetWriteDeadline(up.getIODeadLine(up.config.PoolWriteTimeout(up.poolIndex), up.stat == StatAuthorized))
 }
 
+// handleResponse 逐帧读取矿池发送的 ex-message 和 JSON 行（分帧方式见 UpSessionBase.go）
 func (up *UpSessionBTC) handleResponse() {
 	up.readLoopRunning = true
 	for up.readLoopRunning {
 		up.setReadDeadline()
 		magicNum, err := up.serverReader.Peek(1)
 		if err != nil {
-			glog.Error(up.id, "failed to read pool server response: ", err.Error())
+			Log.Error(up.id, "failed to read pool server response: ", err.Error())
 			up.connBroken()
 			return
 		}
@@ -537,12 +1134,12 @@ func (up *UpSessionBTC) readExMessage() {
 	message := new(ExMessage)
 	err := binary.Read(up.serverReader, binary.LittleEndian, &message.ExMessageHeader)
 	if err != nil {
-		glog.Error(up.id, "failed to read ex-message header from pool server: ", err.Error())
+		Log.Error(up.id, "failed to read ex-message header from pool server: ", err.Error())
 		up.connBroken()
 		return
 	}
 	if message.Size < 4 {
-		glog.Warning(up.id, "broken ex-message header from pool server: ", message.ExMessageHeader)
+		Log.Warning(up.id, "broken ex-message header from pool server: ", message.ExMessageHeader)
 		up.connBroken()
 		return
 	}
@@ -552,14 +1149,14 @@ func (up *UpSessionBTC) readExMessage() {
 		message.Body = make([]byte, size)
 		_, err = io.ReadFull(up.serverReader, message.Body)
 		if err != nil {
-			glog.Error(up.id, "failed to read ex-message body from pool server: ", err.Error())
+			Log.Error(up.id, "failed to read ex-message body from pool server: ", err.Error())
 			up.connBroken()
 			return
 		}
 	}
 
-	if glog.V(9) {
-		glog.Info(up.id, "readExMessage: ", message.ExMessageHeader.Type, " ", hex.EncodeToString(message.Body))
+	if glog.V(9) || LogExMessage.V(9) {
+		Log.Info(up.id, "readExMessage: ", message.ExMessageHeader.Type, " len=", message.ExMessageHeader.Size, " ", hex.EncodeToString(message.Body))
 	}
 	up.SendEvent(EventRecvExMessage{message})
 }
@@ -567,19 +1164,31 @@ func (up *UpSessionBTC) readExMessage() {
 func (up *UpSessionBTC) readLine() {
 	jsonBytes, err := up.serverReader.ReadBytes('\n')
 	if err != nil {
-		glog.Error(up.id, "failed to read JSON line from pool server: ", err.Error())
+		if err == io.EOF && len(jsonBytes) > 0 {
+			// 矿池发送最后一行后立即断开时，该行可能没有换行符。其中是完整的 JSON 时（如认证响应）先处理，再按断开处理
+			if rpcData, e := NewJSONRPCLineBTC(jsonBytes); e == nil {
+				Log.Info(up.id, "pool server closed the connection right after a line without newline: ", string(jsonBytes))
+				up.SendEvent(EventRecvJSONRPCBTC{rpcData, append(jsonBytes, '\n')})
+			}
+		}
+		Log.Error(up.id, "failed to read JSON line from pool server: ", err.Error())
 		up.connBroken()
 		return
 	}
-	if glog.V(9) {
-		glog.Info(up.id, "readLine: ", string(jsonBytes))
+	if glog.V(9) || LogJSONRPC.V(9) {
+		Log.Info(up.id, "readLine: ", string(jsonBytes))
 	}
 
 	rpcData, err := NewJSONRPCLineBTC(jsonBytes)
 
 	// ignore the json decode error
 	if err != nil {
-		glog.Info(up.id, "failed to decode JSON line from pool server: ", err.Error(), "; ", string(jsonBytes))
+		if misframedPoolLine(jsonBytes) {
+			Log.Error(up.id, "ex-message inside a JSON line from pool server, the stream is misframed: ", hex.EncodeToString(jsonBytes))
+			up.connBroken()
+			return
+		}
+		Log.Info(up.id, "failed to decode JSON line from pool server: ", err.Error(), "; ", string(jsonBytes))
 		return
 	}
 
@@ -587,11 +1196,15 @@ func (up *UpSessionBTC) readLine() {
 }
 
 func (up *UpSessionBTC) Run() {
+	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
+		go up.expireSubmitIDsTicker()
+	}
+
 	up.handleEvent()
 }
 
 func (up *UpSessionBTC) SendEvent(event interface{}) {
-	up.eventChannel <- event
+	sendEventWithPolicy(up.ctx, up.eventChannel, event, up.config, up.manager.parent.metrics)
 }
 
 func (up *UpSessionBTC) addDownSession(e EventAddDownSession) {
@@ -599,12 +1212,36 @@ func (up *UpSessionBTC) addDownSession(e EventAddDownSession) {
 	up.downSessions[down.sessionID] = down
 	up.registerWorker(down)
 
-	if up.rpcSetVersionMask != nil && down.versionMask != 0 {
-		down.SendEvent(EventSendBytes{up.rpcSetVersionMask})
+	if versionMask := down.loadVersionMask(); up.rpcSetVersionMask != nil && versionMask != 0 {
+		if up.serverCapVersionRolling && up.versionMask != 0 && bits.OnesCount32(versionMask&up.versionMask) < up.versionRollingMinBitCount {
+			// 矿机可滚动的位数少于矿池的要求，让矿机停止滚动版本位，以免 share 被拒绝。
+			// 矿机此后被当作不滚动版本位的矿机，不再转发版本掩码，也不会被当作 AsicBoost 丢失而要求重连。
+			Log.Warning(up.id, "miner ", down.fullName, " can only roll ", bits.OnesCount32(versionMask&up.versionMask),
+				" version bits, fewer than min-bit-count ", up.versionRollingMinBitCount, " of pool server, disable its version rolling")
+			down.storeVersionMask(0)
+			down.SendEvent(EventSetVersionMask{0, []byte(`{"id":null,"method":"mining.set_version_mask","params":["00000000"]}` + "\n")})
+		} else {
+			down.SendEvent(EventSetVersionMask{up.versionMask, up.rpcSetVersionMask})
+		}
 	}
 
 	if up.rpcSetDifficulty != nil {
-		down.SendEvent(EventSendBytes{up.rpcSetDifficulty})
+		down.SendEvent(EventSetDifficultyBTC{up.difficulty, up.rpcSetDifficulty})
+		up.reportMinerDifficulty([]uint16{down.sessionID}, up.difficulty, up.difficultyClamp.allPoolDiff)
+	} else if diff := up.downSessionInitialDifficulty(down); diff > 0 {
+		// 矿池尚未发送难度，先使用矿机建议的或配置的初始难度
+		diff = up.config.ClampDifficulty(diff)
+		bytes, err := up.getSetDifficultyLine(diff)
+		if err == nil {
+			down.SendEvent(EventSetDifficultyBTC{diff, bytes})
+			up.reportMinerDifficulty([]uint16{down.sessionID}, diff, 0)
+		} else {
+			Log.Error(up.id, "failed to convert mining.set_difficulty request to JSON: ", err.Error())
+		}
+	}
+
+	if up.rpcSetGoal != nil {
+		down.SendEvent(EventSetGoal{up.rpcSetGoal})
 	}
 
 	if up.lastJob != nil {
@@ -612,82 +1249,254 @@ func (up *UpSessionBTC) addDownSession(e EventAddDownSession) {
 		if err == nil {
 			down.SendEvent(EventSendBytes{bytes})
 		} else {
-			glog.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", up.lastJob)
+			Log.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", up.lastJob)
 		}
 	}
 }
 
 func (up *UpSessionBTC) registerWorker(down *DownSessionBTC) {
-	msg := ExMessageRegisterWorker{down.sessionID, down.clientAgent, down.workerName}
+	if up.skipCapabilities() {
+		// 普通 stratum 协议没有矿机注册，所有 share 都以子账户的名义提交
+		return
+	}
+	// 矿机在 mining.subscribe 中提供的挖矿软件名称，便于矿池按固件统计
+	msg := ExMessageRegisterWorker{down.sessionID, FilterClientAgent(down.clientAgent, RegisterWorkerMaxClientAgentLength), down.workerName}
 	_, err := up.writeExMessage(&msg)
 	if err != nil {
-		glog.Error(up.id, "failed to register worker to pool server: ", err.Error())
+		Log.Error(up.id, "failed to register worker to pool server: ", err.Error())
 		up.close()
 	}
 }
 
 func (up *UpSessionBTC) unregisterWorker(sessionID uint16) {
+	if up.skipCapabilities() {
+		return
+	}
 	msg := ExMessageUnregisterWorker{sessionID}
 	_, err := up.writeExMessage(&msg)
 	if err != nil {
-		glog.Error(up.id, "failed to unregister worker from pool server: ", err.Error())
+		Log.Error(up.id, "failed to unregister worker from pool server: ", err.Error())
+		up.close()
+	}
+}
+
+// forwardDeclaredHashrate 将矿机声明的算力转发给矿池（forward_declared_hashrate）
+func (up *UpSessionBTC) forwardDeclaredHashrate(e EventDeclaredHashrate) {
+	if _, ok := up.downSessions[e.SessionID]; !ok || !up.serverCapSubmitHashrate {
+		return
+	}
+	msg := ExMessageSubmitHashrate{e.SessionID, declaredHashrateUint64(e.Hashrate)}
+	_, err := up.writeExMessage(&msg)
+	if err != nil {
+		Log.Error(up.id, "failed to forward declared hashrate to pool server: ", err.Error())
 		up.close()
 	}
 }
 
 func (up *UpSessionBTC) handleMiningNotify(rpcData *JSONRPCLineBTC, jsonBytes []byte) {
-	job, err := NewStratumJobBTC(rpcData, up.sessionID)
+	if up.isNiceHash() && len(rpcData.Params) > 9 {
+		// 任务的最后附带了目标值，先转发难度，并从任务中去掉它
+		if target, ok := rpcData.Params[9].(string); ok {
+			diff, err := TargetToDiffBTC(target)
+			if err != nil {
+				Log.Warning(up.id, "failed to convert target in mining.notify to difficulty: ", err.Error(), "; ", string(jsonBytes))
+			} else {
+				up.setPoolDifficulty(diff)
+			}
+		}
+		rpcData.Params = rpcData.Params[:9]
+	}
+
+	job, err := NewStratumJobBTC(rpcData, up.extraNonce1)
 	if err != nil {
-		glog.Warning(up.id, err.Error(), ": ", string(jsonBytes))
+		Log.Warning(up.id, err.Error(), ": ", string(jsonBytes))
 		return
 	}
+	if up.difficultyClamp.multiplier > 1 || up.config.DifficultyClamp.Max > 0 {
+		up.addRecentJob(job)
+	}
 
-	bytes, err := job.ToNotifyLine(false)
+	if up.config.Advanced.CoalesceMiningNotify {
+		// 先排队，处理完通道中已有的事件后再广播，以便合并连续到达的任务
+		up.pendingJobs = append(up.pendingJobs, job)
+		if len(up.pendingJobs) == 1 {
+			go up.SendEvent(EventBroadcastNotify{})
+		}
+		return
+	}
+
+	up.broadcastJobs([]*StratumJobBTC{job})
+}
+
+// addRecentJob 保存最近的任务，clean_jobs 为 true 时之前的任务全部失效
+func (up *UpSessionBTC) addRecentJob(job *StratumJobBTC) {
+	if job.IsClean() {
+		up.recentJobs = make(map[string]*StratumJobBTC)
+		up.recentJobIDs = nil
+	}
+	jobID, _ := job.Params[0].(string)
+	if _, ok := up.recentJobs[jobID]; !ok {
+		up.recentJobIDs = append(up.recentJobIDs, jobID)
+	}
+	up.recentJobs[jobID] = job
+	if len(up.recentJobIDs) > UpSessionRecentJobsBTC {
+		delete(up.recentJobs, up.recentJobIDs[0])
+		up.recentJobIDs = up.recentJobIDs[1:]
+	}
+}
+
+// checkPoolDifficulty 是否在本地检查 sessionID 对应矿机的 share 满足矿池难度：
+// 设置了 difficulty_multiplier，或者矿机的难度被 difficulty_clamp 调低而矿池不知道该难度（未设置 report_difficulty）
+func (up *UpSessionBTC) checkPoolDifficulty(sessionID uint16) bool {
+	if up.difficultyClamp.multiplier > 1 {
+		return true
+	}
+	return up.difficultyClamp.Lowered(sessionID) && !up.config.PoolReportDifficulty(up.poolIndex)
+}
+
+// meetPoolDifficulty 检查 share 是否满足矿池为矿机设置的难度。
+// 矿池难度或任务未知、无法计算哈希时交给矿池判断。
+func (up *UpSessionBTC) meetPoolDifficulty(msg *ExMessageSubmitShareBTC) bool {
+	meet, known := up.meetDifficulty(msg, up.difficultyClamp.PoolDifficulty(msg.Base.SessionID))
+	return meet || !known
+}
+
+// meetClampedDifficulty 矿机的难度被 difficulty_clamp 调低到矿池难度以下时，检查 share 是否满足矿机收到的难度。
+// 无法计算哈希时返回 false，矿池的拒绝原样响应给矿机。
+func (up *UpSessionBTC) meetClampedDifficulty(msg *ExMessageSubmitShareBTC) bool {
+	if !up.difficultyClamp.Lowered(msg.Base.SessionID) {
+		return false
+	}
+	meet, known := up.meetDifficulty(msg, up.difficultyClamp.MinerDifficulty(up.difficultyClamp.PoolDifficulty(msg.Base.SessionID)))
+	return meet && known
+}
+
+// meetDifficulty 检查 share 是否满足难度 diff，难度或任务未知、无法计算哈希时 known 为 false
+func (up *UpSessionBTC) meetDifficulty(msg *ExMessageSubmitShareBTC, diff uint64) (meet bool, known bool) {
+	job := up.recentJobs[msg.JobIDString]
+	if diff < 1 || job == nil {
+		return
+	}
+	extraNonce2 := DownSessionExtraNonce1BTC(msg.Base.SessionID) + Uint32ToHex(msg.Base.ExtraNonce2)
+	hash, err := job.ShareHash(extraNonce2, msg.Time, msg.Base.Nonce, msg.VersionMask, up.versionMask)
 	if err != nil {
-		glog.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", string(jsonBytes))
+		Log.Warning(up.id, "failed to compute hash of share: ", err.Error(), "; ", job.Params)
+		return
+	}
+	return MeetDifficultyBTC(&hash, diff), true
+}
+
+// broadcastJobs 将任务按顺序广播给所有矿机
+func (up *UpSessionBTC) broadcastJobs(jobs []*StratumJobBTC) {
+	// 任务只序列化一次，所有矿机共享同一个事件
+	firstJob := up.lastJob == nil
+	events := make([]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		bytes, err := job.ToNotifyLine(false)
+		if err != nil {
+			Log.Warning(up.id, "failed to convert job to JSON: ", err.Error(), "; ", job.Params)
+			continue
+		}
+		events = append(events, EventMiningNotifyBTC{bytes})
+		up.lastJob = job
+	}
+	if len(events) < 1 {
 		return
 	}
+	if firstJob && up.config.Advanced.PoolWarmupSeconds > 0 {
+		up.manager.SendEvent(EventUpSessionWarmedUp{up.slot, up, false})
+	}
 
+	// 矿机不在事件循环中发送，某台矿机写入失败或卡住只会影响它自己，不影响其他矿机和矿池连接
+	targets := make([]broadcastTarget, 0, len(up.downSessions))
 	for _, down := range up.downSessions {
-		go down.SendEvent(EventSendBytes{bytes})
+		targets = append(targets, down)
 	}
+	broadcastEvents(up.ctx, targets, events)
+}
 
-	up.lastJob = job
+// broadcastPendingJobs 广播排队中的任务。
+// clean_jobs 为 true 的任务使之前的任务全部失效，因此只广播最后一个这样的任务及其后的任务；
+// 不带 clean_jobs 的任务不会使之前的任务失效，不能丢弃。
+func (up *UpSessionBTC) broadcastPendingJobs() {
+	jobs := up.pendingJobs
+	up.pendingJobs = nil
+
+	start := 0
+	for i, job := range jobs {
+		if job.IsClean() {
+			start = i
+		}
+	}
+	if start > 0 && glog.V(3) {
+		Log.Info(up.id, "coalesce mining.notify: ", start, " jobs are superseded by a clean job")
+	}
+
+	up.broadcastJobs(jobs[start:])
 }
 
 func (up *UpSessionBTC) recvJSONRPC(e EventRecvJSONRPCBTC) {
 	rpcData := e.RPCData
 	jsonBytes := e.JSONBytes
 
-	if len(rpcData.Method) > 0 {
-		switch rpcData.Method {
+	// 带有方法名的消息总是通知（或矿池发起的请求），即使 id 不为 null 也不会被当作响应
+	method := NormalizeMethod(rpcData.Method)
+	if len(method) > 0 {
+		if method != "mining.notify" && len(up.pendingJobs) > 0 {
+			// 按矿池发送的顺序转发给矿机
+			up.broadcastPendingJobs()
+		}
+
+		switch method {
 		case "mining.set_version_mask":
 			up.handleSetVersionMask(rpcData, jsonBytes)
 		case "mining.set_difficulty":
 			up.handleSetDifficulty(rpcData, jsonBytes)
+		case "mining.set_target":
+			up.handleSetTarget(rpcData, jsonBytes)
 		case "mining.notify":
 			up.handleMiningNotify(rpcData, jsonBytes)
+		case "mining.set_goal":
+			up.handleSetGoal(rpcData, jsonBytes)
 		default:
-			glog.Info(up.id, "[TODO] pool request: ", rpcData)
+			up.handleUnknownRequest(rpcData, jsonBytes)
 		}
 		return
 	}
 
-	switch rpcData.ID {
+	id, ok := JSONRPCResponseID(rpcData.ID, up.config.PoolNumericRequestID(up.poolIndex))
+	if !ok {
+		logUnknownPoolMessage(up.config, up.id, "response", rpcData, jsonBytes)
+		return
+	}
+
+	switch id {
 	case "caps":
+		up.handshake.receive(HandshakeGetCapabilities)
 		up.handleGetCapsResponse(rpcData, jsonBytes)
 	case "conf":
+		up.handshake.receive(HandshakeConfigure)
 		up.handleConfigureResponse(rpcData, jsonBytes)
 	case "sub":
+		up.handshake.receive(HandshakeSubscribe)
 		up.handleSubScribeResponse(rpcData, jsonBytes)
 	case "auth":
+		up.handshake.receive(HandshakeAuthorize)
 		up.handleAuthorizeResponse(rpcData, jsonBytes)
 	case "caps_again":
 		// ignore
+	case "submit":
+		// ignore
+	case "suggest_diff":
+		// ignore
 	case "conn_test":
 		// ignore
 	default:
-		glog.Info(up.id, "[TODO] pool response: ", rpcData)
+		if strings.HasPrefix(id, "submit:") {
+			up.handleSubmitResponse(id, rpcData, jsonBytes)
+			return
+		}
+		logUnknownPoolMessage(up.config, up.id, "response", rpcData, jsonBytes)
 	}
 }
 
@@ -697,20 +1506,180 @@ func (up *UpSessionBTC) handleSubmitShare(e EventSubmitShareBTC) {
 		return
 	}
 
-	_, err := up.writeExMessage(e.Message)
+	// 退出或 drain 时不再提交新的 share，以便在 shutdown_submit_grace_seconds 内等到已提交的 share 的响应
+	if up.manager.parent.SubmitsStopped() {
+		if glog.V(3) {
+			Log.Info(up.id, "submits are stopped, reject share of miner #", e.Message.Base.SessionID)
+		}
+		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_INTERNAL_ERROR)
+		return
+	}
+
+	// 滚动了掩码之外的版本位的 share 会被矿池拒绝，甚至可能导致连接被惩罚。
+	// 矿池不允许滚动版本位（掩码为 0）时所有版本位都在掩码之外，矿机收到空掩码之前提交的 share 也会走到这里。
+	// 尚未从 mining.configure 或 mining.set_version_mask 得到掩码时不知道哪些位是允许的，交给矿池判断。
+	if illegalBits := e.Message.VersionMask &^ up.versionMask; illegalBits != 0 && up.rpcSetVersionMask != nil {
+		allowed := fmt.Sprintf("%08x", up.versionMask)
+		if up.versionMask == 0 {
+			allowed += " (version rolling not allowed by pool server)"
+		}
+		if up.config.Advanced.RejectIllegalVersionMask {
+			Log.Warning(up.id, "reject share of session ", e.Message.Base.SessionID, ": version bits ", fmt.Sprintf("%08x", e.Message.VersionMask),
+				" outside the allowed mask ", allowed)
+			up.manager.parent.metrics.IllegalVersionBits.Inc("action", "rejected")
+			up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ILLEGAL_VERMASK)
+			return
+		}
+		Log.Warning(up.id, "correct share of session ", e.Message.Base.SessionID, ": strip version bits ", fmt.Sprintf("%08x", illegalBits),
+			" of ", fmt.Sprintf("%08x", e.Message.VersionMask), " outside the allowed mask ", allowed)
+		up.manager.parent.metrics.IllegalVersionBits.Inc("action", "corrected")
+		e.Message.VersionMask &= up.versionMask
+	}
+
+	// 不满足矿池难度的 share 不提交给矿池，以免被矿池拒绝甚至惩罚连接：
+	// 矿机的难度高于矿池难度（difficulty_multiplier）时，正常情况下 share 都满足矿池难度，不满足的在本地拒绝；
+	// 矿机的难度被 difficulty_clamp 调低时，满足矿机难度的在本地接受。
+	// 设置了 report_difficulty 时矿池按报告的矿机难度判断，照常提交。
+	if up.checkPoolDifficulty(e.Message.Base.SessionID) && !up.meetPoolDifficulty(e.Message) {
+		if up.meetClampedDifficulty(e.Message) {
+			if glog.V(3) {
+				Log.Info(up.id, "share of session ", e.Message.Base.SessionID, " meets the lowered difficulty but not pool difficulty ",
+					up.difficultyClamp.PoolDifficulty(e.Message.Base.SessionID), ", accept it locally")
+			}
+			up.manager.parent.metrics.ClampedSubmits.Inc()
+			up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
+			return
+		}
+		if glog.V(3) {
+			Log.Info(up.id, "share of session ", e.Message.Base.SessionID, " does not meet pool difficulty ", up.difficultyClamp.PoolDifficulty(e.Message.Base.SessionID))
+		}
+		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_LOW_DIFFICULTY)
+		return
+	}
+
+	if up.skipCapabilities() {
+		up.submitShareJSON(e)
+		return
+	}
+
+	_, err := up.writeSubmitExMessage(e.Message)
+	if err == nil {
+		up.addForwardedShare(e.Message.Base.SessionID)
+	}
 
 	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
-		up.submitIDs[up.submitIndex] = SubmitID{e.ID, e.Message.Base.SessionID}
-		up.submitIndex++
+		// 矿池按收到的顺序为 share 编号，因此每个写出的 share 都要分配序号
+		index, evicted := up.submitIDs.Add(e.ID, e.Message.Base.SessionID, e.Time)
+		if up.meetClampedDifficulty(e.Message) {
+			up.submitIDs.SetMeetsClampedDifficulty(index)
+		}
+		if evicted != nil {
+			Log.Warning(up.id, "too many shares without responses from pool server, respond to session ", evicted.SessionID, " locally")
+			up.manager.parent.metrics.UnconfirmedSubmits.Inc("reason", "evicted")
+			up.sendSubmitResponse(evicted.SessionID, evicted.ID, STATUS_ACCEPT)
+		}
 	} else {
 		up.sendSubmitResponse(e.Message.Base.SessionID, e.ID, STATUS_ACCEPT)
 	}
 
 	if err != nil {
-		glog.Error(up.id, "failed to submit share: ", err.Error())
+		Log.Error(up.id, "failed to submit share: ", err.Error())
+		up.close()
+		return
+	}
+}
+
+// submitWorkerName 跳过能力协商时 mining.submit 中的矿工名。
+// 默认以子账户的名义提交；为矿池配置了矿工名的格式时，按格式带上矿机名，使矿池按矿机统计。
+// 同一连接上认证了多个矿工时，workerName 为提交 share 的矿工的矿机名。
+func (up *UpSessionBTC) submitWorkerName(sessionID uint16, workerName string) string {
+	if !up.config.PoolFormatWorkerNames(up.poolIndex) {
+		return up.subAccount
+	}
+	if len(workerName) < 1 {
+		down, ok := up.downSessions[sessionID]
+		if !ok {
+			return up.subAccount
+		}
+		workerName = down.workerName
+	}
+	return up.config.PoolWorkerName(up.poolIndex, up.subAccount, workerName)
+}
+
+// submitShareJSON 跳过能力协商时通过 mining.submit 提交 share
+func (up *UpSessionBTC) submitShareJSON(e EventSubmitShareBTC) {
+	msg := e.Message
+
+	// 矿池的 extranonce2 由矿机的 extranonce1（会话ID）和矿机的 extranonce2 组成
+	params := JSONRPCArray{up.submitWorkerName(msg.Base.SessionID, e.WorkerName), msg.JobIDString, DownSessionExtraNonce1BTC(msg.Base.SessionID) + Uint32ToHex(msg.Base.ExtraNonce2),
+		Uint32ToHex(msg.Time), Uint32ToHex(msg.Base.Nonce)}
+	if msg.VersionMask != 0 {
+		params = append(params, Uint32ToHex(msg.VersionMask))
+	}
+
+	var request JSONRPCRequest
+	request.ID = "submit"
+	request.Method = "mining.submit"
+	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
+		// 在请求 ID 中带上序号，以便找到矿池响应对应的矿机请求
+		index, evicted := up.submitIDs.Add(e.ID, msg.Base.SessionID, e.Time)
+		if up.meetClampedDifficulty(msg) {
+			up.submitIDs.SetMeetsClampedDifficulty(index)
+		}
+		if evicted != nil {
+			Log.Warning(up.id, "too many shares without responses from pool server, respond to session ", evicted.SessionID, " locally")
+			up.manager.parent.metrics.UnconfirmedSubmits.Inc("reason", "evicted")
+			up.sendSubmitResponse(evicted.SessionID, evicted.ID, STATUS_ACCEPT)
+		}
+		request.ID = fmt.Sprintf("submit:%d", index)
+	} else {
+		up.sendSubmitResponse(msg.Base.SessionID, e.ID, STATUS_ACCEPT)
+	}
+	request.SetParams(params...)
+
+	_, err := up.writeJSONRequest(&request)
+	if err != nil {
+		Log.Error(up.id, "failed to submit share: ", err.Error())
 		up.close()
 		return
 	}
+	up.addForwardedShare(msg.Base.SessionID)
+}
+
+// addForwardedShare 按矿机的子账户统计转发给矿池的 share
+func (up *UpSessionBTC) addForwardedShare(sessionID uint16) {
+	subAccount := up.subAccount
+	if down, ok := up.downSessions[sessionID]; ok {
+		subAccount = down.subAccountName
+	}
+	up.manager.parent.shareStats.AddForwarded(subAccount)
+}
+
+// handleSubmitResponse 处理矿池对 mining.submit 的响应
+func (up *UpSessionBTC) handleSubmitResponse(id string, rpcData *JSONRPCLineBTC, jsonBytes []byte) {
+	index, err := strconv.ParseUint(strings.TrimPrefix(id, "submit:"), 10, 16)
+	if err != nil {
+		Log.Error(up.id, "wrong id of mining.submit response: ", string(jsonBytes))
+		return
+	}
+	submitID, ok := up.submitIDs.Remove(uint16(index))
+	if !ok {
+		// 可能已超时并在本地响应过了
+		Log.Error(up.id, "cannot find submit id ", index, " in mining.submit response: ", string(jsonBytes))
+		return
+	}
+
+	status := STATUS_ACCEPT
+	if accepted, _ := rpcData.Result.(bool); !accepted || rpcData.Error != nil {
+		status = STATUS_REJECT_NO_REASON
+		if code, _, ok := ParseJSONRPCError(rpcData.Error); ok && code != 0 {
+			status = StratumStatus(code)
+		}
+	}
+
+	up.manager.parent.metrics.SubmitResponseSeconds.Observe(time.Since(submitID.Time).Seconds())
+	up.sendSubmitResponse(submitID.SessionID, submitID.ID, up.clampedSubmitStatus(submitID, status))
+	up.checkWaitingSubmits()
 }
 
 func (up *UpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{}, status StratumStatus) {
@@ -718,88 +1687,284 @@ func (up *UpSessionBTC) sendSubmitResponse(sessionID uint16, id interface{}, sta
 	if !ok {
 		// 客户端已断开，忽略
 		if glog.V(3) {
-			glog.Info(up.id, "cannot find down session: ", sessionID)
+			Log.Info(up.id, "cannot find down session: ", sessionID)
 		}
 		return
 	}
-	go down.SendEvent(EventSubmitResponse{id, status})
+	if up.waitingSubmits != nil {
+		// 等待结束后代理随即退出，在此之前必须把响应放入矿机的事件通道
+		down.SendEvent(EventSubmitResponse{id, status, false})
+		return
+	}
+	go down.SendEvent(EventSubmitResponse{id, status, false})
+}
+
+// waitSubmits 退出或 drain 时等待矿池响应已提交的 share，此前已停止提交新的 share（见 handleSubmitShare）
+func (up *UpSessionBTC) waitSubmits(e EventWaitSubmits) {
+	up.waitingSubmits = &e
+	if up.submitIDs.Len() > 0 {
+		time.AfterFunc(time.Until(e.Deadline), func() { up.SendEvent(EventWaitSubmitsTimeout{}) })
+	}
+	up.checkWaitingSubmits()
+}
+
+// checkWaitingSubmits 已提交的 share 都得到响应后结束等待
+func (up *UpSessionBTC) checkWaitingSubmits() {
+	if up.waitingSubmits != nil && up.submitIDs.Len() < 1 {
+		up.waitingSubmits.Response <- 0
+		up.waitingSubmits = nil
+	}
+}
+
+// waitSubmitsTimeout 到期仍未响应的 share 在本地响应为失败
+func (up *UpSessionBTC) waitSubmitsTimeout() {
+	if up.waitingSubmits == nil {
+		return
+	}
+	remaining := up.submitIDs.RemoveAll()
+	Log.Warning(up.id, len(remaining), " shares are not responded by pool server in time, respond to miners locally")
+	for _, submitID := range remaining {
+		up.sendSubmitResponse(submitID.SessionID, submitID.ID, STATUS_INTERNAL_ERROR)
+	}
+	up.waitingSubmits.Response <- len(remaining)
+	up.waitingSubmits = nil
 }
 
 func (up *UpSessionBTC) handleExMessageSubmitResponse(ex *ExMessage) {
 	if !up.config.SubmitResponseFromServer || !up.serverCapSubmitResponse {
-		glog.Error(up.id, "unexpected ex-message CMD_SUBMIT_RESPONSE from pool server")
+		Log.Error(up.id, "unexpected ex-message CMD_SUBMIT_RESPONSE from pool server")
 		return
 	}
 
 	var msg ExMessageSubmitResponse
 	err := msg.Unserialize(ex.Body)
 	if err != nil {
-		glog.Error(up.id, "failed to decode ex-message CMD_SUBMIT_RESPONSE: ", err.Error(), "; ", ex)
+		Log.Error(up.id, "failed to decode ex-message CMD_SUBMIT_RESPONSE: ", err.Error(), "; ", ex)
 		return
 	}
 
-	submitID, ok := up.submitIDs[msg.Index]
+	submitID, ok := up.submitIDs.Remove(msg.Index)
 	if !ok {
-		glog.Error(up.id, "cannot find submit id ", msg.Index, " in ex-message CMD_SUBMIT_RESPONSE: ", msg)
+		// 可能已超时并在本地响应过了
+		Log.Error(up.id, "cannot find submit id ", msg.Index, " in ex-message CMD_SUBMIT_RESPONSE: ", msg)
 		return
 	}
-	delete(up.submitIDs, msg.Index)
 
-	up.sendSubmitResponse(submitID.SessionID, submitID.ID, msg.Status)
+	up.manager.parent.metrics.SubmitResponseSeconds.Observe(time.Since(submitID.Time).Seconds())
+	up.sendSubmitResponse(submitID.SessionID, submitID.ID, up.clampedSubmitStatus(submitID, msg.Status))
+	up.checkWaitingSubmits()
+}
+
+// clampedSubmitStatus 按 difficulty_clamp 获取响应给矿机的 share 提交结果
+func (up *UpSessionBTC) clampedSubmitStatus(submitID SubmitID, status StratumStatus) StratumStatus {
+	status, clamped := up.difficultyClamp.SubmitStatus(submitID, status)
+	if clamped {
+		up.manager.parent.metrics.ClampedSubmits.Inc()
+	}
+	return status
+}
+
+// expireSubmitIDsTicker 定期清理矿池超时未响应的 share。每个超时时间内检查多次，以免 share 等待接近两倍的超时时间。
+func (up *UpSessionBTC) expireSubmitIDsTicker() {
+	ticker := time.NewTicker(up.config.Advanced.PoolSubmitResponseTimeoutSeconds.Get() / UpSessionSubmitResponseExpireChecks)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-up.ctx.Done():
+			return
+		case <-ticker.C:
+			up.SendEvent(EventExpireSubmitIDs{})
+		}
+	}
+}
+
+// expireSubmitIDs 矿池超时未响应的 share 在本地响应为接受，以免矿机一直等待。
+// 这些 share 的实际结果未知，单独计入 btcagent_unconfirmed_submits_total。
+func (up *UpSessionBTC) expireSubmitIDs() {
+	expired := up.submitIDs.Expire(time.Now())
+	if len(expired) < 1 {
+		return
+	}
+	up.manager.parent.metrics.UnconfirmedSubmits.Add(float64(len(expired)), "reason", "timeout")
+	Log.Warning(up.id, len(expired), " shares are not responded by pool server in ", up.config.Advanced.PoolSubmitResponseTimeoutSeconds, " seconds, respond to miners locally")
+	for _, submitID := range expired {
+		up.sendSubmitResponse(submitID.SessionID, submitID.ID, STATUS_ACCEPT)
+	}
+	up.checkWaitingSubmits()
+}
+
+// downSessionInitialDifficulty 矿机的初始难度，矿机通过 mining.suggest_difficulty 建议的难度优先
+func (up *UpSessionBTC) downSessionInitialDifficulty(down *DownSessionBTC) uint64 {
+	if down.suggestedDifficulty > 0 {
+		return down.suggestedDifficulty
+	}
+	return up.initialDifficulty()
+}
+
+func (up *UpSessionBTC) getSetDifficultyLine(diff uint64) ([]byte, error) {
+	var request JSONRPCRequest
+	request.Method = "mining.set_difficulty"
+	request.SetParams(diff)
+	return request.ToJSONBytesLine()
 }
 
 func (up *UpSessionBTC) handleExMessageMiningSetDiff(ex *ExMessage) {
 	var msg ExMessageMiningSetDiff
 	err := msg.Unserialize(ex.Body)
 	if err != nil {
-		glog.Error(up.id, "failed to decode ex-message CMD_MINING_SET_DIFF: ", err.Error(), "; ", ex)
+		Log.Error(up.id, "failed to decode ex-message CMD_MINING_SET_DIFF: ", err.Error(), "; ", ex)
 		return
 	}
 
-	diff := uint64(1) << msg.Base.DiffExp
+	poolDiff := uint64(1) << msg.Base.DiffExp
+	diff := up.difficultyClamp.MinerDifficulty(poolDiff)
+	if diff != poolDiff {
+		Log.Info(up.id, "difficulty ", poolDiff, " from pool server is adjusted to ", diff, " for ", len(msg.SessionIDs), " miners")
+	}
 
-	var request JSONRPCRequest
-	request.Method = "mining.set_difficulty"
-	request.SetParams(diff)
-	bytes, err := request.ToJSONBytesLine()
+	bytes, err := up.getSetDifficultyLine(diff)
 	if err != nil {
-		glog.Error(up.id, "failed to convert mining.set_difficulty request to JSON: ", err.Error(), "; ", request)
+		Log.Error(up.id, "failed to convert mining.set_difficulty request to JSON: ", err.Error(), "; ", diff)
 		return
 	}
 
-	e := EventSendBytes{bytes}
+	e := EventSetDifficultyBTC{diff, bytes}
+	sessionIDs := make([]uint16, 0, len(msg.SessionIDs))
 	for _, sessionID := range msg.SessionIDs {
 		down := up.downSessions[sessionID]
 		if down != nil {
+			up.difficultyClamp.ClampSession(sessionID, poolDiff)
+			sessionIDs = append(sessionIDs, sessionID)
 			go down.SendEvent(e)
 		} else {
 			// 客户端已断开，忽略
 			if glog.V(3) {
-				glog.Info(up.id, "cannot find down session: ", sessionID)
+				Log.Info(up.id, "cannot find down session: ", sessionID)
 			}
 		}
 	}
+	up.reportMinerDifficulty(sessionIDs, diff, poolDiff)
+}
+
+// handleExMessageMiningNotify 将 CMD_MINING_NOTIFY 转换为 JSON 的 mining.notify，
+// 之后与 JSON 的任务相同地处理（clean_jobs、coalesce_mining_notify 等）
+func (up *UpSessionBTC) handleExMessageMiningNotify(ex *ExMessage) {
+	var msg ExMessageMiningNotify
+	err := msg.Unserialize(ex.Body)
+	if err != nil {
+		Log.Error(up.id, "failed to decode ex-message CMD_MINING_NOTIFY: ", err.Error(), "; ", ex)
+		return
+	}
+
+	rpcData := JSONRPCLineBTC{Method: "mining.notify", Params: msg.Params()}
+	// 只用于日志
+	jsonBytes, _ := json.Marshal(&rpcData)
+	up.handleMiningNotify(&rpcData, jsonBytes)
+}
+
+// reportMinerDifficulty 设置了 report_difficulty 时，矿机的难度 diff 与矿池为其设置的难度 poolDiff（未知时为 0）不同，
+// 例如被 difficulty_clamp 调整过或矿池尚未设置难度时，通过 CMD_MINING_SET_DIFF 告诉矿池 sessionIDs 对应矿机的实际难度，
+// 以便矿池按矿机实际的难度统计 share。ex-message 中的难度只能是 2 的整数次幂，其他难度向下取整。
+func (up *UpSessionBTC) reportMinerDifficulty(sessionIDs []uint16, diff uint64, poolDiff uint64) {
+	if !up.config.PoolReportDifficulty(up.poolIndex) || len(sessionIDs) < 1 || diff < 1 {
+		return
+	}
+	diffExp := uint8(bits.Len64(diff) - 1)
+	if diff == poolDiff || uint64(1)<<diffExp == poolDiff {
+		return
+	}
+
+	for len(sessionIDs) > 0 {
+		count := len(sessionIDs)
+		if count > ExMessageMiningSetDiffMaxSessions {
+			count = ExMessageMiningSetDiffMaxSessions
+		}
+		var msg ExMessageMiningSetDiff
+		msg.Base.DiffExp = diffExp
+		msg.Base.Count = uint16(count)
+		msg.SessionIDs = sessionIDs[:count]
+		sessionIDs = sessionIDs[count:]
+
+		if glog.V(3) {
+			Log.Info(up.id, "report difficulty ", uint64(1)<<diffExp, " of ", count, " miners to pool server")
+		}
+		_, err := up.writeExMessage(&msg)
+		if err != nil {
+			Log.Error(up.id, "failed to report miner difficulty to pool server: ", err.Error())
+			up.close()
+			return
+		}
+	}
 }
 
 func (up *UpSessionBTC) recvExMessage(e EventRecvExMessage) {
+	if up.stat != StatAuthorized {
+		up.initRecvExMessage(e.Message)
+		return
+	}
+
 	switch e.Message.Type {
 	case CMD_SUBMIT_RESPONSE:
 		up.handleExMessageSubmitResponse(e.Message)
 	case CMD_MINING_SET_DIFF:
+		up.broadcastPendingJobs()
 		up.handleExMessageMiningSetDiff(e.Message)
+	case CMD_MINING_NOTIFY:
+		if !up.serverCapMiningNotify {
+			Log.Warning(up.id, "ex-message CMD_MINING_NOTIFY without capability ", CapMiningNotify, ", discard: ", e.Message)
+			return
+		}
+		up.handleExMessageMiningNotify(e.Message)
 	default:
-		glog.Error(up.id, "unknown ex-message: ", e.Message)
+		Log.Error(up.id, "unknown ex-message: ", e.Message)
+	}
+}
+
+// initRecvExMessage 处理认证成功前收到的 ex-message。
+// 会影响矿机的消息（如难度）暂存起来，认证成功后再处理，其他消息直接丢弃。
+func (up *UpSessionBTC) initRecvExMessage(message *ExMessage) {
+	switch message.Type {
+	case CMD_MINING_SET_DIFF:
+		if len(up.pendingExMessages) >= UpSessionMaxPendingExMessages {
+			Log.Warning(up.id, "too many ex-messages before authorized, discard: ", message)
+			return
+		}
+		if glog.V(2) {
+			Log.Info(up.id, "ex-message before authorized, process it later: ", message)
+		}
+		up.pendingExMessages = append(up.pendingExMessages, message)
+	case CMD_MINING_NOTIFY:
+		// 认证之前不接受 ex-message 形式的任务，即使能力协商已经完成
+		Log.Warning(up.id, "ex-message CMD_MINING_NOTIFY before authorized, discard: ", message)
+	default:
+		if glog.V(3) {
+			Log.Info(up.id, "ex-message before authorized, discard: ", message)
+		}
+	}
+}
+
+// processPendingExMessages 处理认证成功前暂存的 ex-message
+func (up *UpSessionBTC) processPendingExMessages() {
+	messages := up.pendingExMessages
+	up.pendingExMessages = nil
+	for _, message := range messages {
+		up.recvExMessage(EventRecvExMessage{message})
 	}
 }
 
 func (up *UpSessionBTC) downSessionBroken(e EventDownSessionBroken) {
 	delete(up.downSessions, e.SessionID)
+	up.difficultyClamp.Remove(e.SessionID)
 	up.unregisterWorker(e.SessionID)
 
 	if up.disconnectedMinerCounter == 0 {
 		go func() {
-			time.Sleep(1 * time.Second)
-			up.SendEvent(EventSendUpdateMinerNum{})
+			select {
+			case <-time.After(1 * time.Second):
+				up.SendEvent(EventSendUpdateMinerNum{})
+			case <-up.ctx.Done():
+			}
 		}()
 	}
 	up.disconnectedMinerCounter++
@@ -818,16 +1983,77 @@ func (up *UpSessionBTC) outdatedUpSessionConnection(e EventUpSessionConnection)
 	}
 }
 
+func (up *UpSessionBTC) getStatus(e EventGetUpSessionStatus) {
+	pool := up.config.Pools[up.poolIndex]
+	status := UpSessionStatus{
+		Slot:       up.slot,
+		Ready:      up.stat == StatAuthorized,
+		MinerNum:   len(up.downSessions),
+		Pool:       pool.Address(),
+		SubAccount: up.subAccount,
+		Stat:       up.stat.String(),
+		SessionID:  up.sessionID,
+	}
+	if !up.authorizedTime.IsZero() {
+		status.UptimeSeconds = uint64(time.Since(up.authorizedTime).Seconds())
+	}
+	if len(up.extraNonce1) > 0 {
+		status.ExtraNonce = up.extraNonceStatus()
+	}
+	if e.WithMiners {
+		status.Miners = make([]DownSessionStatus, 0, len(up.downSessions))
+		for _, down := range up.downSessions {
+			status.Miners = append(status.Miners, down.status())
+		}
+	}
+	e.Response <- status
+}
+
+// extraNonceStatus 矿池分配的 extranonce 的划分和会话ID的用量
+func (up *UpSessionBTC) extraNonceStatus() *ExtraNonceStatus {
+	sessionIDManager := up.manager.parent.sessionIDManager
+	status := &ExtraNonceStatus{
+		PoolExtraNonce1:      up.extraNonce1,
+		PoolExtraNonce2Size:  UpSessionExtraNonce2SizeBTC,
+		SessionIDSize:        UpSessionExtraNonce2SizeBTC - DownSessionExtraNonce2SizeBTC,
+		SessionIDBits:        bits.Len(uint(sessionIDManager.Capacity() - 1)),
+		MinerExtraNonce2Size: DownSessionExtraNonce2SizeBTC,
+		Sessions:             sessionIDManager.Count(),
+		MaxSessions:          sessionIDManager.Capacity(),
+	}
+	if percent := up.config.Advanced.SessionCapacityWarningPercent; percent > 0 {
+		status.CapacityWarning = status.Sessions*100 > status.MaxSessions*int(percent)
+	}
+	return status
+}
+
+// getDownSessions 获取该连接上的矿机（管理命令 kick），是否断开由矿机在自己的事件循环中判断
+func (up *UpSessionBTC) getDownSessions(e EventGetDownSessions) {
+	downSessions := make([]DownSession, 0, len(up.downSessions))
+	for _, down := range up.downSessions {
+		downSessions = append(downSessions, down)
+	}
+	e.Response <- downSessions
+}
+
 func (up *UpSessionBTC) handleEvent() {
 	up.eventLoopRunning = true
 	for up.eventLoopRunning {
-		event := <-up.eventChannel
+		var event interface{}
+		select {
+		case event = <-up.eventChannel:
+		case <-up.ctx.Done():
+			up.exit()
+			return
+		}
 
 		switch e := event.(type) {
 		case EventAddDownSession:
 			up.addDownSession(e)
 		case EventSubmitShareBTC:
 			up.handleSubmitShare(e)
+		case EventDeclaredHashrate:
+			up.forwardDeclaredHashrate(e)
 		case EventDownSessionBroken:
 			up.downSessionBroken(e)
 		case EventSendUpdateMinerNum:
@@ -837,13 +2063,27 @@ func (up *UpSessionBTC) handleEvent() {
 		case EventRecvExMessage:
 			up.recvExMessage(e)
 		case EventConnBroken:
-			up.close()
+			up.handleConnBroken()
 		case EventUpSessionConnection:
 			up.outdatedUpSessionConnection(e)
+		case EventGetUpSessionStatus:
+			up.getStatus(e)
+		case EventGetDownSessions:
+			up.getDownSessions(e)
+		case EventExpireSubmitIDs:
+			up.expireSubmitIDs()
+		case EventWaitSubmits:
+			up.waitSubmits(e)
+		case EventWaitSubmitsTimeout:
+			up.waitSubmitsTimeout()
+		case EventFlushSubmits:
+			up.flushSubmits()
+		case EventBroadcastNotify:
+			up.broadcastPendingJobs()
 		case EventExit:
 			up.exit()
 		default:
-			glog.Error(up.id, "unknown event: ", e)
+			Log.Error(up.id, "unknown event: ", e)
 		}
 	}
 }
@@ -0,0 +1,2898 @@
+package btcagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUpSessionBTC() *UpSessionBTC {
+	config := NewConfig()
+	config.MultiUserMode = true
+	config.sessionFactory = new(SessionFactoryBTC)
+	manager := NewUpSessionManager("test", "", config, NewSessionManager(config))
+	return NewUpSessionBTC(manager, config, 0, 0)
+}
+
+func recvTestJSONRPCUpSessionBTC(t *testing.T, up *UpSessionBTC, line string) {
+	rpcData, err := NewJSONRPCLineBTC([]byte(line))
+	if err != nil {
+		t.Fatalf("NewJSONRPCLineBTC failed: %s", err.Error())
+	}
+	up.recvJSONRPC(EventRecvJSONRPCBTC{rpcData, []byte(line)})
+}
+
+func TestUpSessionBTCMethodCaseInsensitive(t *testing.T) {
+	up := newTestUpSessionBTC()
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"Mining.Set_Difficulty ","params":[8192]}`)
+	if up.rpcSetDifficulty == nil {
+		t.Errorf("odd-cased mining.set_difficulty is not routed")
+	}
+
+	up = newTestUpSessionBTC()
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_difficulty_x","params":[8192]}`)
+	if up.rpcSetDifficulty != nil {
+		t.Errorf("unknown method is routed to mining.set_difficulty")
+	}
+}
+
+func TestUpSessionBTCNotificationAndResponseID(t *testing.T) {
+	// 带有方法名的消息按方法名分发，不会被当作响应
+	up := newTestUpSessionBTC()
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"caps","method":"mining.set_difficulty","params":[8192]}`)
+	if up.rpcSetDifficulty == nil {
+		t.Errorf("notification with id is not routed by method")
+	}
+
+	// 只有 id 完全匹配的响应才会被处理
+	caps := `"result":{"capabilities":["verrol"]},"error":null}`
+	for _, line := range []string{`{"id":null,` + caps, `{` + caps, `{"id":1,` + caps, `{"id":"Caps",` + caps} {
+		up = newTestUpSessionBTC()
+		recvTestJSONRPCUpSessionBTC(t, up, line)
+		if up.serverCapVersionRolling {
+			t.Errorf("%s should not be matched as the caps response", line)
+		}
+	}
+
+	up = newTestUpSessionBTC()
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"caps",`+caps)
+	if !up.serverCapVersionRolling {
+		t.Errorf("caps response is not matched")
+	}
+}
+
+func TestUpSessionBTCHandshakeTimeout(t *testing.T) {
+	// 矿池接受连接后不再响应任何请求
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptConnTest(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionDialTimeoutSeconds = 10
+	config.Advanced.PoolHandshakeTimeoutSeconds = 1
+
+	manager := NewUpSessionManager("", "", config, NewSessionManager(config))
+	up := NewUpSessionBTC(manager, config, 0, 0)
+
+	start := time.Now()
+	up.Init()
+	elapsed := time.Since(start)
+
+	if up.Stat() == StatAuthorized {
+		t.Errorf("stalled pool should not be authorized")
+	}
+	if elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("handshake should time out after 1 second, elapsed: %s", elapsed)
+	}
+}
+
+func TestUpSessionBTCNumericRequestID(t *testing.T) {
+	// 只接受数字 id 的矿池，收到字符串 id 时返回错误并断开。echoQuoted 不为 0 时把数字 id 作为字符串回显
+	var echoQuoted int32
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			var request struct {
+				ID     json.RawMessage `json:"id"`
+				Method string          `json:"method"`
+			}
+			json.Unmarshal(line, &request)
+			id := string(request.ID)
+			if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+				pool.WriteLine(conn, `{"id":`+id+`,"result":null,"error":[20,"id must be a number",null]}`)
+				return
+			}
+			if atomic.LoadInt32(&echoQuoted) != 0 {
+				id = `"` + id + `"`
+			}
+			switch request.Method {
+			case "agent.get_capabilities":
+				pool.WriteLine(conn, `{"id":`+id+`,"result":{"capabilities":["verrol","subres"]},"error":null}`)
+			case "mining.configure":
+				pool.WriteLine(conn, `{"id":`+id+`,"result":{"version-rolling":true,"version-rolling.mask":"1fffe000","version-rolling.min-bit-count":2},"error":null}`)
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":`+id+`,"result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+			case "mining.authorize":
+				pool.WriteLine(conn, `{"id":`+id+`,"result":true,"error":null}`)
+			}
+		}
+	})
+
+	connect := func(numeric bool) *UpSessionBTC {
+		config := pool.Config(new(SessionFactoryBTC))
+		config.Pools[0].Options.NumericRequestID = numeric
+		config.Advanced.PoolHandshakeTimeoutSeconds = 2
+		manager := NewUpSessionManager("", "", config, NewSessionManager(config))
+		up := NewUpSessionBTC(manager, config, 0, 0)
+		up.Init()
+		return up
+	}
+
+	up := connect(true)
+	if up.Stat() != StatAuthorized {
+		t.Errorf("handshake with numeric ids should complete, stat: %s", up.Stat())
+	}
+	if !up.serverCapVersionRolling || up.versionRollingMinBitCount != 2 || up.sessionID != 0x01000002 {
+		t.Errorf("responses with numeric ids are not handled: %v %d %08x", up.serverCapVersionRolling, up.versionRollingMinBitCount, up.sessionID)
+	}
+	up.close()
+
+	atomic.StoreInt32(&echoQuoted, 1)
+	up = connect(true)
+	if up.Stat() != StatAuthorized || up.sessionID != 0x01000002 {
+		t.Errorf("responses with numeric ids echoed as strings are not handled, stat: %s", up.Stat())
+	}
+	up.close()
+	atomic.StoreInt32(&echoQuoted, 0)
+
+	if up := connect(false); up.Stat() == StatAuthorized {
+		t.Errorf("pool should reject string ids")
+	}
+
+	// mining.submit 的序号与数字 id 相互转换
+	numericID := NumericRequestID("submit:65535")
+	bytes, _ := json.Marshal(JSONRPCRequest{ID: numericID})
+	var line JSONRPCLineBTC
+	json.Unmarshal(bytes, &line)
+	if id, ok := JSONRPCResponseID(decodeJSONRPCID(bytes, line.ID), true); !ok || id != "submit:65535" {
+		t.Errorf("wrong id of submit response: %s, %v", id, ok)
+	}
+	if _, ok := JSONRPCResponseID(json.Number("5"), false); ok {
+		t.Errorf("numeric ids should not be accepted without numeric_request_id")
+	}
+}
+
+func TestUpSessionBTCWriteTimeout(t *testing.T) {
+	// 矿池接受连接后从不读取数据
+	connected := make(chan net.Conn, 1)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		connected <- conn
+		time.Sleep(10 * time.Second)
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.WriteTimeoutSeconds = 1
+
+	conn, err := net.Dial("tcp", pool.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("connect to mock pool failed: %s", err.Error())
+	}
+	defer conn.Close()
+	<-connected
+
+	manager := NewUpSessionManager("", "", config, NewSessionManager(config))
+	up := NewUpSessionBTC(manager, config, 0, 0)
+	up.serverConn = conn
+	up.stat = StatAuthorized
+
+	// 数据量远超 socket 缓冲区，写入会一直阻塞到超时
+	start := time.Now()
+	_, err = up.writeBytes(make([]byte, 64*1024*1024))
+	elapsed := time.Since(start)
+
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("write should time out: %v", err)
+	}
+	if elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("write should time out after 1 second, elapsed: %s", elapsed)
+	}
+}
+
+// shortWriteConn 每次最多写出 maxWrite 字节且不返回错误，模拟短写
+type shortWriteConn struct {
+	net.Conn
+	maxWrite int
+	writes   int
+}
+
+func (conn *shortWriteConn) Write(b []byte) (int, error) {
+	conn.writes++
+	if conn.maxWrite == 0 {
+		return 0, nil
+	}
+	if len(b) > conn.maxWrite {
+		b = b[:conn.maxWrite]
+	}
+	return conn.Conn.Write(b)
+}
+
+func TestUpSessionBTCShortWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &shortWriteConn{Conn: server, maxWrite: 3}
+
+	up := newTestUpSessionBTC()
+	up.serverConn = conn
+	up.stat = StatAuthorized
+
+	request := JSONRPCRequest{ID: "auth", Method: "mining.authorize", Params: JSONRPCArray{"test", ""}}
+	line, _ := request.ToJSONBytesLine()
+	msg := ExMessageUnregisterWorker{0x1234}
+	frame := msg.Serialize()
+
+	received := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, len(line)+len(frame))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _ := io.ReadFull(client, data)
+		received <- data[:n]
+	}()
+
+	if n, err := up.writeJSONRequest(&request); err != nil || n != len(line) {
+		t.Errorf("writeJSONRequest failed: %d, %v", n, err)
+	}
+	if n, err := up.writeExMessage(&msg); err != nil || n != len(frame) {
+		t.Errorf("writeExMessage failed: %d, %v", n, err)
+	}
+	if data := <-received; !bytes.Equal(data, append(line, frame...)) {
+		t.Errorf("wrong data received: %q", data)
+	}
+	if conn.writes < len(line)/3 {
+		t.Errorf("writes should be split, got %d writes", conn.writes)
+	}
+
+	// 什么都没写出也没有出错时返回错误，调用方会断开连接
+	conn.maxWrite = 0
+	if _, err := up.writeBytes([]byte("{}\n")); err != io.ErrShortWrite {
+		t.Errorf("write without progress should fail: %v", err)
+	}
+}
+
+func TestNewAuthorizeError(t *testing.T) {
+	if err := NewAuthorizeError(true, nil); err != nil {
+		t.Errorf("true result without error should succeed: %v", err)
+	}
+
+	tests := []struct {
+		result    interface{}
+		rpcErr    interface{}
+		code      int
+		permanent bool
+	}{
+		{nil, []interface{}{float64(24), "Unauthorized worker", nil}, 24, true},
+		{false, []interface{}{float64(29), "Invalid username"}, 29, true},
+		{nil, map[string]interface{}{"code": float64(-1), "message": "server busy"}, -1, false},
+		{true, []interface{}{float64(20), "Other/Unknown"}, 20, false},
+		{nil, nil, 0, false},
+		{"true", nil, 0, false},
+	}
+	for _, test := range tests {
+		err := NewAuthorizeError(test.result, test.rpcErr)
+		if err == nil {
+			t.Errorf("NewAuthorizeError(%v, %v) should fail", test.result, test.rpcErr)
+			continue
+		}
+		if err.Code != test.code || err.Permanent != test.permanent {
+			t.Errorf("NewAuthorizeError(%v, %v) = %v, want code %d, permanent %v", test.result, test.rpcErr, err, test.code, test.permanent)
+		}
+	}
+}
+
+func TestUpSessionBTCAuthorizeResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	up := newTestUpSessionBTC()
+	up.serverConn = server
+	up.stat = StatSubScribed
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"auth","result":null,"error":[201,"Sub-account banned",null]}`)
+	if up.Stat() == StatAuthorized || up.AuthorizeError() == nil || !up.AuthorizeError().Permanent {
+		t.Errorf("null result with error should fail: %v, %v", up.Stat(), up.AuthorizeError())
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+
+	up = newTestUpSessionBTC()
+	up.serverConn = server2
+	up.stat = StatSubScribed
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"auth","result":true,"error":null}`)
+	if up.Stat() != StatAuthorized || up.AuthorizeError() != nil {
+		t.Errorf("true result should succeed: %v, %v", up.Stat(), up.AuthorizeError())
+	}
+}
+
+func TestUpSessionBTCRequiredCapabilities(t *testing.T) {
+	caps := `{"id":"caps","result":{"capabilities":["verrol","subres"]},"error":null}`
+
+	client, server := net.Pipe()
+	defer client.Close()
+	up := newTestUpSessionBTC()
+	up.config.Advanced.PoolCapabilities = []string{CapVersionRolling, "newcap"}
+	up.config.Advanced.RequiredPoolCapabilities = []string{"newcap"}
+	up.serverConn = server
+	up.stat = StatConnected
+
+	request := up.getAgentGetCapsRequest("caps")
+	if len(request.Params) != 1 || len(request.Params[0].(JSONRPCArray)) != 2 {
+		t.Errorf("wrong capabilities requested: %v", request.Params)
+	}
+
+	recvTestJSONRPCUpSessionBTC(t, up, caps)
+	if up.stat != StatDisconnected {
+		t.Errorf("pool without required capability should be rejected")
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	up = newTestUpSessionBTC()
+	up.config.Advanced.RequiredPoolCapabilities = []string{CapVersionRolling}
+	up.serverConn = server2
+	up.stat = StatConnected
+
+	recvTestJSONRPCUpSessionBTC(t, up, caps)
+	if up.stat != StatConnected || !up.serverCapVersionRolling {
+		t.Errorf("pool with required capability should be accepted")
+	}
+	if up.serverCapSubmitResponse {
+		t.Errorf("subres is not requested and should not be negotiated")
+	}
+}
+
+func TestUpSessionBTCSubmitVersionMask(t *testing.T) {
+	maskReceived := true
+	var up *UpSessionBTC
+	submit := func(reject bool, versionMask uint32) (submitted []byte, response interface{}) {
+		up = newTestUpSessionBTC()
+		up.config.Advanced.RejectIllegalVersionMask = reject
+		if maskReceived {
+			up.versionMask = 0x1fffe000
+			up.rpcSetVersionMask = []byte(`{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}` + "\n")
+		}
+
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		up.serverConn = server
+
+		down := NewDownSessionBTC(up.manager.parent, server, 1)
+		up.downSessions[down.sessionID] = down
+
+		msg := new(ExMessageSubmitShareBTC)
+		msg.Base.SessionID = down.sessionID
+		msg.VersionMask = versionMask
+		go up.handleSubmitShare(EventSubmitShareBTC{1, msg, time.Now(), ""})
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		submitted = make([]byte, 64)
+		n, _ := client.Read(submitted)
+		submitted = submitted[:n]
+
+		select {
+		case response = <-down.eventChannel:
+		case <-time.After(5 * time.Second):
+		}
+		return
+	}
+
+	submitted, response := submit(false, 0x00006000)
+	if len(submitted) < 4 || binary.LittleEndian.Uint32(submitted[len(submitted)-4:]) != 0x00006000 {
+		t.Errorf("in-mask version is changed: %x", submitted)
+	}
+	if e, ok := response.(EventSubmitResponse); !ok || e.Status != STATUS_ACCEPT {
+		t.Errorf("wrong submit response: %v", response)
+	}
+
+	submitted, _ = submit(false, 0x20006000)
+	if len(submitted) < 4 || binary.LittleEndian.Uint32(submitted[len(submitted)-4:]) != 0x00006000 {
+		t.Errorf("out-of-mask version is not corrected: %x", submitted)
+	}
+
+	submitted, response = submit(true, 0x20006000)
+	if len(submitted) != 0 {
+		t.Errorf("out-of-mask share is submitted: %x", submitted)
+	}
+	if e, ok := response.(EventSubmitResponse); !ok || e.Status != STATUS_ILLEGAL_VERMASK {
+		t.Errorf("out-of-mask share is not rejected: %v", response)
+	}
+
+	// 尚未收到矿池的版本掩码时不检查版本位，不当作掩码为 0
+	maskReceived = false
+	submitted, _ = submit(true, 0x00006000)
+	if len(submitted) < 4 || binary.LittleEndian.Uint32(submitted[len(submitted)-4:]) != 0x00006000 {
+		t.Errorf("version bits are changed before the version mask is received: %x", submitted)
+	}
+	for _, action := range []string{"corrected", "rejected"} {
+		if count := up.manager.parent.metrics.IllegalVersionBits.Get("action", action); count != 0 {
+			t.Errorf("version bits are counted as illegal before the version mask is received: %s %v", action, count)
+		}
+	}
+}
+
+func TestUpSessionBTCZeroVersionMask(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	up := newTestUpSessionBTC()
+	up.config.DisconnectWhenLostAsicboost = true
+	up.serverConn = server
+	up.serverCapVersionRolling = true
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}`)
+
+	minerConn, minerServer := net.Pipe()
+	defer minerConn.Close()
+	go io.Copy(ioutil.Discard, minerConn)
+	down := NewDownSessionBTC(up.manager.parent, minerServer, 1)
+	down.versionMask = 0x1fffe000
+	down.versionRollingShareCounter = 200
+	up.downSessions[down.sessionID] = down
+
+	// 矿池中途关闭版本滚动，矿机收到空的版本掩码
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_version_mask","params":["0"]}`)
+	if up.versionMask != 0 {
+		t.Errorf("version mask should be 0: %08x", up.versionMask)
+	}
+	emptyMask := `{"id":null,"method":"mining.set_version_mask","params":["00000000"]}` + "\n"
+	select {
+	case e := <-down.eventChannel:
+		mask, ok := e.(EventSetVersionMask)
+		if !ok || mask.VersionMask != 0 || string(mask.Content) != emptyMask {
+			t.Fatalf("miner is not notified with an empty version mask: %v", e)
+		}
+		// 矿机停止滚动版本位后不会被当作 AsicBoost 丢失而要求重连
+		down.setVersionMask(mask)
+		if down.versionRollingShareCounter != 0 {
+			t.Errorf("version rolling shares should be reset: %d", down.versionRollingShareCounter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner is not notified")
+	}
+
+	// 收到空掩码之前提交的 share 去掉版本位后提交
+	msg := new(ExMessageSubmitShareBTC)
+	msg.Base.SessionID = down.sessionID
+	msg.VersionMask = 0x00006000
+	go up.handleSubmitShare(EventSubmitShareBTC{1, msg, time.Now(), ""})
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(client, header); err != nil {
+		t.Fatalf("share is not submitted: %v", err)
+	}
+	if header[1] != CMD_SUBMIT_SHARE || msg.VersionMask != 0 {
+		t.Errorf("version bits are not stripped: type %02x, version mask %08x", header[1], msg.VersionMask)
+	}
+	if count := up.manager.parent.metrics.IllegalVersionBits.Get("action", "corrected"); count != 1 {
+		t.Errorf("stripped version bits are not counted: %v", count)
+	}
+}
+
+func TestUpSessionBTCPoolWithoutAsicboost(t *testing.T) {
+	caps := `{"id":"caps","result":{"capabilities":["subres"]},"error":null}`
+
+	client, server := net.Pipe()
+	defer client.Close()
+	up := newTestUpSessionBTC()
+	up.config.PoolWithoutAsicboost = PoolWithoutAsicboostFailover
+	up.serverConn = server
+	up.stat = StatConnected
+
+	recvTestJSONRPCUpSessionBTC(t, up, caps)
+	if up.stat != StatDisconnected {
+		t.Errorf("pool without ASICBoost should be failed over")
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	up = newTestUpSessionBTC()
+	up.config.PoolWithoutAsicboost = PoolWithoutAsicboostDisable
+	up.serverConn = server2
+	up.stat = StatConnected
+
+	down := NewDownSessionBTC(up.manager.parent, server2, 1)
+	down.versionMask = 0x1fffe000
+	up.downSessions[down.sessionID] = down
+
+	recvTestJSONRPCUpSessionBTC(t, up, caps)
+	if up.stat != StatConnected {
+		t.Fatalf("pool without ASICBoost should be kept")
+	}
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}`)
+
+	emptyMask := `{"id":null,"method":"mining.set_version_mask","params":["00000000"]}` + "\n"
+	select {
+	case e := <-down.eventChannel:
+		if mask, ok := e.(EventSetVersionMask); !ok || mask.VersionMask != 0 || string(mask.Content) != emptyMask {
+			t.Errorf("miner is not notified with an empty version mask: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("miner is not notified")
+	}
+	if string(up.rpcSetVersionMask) != emptyMask {
+		t.Errorf("version mask of pool server should be ignored: %s", string(up.rpcSetVersionMask))
+	}
+}
+
+func TestUpSessionBTCPoolWithoutSubres(t *testing.T) {
+	caps := `{"id":"caps","result":{"capabilities":["verrol"]},"error":null}`
+
+	newUp := func(behavior string) (up *UpSessionBTC, client net.Conn) {
+		client, server := net.Pipe()
+		go io.Copy(ioutil.Discard, client)
+		up = newTestUpSessionBTC()
+		up.config.SubmitResponseFromServer = true
+		up.config.PoolWithoutSubres = behavior
+		up.serverConn = server
+		up.stat = StatConnected
+		return
+	}
+
+	up, client := newUp(PoolWithoutSubresFailover)
+	defer client.Close()
+	recvTestJSONRPCUpSessionBTC(t, up, caps)
+	if up.stat != StatDisconnected {
+		t.Errorf("pool without subres should be failed over")
+	}
+
+	// 降级为本地响应：矿池不会响应 share，矿机立即收到接受的响应
+	up, client2 := newUp(PoolWithoutSubresLocalAck)
+	defer client2.Close()
+	output := captureLog(t, func() {
+		recvTestJSONRPCUpSessionBTC(t, up, caps)
+	})
+	if up.stat != StatConnected || up.serverCapSubmitResponse {
+		t.Fatalf("pool without subres should be kept in local-ack mode")
+	}
+	if !strings.Contains(output, "downgrade to local-ack mode") {
+		t.Errorf("downgrade is not logged: %s", output)
+	}
+
+	minerClient, minerServer := net.Pipe()
+	defer minerClient.Close()
+	defer minerServer.Close()
+	down := NewDownSessionBTC(up.manager.parent, minerServer, 1)
+	up.downSessions[down.sessionID] = down
+	msg := new(ExMessageSubmitShareBTC)
+	msg.Base.SessionID = down.sessionID
+	up.handleSubmitShare(EventSubmitShareBTC{1, msg, time.Now(), ""})
+	select {
+	case e := <-down.eventChannel:
+		if response, ok := e.(EventSubmitResponse); !ok || response.ID != 1 || response.Status != STATUS_ACCEPT {
+			t.Errorf("share should be accepted locally: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("miner is not responded")
+	}
+	if up.submitIDs.Len() != 0 {
+		t.Errorf("share should not wait for the pool response")
+	}
+}
+
+func TestUpSessionBTCFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	up := newTestUpSessionBTC()
+	up.serverConn = server
+	up.serverReader = bufio.NewReader(server)
+	up.stat = StatAuthorized
+	go up.handleResponse()
+
+	// CMD_MINING_SET_DIFF，消息体中包含 '\n' 和 '{'
+	exMessage := []byte{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9, 0, '\n', 1, 0, '{', 0}
+	chunks := [][]byte{
+		[]byte(`{"id":null,"method":"mining.set_difficulty",`),
+		append([]byte(`"params":[8192]}`+"\n"), exMessage[:2]...),
+		exMessage[2:6],
+		append(exMessage[6:], `{"id":null,"method":"mining.set_difficulty","params":[16384]}`...),
+		[]byte("\n"),
+	}
+	go func() {
+		for _, chunk := range chunks {
+			client.Write(chunk)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	recv := func() interface{} {
+		select {
+		case e := <-up.eventChannel:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event received")
+		}
+		return nil
+	}
+
+	if e, ok := recv().(EventRecvJSONRPCBTC); !ok || len(e.RPCData.Params) != 1 || e.RPCData.Params[0] != float64(8192) {
+		t.Errorf("first JSON line is misframed: %v", e)
+	}
+	if e, ok := recv().(EventRecvExMessage); !ok || e.Message.Type != CMD_MINING_SET_DIFF || string(e.Message.Body) != string(exMessage[4:]) {
+		t.Errorf("ex-message is misframed: %v", e)
+	}
+	if e, ok := recv().(EventRecvJSONRPCBTC); !ok || len(e.RPCData.Params) != 1 || e.RPCData.Params[0] != float64(16384) {
+		t.Errorf("second JSON line is misframed: %v", e)
+	}
+
+	// 矿池在 JSON 行的中间插入 ex-message，之后的数据无法可靠地分帧，断开连接
+	go func() {
+		client.Write([]byte(`{"id":null,"method":"mining.set_difficulty",`))
+		client.Write(exMessage)
+		client.Write([]byte(`"params":[8192]}` + "\n"))
+	}()
+	if e, ok := recv().(EventConnBroken); !ok {
+		t.Errorf("misframed stream should break the connection: %v", e)
+	}
+}
+
+func TestUpSessionBTCInitialDifficulty(t *testing.T) {
+	addDownSession := func(up *UpSessionBTC, suggest uint64) string {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close(); server.Close() })
+		// 丢弃注册矿工的 ex-message
+		go io.Copy(ioutil.Discard, client)
+		up.serverConn = server
+
+		down := NewDownSessionBTC(up.manager.parent, server, 1)
+		down.suggestedDifficulty = suggest
+		up.addDownSession(EventAddDownSession{down})
+
+		select {
+		case e := <-down.eventChannel:
+			if diff, ok := e.(EventSetDifficultyBTC); ok {
+				return string(diff.Content)
+			}
+		default:
+		}
+		return ""
+	}
+	setDiff := func(diff string) string {
+		return `{"id":null,"method":"mining.set_difficulty","params":[` + diff + `]}` + "\n"
+	}
+
+	up := newTestUpSessionBTC()
+	if line := addDownSession(up, 0); line != "" {
+		t.Errorf("no difficulty should be sent without configuration: %s", line)
+	}
+
+	up = newTestUpSessionBTC()
+	up.config.Pools = []PoolInfo{{Host: "127.0.0.1", Port: 3333, Options: PoolOptions{InitialDifficulty: 4096}}}
+	up.config.InitialDifficulty.Default = 1024
+	if line := addDownSession(up, 0); line != setDiff("4096") {
+		t.Errorf("initial difficulty of the pool is not sent: %s", line)
+	}
+
+	up.config.InitialDifficulty.SubAccounts = map[string]uint64{up.subAccount: 65536}
+	if line := addDownSession(up, 0); line != setDiff("65536") {
+		t.Errorf("initial difficulty of the sub-account is not sent: %s", line)
+	}
+	if line := addDownSession(up, 8192); line != setDiff("8192") {
+		t.Errorf("difficulty suggested by the miner should win: %s", line)
+	}
+
+	up.rpcSetDifficulty = []byte(setDiff("16384"))
+	if line := addDownSession(up, 8192); line != setDiff("16384") {
+		t.Errorf("difficulty of the pool server should be used once received: %s", line)
+	}
+}
+
+func TestUpSessionBTCSuggestDifficultyToPool(t *testing.T) {
+	firstRequest := func(suggest bool) string {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		up := newTestUpSessionBTC()
+		up.config.InitialDifficulty.Default = 1024
+		up.config.InitialDifficulty.SuggestToPool = suggest
+		up.serverConn = server
+		go func() {
+			up.sendAuthorizeRequest()
+			server.Close()
+		}()
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		go io.Copy(ioutil.Discard, client)
+		return line
+	}
+
+	// 默认只把初始难度发给矿机，不向矿池建议
+	if line := firstRequest(false); !strings.Contains(line, `"mining.authorize"`) {
+		t.Errorf("initial difficulty should not be suggested to the pool by default: %s", line)
+	}
+	if line := firstRequest(true); !strings.Contains(line, `"mining.suggest_difficulty"`) || !strings.Contains(line, "[1024]") {
+		t.Errorf("initial difficulty is not suggested to the pool: %s", line)
+	}
+}
+
+func TestUpSessionBTCExMessageBeforeAuthorized(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	up := newTestUpSessionBTC()
+	up.serverConn = server
+	up.stat = StatSubScribed
+
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	// 认证响应之前矿池发送了 CMD_MINING_SET_DIFF 和一个未知类型的 ex-message
+	up.recvExMessage(EventRecvExMessage{&ExMessage{ExMessageHeader{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9}, []byte{10, 1, 0, 1, 0}}})
+	up.recvExMessage(EventRecvExMessage{&ExMessage{ExMessageHeader{ExMessageMagicNumber, 0x66, 4}, nil}})
+	if len(up.pendingExMessages) != 1 {
+		t.Fatalf("wrong pending ex-messages: %v", up.pendingExMessages)
+	}
+
+	select {
+	case e := <-down.eventChannel:
+		t.Fatalf("ex-message is processed before authorized: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"auth","result":true,"error":null}`)
+	if up.stat != StatAuthorized || len(up.pendingExMessages) != 0 {
+		t.Fatalf("pending ex-messages are not processed after authorized")
+	}
+
+	select {
+	case e := <-down.eventChannel:
+		diff, ok := e.(EventSetDifficultyBTC)
+		if !ok || diff.Difficulty != 1024 || string(diff.Content) != `{"id":null,"method":"mining.set_difficulty","params":[1024]}`+"\n" {
+			t.Errorf("wrong difficulty sent to miner: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("difficulty is not sent to miner after authorized")
+	}
+}
+
+// readTestExMessages 读取矿机发给矿池的消息直到连接断开，对其中的 ex-message 调用 handle，跳过 JSON 行
+func readTestExMessages(reader *bufio.Reader, handle func(header ExMessageHeader, body []byte)) {
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] != ExMessageMagicNumber {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				return
+			}
+			continue
+		}
+		var header ExMessageHeader
+		if binary.Read(reader, binary.LittleEndian, &header) != nil || header.Size < 4 {
+			return
+		}
+		body := make([]byte, header.Size-4)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+		handle(header, body)
+	}
+}
+
+func TestUpSessionBTCExMessageSetDiffToMiner(t *testing.T) {
+	// 矿池完成握手后，收到矿机的 CMD_REGISTER_WORKER 时通过 CMD_MINING_SET_DIFF 将该矿机的难度设置为 2^20
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			if header.Type == CMD_REGISTER_WORKER && len(body) >= 2 {
+				conn.Write([]byte{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9, 0, 20, 1, 0, body[0], body[1]})
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(miner)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the difficulty from ex-message: %v", err)
+		}
+		if line == `{"id":null,"method":"mining.set_difficulty","params":[1048576]}`+"\n" {
+			break
+		}
+	}
+}
+
+func TestUpSessionBTCExMessageMiningNotifyToMiner(t *testing.T) {
+	// 矿池支持 exnotify，完成握手后，收到矿机的 CMD_REGISTER_WORKER 时通过 CMD_MINING_NOTIFY 下发新的任务
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		for authorized := false; !authorized; {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps":
+				pool.WriteLine(conn, `{"id":"caps","result":{"capabilities":["verrol","subres","exnotify"]},"error":null}`)
+			case "conf":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+			case "sub":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+			case "auth":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				authorized = true
+			}
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			if header.Type == CMD_REGISTER_WORKER {
+				conn.Write(testExMessageMiningNotify)
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	// 矿池分配的 extranonce1 加在 coinbase1 之后
+	expected := `{"id":null,"method":"mining.notify","params":` +
+		strings.Replace(testExMessageMiningNotifyParams, `"01000000"`, `"0100000001000002"`, 1) + "}\n"
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(miner)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the job from ex-message: %v", err)
+		}
+		if line == expected {
+			break
+		}
+	}
+}
+
+func TestUpSessionBTCReportDifficulty(t *testing.T) {
+	// 矿池通过 CMD_MINING_SET_DIFF 将矿机的难度设置为 2^20，被 difficulty_clamp.max 调低后报告给矿池
+	reports := make(chan ExMessageMiningSetDiff, 16)
+	registered := make(chan uint16, 1)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			switch header.Type {
+			case CMD_REGISTER_WORKER:
+				if len(body) >= 2 {
+					registered <- binary.LittleEndian.Uint16(body)
+					conn.Write([]byte{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9, 0, 20, 1, 0, body[0], body[1]})
+				}
+			case CMD_MINING_SET_DIFF:
+				var msg ExMessageMiningSetDiff
+				if err := msg.Unserialize(body); err != nil {
+					t.Errorf("wrong difficulty report: %v, %v", body, err)
+					return
+				}
+				reports <- msg
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.ReportDifficulty = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.DifficultyClamp.Max = 600000
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	var sessionID uint16
+	select {
+	case sessionID = <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner was not registered")
+	}
+	// 600000 向下取整为 2^19。之前可能还有矿池设置难度前使用的初始难度的报告
+	for {
+		select {
+		case msg := <-reports:
+			if msg.Base.DiffExp != 19 {
+				continue
+			}
+			if msg.Base.Count != 1 || len(msg.SessionIDs) != 1 || msg.SessionIDs[0] != sessionID {
+				t.Errorf("wrong sessions in difficulty report: %+v, expected %d", msg, sessionID)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("pool did not receive the difficulty 2^19 of the miner")
+		}
+	}
+}
+
+func TestUpSessionBTCRegisterWorker(t *testing.T) {
+	frames := make(chan ExMessage, 16)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			if header.Type == CMD_REGISTER_WORKER || header.Type == CMD_UNREGISTER_WORKER {
+				frames <- ExMessage{header, body}
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	waitFrame := func(cmd uint8) ExMessage {
+		t.Helper()
+		select {
+		case frame := <-frames:
+			if frame.Type != cmd || len(frame.Body) < 2 {
+				t.Fatalf("wrong ex-message 0x%02x, expected 0x%02x: %v", frame.Type, cmd, frame.Body)
+			}
+			return frame
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool did not receive ex-message 0x%02x", cmd)
+		}
+		return ExMessage{}
+	}
+
+	// 矿机认证成功后注册，断开后以相同的会话ID注销
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	register := waitFrame(CMD_REGISTER_WORKER)
+	names := bytes.Split(register.Body[2:], []byte{0})
+	if len(names) != 3 || string(names[1]) != "w1" {
+		t.Errorf("wrong worker registered: %q", register.Body)
+	}
+
+	miner.Close()
+	unregister := waitFrame(CMD_UNREGISTER_WORKER)
+	if !bytes.Equal(unregister.Body, register.Body[:2]) {
+		t.Errorf("wrong session unregistered: %v, registered %v", unregister.Body, register.Body[:2])
+	}
+}
+
+func TestUpSessionBTCRegisterWorkerClientAgent(t *testing.T) {
+	registers := make(chan []byte, 16)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			if header.Type == CMD_REGISTER_WORKER {
+				registers <- body
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	for _, c := range []struct {
+		userAgent string // JSON 字符串
+		expected  string
+	}{
+		{`"bmminer/2.0.0"`, "bmminer/2.0.0"},
+		// 控制字符（包括 \0）和非 ASCII 字符被去掉
+		{`" cgminer\u0000/4.10\n\u00e9 "`, "cgminer/4.10"},
+		// 截断到 64 字节
+		{`"` + strings.Repeat("a", 100) + `"`, strings.Repeat("a", RegisterWorkerMaxClientAgentLength)},
+	} {
+		miner, err := net.Dial("tcp", manager.Addr().String())
+		if err != nil {
+			t.Fatalf("connect to agent failed: %v", err)
+		}
+		miner.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[` + c.userAgent + `]}` + "\n" +
+			`{"id":2,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+
+		select {
+		case body := <-registers:
+			fields := bytes.Split(body[2:], []byte{0})
+			if len(fields) != 3 || string(fields[0]) != c.expected || string(fields[1]) != "w1" {
+				t.Errorf("user agent %s registered as %q, expected %q", c.userAgent, body[2:], c.expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool did not receive the register of user agent %s", c.userAgent)
+		}
+		miner.Close()
+	}
+}
+
+func TestUpSessionBTCHandshakeOverPipe(t *testing.T) {
+	// 矿池和矿机都使用 net.Pipe 连接，不经过 TCP
+	pool := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner, agentConn := net.Pipe()
+	defer miner.Close()
+	go manager.RunDownSession(agentConn)
+	go miner.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+
+	// 矿机收到认证成功的响应和矿池下发的任务
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(miner)
+	authorized, notified := false, false
+	for !authorized || !notified {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive expected messages over pipe: %v", err)
+		}
+		if strings.HasPrefix(line, `{"id":2,"result":true,`) {
+			authorized = true
+		}
+		if strings.Contains(line, `"method":"mining.notify"`) {
+			notified = true
+		}
+	}
+}
+
+// testUpSessionBTCResumeSession 矿池连接断开后重连，检查 mining.subscribe 中请求恢复的会话ID和最终使用的 extranonce1。
+// rejectResume 为 true 时矿池拒绝恢复会话。
+func testUpSessionBTCResumeSession(t *testing.T, rejectResume bool, expectedExtraNonce1 string) {
+	var connections int32
+	subscribes := make(chan JSONRPCArray, 16)
+	drop := make(chan struct{})
+	// 第 n 个连接分配的 extranonce1 为 0100000n，请求恢复会话时使用请求中的会话ID
+	pool := NewMockPipePool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		n := atomic.AddInt32(&connections, 1)
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps", "caps_again":
+				pool.WriteLine(conn, `{"id":"`+request.ID.(string)+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+			case "conf":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+			case "sub":
+				subscribes <- request.Params
+				extraNonce1 := fmt.Sprintf("0100000%d", n)
+				if len(request.Params) > 1 {
+					if rejectResume {
+						pool.WriteLine(conn, `{"id":"sub","result":null,"error":[20,"Session not found",null]}`)
+						continue
+					}
+					extraNonce1, _ = request.Params[1].(string)
+				}
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","`+extraNonce1+`"]],"`+extraNonce1+`",8],"error":null}`)
+			case "auth":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				if n == 1 {
+					go io.Copy(ioutil.Discard, reader)
+					<-drop
+					return
+				}
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.Pools[0].Options.ResumeSession = true
+	manager := startTestSessionManager(t, config)
+
+	waitSubscribe := func() JSONRPCArray {
+		t.Helper()
+		select {
+		case params := <-subscribes:
+			return params
+		case <-time.After(5 * time.Second):
+			t.Fatal("pool server did not receive mining.subscribe")
+		}
+		return nil
+	}
+
+	// 第一次连接时没有可以恢复的会话
+	if params := waitSubscribe(); len(params) != 1 {
+		t.Errorf("first subscribe should not resume a session: %v", params)
+	}
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	close(drop)
+	if params := waitSubscribe(); len(params) != 2 || params[1] != "01000001" {
+		t.Errorf("subscribe after reconnecting should resume session 01000001: %v", params)
+	}
+	if rejectResume {
+		if params := waitSubscribe(); len(params) != 1 {
+			t.Errorf("subscribe after the resume rejected should subscribe a new session: %v", params)
+		}
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		status := testUpSessionStatus(t, manager)
+		if status.Ready && status.ExtraNonce != nil && status.ExtraNonce.PoolExtraNonce1 == expectedExtraNonce1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("pool connection is not ready with extranonce1 %s: %+v", expectedExtraNonce1, status)
+		}
+	}
+}
+
+func TestUpSessionBTCResumeSession(t *testing.T) {
+	testUpSessionBTCResumeSession(t, false, "01000001")
+}
+
+func TestUpSessionBTCResumeSessionRejected(t *testing.T) {
+	testUpSessionBTCResumeSession(t, true, "01000002")
+}
+
+func TestUpSessionBTCSubmitResponseIndex(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.SubmitResponseFromServer = true
+	up.serverCapSubmitResponse = true
+	up.stat = StatAuthorized
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	up.serverConn = server
+	go io.Copy(ioutil.Discard, client)
+
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	for id := 1; id <= 3; id++ {
+		msg := new(ExMessageSubmitShareBTC)
+		msg.Base.SessionID = down.sessionID
+		up.handleSubmitShare(EventSubmitShareBTC{id, msg, time.Now(), ""})
+	}
+
+	respond := func(index uint16, status StratumStatus) {
+		body := new(bytes.Buffer)
+		binary.Write(body, binary.LittleEndian, ExMessageSubmitResponse{index, status})
+		ex := new(ExMessage)
+		ex.Type = CMD_SUBMIT_RESPONSE
+		ex.Body = body.Bytes()
+		up.recvExMessage(EventRecvExMessage{ex})
+	}
+	recv := func() (e EventSubmitResponse) {
+		select {
+		case event := <-down.eventChannel:
+			e, _ = event.(EventSubmitResponse)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("miner did not receive submit response")
+		}
+		return
+	}
+
+	// 矿池按提交顺序编号，响应可以乱序到达
+	respond(2, STATUS_LOW_DIFFICULTY)
+	if e := recv(); e.ID != 3 || e.Status != STATUS_LOW_DIFFICULTY {
+		t.Errorf("wrong submit response for index 2: %v", e)
+	}
+	respond(0, STATUS_ACCEPT)
+	if e := recv(); e.ID != 1 || e.Status != STATUS_ACCEPT {
+		t.Errorf("wrong submit response for index 0: %v", e)
+	}
+
+	// 超时未响应的 share 在本地响应为接受，之后到达的响应被忽略
+	up.submitIDs.timeout = 0
+	up.expireSubmitIDs()
+	if e := recv(); e.ID != 2 || e.Status != STATUS_ACCEPT {
+		t.Errorf("wrong submit response for expired index 1: %v", e)
+	}
+	respond(1, STATUS_DUPLICATE_SHARE)
+	select {
+	case e := <-down.eventChannel:
+		t.Errorf("response of expired share should be ignored: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpSessionBTCSubmitResponseSeconds(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.SubmitResponseFromServer = true
+	up.stat = StatAuthorized
+	histogram := up.manager.parent.metrics.SubmitResponseSeconds
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	up.serverConn = server
+	go io.Copy(ioutil.Discard, client)
+
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	respond := func(index uint16) {
+		body := new(bytes.Buffer)
+		binary.Write(body, binary.LittleEndian, ExMessageSubmitResponse{index, STATUS_ACCEPT})
+		ex := new(ExMessage)
+		ex.Type = CMD_SUBMIT_RESPONSE
+		ex.Body = body.Bytes()
+		up.recvExMessage(EventRecvExMessage{ex})
+	}
+
+	// 矿池不支持 subres 时在本地响应，不统计
+	msg := new(ExMessageSubmitShareBTC)
+	msg.Base.SessionID = down.sessionID
+	up.handleSubmitShare(EventSubmitShareBTC{1, msg, time.Now(), ""})
+	if histogram.Count() != 0 {
+		t.Errorf("local response should not be observed")
+	}
+
+	// 矿池 50 毫秒后才响应
+	up.serverCapSubmitResponse = true
+	up.handleSubmitShare(EventSubmitShareBTC{2, msg, time.Now(), ""})
+	time.Sleep(50 * time.Millisecond)
+	respond(0)
+	if histogram.Count() != 1 || histogram.Sum() < 0.05 || histogram.Sum() > 5 {
+		t.Errorf("wrong observation, count: %d, sum: %f", histogram.Count(), histogram.Sum())
+	}
+
+	// 超时后在本地响应的 share 不统计
+	up.handleSubmitShare(EventSubmitShareBTC{3, msg, time.Now(), ""})
+	up.submitIDs.timeout = 0
+	up.expireSubmitIDs()
+	respond(1)
+	if histogram.Count() != 1 {
+		t.Errorf("expired share should not be observed, count: %d", histogram.Count())
+	}
+}
+
+func TestUpSessionBTCDifficultyClamp(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.SubmitResponseFromServer = true
+	up.config.DifficultyClamp.Min = 1024
+	up.config.DifficultyClamp.Max = 2048
+	up.serverCapSubmitResponse = true
+	up.stat = StatAuthorized
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	up.serverConn = server
+	go io.Copy(ioutil.Discard, client)
+
+	// 创世区块的 extranonce2 由全 0 的会话ID和矿机的 extranonce2 组成
+	down := NewDownSessionBTC(up.manager.parent, server, 0)
+	up.downSessions[down.sessionID] = down
+
+	recvDiff := func() string {
+		select {
+		case e := <-down.eventChannel:
+			if diff, ok := e.(EventSetDifficultyBTC); ok {
+				return string(diff.Content)
+			}
+			t.Fatalf("unexpected event: %v", e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("difficulty is not sent to miner")
+		}
+		return ""
+	}
+	setDiffLine := func(diff string) string {
+		return `{"id":null,"method":"mining.set_difficulty","params":[` + diff + `]}` + "\n"
+	}
+
+	// 矿池难度高于上限
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_difficulty","params":[1048576]}`)
+	if line := recvDiff(); line != setDiffLine("2048") {
+		t.Errorf("difficulty above max is not clamped: %s", line)
+	}
+	if string(up.rpcSetDifficulty) != setDiffLine("2048") {
+		t.Errorf("clamped difficulty is not sent to new miners: %s", up.rpcSetDifficulty)
+	}
+
+	// 矿池难度低于下限（2^9）
+	up.recvExMessage(EventRecvExMessage{&ExMessage{ExMessageHeader{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9}, []byte{9, 1, 0, 0, 0}}})
+	if line := recvDiff(); line != setDiffLine("1024") {
+		t.Errorf("difficulty below min is not clamped: %s", line)
+	}
+
+	coinbaseTx := testGenesisCoinbaseTxBTC
+	up.extraNonce1 = coinbaseTx[10:18]
+	notify, err := NewJSONRPCLineBTC([]byte(`{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",` +
+		`"` + coinbaseTx[:10] + `","` + coinbaseTx[34:] + `",[],"00000001","1d00ffff","495fab29",true]}`))
+	if err != nil {
+		t.Fatalf("NewJSONRPCLineBTC failed: %v", err)
+	}
+	job, err := NewStratumJobBTC(notify, up.extraNonce1)
+	if err != nil {
+		t.Fatalf("NewStratumJobBTC failed: %v", err)
+	}
+	up.addRecentJob(job)
+
+	// 创世区块的 nonce 满足约 2536 的难度，改变 nonce 后不满足
+	const genesisNonce = 0x7c2bac1d
+	// 返回矿机收到的响应，以及 share 是否提交给了矿池
+	submit := func(nonce uint32, poolStatus StratumStatus) (StratumStatus, bool) {
+		next := up.submitIDs.next
+		msg := new(ExMessageSubmitShareBTC)
+		msg.Base.SessionID = down.sessionID
+		msg.Base.Nonce = nonce
+		msg.Time = 0x495fab29
+		msg.JobIDString = "1"
+		up.handleSubmitShare(EventSubmitShareBTC{1, msg, time.Now(), ""})
+
+		forwarded := up.submitIDs.next != next
+		if forwarded {
+			body := new(bytes.Buffer)
+			binary.Write(body, binary.LittleEndian, ExMessageSubmitResponse{uint16(up.submitIDs.next - 1), poolStatus})
+			ex := new(ExMessage)
+			ex.Type = CMD_SUBMIT_RESPONSE
+			ex.Body = body.Bytes()
+			up.recvExMessage(EventRecvExMessage{ex})
+		}
+
+		select {
+		case event := <-down.eventChannel:
+			e, _ := event.(EventSubmitResponse)
+			return e.Status, forwarded
+		case <-time.After(5 * time.Second):
+			t.Fatalf("miner did not receive submit response")
+		}
+		return 0, forwarded
+	}
+
+	// 难度被调高时，矿机的 share 都满足矿池难度，矿池的拒绝原样响应
+	if status, forwarded := submit(genesisNonce, STATUS_LOW_DIFFICULTY); status != STATUS_LOW_DIFFICULTY || !forwarded {
+		t.Errorf("low difficulty share of miner that is not lowered should be rejected by pool: %v, %v", status, forwarded)
+	}
+
+	// 矿池为单台矿机设置的难度（2^20）高于上限
+	up.recvExMessage(EventRecvExMessage{&ExMessage{ExMessageHeader{ExMessageMagicNumber, CMD_MINING_SET_DIFF, 9}, []byte{20, 1, 0, 0, 0}}})
+	if line := recvDiff(); line != setDiffLine("2048") {
+		t.Errorf("difficulty above max is not clamped: %s", line)
+	}
+
+	// 难度被调低时，不满足矿池难度、但满足矿机难度的 share 不提交给矿池，在本地接受
+	clamped := up.manager.parent.metrics.ClampedSubmits
+	if status, forwarded := submit(genesisNonce, STATUS_LOW_DIFFICULTY); status != STATUS_ACCEPT || forwarded {
+		t.Errorf("share meeting the difficulty of lowered miner should be accepted locally: %v, %v", status, forwarded)
+	}
+	if clamped.Get() != 1 {
+		t.Errorf("accepted share is not counted: %v", clamped.Get())
+	}
+	// 不满足矿机难度的 share 在本地拒绝
+	if status, forwarded := submit(genesisNonce-1, STATUS_ACCEPT); status != STATUS_LOW_DIFFICULTY || forwarded {
+		t.Errorf("share below the difficulty of lowered miner should be rejected locally: %v, %v", status, forwarded)
+	}
+	// 矿池按报告的难度判断时照常提交，矿池以难度过低拒绝、但满足矿机难度的 share 响应给矿机为接受
+	up.config.Pools = []PoolInfo{{}}
+	up.config.Pools[0].Options.ReportDifficulty = true
+	if status, forwarded := submit(genesisNonce, STATUS_LOW_DIFFICULTY); status != STATUS_ACCEPT || !forwarded {
+		t.Errorf("share of lowered miner should be submitted when difficulty is reported: %v, %v", status, forwarded)
+	}
+	if clamped.Get() != 2 {
+		t.Errorf("accepted share is not counted: %v", clamped.Get())
+	}
+	up.config.Pools = nil
+	// 任务未知、无法验证的 share 提交给矿池，原样响应矿池的拒绝
+	delete(up.recentJobs, "1")
+	if status, forwarded := submit(genesisNonce, STATUS_LOW_DIFFICULTY); status != STATUS_LOW_DIFFICULTY || !forwarded {
+		t.Errorf("share of unknown job should be rejected by pool: %v, %v", status, forwarded)
+	}
+	if status, _ := submit(genesisNonce, STATUS_DUPLICATE_SHARE); status != STATUS_DUPLICATE_SHARE {
+		t.Errorf("wrong status for duplicate share: %v", status)
+	}
+	if clamped.Get() != 2 {
+		t.Errorf("rejected shares should not be counted: %v", clamped.Get())
+	}
+
+	// 矿机断开后清除记录
+	up.downSessionBroken(EventDownSessionBroken{down.sessionID})
+	if up.difficultyClamp.Lowered(down.sessionID) != up.difficultyClamp.all {
+		t.Errorf("record of disconnected miner is not removed")
+	}
+}
+
+func TestUpSessionBTCCoalesceMiningNotify(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.Advanced.CoalesceMiningNotify = true
+	up.stat = StatAuthorized
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	notify := func(jobID string, clean bool) {
+		cleanJSON := "false"
+		if clean {
+			cleanJSON = "true"
+		}
+		recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.notify","params":["`+jobID+`","00",`+
+			`"01000000","ffffffff",[],"20000000","1d00ffff","5f5e1000",`+cleanJSON+`]}`)
+	}
+	// 处理排队中的事件，直到广播排队的任务
+	broadcast := func() {
+		for len(up.pendingJobs) > 0 {
+			select {
+			case event := <-up.eventChannel:
+				if _, ok := event.(EventBroadcastNotify); ok {
+					up.broadcastPendingJobs()
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("pending jobs are not broadcast")
+			}
+		}
+	}
+	recvJobIDs := func() (jobIDs []string) {
+		for {
+			select {
+			case event := <-down.eventChannel:
+				e, ok := event.(EventMiningNotifyBTC)
+				if !ok {
+					t.Fatalf("unexpected event: %v", event)
+				}
+				rpcData, err := NewJSONRPCLineBTC(e.Content)
+				if err != nil {
+					t.Fatalf("wrong notify: %s", string(e.Content))
+				}
+				jobIDs = append(jobIDs, rpcData.Params[0].(string))
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+	checkJobIDs := func(expected ...string) {
+		t.Helper()
+		jobIDs := recvJobIDs()
+		if strings.Join(jobIDs, ",") != strings.Join(expected, ",") {
+			t.Errorf("wrong jobs sent to miner: %v, expected %v", jobIDs, expected)
+		}
+		if up.lastJob == nil || up.lastJob.Params[0] != expected[len(expected)-1] {
+			t.Errorf("wrong last job: %v", up.lastJob)
+		}
+	}
+
+	// clean 任务之前排队的任务被丢弃，之后的增量任务保留
+	notify("1", false)
+	notify("2", true)
+	notify("3", false)
+	notify("4", true)
+	notify("5", false)
+	notify("6", false)
+	broadcast()
+	checkJobIDs("4", "5", "6")
+
+	// 没有 clean 任务时不丢弃任何任务
+	notify("7", false)
+	notify("8", false)
+	broadcast()
+	checkJobIDs("7", "8")
+
+	// 其他通知到达前先广播排队的任务，以保持矿池发送的顺序
+	notify("9", false)
+	notify("10", true)
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}`)
+	if len(up.pendingJobs) != 0 {
+		t.Errorf("pending jobs are not broadcast before other notifications")
+	}
+	checkJobIDs("10")
+
+	// CMD_MINING_NOTIFY 与 JSON 的任务一起排队和合并
+	exNotify := func(jobID uint8, clean bool) {
+		body := append([]byte{}, testExMessageMiningNotify[4:]...)
+		body[0] = jobID
+		body[45] = 0
+		if clean {
+			body[45] = 1
+		}
+		up.recvExMessage(EventRecvExMessage{&ExMessage{ExMessageHeader{ExMessageMagicNumber, CMD_MINING_NOTIFY, uint16(4 + len(body))}, body}})
+	}
+	// 未协商 exnotify 时忽略
+	exNotify(11, true)
+	if len(up.pendingJobs) != 0 {
+		t.Errorf("CMD_MINING_NOTIFY without capability should be discarded")
+	}
+	up.serverCapMiningNotify = true
+	// 认证之前同样忽略
+	up.stat = StatSubScribed
+	exNotify(11, true)
+	up.stat = StatAuthorized
+	if len(up.pendingJobs) != 0 {
+		t.Errorf("CMD_MINING_NOTIFY before authorized should be discarded")
+	}
+	notify("11", false)
+	exNotify(12, true)
+	notify("13", false)
+	exNotify(14, false)
+	broadcast()
+	checkJobIDs("12", "13", "14")
+}
+
+func TestUpSessionBTCStalledMiner(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.Advanced.MinerSendQueueSize = 4
+	up.manager.parent.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	up.stat = StatAuthorized
+
+	healthyClient, healthyServer := net.Pipe()
+	defer healthyClient.Close()
+	healthy := NewDownSessionBTC(up.manager.parent, healthyServer, 1)
+	up.downSessions[healthy.sessionID] = healthy
+	go healthy.handleEvent()
+
+	// 矿机从不读取数据，写入一直阻塞
+	stalledClient, stalledServer := net.Pipe()
+	defer stalledClient.Close()
+	stalled := NewDownSessionBTC(up.manager.parent, stalledServer, 2)
+	up.downSessions[stalled.sessionID] = stalled
+	go stalled.handleEvent()
+
+	// 每个任务都应及时送达其他矿机，不受不收数据的矿机影响
+	reader := bufio.NewReader(healthyClient)
+	for i := 0; i < 20; i++ {
+		recvTestJSONRPCUpSessionBTC(t, up, fmt.Sprintf(`{"id":null,"method":"mining.notify","params":["%d","00",`+
+			`"01000000","ffffffff",[],"20000000","1d00ffff","5f5e1000",false]}`, i))
+
+		healthyClient.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.Contains(line, fmt.Sprintf(`"params":["%d",`, i)) {
+			t.Fatalf("healthy miner did not receive job %d: %s, %v", i, line, err)
+		}
+	}
+
+	// 发送队列满的矿机被断开
+	select {
+	case <-stalled.ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Errorf("stalled miner is not disconnected")
+	}
+	select {
+	case <-healthy.ctx.Done():
+		t.Errorf("healthy miner should not be disconnected")
+	default:
+	}
+}
+
+func TestUpSessionBTCMinerWriteFailed(t *testing.T) {
+	up := newTestUpSessionBTC()
+	// 只有一个会话ID，释放后才能再次分配
+	up.manager.parent.sessionIDManager, _ = NewSessionIDManager(0)
+	up.stat = StatAuthorized
+	poolClient, poolServer := net.Pipe()
+	defer poolClient.Close()
+	go io.Copy(ioutil.Discard, poolServer)
+	up.serverConn = poolClient
+
+	sessionID, _ := up.manager.parent.sessionIDManager.AllocSessionID()
+	client, server := net.Pipe()
+	down := NewDownSessionBTC(up.manager.parent, server, sessionID)
+	down.upSession = up
+	down.stat = StatAuthorized
+	up.downSessions[down.sessionID] = down
+	// 不启动读循环，只能通过写入失败发现连接已断开
+	go down.handleEvent()
+
+	client.Close()
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.notify","params":["1","00",`+
+		`"01000000","ffffffff",[],"20000000","1d00ffff","5f5e1000",true]}`)
+
+	select {
+	case <-down.ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("miner is not disconnected after the write failed")
+	}
+	if !strings.HasPrefix(down.sessionLog.reason, "write failed: ") {
+		t.Errorf("wrong disconnect reason: %q", down.sessionLog.reason)
+	}
+
+	// 矿机会话从矿池连接中移除，会话ID被释放
+	for {
+		select {
+		case event := <-up.eventChannel:
+			if e, ok := event.(EventDownSessionBroken); ok {
+				up.downSessionBroken(e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("pool session is not notified")
+		}
+		if _, ok := up.downSessions[sessionID]; !ok {
+			break
+		}
+	}
+	for start := time.Now(); up.manager.parent.sessionIDManager.IsFull(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("session id %d is not freed", sessionID)
+		}
+	}
+}
+
+func TestUpSessionBTCExtraNonceStatus(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.config.Pools = []PoolInfo{{Host: "127.0.0.1", Port: 3333}}
+	up.manager.parent.sessionIDManager, _ = NewSessionIDManager(0xfffe)
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+
+	getStatus := func() *ExtraNonceStatus {
+		t.Helper()
+		response := make(chan UpSessionStatus, 1)
+		up.getStatus(EventGetUpSessionStatus{false, response})
+		status := <-response
+		if status.ExtraNonce == nil {
+			t.Fatalf("missing extranonce in status: %+v", status)
+		}
+		return status.ExtraNonce
+	}
+
+	status := getStatus()
+	expected := ExtraNonceStatus{
+		PoolExtraNonce1:      "01000002",
+		PoolExtraNonce2Size:  UpSessionExtraNonce2SizeBTC,
+		SessionIDSize:        4,
+		SessionIDBits:        16,
+		MinerExtraNonce2Size: DownSessionExtraNonce2SizeBTC,
+		Sessions:             0,
+		MaxSessions:          0xffff,
+	}
+	if *status != expected {
+		t.Errorf("wrong extranonce status: %+v, expected %+v", *status, expected)
+	}
+	if status.SessionIDSize+status.MinerExtraNonce2Size != status.PoolExtraNonce2Size || status.SessionIDBits > status.SessionIDSize*8 {
+		t.Errorf("session id and miner extranonce2 do not fit in the pool extranonce2: %+v", *status)
+	}
+
+	// 超过 session_capacity_warning_percent 时提示
+	up.config.Advanced.SessionCapacityWarningPercent = 50
+	up.manager.parent.sessionIDManager, _ = NewSessionIDManager(9)
+	for i := 0; i < 5; i++ {
+		up.manager.parent.sessionIDManager.AllocSessionID()
+	}
+	if status := getStatus(); status.Sessions != 5 || status.MaxSessions != 10 || status.SessionIDBits != 4 || status.CapacityWarning {
+		t.Errorf("no warning expected at 50%% usage: %+v", *status)
+	}
+	up.manager.parent.sessionIDManager.AllocSessionID()
+	if status := getStatus(); status.Sessions != 6 || !status.CapacityWarning {
+		t.Errorf("warning expected at 60%% usage: %+v", *status)
+	}
+}
+
+func TestUpSessionBTCProtocolVariantNiceHash(t *testing.T) {
+	newUp := func(variant string) (up *UpSessionBTC, down *DownSessionBTC) {
+		up = newTestUpSessionBTC()
+		up.config.Pools = []PoolInfo{{Host: "127.0.0.1", Port: 3333, Options: PoolOptions{ProtocolVariant: variant}}}
+		up.stat = StatAuthorized
+		_, server := net.Pipe()
+		down = NewDownSessionBTC(up.manager.parent, server, 1)
+		up.downSessions[down.sessionID] = down
+		return
+	}
+	recvLines := func(down *DownSessionBTC) (lines []string) {
+		for {
+			select {
+			case event := <-down.eventChannel:
+				switch e := event.(type) {
+				case EventSendBytes:
+					lines = append(lines, string(e.Content))
+				case EventSetDifficultyBTC:
+					lines = append(lines, string(e.Content))
+				case EventMiningNotifyBTC:
+					lines = append(lines, string(e.Content))
+				}
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+	setDiffLine := func(diff string) string {
+		return `{"id":null,"method":"mining.set_difficulty","params":[` + diff + `]}` + "\n"
+	}
+
+	// 以下消息截取自 NiceHash 风格的矿池
+	messages := []string{
+		`{"id":null,"method":"mining.set_difficulty","params":[500000]}`,
+		`{"id":null,"method":"mining.set_difficulty","params":[1000000]}`,
+		`{"id":null,"method":"mining.set_target","params":["000000000000ffff000000000000000000000000000000000000000000000000"]}`,
+		`{"id":null,"method":"mining.notify","params":["2","00","01000000","ffffffff",[],"20000000","1d00ffff","5f5e1000",true,` +
+			`"0000000000007fff800000000000000000000000000000000000000000000000"]}`,
+	}
+
+	up, down := newUp(ProtocolVariantNiceHash)
+	for _, message := range messages {
+		recvTestJSONRPCUpSessionBTC(t, up, message)
+	}
+	// 事件由不同的 goroutine 发送，矿机收到的顺序不固定
+	lines := recvLines(down)
+	sort.Strings(lines)
+	if len(lines) != 5 || lines[1] != setDiffLine("1000000") || lines[2] != setDiffLine("131072") ||
+		lines[3] != setDiffLine("500000") || lines[4] != setDiffLine("65536") {
+		t.Fatalf("wrong difficulty sent to miner: %v", lines)
+	}
+	// 目标值不会转发给矿机
+	rpcData, err := NewJSONRPCLineBTC([]byte(lines[0]))
+	if err != nil || rpcData.Method != "mining.notify" || len(rpcData.Params) != 9 || rpcData.Params[0] != "2" {
+		t.Errorf("wrong job sent to miner: %s", lines[0])
+	}
+
+	// 难度未变化时不重复发送
+	recvTestJSONRPCUpSessionBTC(t, up, `{"id":null,"method":"mining.set_difficulty","params":[131072]}`)
+	if lines := recvLines(down); len(lines) != 0 {
+		t.Errorf("unchanged difficulty should not be sent: %v", lines)
+	}
+
+	// 标准协议只转发第一个 mining.set_difficulty，其余难度通过 ex-message 下发
+	up, down = newUp(ProtocolVariantStandard)
+	for _, message := range messages[:3] {
+		recvTestJSONRPCUpSessionBTC(t, up, message)
+	}
+	if lines := recvLines(down); len(lines) != 1 || lines[0] != messages[0] {
+		t.Errorf("wrong difficulty sent to miner with standard protocol: %v", lines)
+	}
+}
+
+func TestUpSessionBTCConfigureVersionMask(t *testing.T) {
+	// 矿池只在 mining.configure 的响应中给出版本掩码 1fffe000，从不发送 mining.set_version_mask
+	versionMasks := make(chan uint32, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			// share 的 nTime 与任务不同，版本位在 nTime 之后
+			if header.Type == CMD_SUBMIT_SHARE_WITH_TIME_VER && len(body) >= 19 {
+				versionMasks <- binary.LittleEndian.Uint32(body[15:])
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	conn := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// 掩码之内的版本位原样提交
+	conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","0000abcd","5f5e1001","12345678","00002000"]}` + "\n"))
+	select {
+	case versionMask := <-versionMasks:
+		if versionMask != 0x00002000 {
+			t.Errorf("wrong version bits submitted: %08x", versionMask)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("share with version bits is not submitted")
+	}
+}
+
+func TestUpSessionBTCSkipCapabilities(t *testing.T) {
+	// 矿池不支持 agent.get_capabilities，收到后返回错误并断开连接
+	submits := make(chan []interface{}, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			id, _ := json.Marshal(request.ID)
+			switch request.Method {
+			case "agent.get_capabilities":
+				pool.WriteLine(conn, `{"id":`+string(id)+`,"result":null,"error":[20,"Unknown method",null]}`)
+				return
+			case "mining.configure":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+			case "mining.subscribe":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+			case "mining.authorize":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+					`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+			case "mining.submit":
+				submits <- request.Params
+				if extraNonce2, _ := request.Params[2].(string); strings.HasSuffix(extraNonce2, "abce") {
+					pool.WriteLine(conn, `{"id":`+string(id)+`,"result":null,"error":[23,"Low difficulty",null]}`)
+				} else {
+					pool.WriteLine(conn, `{"id":`+string(id)+`,"result":true,"error":null}`)
+				}
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.SkipCapabilities = true
+	config.MultiUserMode = true
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.SubmitResponseFromServer = true
+	manager := startTestSessionManager(t, config)
+
+	// 矿机先托管在 FakeUpSession 上，收到任务说明 BTCAgent 已向矿池认证成功
+	conn := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","0000abcd","5f5e1001","12345678","00002000"]}` + "\n" +
+		`{"id":4,"method":"mining.submit","params":["test.w1","1","0000abce","5f5e1001","12345678"]}` + "\n"))
+
+	// 两个 share 由不同的 goroutine 转发，矿池收到的顺序不固定
+	for i := 0; i < 2; i++ {
+		select {
+		case params := <-submits:
+			extraNonce2, _ := params[2].(string)
+			if len(params) < 5 || params[0] != "test" || params[1] != "1" || len(extraNonce2) != 16 ||
+				params[3] != "5f5e1001" || params[4] != "12345678" {
+				t.Errorf("wrong mining.submit params: %v", params)
+			}
+			if strings.HasSuffix(extraNonce2, "abcd") && (len(params) != 6 || params[5] != "00002000") {
+				t.Errorf("missing version mask in mining.submit params: %v", params)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool did not receive mining.submit")
+		}
+	}
+
+	// 矿池的响应转发给矿机
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	responses := map[string]string{}
+	for len(responses) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive share responses: %v, %v", err, responses)
+		}
+		for _, id := range []string{`{"id":3,`, `{"id":4,`} {
+			if strings.HasPrefix(line, id) {
+				responses[id] = line
+			}
+		}
+	}
+	if !strings.Contains(responses[`{"id":3,`], `"result":true`) || !strings.Contains(responses[`{"id":4,`], `"error":[23,`) {
+		t.Errorf("wrong share responses: %v", responses)
+	}
+}
+
+func TestUpSessionBTCExtraNonceRoundTrip(t *testing.T) {
+	const coinbase1 = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff"
+	const coinbase2 = "ffffffff0100000000000000000000000000"
+
+	// 矿机收到的 extranonce1 和 extranonce2 拼接后，必须与矿池的 extranonce1 和 extranonce2 拼接的结果相同
+	for _, poolExtraNonce1 := range []string{"01000002", "a1b2c3", "a1b2c3d4e5f6"} {
+		t.Run(poolExtraNonce1, func(t *testing.T) {
+			submits := make(chan []interface{}, 1)
+			pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+				for {
+					request, err := pool.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					id, _ := json.Marshal(request.ID)
+					switch request.Method {
+					case "mining.configure":
+						pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+					case "mining.subscribe":
+						pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","`+poolExtraNonce1+`"]],"`+poolExtraNonce1+`",8],"error":null}`)
+					case "mining.authorize":
+						pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+						pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+							`"`+coinbase1+`","`+coinbase2+`",[],"20000000","1d00ffff","5f5e1000",true]}`)
+					case "mining.submit":
+						submits <- request.Params
+						pool.WriteLine(conn, `{"id":`+string(id)+`,"result":true,"error":null}`)
+					}
+				}
+			})
+			config := pool.Config(new(SessionFactoryBTC))
+			config.Pools[0].Options.SkipCapabilities = true
+			config.Advanced.PoolConnectionNumberPerSubAccount = 1
+			manager := startTestSessionManager(t, config)
+			waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+			conn, err := net.Dial("tcp", manager.Addr().String())
+			if err != nil {
+				t.Fatalf("connect to agent failed: %v", err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+				`{"id":2,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+
+			// 读取订阅响应中的 extranonce1、extranonce2_size 和矿池的任务
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+			var minerExtraNonce1, minerCoinbase1, minerCoinbase2 string
+			var extraNonce2Size float64
+			for len(minerCoinbase1) < 1 {
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					t.Fatalf("miner did not receive the job: %v", err)
+				}
+				if bytes.HasPrefix(line, []byte(`{"id":1,`)) {
+					var response JSONRPCResponse
+					json.Unmarshal(line, &response)
+					result, _ := response.Result.([]interface{})
+					if len(result) != 3 {
+						t.Fatalf("wrong subscribe result: %s", line)
+					}
+					minerExtraNonce1, _ = result[1].(string)
+					extraNonce2Size, _ = result[2].(float64)
+					continue
+				}
+				rpcData, err := NewJSONRPCLineBTC(line)
+				if err != nil {
+					t.Fatalf("wrong message %s: %v", line, err)
+				}
+				if rpcData.Method == "mining.notify" && rpcData.Params[0] == "1" {
+					minerCoinbase1, _ = rpcData.Params[2].(string)
+					minerCoinbase2, _ = rpcData.Params[3].(string)
+				}
+			}
+			if extraNonce2Size != DownSessionExtraNonce2SizeBTC {
+				t.Errorf("wrong extranonce2_size: %v", extraNonce2Size)
+			}
+
+			minerExtraNonce2 := "0000abcd"
+			conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","` + minerExtraNonce2 + `","5f5e1001","12345678"]}` + "\n"))
+			var params []interface{}
+			select {
+			case params = <-submits:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("pool did not receive mining.submit")
+			}
+			poolExtraNonce2, _ := params[2].(string)
+			if len(poolExtraNonce2) != UpSessionExtraNonce2SizeBTC*2 {
+				t.Errorf("wrong extranonce2 size in mining.submit: %v", params)
+			}
+
+			minerCoinbase := minerCoinbase1 + minerExtraNonce1 + minerExtraNonce2 + minerCoinbase2
+			poolCoinbase := coinbase1 + poolExtraNonce1 + poolExtraNonce2 + coinbase2
+			if minerCoinbase != poolCoinbase {
+				t.Errorf("coinbase of the miner does not match the pool:\nminer: %s\npool:  %s", minerCoinbase, poolCoinbase)
+			}
+		})
+	}
+}
+
+func TestUpSessionBTCForwardSetGoal(t *testing.T) {
+	newUp := func(forward bool) (up *UpSessionBTC, supported *DownSessionBTC, unsupported *DownSessionBTC) {
+		up = newTestUpSessionBTC()
+		up.config.Pools = []PoolInfo{{Host: "127.0.0.1", Port: 3333, Options: PoolOptions{ForwardSetGoal: forward}}}
+		up.stat = StatAuthorized
+		_, server1 := net.Pipe()
+		supported = NewDownSessionBTC(up.manager.parent, server1, 1)
+		supported.supportSetGoal = true
+		_, server2 := net.Pipe()
+		unsupported = NewDownSessionBTC(up.manager.parent, server2, 2)
+		up.downSessions[supported.sessionID] = supported
+		up.downSessions[unsupported.sessionID] = unsupported
+		return
+	}
+	recvSetGoal := func(down *DownSessionBTC) *EventSetGoal {
+		select {
+		case event := <-down.eventChannel:
+			if e, ok := event.(EventSetGoal); ok {
+				return &e
+			}
+			t.Errorf("unexpected event: %v", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return nil
+	}
+
+	message := `{"id":null,"method":"mining.set_goal","params":["sha256d",{"merged":["nmc"]}]}` + "\n"
+	up, supported, unsupported := newUp(true)
+	recvTestJSONRPCUpSessionBTC(t, up, message)
+	for _, down := range []*DownSessionBTC{supported, unsupported} {
+		e := recvSetGoal(down)
+		if e == nil || string(e.Content) != message {
+			t.Fatalf("mining.set_goal is not forwarded to session %d: %v", down.sessionID, e)
+		}
+	}
+
+	// 之后连接的矿机也会收到
+	serverConn, pool := net.Pipe()
+	defer pool.Close()
+	go io.Copy(ioutil.Discard, pool)
+	up.serverConn = serverConn
+	_, server := net.Pipe()
+	down := NewDownSessionBTC(up.manager.parent, server, 3)
+	up.addDownSession(EventAddDownSession{down})
+	if e := recvSetGoal(down); e == nil || string(e.Content) != message {
+		t.Errorf("mining.set_goal is not sent to new session: %v", e)
+	}
+
+	// 只有声明支持 set-goal 扩展的矿机才会收到
+	client, server := net.Pipe()
+	defer client.Close()
+	supported = NewDownSessionBTC(up.manager.parent, server, 4)
+	supported.supportSetGoal = true
+	supported.setGoal(EventSetGoal{[]byte(message)})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != message {
+		t.Errorf("mining.set_goal is not sent to miner: %v, %s", err, line)
+	}
+	unsupported.setGoal(EventSetGoal{[]byte(message)})
+	if !unsupported.setGoalIgnored {
+		t.Errorf("mining.set_goal should be ignored by miner without set-goal extension")
+	}
+
+	// 未启用 forward_set_goal 时忽略
+	up, supported, _ = newUp(false)
+	recvTestJSONRPCUpSessionBTC(t, up, message)
+	if e := recvSetGoal(supported); e != nil || up.rpcSetGoal != nil {
+		t.Errorf("mining.set_goal should not be forwarded: %v", e)
+	}
+}
+
+// countingReader 统计 Read 的调用次数（相当于读取连接的系统调用次数）
+type countingReader struct {
+	reader io.Reader
+	reads  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.reader.Read(p)
+}
+
+// BenchmarkUpSessionBTCReadBufferSize 矿池连续下发大量 mining.notify 时，不同 read_buffer_size 读取连接的次数
+func BenchmarkUpSessionBTCReadBufferSize(b *testing.B) {
+	// 带 12 个 merkle 分支的任务，约 1.3KB
+	branches := make([]string, 12)
+	for i := range branches {
+		branches[i] = `"` + strings.Repeat(fmt.Sprintf("%02x", i), 32) + `"`
+	}
+	notify := `{"id":null,"method":"mining.notify","params":["bf","` + strings.Repeat("00", 32) + `","` +
+		strings.Repeat("01", 100) + `","` + strings.Repeat("ff", 100) + `",[` + strings.Join(branches, ",") +
+		`],"20000000","1d00ffff","5f5e1000",true]}` + "\n"
+	data := []byte(strings.Repeat(notify, 1000))
+
+	for _, size := range []uint{DefaultReadBufferSize, 64 * 1024} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			config := NewConfig()
+			config.Advanced.ReadBufferSize.PoolSession = size
+			b.SetBytes(int64(len(data)))
+
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				counter := &countingReader{reader: bytes.NewReader(data)}
+				reader := bufio.NewReaderSize(counter, int(config.Advanced.ReadBufferSize.PoolSession))
+				for {
+					_, err := reader.ReadBytes('\n')
+					if err != nil {
+						break
+					}
+				}
+				reads += counter.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestUpSessionBTCHandshakeInterrupted(t *testing.T) {
+	for _, c := range []struct {
+		closeAt string
+		stage   HandshakeStage
+	}{
+		{"caps", HandshakeGetCapabilities},
+		{"conf", HandshakeConfigure},
+		{"sub", HandshakeSubscribe},
+		{"auth", HandshakeAuthorize},
+	} {
+		closeAt := c.closeAt
+		pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+			pool.AcceptHandshakeBTCUntil(conn, reader, closeAt)
+		})
+		config := pool.Config(new(SessionFactoryBTC))
+		manager := NewSessionManager(config)
+		up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+
+		output := captureLog(t, up.Init)
+		manager.cancel()
+		if up.Stat() == StatAuthorized {
+			t.Fatalf("%s: pool closed the connection, should not be authorized", closeAt)
+		}
+		handshakeErr := up.HandshakeError()
+		if handshakeErr == nil || handshakeErr.Stage != c.stage {
+			t.Errorf("%s: wrong handshake error: %v", closeAt, handshakeErr)
+			continue
+		}
+		if handshakeErr.Transient() != (c.stage != HandshakeAuthorize) {
+			t.Errorf("%s: wrong transient flag", closeAt)
+		}
+		if !strings.Contains(output, "closed the connection during handshake, no response to "+c.stage.String()+" received") {
+			t.Errorf("%s: handshake stage is not logged: %s", closeAt, output)
+		}
+	}
+
+	// 握手超时
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTCUntil(conn, reader, "sub") {
+			return
+		}
+		io.Copy(ioutil.Discard, reader)
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolHandshakeTimeoutSeconds = 1
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+	up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+	output := captureLog(t, up.Init)
+	if handshakeErr := up.HandshakeError(); handshakeErr == nil || handshakeErr.Stage != HandshakeSubscribe || handshakeErr.Reason != "timeout" {
+		t.Errorf("wrong handshake error: %v", handshakeErr)
+	}
+	if !strings.Contains(output, "handshake timeout, not authorized in 1 seconds, no response to mining.subscribe received") {
+		t.Errorf("handshake timeout is not logged: %s", output)
+	}
+}
+
+func TestUpSessionBTCAuthorizeResponseBeforeEOF(t *testing.T) {
+	// 矿池发送没有换行符的认证响应后立即断开，认证响应仍然有效
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTCUntil(conn, reader, "auth") {
+			conn.Write([]byte(`{"id":"auth","result":true,"error":null}`))
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	manager := NewSessionManager(config)
+	defer manager.cancel()
+	up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+
+	output := captureLog(t, up.Init)
+	if up.Stat() != StatAuthorized || up.HandshakeError() != nil {
+		t.Fatalf("authorize response before EOF is lost, stat %v, handshake error %v: %s", up.Stat(), up.HandshakeError(), output)
+	}
+	if !strings.Contains(output, "closed the connection right after a line without newline") {
+		t.Errorf("the line before EOF is not logged: %s", output)
+	}
+
+	// 之后按断开处理
+	select {
+	case event := <-up.eventChannel:
+		if _, ok := event.(EventConnBroken); !ok {
+			t.Errorf("expected EventConnBroken after the last line, got %T", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("EOF after the last line is not treated as a disconnect")
+	}
+}
+
+func TestHandshakeProgressPending(t *testing.T) {
+	var progress handshakeProgress
+	if progress.pending() != HandshakeConnect {
+		t.Errorf("nothing sent, wrong stage: %s", progress.pending())
+	}
+	for _, stage := range []HandshakeStage{HandshakeGetCapabilities, HandshakeConfigure, HandshakeSubscribe, HandshakeAuthorize} {
+		progress.send(stage)
+	}
+	progress.receive(HandshakeGetCapabilities)
+	if progress.pending() != HandshakeConfigure {
+		t.Errorf("wrong stage: %s", progress.pending())
+	}
+	// 矿池没有响应 mining.configure，但已响应 mining.subscribe
+	progress.receive(HandshakeSubscribe)
+	if progress.pending() != HandshakeAuthorize || progress.last() != HandshakeAuthorize {
+		t.Errorf("wrong stage: %s", progress.pending())
+	}
+}
+
+// countingConn 统计 Write 的调用次数（相当于写入连接的系统调用次数），写入的内容直接丢弃
+type countingConn struct {
+	net.Conn
+	writes int64
+	bytes  int64
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&conn.writes, 1)
+	atomic.AddInt64(&conn.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+func newCoalesceTestUpSessionBTC(window uint) (up *UpSessionBTC, conn *countingConn) {
+	client, server := net.Pipe()
+	client.Close()
+	up = newTestUpSessionBTC()
+	up.config.Advanced.PoolSubmitCoalesceMilliseconds = window
+	conn = &countingConn{Conn: server}
+	up.serverConn = conn
+	up.stat = StatAuthorized
+	return
+}
+
+func TestUpSessionBTCSubmitCoalesce(t *testing.T) {
+	up, conn := newCoalesceTestUpSessionBTC(5)
+	share := func(sessionID uint16) EventSubmitShareBTC {
+		msg := new(ExMessageSubmitShareBTC)
+		msg.Base.SessionID = sessionID
+		return EventSubmitShareBTC{1, msg, time.Now(), ""}
+	}
+	size := int64(len(share(0).Message.Serialize()))
+
+	up.handleSubmitShare(share(1))
+	up.handleSubmitShare(share(2))
+	if atomic.LoadInt64(&conn.writes) != 0 {
+		t.Fatalf("shares should be queued until the window ends")
+	}
+	select {
+	case e := <-up.eventChannel:
+		if _, ok := e.(EventFlushSubmits); !ok {
+			t.Fatalf("unexpected event: %v", e)
+		}
+		up.flushSubmits()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued shares are not flushed")
+	}
+	if conn.writes != 1 || conn.bytes != 2*size {
+		t.Errorf("shares should be written at once, writes: %d, bytes: %d", conn.writes, conn.bytes)
+	}
+
+	// 其他消息写出前先写出排队中的 share
+	up.handleSubmitShare(share(3))
+	up.writeExMessage(&ExMessageUnregisterWorker{SessionID: 3})
+	if conn.writes != 2 || conn.bytes <= 3*size {
+		t.Errorf("queued share should be written before other messages, writes: %d, bytes: %d", conn.writes, conn.bytes)
+	}
+	up.flushSubmits()
+	if conn.writes != 2 {
+		t.Errorf("nothing should be written without queued shares")
+	}
+
+	// 0 表示立即写出
+	up, conn = newCoalesceTestUpSessionBTC(0)
+	up.handleSubmitShare(share(1))
+	up.handleSubmitShare(share(2))
+	if conn.writes != 2 {
+		t.Errorf("shares should be written immediately, writes: %d", conn.writes)
+	}
+}
+
+// BenchmarkUpSessionBTCSubmitCoalesce 16 台矿机共约 16k share/s 时，不同合并窗口下写入连接的次数
+func BenchmarkUpSessionBTCSubmitCoalesce(b *testing.B) {
+	const miners = 16
+	for _, window := range []uint{0, 1, 2} {
+		b.Run(fmt.Sprintf("window=%dms", window), func(b *testing.B) {
+			up, conn := newCoalesceTestUpSessionBTC(window)
+			go up.handleEvent()
+			defer up.cancel()
+
+			msg := new(ExMessageSubmitShareBTC)
+			size := int64(len(msg.Serialize()))
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for m := 0; m < miners; m++ {
+				wg.Add(1)
+				go func(m int) {
+					defer wg.Done()
+					// 每台矿机每毫秒提交一个 share
+					for i := m; i < b.N; i += miners {
+						msg := new(ExMessageSubmitShareBTC)
+						msg.Base.SessionID = uint16(m)
+						up.SendEvent(EventSubmitShareBTC{i, msg, time.Now(), ""})
+						time.Sleep(time.Millisecond)
+					}
+				}(m)
+			}
+			wg.Wait()
+			for atomic.LoadInt64(&conn.bytes) < int64(b.N)*size {
+				time.Sleep(time.Millisecond)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&conn.writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestUpSessionBTCNotifyBeforeAuthorized(t *testing.T) {
+	// 矿池在订阅响应之后、认证响应之前就发送难度和任务，之后不再发送新任务
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps", "caps_again":
+				pool.WriteLine(conn, `{"id":"`+request.ID.(string)+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+			case "conf":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+			case "sub":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.set_difficulty","params":[1024]}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.set_difficulty","params":[4096]}`)
+				pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["early","0000000000000000000000000000000000000000000000000000000000000000",`+
+					`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+			case "auth":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+			}
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.CoalesceMiningNotify = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	conn, err := net.Dial("tcp", manager.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["w1","x"]}` + "\n"))
+
+	// 矿机加入后立即获得认证之前收到的最新难度和任务
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	difficulty := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the job sent before authorized: %v", err)
+		}
+		if strings.Contains(line, `"method":"mining.set_difficulty"`) {
+			difficulty = line
+		}
+		if strings.Contains(line, `"method":"mining.notify"`) {
+			if !strings.Contains(line, `"params":["early",`) {
+				t.Errorf("wrong job: %s", line)
+			}
+			break
+		}
+	}
+	if difficulty != `{"id":null,"method":"mining.set_difficulty","params":[4096]}`+"\n" {
+		t.Errorf("miner should receive the latest difficulty sent before authorized: %s", difficulty)
+	}
+}
+
+func TestUpSessionBTCUnknownPoolMessage(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.stat = StatAuthorized
+	up.config.Pools = []PoolInfo{{Host: "127.0.0.1", Port: 3333, SubAccount: "test"}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	const notification = `{"id":null,"method":"mining.unknown_extension","params":["abc"]}` + "\n"
+	recv := func(mode string, line string) string {
+		up.config.UnknownPoolMessage = mode
+		return captureLog(t, func() {
+			recvTestJSONRPCUpSessionBTC(t, up, line)
+		})
+	}
+	noRelay := func(mode string) {
+		t.Helper()
+		select {
+		case e := <-down.eventChannel:
+			t.Errorf("unknown message should not be relayed in %s mode: %v", mode, e)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// 默认以 Info 级别打印
+	output := recv(UnknownPoolMessageInfo, notification)
+	if !strings.HasPrefix(output, "I") || !strings.Contains(output, "[TODO] pool request: ") {
+		t.Errorf("wrong log in info mode:\n%s", output)
+	}
+	noRelay(UnknownPoolMessageInfo)
+
+	// strict 以 Warning 级别打印完整消息
+	output = recv(UnknownPoolMessageStrict, notification)
+	if !strings.HasPrefix(output, "W") || !strings.Contains(output, "unknown pool request: "+strings.TrimSpace(notification)) {
+		t.Errorf("wrong log in strict mode:\n%s", output)
+	}
+	output = recv(UnknownPoolMessageStrict, `{"id":"unknown","result":true,"error":null}`+"\n")
+	if !strings.HasPrefix(output, "W") || !strings.Contains(output, `unknown pool response: {"id":"unknown","result":true,"error":null}`) {
+		t.Errorf("wrong log of response in strict mode:\n%s", output)
+	}
+	noRelay(UnknownPoolMessageStrict)
+
+	// quiet 直接丢弃
+	if output = recv(UnknownPoolMessageQuiet, notification); strings.Contains(output, "pool request") {
+		t.Errorf("unknown message should not be logged in quiet mode:\n%s", output)
+	}
+	noRelay(UnknownPoolMessageQuiet)
+
+	// passthrough 只转发跳过能力协商的矿池发送的通知
+	if output = recv(UnknownPoolMessagePassthrough, notification); !strings.Contains(output, "[TODO] pool request: ") {
+		t.Errorf("unknown message should be logged without skip_capabilities:\n%s", output)
+	}
+	noRelay(UnknownPoolMessagePassthrough)
+
+	up.config.Pools[0].Options.SkipCapabilities = true
+	recv(UnknownPoolMessagePassthrough, notification)
+	select {
+	case e := <-down.eventChannel:
+		if bytes, ok := e.(EventSendBytes); !ok || string(bytes.Content) != notification {
+			t.Errorf("wrong message relayed to miner: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("unknown notification is not relayed to miner")
+	}
+
+	// 需要响应的请求不转发
+	recv(UnknownPoolMessagePassthrough, `{"id":5,"method":"mining.unknown_request","params":[]}`+"\n")
+	noRelay(UnknownPoolMessagePassthrough)
+}
+
+func TestUpSessionBTCBroadcastWithBrokenMiner(t *testing.T) {
+	poolConns := make(chan net.Conn, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		poolConns <- conn
+		io.Copy(ioutil.Discard, reader)
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+
+	var poolConn net.Conn
+	select {
+	case poolConn = <-poolConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not connect to pool")
+	}
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+	miners := make([]net.Conn, 3)
+	for i := range miners {
+		miners[i] = dialTestMinerBTC(t, manager, fmt.Sprintf("test.w%d", i+1), "mining.notify")
+		if miners[i] == nil {
+			t.FailNow()
+		}
+		defer miners[i].Close()
+	}
+
+	// 广播过程中一台矿机断开，其他矿机仍然收到全部任务
+	const jobs = 200
+	for i := 0; i < jobs; i++ {
+		if i == jobs/4 {
+			miners[0].Close()
+		}
+		pool.WriteLine(poolConn, fmt.Sprintf(`{"id":null,"method":"mining.notify","params":["j%d","0000000000000000000000000000000000000000000000000000000000000000",`+
+			`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",false]}`, i))
+	}
+	last := fmt.Sprintf(`"params":["j%d",`, jobs-1)
+	for i, miner := range miners[1:] {
+		miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(miner)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("miner #%d did not receive all jobs: %v", i+1, err)
+			}
+			if strings.Contains(line, last) {
+				break
+			}
+		}
+	}
+
+	// 矿池连接在广播过程中断开，矿机转移到其他矿池连接，代理仍然正常
+	for i := 0; i < jobs/2; i++ {
+		pool.WriteLine(poolConn, fmt.Sprintf(`{"id":null,"method":"mining.notify","params":["k%d","0000000000000000000000000000000000000000000000000000000000000000",`+
+			`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",false]}`, i))
+	}
+	poolConn.Close()
+	select {
+	case poolConn = <-poolConns:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent did not reconnect to pool")
+	}
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+	if status := manager.HealthCheck(); !status.Live || !status.Ready {
+		t.Errorf("agent should be healthy after the pool reconnected: %+v", status)
+	}
+	for i, miner := range miners[1:] {
+		miner.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		reader := bufio.NewReader(miner)
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					t.Errorf("miner #%d should stay connected: %v", i+1, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// 比特币创世区块：coinbase 交易拆分为 coinbase1、矿池的 extranonce1（4 字节）、extranonce2（8 字节）和 coinbase2，
+// 区块头的哈希满足约 2536 的难度
+const testGenesisCoinbaseTxBTC = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+func TestUpSessionBTCDifficultyMultiplier(t *testing.T) {
+	coinbaseTx := testGenesisCoinbaseTxBTC
+	coinbase1, poolExtraNonce1, coinbase2 := coinbaseTx[:10], coinbaseTx[10:18], coinbaseTx[34:]
+
+	submits := make(chan uint32, 4)
+	reports := make(chan ExMessageMiningSetDiff, 4)
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		for authorized := false; !authorized; {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps":
+				pool.WriteLine(conn, `{"id":"caps","result":{"capabilities":["verrol"]},"error":null}`)
+			case "conf":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":false},"error":null}`)
+			case "sub":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","`+poolExtraNonce1+`"]],"`+poolExtraNonce1+`",8],"error":null}`)
+			case "auth":
+				pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				authorized = true
+			}
+		}
+		pool.WriteLine(conn, `{"id":null,"method":"mining.set_difficulty","params":[1024]}`)
+		pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+			`"`+coinbase1+`","`+coinbase2+`",[],"00000001","1d00ffff","495fab29",true]}`)
+		readTestExMessages(reader, func(header ExMessageHeader, body []byte) {
+			switch header.Type {
+			case CMD_SUBMIT_SHARE, CMD_SUBMIT_SHARE_WITH_TIME:
+				if len(body) >= 11 {
+					submits <- binary.LittleEndian.Uint32(body[7:])
+				}
+			case CMD_MINING_SET_DIFF:
+				var msg ExMessageMiningSetDiff
+				if err := msg.Unserialize(body); err == nil {
+					reports <- msg
+				}
+			}
+		})
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Pools[0].Options.DifficultyMultiplier = 4
+	config.Pools[0].Options.ReportDifficulty = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	conn, err := net.Dial("tcp", manager.Addr().String())
+	if err != nil {
+		t.Fatalf("connect to agent failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["test.w1","x"]}` + "\n"))
+
+	// 矿机收到矿池难度的 4 倍
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	var difficulty float64
+	gotJob := false
+	for difficulty == 0 || !gotJob {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive the difficulty and the job: %v", err)
+		}
+		if bytes.HasPrefix(line, []byte(`{"id":1,`)) {
+			// 创世区块的 extranonce2 由全 0 的会话ID和矿机的 extranonce2 组成
+			if !bytes.Contains(line, []byte(`"00000000",4]`)) {
+				t.Fatalf("the test needs session id 0: %s", line)
+			}
+			continue
+		}
+		rpcData, err := NewJSONRPCLineBTC(line)
+		if err != nil {
+			continue
+		}
+		switch rpcData.Method {
+		case "mining.set_difficulty":
+			difficulty, _ = rpcData.Params[0].(float64)
+		case "mining.notify":
+			gotJob = true
+		}
+	}
+	if difficulty != 4096 {
+		t.Errorf("miner should receive difficulty 4096, got %v", difficulty)
+	}
+
+	// 矿机的难度报告给矿池，以便矿池按该难度统计 share
+	select {
+	case msg := <-reports:
+		if msg.Base.DiffExp != 12 || len(msg.SessionIDs) != 1 || msg.SessionIDs[0] != 0 {
+			t.Errorf("wrong difficulty report: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("difficulty of miner is not reported to pool")
+	}
+
+	// 创世区块的 nonce 满足矿池难度（但不满足矿机难度），提交给矿池；改变 nonce 后不满足矿池难度，在本地拒绝
+	conn.Write([]byte(`{"id":3,"method":"mining.submit","params":["test.w1","1","00000000","495fab29","7c2bac1e"]}` + "\n" +
+		`{"id":4,"method":"mining.submit","params":["test.w1","1","00000000","495fab29","7c2bac1d"]}` + "\n"))
+
+	responses := map[string]string{}
+	for len(responses) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not receive share responses: %v, %v", err, responses)
+		}
+		for _, id := range []string{`{"id":3,`, `{"id":4,`} {
+			if strings.HasPrefix(line, id) {
+				responses[id] = line
+			}
+		}
+	}
+	if !strings.Contains(responses[`{"id":3,`], `"error":[23,`) || !strings.Contains(responses[`{"id":4,`], `"result":true`) {
+		t.Errorf("wrong share responses: %v", responses)
+	}
+
+	select {
+	case nonce := <-submits:
+		if nonce != 0x7c2bac1d {
+			t.Errorf("wrong nonce of submitted share: %x", nonce)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pool did not receive the share meeting its difficulty")
+	}
+	select {
+	case nonce := <-submits:
+		t.Errorf("share below the pool difficulty should not be submitted: %x", nonce)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpSessionBTCMissingSessionID(t *testing.T) {
+	for _, c := range []struct {
+		sessionID        string
+		missingSessionID string
+		authorized       bool
+	}{
+		{`""`, "", false},
+		{`null`, MissingSessionIDFailover, false},
+		{`""`, MissingSessionIDZero, true},
+		{`null`, MissingSessionIDZero, true},
+	} {
+		sessionID := c.sessionID
+		pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+			if !pool.AcceptConnTest(conn, reader) {
+				return
+			}
+			for {
+				request, err := pool.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				switch request.ID {
+				case "caps", "caps_again":
+					pool.WriteLine(conn, `{"id":"`+request.ID.(string)+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+				case "sub":
+					pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify",`+sessionID+`]],`+sessionID+`,8],"error":null}`)
+				case "auth":
+					pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				}
+			}
+		})
+		config := pool.Config(new(SessionFactoryBTC))
+		config.Pools[0].Options.MissingSessionID = c.missingSessionID
+		manager := NewSessionManager(config)
+		up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+		up.Init()
+		manager.cancel()
+
+		name := sessionID + " " + c.missingSessionID
+		if (up.Stat() == StatAuthorized) != c.authorized {
+			t.Errorf("%s: wrong stat %v, authorized expected: %v", name, up.Stat(), c.authorized)
+			continue
+		}
+		if c.authorized {
+			if up.sessionID != 0 || len(up.extraNonce1) > 0 {
+				t.Errorf("%s: session id should be 0: %d %q", name, up.sessionID, up.extraNonce1)
+			}
+			continue
+		}
+		// 视为协议不兼容，由 UpSessionManager 切换到下一个矿池
+		handshakeErr := up.HandshakeError()
+		if handshakeErr == nil || handshakeErr.Stage != HandshakeSubscribe || !handshakeErr.Incompatible || handshakeErr.Reason != "session id is missing" {
+			t.Errorf("%s: wrong handshake error: %v", name, handshakeErr)
+		}
+	}
+}
+
+func TestUpSessionBTCStrictConfigureResponse(t *testing.T) {
+	for _, c := range []struct {
+		result     string
+		strict     bool
+		authorized bool
+	}{
+		{`{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null`, true, true},
+		{`false,"error":[20,"Unsupported method",null]`, true, true},
+		{`{"version-rolling":false},"error":null`, true, true},
+		{`["version-rolling","1fffe000"],"error":null`, false, true},
+		{`["version-rolling","1fffe000"],"error":null`, true, false},
+		{`{"version-rolling":true,"version-rolling.mask":1},"error":null`, true, false},
+	} {
+		result := c.result
+		pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+			if !pool.AcceptConnTest(conn, reader) {
+				return
+			}
+			for {
+				request, err := pool.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				switch request.ID {
+				case "caps", "caps_again":
+					pool.WriteLine(conn, `{"id":"`+request.ID.(string)+`","result":{"capabilities":["verrol","subres"]},"error":null}`)
+				case "conf":
+					pool.WriteLine(conn, `{"id":"conf","result":`+result+`}`)
+				case "sub":
+					pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",8],"error":null}`)
+				case "auth":
+					pool.WriteLine(conn, `{"id":"auth","result":true,"error":null}`)
+				}
+			}
+		})
+		config := pool.Config(new(SessionFactoryBTC))
+		config.Advanced.StrictConfigureResponse = c.strict
+		manager := NewSessionManager(config)
+		up := NewUpSessionBTC(NewUpSessionManager("", "", config, manager), config, 0, 0)
+		up.Init()
+		manager.cancel()
+
+		name := fmt.Sprintf("%s strict=%v", result, c.strict)
+		if (up.Stat() == StatAuthorized) != c.authorized {
+			t.Errorf("%s: wrong stat %v, authorized expected: %v", name, up.Stat(), c.authorized)
+			continue
+		}
+		if c.authorized {
+			continue
+		}
+		// 视为协议不兼容，由 UpSessionManager 切换到下一个矿池
+		handshakeErr := up.HandshakeError()
+		if handshakeErr == nil || handshakeErr.Stage != HandshakeConfigure || !handshakeErr.Incompatible ||
+			!strings.HasPrefix(handshakeErr.Reason, "unrecognized mining.configure response") {
+			t.Errorf("%s: wrong handshake error: %v", name, handshakeErr)
+		}
+	}
+}
+
+func TestUpSessionBTCSubmitWorkerName(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.subAccount = "alice"
+	up.config.Pools = []PoolInfo{{Host: "pool.example.com", Port: 3333}}
+	up.downSessions[1] = &DownSessionBTC{workerName: "w1"}
+
+	if name := up.submitWorkerName(1, "w2"); name != "alice" {
+		t.Errorf("shares should be submitted as the sub-account without worker_name_format: %s", name)
+	}
+	up.config.Pools[0].Options.WorkerNameFormat = "{sub_account}.{worker}"
+	// 同一连接上的其他矿工以自己的矿机名提交
+	if name := up.submitWorkerName(1, "w2"); name != "alice.w2" {
+		t.Errorf("share of w2 submitted as %s", name)
+	}
+	if name := up.submitWorkerName(1, ""); name != "alice.w1" {
+		t.Errorf("share without worker name submitted as %s", name)
+	}
+}
+
+func TestUpSessionBTCVersionRollingMinBitCount(t *testing.T) {
+	up := newTestUpSessionBTC()
+	up.serverCapVersionRolling = true
+	up.versionMask = 0x1fffe000
+	up.versionRollingMinBitCount = 16
+	up.rpcSetVersionMask = []byte(`{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}` + "\n")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// 丢弃注册矿工的 ex-message
+	go io.Copy(ioutil.Discard, client)
+	up.serverConn = server
+
+	attach := func(versionMask uint32) (*DownSessionBTC, EventSetVersionMask) {
+		_, minerServer := net.Pipe()
+		down := NewDownSessionBTC(up.manager.parent, minerServer, 1)
+		down.storeVersionMask(versionMask)
+		up.addDownSession(EventAddDownSession{down})
+		for {
+			select {
+			case e := <-down.eventChannel:
+				if mask, ok := e.(EventSetVersionMask); ok {
+					return down, mask
+				}
+			default:
+				t.Fatalf("miner with version mask %08x is not sent a version mask", versionMask)
+			}
+		}
+	}
+
+	// 可滚动的位数不足，停止滚动版本位
+	down, mask := attach(0x00006000)
+	if mask.VersionMask != 0 || !strings.Contains(string(mask.Content), `"00000000"`) || down.loadVersionMask() != 0 {
+		t.Errorf("version rolling of the miner should be disabled: %v, %08x", mask, down.loadVersionMask())
+	}
+
+	down, mask = attach(0x1fffe000)
+	if mask.VersionMask != 0x1fffe000 || down.loadVersionMask() != 0x1fffe000 {
+		t.Errorf("miner with enough version bits should keep rolling: %v, %08x", mask, down.loadVersionMask())
+	}
+}
+
+func TestUpSessionBTCExpireSubmitIDs(t *testing.T) {
+	up := newTestUpSessionBTC()
+	_, server := net.Pipe()
+	down := NewDownSessionBTC(up.manager.parent, server, 1)
+	up.downSessions[down.sessionID] = down
+
+	now := time.Now()
+	up.submitIDs.Add(1, down.sessionID, now.Add(-2*up.config.Advanced.PoolSubmitResponseTimeoutSeconds.Get()))
+	up.submitIDs.Add(2, down.sessionID, now)
+	up.expireSubmitIDs()
+
+	// 超时的 share 在本地响应为接受，单独计数
+	select {
+	case e := <-down.eventChannel:
+		if response, ok := e.(EventSubmitResponse); !ok || response.ID != 1 || response.Status != STATUS_ACCEPT {
+			t.Errorf("wrong response of the expired share: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired share is not responded")
+	}
+	if count := up.manager.parent.metrics.UnconfirmedSubmits.Get("reason", "timeout"); count != 1 || up.submitIDs.Len() != 1 {
+		t.Errorf("wrong unconfirmed submits: %v, %d waiting", count, up.submitIDs.Len())
+	}
+}
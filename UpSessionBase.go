@@ -1,13 +1,189 @@
-package main
+package btcagent
 
-type SubmitID struct {
-	ID        interface{}
-	SessionID uint16
-}
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
 
 type UpSession interface {
 	Stat() AuthorizeStat
+	AuthorizeError() *AuthorizeError
+	HandshakeError() *HandshakeError
+	// HasJob 是否已收到矿池的任务，只在 Run() 之前调用
+	HasJob() bool
 	Init()
 	Run()
 	SendEvent(event interface{})
 }
+
+// RequestedCapabilities 通过 agent.get_capabilities 向矿池请求的能力，未配置时使用默认值
+func RequestedCapabilities(config *Config, defaults ...string) []string {
+	if config.Advanced.PoolCapabilities != nil {
+		return config.Advanced.PoolCapabilities
+	}
+	return defaults
+}
+
+// NegotiateCapabilities 获取双方均支持的能力
+func NegotiateCapabilities(requested []string, offered []string) (negotiated []string) {
+	negotiated = []string{}
+	for _, capability := range requested {
+		if containsString(offered, capability) {
+			negotiated = append(negotiated, capability)
+		}
+	}
+	return
+}
+
+// MissingCapabilities 获取协商结果中缺少的必需能力
+func MissingCapabilities(required []string, negotiated []string) (missing []string) {
+	for _, capability := range required {
+		if !containsString(negotiated, capability) {
+			missing = append(missing, capability)
+		}
+	}
+	return
+}
+
+// jsonRequestForLog 获取打印到日志中的请求，mining.authorize 中的密码会被隐藏
+func jsonRequestForLog(request *JSONRPCRequest, bytes []byte) string {
+	if NormalizeMethod(request.Method) != "mining.authorize" || len(request.Params) < 2 {
+		return string(bytes)
+	}
+	masked := *request
+	masked.Params = append([]interface{}{}, request.Params...)
+	masked.Params[1] = Password(fmt.Sprint(request.Params[1])).String()
+	maskedBytes, err := masked.ToJSONBytesLine()
+	if err != nil {
+		return ""
+	}
+	return string(maskedBytes)
+}
+
+// logUnknownPoolMessage 按 unknown_pool_message 记录无法处理的矿池消息，kind 为 "request" 或 "response"
+func logUnknownPoolMessage(config *Config, id string, kind string, rpcData interface{}, jsonBytes []byte) {
+	switch config.UnknownPoolMessage {
+	case UnknownPoolMessageQuiet:
+	case UnknownPoolMessageStrict:
+		Log.Warning(id, "unknown pool ", kind, ": ", strings.TrimSpace(string(jsonBytes)))
+	default:
+		Log.Info(id, "[TODO] pool ", kind, ": ", rpcData)
+	}
+}
+
+// 矿池发送的数据由 ex-message 和 JSON 行两种帧组成。读取时只根据每帧的第一个字节判断帧的类型，
+// 并且总是读完整帧（ex-message 按 header 中的长度读取，JSON 行读到换行符）后再判断下一帧，
+// 因此一帧被拆分到多个 TCP 包中也不会导致错位。读取出错时直接断开连接，不会从帧的中间继续读取。
+//
+// 矿池在 JSON 行的中间插入 ex-message 时，读到的“行”会包含 ex-message，无法解析。
+// 这时连同其中的 ex-message 一起丢弃，之后的数据也不再可靠，因此断开连接而不是忽略该行。
+
+// misframedPoolLine 无法解析的 JSON 行中是否混入了 ex-message（包含 ex-message 的 magic number）
+func misframedPoolLine(line []byte) bool {
+	return bytes.IndexByte(line, ExMessageMagicNumber) >= 0
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeError 矿池拒绝认证的原因
+type AuthorizeError struct {
+	Code    int
+	Message string
+	// 重试也不会成功的错误（如子账户不存在、被封禁），应降低重试频率
+	Permanent bool
+}
+
+// NewAuthorizeError 检查 mining.authorize 的响应，认证成功时返回 nil。
+// 只有 result 为 true 且 error 为空时才认为认证成功。
+func NewAuthorizeError(result interface{}, rpcErr interface{}) (err *AuthorizeError) {
+	success, _ := result.(bool)
+	if success && rpcErr == nil {
+		return nil
+	}
+
+	err = new(AuthorizeError)
+	code, message, ok := ParseJSONRPCError(rpcErr)
+	if !ok {
+		err.Message = "authorize result is not true"
+		return
+	}
+	err.Code = code
+	err.Message = message
+	_, err.Permanent = PermanentAuthorizeErrorCodes[code]
+	return
+}
+
+func (err *AuthorizeError) Error() string {
+	kind := "transient"
+	if err.Permanent {
+		kind = "permanent"
+	}
+	return fmt.Sprintf("[%d] %s (%s)", err.Code, err.Message, kind)
+}
+
+// HandshakeError 握手过程中连接断开、写入失败、超时或响应无法解析，Stage 为当时正在等待响应的步骤
+type HandshakeError struct {
+	Stage  HandshakeStage
+	Reason string
+	// 矿池的响应无法解析，矿池使用不兼容的协议
+	Incompatible bool
+}
+
+func (err *HandshakeError) Error() string {
+	return fmt.Sprintf("%s failed: %s", err.Stage, err.Reason)
+}
+
+// Transient 矿池在响应认证请求之前就断开了连接，与子账户无关，应当重试。协议不兼容的错误不会自行恢复。
+func (err *HandshakeError) Transient() bool {
+	return err.Stage < HandshakeAuthorize && !err.Incompatible
+}
+
+// handshakeProgress 记录已发送的握手请求和已收到的响应，用于判断握手失败的步骤。
+// 矿池按顺序响应请求（有些矿池不响应 mining.configure），因此最后一个已响应的请求之后的第一个请求
+// 就是正在等待响应的步骤。只能在事件循环中使用。
+type handshakeProgress struct {
+	sent     uint8
+	received uint8
+}
+
+func (progress *handshakeProgress) send(stage HandshakeStage) {
+	progress.sent |= 1 << stage
+}
+
+func (progress *handshakeProgress) receive(stage HandshakeStage) {
+	progress.received |= 1 << stage
+}
+
+// last 获取最后发送的请求的步骤，尚未发送任何请求时返回 HandshakeConnect
+func (progress *handshakeProgress) last() (stage HandshakeStage) {
+	for i := HandshakeGetCapabilities; i <= HandshakeAuthorize; i++ {
+		if progress.sent&(1<<i) != 0 {
+			stage = i
+		}
+	}
+	return
+}
+
+// pending 获取正在等待响应的步骤，尚未发送任何请求时返回 HandshakeConnect
+func (progress *handshakeProgress) pending() HandshakeStage {
+	stage := HandshakeGetCapabilities
+	for i := HandshakeGetCapabilities; i <= HandshakeAuthorize; i++ {
+		if progress.received&(1<<i) != 0 {
+			stage = i + 1
+		}
+	}
+	for ; stage <= HandshakeAuthorize; stage++ {
+		if progress.sent&(1<<stage) != 0 {
+			return stage
+		}
+	}
+	return progress.last()
+}
@@ -1,7 +1,8 @@
-package main
+package btcagent
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -29,39 +31,67 @@ type UpSessionETH struct {
 	serverConn      net.Conn
 	serverReader    *bufio.Reader
 	readLoopRunning bool
+	readAuthorized  int32 // 供读循环判断是否已认证，需原子读写
 
-	stat      AuthorizeStat
-	sessionID uint32
+	stat           AuthorizeStat
+	authorizeError *AuthorizeError
+	authorizedTime time.Time // 认证成功的时间，断开后清零，用于矿池连接统计
+	handshake      handshakeProgress
+	handshakeError *HandshakeError
+	sessionID      uint32
 
 	serverCapSubmitResponse bool
+	serverCapSubmitHashrate bool // 矿池接受 CMD_SUBMIT_HASHRATE，未协商时不转发矿机声明的算力
+
+	// 等待合并写出的 share（启用 pool_submit_coalesce_milliseconds 时）
+	pendingSubmits []byte
 
 	eventLoopRunning bool
 	eventChannel     chan interface{}
 
+	// 由 UpSessionManager 的 ctx 派生，取消后断开连接、退出事件循环
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 握手（订阅、认证等）的截止时间，超时未认证成功则断开连接
+	handshakeDeadline time.Time
+
 	lastJob     *StratumJobETH
 	defaultDiff uint64
 
-	submitIDs   map[uint16]SubmitID
-	submitIndex uint16
+	// 尚未广播给矿机的任务，启用 coalesce_mining_notify 时使用
+	pendingJobs []*StratumJobETH
+
+	// 提交给矿池的 share 序号与矿机请求 ID 的对应关系，用于 submit_response_from_server
+	submitIDs *SubmitIDMap
+	// 退出前等待已提交的 share 的响应（shutdown_submit_grace_seconds），未在等待时为 nil
+	waitingSubmits *EventWaitSubmits
+	// 限制发给矿机的难度
+	difficultyClamp *DifficultyClamp
 
 	// 用于统计断开连接的矿机数，并同步给 UpSessionManager
 	disconnectedMinerCounter int
+
+	// 认证成功前收到的 ex-message，认证成功后再处理
+	pendingExMessages []*ExMessage
 }
 
-func NewUpSessionETH(manager *UpSessionManager, poolIndex int, slot int) (up *UpSessionETH) {
+func NewUpSessionETH(manager *UpSessionManager, config *Config, poolIndex int, slot int) (up *UpSessionETH) {
 	up = new(UpSessionETH)
 	up.manager = manager
-	up.config = manager.config
+	up.config = config
 	up.slot = slot
 	up.subAccount = manager.subAccount
 	up.poolIndex = poolIndex
 	up.downSessions = make(map[uint16]*DownSessionETH)
 	up.stat = StatDisconnected
-	up.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSession)
-	up.submitIDs = make(map[uint16]SubmitID)
+	up.eventChannel = make(chan interface{}, up.config.Advanced.MessageQueueSize.PoolSession)
+	up.ctx, up.cancel = context.WithCancel(manager.ctx)
+	up.submitIDs = NewSubmitIDMap(up.config.Advanced.PoolSubmitResponseTimeoutSeconds.Get())
+	up.difficultyClamp = NewDifficultyClamp(up.config, 1)
 
 	if !up.config.MultiUserMode {
-		up.subAccount = manager.config.Pools[poolIndex].SubAccount
+		up.subAccount = up.config.PoolSubAccount(poolIndex)
 	}
 
 	return
@@ -71,11 +101,23 @@ func (up *UpSessionETH) Stat() AuthorizeStat {
 	return up.stat
 }
 
+func (up *UpSessionETH) AuthorizeError() *AuthorizeError {
+	return up.authorizeError
+}
+
+func (up *UpSessionETH) HandshakeError() *HandshakeError {
+	return up.handshakeError
+}
+
+func (up *UpSessionETH) HasJob() bool {
+	return up.lastJob != nil
+}
+
 func (up *UpSessionETH) connect() {
 	pool := up.config.Pools[up.poolIndex]
-	url := fmt.Sprintf("%s:%d", pool.Host, pool.Port)
+	url := pool.Address()
 
-	if up.config.PoolUseTls {
+	if up.config.PoolUseTLS(up.poolIndex) {
 		up.id = fmt.Sprintf("pool#%d <%s> [tls://%s] ", up.slot, up.subAccount, url)
 	} else {
 		up.id = fmt.Sprintf("pool#%d <%s> [%s] ", up.slot, up.subAccount, url)
@@ -93,7 +135,12 @@ func (up *UpSessionETH) connect() {
 
 	// 接收连接事件
 	for i := 0; i < counter; i++ {
-		event := <-up.eventChannel
+		var event interface{}
+		select {
+		case event = <-up.eventChannel:
+		case <-up.ctx.Done():
+			return
+		}
 		switch e := event.(type) {
 		case EventUpSessionConnection:
 			up.upSessionConnection(e)
@@ -101,7 +148,7 @@ func (up *UpSessionETH) connect() {
 				return
 			}
 		default:
-			glog.Error(up.id, "unknown event: ", e)
+			Log.Error(up.id, "unknown event: ", e)
 		}
 	}
 
@@ -112,21 +159,26 @@ func (up *UpSessionETH) connect() {
 
 	// 尝试直连
 	go up.tryConnect(pool.Host, url, "")
-	event := <-up.eventChannel
+	var event interface{}
+	select {
+	case event = <-up.eventChannel:
+	case <-up.ctx.Done():
+		return
+	}
 	switch e := event.(type) {
 	case EventUpSessionConnection:
 		up.upSessionConnection(e)
 	default:
-		glog.Error(up.id, "unknown event: ", e)
+		Log.Error(up.id, "unknown event: ", e)
 	}
 }
 
 func (up *UpSessionETH) upSessionConnection(e EventUpSessionConnection) {
 	if e.Error != nil {
 		if len(e.ProxyURL) > 0 {
-			glog.Warning(up.id, "proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
+			Log.Warning(up.id, "proxy [", e.ProxyURL, "] failed: ", e.Error.Error())
 		} else {
-			glog.Warning(up.id, "direct connection failed: ", e.Error.Error())
+			Log.Warning(up.id, "direct connection failed: ", e.Error.Error())
 		}
 
 		if e.Conn != nil {
@@ -141,9 +193,9 @@ func (up *UpSessionETH) upSessionConnection(e EventUpSessionConnection) {
 	up.id += fmt.Sprintf("(%s) ", up.serverConn.RemoteAddr().String())
 
 	if len(e.ProxyURL) > 0 {
-		glog.Info(up.id, "successfully connected with proxy [", e.ProxyURL, "]")
+		Log.Info(up.id, "successfully connected with proxy [", e.ProxyURL, "]")
 	} else {
-		glog.Info(up.id, "successfully connected directly")
+		Log.Info(up.id, "successfully connected directly")
 	}
 }
 
@@ -157,47 +209,57 @@ func (up *UpSessionETH) tryConnect(poolHost, poolURL, proxyURL string) {
 	var reader *bufio.Reader
 
 	if len(proxyURL) > 0 {
-		glog.Info(up.id, "connect to pool server with proxy [", proxyURL, "]...")
+		Log.Info(up.id, "connect to pool server with proxy [", proxyURL, "]...")
 		dialer, err = GetProxyDialer(proxyURL, timeout, insecureSkipVerify)
 	} else {
-		glog.Info(up.id, "connect to pool server directly...")
-		dialer = &net.Dialer{Timeout: timeout}
+		Log.Info(up.id, "connect to pool server directly...")
+		dialer = up.config.DirectDialer()
 	}
 
 	if err == nil {
-		conn, err = dialer.Dial("tcp", poolURL)
+		conn, err = DialRetry(up.config, dialer, poolURL, up.id)
 		if err == nil {
-			if up.config.PoolUseTls {
+			if up.config.PoolUseTLS(up.poolIndex) {
 				conn = tls.Client(conn, &tls.Config{
 					ServerName:         poolHost,
 					InsecureSkipVerify: insecureSkipVerify,
 				})
 			}
+			if capture := up.manager.parent.poolCapture; capture != nil {
+				conn = capture.Wrap(conn, poolURL)
+			}
 			reader, err = up.testConnection(conn)
 		}
 	}
 
-	up.SendEvent(EventUpSessionConnection{proxyURL, conn, reader, err})
+	select {
+	case up.eventChannel <- EventUpSessionConnection{proxyURL, conn, reader, err}:
+	case <-up.ctx.Done():
+		// 已退出，没有人会接收这个连接
+		if conn != nil {
+			conn.Close()
+		}
+	}
 }
 
 func (up *UpSessionETH) testConnection(conn net.Conn) (reader *bufio.Reader, err error) {
 	ch := make(chan error, 1)
-	reader = bufio.NewReader(conn)
+	reader = bufio.NewReaderSize(conn, int(up.config.Advanced.ReadBufferSize.PoolSession))
 
 	go func() {
 		capsRequest := up.getAgentGetCapsRequest("conn_test")
-		bytes, e := capsRequest.ToJSONBytesLine()
+		bytes, e := up.requestWithPoolID(&capsRequest).ToJSONBytesLine()
 		if e == nil {
-			if glog.V(10) {
-				glog.Info(up.id, "testConnection send: ", string(bytes))
+			if glog.V(10) || LogJSONRPC.V(10) {
+				Log.Info(up.id, "testConnection send: ", string(bytes))
 			}
-			conn.SetWriteDeadline(up.getIODeadLine())
-			_, e = conn.Write(bytes)
+			conn.SetWriteDeadline(up.getIODeadLine(up.config.PoolWriteTimeout(up.poolIndex), false))
+			_, e = WriteFull(conn, bytes)
 			if e == nil {
-				conn.SetReadDeadline(up.getIODeadLine())
+				conn.SetReadDeadline(up.getIODeadLine(up.config.PoolReadTimeout(up.poolIndex), false))
 				bytes, e = reader.ReadBytes('\n')
-				if glog.V(9) {
-					glog.Info(up.id, "testConnection recv: ", string(bytes))
+				if glog.V(9) || LogJSONRPC.V(9) {
+					Log.Info(up.id, "testConnection recv: ", string(bytes))
 				}
 			}
 		}
@@ -215,43 +277,110 @@ func (up *UpSessionETH) testConnection(conn net.Conn) (reader *bufio.Reader, err
 }
 
 func (up *UpSessionETH) writeJSONRequest(jsonData *JSONRPCRequest) (int, error) {
+	jsonData = up.requestWithPoolID(jsonData)
 	bytes, err := jsonData.ToJSONBytesLine()
 	if err != nil {
 		return 0, err
 	}
-	if glog.V(10) {
-		glog.Info(up.id, "writeJSONRequest: ", string(bytes))
+	if glog.V(10) || LogJSONRPC.V(10) {
+		Log.Info(up.id, "writeJSONRequest: ", jsonRequestForLog(jsonData, bytes))
 	}
 	return up.writeBytes(bytes)
 }
 
+// requestWithPoolID 矿池要求数字 id 时返回换成数字 id 的请求副本
+func (up *UpSessionETH) requestWithPoolID(jsonData *JSONRPCRequest) *JSONRPCRequest {
+	id, ok := jsonData.ID.(string)
+	if !ok || !up.config.PoolNumericRequestID(up.poolIndex) {
+		return jsonData
+	}
+	request := *jsonData
+	request.ID = NumericRequestID(id)
+	return &request
+}
+
 func (up *UpSessionETH) writeExMessage(msg SerializableExMessage) (int, error) {
 	bytes := msg.Serialize()
-	if glog.V(10) && len(bytes) > 1 {
-		glog.Info(up.id, "writeExMessage: ", bytes[1], msg, " ", hex.EncodeToString(bytes))
+	if (glog.V(10) || LogExMessage.V(10)) && len(bytes) > 1 {
+		Log.Info(up.id, "writeExMessage: ", bytes[1], msg, " len=", len(bytes), " ", hex.EncodeToString(bytes))
 	}
 	return up.writeBytes(bytes)
 }
 
 func (up *UpSessionETH) writeBytes(bytes []byte) (int, error) {
+	if len(up.pendingSubmits) > 0 {
+		// 先写出等待合并的 share，保持与其他消息（如注销矿工）的顺序
+		bytes = append(up.pendingSubmits, bytes...)
+		up.pendingSubmits = nil
+	}
 	up.setWriteDeadline()
-	return up.serverConn.Write(bytes)
+	// 只写出部分数据时调用方会断开连接，不会从帧的中间继续写
+	return WriteFull(up.serverConn, bytes)
+}
+
+// writeSubmitExMessage 提交 share。启用 pool_submit_coalesce_milliseconds 时先放入队列，
+// 窗口结束时与窗口内的其他 share 在一次写入中发给矿池，以减少系统调用
+func (up *UpSessionETH) writeSubmitExMessage(msg SerializableExMessage) (int, error) {
+	window := up.config.Advanced.PoolSubmitCoalesceMilliseconds
+	if window == 0 {
+		return up.writeExMessage(msg)
+	}
+
+	bytes := msg.Serialize()
+	if (glog.V(10) || LogExMessage.V(10)) && len(bytes) > 1 {
+		Log.Info(up.id, "queue ExMessage: ", bytes[1], msg, " len=", len(bytes), " ", hex.EncodeToString(bytes))
+	}
+	if len(up.pendingSubmits) == 0 {
+		time.AfterFunc(time.Duration(window)*time.Millisecond, func() {
+			up.SendEvent(EventFlushSubmits{})
+		})
+	}
+	up.pendingSubmits = append(up.pendingSubmits, bytes...)
+	if len(up.pendingSubmits) >= UpSessionMaxCoalescedSubmitBytes {
+		return up.writeBytes(nil)
+	}
+	return len(bytes), nil
+}
+
+// flushSubmits 写出等待合并的 share
+func (up *UpSessionETH) flushSubmits() {
+	if len(up.pendingSubmits) == 0 {
+		return
+	}
+	_, err := up.writeBytes(nil)
+	if err != nil {
+		Log.Error(up.id, "failed to submit share: ", err.Error())
+		up.close()
+	}
+}
+
+func (up *UpSessionETH) requestedCapabilities() []string {
+	capabilities := []string{}
+	if up.config.SubmitResponseFromServer {
+		capabilities = append(capabilities, CapSubmitResponse)
+	}
+	if up.config.Advanced.ForwardDeclaredHashrate {
+		capabilities = append(capabilities, CapSubmitHashrate)
+	}
+	return RequestedCapabilities(up.config, capabilities...)
 }
 
 func (up *UpSessionETH) getAgentGetCapsRequest(id string) (req JSONRPCRequest) {
 	req.ID = id
 	req.Method = "agent.get_capabilities"
-	if up.config.SubmitResponseFromServer {
-		req.SetParams(JSONRPCArray{CapSubmitResponse})
-	} else {
-		req.SetParams(JSONRPCArray{})
+
+	caps := JSONRPCArray{}
+	for _, capability := range up.requestedCapabilities() {
+		caps = append(caps, capability)
 	}
+	req.SetParams(caps)
 	return
 }
 
 func (up *UpSessionETH) sendInitRequest() (err error) {
 	// send agent.get_capabilities first
 	capsRequest := up.getAgentGetCapsRequest("caps")
+	up.handshake.send(HandshakeGetCapabilities)
 	_, err = up.writeJSONRequest(&capsRequest)
 	if err != nil {
 		return
@@ -262,6 +391,7 @@ func (up *UpSessionETH) sendInitRequest() (err error) {
 	// send subscribe request
 	request.ID = "sub"
 	request.Method = "mining.subscribe"
+	up.handshake.send(HandshakeSubscribe)
 	request.SetParams(UpSessionUserAgent)
 	_, err = up.writeJSONRequest(&request)
 	if err != nil {
@@ -271,7 +401,8 @@ func (up *UpSessionETH) sendInitRequest() (err error) {
 	// send authorize request
 	request.ID = "auth"
 	request.Method = "mining.authorize"
-	request.SetParams(up.subAccount, "")
+	up.handshake.send(HandshakeAuthorize)
+	request.SetParams(up.subAccount, up.config.PoolAuthorizePassword(up.poolIndex, up.subAccount, up.manager.minerPassword))
 	_, err = up.writeJSONRequest(&request)
 	if err != nil {
 		return
@@ -292,7 +423,12 @@ func (up *UpSessionETH) exit() {
 
 func (up *UpSessionETH) close() {
 	if up.stat == StatAuthorized {
-		up.manager.SendEvent(EventUpSessionBroken{up.slot})
+		up.manager.SendEvent(EventUpSessionBroken{up.slot, up})
+	}
+	if !up.authorizedTime.IsZero() {
+		// exit() 时 stat 已不是 StatAuthorized，因此通过认证时间判断
+		up.manager.parent.poolStats.Disconnected(up.config.Pool(up.poolIndex), up.manager.subAccount, up.slot, time.Now())
+		up.authorizedTime = time.Time{}
 	}
 
 	if up.config.AlwaysKeepDownconn {
@@ -310,47 +446,79 @@ func (up *UpSessionETH) close() {
 
 	up.eventLoopRunning = false
 	up.stat = StatDisconnected
+	up.pendingSubmits = nil
 	up.serverConn.Close()
+	up.cancel()
 }
 
 func (up *UpSessionETH) Init() {
 	up.connect()
 	if up.stat != StatConnected {
 		if len(up.config.Proxy) > 0 && (up.config.DirectConnectWithProxy || up.config.DirectConnectAfterProxy) {
-			glog.Error(up.id, "all connections both proxy and direct failed")
+			Log.Error(up.id, "all connections both proxy and direct failed")
 		} else if len(up.config.Proxy) > 1 {
-			glog.Error(up.id, "all proxy connections failed")
+			Log.Error(up.id, "all proxy connections failed")
 		}
+		up.cancel()
 		return
 	}
 
+	up.handshakeDeadline = time.Now().Add(up.config.Advanced.PoolHandshakeTimeoutSeconds.Get())
 	go up.handleResponse()
 
 	err := up.sendInitRequest()
 	if err != nil {
-		glog.Error(up.id, "failed to send request to pool server: ", err.Error())
+		up.handshakeError = &HandshakeError{up.handshake.last(), err.Error(), false}
+		Log.Error(up.id, "failed to send ", up.handshakeError.Stage, " request to pool server: ", err.Error())
 		up.close()
 		return
 	}
 
 	up.handleEvent()
+
+	if up.stat != StatAuthorized && !time.Now().Before(up.handshakeDeadline) {
+		up.handshakeError = &HandshakeError{up.handshake.pending(), "timeout", false}
+		Log.Error(up.id, "pool server handshake timeout, not authorized in ", up.config.Advanced.PoolHandshakeTimeoutSeconds,
+			" seconds, no response to ", up.handshakeError.Stage, " received")
+	}
 }
 
 func (up *UpSessionETH) handleSetDifficulty(rpcData *JSONRPCLineETH, jsonBytes []byte) {
-	if up.defaultDiff == 0 {
+	if up.isNiceHash() {
+		// 难度随时可能调整，每次都要转发
 		if len(rpcData.Params) < 1 {
-			glog.Error(up.id, "missing difficulty in mining.set_difficulty message: ", string(jsonBytes))
+			Log.Error(up.id, "missing difficulty in mining.set_difficulty message: ", string(jsonBytes))
 			return
 		}
 		diff, ok := rpcData.Params[0].(float64)
 		if !ok {
-			glog.Error(up.id, "difficulty in mining.set_difficulty message is not a number: ", string(jsonBytes))
+			Log.Error(up.id, "difficulty in mining.set_difficulty message is not a number: ", string(jsonBytes))
 			return
 		}
 		// nicehash_diff = btcpool_diff / pow(2, 32)
-		up.defaultDiff = uint64(diff * 4294967296.0)
+		up.setPoolDifficulty(uint64(diff * 4294967296.0))
+		return
+	}
+
+	// 有些矿池在认证响应之前就发送难度，此时还没有矿机，保留最新的难度
+	if up.defaultDiff == 0 || up.stat != StatAuthorized {
+		if len(rpcData.Params) < 1 {
+			Log.Error(up.id, "missing difficulty in mining.set_difficulty message: ", string(jsonBytes))
+			return
+		}
+		diff, ok := rpcData.Params[0].(float64)
+		if !ok {
+			Log.Error(up.id, "difficulty in mining.set_difficulty message is not a number: ", string(jsonBytes))
+			return
+		}
+		// nicehash_diff = btcpool_diff / pow(2, 32)
+		poolDiff := uint64(diff * 4294967296.0)
 		if glog.V(5) {
-			glog.Info(up.id, "mining.set_difficulty: ", diff, " -> ", up.defaultDiff)
+			Log.Info(up.id, "mining.set_difficulty: ", diff, " -> ", poolDiff)
+		}
+		up.defaultDiff = up.difficultyClamp.ClampAll(poolDiff)
+		if up.defaultDiff != poolDiff {
+			Log.Info(up.id, "difficulty ", poolDiff, " from pool server is clamped to ", up.defaultDiff)
 		}
 
 		e := EventSetDifficulty{up.defaultDiff}
@@ -360,107 +528,245 @@ func (up *UpSessionETH) handleSetDifficulty(rpcData *JSONRPCLineETH, jsonBytes [
 	}
 }
 
+// handleSetTarget 处理 NiceHash 风格的矿池通过目标值下发的难度
+func (up *UpSessionETH) handleSetTarget(rpcData *JSONRPCLineETH, jsonBytes []byte) {
+	if !up.isNiceHash() {
+		logUnknownPoolMessage(up.config, up.id, "request", rpcData, jsonBytes)
+		return
+	}
+	if len(rpcData.Params) < 1 {
+		Log.Error(up.id, "missing target in mining.set_target message: ", string(jsonBytes))
+		return
+	}
+	target, ok := rpcData.Params[0].(string)
+	if !ok {
+		Log.Error(up.id, "target in mining.set_target message is not a string: ", string(jsonBytes))
+		return
+	}
+	diff, err := TargetToDiffETH(target)
+	if err != nil {
+		Log.Error(up.id, "failed to convert target to difficulty: ", err.Error(), "; ", string(jsonBytes))
+		return
+	}
+	up.setPoolDifficulty(diff)
+}
+
+// setPoolDifficulty 将 NiceHash 风格的矿池下发的难度转发给所有矿机，难度未变化时不转发
+func (up *UpSessionETH) setPoolDifficulty(poolDiff uint64) {
+	if poolDiff < 1 {
+		poolDiff = 1
+	}
+	diff := up.difficultyClamp.ClampAll(poolDiff)
+	if diff != poolDiff {
+		Log.Info(up.id, "difficulty ", poolDiff, " from pool server is clamped to ", diff)
+	}
+	if diff == up.defaultDiff {
+		return
+	}
+	up.defaultDiff = diff
+
+	// 新难度只对之后的任务有效
+	up.broadcastPendingJobs()
+	e := EventSetDifficulty{up.defaultDiff}
+	for _, down := range up.downSessions {
+		go down.SendEvent(e)
+	}
+}
+
+// isNiceHash 矿池是否为 NiceHash 风格的协议变体
+func (up *UpSessionETH) isNiceHash() bool {
+	return up.config.PoolProtocolVariant(up.poolIndex) == ProtocolVariantNiceHash
+}
+
 func (up *UpSessionETH) handleSubScribeResponse(rpcData *JSONRPCLineETH, jsonBytes []byte) {
+	if rpcData.Error != nil {
+		// 矿池拒绝订阅，不是协议不兼容
+		Log.Error(up.id, "subscribe failed: ", string(jsonBytes))
+		up.close()
+		return
+	}
 	result, ok := rpcData.Result.([]interface{})
 	if !ok {
-		glog.Error(up.id, "subscribe result is not an array: ", string(jsonBytes))
-		up.close()
+		up.incompatibleHandshake(HandshakeSubscribe, "subscribe result is not an array", jsonBytes)
 		return
 	}
 	if len(result) < 2 {
-		glog.Error(up.id, "subscribe result missing items: ", string(jsonBytes))
-		up.close()
+		up.incompatibleHandshake(HandshakeSubscribe, "subscribe result missing items", jsonBytes)
 		return
 	}
-	sessionIDHex, ok := result[1].(string)
-	if !ok {
-		glog.Error(up.id, "session id is not a string: ", string(jsonBytes))
-		up.close()
+	if !up.parseSessionID(result[1], jsonBytes) {
 		return
 	}
+	up.stat = StatSubScribed
+}
+
+// parseSessionID 解析订阅结果中的会话ID，无法解析时断开连接并返回 false。
+// 没有会话ID（空字符串或 null）时按矿池的 missing_session_id 配置断开连接或使用为 0 的会话ID。
+func (up *UpSessionETH) parseSessionID(value interface{}, jsonBytes []byte) bool {
+	sessionIDHex, ok := value.(string)
+	if !ok && value != nil {
+		up.incompatibleHandshake(HandshakeSubscribe, "session id is not a string", jsonBytes)
+		return false
+	}
+	if len(sessionIDHex) < 1 {
+		if up.config.PoolMissingSessionID(up.poolIndex) != MissingSessionIDZero {
+			up.incompatibleHandshake(HandshakeSubscribe, "session id is missing", jsonBytes)
+			return false
+		}
+		Log.Warning(up.id, "pool server does not send a session id, use session id 0: ", string(jsonBytes))
+		up.sessionID = 0
+		return true
+	}
+
 	sessionID, err := strconv.ParseUint(sessionIDHex, 16, 32)
 	if err != nil {
-		glog.Error(up.id, "session id is not a hex: ", string(jsonBytes))
-		up.close()
-		return
+		up.incompatibleHandshake(HandshakeSubscribe, "session id is not a hex", jsonBytes)
+		return false
 	}
 	up.sessionID = uint32(sessionID)
-	up.stat = StatSubScribed
+	return true
+}
+
+// incompatibleHandshake 矿池的握手响应无法解析，断开连接。
+// UpSessionManager 根据 HandshakeError.Incompatible 统计矿池连续的协议不兼容次数。
+func (up *UpSessionETH) incompatibleHandshake(stage HandshakeStage, reason string, jsonBytes []byte) {
+	Log.Error(up.id, "pool server speaks an incompatible protocol, ", reason, ": ", string(jsonBytes))
+	up.handshakeError = &HandshakeError{stage, reason, true}
+	up.close()
 }
 
 func (up *UpSessionETH) handleGetCapsResponse(rpcData *JSONRPCLineETH, jsonBytes []byte) {
 	result, ok := rpcData.Result.(map[string]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, result is not an object: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, result is not an object: ", string(jsonBytes))
 	}
 	caps, ok := result["capabilities"]
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, missing field capabilities: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, missing field capabilities: ", string(jsonBytes))
 	}
 	capsArr, ok := caps.([]interface{})
 	if !ok {
-		glog.Error(up.id, "get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
+		Log.Error(up.id, "get server capabilities failed, capabilities is not an array: ", string(jsonBytes))
 	}
+	offered := []string{}
 	for _, capability := range capsArr {
+		if str, ok := capability.(string); ok {
+			offered = append(offered, str)
+		}
+	}
+	requested := up.requestedCapabilities()
+	negotiated := NegotiateCapabilities(requested, offered)
+	Log.Info(up.id, "capabilities requested: ", requested, ", offered by pool server: ", offered, ", negotiated: ", negotiated)
+
+	missing := MissingCapabilities(up.config.Advanced.RequiredPoolCapabilities, negotiated)
+	if len(missing) > 0 {
+		Log.Error(up.id, "pool server does not support required capabilities ", missing, ", try the next pool server")
+		up.close()
+		return
+	}
+
+	for _, capability := range negotiated {
 		switch capability {
 		case CapSubmitResponse:
 			up.serverCapSubmitResponse = true
+		case CapSubmitHashrate:
+			up.serverCapSubmitHashrate = true
 		}
 	}
+	if up.config.Advanced.ForwardDeclaredHashrate && !up.serverCapSubmitHashrate {
+		Log.Warning(up.id, "[WARNING] pool server does not support ", CapSubmitHashrate, ", hashrate declared by miners is not forwarded")
+	}
 	if up.config.SubmitResponseFromServer {
 		if up.serverCapSubmitResponse {
 			if glog.V(1) {
-				glog.Info(up.id, "pool server will send share response to BTCAgent")
+				Log.Info(up.id, "pool server will send share response to BTCAgent")
 			}
 		} else {
-			glog.Warning(up.id, "[WARNING] pool server does not support sendding share response to BTCAgent")
+			switch up.config.PoolWithoutSubres {
+			case PoolWithoutSubresFailover:
+				Log.Error(up.id, "pool server does not support sending share responses to BTCAgent, try the next pool server")
+				up.close()
+				return
+			default:
+				// 矿池不会响应 share，没有 subres 时所有 share 都在本地响应为接受
+				Log.Warning(up.id, "[WARNING] pool server does not support sending share responses to BTCAgent, ",
+					"downgrade to local-ack mode: shares submitted to this pool server are accepted by BTCAgent immediately")
+			}
 		}
 	}
 }
 
 func (up *UpSessionETH) handleAuthorizeResponse(rpcData *JSONRPCLineETH, jsonBytes []byte) {
-	result, ok := rpcData.Result.(bool)
-	if !ok || !result {
-		glog.Error(up.id, "authorize failed: ", rpcData.Error)
+	up.authorizeError = NewAuthorizeError(rpcData.Result, rpcData.Error)
+	if up.authorizeError != nil {
+		Log.Error(up.id, "authorize failed: ", up.authorizeError, "; ", string(jsonBytes))
 		up.close()
 		return
 	}
-	glog.Info(up.id, "authorize success, session id: ", up.sessionID)
+	Log.Info(up.id, "authorize success, session id: ", up.sessionID)
 	up.stat = StatAuthorized
+	atomic.StoreInt32(&up.readAuthorized, 1)
+	up.authorizedTime = time.Now()
+	up.manager.parent.poolStats.Connected(up.config.Pool(up.poolIndex), up.manager.subAccount, up.slot, up.authorizedTime)
+	// 正在进行的读操作使用的是握手的截止时间，需要更新
+	up.setReadDeadline()
+	up.processPendingExMessages()
+	// 认证之前收到的任务立即广播，使之后加入的矿机马上获得当前任务，而不是等待下一个 mining.notify
+	if len(up.pendingJobs) > 0 {
+		up.broadcastPendingJobs()
+	}
 	// 让 Init() 函数返回
 	up.eventLoopRunning = false
 }
 
+// handleConnBroken 与矿池的连接断开。握手过程中断开时记录正在等待响应的步骤，
+// Init() 返回后由 UpSessionManager 尝试下一个矿池或重连。
+func (up *UpSessionETH) handleConnBroken() {
+	if up.stat == StatConnected || up.stat == StatSubScribed {
+		up.handshakeError = &HandshakeError{up.handshake.pending(), "connection lost", false}
+		if time.Now().Before(up.handshakeDeadline) {
+			Log.Error(up.id, "pool server closed the connection during handshake, no response to ", up.handshakeError.Stage, " received")
+		}
+	}
+	up.close()
+}
+
 func (up *UpSessionETH) connBroken() {
 	up.readLoopRunning = false
 	up.SendEvent(EventConnBroken{})
 }
 
-func (up *UpSessionETH) getIODeadLine() time.Time {
-	var timeout Seconds
-	if up.stat == StatAuthorized {
-		timeout = up.config.Advanced.PoolConnectionReadTimeoutSeconds
-	} else {
-		timeout = up.config.Advanced.PoolConnectionDialTimeoutSeconds
+// getIODeadLine 认证成功后使用 timeout 作为读写超时，之前则受连接超时和握手超时的限制
+func (up *UpSessionETH) getIODeadLine(timeout time.Duration, authorized bool) time.Time {
+	if authorized {
+		return time.Now().Add(timeout)
 	}
-	return time.Now().Add(timeout.Get())
+
+	deadline := time.Now().Add(up.config.Advanced.PoolConnectionDialTimeoutSeconds.Get())
+	if !up.handshakeDeadline.IsZero() && up.handshakeDeadline.Before(deadline) {
+		deadline = up.handshakeDeadline
+	}
+	return deadline
 }
 
 func (up *UpSessionETH) setReadDeadline() {
-	up.serverConn.SetReadDeadline(up.getIODeadLine())
+	// 读循环与事件循环并行运行，不能读取 up.stat
+	up.serverConn.SetReadDeadline(up.getIODeadLine(up.config.PoolReadTimeout(up.poolIndex), atomic.LoadInt32(&up.readAuthorized) != 0))
 }
 
+// setWriteDeadline 写入超时后 Write 会返回错误，调用方将断开连接并重连，以免阻塞事件循环
 func (up *UpSessionETH) setWriteDeadline() {
-	up.serverConn.SetWriteDeadline(up.getIODeadLine())
+	up.serverConn.SetWriteDeadline(up.getIODeadLine(up.config.PoolWriteTimeout(up.poolIndex), up.stat == StatAuthorized))
 }
 
+// handleResponse 逐帧读取矿池发送的 ex-message 和 JSON 行（分帧方式见 UpSessionBase.go）
 func (up *UpSessionETH) handleResponse() {
 	up.readLoopRunning = true
 	for up.readLoopRunning {
 		up.setReadDeadline()
 		magicNum, err := up.serverReader.Peek(1)
 		if err != nil {
-			glog.Error(up.id, "failed to read pool server response: ", err.Error())
+			Log.Error(up.id, "failed to read pool server response: ", err.Error())
 			up.connBroken()
 			return
 		}
@@ -481,12 +787,12 @@ func (up *UpSessionETH) readExMessage() {
 	message := new(ExMessage)
 	err := binary.Read(up.serverReader, binary.LittleEndian, &message.ExMessageHeader)
 	if err != nil {
-		glog.Error(up.id, "failed to read ex-message header from pool server: ", err.Error())
+		Log.Error(up.id, "failed to read ex-message header from pool server: ", err.Error())
 		up.connBroken()
 		return
 	}
 	if message.Size < 4 {
-		glog.Warning(up.id, "broken ex-message header from pool server: ", message.ExMessageHeader)
+		Log.Warning(up.id, "broken ex-message header from pool server: ", message.ExMessageHeader)
 		up.connBroken()
 		return
 	}
@@ -496,14 +802,14 @@ func (up *UpSessionETH) readExMessage() {
 		message.Body = make([]byte, size)
 		_, err = io.ReadFull(up.serverReader, message.Body)
 		if err != nil {
-			glog.Error(up.id, "failed to read ex-message body from pool server: ", err.Error())
+			Log.Error(up.id, "failed to read ex-message body from pool server: ", err.Error())
 			up.connBroken()
 			return
 		}
 	}
 
-	if glog.V(9) {
-		glog.Info(up.id, "readExMessage: ", message.ExMessageHeader.Type, " ", hex.EncodeToString(message.Body))
+	if glog.V(9) || LogExMessage.V(9) {
+		Log.Info(up.id, "readExMessage: ", message.ExMessageHeader.Type, " len=", message.ExMessageHeader.Size, " ", hex.EncodeToString(message.Body))
 	}
 	up.SendEvent(EventRecvExMessage{message})
 }
@@ -511,19 +817,31 @@ func (up *UpSessionETH) readExMessage() {
 func (up *UpSessionETH) readLine() {
 	jsonBytes, err := up.serverReader.ReadBytes('\n')
 	if err != nil {
-		glog.Error(up.id, "failed to read JSON line from pool server: ", err.Error())
+		if err == io.EOF && len(jsonBytes) > 0 {
+			// 矿池发送最后一行后立即断开时，该行可能没有换行符。其中是完整的 JSON 时（如认证响应）先处理，再按断开处理
+			if rpcData, e := NewJSONRPCLineETH(jsonBytes); e == nil {
+				Log.Info(up.id, "pool server closed the connection right after a line without newline: ", string(jsonBytes))
+				up.SendEvent(EventRecvJSONRPCETH{rpcData, append(jsonBytes, '\n')})
+			}
+		}
+		Log.Error(up.id, "failed to read JSON line from pool server: ", err.Error())
 		up.connBroken()
 		return
 	}
-	if glog.V(9) {
-		glog.Info(up.id, "readLine: ", string(jsonBytes))
+	if glog.V(9) || LogJSONRPC.V(9) {
+		Log.Info(up.id, "readLine: ", string(jsonBytes))
 	}
 
 	rpcData, err := NewJSONRPCLineETH(jsonBytes)
 
 	// ignore the json decode error
 	if err != nil {
-		glog.Info(up.id, "failed to decode JSON line from pool server: ", err.Error(), "; ", string(jsonBytes))
+		if misframedPoolLine(jsonBytes) {
+			Log.Error(up.id, "ex-message inside a JSON line from pool server, the stream is misframed: ", hex.EncodeToString(jsonBytes))
+			up.connBroken()
+			return
+		}
+		Log.Info(up.id, "failed to decode JSON line from pool server: ", err.Error(), "; ", string(jsonBytes))
 		return
 	}
 
@@ -531,11 +849,15 @@ func (up *UpSessionETH) readLine() {
 }
 
 func (up *UpSessionETH) Run() {
+	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
+		go up.expireSubmitIDsTicker()
+	}
+
 	up.handleEvent()
 }
 
 func (up *UpSessionETH) SendEvent(event interface{}) {
-	up.eventChannel <- event
+	sendEventWithPolicy(up.ctx, up.eventChannel, event, up.config, up.manager.parent.metrics)
 }
 
 func (up *UpSessionETH) addDownSession(e EventAddDownSession) {
@@ -549,10 +871,11 @@ func (up *UpSessionETH) addDownSession(e EventAddDownSession) {
 }
 
 func (up *UpSessionETH) registerWorker(down *DownSessionETH) {
-	msg := ExMessageRegisterWorker{down.sessionID, down.clientAgent, down.workerName}
+	// 矿机在 mining.subscribe 中提供的挖矿软件名称，便于矿池按固件统计
+	msg := ExMessageRegisterWorker{down.sessionID, FilterClientAgent(down.clientAgent, RegisterWorkerMaxClientAgentLength), down.workerName}
 	_, err := up.writeExMessage(&msg)
 	if err != nil {
-		glog.Error(up.id, "failed to register worker to pool server: ", err.Error())
+		Log.Error(up.id, "failed to register worker to pool server: ", err.Error())
 		up.close()
 	}
 }
@@ -561,55 +884,145 @@ func (up *UpSessionETH) unregisterWorker(sessionID uint16) {
 	msg := ExMessageUnregisterWorker{sessionID}
 	_, err := up.writeExMessage(&msg)
 	if err != nil {
-		glog.Error(up.id, "failed to unregister worker from pool server: ", err.Error())
+		Log.Error(up.id, "failed to unregister worker from pool server: ", err.Error())
+		up.close()
+	}
+}
+
+// forwardDeclaredHashrate 将矿机声明的算力转发给矿池（forward_declared_hashrate）
+func (up *UpSessionETH) forwardDeclaredHashrate(e EventDeclaredHashrate) {
+	if _, ok := up.downSessions[e.SessionID]; !ok || !up.serverCapSubmitHashrate {
+		return
+	}
+	msg := ExMessageSubmitHashrate{e.SessionID, declaredHashrateUint64(e.Hashrate)}
+	_, err := up.writeExMessage(&msg)
+	if err != nil {
+		Log.Error(up.id, "failed to forward declared hashrate to pool server: ", err.Error())
 		up.close()
 	}
 }
 
 func (up *UpSessionETH) handleMiningNotify(rpcData *JSONRPCLineETH, jsonBytes []byte) {
+	if up.isNiceHash() && len(rpcData.Params) > 4 {
+		// 任务的最后附带了目标值，先转发难度
+		if target, ok := rpcData.Params[4].(string); ok {
+			diff, err := TargetToDiffETH(target)
+			if err != nil {
+				Log.Warning(up.id, "failed to convert target in mining.notify to difficulty: ", err.Error(), "; ", string(jsonBytes))
+			} else {
+				up.setPoolDifficulty(diff)
+			}
+		}
+	}
+
 	job, err := NewStratumJobETH(rpcData, up.sessionID)
 	if err != nil {
-		glog.Warning(up.id, err.Error(), ": ", string(jsonBytes))
+		Log.Warning(up.id, err.Error(), ": ", string(jsonBytes))
+		return
+	}
+
+	if up.config.Advanced.CoalesceMiningNotify {
+		// 先排队，处理完通道中已有的事件后再广播，以便合并连续到达的任务
+		up.pendingJobs = append(up.pendingJobs, job)
+		if len(up.pendingJobs) == 1 {
+			go up.SendEvent(EventBroadcastNotify{})
+		}
 		return
 	}
 
-	e := EventStratumJobETH{job}
+	up.broadcastJobs([]*StratumJobETH{job})
+}
+
+// broadcastJobs 将任务按顺序广播给所有矿机
+func (up *UpSessionETH) broadcastJobs(jobs []*StratumJobETH) {
+	if len(jobs) < 1 {
+		return
+	}
+	if up.lastJob == nil && up.config.Advanced.PoolWarmupSeconds > 0 {
+		up.manager.SendEvent(EventUpSessionWarmedUp{up.slot, up, false})
+	}
+	up.lastJob = jobs[len(jobs)-1]
+
+	events := make([]interface{}, len(jobs))
+	for i, job := range jobs {
+		events[i] = EventMiningNotifyETH{job}
+	}
+
+	// 矿机不在事件循环中发送，某台矿机写入失败或卡住只会影响它自己，不影响其他矿机和矿池连接
+	targets := make([]broadcastTarget, 0, len(up.downSessions))
 	for _, down := range up.downSessions {
-		go down.SendEvent(e)
+		targets = append(targets, down)
 	}
+	broadcastEvents(up.ctx, targets, events)
+}
 
-	up.lastJob = job
+// broadcastPendingJobs 广播排队中的任务。
+// clean_jobs 为 true 的任务使之前的任务全部失效，因此只广播最后一个这样的任务及其后的任务；
+// 不带 clean_jobs 的任务不会使之前的任务失效，不能丢弃。
+func (up *UpSessionETH) broadcastPendingJobs() {
+	jobs := up.pendingJobs
+	up.pendingJobs = nil
+
+	start := 0
+	for i, job := range jobs {
+		if job.IsClean {
+			start = i
+		}
+	}
+	if start > 0 && glog.V(3) {
+		Log.Info(up.id, "coalesce mining.notify: ", start, " jobs are superseded by a clean job")
+	}
+
+	up.broadcastJobs(jobs[start:])
 }
 
 func (up *UpSessionETH) recvJSONRPC(e EventRecvJSONRPCETH) {
 	rpcData := e.RPCData
 	jsonBytes := e.JSONBytes
 
-	if len(rpcData.Method) > 0 {
-		switch rpcData.Method {
+	// 带有方法名的消息总是通知（或矿池发起的请求），即使 id 不为 null 也不会被当作响应
+	method := NormalizeMethod(rpcData.Method)
+	if len(method) > 0 {
+		if method != "mining.notify" && len(up.pendingJobs) > 0 {
+			// 按矿池发送的顺序转发给矿机
+			up.broadcastPendingJobs()
+		}
+
+		switch method {
 		case "mining.set_difficulty":
 			up.handleSetDifficulty(rpcData, jsonBytes)
+		case "mining.set_target":
+			up.handleSetTarget(rpcData, jsonBytes)
 		case "mining.notify":
 			up.handleMiningNotify(rpcData, jsonBytes)
 		default:
-			glog.Info(up.id, "[TODO] pool request: ", rpcData)
+			logUnknownPoolMessage(up.config, up.id, "request", rpcData, jsonBytes)
 		}
 		return
 	}
 
-	switch rpcData.ID {
+	id, ok := JSONRPCResponseID(rpcData.ID, up.config.PoolNumericRequestID(up.poolIndex))
+	if !ok {
+		logUnknownPoolMessage(up.config, up.id, "response", rpcData, jsonBytes)
+		return
+	}
+
+	switch id {
 	case "caps":
+		up.handshake.receive(HandshakeGetCapabilities)
 		up.handleGetCapsResponse(rpcData, jsonBytes)
 	case "sub":
+		up.handshake.receive(HandshakeSubscribe)
 		up.handleSubScribeResponse(rpcData, jsonBytes)
 	case "auth":
+		up.handshake.receive(HandshakeAuthorize)
 		up.handleAuthorizeResponse(rpcData, jsonBytes)
 	case "caps_again":
 		// ignore
 	case "conn_test":
 		// ignore
 	default:
-		glog.Info(up.id, "[TODO] pool response: ", rpcData)
+		logUnknownPoolMessage(up.config, up.id, "response", rpcData, jsonBytes)
 	}
 }
 
@@ -619,76 +1032,184 @@ func (up *UpSessionETH) handleSubmitShare(e EventSubmitShareETH) {
 		return
 	}
 
-	_, err := up.writeExMessage(e.Message)
+	// 退出或 drain 时不再提交新的 share，以便在 shutdown_submit_grace_seconds 内等到已提交的 share 的响应
+	if up.manager.parent.SubmitsStopped() {
+		if glog.V(3) {
+			Log.Info(up.id, "submits are stopped, reject share of miner #", e.Message.SessionID)
+		}
+		up.sendSubmitResponse(e.Message.SessionID, e.ID, STATUS_INTERNAL_ERROR)
+		return
+	}
+
+	_, err := up.writeSubmitExMessage(e.Message)
+	if err == nil {
+		up.addForwardedShare(e.Message.SessionID)
+	}
 
 	if up.config.SubmitResponseFromServer && up.serverCapSubmitResponse {
-		up.submitIDs[up.submitIndex] = SubmitID{e.ID, e.Message.SessionID}
-		up.submitIndex++
+		// 矿池按收到的顺序为 share 编号，因此每个写出的 share 都要分配序号
+		_, evicted := up.submitIDs.Add(e.ID, e.Message.SessionID, e.Time)
+		if evicted != nil {
+			Log.Warning(up.id, "too many shares without responses from pool server, respond to session ", evicted.SessionID, " locally")
+			up.manager.parent.metrics.UnconfirmedSubmits.Inc("reason", "evicted")
+			up.sendSubmitResponse(evicted.SessionID, evicted.ID, STATUS_ACCEPT)
+		}
 	} else {
 		up.sendSubmitResponse(e.Message.SessionID, e.ID, STATUS_ACCEPT)
 	}
 
 	if err != nil {
-		glog.Error(up.id, "failed to submit share: ", err.Error())
+		Log.Error(up.id, "failed to submit share: ", err.Error())
 		up.close()
 		return
 	}
 }
 
+// addForwardedShare 按矿机的子账户统计转发给矿池的 share
+func (up *UpSessionETH) addForwardedShare(sessionID uint16) {
+	subAccount := up.subAccount
+	if down, ok := up.downSessions[sessionID]; ok {
+		subAccount = down.subAccountName
+	}
+	up.manager.parent.shareStats.AddForwarded(subAccount)
+}
+
 func (up *UpSessionETH) sendSubmitResponse(sessionID uint16, id interface{}, status StratumStatus) {
 	down, ok := up.downSessions[sessionID]
 	if !ok {
 		// 客户端已断开，忽略
 		if glog.V(3) {
-			glog.Info(up.id, "cannot find down session: ", sessionID)
+			Log.Info(up.id, "cannot find down session: ", sessionID)
 		}
 		return
 	}
-	go down.SendEvent(EventSubmitResponse{id, status})
+	if up.waitingSubmits != nil {
+		// 等待结束后代理随即退出，在此之前必须把响应放入矿机的事件通道
+		down.SendEvent(EventSubmitResponse{id, status, false})
+		return
+	}
+	go down.SendEvent(EventSubmitResponse{id, status, false})
+}
+
+// waitSubmits 退出或 drain 时等待矿池响应已提交的 share，此前已停止提交新的 share（见 handleSubmitShare）
+func (up *UpSessionETH) waitSubmits(e EventWaitSubmits) {
+	up.waitingSubmits = &e
+	if up.submitIDs.Len() > 0 {
+		time.AfterFunc(time.Until(e.Deadline), func() { up.SendEvent(EventWaitSubmitsTimeout{}) })
+	}
+	up.checkWaitingSubmits()
+}
+
+// checkWaitingSubmits 已提交的 share 都得到响应后结束等待
+func (up *UpSessionETH) checkWaitingSubmits() {
+	if up.waitingSubmits != nil && up.submitIDs.Len() < 1 {
+		up.waitingSubmits.Response <- 0
+		up.waitingSubmits = nil
+	}
+}
+
+// waitSubmitsTimeout 到期仍未响应的 share 在本地响应为失败
+func (up *UpSessionETH) waitSubmitsTimeout() {
+	if up.waitingSubmits == nil {
+		return
+	}
+	remaining := up.submitIDs.RemoveAll()
+	Log.Warning(up.id, len(remaining), " shares are not responded by pool server in time, respond to miners locally")
+	for _, submitID := range remaining {
+		up.sendSubmitResponse(submitID.SessionID, submitID.ID, STATUS_INTERNAL_ERROR)
+	}
+	up.waitingSubmits.Response <- len(remaining)
+	up.waitingSubmits = nil
 }
 
 func (up *UpSessionETH) handleExMessageSubmitResponse(ex *ExMessage) {
 	if !up.config.SubmitResponseFromServer || !up.serverCapSubmitResponse {
-		glog.Error(up.id, "unexpected ex-message CMD_SUBMIT_RESPONSE from pool server")
+		Log.Error(up.id, "unexpected ex-message CMD_SUBMIT_RESPONSE from pool server")
 		return
 	}
 
 	var msg ExMessageSubmitResponse
 	err := msg.Unserialize(ex.Body)
 	if err != nil {
-		glog.Error(up.id, "failed to decode ex-message CMD_SUBMIT_RESPONSE: ", err.Error(), "; ", ex)
+		Log.Error(up.id, "failed to decode ex-message CMD_SUBMIT_RESPONSE: ", err.Error(), "; ", ex)
 		return
 	}
 
-	submitID, ok := up.submitIDs[msg.Index]
+	submitID, ok := up.submitIDs.Remove(msg.Index)
 	if !ok {
-		glog.Error(up.id, "cannot find submit id ", msg.Index, " in ex-message CMD_SUBMIT_RESPONSE: ", msg)
+		// 可能已超时并在本地响应过了
+		Log.Error(up.id, "cannot find submit id ", msg.Index, " in ex-message CMD_SUBMIT_RESPONSE: ", msg)
 		return
 	}
-	delete(up.submitIDs, msg.Index)
 
-	up.sendSubmitResponse(submitID.SessionID, submitID.ID, msg.Status)
+	up.manager.parent.metrics.SubmitResponseSeconds.Observe(time.Since(submitID.Time).Seconds())
+	up.sendSubmitResponse(submitID.SessionID, submitID.ID, up.clampedSubmitStatus(submitID, msg.Status))
+	up.checkWaitingSubmits()
+}
+
+// clampedSubmitStatus 按 difficulty_clamp 获取响应给矿机的 share 提交结果
+func (up *UpSessionETH) clampedSubmitStatus(submitID SubmitID, status StratumStatus) StratumStatus {
+	status, clamped := up.difficultyClamp.SubmitStatus(submitID, status)
+	if clamped {
+		up.manager.parent.metrics.ClampedSubmits.Inc()
+	}
+	return status
+}
+
+// expireSubmitIDsTicker 定期清理矿池超时未响应的 share。每个超时时间内检查多次，以免 share 等待接近两倍的超时时间。
+func (up *UpSessionETH) expireSubmitIDsTicker() {
+	ticker := time.NewTicker(up.config.Advanced.PoolSubmitResponseTimeoutSeconds.Get() / UpSessionSubmitResponseExpireChecks)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-up.ctx.Done():
+			return
+		case <-ticker.C:
+			up.SendEvent(EventExpireSubmitIDs{})
+		}
+	}
+}
+
+// expireSubmitIDs 矿池超时未响应的 share 在本地响应为接受，以免矿机一直等待。
+// 这些 share 的实际结果未知，单独计入 btcagent_unconfirmed_submits_total。
+func (up *UpSessionETH) expireSubmitIDs() {
+	expired := up.submitIDs.Expire(time.Now())
+	if len(expired) < 1 {
+		return
+	}
+	up.manager.parent.metrics.UnconfirmedSubmits.Add(float64(len(expired)), "reason", "timeout")
+	Log.Warning(up.id, len(expired), " shares are not responded by pool server in ", up.config.Advanced.PoolSubmitResponseTimeoutSeconds, " seconds, respond to miners locally")
+	for _, submitID := range expired {
+		up.sendSubmitResponse(submitID.SessionID, submitID.ID, STATUS_ACCEPT)
+	}
+	up.checkWaitingSubmits()
 }
 
 func (up *UpSessionETH) handleExMessageMiningSetDiff(ex *ExMessage) {
 	var msg ExMessageMiningSetDiff
 	err := msg.Unserialize(ex.Body)
 	if err != nil {
-		glog.Error(up.id, "failed to decode ex-message CMD_MINING_SET_DIFF: ", err.Error(), "; ", ex)
+		Log.Error(up.id, "failed to decode ex-message CMD_MINING_SET_DIFF: ", err.Error(), "; ", ex)
 		return
 	}
 
-	diff := uint64(1) << msg.Base.DiffExp
+	poolDiff := uint64(1) << msg.Base.DiffExp
+	diff := up.config.ClampDifficulty(poolDiff)
+	if diff != poolDiff {
+		Log.Info(up.id, "difficulty ", poolDiff, " from pool server is clamped to ", diff, " for ", len(msg.SessionIDs), " miners")
+	}
 
 	e := EventSetDifficulty{diff}
 	for _, sessionID := range msg.SessionIDs {
 		down := up.downSessions[sessionID]
 		if down != nil {
+			up.difficultyClamp.ClampSession(sessionID, poolDiff)
 			go down.SendEvent(e)
 		} else {
 			// 客户端已断开，忽略
 			if glog.V(3) {
-				glog.Info(up.id, "cannot find down session: ", sessionID)
+				Log.Info(up.id, "cannot find down session: ", sessionID)
 			}
 		}
 	}
@@ -698,7 +1219,7 @@ func (up *UpSessionETH) handleExMessageSetExtraNonce(ex *ExMessage) {
 	var msg ExMessageSetExtranonce
 	err := msg.Unserialize(ex.Body)
 	if err != nil {
-		glog.Error(up.id, "failed to decode ex-message CMD_SET_EXTRA_NONCE: ", err.Error(), "; ", ex)
+		Log.Error(up.id, "failed to decode ex-message CMD_SET_EXTRA_NONCE: ", err.Error(), "; ", ex)
 		return
 	}
 
@@ -711,32 +1232,72 @@ func (up *UpSessionETH) handleExMessageSetExtraNonce(ex *ExMessage) {
 	} else {
 		// 客户端已断开，忽略
 		if glog.V(3) {
-			glog.Info(up.id, "cannot find down session: ", msg.SessionID)
+			Log.Info(up.id, "cannot find down session: ", msg.SessionID)
 		}
 	}
 }
 
 func (up *UpSessionETH) recvExMessage(e EventRecvExMessage) {
+	if up.stat != StatAuthorized {
+		up.initRecvExMessage(e.Message)
+		return
+	}
+
 	switch e.Message.Type {
 	case CMD_SUBMIT_RESPONSE:
 		up.handleExMessageSubmitResponse(e.Message)
 	case CMD_MINING_SET_DIFF:
+		up.broadcastPendingJobs()
 		up.handleExMessageMiningSetDiff(e.Message)
 	case CMD_SET_EXTRA_NONCE:
+		up.broadcastPendingJobs()
 		up.handleExMessageSetExtraNonce(e.Message)
 	default:
-		glog.Error(up.id, "unknown ex-message: ", e.Message)
+		Log.Error(up.id, "unknown ex-message: ", e.Message)
+	}
+}
+
+// initRecvExMessage 处理认证成功前收到的 ex-message。
+// 会影响矿机的消息（如难度）暂存起来，认证成功后再处理，其他消息直接丢弃。
+func (up *UpSessionETH) initRecvExMessage(message *ExMessage) {
+	switch message.Type {
+	case CMD_MINING_SET_DIFF, CMD_SET_EXTRA_NONCE:
+		if len(up.pendingExMessages) >= UpSessionMaxPendingExMessages {
+			Log.Warning(up.id, "too many ex-messages before authorized, discard: ", message)
+			return
+		}
+		if glog.V(2) {
+			Log.Info(up.id, "ex-message before authorized, process it later: ", message)
+		}
+		up.pendingExMessages = append(up.pendingExMessages, message)
+	default:
+		if glog.V(3) {
+			Log.Info(up.id, "ex-message before authorized, discard: ", message)
+		}
+	}
+}
+
+// processPendingExMessages 处理认证成功前暂存的 ex-message
+func (up *UpSessionETH) processPendingExMessages() {
+	messages := up.pendingExMessages
+	up.pendingExMessages = nil
+	for _, message := range messages {
+		up.recvExMessage(EventRecvExMessage{message})
 	}
 }
 
 func (up *UpSessionETH) downSessionBroken(e EventDownSessionBroken) {
 	delete(up.downSessions, e.SessionID)
+	up.difficultyClamp.Remove(e.SessionID)
 	up.unregisterWorker(e.SessionID)
 
 	if up.disconnectedMinerCounter == 0 {
 		go func() {
-			time.Sleep(1 * time.Second)
-			up.SendEvent(EventSendUpdateMinerNum{})
+			select {
+			case <-time.After(1 * time.Second):
+				up.SendEvent(EventSendUpdateMinerNum{})
+			case <-up.ctx.Done():
+			}
 		}()
 	}
 	up.disconnectedMinerCounter++
@@ -755,16 +1316,56 @@ func (up *UpSessionETH) outdatedUpSessionConnection(e EventUpSessionConnection)
 	}
 }
 
+func (up *UpSessionETH) getStatus(e EventGetUpSessionStatus) {
+	pool := up.config.Pools[up.poolIndex]
+	status := UpSessionStatus{
+		Slot:       up.slot,
+		Ready:      up.stat == StatAuthorized,
+		MinerNum:   len(up.downSessions),
+		Pool:       pool.Address(),
+		SubAccount: up.subAccount,
+		Stat:       up.stat.String(),
+		SessionID:  up.sessionID,
+	}
+	if !up.authorizedTime.IsZero() {
+		status.UptimeSeconds = uint64(time.Since(up.authorizedTime).Seconds())
+	}
+	if e.WithMiners {
+		status.Miners = make([]DownSessionStatus, 0, len(up.downSessions))
+		for _, down := range up.downSessions {
+			status.Miners = append(status.Miners, down.status())
+		}
+	}
+	e.Response <- status
+}
+
+// getDownSessions 获取该连接上的矿机（管理命令 kick），是否断开由矿机在自己的事件循环中判断
+func (up *UpSessionETH) getDownSessions(e EventGetDownSessions) {
+	downSessions := make([]DownSession, 0, len(up.downSessions))
+	for _, down := range up.downSessions {
+		downSessions = append(downSessions, down)
+	}
+	e.Response <- downSessions
+}
+
 func (up *UpSessionETH) handleEvent() {
 	up.eventLoopRunning = true
 	for up.eventLoopRunning {
-		event := <-up.eventChannel
+		var event interface{}
+		select {
+		case event = <-up.eventChannel:
+		case <-up.ctx.Done():
+			up.exit()
+			return
+		}
 
 		switch e := event.(type) {
 		case EventAddDownSession:
 			up.addDownSession(e)
 		case EventSubmitShareETH:
 			up.handleSubmitShare(e)
+		case EventDeclaredHashrate:
+			up.forwardDeclaredHashrate(e)
 		case EventDownSessionBroken:
 			up.downSessionBroken(e)
 		case EventSendUpdateMinerNum:
@@ -774,13 +1375,27 @@ func (up *UpSessionETH) handleEvent() {
 		case EventRecvExMessage:
 			up.recvExMessage(e)
 		case EventConnBroken:
-			up.close()
+			up.handleConnBroken()
 		case EventUpSessionConnection:
 			up.outdatedUpSessionConnection(e)
+		case EventGetUpSessionStatus:
+			up.getStatus(e)
+		case EventGetDownSessions:
+			up.getDownSessions(e)
+		case EventExpireSubmitIDs:
+			up.expireSubmitIDs()
+		case EventWaitSubmits:
+			up.waitSubmits(e)
+		case EventWaitSubmitsTimeout:
+			up.waitSubmitsTimeout()
+		case EventFlushSubmits:
+			up.flushSubmits()
+		case EventBroadcastNotify:
+			up.broadcastPendingJobs()
 		case EventExit:
 			up.exit()
 		default:
-			glog.Error(up.id, "unknown event: ", e)
+			Log.Error(up.id, "unknown event: ", e)
 		}
 	}
 }
@@ -1,7 +1,11 @@
-package main
+package btcagent
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -11,6 +15,18 @@ type UpSessionInfo struct {
 	minerNum  int
 	ready     bool
 	upSession UpSession
+	pool      PoolInfo // 连接的矿池
+	// 连接的矿池已从矿池列表中删除，不再分配新矿机，同一 slot 的替代连接就绪后断开
+	draining bool
+	// 已认证但尚未收到任务（pool_warmup_seconds），分配给该连接的矿机在 pending 中等待
+	warmingUp bool
+	pending   []DownSession
+}
+
+// upSessionResume 一个 slot 最近一次认证成功的矿池会话，用于 resume_session
+type upSessionResume struct {
+	pool      PoolInfo
+	sessionID string // 矿池在 mining.subscribe 中分配的会话ID（extranonce1）
 }
 
 type FakeUpSessionInfo struct {
@@ -24,23 +40,46 @@ type UpSessionManager struct {
 	subAccount string
 	config     *Config
 	parent     *SessionManager
+	// 在 SessionManager 中的标识，按 user_agent_routes 建立时包括规则名称
+	key string
+
+	// *Config，与 config 只有矿池列表不同，运行时更新矿池列表（setpools）后替换。
+	// 新建的矿池连接使用其中的矿池列表，已有的连接继续使用创建时的配置。
+	pools atomic.Value
+
+	// 创建该子账户的矿池连接的矿机提供的密码，用于 pool_password.from_miner
+	minerPassword string
 
 	upSessions    []UpSessionInfo
 	fakeUpSession FakeUpSessionInfo
 
 	eventChannel chan interface{}
 
+	// 由 SessionManager 的 ctx 派生，取消后所有矿池连接退出
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	initSuccess        bool
 	initFailureCounter int
+	// 认证成功之前因矿池在握手过程中断开而重试的次数
+	handshakeRetryCounter int
 
 	printingMinerNum bool
+
+	// slot -> 最近一次认证成功的矿池会话，在矿池连接的 goroutine 中读写
+	resumeLock     sync.Mutex
+	resumeSessions map[int]upSessionResume
 }
 
-func NewUpSessionManager(subAccount string, config *Config, parent *SessionManager) (manager *UpSessionManager) {
+func NewUpSessionManager(subAccount string, minerPassword string, config *Config, parent *SessionManager) (manager *UpSessionManager) {
 	manager = new(UpSessionManager)
 	manager.subAccount = subAccount
+	manager.minerPassword = minerPassword
 	manager.config = config
+	manager.pools.Store(config)
 	manager.parent = parent
+	manager.resumeSessions = make(map[int]upSessionResume)
+	manager.ctx, manager.cancel = context.WithCancel(parent.ctx)
 
 	upSessions := make([]UpSessionInfo, manager.config.Advanced.PoolConnectionNumberPerSubAccount)
 	manager.upSessions = upSessions[:]
@@ -48,12 +87,18 @@ func NewUpSessionManager(subAccount string, config *Config, parent *SessionManag
 
 	manager.eventChannel = make(chan interface{}, manager.config.Advanced.MessageQueueSize.PoolSessionManager)
 
-	if manager.config.MultiUserMode {
-		manager.id = fmt.Sprintf("<%s> ", manager.subAccount)
+	manager.key = upSessionManagerKey(subAccount, config.route)
+	if manager.config.MultiUserMode || config.route != nil {
+		manager.id = fmt.Sprintf("<%s> ", manager.key)
 	}
 	return
 }
 
+// poolsConfig 获取当前矿池列表所在的配置，可以在任意 goroutine 中调用
+func (manager *UpSessionManager) poolsConfig() *Config {
+	return manager.pools.Load().(*Config)
+}
+
 func (manager *UpSessionManager) Run() {
 	go manager.fakeUpSession.upSession.Run()
 
@@ -64,22 +109,160 @@ func (manager *UpSessionManager) Run() {
 	manager.handleEvent()
 }
 
+// upSessionAttempt 一次矿池连接尝试的结果
+type upSessionAttempt struct {
+	poolIndex int
+	upSession UpSession
+	elapsed   time.Duration
+}
+
+// connect 为 slot 建立矿池连接。
+//
+// 按 pools 的顺序尝试，同时进行的尝试不超过 pool_connect_concurrency 个：当前矿池失败时立即尝试下一个，
+// 超过 pool_connect_stagger_seconds 仍未认证成功时也同时开始尝试下一个，这样一个无响应的矿池不会拖慢启动。
+// 使用最先认证成功的连接，其余尝试结束后断开。可用的矿池响应足够快时，总是使用排在前面的矿池。
+// 因协议不兼容被标记为不可用的矿池不参与尝试。矿池列表在开始时获取，尝试过程中更新矿池列表不影响本次尝试。
 func (manager *UpSessionManager) connect(slot int) {
-	for i := range manager.config.Pools {
-		up := manager.config.sessionFactory.NewUpSession(manager, i, slot)
-		up.Init()
+	config := manager.poolsConfig()
+	order := manager.connectOrder(config, slot)
+	pools := len(order)
+	concurrency := int(manager.config.Advanced.PoolConnectConcurrency)
+	stagger := manager.config.Advanced.PoolConnectStaggerSeconds.Get()
+
+	// 所有矿池均因永久性错误拒绝认证
+	permanent := pools > 0
+	interrupted := false
+
+	// 有缓冲，退出后仍在进行的尝试不会阻塞
+	attempts := make(chan upSessionAttempt, pools)
+	next, running := 0, 0
+	tryNext := true
+	var staggerTimer <-chan time.Time
+	var ready *upSessionAttempt
+
+	for ready == nil && (next < pools || running > 0) {
+		if next < pools && running < concurrency && (running == 0 || tryNext) {
+			up := manager.config.sessionFactory.NewUpSession(manager, config, order[next], slot)
+			go func(poolIndex int) {
+				start := time.Now()
+				up.Init()
+				attempts <- upSessionAttempt{poolIndex, up, time.Since(start)}
+			}(order[next])
+			next++
+			running++
+			tryNext = false
+			staggerTimer = time.After(stagger)
+			continue
+		}
 
-		if up.Stat() == StatAuthorized {
-			go up.Run()
-			manager.SendEvent(EventUpSessionReady{slot, up})
+		select {
+		case attempt := <-attempts:
+			running--
+			pool := config.Pools[attempt.poolIndex].Address()
+			manager.parent.poolStats.Attempted(&config.Pools[attempt.poolIndex], attempt.upSession.Stat() == StatAuthorized, attempt.elapsed)
+			if attempt.upSession.Stat() == StatAuthorized {
+				Log.Info(manager.id, "pool#", slot, " connected to pool server #", attempt.poolIndex, " [", pool, "] in ", attempt.elapsed.Round(time.Millisecond))
+				ready = &attempt
+				continue
+			}
+			if handshakeErr := attempt.upSession.HandshakeError(); handshakeErr != nil {
+				Log.Warning(manager.id, "pool#", slot, " failed to connect to pool server #", attempt.poolIndex, " [", pool, "] after ", attempt.elapsed.Round(time.Millisecond), ": ", handshakeErr)
+				interrupted = interrupted || handshakeErr.Transient()
+				if handshakeErr.Incompatible {
+					manager.poolIncompatible(config, attempt.poolIndex)
+				}
+			} else {
+				Log.Warning(manager.id, "pool#", slot, " failed to connect to pool server #", attempt.poolIndex, " [", pool, "] after ", attempt.elapsed.Round(time.Millisecond))
+			}
+			authErr := attempt.upSession.AuthorizeError()
+			if authErr == nil || !authErr.Permanent {
+				permanent = false
+			}
+			tryNext = true
+		case <-staggerTimer:
+			tryNext = true
+		case <-manager.ctx.Done():
+			go manager.closeAttempts(config, attempts, running)
 			return
 		}
 	}
-	manager.SendEvent(EventUpSessionInitFailed{slot})
+
+	go manager.closeAttempts(config, attempts, running)
+	if ready != nil {
+		hasJob := ready.upSession.HasJob()
+		go ready.upSession.Run()
+		manager.SendEvent(EventUpSessionReady{slot, ready.upSession, config.Pools[ready.poolIndex], hasJob})
+		return
+	}
+	if manager.ctx.Err() != nil {
+		return
+	}
+	manager.SendEvent(EventUpSessionInitFailed{slot, permanent, interrupted})
+}
+
+// connectOrder 获取本次要尝试的矿池，跳过只以透传模式连接的矿池和被标记为不可用的矿池。所有矿池都不可用时仍按顺序全部尝试。
+// 配置了 advanced.pool_selection 时按评分从高到低排列，评分相同时保持 pools 的顺序。
+func (manager *UpSessionManager) connectOrder(config *Config, slot int) (order []int) {
+	now := time.Now()
+	var aggregated []int
+	for i := range config.Pools {
+		if config.PassthroughPool(i) {
+			continue
+		}
+		aggregated = append(aggregated, i)
+		if manager.parent.poolStats.Unhealthy(&config.Pools[i], now) {
+			if glog.V(1) {
+				Log.Info(manager.id, "pool#", slot, " skip unhealthy pool server #", i, " [", config.Pools[i].Address(), "]")
+			}
+			continue
+		}
+		order = append(order, i)
+	}
+	if len(order) < 1 {
+		order = aggregated
+	}
+
+	if manager.config.Advanced.PoolSelection.Enabled() {
+		scores := manager.parent.poolStats.Scores(config.Pools)
+		sort.SliceStable(order, func(i, j int) bool {
+			return scores[order[i]] > scores[order[j]]
+		})
+		if glog.V(2) {
+			for _, i := range order {
+				Log.Info(manager.id, "pool#", slot, " pool server #", i, " [", config.Pools[i].Address(), "] score: ", scores[i])
+			}
+		}
+	}
+	return
+}
+
+// poolIncompatible 矿池的握手响应无法解析。连续次数达到 pool_max_incompatible_handshakes 后，
+// 在 pool_unhealthy_seconds 内不再尝试该矿池，而是切换到其他矿池
+func (manager *UpSessionManager) poolIncompatible(config *Config, poolIndex int) {
+	maxTimes := manager.config.Advanced.PoolMaxIncompatibleHandshakes
+	duration := manager.config.Advanced.PoolUnhealthySeconds
+	if manager.parent.poolStats.Incompatible(&config.Pools[poolIndex], time.Now(), maxTimes, duration.Get()) {
+		Log.Error(manager.id, "pool server #", poolIndex, " [", config.Pools[poolIndex].Address(), "] speaks an incompatible protocol, ",
+			maxTimes, " handshakes failed in a row, mark it unhealthy and skip it for ", duration, " seconds")
+	}
+}
+
+// closeAttempts 等待其余 running 个尝试结束，断开其中认证成功的连接
+func (manager *UpSessionManager) closeAttempts(config *Config, attempts chan upSessionAttempt, running int) {
+	for ; running > 0; running-- {
+		attempt := <-attempts
+		if attempt.upSession.Stat() == StatAuthorized {
+			if glog.V(3) {
+				Log.Info(manager.id, "close redundant connection to pool server #", attempt.poolIndex, " [", config.Pools[attempt.poolIndex].Address(), "]")
+			}
+			go attempt.upSession.Run()
+			attempt.upSession.SendEvent(EventExit{})
+		}
+	}
 }
 
 func (manager *UpSessionManager) SendEvent(event interface{}) {
-	manager.eventChannel <- event
+	sendEventWithPolicy(manager.ctx, manager.eventChannel, event, manager.config, manager.parent.metrics)
 }
 
 func (manager *UpSessionManager) addDownSession(e EventAddDownSession) {
@@ -87,17 +270,28 @@ func (manager *UpSessionManager) addDownSession(e EventAddDownSession) {
 
 	var selected *UpSessionInfo
 
-	// 寻找连接数最少的服务器
+	// 寻找连接数最少的服务器，只有所有服务器都在 drain 时才分配给 drain 中的服务器，
+	// 只有所有服务器都在等待第一个任务时才分配给等待中的服务器
 	for i := range manager.upSessions {
 		info := &manager.upSessions[i]
-		if info.ready && (selected == nil || info.minerNum < selected.minerNum) {
+		if !info.ready {
+			continue
+		}
+		if selected == nil || (selected.warmingUp && !info.warmingUp) ||
+			(selected.warmingUp == info.warmingUp && ((selected.draining && !info.draining) || (selected.draining == info.draining && info.minerNum < selected.minerNum))) {
 			selected = info
 		}
 	}
 
 	if selected != nil {
 		selected.minerNum++
-		e.Session.SendEvent(EventSetUpSession{selected.upSession})
+		if selected.warmingUp {
+			// 矿池连接收到第一个任务后再把矿机交给它
+			selected.pending = append(selected.pending, e.Session)
+		} else {
+			e.Session.SendEvent(EventSetUpSession{selected.upSession})
+		}
+		manager.trySpawnUpSession()
 		return
 	}
 
@@ -112,47 +306,186 @@ func (manager *UpSessionManager) addDownSession(e EventAddDownSession) {
 	e.Session.SendEvent(EventPoolNotReady{})
 }
 
+// trySpawnUpSession 设置了 pool_connection_max_miners 时，所有连接的矿机数都达到上限后新建一个矿池连接。
+// 有连接尚未就绪（正在建立、重连或 drain）时不新建，之后的矿机暂时分配给矿机最少的连接。
+func (manager *UpSessionManager) trySpawnUpSession() {
+	maxMiners := manager.config.Advanced.PoolConnectionMaxMiners
+	if maxMiners < 1 || len(manager.upSessions) >= UpSessionMaxNumPerSubAccount {
+		return
+	}
+	for _, info := range manager.upSessions {
+		if !info.ready || info.draining || uint(info.minerNum) < maxMiners {
+			return
+		}
+	}
+
+	slot := len(manager.upSessions)
+	manager.upSessions = append(manager.upSessions, UpSessionInfo{})
+	Log.Info(manager.id, "all ", slot, " pool connections have ", maxMiners, " miners, open pool connection #", slot)
+	go manager.connect(slot)
+}
+
 func (manager *UpSessionManager) upSessionReady(e EventUpSessionReady) {
 	defer manager.tryPrintMinerNum()
 
 	manager.initSuccess = true
 
 	info := &manager.upSessions[e.Slot]
+	if info.ready && info.draining {
+		// 替代的连接已就绪，断开连接到已删除矿池的连接，其上的矿机转移到其他连接或断开后重连
+		Log.Info(manager.id, "pool#", e.Slot, " disconnect from removed pool server [", info.pool.Address(), "], replaced by [", e.Pool.Address(), "]")
+		info.upSession.SendEvent(EventExit{})
+		info.minerNum = 0
+		manager.reassignPending(info)
+	}
 	info.upSession = e.Session
+	info.pool = e.Pool
 	info.ready = true
+	info.draining = false
+	info.warmingUp = manager.config.Advanced.PoolWarmupSeconds > 0 && !e.HasJob
+	if info.warmingUp {
+		go func() {
+			select {
+			case <-time.After(manager.config.Advanced.PoolWarmupSeconds.Get()):
+				manager.SendEvent(EventUpSessionWarmedUp{e.Slot, e.Session, true})
+			case <-manager.ctx.Done():
+			}
+		}()
+	}
+
+	// 连接过程中矿池列表已更新，连接的矿池已被删除
+	if manager.poolRemoved(&e.Pool) {
+		manager.drainUpSession(e.Slot)
+	}
 
 	// 从 FakeUpSession 拿回矿机
 	manager.fakeUpSession.upSession.SendEvent(EventTransferDownSessions{})
 }
 
+// upSessionWarmedUp 矿池连接收到了第一个任务或等待超时，把等待中的矿机交给它
+func (manager *UpSessionManager) upSessionWarmedUp(e EventUpSessionWarmedUp) {
+	info := &manager.upSessions[e.Slot]
+	if !info.ready || !info.warmingUp || info.upSession != e.Session {
+		return
+	}
+	info.warmingUp = false
+	if e.Timeout {
+		Log.Warning(manager.id, "pool#", e.Slot, " no job from pool server within ", manager.config.Advanced.PoolWarmupSeconds,
+			" seconds, attach ", len(info.pending), " waiting miners anyway")
+	} else if glog.V(1) {
+		Log.Info(manager.id, "pool#", e.Slot, " got the first job from pool server, attach ", len(info.pending), " waiting miners")
+	}
+	for _, down := range info.pending {
+		down.SendEvent(EventSetUpSession{info.upSession})
+	}
+	info.pending = nil
+}
+
+// reassignPending 矿池连接在收到第一个任务之前断开或被替代，等待它的矿机重新分配给其他连接
+func (manager *UpSessionManager) reassignPending(info *UpSessionInfo) {
+	info.warmingUp = false
+	pending := info.pending
+	info.pending = nil
+	if len(pending) < 1 {
+		return
+	}
+	go func() {
+		for _, down := range pending {
+			manager.SendEvent(EventAddDownSession{down})
+		}
+	}()
+}
+
 func (manager *UpSessionManager) upSessionInitFailed(e EventUpSessionInitFailed) {
 	if manager.initSuccess {
-		glog.Error(manager.id, "Failed to connect to all ", len(manager.config.Pools), " pool servers, please check your configuration! Retry in 5 seconds.")
-		go func() {
-			time.Sleep(5 * time.Second)
-			manager.connect(e.Slot)
-		}()
+		retryInterval := UpSessionRetryIntervalSeconds
+		if e.PermanentAuthorizeError {
+			retryInterval = UpSessionAuthorizeRetryIntervalSeconds
+			Log.Error(manager.id, "All ", len(manager.poolsConfig().Pools), " pool servers rejected the sub-account ", manager.subAccount, ", please check your sub-account! Retry in ", retryInterval, " seconds.")
+		} else {
+			Log.Error(manager.id, "Failed to connect to all ", len(manager.poolsConfig().Pools), " pool servers, please check your configuration! Retry in ", retryInterval, " seconds.")
+		}
+		manager.retryConnect(e.Slot, retryInterval)
+		return
+	}
+
+	// 矿池在处理子账户之前断开，可能只是矿池重启或网络波动，不计入初始化失败
+	if e.HandshakeInterrupted && manager.handshakeRetryCounter < UpSessionHandshakeRetryTimes*len(manager.upSessions) {
+		manager.handshakeRetryCounter++
+		Log.Error(manager.id, "Pool servers closed the connection during handshake, retry in ", UpSessionRetryIntervalSeconds, " seconds.")
+		manager.retryConnect(e.Slot, UpSessionRetryIntervalSeconds)
 		return
 	}
 
 	manager.initFailureCounter++
 
 	if manager.initFailureCounter >= len(manager.upSessions) {
-		glog.Error(manager.id, "Too many connection failure to pool, please check your sub-account or pool configurations! Sub-account: ", manager.subAccount, ", pools: ", manager.config.Pools)
+		Log.Error(manager.id, "Too many connection failure to pool, please check your sub-account or pool configurations! Sub-account: ", manager.subAccount, ", pools: ", manager.poolsConfig().Pools)
 
-		manager.parent.SendEvent(EventStopUpSessionManager{manager.subAccount})
+		manager.parent.SendEvent(EventStopUpSessionManager{manager.key})
 		return
 	}
 }
 
+// retryConnect 等待 retryInterval 后重新为 slot 建立矿池连接
+func (manager *UpSessionManager) retryConnect(slot int, retryInterval Seconds) {
+	go func() {
+		select {
+		case <-time.After(retryInterval.Get()):
+			manager.connect(slot)
+		case <-manager.ctx.Done():
+		}
+	}()
+}
+
 func (manager *UpSessionManager) upSessionBroken(e EventUpSessionBroken) {
 	defer manager.tryPrintMinerNum()
 
 	info := &manager.upSessions[e.Slot]
+	if info.upSession != e.Session {
+		// 该 slot 已由替代的连接使用，旧连接断开不影响它
+		return
+	}
+	draining := info.draining
 	info.ready = false
+	info.draining = false
 	info.minerNum = 0
+	manager.reassignPending(info)
 
-	go manager.connect(e.Slot)
+	// drain 时替代的连接已在建立中
+	if !draining {
+		go manager.connect(e.Slot)
+	}
+}
+
+// setPools 更新矿池列表。连接到仍在列表中的矿池的连接不受影响，
+// 连接到已删除矿池的连接开始 drain，新的矿池可以用于之后的连接和故障切换。
+func (manager *UpSessionManager) setPools(e EventSetPools) {
+	manager.pools.Store(e.Config)
+	for slot := range manager.upSessions {
+		info := &manager.upSessions[slot]
+		if info.ready && !info.draining && manager.poolRemoved(&info.pool) {
+			manager.drainUpSession(slot)
+		}
+	}
+}
+
+// poolRemoved 矿池是否已不在当前的矿池列表中
+func (manager *UpSessionManager) poolRemoved(pool *PoolInfo) bool {
+	for _, current := range manager.poolsConfig().Pools {
+		if current == *pool {
+			return false
+		}
+	}
+	return true
+}
+
+// drainUpSession 不再向 slot 的连接分配新矿机，并为该 slot 连接当前列表中的矿池，就绪后断开原连接
+func (manager *UpSessionManager) drainUpSession(slot int) {
+	info := &manager.upSessions[slot]
+	info.draining = true
+	Log.Info(manager.id, "pool#", slot, " pool server [", info.pool.Address(), "] removed from the pool list, draining")
+	go manager.connect(slot)
 }
 
 func (manager *UpSessionManager) updateMinerNum(e EventUpdateMinerNum) {
@@ -161,25 +494,32 @@ func (manager *UpSessionManager) updateMinerNum(e EventUpdateMinerNum) {
 	manager.upSessions[e.Slot].minerNum -= e.DisconnectedMinerCounter
 
 	if glog.V(3) {
-		glog.Info(manager.id, "miner num update, slot: ", e.Slot, ", miners: ", manager.upSessions[e.Slot].minerNum)
+		Log.Info(manager.id, "miner num update, slot: ", e.Slot, ", miners: ", manager.upSessions[e.Slot].minerNum)
 	}
 
-	if manager.config.MultiUserMode {
-		minerNum := 0
-		for i := range manager.upSessions {
-			minerNum += manager.upSessions[i].minerNum
-		}
-		if minerNum < 1 {
-			glog.Info(manager.id, "no miners on sub-account ", manager.subAccount, ", close pool connections")
-			manager.parent.SendEvent(EventStopUpSessionManager{manager.subAccount})
-		}
-	}
+	manager.tryStopWithoutMiners()
 }
 
 func (manager *UpSessionManager) updateFakeMinerNum(e EventUpdateFakeMinerNum) {
 	defer manager.tryPrintMinerNum()
 
 	manager.fakeUpSession.minerNum -= e.DisconnectedMinerCounter
+	manager.tryStopWithoutMiners()
+}
+
+// tryStopWithoutMiners 多用户模式下，子账户的矿机全部断开后关闭该子账户的矿池连接
+func (manager *UpSessionManager) tryStopWithoutMiners() {
+	if !manager.config.MultiUserMode {
+		return
+	}
+	minerNum := manager.fakeUpSession.minerNum
+	for i := range manager.upSessions {
+		minerNum += manager.upSessions[i].minerNum
+	}
+	if minerNum < 1 {
+		Log.Info(manager.id, "no miners on sub-account ", manager.subAccount, ", close pool connections")
+		manager.parent.SendEvent(EventStopUpSessionManager{manager.key})
+	}
 }
 
 func (manager *UpSessionManager) updateFakeJob(e interface{}) {
@@ -193,7 +533,13 @@ func (manager *UpSessionManager) exit() {
 		if up.ready {
 			up.upSession.SendEvent(EventExit{})
 		}
+		for _, down := range up.pending {
+			go down.SendEvent(EventExit{})
+		}
 	}
+
+	// 尚未就绪的矿池连接及等待重连的 goroutine 也随之退出
+	manager.cancel()
 }
 
 func (manager *UpSessionManager) tryPrintMinerNum() {
@@ -202,8 +548,11 @@ func (manager *UpSessionManager) tryPrintMinerNum() {
 	}
 	manager.printingMinerNum = true
 	go func() {
-		time.Sleep(5 * time.Second)
-		manager.SendEvent(EventPrintMinerNum{})
+		select {
+		case <-time.After(5 * time.Second):
+			manager.SendEvent(EventPrintMinerNum{})
+		case <-manager.ctx.Done():
+		}
 	}()
 }
 
@@ -216,19 +565,155 @@ func (manager *UpSessionManager) printMinerNum() {
 			pools++
 		}
 	}
-	glog.Info(manager.id, "connection number changed, pool servers: ", pools, ", miners: ", miners)
+	Log.Info(manager.id, "connection number changed, pool servers: ", pools, ", miners: ", miners)
 	manager.printingMinerNum = false
 }
 
+func (manager *UpSessionManager) getStatus(e EventGetUpSessionManagerStatus) {
+	status := UpSessionManagerStatus{
+		SubAccount:   manager.subAccount,
+		Route:        manager.routeName(),
+		FakeMinerNum: manager.fakeUpSession.minerNum,
+		UpSessions:   make([]UpSessionStatus, len(manager.upSessions)),
+
+		ActiveConnections: make(map[string]int),
+	}
+	upSessions := make([]UpSession, len(manager.upSessions))
+	for i, info := range manager.upSessions {
+		status.UpSessions[i] = UpSessionStatus{Slot: i, Ready: info.ready, Draining: info.draining, WarmingUp: info.warmingUp, MinerNum: info.minerNum}
+		if info.ready {
+			upSessions[i] = info.upSession
+			status.ActiveConnections[info.pool.Address()]++
+		}
+	}
+
+	// 矿池连接的事件循环可能正忙，在单独的 goroutine 中等待
+	go func() {
+		for i, up := range upSessions {
+			if up == nil {
+				continue
+			}
+			response := make(chan UpSessionStatus, 1)
+			up.SendEvent(EventGetUpSessionStatus{e.WithMiners, response})
+			select {
+			case upStatus := <-response:
+				upStatus.MinerNum = status.UpSessions[i].MinerNum
+				upStatus.Draining = status.UpSessions[i].Draining
+				upStatus.WarmingUp = status.UpSessions[i].WarmingUp
+				status.UpSessions[i] = upStatus
+			case <-adminCommandTimeout():
+				Log.Warning(manager.id, "get status of pool connection #", i, " timeout")
+			}
+		}
+		e.Response <- status
+	}()
+}
+
+// routeName 按 user_agent_routes 建立时为规则名称，否则为空字符串
+func (manager *UpSessionManager) routeName() string {
+	if manager.config.route == nil {
+		return ""
+	}
+	return manager.config.route.Name
+}
+
+func (manager *UpSessionManager) reconnectUpSession(e EventReconnectUpSession) {
+	if e.Slot >= len(manager.upSessions) || !manager.upSessions[e.Slot].ready {
+		e.Response <- AdminResponse{nil, AdminErrIllegalParams}
+		return
+	}
+	Log.Info(manager.id, "[admin] reconnect pool connection #", e.Slot)
+	manager.upSessions[e.Slot].upSession.SendEvent(EventConnBroken{})
+	e.Response <- AdminResponse{true, nil}
+}
+
+// kickDownSessions 断开该子账户中符合条件的矿机（管理命令 kick），包括矿池连接尚未就绪时 FakeUpSession 中的矿机，
+// 以及等待矿池连接收到第一个任务的矿机（pending）。矿池连接只提供其上的矿机，
+// 矿机在自己的事件循环中判断是否符合条件并返回自己的状态，因此不会在其他 goroutine 中读取矿机的字段。
+func (manager *UpSessionManager) kickDownSessions(e EventKickDownSessions) {
+	sessions := []EventInterface{manager.fakeUpSession.upSession}
+	var downSessions []DownSession
+	for _, info := range manager.upSessions {
+		if info.ready {
+			sessions = append(sessions, info.upSession)
+		}
+		downSessions = append(downSessions, info.pending...)
+	}
+
+	// 与 getStatus 相同，在单独的 goroutine 中等待矿池连接和矿机的事件循环
+	go func() {
+		timeout := adminCommandTimeout()
+		for _, session := range sessions {
+			response := make(chan []DownSession, 1)
+			go session.SendEvent(EventGetDownSessions{response})
+			select {
+			case result := <-response:
+				downSessions = append(downSessions, result...)
+			case <-timeout:
+				Log.Warning(manager.id, "get miners of pool connection timeout")
+				e.Response <- make([]DownSessionStatus, 0)
+				return
+			}
+		}
+
+		kicked := make([]DownSessionStatus, 0)
+		response := make(chan []DownSessionStatus, len(downSessions))
+		for _, down := range downSessions {
+			go down.SendEvent(EventKickDownSession{e.Filter, response})
+		}
+		for range downSessions {
+			select {
+			case result := <-response:
+				kicked = append(kicked, result...)
+			case <-timeout:
+				Log.Warning(manager.id, "kick miners timeout")
+				e.Response <- kicked
+				return
+			}
+		}
+		e.Response <- kicked
+	}()
+}
+
+// healthCheck 响应健康检查，返回已认证的矿池连接数
+func (manager *UpSessionManager) healthCheck(e EventHealthCheck) {
+	status := HealthStatus{Live: true, SubAccounts: 1}
+	for _, info := range manager.upSessions {
+		if info.ready {
+			status.Pools++
+		}
+	}
+	e.Response <- status
+}
+
+// waitSubmits 退出前等待已认证的矿池连接响应已提交的 share
+func (manager *UpSessionManager) waitSubmits(e EventWaitSubmits) {
+	upSessions := make([]EventInterface, 0, len(manager.upSessions))
+	for _, info := range manager.upSessions {
+		if info.ready {
+			upSessions = append(upSessions, info.upSession)
+		}
+	}
+	go waitSubmitsOf(upSessions, e)
+}
+
 func (manager *UpSessionManager) handleEvent() {
 	for {
-		event := <-manager.eventChannel
+		var event interface{}
+		select {
+		case event = <-manager.eventChannel:
+		case <-manager.ctx.Done():
+			manager.exit()
+			return
+		}
 
 		switch e := event.(type) {
 		case EventUpSessionReady:
 			manager.upSessionReady(e)
 		case EventUpSessionInitFailed:
 			manager.upSessionInitFailed(e)
+		case EventUpSessionWarmedUp:
+			manager.upSessionWarmedUp(e)
 		case EventAddDownSession:
 			manager.addDownSession(e)
 		case EventUpSessionBroken:
@@ -243,11 +728,47 @@ func (manager *UpSessionManager) handleEvent() {
 			manager.updateFakeJob(e)
 		case EventPrintMinerNum:
 			manager.printMinerNum()
+		case EventGetUpSessionManagerStatus:
+			manager.getStatus(e)
+		case EventReconnectUpSession:
+			manager.reconnectUpSession(e)
+		case EventKickDownSessions:
+			manager.kickDownSessions(e)
+		case EventHealthCheck:
+			manager.healthCheck(e)
+		case EventWaitSubmits:
+			manager.waitSubmits(e)
+		case EventSetPools:
+			manager.setPools(e)
 		case EventExit:
 			manager.exit()
 			return
 		default:
-			glog.Error("[UpSessionManager] unknown event: ", event)
+			Log.Error("[UpSessionManager] unknown event: ", event)
 		}
 	}
 }
+
+// saveResumeSession 记录 slot 在 pool 上认证成功的会话ID，可以在任意 goroutine 中调用
+func (manager *UpSessionManager) saveResumeSession(slot int, pool *PoolInfo, sessionID string) {
+	if pool == nil {
+		return
+	}
+	manager.resumeLock.Lock()
+	manager.resumeSessions[slot] = upSessionResume{*pool, sessionID}
+	manager.resumeLock.Unlock()
+}
+
+// resumeSessionID 获取 slot 之前在 pool 上的会话ID，slot 上次连接的不是该矿池时返回空，可以在任意 goroutine 中调用
+func (manager *UpSessionManager) resumeSessionID(slot int, pool *PoolInfo) string {
+	if pool == nil {
+		return ""
+	}
+	manager.resumeLock.Lock()
+	defer manager.resumeLock.Unlock()
+	resume, ok := manager.resumeSessions[slot]
+	if !ok || resume.pool != *pool {
+		return ""
+	}
+	return resume.sessionID
+}
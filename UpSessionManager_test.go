@@ -0,0 +1,728 @@
+package btcagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpSessionManagerPoolSubAccountFailover(t *testing.T) {
+	// 第一个矿池拒绝所有子账户，BTCAgent 应当切换到第二个矿池并使用它的子账户
+	authorized := make(chan string, 16)
+	reject := func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		pool.AcceptHandshakeBTCWithAuthorize(conn, reader, func(request *JSONRPCRequest) bool {
+			authorized <- "pool1:" + request.Params[0].(string)
+			return false
+		})
+	}
+	accept := func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		ok := pool.AcceptHandshakeBTCWithAuthorize(conn, reader, func(request *JSONRPCRequest) bool {
+			authorized <- "pool2:" + request.Params[0].(string)
+			return true
+		})
+		if ok {
+			io.Copy(ioutil.Discard, reader)
+		}
+	}
+	pool1 := NewMockPool(t, reject)
+	pool2 := NewMockPool(t, accept)
+
+	config := pool1.Config(new(SessionFactoryBTC))
+	config.SubAccount = "global"
+	config.Pools = []PoolInfo{pool1.PoolInfo(""), pool2.PoolInfo("pool2-account")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	startTestSessionManager(t, config)
+
+	for _, expected := range []string{"pool1:global", "pool2:pool2-account"} {
+		select {
+		case subAccount := <-authorized:
+			if subAccount != expected {
+				t.Errorf("wrong sub-account, expected %s, got %s", expected, subAccount)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("agent did not authorize %s", expected)
+		}
+	}
+}
+
+// startPasswordTestPool 启动记录认证密码的矿池
+func startPasswordTestPool(t *testing.T) (pool *MockPool, passwords chan string) {
+	passwords = make(chan string, 16)
+	pool = NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		ok := pool.AcceptHandshakeBTCWithAuthorize(conn, reader, func(request *JSONRPCRequest) bool {
+			password, _ := request.Params[1].(string)
+			passwords <- password
+			return true
+		})
+		if ok {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	return
+}
+
+func expectPoolPassword(t *testing.T, passwords chan string, expected string) {
+	t.Helper()
+	select {
+	case password := <-passwords:
+		if password != expected {
+			t.Errorf("wrong password, expected %s, got %s", expected, password)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent did not authorize")
+	}
+}
+
+func TestUpSessionManagerPoolPassword(t *testing.T) {
+	pool, passwords := startPasswordTestPool(t)
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.PoolPassword.Default = "default-secret"
+	config.Pools[0].Options.Password = "pool-secret"
+	startTestSessionManager(t, config)
+
+	expectPoolPassword(t, passwords, "pool-secret")
+
+	// 打印配置和请求时不能泄露密码
+	config.PoolPassword.SubAccounts = map[string]Password{"test": "sub-account-secret"}
+	printed := fmt.Sprint(config.Pools, config.PoolPassword)
+	request := JSONRPCRequest{"auth", "mining.authorize", []interface{}{"test", "pool-secret"}}
+	bytes, _ := request.ToJSONBytesLine()
+	printed += jsonRequestForLog(&request, bytes)
+	if strings.Contains(printed, "secret") {
+		t.Errorf("password is printed: %s", printed)
+	}
+	if !strings.Contains(printed, `"test"`) {
+		t.Errorf("sub-account should be printed: %s", printed)
+	}
+}
+
+func TestUpSessionManagerPoolPasswordFromMiner(t *testing.T) {
+	pool, passwords := startPasswordTestPool(t)
+	config := pool.Config(new(SessionFactoryBTC))
+	config.MultiUserMode = true
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.PoolPassword.Default = "default-secret"
+	config.PoolPassword.SubAccounts = map[string]Password{"user2": "user2-secret"}
+	manager := startTestSessionManager(t, config)
+
+	miner := dialTestMinerBTC(t, manager, "user1.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+	expectPoolPassword(t, passwords, "default-secret")
+
+	// 启用 from_miner 后使用矿机提供的密码 "x"
+	config.PoolPassword.FromMiner = true
+	miner2 := dialTestMinerBTC(t, manager, "user2.w1", "")
+	if miner2 == nil {
+		t.FailNow()
+	}
+	defer miner2.Close()
+	expectPoolPassword(t, passwords, "x")
+}
+
+// waitPoolConnections 等待 poolIndex 对应的矿池有 expected 个已认证的连接，返回等待的时间
+func waitPoolConnections(t *testing.T, manager *SessionManager, poolIndex int, expected int, timeout time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if manager.poolStats.Snapshot(time.Now())[poolIndex].Connections == expected {
+			return time.Since(start)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool server #%d does not have %d connections in %s", poolIndex, expected, timeout)
+	return timeout
+}
+
+func TestUpSessionManagerConnectSlowPool(t *testing.T) {
+	accept := func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	}
+	// 接受连接但从不响应，直到握手超时
+	slow := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		io.Copy(ioutil.Discard, reader)
+	})
+	fast := NewMockPool(t, accept)
+	// 连接被拒绝的矿池
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	refused := PoolInfo{Host: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port), SubAccount: "test"}
+	listener.Close()
+
+	config := fast.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{refused, slow.PoolInfo("test"), fast.PoolInfo("test")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 3
+	config.Advanced.PoolConnectionDialTimeoutSeconds = 30
+	config.Advanced.PoolHandshakeTimeoutSeconds = 30
+	config.Advanced.PoolConnectStaggerSeconds = 1
+	manager := startTestSessionManager(t, config)
+
+	// 所有连接都不必等待无响应矿池的握手超时
+	elapsed := waitPoolConnections(t, manager, 2, 3, 10*time.Second)
+	if elapsed > 5*time.Second {
+		t.Errorf("fast pool server should be ready quickly, took %s", elapsed)
+	}
+	if conn := dialTestMinerBTC(t, manager, "w1", ""); conn != nil {
+		conn.Close()
+	}
+}
+
+func TestUpSessionManagerConnectPreferFirstPool(t *testing.T) {
+	connections := make(chan int, 16)
+	newPool := func(index int) *MockPool {
+		return NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+			connections <- index
+			if pool.AcceptHandshakeBTC(conn, reader) {
+				io.Copy(ioutil.Discard, reader)
+			}
+		})
+	}
+	pool1 := newPool(1)
+	pool2 := newPool(2)
+
+	config := pool1.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{pool1.PoolInfo("test"), pool2.PoolInfo("test")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 2
+	manager := startTestSessionManager(t, config)
+
+	// 第一个矿池响应足够快，不会尝试第二个矿池
+	waitPoolConnections(t, manager, 0, 2, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	for len(connections) > 0 {
+		if index := <-connections; index != 1 {
+			t.Errorf("agent should not connect to pool server %d", index)
+		}
+	}
+}
+
+func TestUpSessionManagerRetryHandshakeInterrupted(t *testing.T) {
+	// 矿池第一次连接时在订阅之前断开，BTCAgent 应当重试而不是放弃该子账户
+	connections := 0
+	var lock sync.Mutex
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		lock.Lock()
+		connections++
+		first := connections == 1
+		lock.Unlock()
+		if first {
+			pool.AcceptHandshakeBTCUntil(conn, reader, "sub")
+			return
+		}
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+
+	waitPoolConnections(t, manager, 0, 1, 3*UpSessionRetryIntervalSeconds.Get())
+}
+
+func TestUpSessionManagerSkipIncompatiblePool(t *testing.T) {
+	// 第一个矿池的订阅响应总是无法解析
+	var lock sync.Mutex
+	brokenConnections := 0
+	broken := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		lock.Lock()
+		brokenConnections++
+		lock.Unlock()
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps":
+				pool.WriteLine(conn, `{"id":"caps","result":{"capabilities":["verrol","subres"]},"error":null}`)
+			case "sub":
+				pool.WriteLine(conn, `{"id":"sub","result":true,"error":null}`)
+			}
+		}
+	})
+	// 第二个矿池正常，但先断开最初的几个连接，使 BTCAgent 重连
+	goodConnections := 0
+	good := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		lock.Lock()
+		goodConnections++
+		reconnect := goodConnections <= 3
+		lock.Unlock()
+		if !pool.AcceptHandshakeBTC(conn, reader) {
+			return
+		}
+		if reconnect {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		io.Copy(ioutil.Discard, reader)
+	})
+
+	config := broken.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{broken.PoolInfo("test"), good.PoolInfo("test")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 3
+	config.Advanced.PoolConnectConcurrency = 1
+	config.Advanced.PoolMaxIncompatibleHandshakes = 2
+	manager := startTestSessionManager(t, config)
+
+	// 三个连接都因第一个矿池协议不兼容而切换到第二个矿池，断开后重连时不再尝试第一个矿池
+	for start := time.Now(); manager.poolStats.Snapshot(time.Now())[1].Connects < 6; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("agent did not reconnect to the second pool: %v", manager.poolStats.Snapshot(time.Now()))
+		}
+	}
+	waitPoolConnections(t, manager, 1, 3, 5*time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if brokenConnections != 3 {
+		t.Errorf("incompatible pool should be skipped after 2 handshakes, connections: %d", brokenConnections)
+	}
+	if stats := manager.poolStats.Snapshot(time.Now()); !stats[0].Unhealthy || stats[1].Unhealthy {
+		t.Errorf("wrong unhealthy pools: %v", stats)
+	}
+}
+
+// setTestPools 通过文本格式的 setpools 命令更新矿池列表
+func setTestPools(t *testing.T, manager *SessionManager, pools ...PoolInfo) AdminResponse {
+	t.Helper()
+	data, err := json.Marshal(pools)
+	if err != nil {
+		t.Fatalf("marshal pools failed: %v", err)
+	}
+	request, err := NewAdminRequest([]byte("setpools " + string(data)))
+	if err != nil {
+		t.Fatalf("wrong setpools command: %v", err)
+	}
+	return manager.AdminCommand(request)
+}
+
+// testUpSessionStatus 获取单用户模式下第一个矿池连接的状态
+func testUpSessionStatus(t *testing.T, manager *SessionManager) UpSessionStatus {
+	t.Helper()
+	response := manager.AdminCommand(&AdminRequest{Method: "pools"})
+	statusList, ok := response.Result.([]UpSessionManagerStatus)
+	if response.Error != nil || !ok || len(statusList) != 1 || len(statusList[0].UpSessions) < 1 {
+		t.Fatalf("wrong pools status: %+v", response)
+	}
+	return statusList[0].UpSessions[0]
+}
+
+func TestUpSessionManagerSetPoolsAppend(t *testing.T) {
+	drop := make(chan struct{})
+	pool1 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			go io.Copy(ioutil.Discard, reader)
+			<-drop
+		}
+	})
+	pool2 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool1.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	response := setTestPools(t, manager, pool1.PoolInfo("test"), pool2.PoolInfo("test"))
+	if response.Error != nil {
+		t.Fatalf("setpools failed: %v", response.Error)
+	}
+	if addresses, _ := response.Result.([]string); len(addresses) != 2 || addresses[1] != pool2.listener.Addr().String() {
+		t.Errorf("wrong setpools result: %v", response.Result)
+	}
+
+	// 仍在列表中的矿池连接不受影响
+	time.Sleep(100 * time.Millisecond)
+	stats := manager.poolStats.Snapshot(time.Now())
+	if len(stats) != 2 || stats[0].Connections != 1 || stats[0].Connects != 1 || stats[1].Connects != 0 {
+		t.Errorf("connection to the remaining pool should be kept: %+v", stats)
+	}
+	if status := testUpSessionStatus(t, manager); !status.Ready || status.Draining {
+		t.Errorf("connection to the remaining pool should not be drained: %+v", status)
+	}
+
+	// 第一个矿池不可用后切换到新增的矿池
+	pool1.listener.Close()
+	close(drop)
+	waitPoolConnections(t, manager, 1, 1, 5*time.Second)
+}
+
+func TestUpSessionManagerSetPoolsRemoveInactive(t *testing.T) {
+	var pool2Connections int32
+	pool1 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	pool2 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		atomic.AddInt32(&pool2Connections, 1)
+	})
+	config := pool1.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{pool1.PoolInfo("test"), pool2.PoolInfo("test")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	// 有误的矿池列表不生效
+	wrongPort := pool1.PoolInfo("test")
+	wrongPort.Port = 0
+	for _, pools := range [][]PoolInfo{{}, {wrongPort}, {pool1.PoolInfo("")}} {
+		if response := setTestPools(t, manager, pools...); response.Error == nil || response.Error.ErrNo != AdminErrIllegalParams.ErrNo {
+			t.Errorf("setpools %v should fail: %+v", pools, response)
+		}
+	}
+	if stats := manager.poolStats.Snapshot(time.Now()); len(stats) != 2 {
+		t.Errorf("pool list should not be changed by wrong lists: %+v", stats)
+	}
+
+	before := testUpSessionStatus(t, manager)
+	if response := setTestPools(t, manager, pool1.PoolInfo("test")); response.Error != nil {
+		t.Fatalf("setpools failed: %v", response.Error)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats := manager.poolStats.Snapshot(time.Now())
+	if len(stats) != 1 || stats[0].Connections != 1 || stats[0].Connects != 1 {
+		t.Errorf("connection to the remaining pool should be kept: %+v", stats)
+	}
+	after := testUpSessionStatus(t, manager)
+	if !after.Ready || after.Draining || after.SessionID != before.SessionID || after.Pool != before.Pool {
+		t.Errorf("connection should not be changed, before: %+v, after: %+v", before, after)
+	}
+	if connections := atomic.LoadInt32(&pool2Connections); connections != 0 {
+		t.Errorf("removed pool should not be connected: %d", connections)
+	}
+}
+
+func TestUpSessionManagerSetPoolsRemoveActive(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	pool1 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+			closed <- struct{}{}
+		}
+	})
+	// 收到 release 之前不响应握手
+	release := make(chan struct{})
+	pool2 := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		<-release
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool1.Config(new(SessionFactoryBTC))
+	config.AlwaysKeepDownconn = true
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "mining.notify")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+
+	if response := setTestPools(t, manager, pool2.PoolInfo("test")); response.Error != nil {
+		t.Fatalf("setpools failed: %v", response.Error)
+	}
+
+	// 替代的连接就绪之前，原连接继续为矿机服务
+	for start := time.Now(); !testUpSessionStatus(t, manager).Draining; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("connection to the removed pool is not drained: %+v", testUpSessionStatus(t, manager))
+		}
+	}
+	if status := testUpSessionStatus(t, manager); !status.Ready || status.Pool != pool1.listener.Addr().String() || status.MinerNum != 1 {
+		t.Errorf("draining connection should be kept until replaced: %+v", status)
+	}
+
+	// 替代的连接就绪后断开原连接，矿机转移到新的连接
+	close(release)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to the removed pool is not closed")
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		status := testUpSessionStatus(t, manager)
+		if status.Ready && !status.Draining && status.Pool == pool2.listener.Addr().String() && status.MinerNum == 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("miner is not transferred to the new pool: %+v", status)
+		}
+	}
+
+	reader := bufio.NewReader(miner)
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner should receive a job from the new pool: %v", err)
+		}
+		if strings.Contains(line, `"method":"mining.notify"`) {
+			break
+		}
+	}
+}
+
+func TestUpSessionManagerMaxMinersPerConnection(t *testing.T) {
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.Advanced.PoolConnectionMaxMiners = 2
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	dial := func(worker string) {
+		t.Helper()
+		miner := dialTestMinerBTC(t, manager, worker, "mining.notify")
+		if miner == nil {
+			t.FailNow()
+		}
+		t.Cleanup(func() { miner.Close() })
+	}
+	getStatus := func() UpSessionManagerStatus {
+		t.Helper()
+		response := manager.AdminCommand(&AdminRequest{Method: "pools"})
+		statusList, ok := response.Result.([]UpSessionManagerStatus)
+		if response.Error != nil || !ok || len(statusList) != 1 {
+			t.Fatalf("wrong pools status: %+v", response)
+		}
+		return statusList[0]
+	}
+
+	// 一个连接未满时不新建连接
+	dial("test.w1")
+	if status := getStatus(); len(status.UpSessions) != 1 {
+		t.Errorf("no more pool connections expected below the limit: %+v", status)
+	}
+
+	// 连接已满后新建第二个连接，之后的矿机分配给它
+	dial("test.w2")
+	waitPoolConnections(t, manager, 0, 2, 5*time.Second)
+	dial("test.w3")
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		status := getStatus()
+		if len(status.UpSessions) == 2 && status.UpSessions[0].MinerNum == 2 && status.UpSessions[1].MinerNum == 1 {
+			if status.ActiveConnections[pool.listener.Addr().String()] != 2 {
+				t.Errorf("wrong active connections: %v", status.ActiveConnections)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("miners are not distributed to the second pool connection: %+v", status)
+		}
+	}
+}
+
+func TestUpSessionManagerConnectOrderByScore(t *testing.T) {
+	config := NewConfig()
+	config.Pools = []PoolInfo{{Host: "pool1", Port: 3333}, {Host: "pool2", Port: 3333}, {Host: "pool3", Port: 3333}, {Host: "pool4", Port: 3333}}
+	config.Pools[2].Options.Priority = 1
+	config.Pools[3].Options.Priority = 1
+	config.sessionFactory = new(SessionFactoryBTC)
+	parent := NewSessionManager(config)
+	manager := NewUpSessionManager("", "", config, parent)
+
+	// 权重均为 0 时按 pools 的顺序
+	parent.poolStats.Attempted(&config.Pools[0], false, time.Second)
+	if order := manager.connectOrder(config, 0); fmt.Sprint(order) != "[0 1 2 3]" {
+		t.Errorf("pools are reordered without pool_selection: %v", order)
+	}
+
+	// pool3 和 pool4 优先级较高，其中 pool4 连接较慢；pool1 连接失败过，pool2 不可用
+	config.Advanced.PoolSelection = PoolSelectionWeights{Priority: 1, Latency: 1, Reliability: 1}
+	parent = NewSessionManager(config)
+	manager = NewUpSessionManager("", "", config, parent)
+	parent.poolStats.Attempted(&config.Pools[0], false, time.Second)
+	parent.poolStats.Attempted(&config.Pools[2], true, 100*time.Millisecond)
+	parent.poolStats.Attempted(&config.Pools[3], true, 900*time.Millisecond)
+	parent.poolStats.Incompatible(&config.Pools[1], time.Now(), 1, time.Minute)
+	if order := manager.connectOrder(config, 0); fmt.Sprint(order) != "[2 3 0]" {
+		t.Errorf("wrong connect order by score: %v, expected [2 3 0]", order)
+	}
+}
+
+func TestUpSessionManagerWarmup(t *testing.T) {
+	// 矿池认证成功后等到 release 关闭才发送第一个任务
+	release := make(chan struct{})
+	pool := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptHandshakeBTCUntil(conn, reader, "caps_again") {
+			pool.WriteLine(conn, `{"id":"caps_again","result":{"capabilities":["verrol","subres"]},"error":null}`)
+		}
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+			return
+		}
+		pool.WriteLine(conn, `{"id":null,"method":"mining.notify","params":["1","0000000000000000000000000000000000000000000000000000000000000000",`+
+			`"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff","ffffffff0100000000000000000000000000",[],"20000000","1d00ffff","5f5e1000",true]}`)
+		io.Copy(ioutil.Discard, reader)
+	})
+	config := pool.Config(new(SessionFactoryBTC))
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	config.Advanced.PoolWarmupSeconds = 30
+	manager := startTestSessionManager(t, config)
+	waitPoolConnections(t, manager, 0, 1, 5*time.Second)
+
+	miner := dialTestMinerBTC(t, manager, "test.w1", "")
+	if miner == nil {
+		t.FailNow()
+	}
+	defer miner.Close()
+	reader := bufio.NewReader(miner)
+
+	// 矿池连接收到任务之前，矿机不会分配给它
+	miner.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("miner attached before the first job: %s", line)
+	}
+	response := manager.AdminCommand(&AdminRequest{Method: "pools"})
+	statusList, ok := response.Result.([]UpSessionManagerStatus)
+	if !ok || len(statusList) != 1 || !statusList[0].UpSessions[0].WarmingUp || statusList[0].UpSessions[0].MinerNum != 1 {
+		t.Errorf("pool connection should be warming up with a waiting miner: %+v", response)
+	}
+
+	// 收到任务后矿机分配给该连接并收到任务
+	close(release)
+	miner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("miner did not get the job after the pool connection warmed up: %v", err)
+		}
+		if strings.Contains(line, `"method":"mining.notify"`) {
+			break
+		}
+	}
+}
+
+func TestUpSessionManagerIncompatibleExtranonce(t *testing.T) {
+	// 第一个矿池的 extranonce2 只有 4 字节
+	small := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if !pool.AcceptConnTest(conn, reader) {
+			return
+		}
+		for {
+			request, err := pool.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			switch request.ID {
+			case "caps":
+				pool.WriteLine(conn, `{"id":"caps","result":{"capabilities":["verrol","subres"]},"error":null}`)
+			case "conf":
+				pool.WriteLine(conn, `{"id":"conf","result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}`)
+			case "sub":
+				pool.WriteLine(conn, `{"id":"sub","result":[[["mining.notify","01000002"]],"01000002",4],"error":null}`)
+			}
+		}
+	})
+	good := NewMockPool(t, func(pool *MockPool, conn net.Conn, reader *bufio.Reader) {
+		if pool.AcceptHandshakeBTC(conn, reader) {
+			io.Copy(ioutil.Discard, reader)
+		}
+	})
+
+	config := small.Config(new(SessionFactoryBTC))
+	config.Pools = []PoolInfo{small.PoolInfo("test"), good.PoolInfo("test")}
+	config.Advanced.PoolConnectionNumberPerSubAccount = 1
+	// 不标记为不可用，每次连接都先尝试第一个矿池
+	config.Advanced.PoolMaxIncompatibleHandshakes = 0
+	manager := startTestSessionManager(t, config)
+
+	// 切换到第二个矿池
+	waitPoolConnections(t, manager, 1, 1, 5*time.Second)
+	pool := config.Pools[0].Address()
+	if count := manager.metrics.IncompatibleExtranonce.Get("pool", pool, "extranonce2_size", "4"); count != 1 {
+		t.Errorf("wrong incompatible extranonce count: %v", count)
+	}
+	recorder := httptest.NewRecorder()
+	manager.metrics.WriteText(recorder)
+	expected := `btcagent_pool_incompatible_extranonce_total{pool="` + pool + `",extranonce2_size="4"} 1`
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("missing metric %s:\n%s", expected, recorder.Body.String())
+	}
+}
+
+func TestUpSessionManagerBrokenReplacedSession(t *testing.T) {
+	config := NewConfig()
+	config.sessionFactory = new(SessionFactoryBTC)
+	parent := NewSessionManager(config)
+	manager := NewUpSessionManager("test", "", config, parent)
+	defer manager.cancel()
+
+	old := NewUpSessionBTC(manager, config, 0, 0)
+	current := NewUpSessionBTC(manager, config, 0, 0)
+	info := &manager.upSessions[0]
+	info.upSession = current
+	info.ready = true
+
+	// 被替代的连接迟到的断开事件不影响该 slot 当前的连接
+	manager.upSessionBroken(EventUpSessionBroken{0, old})
+	if !info.ready {
+		t.Errorf("current pool connection is marked broken by the replaced one")
+	}
+	manager.upSessionBroken(EventUpSessionBroken{0, current})
+	if info.ready {
+		t.Errorf("broken pool connection is still ready")
+	}
+}
+
+func TestUpSessionManagerPrintMinerNumNotDropped(t *testing.T) {
+	config := NewConfig()
+	config.Advanced.MessageQueueOverflow.Timer = EventOverflowDrop
+	metrics := NewAgentMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 丢弃 EventPrintMinerNum 后 printingMinerNum 不会被清除，之后不再打印矿机数，因此通道已满时同样等待
+	channel := make(chan interface{}, 1)
+	channel <- EventPingMiner{}
+	sent := make(chan bool, 1)
+	go func() {
+		sent <- sendEventWithPolicy(ctx, channel, EventPrintMinerNum{}, config, metrics)
+	}()
+	select {
+	case <-sent:
+		t.Fatalf("EventPrintMinerNum should wait for the full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-channel
+	select {
+	case ok := <-sent:
+		if !ok {
+			t.Errorf("EventPrintMinerNum is not queued")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("EventPrintMinerNum is not queued")
+	}
+}
@@ -0,0 +1,103 @@
+package btcagent
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// UserAgentRoute 按矿机在 mining.subscribe 中提供的挖矿软件名称（user agent）选择矿池连接的规则（user_agent_routes）。
+//
+// 匹配的矿机使用单独的矿池连接，不与其他矿机共用，例如让 ASICBoost 有问题的固件连接到不滚动版本位的矿池连接。
+// 都不匹配的矿机使用默认的矿池连接。
+type UserAgentRoute struct {
+	Name    string `json:"name"`    // 规则名称，用于日志和状态
+	Pattern string `json:"pattern"` // 正则表达式，不区分大小写，匹配 user agent 的一部分即可
+	// 匹配的矿机连接的矿池，为空时使用 pools（包括通过 setpools 更新的矿池列表）
+	Pools []PoolInfo `json:"pools"`
+	// 不让匹配的矿机滚动版本位，向它们发送空的版本掩码（仅限 BTC）
+	DisableVersionRolling bool `json:"disable_version_rolling"`
+
+	regexp *regexp.Regexp
+}
+
+// initUserAgentRoutes 检查 user_agent_routes，编译其中的正则表达式并规范化其中的矿池
+func (conf *Config) initUserAgentRoutes() (err error) {
+	// 规则名称是按规则建立的矿池连接的标识的一部分（见 upSessionManagerKey），不能重复
+	names := make(map[string]bool, len(conf.UserAgentRoutes))
+	for i := range conf.UserAgentRoutes {
+		route := &conf.UserAgentRoutes[i]
+		if len(route.Name) < 1 {
+			route.Name = fmt.Sprintf("route#%d", i)
+		}
+		if names[route.Name] {
+			err = fmt.Errorf("[OPTION] Duplicate name of user_agent_routes: %s", route.Name)
+			return
+		}
+		names[route.Name] = true
+		if len(route.Pattern) < 1 {
+			err = fmt.Errorf("[OPTION] user_agent_routes %s has an empty pattern", route.Name)
+			return
+		}
+		route.regexp, err = regexp.Compile("(?i)" + route.Pattern)
+		if err != nil {
+			err = fmt.Errorf("[OPTION] Illegal pattern %q of user_agent_routes %s: %w", route.Pattern, route.Name, err)
+			return
+		}
+		if route.DisableVersionRolling && conf.AgentType != "btc" {
+			err = fmt.Errorf("[OPTION] disable_version_rolling of user_agent_routes %s is only supported by BTCAgent for BTC", route.Name)
+			return
+		}
+		if len(route.Pools) > 0 {
+			var routeConf *Config
+			routeConf, err = conf.WithPools(route.Pools)
+			if err != nil {
+				err = fmt.Errorf("[OPTION] Pools of user_agent_routes %s: %w", route.Name, err)
+				return
+			}
+			if routeConf.HasPassthroughPool() {
+				err = fmt.Errorf("[OPTION] Pools of user_agent_routes %s cannot be connected in passthrough mode", route.Name)
+				return
+			}
+			route.Pools = routeConf.Pools
+		}
+		Log.Info("[OPTION] Miners with user agent matching ", route.Pattern, " use the pool connections of route ", route.Name,
+			", pools: ", len(route.Pools), ", disable version rolling: ", route.DisableVersionRolling)
+	}
+	if len(conf.UserAgentRoutes) > 0 && conf.PassthroughOnly() {
+		Log.Warning("[OPTION] user_agent_routes is ignored in passthrough mode")
+	}
+	return
+}
+
+// UserAgentRoute 获取 user agent 匹配的第一个规则，都不匹配时返回 nil
+func (conf *Config) UserAgentRoute(userAgent string) *UserAgentRoute {
+	for i := range conf.UserAgentRoutes {
+		if conf.UserAgentRoutes[i].regexp.MatchString(userAgent) {
+			return &conf.UserAgentRoutes[i]
+		}
+	}
+	return nil
+}
+
+// WithRoute 复制配置，用于按 route 建立的矿池连接。route 配置了矿池时使用其中的矿池，否则使用原配置的矿池列表
+func (conf *Config) WithRoute(route *UserAgentRoute) *Config {
+	copied := *conf
+	if len(route.Pools) > 0 {
+		copied.Pools = route.Pools
+	}
+	copied.route = route
+	return &copied
+}
+
+// RouteDisableVersionRolling 是否为按 user_agent_routes 建立的、不滚动版本位的矿池连接
+func (conf *Config) RouteDisableVersionRolling() bool {
+	return conf.route != nil && conf.route.DisableVersionRolling
+}
+
+// upSessionManagerKey 矿池会话管理器在 SessionManager 中的标识：默认为子账户名，按规则建立的为“子账户名@规则名称”
+func upSessionManagerKey(subAccount string, route *UserAgentRoute) string {
+	if route == nil {
+		return subAccount
+	}
+	return subAccount + "@" + route.Name
+}
@@ -1,14 +1,20 @@
-package main
+package btcagent
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
+	"math"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/holiman/uint256"
 )
 
 // IP2Long IP转整数
@@ -106,6 +112,17 @@ func SubString(str string, start, length int) string {
 	return string(rs[start:end])
 }
 
+// TruncateUTF8 将字符串截断到不超过 maxLength 字节，不会截断多字节字符
+func TruncateUTF8(str string, maxLength int) string {
+	if len(str) <= maxLength {
+		return str
+	}
+	for maxLength > 0 && !utf8.RuneStart(str[maxLength]) {
+		maxLength--
+	}
+	return str[:maxLength]
+}
+
 // IOCopyBuffer 在写入失败时还能拿到Buffer的IO拷贝函数
 func IOCopyBuffer(dst io.Writer, src io.Reader, buf []byte) (bufferLen int, err error) {
 	if buf == nil {
@@ -142,6 +159,24 @@ func IOCopyBuffer(dst io.Writer, src io.Reader, buf []byte) (bufferLen int, err
 	return
 }
 
+// WriteFull 写出全部数据。net.Conn 在出错前总会写完全部数据，但其他 io.Writer 可能只写出一部分而不返回错误，
+// 此时继续写出剩余部分，以免流中出现不完整的 JSON 行或 ex-message。没有写出任何数据也没有出错时返回 io.ErrShortWrite。
+func WriteFull(w io.Writer, data []byte) (n int, err error) {
+	for n < len(data) {
+		var written int
+		written, err = w.Write(data[n:])
+		n += written
+		if err != nil {
+			return
+		}
+		if written == 0 {
+			err = io.ErrShortWrite
+			return
+		}
+	}
+	return
+}
+
 // StripEthAddrFromFullName 从矿机名中去除不必要的以太坊钱包地址
 func StripEthAddrFromFullName(fullNameStr string) string {
 	pos := strings.Index(fullNameStr, ".")
@@ -161,6 +196,21 @@ func FilterWorkerName(workerName string) string {
 	return pattren.ReplaceAllString(workerName, "")
 }
 
+// FilterClientAgent 去掉挖矿软件名称（user agent）中的控制字符和非 ASCII 字符以及首尾空白，并截断到 maxLength 字节，
+// 以免破坏以 \0 结尾的 ex-message 字段
+func FilterClientAgent(clientAgent string, maxLength int) string {
+	filtered := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7E {
+			return -1
+		}
+		return r
+	}, clientAgent))
+	if len(filtered) > maxLength {
+		filtered = strings.TrimSpace(filtered[:maxLength])
+	}
+	return filtered
+}
+
 func IPAsWorkerName(format string, ip string) string {
 	if len(ip) < 1 {
 		return ip
@@ -234,3 +284,40 @@ func BinReverse(bin []byte) {
 		j--
 	}
 }
+
+// DoubleSHA256 计算两次 SHA256
+func DoubleSHA256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// TargetToDiff 将大端字节序的十六进制目标值（target）转换为难度 diff1 / target，结果至少为 1
+func TargetToDiff(diff1 *uint256.Int, targetHex string) (diff uint64, err error) {
+	bin, err := Hex2Bin(targetHex)
+	if err != nil {
+		return
+	}
+	if len(bin) > 32 {
+		err = errors.New("target is longer than 32 bytes")
+		return
+	}
+
+	var target uint256.Int
+	target.SetBytes(bin)
+	if target.IsZero() {
+		err = errors.New("target is zero")
+		return
+	}
+
+	var result uint256.Int
+	result.Div(diff1, &target)
+	if !result.IsUint64() {
+		return math.MaxUint64, nil
+	}
+	diff = result.Uint64()
+	if diff < 1 {
+		diff = 1
+	}
+	return
+}
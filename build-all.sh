@@ -15,7 +15,7 @@ build() {
     if [ "$1" == "windows" ]; then ext=".exe"; fi
 
     echo "build for $os $arch..."
-    GOOS="$1" GOARCH="$2" go build -o "build/btcagent-$os-$arch$ext"
+    GOOS="$1" GOARCH="$2" go build -o "build/btcagent-$os-$arch$ext" ./cmd/btcagent
 }
 
 cd "$(dirname "$0")"
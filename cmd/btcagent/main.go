@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/btccom/btcagent"
+	"github.com/golang/glog"
+)
+
+func main() {
+	// 解析命令行参数
+	configFilePath := flag.String("c", "agent_conf.json", "Path of config file")
+	logDir := flag.String("l", "", "Log directory")
+	checkConfig := flag.Bool("check-config", false, "Check the config file and exit, the exit status is non-zero if the check fails")
+	checkPools := flag.Bool("check-pools", false, "With -check-config, also connect to each pool server (and authorize in single user mode)")
+	selfTest := flag.Bool("selftest", false, "Proxy a share from an in-process fake miner to an in-process fake pool and exit, the exit status is non-zero if it fails")
+	flag.Parse()
+
+	if *logDir == "" || *logDir == "stderr" {
+		flag.Lookup("logtostderr").Value.Set("true")
+	} else {
+		flag.Lookup("log_dir").Value.Set(*logDir)
+	}
+
+	// 增大文件描述符上限
+	btcagent.IncreaseFDLimit()
+
+	if *checkConfig {
+		os.Exit(runCheckConfig(*configFilePath, *checkPools))
+	}
+	if *selfTest {
+		os.Exit(runSelfTest())
+	}
+
+	// 读取配置文件
+	config := btcagent.NewConfig()
+	err := config.LoadFromFile(*configFilePath)
+	if err != nil {
+		glog.Fatal("load config failed: ", err)
+		return
+	}
+	err = config.Init()
+	if err != nil {
+		glog.Fatal(err)
+		return
+	}
+
+	// 打印加载的配置文件（用于调试）
+	if glog.V(3) {
+		configBytes, _ := json.Marshal(config.Masked())
+		glog.Info("config: ", string(configBytes))
+	}
+
+	// 代理实例
+	agent := btcagent.NewAgent(config)
+
+	// 启动 HTTP 调试服务
+	if config.HTTPDebug.Enable {
+		glog.Info("HTTP debug enabled: ", config.HTTPDebug.Listen)
+		http.Handle("/log", agent.LogLevel())
+		http.Handle("/metrics", agent.Metrics())
+		http.Handle("/healthz", agent.Liveness())
+		http.Handle("/readyz", agent.Readiness())
+		go func() {
+			err := http.ListenAndServe(config.HTTPDebug.Listen, nil)
+			if err != nil {
+				glog.Error("launch http debug service failed: ", err.Error())
+			}
+		}()
+	}
+
+	// 退出信号
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		glog.Info("exiting...")
+	}()
+
+	// 收到 SIGHUP 时重新载入TLS证书
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			agent.ReloadTLSCertificate()
+		}
+	}()
+
+	// 运行代理
+	err = agent.Run(ctx)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Flush()
+}
+
+// runCheckConfig 检查配置文件（和矿池连接），打印结果，返回进程的退出状态
+func runCheckConfig(configFilePath string, checkPools bool) int {
+	defer glog.Flush()
+
+	config := btcagent.NewConfig()
+	err := config.LoadFromFile(configFilePath)
+	if err == nil {
+		err = config.Init()
+	}
+	if err == nil && len(config.Pools) == 0 {
+		// Init 允许没有矿池，但这样的代理无法工作
+		err = fmt.Errorf("[OPTION] no pool server configured in pools")
+	}
+	if err != nil {
+		fmt.Println("config", configFilePath, "is invalid:", err)
+		return 1
+	}
+	fmt.Println("config", configFilePath, "is valid,", len(config.Pools), "pool servers")
+
+	if !checkPools {
+		return 0
+	}
+	status := 0
+	for _, result := range btcagent.CheckPools(config) {
+		fmt.Println(result)
+		if result.Err != nil {
+			status = 1
+		}
+	}
+	return status
+}
+
+// runSelfTest 运行自检，打印报告，返回进程的退出状态
+func runSelfTest() int {
+	defer glog.Flush()
+
+	report := btcagent.RunSelfTest()
+	for _, line := range report.Lines() {
+		fmt.Println(line)
+	}
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
@@ -10,6 +10,7 @@ require (
 	github.com/holiman/uint256 v1.2.0
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20211123203042-d83791d6bcd9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (